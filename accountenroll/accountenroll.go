@@ -0,0 +1,239 @@
+// Package accountenroll provides account-driven User Enrollment.
+// Devices discover the enrollment server from the domain of the user's
+// Managed Apple ID, the user authenticates with an SSO reverse proxy,
+// and the device downloads a User Enrollment (BYOD) profile for the
+// Managed Apple ID. Managed Apple ID GetToken requests are answered
+// with the identity provider access token of the authenticated user.
+package accountenroll
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/directory"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+const (
+	// ServiceTypeMAID is the GetToken service type for Managed Apple IDs.
+	ServiceTypeMAID = "com.apple.maid"
+
+	// ParamName is the MDM URL query parameter containing the session.
+	ParamName = "aue"
+
+	// DefaultTTL is the default lifetime of sessions for downloading
+	// the enrollment profile.
+	DefaultTTL = 15 * time.Minute
+)
+
+var (
+	// ErrInvalidToken is returned for unknown or expired bearer tokens.
+	ErrInvalidToken = errors.New("invalid bearer token")
+
+	// ErrNoAccessToken is returned when a Managed Apple ID token is
+	// requested for an enrollment without an access token.
+	ErrNoAccessToken = errors.New("no access token for enrollment")
+)
+
+// Session is an authenticated account-driven enrollment.
+type Session struct {
+	// User is the Managed Apple ID of the authenticated user.
+	User string `json:"user"`
+
+	// AccessToken is the identity provider access token of the user.
+	AccessToken string `json:"access_token,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store stores sessions and the sessions of enrollments.
+type Store interface {
+	StoreSession(ctx context.Context, token string, s *Session) error
+
+	// RetrieveSession retrieves the session of token.
+	// Nil is returned if the session does not exist.
+	RetrieveSession(ctx context.Context, token string) (*Session, error)
+
+	// StoreEnrollmentSession associates enrollment id with the session of token.
+	StoreEnrollmentSession(ctx context.Context, id, token string) error
+
+	// RetrieveEnrollmentSession retrieves the session token of enrollment id.
+	// An empty string is returned if id has no session.
+	RetrieveEnrollmentSession(ctx context.Context, id string) (string, error)
+}
+
+// ProfileFunc generates an enrollment profile for managedAppleID with
+// params in the MDM URLs.
+type ProfileFunc func(ctx context.Context, managedAppleID string, params url.Values) ([]byte, error)
+
+// Enroller authenticates account-driven enrollments and issues their
+// enrollment profiles. It is also a NanoMDM service that associates
+// enrollments with their sessions and answers GetToken requests.
+type Enroller struct {
+	service.CheckinAndCommandService
+
+	store    Store
+	profile  ProfileFunc
+	assigner directory.Store
+	ttl      time.Duration
+	logger   log.Logger
+	clock    clock.Clock
+}
+
+// Option configures the enroller.
+type Option func(*Enroller)
+
+// WithAssigner assigns enrollments to their user in assigner.
+func WithAssigner(assigner directory.Store) Option {
+	return func(e *Enroller) {
+		e.assigner = assigner
+	}
+}
+
+// WithTTL configures the lifetime of sessions for downloading the
+// enrollment profile.
+func WithTTL(ttl time.Duration) Option {
+	return func(e *Enroller) {
+		e.ttl = ttl
+	}
+}
+
+// WithLogger configures a logger for the enroller.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(e *Enroller) {
+		e.logger = logger
+	}
+}
+
+// WithClock configures the clock used for session expiry.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(e *Enroller) {
+		e.clock = c
+	}
+}
+
+// New creates a new enroller that generates profiles with profile.
+func New(store Store, profile ProfileFunc, opts ...Option) *Enroller {
+	if store == nil {
+		panic("nil store")
+	}
+	if profile == nil {
+		panic("nil profile func")
+	}
+	e := &Enroller{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		profile:                  profile,
+		ttl:                      DefaultTTL,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Login creates a session for the authenticated user and returns its
+// bearer token. The access token of the user is optional.
+func (e *Enroller) Login(ctx context.Context, user, accessToken string) (string, error) {
+	if user == "" {
+		return "", errors.New("empty user")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	now := e.clock.Now()
+	s := &Session{
+		User:        user,
+		AccessToken: accessToken,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(e.ttl),
+	}
+	if err := e.store.StoreSession(ctx, token, s); err != nil {
+		return "", fmt.Errorf("storing session: %w", err)
+	}
+	return token, nil
+}
+
+// Profile returns the enrollment profile for the session of token.
+func (e *Enroller) Profile(ctx context.Context, token string) ([]byte, error) {
+	s, err := e.store.RetrieveSession(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving session: %w", err)
+	}
+	if s == nil || e.clock.Now().After(s.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	return e.profile(ctx, s.User, url.Values{ParamName: {token}})
+}
+
+// TokenUpdate associates the enrollment with the session in the MDM
+// URL and assigns it to the user.
+func (e *Enroller) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	token := r.Params[ParamName]
+	if token == "" || r.ID == "" {
+		return nil
+	}
+	ctx := r.Context()
+	s, err := e.store.RetrieveSession(ctx, token)
+	if err != nil {
+		return fmt.Errorf("retrieving session: %w", err)
+	}
+	if s == nil {
+		return nil
+	}
+	if err = e.store.StoreEnrollmentSession(ctx, r.ID, token); err != nil {
+		return fmt.Errorf("storing enrollment session: %w", err)
+	}
+	if e.assigner != nil {
+		if err = e.assigner.StoreAssignment(ctx, r.ID, s.User); err != nil {
+			return fmt.Errorf("assigning enrollment: %w", err)
+		}
+	}
+	ctxlog.Logger(ctx, e.logger).Debug("msg", "associated enrollment", "id", r.ID, "user", s.User, "type", r.Type.String())
+	return nil
+}
+
+// GetToken returns the access token of the enrollment's user for
+// Managed Apple ID token requests.
+func (e *Enroller) GetToken(r *mdm.Request, msg *mdm.GetToken) (*mdm.GetTokenResponse, error) {
+	if msg.TokenServiceType != ServiceTypeMAID {
+		return nil, fmt.Errorf("unsupported token service type: %s", msg.TokenServiceType)
+	}
+	ctx := r.Context()
+	token, err := e.store.RetrieveEnrollmentSession(ctx, r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving enrollment session: %w", err)
+	}
+	var s *Session
+	if token != "" {
+		if s, err = e.store.RetrieveSession(ctx, token); err != nil {
+			return nil, fmt.Errorf("retrieving session: %w", err)
+		}
+	}
+	if s == nil || s.AccessToken == "" {
+		return nil, ErrNoAccessToken
+	}
+	ctxlog.Logger(ctx, e.logger).Debug("msg", "returning managed Apple ID token", "id", r.ID, "user", s.User)
+	return &mdm.GetTokenResponse{TokenData: []byte(s.AccessToken)}, nil
+}
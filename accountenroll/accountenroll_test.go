@@ -0,0 +1,66 @@
+package accountenroll
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+func TestAccountEnrollment(t *testing.T) {
+	var gotUser, gotToken string
+	e := New(NewKVStore(kvmap.New()), func(_ context.Context, user string, params url.Values) ([]byte, error) {
+		gotUser, gotToken = user, params.Get(ParamName)
+		return []byte("profile"), nil
+	})
+
+	enroll := EnrollHandler(e, "https://example.com/login", log.NopLogger)
+	rec := httptest.NewRecorder()
+	enroll(rec, httptest.NewRequest("GET", "/enroll/account", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "apple-as-web") {
+		t.Fatalf("expected bearer challenge, have: %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/enroll/account/login", nil)
+	req.Header.Set(DefaultUserHeader, "user@example.com")
+	req.Header.Set(DefaultAccessTokenHeader, "idp-token")
+	rec = httptest.NewRecorder()
+	LoginHandler(e, "", "", log.NopLogger)(rec, req)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := loc.Query().Get("access-token")
+	if token == "" {
+		t.Fatalf("no token in redirect: %s", loc)
+	}
+
+	req = httptest.NewRequest("GET", "/enroll/account", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	enroll(rec, req)
+	if rec.Code != http.StatusOK || gotUser != "user@example.com" || gotToken != token {
+		t.Fatalf("profile: have: %d %s %s", rec.Code, gotUser, gotToken)
+	}
+
+	r := mdm.NewRequestWithContext(context.Background(), nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ENROLLMENT"}
+	r.Params = map[string]string{ParamName: token}
+	if err = e.TokenUpdate(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := e.GetToken(r, &mdm.GetToken{TokenServiceType: ServiceTypeMAID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(resp.TokenData), "idp-token"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
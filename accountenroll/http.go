@@ -0,0 +1,120 @@
+package accountenroll
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const (
+	// DiscoveryPath is the well-known service discovery URL path.
+	DiscoveryPath = "/.well-known/com.apple.remotemanagement"
+
+	// DiscoveryVersion is the service discovery version of
+	// account-driven User Enrollment.
+	DiscoveryVersion = "mdm-byod"
+
+	// DefaultUserHeader is the default HTTP header containing the
+	// Managed Apple ID authenticated by the SSO reverse proxy.
+	DefaultUserHeader = "X-Forwarded-User"
+
+	// DefaultAccessTokenHeader is the default HTTP header containing
+	// the identity provider access token from the SSO reverse proxy.
+	DefaultAccessTokenHeader = "X-Forwarded-Access-Token"
+
+	// callbackURL is where the device expects the bearer token after
+	// authentication.
+	callbackURL = "apple-remotemanagement-user-login://authentication-results"
+)
+
+// Server is a service discovery server.
+type Server struct {
+	Version string
+	BaseURL string
+}
+
+// Discovery is the service discovery document.
+type Discovery struct {
+	Servers []Server
+}
+
+// DiscoveryHandler serves the service discovery document pointing
+// devices to the enrollment URL baseURL.
+func DiscoveryHandler(baseURL string, logger log.Logger) http.HandlerFunc {
+	d := &Discovery{Servers: []Server{{Version: DiscoveryVersion, BaseURL: baseURL}}}
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpapi.WriteJSON(w, d, ctxlog.Logger(r.Context(), logger))
+	}
+}
+
+// LoginHandler creates a session for the user authenticated by the SSO
+// reverse proxy and returns its bearer token to the device.
+// The optional access token is read from tokenHeader.
+func LoginHandler(e *Enroller, userHeader, tokenHeader string, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil enroller")
+	}
+	if userHeader == "" {
+		userHeader = DefaultUserHeader
+	}
+	if tokenHeader == "" {
+		tokenHeader = DefaultAccessTokenHeader
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		user := r.Header.Get(userHeader)
+		if user == "" {
+			logger.Info("msg", "no user in header", "header", userHeader)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		token, err := e.Login(r.Context(), user, r.Header.Get(tokenHeader))
+		if err != nil {
+			logger.Info("msg", "login", "user", user, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logger.Debug("msg", "authenticated user", "user", user)
+		http.Redirect(w, r, callbackURL+"?access-token="+url.QueryEscape(token), http.StatusFound)
+	}
+}
+
+// EnrollHandler serves the enrollment profile to devices with a bearer
+// token. Devices without one are challenged to authenticate at loginURL.
+func EnrollHandler(e *Enroller, loginURL string, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil enroller")
+	}
+	challenge := `Bearer method="apple-as-web" url="` + loginURL + `"`
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		profile, err := e.Profile(r.Context(), token)
+		if errors.Is(err, ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			logger.Info("msg", "generating profile", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logger.Debug("msg", "issued user enrollment profile")
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Write(profile)
+	}
+}
@@ -0,0 +1,69 @@
+package accountenroll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPfxSession    = "session."
+	keyPfxEnrollment = "enrollment."
+)
+
+// KVStore stores sessions in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new session store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreSession stores s for token.
+func (s *KVStore) StoreSession(ctx context.Context, token string, sess *Session) error {
+	if token == "" || sess == nil {
+		return errors.New("invalid session")
+	}
+	v, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("marshal session: %w", err)
+	}
+	return s.b.Set(ctx, keyPfxSession+token, v)
+}
+
+// RetrieveSession retrieves the session of token.
+func (s *KVStore) RetrieveSession(ctx context.Context, token string) (*Session, error) {
+	v, err := s.b.Get(ctx, keyPfxSession+token)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sess := new(Session)
+	if err = json.Unmarshal(v, sess); err != nil {
+		return nil, fmt.Errorf("unmarshal session: %w", err)
+	}
+	return sess, nil
+}
+
+// StoreEnrollmentSession associates enrollment id with the session of token.
+func (s *KVStore) StoreEnrollmentSession(ctx context.Context, id, token string) error {
+	return s.b.Set(ctx, keyPfxEnrollment+id, []byte(token))
+}
+
+// RetrieveEnrollmentSession retrieves the session token of enrollment id.
+func (s *KVStore) RetrieveEnrollmentSession(ctx context.Context, id string) (string, error) {
+	v, err := s.b.Get(ctx, keyPfxEnrollment+id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return "", nil
+	}
+	return string(v), err
+}
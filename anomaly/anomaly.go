@@ -0,0 +1,208 @@
+// Package anomaly detects sudden changes in fleet-wide MDM activity.
+// Counts of metrics (such as check-ins or command errors) are compared
+// per window against an exponentially weighted moving average baseline.
+package anomaly
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// Metrics counted by the service.
+const (
+	MetricCheckin      = "checkin"
+	MetricCommandError = "command.error"
+	MetricDMError      = "dm.error"
+)
+
+// baseline is the moving average of a metric.
+type baseline struct {
+	avg     float64
+	windows int
+}
+
+// Detector detects spikes and drops in metric counts.
+type Detector struct {
+	sink   event.Sink
+	logger log.Logger
+	clock  clock.Clock
+
+	alpha     float64
+	factor    float64
+	minCount  float64
+	warmup    int
+	metrics   []string
+	mu        sync.Mutex
+	counts    map[string]int
+	baselines map[string]*baseline
+}
+
+// Option configures a detector.
+type Option func(*Detector)
+
+// WithLogger configures the detector logger.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(d *Detector) {
+		d.logger = logger
+	}
+}
+
+// WithClock configures the clock used for windows.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(d *Detector) {
+		d.clock = c
+	}
+}
+
+// WithFactor sets how many times above (spike) or below (drop) the
+// baseline a window count must be to be anomalous. Default is 3.
+func WithFactor(factor float64) Option {
+	return func(d *Detector) {
+		d.factor = factor
+	}
+}
+
+// WithMinCount sets the minimum of the larger of the window count and
+// baseline for an anomaly. This avoids alerts on tiny fleets or quiet
+// periods. Default is 10.
+func WithMinCount(n int) Option {
+	return func(d *Detector) {
+		d.minCount = float64(n)
+	}
+}
+
+// WithWarmup sets the number of windows used to establish a baseline
+// before any anomalies are detected. Default is 3.
+func WithWarmup(n int) Option {
+	return func(d *Detector) {
+		d.warmup = n
+	}
+}
+
+// New creates a new detector that sends anomaly events to sink.
+// Metrics that are not incremented in a window count as zero.
+func New(sink event.Sink, opts ...Option) *Detector {
+	if sink == nil {
+		panic("nil sink")
+	}
+	d := &Detector{
+		sink:      sink,
+		logger:    log.NopLogger,
+		clock:     clock.Real,
+		alpha:     0.3,
+		factor:    3,
+		minCount:  10,
+		warmup:    3,
+		metrics:   []string{MetricCheckin, MetricCommandError, MetricDMError},
+		counts:    make(map[string]int),
+		baselines: make(map[string]*baseline),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Inc increments metric in the current window.
+func (d *Detector) Inc(metric string) {
+	d.mu.Lock()
+	d.counts[metric]++
+	d.mu.Unlock()
+}
+
+// Window closes the current window, compares its counts to the
+// baselines, and sends events for any anomalies.
+// Returns the anomaly events sent.
+func (d *Detector) Window(ctx context.Context) []*event.Event {
+	d.mu.Lock()
+	counts := d.counts
+	d.counts = make(map[string]int)
+	var events []*event.Event
+	for _, metric := range d.metrics {
+		if e := d.compare(metric, float64(counts[metric])); e != nil {
+			events = append(events, e)
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Fields["metric"] < events[j].Fields["metric"] })
+	for _, e := range events {
+		d.logger.Info(
+			"msg", "anomaly detected",
+			"type", e.Type,
+			"metric", e.Fields["metric"],
+			"count", e.Fields["count"],
+			"baseline", e.Fields["baseline"],
+		)
+		if err := d.sink.Send(ctx, e); err != nil {
+			d.logger.Info("msg", "sending event", "type", e.Type, "err", err)
+		}
+	}
+	return events
+}
+
+// compare compares count to the baseline of metric and updates it.
+// Returns an event if count is anomalous.
+// Anomalous counts are not included in the baseline so that a
+// prolonged outage keeps alerting.
+func (d *Detector) compare(metric string, count float64) *event.Event {
+	b, ok := d.baselines[metric]
+	if !ok {
+		b = &baseline{avg: count}
+		d.baselines[metric] = b
+	}
+
+	var eventType string
+	if b.windows >= d.warmup && (count >= d.minCount || b.avg >= d.minCount) {
+		if count > b.avg*d.factor {
+			eventType = event.TypeAnomalySpike
+		} else if count*d.factor < b.avg {
+			eventType = event.TypeAnomalyDrop
+		}
+	}
+	if eventType == "" {
+		b.avg = d.alpha*count + (1-d.alpha)*b.avg
+		b.windows++
+		return nil
+	}
+
+	e := event.New(d.clock, eventType, "")
+	e.Timestamp = d.clock.Now()
+	e.Fields["metric"] = metric
+	e.Fields["count"] = strconv.FormatFloat(count, 'f', -1, 64)
+	e.Fields["baseline"] = strconv.FormatFloat(b.avg, 'f', 1, 64)
+	return e
+}
+
+// Run closes a window every interval until ctx is done.
+func (d *Detector) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := d.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+
+		d.Window(ctx)
+	}
+}
@@ -0,0 +1,42 @@
+package anomaly
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/event"
+)
+
+func TestDetector(t *testing.T) {
+	ctx := context.Background()
+	d := New(event.SinkFunc(func(context.Context, *event.Event) error { return nil }))
+
+	window := func(checkins int) []*event.Event {
+		for i := 0; i < checkins; i++ {
+			d.Inc(MetricCheckin)
+		}
+		return d.Window(ctx)
+	}
+
+	// establish a baseline
+	for i := 0; i < 5; i++ {
+		if events := window(100); len(events) != 0 {
+			t.Fatalf("window %d: unexpected events: %v", i, events)
+		}
+	}
+
+	events := window(1000)
+	if len(events) != 1 || events[0].Type != event.TypeAnomalySpike || events[0].Fields["metric"] != MetricCheckin {
+		t.Fatalf("expected check-in spike, got: %v", events)
+	}
+
+	// the spike is not part of the baseline
+	events = window(5)
+	if len(events) != 1 || events[0].Type != event.TypeAnomalyDrop {
+		t.Fatalf("expected check-in drop, got: %v", events)
+	}
+
+	if events = window(110); len(events) != 0 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
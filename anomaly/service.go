@@ -0,0 +1,112 @@
+package anomaly
+
+import (
+	"encoding/json"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Service is a NanoMDM service that counts metrics for a detector.
+type Service struct {
+	service.CheckinAndCommandService
+	d *Detector
+}
+
+// NewService creates a new service that counts metrics in d.
+func NewService(d *Detector) *Service {
+	if d == nil {
+		panic("nil detector")
+	}
+	return &Service{CheckinAndCommandService: new(service.NopService), d: d}
+}
+
+// Authenticate counts a check-in.
+func (s *Service) Authenticate(*mdm.Request, *mdm.Authenticate) error {
+	s.d.Inc(MetricCheckin)
+	return nil
+}
+
+// TokenUpdate counts a check-in.
+func (s *Service) TokenUpdate(*mdm.Request, *mdm.TokenUpdate) error {
+	s.d.Inc(MetricCheckin)
+	return nil
+}
+
+// CheckOut counts a check-in.
+func (s *Service) CheckOut(*mdm.Request, *mdm.CheckOut) error {
+	s.d.Inc(MetricCheckin)
+	return nil
+}
+
+// SetBootstrapToken counts a check-in.
+func (s *Service) SetBootstrapToken(*mdm.Request, *mdm.SetBootstrapToken) error {
+	s.d.Inc(MetricCheckin)
+	return nil
+}
+
+// GetBootstrapToken counts a check-in.
+func (s *Service) GetBootstrapToken(*mdm.Request, *mdm.GetBootstrapToken) (*mdm.BootstrapToken, error) {
+	s.d.Inc(MetricCheckin)
+	return nil, nil
+}
+
+// UserAuthenticate counts a check-in.
+func (s *Service) UserAuthenticate(*mdm.Request, *mdm.UserAuthenticate) ([]byte, error) {
+	s.d.Inc(MetricCheckin)
+	return nil, nil
+}
+
+// GetToken counts a check-in.
+func (s *Service) GetToken(*mdm.Request, *mdm.GetToken) (*mdm.GetTokenResponse, error) {
+	s.d.Inc(MetricCheckin)
+	return nil, nil
+}
+
+// statusReport is the subset of a DM status report used to find errors.
+type statusReport struct {
+	StatusItems struct {
+		Management struct {
+			Declarations map[string][]struct {
+				Valid string `json:"valid"`
+			} `json:"declarations"`
+		} `json:"management"`
+	}
+	Errors []json.RawMessage
+}
+
+// hasErrors reports whether the status report has errors or invalid declarations.
+func (r *statusReport) hasErrors() bool {
+	if len(r.Errors) > 0 {
+		return true
+	}
+	for _, declarations := range r.StatusItems.Management.Declarations {
+		for _, d := range declarations {
+			if d.Valid == "invalid" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeclarativeManagement counts a check-in and any DM status report errors.
+func (s *Service) DeclarativeManagement(_ *mdm.Request, m *mdm.DeclarativeManagement) ([]byte, error) {
+	s.d.Inc(MetricCheckin)
+	if m.Endpoint != "status" {
+		return nil, nil
+	}
+	report := new(statusReport)
+	if err := json.Unmarshal(m.Data, report); err == nil && report.hasErrors() {
+		s.d.Inc(MetricDMError)
+	}
+	return nil, nil
+}
+
+// CommandAndReportResults counts command errors.
+func (s *Service) CommandAndReportResults(_ *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results.Status == "Error" || results.Status == "CommandFormatError" {
+		s.d.Inc(MetricCommandError)
+	}
+	return nil, nil
+}
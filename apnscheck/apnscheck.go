@@ -0,0 +1,347 @@
+// Package apnscheck verifies APNs connectivity and credentials without
+// sending pushes to devices.
+//
+// A push is sent to an invalid (all zero) device token. APNs rejects
+// it with the BadDeviceToken reason only after it accepted the
+// connection and credentials. Other responses, such as 403 Forbidden
+// for revoked certificates or invalid provider tokens, and connection
+// errors are failures.
+package apnscheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/apnstoken"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/pushcert"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultExpiryWarning is the default time before push certificates
+// expire that they are reported as expiring.
+const DefaultExpiryWarning = 14 * 24 * time.Hour
+
+// invalidToken is the device token of check pushes.
+var invalidToken = strings.Repeat("0", 64)
+
+// ErrNotChecked is returned for health before the first check.
+var ErrNotChecked = errors.New("APNs not checked yet")
+
+// Methods of APNs authentication.
+const (
+	MethodCertificate = "certificate"
+	MethodToken       = "token"
+)
+
+// Result is the check result of an APNs topic.
+type Result struct {
+	Topic  string `json:"topic,omitempty"`
+	Method string `json:"method"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+
+	// APNsStatus and APNsReason are the APNs response, if any.
+	APNsStatus int    `json:"apns_status,omitempty"`
+	APNsReason string `json:"apns_reason,omitempty"`
+
+	// NotAfter is the expiry of the push certificate.
+	NotAfter *time.Time `json:"not_after,omitempty"`
+
+	// Expiring is true if the push certificate expires soon.
+	Expiring bool `json:"expiring,omitempty"`
+}
+
+// Status is the result of a check of all topics.
+type Status struct {
+	CheckedAt time.Time `json:"checked_at"`
+	OK        bool      `json:"ok"`
+	Results   []*Result `json:"results"`
+}
+
+// CertRetriever retrieves stored push certificates.
+type CertRetriever interface {
+	RetrievePushCert(ctx context.Context, topic string) (cert *tls.Certificate, staleToken string, err error)
+}
+
+// Checker checks APNs connectivity and credentials.
+type Checker struct {
+	certs  CertRetriever
+	signer *apnstoken.Signer
+	topics func() []string
+	client *http.Client
+	url    string
+	expiry time.Duration
+	logger log.Logger
+	clock  clock.Clock
+
+	mu     sync.RWMutex
+	status *Status
+}
+
+// Option configures the checker.
+type Option func(*Checker)
+
+// WithCertificates checks the push certificates of topics in store.
+func WithCertificates(store CertRetriever) Option {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(c *Checker) {
+		c.certs = store
+	}
+}
+
+// WithToken checks provider token authentication with signer.
+func WithToken(signer *apnstoken.Signer) Option {
+	if signer == nil {
+		panic("nil signer")
+	}
+	return func(c *Checker) {
+		c.signer = signer
+	}
+}
+
+// WithTopics configures fn to supply the topics to check.
+func WithTopics(fn func() []string) Option {
+	return func(c *Checker) {
+		c.topics = fn
+	}
+}
+
+// WithClient configures the HTTP client of token authentication checks.
+// The client must support HTTP/2.
+func WithClient(client *http.Client) Option {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(c *Checker) {
+		c.client = client
+	}
+}
+
+// WithURL configures the APNs server URL.
+func WithURL(url string) Option {
+	return func(c *Checker) {
+		c.url = url
+	}
+}
+
+// WithExpiryWarning configures the time before push certificates
+// expire that they are reported as expiring.
+func WithExpiryWarning(d time.Duration) Option {
+	return func(c *Checker) {
+		c.expiry = d
+	}
+}
+
+// WithLogger configures a logger for the checker.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(c *Checker) {
+		c.logger = logger
+	}
+}
+
+// WithClock configures the clock of the checker.
+func WithClock(clk clock.Clock) Option {
+	if clk == nil {
+		panic("nil clock")
+	}
+	return func(c *Checker) {
+		c.clock = clk
+	}
+}
+
+// New creates a new APNs checker.
+func New(opts ...Option) *Checker {
+	c := &Checker{
+		client: http.DefaultClient,
+		url:    apnstoken.ProductionURL,
+		expiry: DefaultExpiryWarning,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// send sends a check push for topic and returns the APNs response.
+// APNs responding with BadDeviceToken is not an error.
+func (c *Checker) send(ctx context.Context, client *http.Client, topic, token string, r *Result) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/3/device/"+invalidToken, bytes.NewReader([]byte(`{"mdm":"preflight"}`)))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("authorization", "bearer "+token)
+	}
+	if topic != "" {
+		req.Header.Set("apns-topic", topic)
+	}
+	req.Header.Set("apns-push-type", "mdm")
+	req.Header.Set("content-type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to APNs: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	json.Unmarshal(bodyBytes, &body)
+	r.APNsStatus = resp.StatusCode
+	r.APNsReason = body.Reason
+	switch {
+	case resp.StatusCode == http.StatusBadRequest && body.Reason == "BadDeviceToken":
+		return nil
+	case topic == "" && resp.StatusCode == http.StatusBadRequest && body.Reason == "MissingTopic":
+		// reachable, but no topic to verify credentials with
+		return nil
+	}
+	return fmt.Errorf("APNs status %d: %s", resp.StatusCode, body.Reason)
+}
+
+// checkCert checks the push certificate of topic.
+func (c *Checker) checkCert(ctx context.Context, topic string) *Result {
+	r := &Result{Topic: topic, Method: MethodCertificate}
+	cert, _, err := c.certs.RetrievePushCert(ctx, topic)
+	if err != nil {
+		r.Error = fmt.Sprintf("retrieving push certificate: %v", err)
+		return r
+	}
+	info, err := pushcert.InfoFromCert(cert)
+	if err != nil {
+		r.Error = fmt.Sprintf("parsing push certificate: %v", err)
+		return r
+	}
+	r.NotAfter = &info.NotAfter
+	now := c.clock.Now()
+	if now.After(info.NotAfter) {
+		r.Error = "push certificate expired"
+		return r
+	}
+	r.Expiring = info.NotAfter.Sub(now) < c.expiry
+	client := &http.Client{
+		Timeout: c.client.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{Certificates: []tls.Certificate{*cert}},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	defer client.CloseIdleConnections()
+	if err = c.send(ctx, client, topic, "", r); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.OK = true
+	return r
+}
+
+// checkToken checks provider token authentication for topic.
+func (c *Checker) checkToken(ctx context.Context, topic string) *Result {
+	r := &Result{Topic: topic, Method: MethodToken}
+	token, err := c.signer.Token()
+	if err != nil {
+		r.Error = fmt.Sprintf("signing provider token: %v", err)
+		return r
+	}
+	if err = c.send(ctx, c.client, topic, token, r); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.OK = true
+	return r
+}
+
+// Check checks APNs for every topic and stores the status.
+// With token authentication and no topics only connectivity is checked.
+func (c *Checker) Check(ctx context.Context) *Status {
+	var topics []string
+	if c.topics != nil {
+		topics = c.topics()
+	}
+	status := &Status{CheckedAt: c.clock.Now(), OK: true, Results: []*Result{}}
+	if c.signer != nil && len(topics) < 1 {
+		status.Results = append(status.Results, c.checkToken(ctx, ""))
+	}
+	for _, topic := range topics {
+		if c.signer != nil {
+			status.Results = append(status.Results, c.checkToken(ctx, topic))
+		} else if c.certs != nil {
+			status.Results = append(status.Results, c.checkCert(ctx, topic))
+		}
+	}
+	for _, r := range status.Results {
+		if !r.OK {
+			status.OK = false
+			c.logger.Info("msg", "APNs check failed", "topic", r.Topic, "method", r.Method, "err", r.Error)
+		} else if r.Expiring {
+			c.logger.Info("msg", "push certificate expiring", "topic", r.Topic, "not_after", r.NotAfter)
+		}
+	}
+	c.logger.Debug("msg", "checked APNs", "ok", status.OK, "results", len(status.Results))
+
+	c.mu.Lock()
+	c.status = status
+	c.mu.Unlock()
+	return status
+}
+
+// Status returns the status of the last check.
+// Nil is returned before the first check.
+func (c *Checker) Status() *Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// CheckHealth reports the status of the last check.
+// It does not run a check.
+func (c *Checker) CheckHealth(_ context.Context) error {
+	status := c.Status()
+	if status == nil {
+		return ErrNotChecked
+	}
+	for _, r := range status.Results {
+		if !r.OK {
+			if r.Topic != "" {
+				return fmt.Errorf("topic %s: %s", r.Topic, r.Error)
+			}
+			return errors.New(r.Error)
+		}
+	}
+	return nil
+}
+
+// Run checks APNs every interval until ctx is done.
+func (c *Checker) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			c.Check(ctx)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package apnscheck
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanohub/apnstoken"
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+type staticKey struct {
+	key *apnstoken.Key
+}
+
+func (k *staticKey) Key() (*apnstoken.Key, bool, error) {
+	return k.key, false, nil
+}
+
+func TestCheckToken(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := apnstoken.NewSigner(&staticKey{&apnstoken.Key{ID: "KEY", PrivateKey: privKey}}, "TEAM", log.NopLogger, clock.Real)
+
+	forbidden := map[string]bool{"com.example.revoked": true}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("authorization"), "bearer ") {
+			t.Error("missing provider token")
+		}
+		if forbidden[r.Header.Get("apns-topic")] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	topics := []string{"com.example.ok"}
+	c := New(
+		WithToken(signer),
+		WithTopics(func() []string { return topics }),
+		WithClient(srv.Client()),
+		WithURL(srv.URL),
+	)
+	if err = c.CheckHealth(ctx); !errors.Is(err, ErrNotChecked) {
+		t.Errorf("health before check: have: %v, want: %v", err, ErrNotChecked)
+	}
+
+	status := c.Check(ctx)
+	if !status.OK || len(status.Results) != 1 {
+		t.Fatalf("status: %+v", status)
+	}
+	if have, want := status.Results[0].APNsReason, "BadDeviceToken"; have != want {
+		t.Errorf("reason: have: %v, want: %v", have, want)
+	}
+	if err = c.CheckHealth(ctx); err != nil {
+		t.Error(err)
+	}
+
+	topics = append(topics, "com.example.revoked")
+	status = c.Check(ctx)
+	if status.OK || status.Results[1].APNsStatus != http.StatusForbidden {
+		t.Errorf("status: %+v", status.Results[1])
+	}
+	if err = c.CheckHealth(ctx); err == nil {
+		t.Error("expected unhealthy")
+	}
+
+	// unreachable server
+	srv.Close()
+	status = c.Check(ctx)
+	if status.OK {
+		t.Error("expected connectivity failure")
+	}
+}
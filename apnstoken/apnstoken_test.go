@@ -0,0 +1,165 @@
+package apnstoken
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type staticKey struct {
+	key     *Key
+	changed bool
+}
+
+func (k *staticKey) Key() (*Key, bool, error) {
+	changed := k.changed
+	k.changed = false
+	return k.key, changed, nil
+}
+
+func newKey(t *testing.T, id string) *Key {
+	t.Helper()
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: id, PrivateKey: privKey}
+}
+
+func verify(t *testing.T, token string, pub *ecdsa.PublicKey) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("invalid token: %s", token)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		t.Fatal("invalid signature")
+	}
+	claimBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(claimBytes, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestSigner(t *testing.T) {
+	keys := &staticKey{key: newKey(t, "KEY1"), changed: true}
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	s := NewSigner(keys, "TEAM1", nil, c)
+
+	token1, err := s.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := verify(t, token1, &keys.key.PrivateKey.PublicKey)
+	if have, want := claims["iss"], "TEAM1"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// token is cached
+	c.Advance(10 * time.Minute)
+	if token2, _ := s.Token(); token2 != token1 {
+		t.Error("expected cached token")
+	}
+
+	// token is refreshed after its lifetime
+	c.Advance(DefaultTokenLifetime)
+	token3, _ := s.Token()
+	if token3 == token1 {
+		t.Error("expected refreshed token")
+	}
+
+	// token is refreshed when the key is rotated
+	keys.key, keys.changed = newKey(t, "KEY2"), true
+	token4, _ := s.Token()
+	if token4 == token3 {
+		t.Error("expected new token for rotated key")
+	}
+	verify(t, token4, &keys.key.PrivateKey.PublicKey)
+}
+
+func TestKeyIDFromPath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		id   string
+	}{
+		{"/keys/AuthKey_ABC123DEFG.p8", "ABC123DEFG"},
+		{"AuthKey_XYZ.p8", "XYZ"},
+		{"/keys/key.p8", ""},
+	} {
+		if have, want := KeyIDFromPath(test.path), test.id; have != want {
+			t.Errorf("%s: have: %v, want: %v", test.path, have, want)
+		}
+	}
+}
+
+type pushStore map[string]*mdm.Push
+
+func (s pushStore) RetrievePushInfo(_ context.Context, ids []string) (map[string]*mdm.Push, error) {
+	ret := make(map[string]*mdm.Push)
+	for _, id := range ids {
+		if p, ok := s[id]; ok {
+			ret[id] = p
+		}
+	}
+	return ret, nil
+}
+
+func TestPush(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("authorization"), "bearer ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/3/device/0102" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+			return
+		}
+		w.Header().Set("apns-id", "APNS1")
+	}))
+	defer srv.Close()
+
+	store := pushStore{
+		"ID1": {PushMagic: "MAGIC1", Token: []byte{1, 2}, Topic: "com.example.mdm"},
+		"ID2": {PushMagic: "MAGIC2", Token: []byte{3, 4}, Topic: "com.example.mdm"},
+	}
+	keys := &staticKey{key: newKey(t, "KEY1"), changed: true}
+	p := New(store, keys, "TEAM1", WithURL(srv.URL), WithClient(srv.Client()))
+
+	resp, err := p.Push(context.Background(), []string{"ID1", "ID2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := resp["ID1"]; r == nil || r.Err != nil || r.Id != "APNS1" {
+		t.Errorf("unexpected response for ID1: %v", r)
+	}
+	if r := resp["ID2"]; r == nil || r.Err == nil || !strings.Contains(r.Err.Error(), "BadDeviceToken") {
+		t.Errorf("expected error for ID2: %v", r)
+	}
+}
@@ -0,0 +1,123 @@
+// Package apnstoken sends APNs MDM push notifications using
+// provider token (.p8 signing key) authentication.
+package apnstoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoKeyID is returned when a key ID is neither configured nor
+// found in the key file name.
+var ErrNoKeyID = errors.New("no APNs key ID")
+
+// ParseKey parses a PEM-encoded PKCS #8 ECDSA private key as
+// downloaded from Apple in a .p8 file.
+func ParseKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing PKCS #8 key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// KeyIDFromPath extracts the key ID from a file name in the form
+// Apple uses for downloaded keys: "AuthKey_<KeyID>.p8".
+func KeyIDFromPath(path string) string {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "AuthKey_") || !strings.HasSuffix(name, ".p8") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "AuthKey_"), ".p8")
+}
+
+// Key is an APNs provider token signing key.
+type Key struct {
+	ID         string
+	PrivateKey *ecdsa.PrivateKey
+}
+
+// FileKey loads a signing key from a file and reloads it when it changes.
+// If no key ID is configured then the key ID is taken from the name of
+// the file (resolving any symlinks). This allows rotating keys without
+// a restart by pointing a symlink at a newly downloaded key file.
+type FileKey struct {
+	path  string
+	keyID string
+
+	mu       sync.Mutex
+	key      *Key
+	resolved string
+	modTime  time.Time
+}
+
+// NewFileKey creates a new file key and loads the key from path.
+// If keyID is empty it is taken from the key file name.
+func NewFileKey(path, keyID string) (*FileKey, error) {
+	f := &FileKey{path: path, keyID: keyID}
+	if _, _, err := f.Key(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Key returns the current signing key.
+// The key is reloaded if the file (or its symlink target) has changed.
+// The changed return value reports whether the key was (re)loaded.
+func (f *FileKey) Key() (key *Key, changed bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resolved, err := filepath.EvalSymlinks(f.path)
+	if err != nil {
+		if f.key != nil {
+			// keep using the key we have
+			return f.key, false, nil
+		}
+		return nil, false, err
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		if f.key != nil {
+			return f.key, false, nil
+		}
+		return nil, false, err
+	}
+	if f.key != nil && resolved == f.resolved && fi.ModTime().Equal(f.modTime) {
+		return f.key, false, nil
+	}
+	pemBytes, err := os.ReadFile(resolved)
+	if err != nil {
+		return nil, false, err
+	}
+	privKey, err := ParseKey(pemBytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading key %s: %w", resolved, err)
+	}
+	keyID := f.keyID
+	if keyID == "" {
+		keyID = KeyIDFromPath(resolved)
+	}
+	if keyID == "" {
+		return nil, false, fmt.Errorf("%w: %s", ErrNoKeyID, resolved)
+	}
+	f.key = &Key{ID: keyID, PrivateKey: privKey}
+	f.resolved = resolved
+	f.modTime = fi.ModTime()
+	return f.key, true, nil
+}
@@ -0,0 +1,249 @@
+package apnstoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/pushpayload"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+const (
+	// ProductionURL is the APNs production server.
+	ProductionURL = "https://api.push.apple.com"
+
+	// DevelopmentURL is the APNs development server.
+	DevelopmentURL = "https://api.sandbox.push.apple.com"
+)
+
+// DefaultWorkers is the default number of concurrent push requests.
+const DefaultWorkers = 5
+
+// Pusher sends MDM push notifications to enrollments using
+// provider token authentication.
+type Pusher struct {
+	store   storage.PushStore
+	signer  *Signer
+	client  *http.Client
+	url     string
+	workers int
+	payload pushpayload.Customizer
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the pusher.
+type Option func(*Pusher)
+
+// WithLogger configures a logger for the pusher.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(p *Pusher) {
+		p.logger = logger
+	}
+}
+
+// WithClock configures the clock used to issue tokens.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(p *Pusher) {
+		p.clock = c
+	}
+}
+
+// WithClient configures the HTTP client used to talk to APNs.
+// The client must support HTTP/2.
+func WithClient(client *http.Client) Option {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(p *Pusher) {
+		p.client = client
+	}
+}
+
+// WithURL configures the APNs server URL.
+func WithURL(url string) Option {
+	return func(p *Pusher) {
+		p.url = url
+	}
+}
+
+// WithWorkers configures the number of concurrent push requests.
+func WithWorkers(n int) Option {
+	return func(p *Pusher) {
+		if n > 0 {
+			p.workers = n
+		}
+	}
+}
+
+// WithPayload customizes push payloads with c.
+func WithPayload(c pushpayload.Customizer) Option {
+	return func(p *Pusher) {
+		p.payload = c
+	}
+}
+
+// New creates a new token-authenticated pusher.
+// Push info for enrollments is retrieved from store.
+func New(store storage.PushStore, keys KeySource, teamID string, opts ...Option) *Pusher {
+	p := &Pusher{
+		store:   store,
+		client:  http.DefaultClient,
+		url:     ProductionURL,
+		workers: DefaultWorkers,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.signer = NewSigner(keys, teamID, p.logger, p.clock)
+	return p
+}
+
+// Signer returns the provider token signer of the pusher.
+func (p *Pusher) Signer() *Signer {
+	return p.signer
+}
+
+// Push sends MDM push notifications to the enrollment ids.
+func (p *Pusher) Push(ctx context.Context, ids []string) (map[string]*push.Response, error) {
+	infos, err := p.store.RetrievePushInfo(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving push info: %w", err)
+	}
+
+	ch := make(chan string)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		resp = make(map[string]*push.Response)
+	)
+	workers := p.workers
+	if len(infos) < workers {
+		workers = len(infos)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ch {
+				r := p.push(ctx, infos[id])
+				mu.Lock()
+				resp[id] = r
+				mu.Unlock()
+			}
+		}()
+	}
+	for id := range infos {
+		ch <- id
+	}
+	close(ch)
+	wg.Wait()
+
+	return resp, nil
+}
+
+// apnsError is the JSON error body of an APNs response.
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+// Error is an APNs error response.
+type Error struct {
+	Status int
+	Reason string
+}
+
+// Error returns the status and reason of the APNs error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("APNs status %d: %s", e.Status, e.Reason)
+}
+
+// Temporary reports whether the push may succeed if retried.
+func (e *Error) Temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// push sends a single push notification.
+func (p *Pusher) push(ctx context.Context, info *mdm.Push) *push.Response {
+	if info == nil {
+		return &push.Response{Err: errors.New("no push info")}
+	}
+	id, err := p.send(ctx, info)
+	var apnsErr *Error
+	if errors.As(err, &apnsErr) && apnsErr.Reason == "ExpiredProviderToken" {
+		// retry once with a newly issued token
+		p.signer.Invalidate()
+		id, err = p.send(ctx, info)
+	}
+	if err != nil {
+		ctxlog.Logger(ctx, p.logger).Debug(
+			"msg", "push failed",
+			"topic", info.Topic,
+			"err", err,
+		)
+	}
+	return &push.Response{Id: id, Err: err}
+}
+
+// send makes a single push request to APNs.
+// APNs error responses are returned as an *Error.
+func (p *Pusher) send(ctx context.Context, info *mdm.Push) (string, error) {
+	token, err := p.signer.Token()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]string{"mdm": info.PushMagic})
+	if err != nil {
+		return "", err
+	}
+	if p.payload != nil {
+		if payload, err = pushpayload.Apply(ctx, p.payload, payload); err != nil {
+			return "", err
+		}
+	}
+	url := p.url + "/3/device/" + hex.EncodeToString(info.Token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", info.Topic)
+	req.Header.Set("apns-push-type", "mdm")
+	req.Header.Set("content-type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	id := resp.Header.Get("apns-id")
+	if resp.StatusCode == http.StatusOK {
+		return id, nil
+	}
+	var body apnsError
+	bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err = json.Unmarshal(bodyBytes, &body); err != nil || body.Reason == "" {
+		body.Reason = string(bodyBytes)
+	}
+	return id, &Error{Status: resp.StatusCode, Reason: body.Reason}
+}
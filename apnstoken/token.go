@@ -0,0 +1,132 @@
+package apnstoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultTokenLifetime is how long a provider token is used before
+// generating a new one. APNs rejects tokens older than one hour and
+// throttles tokens refreshed more often than every 20 minutes.
+const DefaultTokenLifetime = 50 * time.Minute
+
+// KeySource provides the current signing key.
+type KeySource interface {
+	Key() (key *Key, changed bool, err error)
+}
+
+// Signer creates and caches APNs provider authentication tokens.
+type Signer struct {
+	keys     KeySource
+	teamID   string
+	logger   log.Logger
+	clock    clock.Clock
+	lifetime time.Duration
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// NewSigner creates a new signer for teamID.
+func NewSigner(keys KeySource, teamID string, logger log.Logger, c clock.Clock) *Signer {
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	if c == nil {
+		c = clock.Real
+	}
+	return &Signer{
+		keys:     keys,
+		teamID:   teamID,
+		logger:   logger,
+		clock:    c,
+		lifetime: DefaultTokenLifetime,
+	}
+}
+
+// Token returns a provider authentication token.
+// A cached token is returned unless it is older than the token lifetime
+// or the signing key has changed.
+func (s *Signer) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	key, changed, err := s.keys.Key()
+	if err != nil {
+		if s.token != "" && now.Sub(s.issuedAt) < s.lifetime {
+			// keep using the current token until it expires
+			s.logger.Info("msg", "reloading key", "err", err)
+			return s.token, nil
+		}
+		return "", fmt.Errorf("loading key: %w", err)
+	}
+	if !changed && s.token != "" && now.Sub(s.issuedAt) < s.lifetime {
+		return s.token, nil
+	}
+	if changed && s.token != "" {
+		s.logger.Info("msg", "signing key changed", "key_id", key.ID)
+	}
+	token, err := sign(key, s.teamID, now)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.issuedAt = now
+	return token, nil
+}
+
+// Invalidate discards the cached token.
+// A new token is generated on the next call to Token.
+func (s *Signer) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// sign creates an ES256 JSON Web Token for APNs.
+func sign(key *Key, teamID string, iat time.Time) (string, error) {
+	if key == nil || key.PrivateKey == nil {
+		return "", errors.New("nil key")
+	}
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": teamID, "iat": iat.Unix()})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sig, err := signES256(key.PrivateKey, []byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// signES256 signs data and returns the fixed-size JWS signature (R || S).
+func signES256(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return sig, nil
+}
@@ -0,0 +1,465 @@
+// Package appinstall implements an app installation workflow.
+// Installations are confirmed by polling the installed application list
+// of enrollments and the per-enrollment app state is recorded in inventory.
+package appinstall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/logkeys"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const WorkflowName = "io.micromdm.nanohub.wf.appinstall.v1"
+
+// App states recorded in inventory.
+const (
+	StateInstalling = "installing"
+	StateInstalled  = "installed"
+	StateFailed     = "failed"
+	StateTimedOut   = "timed_out"
+)
+
+const (
+	// DefaultPollInterval is the default interval between polls of
+	// the installed application list.
+	DefaultPollInterval = time.Minute
+
+	// DefaultPolls is the default number of polls of the installed
+	// application list before giving up.
+	DefaultPolls = 30
+)
+
+const (
+	stepNameInstall = "install"
+	stepNamePoll    = "poll"
+)
+
+// installStateManaged is the InstallApplication response state of an
+// app that is already installed and managed. Such apps aren't polled.
+const installStateManaged = "Managed"
+
+// Installed application list statuses of the polled app.
+const (
+	statusNotInstalled = "NotInstalled"
+	statusInstalling   = "Installing"
+	statusInstalled    = "Installed"
+	statusFailed       = "DownloadFailed"
+	statusCancelled    = "DownloadCancelled"
+)
+
+// appStatus returns the status of app identifier in the installed
+// application list items.
+func appStatus(items []mdmcommands.InstalledApplicationListItem, identifier string) string {
+	for _, item := range items {
+		if item.Identifier == nil || *item.Identifier != identifier {
+			continue
+		}
+		switch {
+		case item.DownloadFailed != nil && *item.DownloadFailed:
+			return statusFailed
+		case item.DownloadCancelled != nil && *item.DownloadCancelled:
+			return statusCancelled
+		case item.Installing != nil && *item.Installing:
+			return statusInstalling
+		case item.DownloadWaiting != nil && *item.DownloadWaiting:
+			return statusInstalling
+		case item.DownloadPaused != nil && *item.DownloadPaused:
+			return statusInstalling
+		}
+		return statusInstalled
+	}
+	return statusNotInstalled
+}
+
+// ErrNoIdentifier is returned when an app has no bundle identifier.
+var ErrNoIdentifier = errors.New("no app identifier")
+
+// StateKey returns the inventory key of the state of app identifier.
+func StateKey(identifier string) string {
+	return WorkflowName + "." + identifier + ".state"
+}
+
+// StatusKey returns the inventory key of the last managed application
+// list status (or command status) of app identifier.
+func StatusKey(identifier string) string {
+	return WorkflowName + "." + identifier + ".status"
+}
+
+// UpdatedKey returns the inventory key of the time the state of app
+// identifier was last updated.
+func UpdatedKey(identifier string) string {
+	return WorkflowName + "." + identifier + ".updated_at"
+}
+
+// App is the app to install. It is the workflow context in JSON.
+type App struct {
+	// Identifier is the bundle identifier of the app. It is used to
+	// confirm the installation and, if neither ITunesStoreID nor
+	// ManifestURL are set, to install the app from the App Store.
+	Identifier string `json:"identifier"`
+
+	ITunesStoreID *int `json:"itunes_store_id,omitempty"`
+
+	// ManifestURL is the URL of the manifest of an enterprise app.
+	ManifestURL string `json:"manifest_url,omitempty"`
+
+	// Enterprise installs the ManifestURL package with an
+	// InstallEnterpriseApplication command (macOS only).
+	// These are not in the managed application list and are
+	// confirmed by the command response.
+	Enterprise bool `json:"enterprise,omitempty"`
+
+	ManagementFlags *int `json:"management_flags,omitempty"`
+}
+
+// Validate checks a for errors.
+func (a *App) Validate() error {
+	if a == nil || a.Identifier == "" {
+		return ErrNoIdentifier
+	}
+	if a.Enterprise && a.ManifestURL == "" {
+		return errors.New("enterprise app without manifest URL")
+	}
+	return nil
+}
+
+// MarshalBinary marshals a as the workflow context.
+func (a *App) MarshalBinary() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// UnmarshalBinary unmarshals the workflow context into a.
+func (a *App) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, a)
+}
+
+// pollContext is the context of poll steps.
+type pollContext struct {
+	Identifier string `json:"identifier"`
+	Remaining  int    `json:"remaining"`
+}
+
+// MarshalBinary marshals c as the step context.
+func (c *pollContext) MarshalBinary() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// UnmarshalBinary unmarshals the step context into c.
+func (c *pollContext) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Workflow installs apps.
+type Workflow struct {
+	enq          workflow.StepEnqueuer
+	ider         IDer
+	store        storage.Storage
+	sink         event.Sink
+	logger       log.Logger
+	clock        clock.Clock
+	pollInterval time.Duration
+	polls        int
+}
+
+// Option configures the workflow.
+type Option func(*Workflow)
+
+// WithLogger configures a logger for the workflow.
+func WithLogger(logger log.Logger) Option {
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithSink sends app install completion events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(w *Workflow) {
+		w.sink = sink
+	}
+}
+
+// WithIDer configures the command UUID generator.
+func WithIDer(ider IDer) Option {
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithClock configures the clock of the workflow.
+func WithClock(c clock.Clock) Option {
+	return func(w *Workflow) {
+		w.clock = c
+	}
+}
+
+// WithPolling configures the interval and number of polls of the
+// managed application list.
+func WithPolling(interval time.Duration, polls int) Option {
+	return func(w *Workflow) {
+		w.pollInterval = interval
+		w.polls = polls
+	}
+}
+
+// New creates a new app install workflow.
+// App states are stored in store.
+func New(q workflow.StepEnqueuer, store storage.Storage, opts ...Option) (*Workflow, error) {
+	if q == nil {
+		return nil, errors.New("nil step enqueuer")
+	}
+	if store == nil {
+		return nil, errors.New("nil inventory storage")
+	}
+	w := &Workflow{
+		enq:          q,
+		ider:         uuid.NewUUID(),
+		store:        store,
+		logger:       log.NopLogger,
+		clock:        clock.Real,
+		pollInterval: DefaultPollInterval,
+		polls:        DefaultPolls,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = w.logger.With(logkeys.WorkflowName, w.Name())
+	return w, nil
+}
+
+func (w *Workflow) Name() string {
+	return WorkflowName
+}
+
+func (w *Workflow) Config() *workflow.Config {
+	return nil
+}
+
+func (w *Workflow) NewContextValue(name string) workflow.ContextMarshaler {
+	switch name {
+	case "", stepNameInstall:
+		return new(App)
+	case stepNamePoll:
+		return new(pollContext)
+	}
+	return nil
+}
+
+// command creates the installation command for a.
+func (w *Workflow) command(a *App) interface{} {
+	if a.Enterprise {
+		cmd := mdmcommands.NewInstallEnterpriseApplicationCommand(w.ider.ID())
+		manifestURL := a.ManifestURL
+		cmd.Command.ManifestURL = &manifestURL
+		return cmd
+	}
+	cmd := mdmcommands.NewInstallApplicationCommand(w.ider.ID())
+	switch {
+	case a.ManifestURL != "":
+		manifestURL := a.ManifestURL
+		cmd.Command.ManifestURL = &manifestURL
+	case a.ITunesStoreID != nil:
+		cmd.Command.ITunesStoreID = a.ITunesStoreID
+	default:
+		identifier := a.Identifier
+		cmd.Command.Identifier = &identifier
+	}
+	cmd.Command.ManagementFlags = a.ManagementFlags
+	return cmd
+}
+
+// storeState records the state and status of app identifier for id.
+func (w *Workflow) storeState(ctx context.Context, id, identifier, state, status string) error {
+	values := storage.Values{
+		StateKey(identifier):   state,
+		UpdatedKey(identifier): w.clock.Now(),
+		storage.KeyLastSource:  WorkflowName,
+	}
+	if status != "" {
+		values[StatusKey(identifier)] = status
+	}
+	if err := w.store.StoreInventoryValues(ctx, id, values); err != nil {
+		return fmt.Errorf("update inventory values for %s: %w", id, err)
+	}
+	return nil
+}
+
+// complete records the final state of app identifier for id and sends an event.
+func (w *Workflow) complete(ctx context.Context, id, identifier, state, status string) error {
+	if err := w.storeState(ctx, id, identifier, state, status); err != nil {
+		return err
+	}
+	if w.sink != nil {
+		ev := event.New(w.clock, event.TypeAppInstallCompleted, id)
+		ev.Fields["identifier"] = identifier
+		ev.Fields["state"] = state
+		ev.Fields["status"] = status
+		if err := w.sink.Send(ctx, ev); err != nil {
+			ctxlog.Logger(ctx, w.logger).Info(
+				logkeys.EnrollmentID, id,
+				logkeys.Message, "sending event",
+				logkeys.Error, err,
+			)
+		}
+	}
+	return nil
+}
+
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	a, ok := step.Context.(*App)
+	if !ok {
+		return workflow.ErrIncorrectContextType
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	for _, id := range step.IDs {
+		if err := w.storeState(ctx, id, a.Identifier, StateInstalling, ""); err != nil {
+			return err
+		}
+
+		se := step.NewStepEnqueueing()
+		se.IDs = []string{id} // scope to just this ID we're iterating over
+		se.Name = stepNameInstall
+		se.Context = a
+		se.Commands = []interface{}{w.command(a)}
+
+		if err := w.enq.EnqueueStep(ctx, w, se); err != nil {
+			return fmt.Errorf("enqueueing step for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// poll enqueues a poll of the installed application list.
+func (w *Workflow) poll(ctx context.Context, stepResult *workflow.StepResult, c *pollContext) error {
+	cmd := mdmcommands.NewInstalledApplicationListCommand(w.ider.ID())
+	identifiers := []string{c.Identifier}
+	managedOnly := true
+	cmd.Command.Identifiers = &identifiers
+	cmd.Command.ManagedAppsOnly = &managedOnly
+
+	se := stepResult.NewStepEnqueueing()
+	se.Name = stepNamePoll
+	se.Context = c
+	se.Commands = []interface{}{cmd}
+	se.NotUntil = w.clock.Now().Add(w.pollInterval)
+	return w.enq.EnqueueStep(ctx, w, se)
+}
+
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if len(stepResult.CommandResults) != 1 {
+		return workflow.ErrStepResultCommandLenMismatch
+	}
+	switch stepResult.Name {
+	case stepNameInstall:
+		return w.installCompleted(ctx, stepResult)
+	case stepNamePoll:
+		return w.pollCompleted(ctx, stepResult)
+	}
+	return workflow.ErrUnknownStepName
+}
+
+// installCompleted starts polling for the installation of the app.
+func (w *Workflow) installCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	a, ok := stepResult.Context.(*App)
+	if !ok {
+		return workflow.ErrIncorrectContextType
+	}
+	genResper, ok := stepResult.CommandResults[0].(mdmcommands.GenericResponser)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	response := genResper.GetGenericResponse()
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "install received",
+		"identifier", a.Identifier,
+		"status", response.Status,
+	)
+
+	if err := response.Validate(); err != nil {
+		if err2 := w.complete(ctx, stepResult.ID, a.Identifier, StateFailed, response.Status); err2 != nil {
+			return err2
+		}
+		return fmt.Errorf("validating install response: %w", err)
+	}
+
+	if a.Enterprise {
+		return w.complete(ctx, stepResult.ID, a.Identifier, StateInstalled, response.Status)
+	}
+	if r, ok := stepResult.CommandResults[0].(*mdmcommands.InstallApplicationResponse); ok && r.State != nil && *r.State == installStateManaged {
+		// already installed
+		return w.complete(ctx, stepResult.ID, a.Identifier, StateInstalled, *r.State)
+	}
+	return w.poll(ctx, stepResult, &pollContext{Identifier: a.Identifier, Remaining: w.polls})
+}
+
+// pollCompleted records the state of the app and continues polling
+// until the app is installed, fails, or the polls are exhausted.
+func (w *Workflow) pollCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	c, ok := stepResult.Context.(*pollContext)
+	if !ok {
+		return workflow.ErrIncorrectContextType
+	}
+	response, ok := stepResult.CommandResults[0].(*mdmcommands.InstalledApplicationListResponse)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	if err := response.Validate(); err != nil {
+		return fmt.Errorf("validating installed application list response: %w", err)
+	}
+
+	status := appStatus(response.InstalledApplicationList, c.Identifier)
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "installed application list received",
+		"identifier", c.Identifier,
+		"app_status", status,
+		"count_remaining", c.Remaining,
+	)
+
+	switch {
+	case status == statusInstalled:
+		return w.complete(ctx, stepResult.ID, c.Identifier, StateInstalled, status)
+	case status == statusFailed || status == statusCancelled:
+		return w.complete(ctx, stepResult.ID, c.Identifier, StateFailed, status)
+	case c.Remaining <= 1:
+		return w.complete(ctx, stepResult.ID, c.Identifier, StateTimedOut, status)
+	}
+
+	if err := w.storeState(ctx, stepResult.ID, c.Identifier, StateInstalling, status); err != nil {
+		return err
+	}
+	c.Remaining--
+	return w.poll(ctx, stepResult, c)
+}
+
+func (w *Workflow) StepTimeout(_ context.Context, _ *workflow.StepResult) error {
+	return workflow.ErrTimeoutNotUsed
+}
+
+func (w *Workflow) Event(_ context.Context, _ *workflow.Event, _ string, _ *workflow.MDMContext) error {
+	return workflow.ErrEventsNotSupported
+}
@@ -0,0 +1,106 @@
+package appinstall
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+// inventory is an in-memory inventory store.
+type inventory map[string]storage.Values
+
+func (inv inventory) RetrieveInventory(_ context.Context, opt *storage.SearchOptions) (map[string]storage.Values, error) {
+	ret := make(map[string]storage.Values)
+	for _, id := range opt.IDs {
+		if v, ok := inv[id]; ok {
+			ret[id] = v
+		}
+	}
+	return ret, nil
+}
+
+func (inv inventory) StoreInventoryValues(_ context.Context, id string, values storage.Values) error {
+	if inv[id] == nil {
+		inv[id] = make(storage.Values)
+	}
+	for k, v := range values {
+		inv[id][k] = v
+	}
+	return nil
+}
+
+func (inv inventory) DeleteInventory(_ context.Context, id string) error {
+	delete(inv, id)
+	return nil
+}
+
+type enqueuer struct{ steps []*workflow.StepEnqueueing }
+
+func (e *enqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+// last returns the context and result of the last enqueued step
+// completed by the response r of enrollment ID1.
+func (e *enqueuer) last(r interface{}) *workflow.StepResult {
+	se := e.steps[len(e.steps)-1]
+	result := &workflow.StepResult{ID: "ID1", CommandResults: []interface{}{r}}
+	result.Name = se.Name
+	result.Context = se.Context
+	return result
+}
+
+func TestInstall(t *testing.T) {
+	ctx := context.Background()
+	inv := make(inventory)
+	enq := new(enqueuer)
+	w, err := New(enq, inv, WithPolling(0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Start(ctx, &workflow.StepStart{IDs: []string{"ID1"}, StepContext: workflow.StepContext{Context: &App{}}}); err != ErrNoIdentifier {
+		t.Errorf("have: %v, want: %v", err, ErrNoIdentifier)
+	}
+
+	app := &App{Identifier: "com.example.app", ManifestURL: "https://example.com/manifest.plist"}
+	if err = w.Start(ctx, &workflow.StepStart{IDs: []string{"ID1"}, StepContext: workflow.StepContext{Context: app}}); err != nil {
+		t.Fatal(err)
+	}
+	cmd, ok := enq.steps[0].Commands[0].(*mdmcommands.InstallApplicationCommand)
+	if !ok || cmd.Command.ManifestURL == nil || *cmd.Command.ManifestURL != app.ManifestURL {
+		t.Fatal("incorrect install command")
+	}
+
+	ack := mdmcommands.GenericResponse{Status: "Acknowledged"}
+	identifier, installing := app.Identifier, true
+	for _, test := range []struct {
+		response interface{}
+		state    string
+	}{
+		{&mdmcommands.InstallApplicationResponse{GenericResponse: ack}, StateInstalling},
+		{&mdmcommands.InstalledApplicationListResponse{GenericResponse: ack}, StateInstalling},
+		{&mdmcommands.InstalledApplicationListResponse{
+			GenericResponse:          ack,
+			InstalledApplicationList: []mdmcommands.InstalledApplicationListItem{{Identifier: &identifier, Installing: &installing}},
+		}, StateInstalling},
+		{&mdmcommands.InstalledApplicationListResponse{
+			GenericResponse:          ack,
+			InstalledApplicationList: []mdmcommands.InstalledApplicationListItem{{Identifier: &identifier}},
+		}, StateInstalled},
+	} {
+		if err = w.StepCompleted(ctx, enq.last(test.response)); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := inv["ID1"][StateKey(app.Identifier)], test.state; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+	}
+	if have, want := len(enq.steps), 4; have != want {
+		t.Errorf("have: %d steps, want: %d", have, want)
+	}
+}
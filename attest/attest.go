@@ -0,0 +1,308 @@
+// Package attest requests and verifies Managed Device Attestation.
+// Attestations are requested with a DeviceInformation command that
+// queries DevicePropertiesAttestation with a fresh nonce. The returned
+// certificate chain is verified against the Apple attestation roots and
+// the attestation state of each enrollment is stored.
+package attest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/plist"
+)
+
+// Attestation statuses.
+const (
+	StatusPending  = "pending"
+	StatusVerified = "verified"
+	StatusFailed   = "failed"
+)
+
+// NonceSize is the size of attestation nonces in bytes.
+const NonceSize = 32
+
+// State is the attestation state of an enrollment.
+type State struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	CommandUUID string    `json:"command_uuid"`
+	Nonce       []byte    `json:"nonce,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+
+	// VerifiedAt is the time of the last successful verification.
+	// It is kept when later attestations fail.
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+
+	Error      string      `json:"error,omitempty"`
+	Properties *Properties `json:"properties,omitempty"`
+}
+
+// Store stores attestation states.
+type Store interface {
+	StoreState(ctx context.Context, s *State) error
+
+	// RetrieveState retrieves the attestation state of enrollment id.
+	// Nil is returned if no attestation was requested for id.
+	RetrieveState(ctx context.Context, id string) (*State, error)
+}
+
+// InventoryStore stores inventory values.
+// See the NanoCMD inventory subsystem.
+type InventoryStore interface {
+	StoreInventoryValues(ctx context.Context, id string, values storage.Values) error
+}
+
+// Enqueuer enqueues raw MDM commands and pushes the enrollments.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, ids []string, rawCmd []byte) error
+}
+
+// IDer generates unique command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Attester requests and verifies attestations.
+// It is a NanoMDM service that must see the command reports of
+// enrollments.
+type Attester struct {
+	service.CheckinAndCommandService
+
+	store     Store
+	roots     *x509.CertPool
+	inventory InventoryStore
+	sink      event.Sink
+	ider      IDer
+	logger    log.Logger
+	clock     clock.Clock
+}
+
+// Option configures an attester.
+type Option func(*Attester)
+
+// WithInventory stores the attestation status and properties of
+// enrollments in the inventory.
+func WithInventory(inv InventoryStore) Option {
+	return func(a *Attester) {
+		a.inventory = inv
+	}
+}
+
+// WithSink sends attestation failure events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(a *Attester) {
+		a.sink = sink
+	}
+}
+
+// WithIDer configures the generator of command UUIDs.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(a *Attester) {
+		a.ider = ider
+	}
+}
+
+// WithLogger configures a logger for the attester.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(a *Attester) {
+		a.logger = logger
+	}
+}
+
+// WithClock configures the clock of the attester.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(a *Attester) {
+		a.clock = c
+	}
+}
+
+// New creates a new attester that verifies attestations against roots.
+func New(store Store, roots *x509.CertPool, opts ...Option) *Attester {
+	if store == nil {
+		panic("nil store")
+	}
+	if roots == nil {
+		panic("nil roots")
+	}
+	a := &Attester{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		roots:                    roots,
+		ider:                     uuid.NewUUID(),
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// State retrieves the attestation state of enrollment id.
+func (a *Attester) State(ctx context.Context, id string) (*State, error) {
+	return a.store.RetrieveState(ctx, id)
+}
+
+// command is a DeviceInformation attestation command.
+type command struct {
+	CommandUUID string
+	Command     struct {
+		RequestType            string
+		Queries                []string
+		DeviceAttestationNonce []byte
+	}
+}
+
+// Request enqueues an attestation request with a new nonce for ids
+// with enq and returns their pending states.
+func (a *Attester) Request(ctx context.Context, enq Enqueuer, ids []string) ([]*State, error) {
+	if enq == nil {
+		return nil, errors.New("nil enqueuer")
+	}
+	if len(ids) < 1 {
+		return nil, errors.New("no ids")
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	cmd := &command{CommandUUID: a.ider.ID()}
+	cmd.Command.RequestType = "DeviceInformation"
+	cmd.Command.Queries = []string{"DevicePropertiesAttestation"}
+	cmd.Command.DeviceAttestationNonce = nonce
+	raw, err := plist.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("marshal command: %w", err)
+	}
+
+	now := a.clock.Now()
+	states := make([]*State, 0, len(ids))
+	for _, id := range ids {
+		s, err := a.store.RetrieveState(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving state: %w", err)
+		}
+		if s == nil {
+			s = &State{ID: id}
+		}
+		s.Status = StatusPending
+		s.CommandUUID = cmd.CommandUUID
+		s.Nonce = nonce
+		s.RequestedAt = now
+		s.Error = ""
+		if err = a.store.StoreState(ctx, s); err != nil {
+			return nil, fmt.Errorf("storing state: %w", err)
+		}
+		states = append(states, s)
+	}
+	if err = enq.Enqueue(ctx, ids, raw); err != nil {
+		return states, fmt.Errorf("enqueueing attestation request: %w", err)
+	}
+	ctxlog.Logger(ctx, a.logger).Debug("msg", "requested attestation", "command_uuid", cmd.CommandUUID, "count", len(ids))
+	return states, nil
+}
+
+// response is the subset of a DeviceInformation attestation response.
+type response struct {
+	QueryResponses struct {
+		DevicePropertiesAttestation [][]byte
+	}
+}
+
+// CommandAndReportResults verifies the attestation responses of
+// enrollments with pending attestation requests.
+func (a *Attester) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results.CommandUUID == "" || results.Status == "NotNow" || r.EnrollID == nil {
+		return nil, nil
+	}
+	ctx := r.Context()
+	s, err := a.store.RetrieveState(ctx, r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving state: %w", err)
+	}
+	if s == nil || s.Status != StatusPending || s.CommandUUID != results.CommandUUID {
+		return nil, nil
+	}
+
+	var props *Properties
+	if results.Status != "Acknowledged" {
+		err = fmt.Errorf("command status: %s", results.Status)
+	} else {
+		resp := new(response)
+		if err = plist.Unmarshal(results.Raw, resp); err != nil {
+			err = fmt.Errorf("unmarshal response: %w", err)
+		} else {
+			props, err = Verify(resp.QueryResponses.DevicePropertiesAttestation, a.roots, s.Nonce, a.clock.Now())
+		}
+	}
+	a.update(ctx, s, props, err)
+	if err = a.store.StoreState(ctx, s); err != nil {
+		return nil, fmt.Errorf("storing state: %w", err)
+	}
+	return nil, nil
+}
+
+// update updates s with the verification result and records it in the
+// inventory and event sink.
+func (a *Attester) update(ctx context.Context, s *State, props *Properties, verifyErr error) {
+	logger := ctxlog.Logger(ctx, a.logger)
+	s.Nonce = nil
+	s.Properties = props
+	if verifyErr != nil {
+		s.Status = StatusFailed
+		s.Error = verifyErr.Error()
+		logger.Info("msg", "attestation failed", "id", s.ID, "err", verifyErr)
+	} else {
+		s.Status = StatusVerified
+		s.VerifiedAt = a.clock.Now()
+		logger.Debug("msg", "attestation verified", "id", s.ID)
+	}
+
+	if a.inventory != nil {
+		values := storage.Values{"attestation_status": s.Status}
+		if !s.VerifiedAt.IsZero() {
+			values["attestation_verified_at"] = s.VerifiedAt
+		}
+		if props != nil && verifyErr == nil {
+			values["attested_serial_number"] = props.SerialNumber
+			values["attested_udid"] = props.UDID
+			values["attested_os_version"] = props.OSVersion
+			values["attested_sepos_version"] = props.SepOSVersion
+		}
+		if err := a.inventory.StoreInventoryValues(ctx, s.ID, values); err != nil {
+			logger.Info("msg", "storing inventory", "id", s.ID, "err", err)
+		}
+	}
+
+	if a.sink != nil && verifyErr != nil {
+		e := event.New(a.clock, event.TypeAttestationFailed, s.ID)
+		e.Fields["command_uuid"] = s.CommandUUID
+		e.Fields["error"] = s.Error
+		if err := a.sink.Send(ctx, e); err != nil {
+			logger.Info("msg", "sending event", "type", e.Type, "err", err)
+		}
+	}
+}
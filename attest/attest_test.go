@@ -0,0 +1,77 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Attestation Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := []byte("nonce")
+	freshness := sha256.Sum256(nonce)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidSerialNumber, Value: []byte("C02XYZ")},
+			{Id: oidOSVersion, Value: []byte("17.4")},
+			{Id: oidFreshnessCode, Value: freshness[:]},
+		},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	p, err := Verify([][]byte{leafDER}, roots, nonce, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SerialNumber != "C02XYZ" || p.OSVersion != "17.4" {
+		t.Errorf("unexpected properties: %+v", p)
+	}
+
+	if _, err = Verify([][]byte{leafDER}, roots, []byte("other"), now); err != ErrNonceMismatch {
+		t.Errorf("have: %v, want: %v", err, ErrNonceMismatch)
+	}
+	if _, err = Verify([][]byte{leafDER}, x509.NewCertPool(), nonce, now); err == nil {
+		t.Error("expected untrusted chain error")
+	}
+}
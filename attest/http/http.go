@@ -0,0 +1,99 @@
+// Package http provides the HTTP API for Managed Device Attestation.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/attest"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoIDs is returned when no enrollment IDs are provided.
+	ErrNoIDs = errors.New("no ids provided")
+
+	// ErrNotFound is returned when no attestation was requested for an enrollment.
+	ErrNotFound = errors.New("no attestation state")
+)
+
+// RequestHandler requests attestations from the enrollment IDs in the
+// "id" query parameters and returns their pending states.
+func RequestHandler(a *attest.Attester, enq attest.Enqueuer, logger log.Logger) http.HandlerFunc {
+	if a == nil {
+		panic("nil attester")
+	}
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		states, err := a.Request(r.Context(), enq, ids)
+		if err != nil {
+			logger.Info("msg", "requesting attestation", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "requested attestation", "count", len(ids))
+		httpapi.WriteJSON(w, states, logger)
+	}
+}
+
+// GetStateHandler returns the attestation state of the enrollment ID
+// in the URL path.
+func GetStateHandler(a *attest.Attester, logger log.Logger) http.HandlerFunc {
+	if a == nil {
+		panic("nil attester")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		state, err := a.State(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving attestation state", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if state == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, state, logger)
+	}
+}
+
+// HandleAPIv1 registers the attestation API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, a *attest.Attester, enq attest.Enqueuer) {
+	mux.Handle(
+		prefix+"/attest",
+		RequestHandler(a, enq, logger.With("handler", "request-attestation")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/attest/:id",
+		GetStateHandler(a, logger.With("handler", "get-attestation")),
+		"GET",
+	)
+}
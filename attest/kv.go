@@ -0,0 +1,50 @@
+package attest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores attestation states in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new attestation state store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreState stores the attestation state st of its enrollment.
+func (s *KVStore) StoreState(ctx context.Context, st *State) error {
+	if st == nil || st.ID == "" {
+		return errors.New("invalid state")
+	}
+	v, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return s.b.Set(ctx, st.ID, v)
+}
+
+// RetrieveState retrieves the attestation state of enrollment id.
+func (s *KVStore) RetrieveState(ctx context.Context, id string) (*State, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st := new(State)
+	if err = json.Unmarshal(v, st); err != nil {
+		return nil, fmt.Errorf("unmarshal state: %w", err)
+	}
+	return st, nil
+}
@@ -0,0 +1,120 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Apple attestation certificate extension OIDs.
+var (
+	oidSerialNumber    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 9, 1}
+	oidUDID            = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 9, 2}
+	oidOSVersion       = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 10, 1}
+	oidSepOSVersion    = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 10, 2}
+	oidLLBVersion      = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 10, 3}
+	oidFreshnessCode   = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 11, 1}
+	oidSIPStatus       = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 13, 1}
+	oidSecureBoot      = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 13, 2}
+	oidThirdPartyKexts = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 13, 3}
+)
+
+var (
+	// ErrNoCertificates is returned for an empty attestation.
+	ErrNoCertificates = errors.New("no attestation certificates")
+
+	// ErrNonceMismatch is returned when the attestation is not fresh.
+	ErrNonceMismatch = errors.New("attestation freshness code does not match nonce")
+)
+
+// Properties are the device properties attested by Apple.
+type Properties struct {
+	SerialNumber    string `json:"serial_number,omitempty"`
+	UDID            string `json:"udid,omitempty"`
+	OSVersion       string `json:"os_version,omitempty"`
+	SepOSVersion    string `json:"sepos_version,omitempty"`
+	LLBVersion      string `json:"llb_version,omitempty"`
+	SIPStatus       string `json:"sip_status,omitempty"`
+	SecureBoot      string `json:"secure_boot,omitempty"`
+	ThirdPartyKexts string `json:"third_party_kexts,omitempty"`
+}
+
+// extValue returns the value of an attestation extension.
+// Values may be raw or wrapped in a DER OCTET STRING or string.
+func extValue(v []byte) []byte {
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(v, &raw); err == nil && len(rest) == 0 && raw.Class == asn1.ClassUniversal && !raw.IsCompound {
+		return raw.Bytes
+	}
+	return v
+}
+
+// Verify verifies the attestation certificate chain certs (DER, leaf
+// first) against roots at time now and returns the attested properties.
+// If nonce is not empty the leaf freshness code must be its SHA-256 hash.
+func Verify(certs [][]byte, roots *x509.CertPool, nonce []byte, now time.Time) (*Properties, error) {
+	if len(certs) < 1 {
+		return nil, ErrNoCertificates
+	}
+	if roots == nil {
+		return nil, errors.New("no roots")
+	}
+	leaf, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing leaf certificate: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for i, der := range certs[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %d: %w", i+1, err)
+		}
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verifying certificate chain: %w", err)
+	}
+
+	p := new(Properties)
+	var freshness []byte
+	for _, ext := range leaf.Extensions {
+		v := extValue(ext.Value)
+		switch {
+		case ext.Id.Equal(oidSerialNumber):
+			p.SerialNumber = string(v)
+		case ext.Id.Equal(oidUDID):
+			p.UDID = string(v)
+		case ext.Id.Equal(oidOSVersion):
+			p.OSVersion = string(v)
+		case ext.Id.Equal(oidSepOSVersion):
+			p.SepOSVersion = string(v)
+		case ext.Id.Equal(oidLLBVersion):
+			p.LLBVersion = string(v)
+		case ext.Id.Equal(oidFreshnessCode):
+			freshness = v
+		case ext.Id.Equal(oidSIPStatus):
+			p.SIPStatus = string(v)
+		case ext.Id.Equal(oidSecureBoot):
+			p.SecureBoot = string(v)
+		case ext.Id.Equal(oidThirdPartyKexts):
+			p.ThirdPartyKexts = string(v)
+		}
+	}
+	if len(nonce) > 0 {
+		sum := sha256.Sum256(nonce)
+		if !bytes.Equal(freshness, sum[:]) {
+			return p, ErrNonceMismatch
+		}
+	}
+	return p, nil
+}
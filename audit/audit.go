@@ -0,0 +1,274 @@
+// Package audit records API-initiated administrative actions.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/http/trace"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is a single audited administrative action.
+type Event struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Targets    []string  `json:"targets,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Outcome    string    `json:"outcome"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	TraceID    string    `json:"trace_id,omitempty"`
+}
+
+// Query filters audit events.
+// Zero-valued fields are not filtered on.
+type Query struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Match reports whether e satisfies q.
+func (q *Query) Match(e *Event) bool {
+	if q == nil {
+		return true
+	}
+	if q.Actor != "" && q.Actor != e.Actor {
+		return false
+	}
+	if q.Action != "" && q.Action != e.Action {
+		return false
+	}
+	if !q.Since.IsZero() && e.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Timestamp.Before(q.Until) {
+		return false
+	}
+	if q.Target != "" {
+		for _, t := range e.Targets {
+			if t == q.Target {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Store stores and retrieves audit events.
+type Store interface {
+	// StoreEvent stores e.
+	StoreEvent(ctx context.Context, e *Event) error
+
+	// RetrieveEvents retrieves the events matching q, newest first.
+	RetrieveEvents(ctx context.Context, q *Query) ([]*Event, error)
+}
+
+// ActorFn returns the actor responsible for r.
+type ActorFn func(r *http.Request) string
+
+// TargetsFn returns the target IDs of r.
+type TargetsFn func(r *http.Request) []string
+
+// BasicAuthActor returns the HTTP Basic authentication username of r.
+func BasicAuthActor(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// QueryTargets returns the "id" query parameters of r.
+// Comma-separated values are split into separate IDs.
+func QueryTargets(r *http.Request) (ids []string) {
+	for _, v := range r.URL.Query()["id"] {
+		for _, id := range strings.Split(v, ",") {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
+
+// PathTargets returns the comma-separated IDs in the last path segment of r.
+// This matches the NanoMDM API convention for enqueue and push.
+func PathTargets(r *http.Request) (ids []string) {
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segs) < 2 {
+		return nil
+	}
+	for _, id := range strings.Split(segs[len(segs)-1], ",") {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// Auditor records audit events.
+type Auditor struct {
+	store   Store
+	logger  log.Logger
+	clock   clock.Clock
+	actorFn ActorFn
+}
+
+// Option configures an Auditor.
+type Option func(*Auditor)
+
+// WithLogger configures logger on the Auditor.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+
+	return func(a *Auditor) {
+		a.logger = logger
+	}
+}
+
+// WithClock configures the clock used for event timestamps.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+
+	return func(a *Auditor) {
+		a.clock = c
+	}
+}
+
+// WithActorFn overrides the default actor function ([BasicAuthActor]).
+func WithActorFn(fn ActorFn) Option {
+	if fn == nil {
+		panic("nil actor function")
+	}
+
+	return func(a *Auditor) {
+		a.actorFn = fn
+	}
+}
+
+// New creates a new auditor that records events to store.
+func New(store Store, opts ...Option) *Auditor {
+	if store == nil {
+		panic("nil store")
+	}
+
+	a := &Auditor{
+		store:   store,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+		actorFn: BasicAuthActor,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// newID generates a new time-sortable event ID.
+func newID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%016x%x", t.UnixNano(), b)
+}
+
+// Record stores e, populating its ID and timestamp if they are empty.
+func (a *Auditor) Record(ctx context.Context, e *Event) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = a.clock.Now()
+	}
+	if e.ID == "" {
+		e.ID = newID(e.Timestamp)
+	}
+	if e.TraceID == "" {
+		e.TraceID = trace.GetTraceID(ctx)
+	}
+	return a.store.StoreEvent(ctx, e)
+}
+
+// statusRecorder captures the HTTP status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Middleware returns HTTP middleware that records mutating requests
+// (i.e. not GET, HEAD, or OPTIONS) as action.
+// The IDs targeted by the request are extracted using targetsFn which
+// may be nil.
+func (a *Auditor) Middleware(action string, targetsFn TargetsFn) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			e := &Event{
+				Actor:      a.actorFn(r),
+				Action:     action,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     rec.status,
+				Outcome:    OutcomeSuccess,
+				RemoteAddr: r.RemoteAddr,
+			}
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			if e.Status >= 400 {
+				e.Outcome = OutcomeFailure
+			}
+			if targetsFn != nil {
+				e.Targets = targetsFn(r)
+			}
+
+			if err := a.Record(r.Context(), e); err != nil {
+				ctxlog.Logger(r.Context(), a.logger).Info(
+					"msg", "recording audit event",
+					"action", action,
+					"err", err,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+func TestMiddleware(t *testing.T) {
+	s := NewKVStore(kvmap.New())
+	a := New(s)
+
+	h := a.Middleware("test", QueryTargets)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		r := httptest.NewRequest(method, "/test?id=a,b&id=c", nil)
+		r.SetBasicAuth("nanohub", "secret")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	events, err := s.RetrieveEvents(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// GET requests are not audited
+	if have, want := len(events), 2; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+
+	// newest first
+	if have, want := events[0].Outcome, OutcomeFailure; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := events[1].Outcome, OutcomeSuccess; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := events[1].Actor, "nanohub"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := events[1].Targets, []string{"a", "b", "c"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	events, err = s.RetrieveEvents(context.Background(), &Query{Target: "c", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(events), 1; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestKVStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewKVStore(kvmap.New())
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	a := New(s, WithClock(fake))
+	for i := 0; i < 5; i++ {
+		if err := a.Record(ctx, &Event{Action: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(time.Hour)
+	}
+
+	events, err := s.RetrieveEvents(ctx, &Query{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || !events[0].Timestamp.Equal(start.Add(2*time.Hour)) || !events[1].Timestamp.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected events: %v", events)
+	}
+
+	// prune by age
+	if n, err := s.Prune(ctx, start.Add(time.Hour), 0); err != nil || n != 1 {
+		t.Errorf("have: %v pruned (err %v), want: 1", n, err)
+	}
+	// prune by count
+	if n, err := s.Prune(ctx, time.Time{}, 2); err != nil || n != 2 {
+		t.Errorf("have: %v pruned (err %v), want: 2", n, err)
+	}
+	if events, err = s.RetrieveEvents(ctx, nil); err != nil || len(events) != 2 {
+		t.Fatalf("have: %v events (err %v), want: 2", len(events), err)
+	}
+	if !events[1].Timestamp.Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("have: oldest event at %v, want: %v", events[1].Timestamp, start.Add(3*time.Hour))
+	}
+}
@@ -0,0 +1,85 @@
+// Package http provides the HTTP API for querying audit events.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/audit"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultLimit is the number of events returned if no limit is given.
+const DefaultLimit = 100
+
+// parseTime parses the RFC 3339 query parameter key from r.
+func parseTime(r *http.Request, key string) (t time.Time, err error) {
+	if v := r.URL.Query().Get(key); v != "" {
+		t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			err = fmt.Errorf("parsing %s: %w", key, err)
+		}
+	}
+	return
+}
+
+// EventsHandler returns audit events matching the query parameters
+// actor, action, id, since, until, and limit.
+func EventsHandler(store audit.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := &audit.Query{
+			Actor:  r.URL.Query().Get("actor"),
+			Action: r.URL.Query().Get("action"),
+			Target: r.URL.Query().Get("id"),
+		}
+
+		var err error
+		if q.Since, err = parseTime(r, "since"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Until, err = parseTime(r, "until"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Limit, err = httpapi.QueryInt(r, "limit", DefaultLimit); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if q.Limit < 1 {
+			httpapi.JSONError(w, errors.New("invalid limit"), http.StatusBadRequest)
+			return
+		}
+
+		events, err := store.RetrieveEvents(r.Context(), q)
+		if err != nil {
+			logger.Info("msg", "retrieving audit events", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if events == nil {
+			events = []*audit.Event{}
+		}
+
+		httpapi.WriteJSON(w, events, logger)
+	}
+}
+
+// HandleAPIv1 registers the audit API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store audit.Store) {
+	mux.Handle(
+		prefix+"/audit/events",
+		EventsHandler(store, logger.With("handler", "audit-events")),
+		"GET",
+	)
+}
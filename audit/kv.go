@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// maxScan is the maximum number of events examined by a query.
+const maxScan = 10000
+
+// KVStore stores audit events in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new audit store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreEvent stores e keyed by its (time-sortable) ID.
+func (s *KVStore) StoreEvent(ctx context.Context, e *Event) error {
+	if e == nil || e.ID == "" {
+		return errors.New("invalid event")
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	return s.b.Set(ctx, e.ID, v)
+}
+
+// keyTime returns the time encoded in the (time-sortable) ID key.
+// It reports false if key does not begin with a time.
+func keyTime(key string) (time.Time, bool) {
+	if len(key) < 16 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(key[:16], 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// RetrieveEvents retrieves the events matching q, newest first.
+// Only events in the time range of q are read and at most the newest
+// maxScan of those are examined.
+func (s *KVStore) RetrieveEvents(ctx context.Context, q *Query) ([]*Event, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var events []*Event
+	var scanned int
+	for i := len(keys) - 1; i >= 0 && scanned < maxScan; i-- {
+		if t, ok := keyTime(keys[i]); ok && q != nil {
+			if !q.Until.IsZero() && !t.Before(q.Until) {
+				continue
+			}
+			if !q.Since.IsZero() && t.Before(q.Since) {
+				// keys are sorted by time
+				break
+			}
+		}
+		scanned++
+		v, err := s.b.Get(ctx, keys[i])
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return events, fmt.Errorf("getting event %s: %w", keys[i], err)
+		}
+		e := new(Event)
+		if err = json.Unmarshal(v, e); err != nil {
+			return events, fmt.Errorf("unmarshal event %s: %w", keys[i], err)
+		}
+		if !q.Match(e) {
+			continue
+		}
+		events = append(events, e)
+		if q != nil && q.Limit > 0 && len(events) >= q.Limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// Prune deletes the events recorded before before (if not zero) and
+// all but the newest maxCount events (if not zero). It returns the
+// number of deleted events.
+func (s *KVStore) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing keys: %w", err)
+	}
+	var count int64
+	for i, key := range keys {
+		if maxCount < 1 || len(keys)-i <= maxCount {
+			if before.IsZero() {
+				break
+			}
+			if t, ok := keyTime(key); !ok || !t.Before(before) {
+				// keys are sorted by time
+				break
+			}
+		}
+		if err = s.b.Delete(ctx, key); err != nil {
+			return count, fmt.Errorf("deleting event %s: %w", key, err)
+		}
+		count++
+	}
+	return count, nil
+}
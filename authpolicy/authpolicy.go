@@ -0,0 +1,154 @@
+// Package authpolicy authorizes MDM-authenticated requests with
+// additional policy checks, such as for the authproxy.
+package authpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrDenied is returned (possibly wrapped) by policies that deny a request.
+var ErrDenied = errors.New("denied by policy")
+
+// Policy authorizes an MDM-authenticated request from enrollment id.
+type Policy interface {
+	// Authorize returns an error wrapping ErrDenied to deny the request.
+	// Other errors are treated as failures to evaluate the policy.
+	Authorize(r *http.Request, id string) error
+}
+
+// PolicyFunc is an adapter to allow ordinary functions to be policies.
+type PolicyFunc func(r *http.Request, id string) error
+
+// Authorize calls f(r, id).
+func (f PolicyFunc) Authorize(r *http.Request, id string) error {
+	return f(r, id)
+}
+
+// deviceID returns the device channel ID of an enrollment ID.
+// NanoMDM user channel IDs are the device ID and user ID separated by a colon.
+func deviceID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// DeviceChannel only allows device channel enrollments.
+var DeviceChannel = PolicyFunc(func(_ *http.Request, id string) error {
+	if deviceID(id) != id {
+		return fmt.Errorf("%w: not a device channel enrollment", ErrDenied)
+	}
+	return nil
+})
+
+// Check tests a SecurityInfo response for compliance.
+type Check func(*cmdresponse.SecurityInfo) bool
+
+// Compliance checks.
+var (
+	// Passcode requires a passcode compliant with any installed profiles.
+	Passcode Check = func(si *cmdresponse.SecurityInfo) bool {
+		return si.PasscodePresent && si.PasscodeCompliant && si.PasscodeCompliantWithProfiles
+	}
+
+	// FileVault requires FileVault (FDE) to be enabled.
+	FileVault Check = func(si *cmdresponse.SecurityInfo) bool {
+		return si.FDEEnabled
+	}
+
+	// SIP requires System Integrity Protection to be enabled.
+	SIP Check = func(si *cmdresponse.SecurityInfo) bool {
+		return si.SystemIntegrityProtectionEnabled
+	}
+)
+
+// Compliant only allows enrollments whose device's latest SecurityInfo
+// command response passes check. Enrollments without a SecurityInfo
+// response are denied. The name of the check is included in denials.
+func Compliant(store cmdresponse.Store, name string, check Check) Policy {
+	if store == nil {
+		panic("nil store")
+	}
+	return PolicyFunc(func(r *http.Request, id string) error {
+		responses, err := store.RetrieveResponses(r.Context(), deviceID(id))
+		if err != nil {
+			return fmt.Errorf("retrieving responses: %w", err)
+		}
+		resp := responses[cmdresponse.SecurityInfoType]
+		if resp == nil || resp.SecurityInfo == nil {
+			return fmt.Errorf("%w: no SecurityInfo response", ErrDenied)
+		}
+		if !check(resp.SecurityInfo) {
+			return fmt.Errorf("%w: not compliant: %s", ErrDenied, name)
+		}
+		return nil
+	})
+}
+
+// Parse creates policies from a comma-separated list of policy names.
+// Supported names are "device-channel" and the compliance checks
+// "passcode", "filevault", and "sip" (which use store).
+func Parse(spec string, store cmdresponse.Store) ([]Policy, error) {
+	var policies []Policy
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		var check Check
+		switch name {
+		case "":
+			continue
+		case "device-channel":
+			policies = append(policies, DeviceChannel)
+			continue
+		case "passcode":
+			check = Passcode
+		case "filevault":
+			check = FileVault
+		case "sip":
+			check = SIP
+		default:
+			return nil, fmt.Errorf("unknown policy: %s", name)
+		}
+		if store == nil {
+			return nil, fmt.Errorf("policy %s: no response store", name)
+		}
+		policies = append(policies, Compliant(store, name, check))
+	}
+	return policies, nil
+}
+
+// Middleware only calls next if all policies authorize the request.
+// The enrollment ID is retrieved from the request context with getID.
+// Denied requests are responded to with a 403 Forbidden status.
+func Middleware(next http.Handler, getID func(context.Context) string, logger log.Logger, policies ...Policy) http.Handler {
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := getID(r.Context())
+		if id == "" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		for _, p := range policies {
+			if err := p.Authorize(r, id); errors.Is(err, ErrDenied) {
+				ctxlog.Logger(r.Context(), logger).Info("msg", "authorize", "id", id, "err", err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			} else if err != nil {
+				ctxlog.Logger(r.Context(), logger).Info("msg", "authorize", "id", id, "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
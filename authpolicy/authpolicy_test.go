@@ -0,0 +1,63 @@
+package authpolicy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+type ctxKey struct{}
+
+func getID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+func TestMiddleware(t *testing.T) {
+	ctx := context.Background()
+	store := cmdresponse.NewKVStore(kvmap.New())
+	err := store.StoreResponse(ctx, "DEV1", &cmdresponse.Response{
+		RequestType: cmdresponse.SecurityInfoType,
+		SecurityInfo: &cmdresponse.SecurityInfo{
+			PasscodePresent:               true,
+			PasscodeCompliant:             true,
+			PasscodeCompliantWithProfiles: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := Parse("device-channel,passcode", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), getID, nil, policies...)
+
+	for _, test := range []struct {
+		id     string
+		status int
+	}{
+		{"DEV1", http.StatusOK},
+		{"DEV1:USER1", http.StatusForbidden}, // user channel
+		{"DEV2", http.StatusForbidden},       // no SecurityInfo
+		{"", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/authproxy/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, test.id))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if have, want := rec.Code, test.status; have != want {
+			t.Errorf("%s: have: %v, want: %v", test.id, have, want)
+		}
+	}
+
+	if _, err = Parse("bogus", store); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
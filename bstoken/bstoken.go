@@ -0,0 +1,181 @@
+// Package bstoken manages escrowed Bootstrap Tokens.
+// Bootstrap Tokens are escrowed by devices into NanoMDM storage. This
+// package additionally records when tokens were escrowed, sends events
+// on escrow, and checks, retrieves, and clears escrowed tokens.
+package bstoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+// Status is the Bootstrap Token escrow status of an enrollment.
+type Status struct {
+	ID       string `json:"id"`
+	Escrowed bool   `json:"escrowed"`
+
+	// EscrowedAt is the time the token was last escrowed or cleared.
+	// It is the zero time if unknown.
+	EscrowedAt time.Time `json:"escrowed_at,omitempty"`
+}
+
+// Store stores escrow times.
+type Store interface {
+	StoreEscrowedAt(ctx context.Context, id string, at time.Time) error
+
+	// RetrieveEscrowedAt retrieves the escrow time of enrollment id.
+	// The zero time is returned if unknown.
+	RetrieveEscrowedAt(ctx context.Context, id string) (time.Time, error)
+}
+
+// Escrow manages escrowed Bootstrap Tokens.
+// It is a NanoMDM service that records escrows.
+type Escrow struct {
+	service.CheckinAndCommandService
+
+	tokens storage.BootstrapTokenStore
+	store  Store
+	sink   event.Sink
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the escrow.
+type Option func(*Escrow)
+
+// WithSink sends escrow events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(e *Escrow) {
+		e.sink = sink
+	}
+}
+
+// WithLogger configures a logger for the escrow.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(e *Escrow) {
+		e.logger = logger
+	}
+}
+
+// WithClock configures the clock of the escrow.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(e *Escrow) {
+		e.clock = c
+	}
+}
+
+// New creates a new escrow for the tokens escrowed in tokens.
+func New(tokens storage.BootstrapTokenStore, store Store, opts ...Option) *Escrow {
+	if tokens == nil {
+		panic("nil token store")
+	}
+	if store == nil {
+		panic("nil store")
+	}
+	e := &Escrow{
+		CheckinAndCommandService: new(service.NopService),
+		tokens:                   tokens,
+		store:                    store,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// request creates a NanoMDM request for enrollment id.
+func request(ctx context.Context, id string) *mdm.Request {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+	return r
+}
+
+// Token retrieves the escrowed Bootstrap Token of enrollment id.
+// Nil is returned if no token is escrowed.
+func (e *Escrow) Token(ctx context.Context, id string) ([]byte, error) {
+	if id == "" {
+		return nil, errors.New("empty id")
+	}
+	bt, err := e.tokens.RetrieveBootstrapToken(request(ctx, id), &mdm.GetBootstrapToken{})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving bootstrap token: %w", err)
+	}
+	if bt == nil || len(bt.BootstrapToken) < 1 {
+		return nil, nil
+	}
+	return bt.BootstrapToken, nil
+}
+
+// Status returns the escrow status of enrollment id.
+func (e *Escrow) Status(ctx context.Context, id string) (*Status, error) {
+	token, err := e.Token(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s := &Status{ID: id, Escrowed: token != nil}
+	if s.EscrowedAt, err = e.store.RetrieveEscrowedAt(ctx, id); err != nil {
+		return nil, fmt.Errorf("retrieving escrow time: %w", err)
+	}
+	return s, nil
+}
+
+// Clear clears the escrowed Bootstrap Token of enrollment id.
+// Devices escrow a new token when asked to or when it changes.
+func (e *Escrow) Clear(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if err := e.tokens.StoreBootstrapToken(request(ctx, id), &mdm.SetBootstrapToken{}); err != nil {
+		return fmt.Errorf("clearing bootstrap token: %w", err)
+	}
+	e.record(ctx, id, false)
+	return nil
+}
+
+// SetBootstrapToken records the escrow of the enrollment.
+func (e *Escrow) SetBootstrapToken(r *mdm.Request, msg *mdm.SetBootstrapToken) error {
+	if r.EnrollID == nil || r.ID == "" {
+		return nil
+	}
+	e.record(r.Context(), r.ID, len(msg.BootstrapToken.BootstrapToken) > 0)
+	return nil
+}
+
+// record stores the escrow time of enrollment id and sends an event.
+// Errors are only logged as the token itself is already stored.
+func (e *Escrow) record(ctx context.Context, id string, escrowed bool) {
+	logger := ctxlog.Logger(ctx, e.logger)
+	if err := e.store.StoreEscrowedAt(ctx, id, e.clock.Now()); err != nil {
+		logger.Info("msg", "storing escrow time", "id", id, "err", err)
+	}
+	logger.Debug("msg", "bootstrap token changed", "id", id, "escrowed", escrowed)
+	if e.sink == nil {
+		return
+	}
+	ev := event.New(e.clock, event.TypeBootstrapTokenCleared, id)
+	if escrowed {
+		ev = event.New(e.clock, event.TypeBootstrapTokenEscrowed, id)
+	}
+	if err := e.sink.Send(ctx, ev); err != nil {
+		logger.Info("msg", "sending event", "type", ev.Type, "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+package bstoken
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+// tokens is an in-memory Bootstrap Token store.
+type tokens map[string][]byte
+
+func (t tokens) StoreBootstrapToken(r *mdm.Request, msg *mdm.SetBootstrapToken) error {
+	t[r.ID] = msg.BootstrapToken.BootstrapToken
+	return nil
+}
+
+func (t tokens) RetrieveBootstrapToken(r *mdm.Request, _ *mdm.GetBootstrapToken) (*mdm.BootstrapToken, error) {
+	return &mdm.BootstrapToken{BootstrapToken: t[r.ID]}, nil
+}
+
+type sink struct{ types []string }
+
+func (s *sink) Send(_ context.Context, e *event.Event) error {
+	s.types = append(s.types, e.Type)
+	return nil
+}
+
+func TestEscrow(t *testing.T) {
+	ctx := context.Background()
+	toks := make(tokens)
+	evs := new(sink)
+	now := time.Unix(1700000000, 0)
+	e := New(toks, NewKVStore(kvmap.New()), WithSink(evs), WithClock(clock.NewFake(now)))
+
+	msg := &mdm.SetBootstrapToken{BootstrapToken: mdm.BootstrapToken{BootstrapToken: []byte("token")}}
+	r := request(ctx, "A")
+	if err := toks.StoreBootstrapToken(r, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetBootstrapToken(r, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := e.Status(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Escrowed || !s.EscrowedAt.Equal(now) {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	if err = e.Clear(ctx, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = e.Status(ctx, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Escrowed {
+		t.Error("expected cleared token")
+	}
+	if len(evs.types) != 2 || evs.types[0] != event.TypeBootstrapTokenEscrowed || evs.types[1] != event.TypeBootstrapTokenCleared {
+		t.Errorf("unexpected events: %v", evs.types)
+	}
+}
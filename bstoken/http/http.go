@@ -0,0 +1,118 @@
+// Package http provides the HTTP API for escrowed Bootstrap Tokens.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/bstoken"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotEscrowed is returned when no token is escrowed.
+	ErrNotEscrowed = errors.New("no bootstrap token escrowed")
+)
+
+// Token is an escrowed Bootstrap Token.
+type Token struct {
+	ID             string `json:"id"`
+	BootstrapToken []byte `json:"bootstrap_token"`
+}
+
+// idFn returns an HTTP handler that requires the enrollment ID in the URL path.
+func idFn(logger log.Logger, next func(http.ResponseWriter, *http.Request, string, log.Logger)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		next(w, r, id, logger)
+	}
+}
+
+// GetStatusHandler returns whether a Bootstrap Token is escrowed for
+// the enrollment ID in the URL path.
+func GetStatusHandler(e *bstoken.Escrow, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil escrow")
+	}
+	return idFn(logger, func(w http.ResponseWriter, r *http.Request, id string, logger log.Logger) {
+		s, err := e.Status(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving bootstrap token status", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		httpapi.WriteJSON(w, s, logger)
+	})
+}
+
+// GetTokenHandler returns the escrowed Bootstrap Token of the
+// enrollment ID in the URL path.
+func GetTokenHandler(e *bstoken.Escrow, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil escrow")
+	}
+	return idFn(logger, func(w http.ResponseWriter, r *http.Request, id string, logger log.Logger) {
+		token, err := e.Token(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving bootstrap token", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if token == nil {
+			httpapi.JSONError(w, ErrNotEscrowed, http.StatusNotFound)
+			return
+		}
+		logger.Info("msg", "retrieved bootstrap token", "id", id)
+		httpapi.WriteJSON(w, &Token{ID: id, BootstrapToken: token}, logger)
+	})
+}
+
+// ClearHandler clears the escrowed Bootstrap Token of the enrollment ID
+// in the URL path.
+func ClearHandler(e *bstoken.Escrow, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil escrow")
+	}
+	return idFn(logger, func(w http.ResponseWriter, r *http.Request, id string, logger log.Logger) {
+		if err := e.Clear(r.Context(), id); err != nil {
+			logger.Info("msg", "clearing bootstrap token", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		logger.Info("msg", "cleared bootstrap token", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleAPIv1 registers the Bootstrap Token API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, e *bstoken.Escrow) {
+	mux.Handle(
+		prefix+"/bootstraptoken/:id",
+		GetStatusHandler(e, logger.With("handler", "get-bootstrap-token-status")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/bootstraptoken/:id/token",
+		GetTokenHandler(e, logger.With("handler", "get-bootstrap-token")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/bootstraptoken/:id",
+		ClearHandler(e, logger.With("handler", "clear-bootstrap-token")),
+		"DELETE",
+	)
+}
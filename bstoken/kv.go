@@ -0,0 +1,50 @@
+package bstoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores escrow times in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new escrow time store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreEscrowedAt stores the escrow time of enrollment id.
+func (s *KVStore) StoreEscrowedAt(ctx context.Context, id string, at time.Time) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	v, err := at.MarshalText()
+	if err != nil {
+		return fmt.Errorf("marshal time: %w", err)
+	}
+	return s.b.Set(ctx, id, v)
+}
+
+// RetrieveEscrowedAt retrieves the escrow time of enrollment id.
+func (s *KVStore) RetrieveEscrowedAt(ctx context.Context, id string) (time.Time, error) {
+	var at time.Time
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return at, nil
+	} else if err != nil {
+		return at, err
+	}
+	if err = at.UnmarshalText(v); err != nil {
+		return at, fmt.Errorf("unmarshal time: %w", err)
+	}
+	return at, nil
+}
@@ -0,0 +1,186 @@
+// Package capability gates MDM commands and declarations on the OS
+// platform and version of enrollments using a capability matrix.
+package capability
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Platforms of the capability matrix.
+const (
+	IOS      = "iOS" // includes iPadOS
+	MacOS    = "macOS"
+	TvOS     = "tvOS"
+	WatchOS  = "watchOS"
+	VisionOS = "visionOS"
+)
+
+// Kinds of capabilities.
+const (
+	KindCommand     = "command"
+	KindDeclaration = "declaration"
+)
+
+// PlatformOf returns the platform of an Apple product name
+// (e.g. "iPhone14,2" or "MacBookPro18,1").
+// An empty string is returned for unknown products.
+func PlatformOf(productName string) string {
+	switch {
+	case strings.HasPrefix(productName, "iPhone"),
+		strings.HasPrefix(productName, "iPad"),
+		strings.HasPrefix(productName, "iPod"):
+		return IOS
+	case strings.HasPrefix(productName, "AppleTV"):
+		return TvOS
+	case strings.HasPrefix(productName, "Watch"):
+		return WatchOS
+	case strings.HasPrefix(productName, "RealityDevice"):
+		return VisionOS
+	case strings.Contains(productName, "Mac"):
+		return MacOS
+	}
+	return ""
+}
+
+// CompareVersions compares dotted numeric versions a and b.
+// It returns -1 if a < b, 0 if a == b, and 1 if a > b.
+// Missing components are zero so "17" equals "17.0.0".
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = versionPart(as[i])
+		}
+		if i < len(bs) {
+			y = versionPart(bs[i])
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionPart returns the leading number of a version component.
+func versionPart(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n
+}
+
+// Requirement maps platforms to the minimum OS version supporting a
+// command or declaration. Platforms not present are unsupported.
+type Requirement map[string]string
+
+// Matrix is a capability matrix of commands and declarations.
+// Commands and declarations not in the matrix are always supported.
+type Matrix struct {
+	// Commands maps MDM command request types to requirements.
+	Commands map[string]Requirement `json:"commands"`
+
+	// Declarations maps declaration types to requirements.
+	Declarations map[string]Requirement `json:"declarations"`
+}
+
+// Check reports whether name of kind is supported by version of
+// platform. If not the reason is returned. Unknown platforms and
+// versions are supported.
+func (m *Matrix) Check(kind, name, platform, version string) (bool, string) {
+	var req Requirement
+	var ok bool
+	switch kind {
+	case KindCommand:
+		req, ok = m.Commands[name]
+	case KindDeclaration:
+		req, ok = m.Declarations[name]
+	}
+	if !ok || platform == "" || version == "" {
+		return true, ""
+	}
+	minVersion, ok := req[platform]
+	if !ok {
+		return false, fmt.Sprintf("%s %s is not supported on %s", kind, name, platform)
+	}
+	if CompareVersions(version, minVersion) < 0 {
+		return false, fmt.Sprintf("%s %s requires %s %s (have %s)", kind, name, platform, minVersion, version)
+	}
+	return true, ""
+}
+
+// Merge adds the requirements of o to m, replacing any existing
+// requirements for the same command or declaration.
+func (m *Matrix) Merge(o *Matrix) {
+	if m.Commands == nil {
+		m.Commands = make(map[string]Requirement)
+	}
+	if m.Declarations == nil {
+		m.Declarations = make(map[string]Requirement)
+	}
+	for k, v := range o.Commands {
+		m.Commands[k] = v
+	}
+	for k, v := range o.Declarations {
+		m.Declarations[k] = v
+	}
+}
+
+// ParseMatrix parses a JSON capability matrix and merges it over the
+// default matrix.
+func ParseMatrix(data []byte) (*Matrix, error) {
+	o := new(Matrix)
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, fmt.Errorf("unmarshal matrix: %w", err)
+	}
+	m := DefaultMatrix()
+	m.Merge(o)
+	return m, nil
+}
+
+// DefaultMatrix returns the built-in capability matrix.
+// It covers a selection of commands and declarations with
+// platform or OS version restrictions.
+func DefaultMatrix() *Matrix {
+	return &Matrix{
+		Commands: map[string]Requirement{
+			"DeclarativeManagement":  {IOS: "15.0", MacOS: "13.0", TvOS: "16.0", WatchOS: "10.0", VisionOS: "1.1"},
+			"ScheduleOSUpdate":       {IOS: "9.0", MacOS: "10.11", TvOS: "12.0"},
+			"ScheduleOSUpdateScan":   {IOS: "9.0", MacOS: "10.11", TvOS: "12.0"},
+			"AvailableOSUpdates":     {IOS: "9.0", MacOS: "10.11", TvOS: "12.0"},
+			"OSUpdateStatus":         {IOS: "9.0", MacOS: "10.11", TvOS: "12.0"},
+			"RestartDevice":          {IOS: "10.3", MacOS: "10.13", TvOS: "10.2"},
+			"ShutDownDevice":         {IOS: "10.3", MacOS: "10.13"},
+			"SetRecoveryLock":        {MacOS: "11.5"},
+			"VerifyRecoveryLock":     {MacOS: "11.5"},
+			"SetFirmwarePassword":    {MacOS: "10.13"},
+			"VerifyFirmwarePassword": {MacOS: "10.13"},
+			"EnableRemoteDesktop":    {MacOS: "10.14.4"},
+			"DisableRemoteDesktop":   {MacOS: "10.14.4"},
+			"RotateFileVaultKey":     {MacOS: "10.13"},
+			"UserList":               {IOS: "9.3", MacOS: "10.13"},
+			"LogOutUser":             {IOS: "9.3"},
+			"RefreshCellularPlans":   {IOS: "11.0"},
+			"LOMDeviceRequest":       {MacOS: "11.0"},
+			"LOMSetupRequest":        {MacOS: "11.0"},
+		},
+		Declarations: map[string]Requirement{
+			"com.apple.configuration.passcode.settings":                   {IOS: "15.0", MacOS: "13.0", VisionOS: "1.1"},
+			"com.apple.configuration.softwareupdate.enforcement.specific": {IOS: "17.0", MacOS: "14.0", VisionOS: "1.1"},
+			"com.apple.configuration.softwareupdate.settings":             {IOS: "18.0", MacOS: "15.0", VisionOS: "2.0"},
+			"com.apple.configuration.services.configuration-files":        {MacOS: "14.0"},
+			"com.apple.configuration.services.background-tasks":           {MacOS: "15.0"},
+			"com.apple.configuration.diskmanagement.settings":             {MacOS: "15.0"},
+			"com.apple.configuration.math.settings":                       {IOS: "18.0", MacOS: "15.0"},
+			"com.apple.configuration.safari.extensions.settings":          {IOS: "18.0", MacOS: "15.0", VisionOS: "2.0"},
+			"com.apple.configuration.screensharing.host.settings":         {MacOS: "14.0"},
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package capability
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"17.4.1", "17.0", 1},
+		{"17", "17.0.0", 0},
+		{"10.14.3", "10.14.4", -1},
+		{"16.7.2 (a)", "16.7.2", 0},
+	} {
+		if have := CompareVersions(test.a, test.b); have != test.want {
+			t.Errorf("%s vs %s: have: %v, want: %v", test.a, test.b, have, test.want)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	ctx := context.Background()
+	g := New(NewKVStore(kvmap.New()), DefaultMatrix(), WithEnforce())
+
+	for id, device := range map[string][2]string{
+		"MAC": {"MacBookPro18,1", "14.4"},
+		"OLD": {"iPhone10,1", "14.8"},
+		"NEW": {"iPhone14,2", "17.4"},
+	} {
+		raw, err := plist.Marshal(map[string]string{
+			"MessageType": "Authenticate",
+			"ProductName": device[0],
+			"OSVersion":   device[1],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := mdm.NewRequestWithContext(ctx, nil)
+		r.EnrollID = &mdm.EnrollID{ID: id}
+		if err = g.Authenticate(r, &mdm.Authenticate{Raw: raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		requestType string
+		want        []string
+	}{
+		{"DeclarativeManagement", []string{"MAC", "NEW", "UNKNOWN"}},
+		{"SetRecoveryLock", []string{"MAC", "UNKNOWN"}},
+		{"DeviceInformation", []string{"MAC", "OLD", "NEW", "UNKNOWN"}},
+	} {
+		ids, err := g.filter(ctx, []string{"MAC", "OLD", "NEW", "UNKNOWN"}, test.requestType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := len(ids), len(test.want); have != want {
+			t.Fatalf("%s: have: %v, want: %v", test.requestType, ids, test.want)
+		}
+		for i := range ids {
+			if have, want := ids[i], test.want[i]; have != want {
+				t.Errorf("%s: have: %v, want: %v", test.requestType, have, want)
+			}
+		}
+	}
+
+	if _, err := g.filter(ctx, []string{"OLD"}, "SetRecoveryLock"); err == nil {
+		t.Error("expected unsupported error")
+	}
+}
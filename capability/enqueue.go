@@ -0,0 +1,62 @@
+package capability
+
+import (
+	"context"
+	"fmt"
+)
+
+// DMCommandType is the request type of the Declarative Management command.
+const DMCommandType = "DeclarativeManagement"
+
+// Enqueuer enqueues MDM commands and sends APNs pushes.
+// It is satisfied by both the DM notifier and NanoCMD enqueuers.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, ids []string, rawCmd []byte) error
+	EnqueueDMCommand(ctx context.Context, ids []string, tokensJSON []byte) error
+	Push(ctx context.Context, ids []string) error
+	SupportsMultiCommands() bool
+}
+
+// Wrap returns an enqueuer that checks commands against the
+// capability matrix before enqueuing them with next.
+func (g *Gate) Wrap(next Enqueuer) Enqueuer {
+	if next == nil {
+		panic("nil enqueuer")
+	}
+	return &gatedEnqueuer{Enqueuer: next, g: g}
+}
+
+type gatedEnqueuer struct {
+	Enqueuer
+	g *Gate
+}
+
+// Enqueue checks the command for ids and enqueues it.
+func (e *gatedEnqueuer) Enqueue(ctx context.Context, ids []string, rawCmd []byte) error {
+	requestType, err := RequestType(rawCmd)
+	if err != nil {
+		return fmt.Errorf("parsing command: %w", err)
+	}
+	if ids, err = e.g.filter(ctx, ids, requestType); err != nil {
+		return err
+	}
+	return e.Enqueuer.Enqueue(ctx, ids, rawCmd)
+}
+
+// EnqueueDMCommand checks the Declarative Management command for ids
+// and enqueues it. The declarations of the enrollments are checked and
+// unsupported declarations are logged.
+func (e *gatedEnqueuer) EnqueueDMCommand(ctx context.Context, ids []string, tokensJSON []byte) error {
+	ids, err := e.g.filter(ctx, ids, DMCommandType)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		warnings, err := e.g.CheckDeclarations(ctx, id)
+		if err != nil {
+			return fmt.Errorf("checking declarations of %s: %w", id, err)
+		}
+		e.g.logWarnings(ctx, warnings)
+	}
+	return e.Enqueuer.EnqueueDMCommand(ctx, ids, tokensJSON)
+}
@@ -0,0 +1,308 @@
+package capability
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/plist"
+)
+
+// ErrUnsupported is returned when no targeted enrollment supports a command.
+var ErrUnsupported = errors.New("unsupported by enrollment OS")
+
+// Device is the OS platform and version of an enrollment.
+type Device struct {
+	ID           string    `json:"id"`
+	Platform     string    `json:"platform,omitempty"`
+	ProductName  string    `json:"product_name,omitempty"`
+	OSVersion    string    `json:"os_version,omitempty"`
+	BuildVersion string    `json:"build_version,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Store stores device OS versions.
+type Store interface {
+	StoreDevice(ctx context.Context, d *Device) error
+
+	// RetrieveDevice retrieves the device id.
+	// Nil is returned if the device is unknown.
+	RetrieveDevice(ctx context.Context, id string) (*Device, error)
+}
+
+// DeclarationStore retrieves the declarations of enrollments.
+type DeclarationStore interface {
+	RetrieveDeclarationItems(ctx context.Context, enrollmentID string) ([]*ddm.Declaration, error)
+}
+
+// Warning is an unsupported command or declaration for an enrollment.
+type Warning struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Gate checks commands and declarations against the capability matrix
+// using the OS versions of enrollments. It is also a NanoMDM service
+// that records OS versions from Authenticate check-ins and
+// DeviceInformation command responses.
+type Gate struct {
+	service.CheckinAndCommandService
+
+	store   Store
+	matrix  *Matrix
+	decls   DeclarationStore
+	enforce bool
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the gate.
+type Option func(*Gate)
+
+// WithEnforce prevents commands from being enqueued to enrollments
+// that don't support them. Otherwise unsupported commands only log
+// warnings.
+func WithEnforce() Option {
+	return func(g *Gate) {
+		g.enforce = true
+	}
+}
+
+// WithDeclarationStore checks the declarations of enrollments when
+// they are notified of declaration changes.
+func WithDeclarationStore(s DeclarationStore) Option {
+	return func(g *Gate) {
+		g.decls = s
+	}
+}
+
+// WithLogger configures a logger for the gate.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(g *Gate) {
+		g.logger = logger
+	}
+}
+
+// WithClock configures the clock used for device timestamps.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(g *Gate) {
+		g.clock = c
+	}
+}
+
+// New creates a new gate using store and matrix.
+func New(store Store, matrix *Matrix, opts ...Option) *Gate {
+	if store == nil {
+		panic("nil store")
+	}
+	if matrix == nil {
+		panic("nil matrix")
+	}
+	g := &Gate{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		matrix:                   matrix,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Matrix returns the capability matrix of the gate.
+func (g *Gate) Matrix() *Matrix {
+	return g.matrix
+}
+
+// Enforcing reports whether the gate prevents unsupported commands.
+func (g *Gate) Enforcing() bool {
+	return g.enforce
+}
+
+// deviceID returns the device channel ID of an enrollment ID.
+// User channel enrollments share the OS of their device.
+func deviceID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// Device retrieves the OS of enrollment id.
+func (g *Gate) Device(ctx context.Context, id string) (*Device, error) {
+	return g.store.RetrieveDevice(ctx, deviceID(id))
+}
+
+// Check checks name of kind for enrollments ids. It returns the
+// supported IDs and a warning for every unsupported ID.
+// Enrollments with an unknown OS are supported.
+func (g *Gate) Check(ctx context.Context, ids []string, kind, name string) ([]string, []*Warning, error) {
+	supported := make([]string, 0, len(ids))
+	var warnings []*Warning
+	for _, id := range ids {
+		d, err := g.Device(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("retrieving device %s: %w", id, err)
+		}
+		if d == nil {
+			supported = append(supported, id)
+			continue
+		}
+		if ok, reason := g.matrix.Check(kind, name, d.Platform, d.OSVersion); ok {
+			supported = append(supported, id)
+		} else {
+			warnings = append(warnings, &Warning{ID: id, Kind: kind, Name: name, Reason: reason})
+		}
+	}
+	return supported, warnings, nil
+}
+
+// CheckDeclarations checks the declarations of enrollment id.
+// The gate must be configured with a declaration store.
+func (g *Gate) CheckDeclarations(ctx context.Context, id string) ([]*Warning, error) {
+	if g.decls == nil {
+		return nil, nil
+	}
+	d, err := g.Device(ctx, id)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	decls, err := g.decls.RetrieveDeclarationItems(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declarations: %w", err)
+	}
+	var warnings []*Warning
+	for _, decl := range decls {
+		if decl == nil {
+			continue
+		}
+		if ok, reason := g.matrix.Check(KindDeclaration, decl.Type, d.Platform, d.OSVersion); !ok {
+			warnings = append(warnings, &Warning{ID: id, Kind: KindDeclaration, Name: decl.Identifier, Reason: reason})
+		}
+	}
+	return warnings, nil
+}
+
+// logWarnings logs warnings.
+func (g *Gate) logWarnings(ctx context.Context, warnings []*Warning) {
+	logger := ctxlog.Logger(ctx, g.logger)
+	for _, w := range warnings {
+		logger.Info("msg", "unsupported", "id", w.ID, "kind", w.Kind, "name", w.Name, "reason", w.Reason, "enforced", g.enforce && w.Kind == KindCommand)
+	}
+}
+
+// filter checks the command requestType for ids and logs warnings.
+// When enforcing only the supported IDs are returned.
+func (g *Gate) filter(ctx context.Context, ids []string, requestType string) ([]string, error) {
+	supported, warnings, err := g.Check(ctx, ids, KindCommand, requestType)
+	if err != nil {
+		return nil, err
+	}
+	g.logWarnings(ctx, warnings)
+	if !g.enforce {
+		return ids, nil
+	}
+	if len(supported) < 1 && len(ids) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, requestType)
+	}
+	return supported, nil
+}
+
+// RequestType returns the request type of the raw MDM command.
+func RequestType(rawCmd []byte) (string, error) {
+	cmd := new(struct {
+		Command struct {
+			RequestType string
+		}
+	})
+	if err := plist.Unmarshal(rawCmd, cmd); err != nil {
+		return "", err
+	}
+	return cmd.Command.RequestType, nil
+}
+
+func (g *Gate) storeDevice(r *mdm.Request, productName, osVersion, buildVersion string) error {
+	if r.ID == "" || osVersion == "" {
+		return nil
+	}
+	d, err := g.store.RetrieveDevice(r.Context(), deviceID(r.ID))
+	if err != nil {
+		return fmt.Errorf("retrieving device: %w", err)
+	}
+	if d == nil {
+		d = &Device{ID: deviceID(r.ID)}
+	}
+	// responses may not include every field
+	if productName != "" {
+		d.ProductName = productName
+		d.Platform = PlatformOf(productName)
+	}
+	if buildVersion != "" {
+		d.BuildVersion = buildVersion
+	}
+	d.OSVersion = osVersion
+	d.UpdatedAt = g.clock.Now()
+	if err = g.store.StoreDevice(r.Context(), d); err != nil {
+		return fmt.Errorf("storing device: %w", err)
+	}
+	ctxlog.Logger(r.Context(), g.logger).Debug("msg", "stored device OS", "id", d.ID, "platform", d.Platform, "os_version", d.OSVersion)
+	return nil
+}
+
+// Authenticate records the OS of the device.
+// NanoMDM doesn't parse these optional Authenticate fields so they are
+// read from the raw message.
+func (g *Gate) Authenticate(r *mdm.Request, msg *mdm.Authenticate) error {
+	if msg == nil || len(msg.Raw) < 1 {
+		return nil
+	}
+	auth := new(struct {
+		ProductName  string
+		OSVersion    string
+		BuildVersion string
+	})
+	if err := plist.Unmarshal(msg.Raw, auth); err != nil {
+		return fmt.Errorf("unmarshal authenticate: %w", err)
+	}
+	return g.storeDevice(r, auth.ProductName, auth.OSVersion, auth.BuildVersion)
+}
+
+// CommandAndReportResults records the OS of the device from
+// DeviceInformation command responses.
+func (g *Gate) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results == nil || !bytes.Contains(results.Raw, []byte("<key>QueryResponses</key>")) {
+		return nil, nil
+	}
+	resp := new(struct {
+		QueryResponses struct {
+			OSVersion    string
+			ProductName  string
+			BuildVersion string
+		}
+	})
+	if err := plist.Unmarshal(results.Raw, resp); err != nil {
+		return nil, fmt.Errorf("unmarshal query responses: %w", err)
+	}
+	q := resp.QueryResponses
+	return nil, g.storeDevice(r, q.ProductName, q.OSVersion, q.BuildVersion)
+}
@@ -0,0 +1,78 @@
+package capability
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// WarningHeader is the HTTP response header of capability warnings.
+const WarningHeader = "X-NanoHUB-Capability-Warning"
+
+// EnqueueMiddleware wraps the NanoMDM command enqueue API handler.
+// Commands unsupported by targeted enrollments add a warning header to
+// the response. When enforcing the request is rejected instead.
+func EnqueueMiddleware(g *Gate, logger log.Logger) func(http.Handler) http.Handler {
+	if g == nil {
+		panic("nil gate")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.URL.Path, "/enqueue/") || r.Body == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			logger := ctxlog.Logger(r.Context(), logger)
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				httpapi.JSONError(w, fmt.Errorf("reading body: %w", err), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			requestType, err := RequestType(body)
+			if err != nil || requestType == "" {
+				// let the enqueue API report invalid commands
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// the enqueue API takes comma-separated IDs as the last path element
+			var ids []string
+			for _, id := range strings.Split(path.Base(r.URL.Path), ",") {
+				if id != "" {
+					ids = append(ids, id)
+				}
+			}
+			_, warnings, err := g.Check(r.Context(), ids, KindCommand, requestType)
+			if err != nil {
+				logger.Info("msg", "checking capabilities", "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			g.logWarnings(r.Context(), warnings)
+
+			if len(warnings) > 0 && g.enforce {
+				reasons := make([]string, 0, len(warnings))
+				for _, warning := range warnings {
+					reasons = append(reasons, warning.ID+": "+warning.Reason)
+				}
+				httpapi.JSONError(w, fmt.Errorf("%w: %s", ErrUnsupported, strings.Join(reasons, "; ")), http.StatusBadRequest)
+				return
+			}
+			for _, warning := range warnings {
+				w.Header().Add(WarningHeader, warning.ID+": "+warning.Reason)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
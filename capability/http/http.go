@@ -0,0 +1,96 @@
+// Package http provides the HTTP API for the capability matrix.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// Enrollment is the capability check result of an enrollment.
+type Enrollment struct {
+	Device   *capability.Device    `json:"device"`
+	Warnings []*capability.Warning `json:"warnings,omitempty"`
+}
+
+// GetMatrixHandler returns the capability matrix.
+func GetMatrixHandler(g *capability.Gate, logger log.Logger) http.HandlerFunc {
+	if g == nil {
+		panic("nil gate")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpapi.WriteJSON(w, g.Matrix(), ctxlog.Logger(r.Context(), logger))
+	}
+}
+
+// GetEnrollmentHandler returns the OS of the enrollment ID in the URL
+// path. Its assigned declarations are checked. Commands given with the
+// command query parameter are also checked.
+func GetEnrollmentHandler(g *capability.Gate, logger log.Logger) http.HandlerFunc {
+	if g == nil {
+		panic("nil gate")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		d, err := g.Device(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving device", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		ret := &Enrollment{Device: d}
+
+		for _, cmd := range r.URL.Query()["command"] {
+			_, warnings, err := g.Check(r.Context(), []string{id}, capability.KindCommand, cmd)
+			if err != nil {
+				logger.Info("msg", "checking command", "id", id, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			ret.Warnings = append(ret.Warnings, warnings...)
+		}
+
+		warnings, err := g.CheckDeclarations(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "checking declarations", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		ret.Warnings = append(ret.Warnings, warnings...)
+
+		httpapi.WriteJSON(w, ret, logger)
+	}
+}
+
+// HandleAPIv1 registers the capability API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, g *capability.Gate) {
+	mux.Handle(
+		prefix+"/capabilities",
+		GetMatrixHandler(g, logger.With("handler", "get-capabilities")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/capabilities/:id",
+		GetEnrollmentHandler(g, logger.With("handler", "get-enrollment-capabilities")),
+		"GET",
+	)
+}
@@ -0,0 +1,50 @@
+package capability
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores device OS versions in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new device store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreDevice stores d.
+func (s *KVStore) StoreDevice(ctx context.Context, d *Device) error {
+	if d == nil || d.ID == "" {
+		return errors.New("invalid device")
+	}
+	v, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("marshal device: %w", err)
+	}
+	return s.b.Set(ctx, d.ID, v)
+}
+
+// RetrieveDevice retrieves the device id.
+func (s *KVStore) RetrieveDevice(ctx context.Context, id string) (*Device, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d := new(Device)
+	if err = json.Unmarshal(v, d); err != nil {
+		return nil, fmt.Errorf("unmarshal device: %w", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,254 @@
+// Package census records daily aggregate snapshots of the fleet.
+// Snapshots count devices by model, OS version, compliance, and DM set
+// to provide historical trends without external analytics.
+package census
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/authpolicy"
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DateLayout is the layout of snapshot dates.
+const DateLayout = "2006-01-02"
+
+// ErrInvalidDate is returned for dates not in DateLayout.
+var ErrInvalidDate = errors.New("invalid date")
+
+// Compliance counts the devices passing and failing a compliance check.
+type Compliance struct {
+	Compliant    int `json:"compliant"`
+	NonCompliant int `json:"noncompliant"`
+}
+
+// Snapshot is the fleet census of a day.
+// Devices are the enrollments with DeviceInformation responses.
+type Snapshot struct {
+	Date    string    `json:"date"`
+	TakenAt time.Time `json:"taken_at"`
+	Devices int       `json:"devices"`
+
+	Models     map[string]int `json:"models"`
+	OSVersions map[string]int `json:"os_versions"`
+
+	// Compliance counts devices by compliance check name (e.g. "filevault").
+	// Devices without a SecurityInfo response are counted in Unknown.
+	Compliance map[string]*Compliance `json:"compliance"`
+	Unknown    int                    `json:"compliance_unknown"`
+
+	// Sets counts enrollments by DM set. Nil if DM is not available.
+	Sets map[string]int `json:"sets,omitempty"`
+}
+
+// Store stores snapshots by date.
+type Store interface {
+	StoreSnapshot(ctx context.Context, s *Snapshot) error
+
+	// RetrieveSnapshots retrieves the snapshots from since to until
+	// (inclusive) sorted by date. Empty dates are not limited.
+	RetrieveSnapshots(ctx context.Context, since, until string) ([]*Snapshot, error)
+}
+
+// ResponseStore retrieves command responses of all enrollments.
+type ResponseStore interface {
+	RetrieveResponsesByType(ctx context.Context, requestType string) (map[string]*cmdresponse.Response, error)
+}
+
+// SetStore retrieves DM sets and their enrollments.
+type SetStore interface {
+	RetrieveSets(ctx context.Context) ([]string, error)
+	RetrieveEnrollmentIDs(ctx context.Context, declarations []string, sets []string, ids []string) ([]string, error)
+}
+
+// checks are the compliance checks counted in snapshots.
+var checks = map[string]authpolicy.Check{
+	"passcode":  authpolicy.Passcode,
+	"filevault": authpolicy.FileVault,
+	"sip":       authpolicy.SIP,
+}
+
+// Census takes fleet snapshots.
+type Census struct {
+	store     Store
+	responses ResponseStore
+	sets      SetStore
+	logger    log.Logger
+	clock     clock.Clock
+}
+
+// Option configures the census.
+type Option func(*Census)
+
+// WithSets counts enrollments by the DM sets in store.
+func WithSets(store SetStore) Option {
+	return func(c *Census) {
+		c.sets = store
+	}
+}
+
+// WithLogger configures a logger for the census.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(c *Census) {
+		c.logger = logger
+	}
+}
+
+// WithClock configures the clock of the census.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(cs *Census) {
+		cs.clock = c
+	}
+}
+
+// New creates a new census storing snapshots in store.
+func New(store Store, responses ResponseStore, opts ...Option) *Census {
+	if store == nil {
+		panic("nil store")
+	}
+	if responses == nil {
+		panic("nil response store")
+	}
+	c := &Census{
+		store:     store,
+		responses: responses,
+		logger:    log.NopLogger,
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Take takes and stores a snapshot of the fleet.
+// It replaces any earlier snapshot of the same (UTC) day.
+func (c *Census) Take(ctx context.Context) (*Snapshot, error) {
+	now := c.clock.Now()
+	s := &Snapshot{
+		Date:       now.UTC().Format(DateLayout),
+		TakenAt:    now,
+		Models:     make(map[string]int),
+		OSVersions: make(map[string]int),
+		Compliance: make(map[string]*Compliance),
+	}
+
+	devInfos, err := c.responses.RetrieveResponsesByType(ctx, cmdresponse.DeviceInformationType)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving device information: %w", err)
+	}
+	secInfos, err := c.responses.RetrieveResponsesByType(ctx, cmdresponse.SecurityInfoType)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving security info: %w", err)
+	}
+	for name := range checks {
+		s.Compliance[name] = new(Compliance)
+	}
+
+	for id, r := range devInfos {
+		di := r.DeviceInformation
+		if di == nil {
+			continue
+		}
+		s.Devices++
+		if model := di.ModelName; model != "" {
+			s.Models[model]++
+		} else if di.Model != "" {
+			s.Models[di.Model]++
+		}
+		if di.OSVersion != "" {
+			s.OSVersions[strings.TrimSpace(capability.PlatformOf(di.ProductName)+" "+di.OSVersion)]++
+		}
+
+		si := secInfos[id]
+		if si == nil || si.SecurityInfo == nil {
+			s.Unknown++
+			continue
+		}
+		for name, check := range checks {
+			if check(si.SecurityInfo) {
+				s.Compliance[name].Compliant++
+			} else {
+				s.Compliance[name].NonCompliant++
+			}
+		}
+	}
+
+	if c.sets != nil {
+		if s.Sets, err = c.countSets(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = c.store.StoreSnapshot(ctx, s); err != nil {
+		return nil, fmt.Errorf("storing snapshot: %w", err)
+	}
+	ctxlog.Logger(ctx, c.logger).Debug("msg", "took census", "date", s.Date, "devices", s.Devices)
+	return s, nil
+}
+
+// countSets counts the enrollments of each DM set.
+func (c *Census) countSets(ctx context.Context) (map[string]int, error) {
+	names, err := c.sets.RetrieveSets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving sets: %w", err)
+	}
+	counts := make(map[string]int, len(names))
+	for _, name := range names {
+		ids, err := c.sets.RetrieveEnrollmentIDs(ctx, nil, []string{name}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving enrollments of set %s: %w", name, err)
+		}
+		counts[name] = len(ids)
+	}
+	return counts, nil
+}
+
+// Snapshots returns the snapshots from since to until (inclusive).
+// Empty dates are not limited.
+func (c *Census) Snapshots(ctx context.Context, since, until string) ([]*Snapshot, error) {
+	for _, d := range []string{since, until} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse(DateLayout, d); err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDate, d)
+		}
+	}
+	return c.store.RetrieveSnapshots(ctx, since, until)
+}
+
+// Run takes a snapshot every interval until ctx is done.
+func (c *Census) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Take(ctx); err != nil {
+			ctxlog.Logger(ctx, c.logger).Info("msg", "taking census", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package census
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+type responses map[string]map[string]*cmdresponse.Response
+
+func (r responses) RetrieveResponsesByType(_ context.Context, requestType string) (map[string]*cmdresponse.Response, error) {
+	return r[requestType], nil
+}
+
+func TestCensus(t *testing.T) {
+	ctx := context.Background()
+	resps := responses{
+		cmdresponse.DeviceInformationType: {
+			"A": {DeviceInformation: &cmdresponse.DeviceInformation{ModelName: "MacBook Pro", ProductName: "Mac15,3", OSVersion: "14.4"}},
+			"B": {DeviceInformation: &cmdresponse.DeviceInformation{ModelName: "iPhone", ProductName: "iPhone15,2", OSVersion: "17.4"}},
+		},
+		cmdresponse.SecurityInfoType: {
+			"A": {SecurityInfo: &cmdresponse.SecurityInfo{FDEEnabled: true}},
+		},
+	}
+	c := clock.NewFake(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	cs := New(NewKVStore(kvmap.New()), resps, WithClock(c))
+
+	if _, err := cs.Take(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(24 * time.Hour)
+	s, err := cs.Take(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Devices != 2 || s.Models["MacBook Pro"] != 1 || s.OSVersions["macOS 14.4"] != 1 || s.OSVersions["iOS 17.4"] != 1 {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+	if fv := s.Compliance["filevault"]; fv.Compliant != 1 || fv.NonCompliant != 0 || s.Unknown != 1 {
+		t.Errorf("unexpected compliance: %+v, unknown: %d", fv, s.Unknown)
+	}
+
+	snaps, err := cs.Snapshots(ctx, "2024-03-02", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Date != "2024-03-02" {
+		t.Errorf("unexpected snapshots: %v", snaps)
+	}
+	if _, err = cs.Snapshots(ctx, "yesterday", ""); err == nil {
+		t.Error("expected invalid date error")
+	}
+}
@@ -0,0 +1,73 @@
+// Package http provides the HTTP API for fleet census snapshots.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/census"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// GetSnapshotsHandler returns the census snapshots between the "since"
+// and "until" (YYYY-MM-DD, inclusive) query parameters.
+func GetSnapshotsHandler(c *census.Census, logger log.Logger) http.HandlerFunc {
+	if c == nil {
+		panic("nil census")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := r.URL.Query()
+		snaps, err := c.Snapshots(r.Context(), q.Get("since"), q.Get("until"))
+		if errors.Is(err, census.ErrInvalidDate) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving snapshots", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, snaps, logger)
+	}
+}
+
+// TakeSnapshotHandler takes a census snapshot now and returns it.
+func TakeSnapshotHandler(c *census.Census, logger log.Logger) http.HandlerFunc {
+	if c == nil {
+		panic("nil census")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		snap, err := c.Take(r.Context())
+		if err != nil {
+			logger.Info("msg", "taking census", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, snap, logger)
+	}
+}
+
+// HandleAPIv1 registers the census API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, c *census.Census) {
+	mux.Handle(
+		prefix+"/census",
+		GetSnapshotsHandler(c, logger.With("handler", "get-census")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/census",
+		TakeSnapshotHandler(c, logger.With("handler", "take-census")),
+		"POST",
+	)
+}
@@ -0,0 +1,64 @@
+package census
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores snapshots in a key-value bucket keyed by date.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new snapshot store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreSnapshot stores s, replacing any snapshot of the same date.
+func (s *KVStore) StoreSnapshot(ctx context.Context, snap *Snapshot) error {
+	if snap == nil || snap.Date == "" {
+		return errors.New("invalid snapshot")
+	}
+	v, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	return s.b.Set(ctx, snap.Date, v)
+}
+
+// RetrieveSnapshots retrieves the snapshots from since to until (inclusive).
+// Dates sort lexically so they are compared as strings.
+func (s *KVStore) RetrieveSnapshots(ctx context.Context, since, until string) ([]*Snapshot, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	snaps := make([]*Snapshot, 0, len(keys))
+	for _, k := range keys {
+		if (since != "" && k < since) || (until != "" && k > until) {
+			continue
+		}
+		v, err := s.b.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return snaps, err
+		}
+		snap := new(Snapshot)
+		if err = json.Unmarshal(v, snap); err != nil {
+			return snaps, fmt.Errorf("unmarshal snapshot %s: %w", k, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
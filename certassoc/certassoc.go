@@ -0,0 +1,241 @@
+// Package certassoc manages the associations of MDM client identity
+// certificates with enrollments.
+//
+// NanoMDM's certificate authentication associates the hash of the
+// identity certificate of an enrollment when it enrolls. Its storage
+// can only look up the enrollment of a hash. This package records the
+// associations so they can be looked up by enrollment, associates
+// hashes manually (e.g. for migrations), and revokes associations to
+// force enrollments to authenticate again.
+package certassoc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+var (
+	// ErrNotFound is returned when an enrollment has no association.
+	ErrNotFound = errors.New("no certificate association")
+
+	// ErrInvalidHash is returned for hashes that aren't hex SHA-256 hashes.
+	ErrInvalidHash = errors.New("invalid certificate hash")
+)
+
+// Record is the recorded certificate association of an enrollment.
+type Record struct {
+	ID string `json:"id"`
+
+	// Hash is the hex SHA-256 hash of the associated certificate.
+	// It is empty for associations made before they were recorded.
+	Hash         string     `json:"hash,omitempty"`
+	AssociatedAt *time.Time `json:"associated_at,omitempty"`
+
+	// RevokedAt is when the association was revoked.
+	// Enrollments must authenticate (enroll) again with a new
+	// certificate after a revocation.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Association is the certificate association of an enrollment.
+type Association struct {
+	*Record
+
+	// Associated reports whether the storage has any certificate
+	// associated with the enrollment, including revoked ones.
+	Associated bool `json:"associated"`
+}
+
+// Store is NanoMDM storage that records certificate associations in a
+// bucket and rejects revoked associations.
+type Store struct {
+	storage.AllStorage
+
+	bucket kv.Bucket
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the store.
+type Option func(*Store)
+
+// WithLogger configures a logger for the store.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the store.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Store) {
+		s.clock = c
+	}
+}
+
+// New creates a new store for store that records associations in bucket.
+func New(store storage.AllStorage, bucket kv.Bucket, opts ...Option) *Store {
+	if store == nil {
+		panic("nil store")
+	}
+	if bucket == nil {
+		panic("nil bucket")
+	}
+	s := &Store{
+		AllStorage: store,
+		bucket:     bucket,
+		logger:     log.NopLogger,
+		clock:      clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// retrieveRecord retrieves the record of id.
+// Nil is returned if id has no record.
+func (s *Store) retrieveRecord(ctx context.Context, id string) (*Record, error) {
+	v, err := s.bucket.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Record)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal record: %w", err)
+	}
+	return r, nil
+}
+
+// storeRecord stores r, replacing the record of r.ID.
+func (s *Store) storeRecord(ctx context.Context, r *Record) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	return s.bucket.Set(ctx, r.ID, v)
+}
+
+// IsCertHashAssociated checks that r.ID is associated with hash.
+// Revoked associations are not associated.
+func (s *Store) IsCertHashAssociated(r *mdm.Request, hash string) (bool, error) {
+	rec, err := s.retrieveRecord(r.Context(), r.ID)
+	if err != nil {
+		return false, fmt.Errorf("retrieving association record: %w", err)
+	}
+	if rec != nil && rec.RevokedAt != nil {
+		return false, nil
+	}
+	return s.AllStorage.IsCertHashAssociated(r, hash)
+}
+
+// AssociateCertHash associates r.ID with hash and records the
+// association. Any revocation of r.ID is lifted.
+func (s *Store) AssociateCertHash(r *mdm.Request, hash string) error {
+	if err := s.AllStorage.AssociateCertHash(r, hash); err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	err := s.storeRecord(r.Context(), &Record{
+		ID:           r.ID,
+		Hash:         strings.ToLower(hash),
+		AssociatedAt: &now,
+	})
+	if err != nil {
+		return fmt.Errorf("storing association record: %w", err)
+	}
+	return nil
+}
+
+// newRequest creates a new request for enrollment id.
+func newRequest(ctx context.Context, id string) *mdm.Request {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+	return r
+}
+
+// Association retrieves the certificate association of id.
+// ErrNotFound is returned if id has neither a record nor an association.
+func (s *Store) Association(ctx context.Context, id string) (*Association, error) {
+	rec, err := s.retrieveRecord(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving association record: %w", err)
+	}
+	associated, err := s.AllStorage.EnrollmentHasCertHash(newRequest(ctx, id), "")
+	if err != nil {
+		return nil, fmt.Errorf("checking association: %w", err)
+	}
+	if rec == nil {
+		if !associated {
+			return nil, ErrNotFound
+		}
+		rec = &Record{ID: id}
+	}
+	return &Association{Record: rec, Associated: associated}, nil
+}
+
+// Enrollment retrieves the enrollment ID associated with hash.
+// An empty string is returned if hash has no association.
+func (s *Store) Enrollment(ctx context.Context, hash string) (string, error) {
+	return s.AllStorage.EnrollmentFromHash(ctx, strings.ToLower(hash))
+}
+
+// Associate associates id with the hex SHA-256 certificate hash, e.g.
+// after migrating an enrollment from another MDM server.
+func (s *Store) Associate(ctx context.Context, id, hash string) (*Association, error) {
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return nil, ErrInvalidHash
+	}
+	if err := s.AssociateCertHash(newRequest(ctx, id), strings.ToLower(hash)); err != nil {
+		return nil, err
+	}
+	ctxlog.Logger(ctx, s.logger).Info(
+		"msg", "associated certificate",
+		"id", id,
+		"hash", hash,
+	)
+	return s.Association(ctx, id)
+}
+
+// Revoke revokes the certificate association of id. Requests of id
+// are rejected until it authenticates again with a new certificate.
+func (s *Store) Revoke(ctx context.Context, id string) (*Association, error) {
+	a, err := s.Association(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if a.RevokedAt == nil {
+		now := s.clock.Now()
+		a.RevokedAt = &now
+		if err = s.storeRecord(ctx, a.Record); err != nil {
+			return nil, fmt.Errorf("storing association record: %w", err)
+		}
+		ctxlog.Logger(ctx, s.logger).Info(
+			"msg", "revoked certificate association",
+			"id", id,
+		)
+	}
+	return a, nil
+}
@@ -0,0 +1,85 @@
+package certassoc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+// certStore associates one hash per enrollment.
+type certStore struct {
+	storage.AllStorage
+	hashes map[string]string
+}
+
+func (s *certStore) EnrollmentHasCertHash(r *mdm.Request, _ string) (bool, error) {
+	_, ok := s.hashes[r.ID]
+	return ok, nil
+}
+
+func (s *certStore) IsCertHashAssociated(r *mdm.Request, hash string) (bool, error) {
+	return s.hashes[r.ID] == hash, nil
+}
+
+func (s *certStore) AssociateCertHash(r *mdm.Request, hash string) error {
+	s.hashes[r.ID] = hash
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	s := New(&certStore{hashes: map[string]string{"OLD": "aa"}}, kvmap.New())
+
+	req := func(id string) *mdm.Request {
+		r := mdm.NewRequestWithContext(ctx, nil)
+		r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+		return r
+	}
+
+	// associations made before recording have no hash
+	a, err := s.Association(ctx, "OLD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Associated || a.Hash != "" {
+		t.Errorf("unrecorded association: %+v", a.Record)
+	}
+	if _, err = s.Association(ctx, "NONE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have: %v, want: %v", err, ErrNotFound)
+	}
+
+	if _, err = s.Associate(ctx, "AAA", "xyz"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalidHash)
+	}
+	hash := strings.Repeat("0A", 32)
+	if a, err = s.Associate(ctx, "AAA", hash); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := a.Hash, strings.ToLower(hash); have != want {
+		t.Errorf("hash: have %q, want %q", have, want)
+	}
+	if ok, _ := s.IsCertHashAssociated(req("AAA"), a.Hash); !ok {
+		t.Error("expected association")
+	}
+
+	if _, err = s.Revoke(ctx, "AAA"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.IsCertHashAssociated(req("AAA"), a.Hash); ok {
+		t.Error("expected revoked association")
+	}
+
+	// authenticating again lifts the revocation
+	if err = s.AssociateCertHash(req("AAA"), "bb"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.IsCertHashAssociated(req("AAA"), "bb"); !ok {
+		t.Error("expected new association")
+	}
+}
@@ -0,0 +1,173 @@
+// Package http provides the HTTP API for certificate associations.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/certassoc"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNoHash is returned when no certificate hash is provided.
+	ErrNoHash = errors.New("no hash provided")
+)
+
+// writeAssociation writes the association a or the error err of
+// the operation described by msg.
+func writeAssociation(w http.ResponseWriter, a *certassoc.Association, err error, msg, id string, logger log.Logger) {
+	switch {
+	case errors.Is(err, certassoc.ErrNotFound):
+		httpapi.JSONError(w, err, http.StatusNotFound)
+	case errors.Is(err, certassoc.ErrInvalidHash):
+		httpapi.JSONError(w, err, http.StatusBadRequest)
+	case err != nil:
+		logger.Info("msg", msg, "id", id, "err", err)
+		httpapi.JSONError(w, err, 0)
+	default:
+		httpapi.WriteJSON(w, a, logger)
+	}
+}
+
+// GetAssociationHandler returns the certificate association of the
+// enrollment ID in the URL path.
+func GetAssociationHandler(s *certassoc.Store, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		a, err := s.Association(r.Context(), id)
+		writeAssociation(w, a, err, "retrieving association", id, logger)
+	}
+}
+
+// AssociateHandler associates the enrollment ID in the URL path with
+// the certificate hash in the JSON request body.
+func AssociateHandler(s *certassoc.Store, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Hash string `json:"hash"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding body: %w", err), http.StatusBadRequest)
+			return
+		}
+		if req.Hash == "" {
+			httpapi.JSONError(w, ErrNoHash, http.StatusBadRequest)
+			return
+		}
+
+		a, err := s.Associate(r.Context(), id, req.Hash)
+		writeAssociation(w, a, err, "associating certificate", id, logger)
+	}
+}
+
+// RevokeHandler revokes the certificate association of the enrollment
+// ID in the URL path.
+func RevokeHandler(s *certassoc.Store, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		a, err := s.Revoke(r.Context(), id)
+		writeAssociation(w, a, err, "revoking association", id, logger)
+	}
+}
+
+// GetEnrollmentHandler returns the enrollment ID associated with the
+// certificate hash in the URL path.
+func GetEnrollmentHandler(s *certassoc.Store, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		hash := flow.Param(r.Context(), "hash")
+		if hash == "" {
+			httpapi.JSONError(w, ErrNoHash, http.StatusBadRequest)
+			return
+		}
+
+		id, err := s.Enrollment(r.Context(), hash)
+		if err != nil {
+			logger.Info("msg", "retrieving enrollment", "hash", hash, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if id == "" {
+			httpapi.JSONError(w, certassoc.ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, map[string]string{"id": id, "hash": hash}, logger)
+	}
+}
+
+// HandleAPIv1 registers the certificate association API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, s *certassoc.Store) {
+	mux.Handle(
+		prefix+"/enrollments/:id/certauth",
+		GetAssociationHandler(s, logger.With("handler", "get-certauth")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/certauth",
+		AssociateHandler(s, logger.With("handler", "associate-certauth")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/certauth",
+		RevokeHandler(s, logger.With("handler", "revoke-certauth")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/certauth/:hash",
+		GetEnrollmentHandler(s, logger.With("handler", "get-certauth-enrollment")),
+		"GET",
+	)
+}
@@ -0,0 +1,230 @@
+// Package certexpiry tracks the expiry of MDM client identity
+// certificates and renews them before they expire.
+//
+// NanoMDM's certificate authentication only stores certificate hashes
+// so the service records the validity of the identity certificates
+// enrollments connect with. A renewal workflow installs a new
+// enrollment profile (with a SCEP or ACME identity payload) on
+// enrollments whose certificates expire soon.
+package certexpiry
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Record is the identity certificate of an enrollment.
+type Record struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic,omitempty"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// RenewalStartedAt is when the last renewal of this certificate
+	// started and RenewalInstanceID is its workflow instance.
+	RenewalStartedAt  *time.Time `json:"renewal_started_at,omitempty"`
+	RenewalInstanceID string     `json:"renewal_instance_id,omitempty"`
+
+	// RenewalStatus is the status of the renewal profile installation
+	// (e.g. "Acknowledged" or "Error") and RenewalError its error.
+	RenewalStatus string `json:"renewal_status,omitempty"`
+	RenewalError  string `json:"renewal_error,omitempty"`
+
+	// RenewedAt is when the enrollment first connected with this
+	// certificate after a renewal of its previous certificate.
+	RenewedAt *time.Time `json:"renewed_at,omitempty"`
+}
+
+// Store stores identity certificate records.
+type Store interface {
+	StoreRecord(ctx context.Context, r *Record) error
+
+	// RetrieveRecord retrieves the record of id.
+	// Nil is returned if id has no record.
+	RetrieveRecord(ctx context.Context, id string) (*Record, error)
+
+	// RetrieveRecords retrieves all records.
+	RetrieveRecords(ctx context.Context) ([]*Record, error)
+}
+
+// Expiring retrieves the records of certificates that expire before
+// before (including expired certificates) sorted by expiry.
+func Expiring(ctx context.Context, store Store, before time.Time) ([]*Record, error) {
+	records, err := store.RetrieveRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var expiring []*Record
+	for _, r := range records {
+		if r.NotAfter.Before(before) {
+			expiring = append(expiring, r)
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].NotAfter.Before(expiring[j].NotAfter) })
+	return expiring, nil
+}
+
+// Service is a NanoMDM service that records the identity certificates
+// of device channel enrollments. User channel enrollments share the
+// identity certificate of their device.
+type Service struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	logger log.Logger
+	clock  clock.Clock
+
+	// serials caches the last seen certificate serial by enrollment
+	// to avoid retrieving records for every command report.
+	mu      sync.Mutex
+	serials map[string]string
+}
+
+// Option configures the service.
+type Option func(*Service)
+
+// WithLogger configures a logger for the service.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the service.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// NewService creates a new certificate recording service.
+func NewService(store Store, opts ...Option) *Service {
+	if store == nil {
+		panic("nil store")
+	}
+	s := &Service{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+		serials:                  make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// serial returns the hex serial number of cert.
+func serial(cert *x509.Certificate) string {
+	if cert.SerialNumber == nil {
+		return ""
+	}
+	return cert.SerialNumber.Text(16)
+}
+
+// record records the identity certificate of the request.
+// The record is only stored if the certificate or topic changed.
+func (s *Service) record(r *mdm.Request, topic string) error {
+	if r.EnrollID == nil || r.ID == "" || r.ParentID != "" || r.Certificate == nil {
+		return nil
+	}
+	sn := serial(r.Certificate)
+	s.mu.Lock()
+	seen := s.serials[r.ID] == sn
+	s.mu.Unlock()
+	if seen && topic == "" {
+		return nil
+	}
+
+	ctx := r.Context()
+	prev, err := s.store.RetrieveRecord(ctx, r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving record: %w", err)
+	}
+	if prev != nil && prev.Serial == sn && (topic == "" || topic == prev.Topic) {
+		s.mu.Lock()
+		s.serials[r.ID] = sn
+		s.mu.Unlock()
+		return nil
+	}
+
+	now := s.clock.Now()
+	rec := &Record{
+		ID:        r.ID,
+		Topic:     topic,
+		Serial:    sn,
+		Subject:   r.Certificate.Subject.String(),
+		Issuer:    r.Certificate.Issuer.String(),
+		NotBefore: r.Certificate.NotBefore,
+		NotAfter:  r.Certificate.NotAfter,
+		UpdatedAt: now,
+	}
+	if prev != nil {
+		if rec.Topic == "" {
+			rec.Topic = prev.Topic
+		}
+		if prev.Serial == sn {
+			// only the topic changed
+			rec.RenewalStartedAt = prev.RenewalStartedAt
+			rec.RenewalInstanceID = prev.RenewalInstanceID
+			rec.RenewalStatus = prev.RenewalStatus
+			rec.RenewalError = prev.RenewalError
+			rec.RenewedAt = prev.RenewedAt
+		} else if prev.RenewalStartedAt != nil {
+			rec.RenewedAt = &now
+		}
+	}
+	if err = s.store.StoreRecord(ctx, rec); err != nil {
+		return fmt.Errorf("storing record: %w", err)
+	}
+	s.mu.Lock()
+	s.serials[r.ID] = sn
+	s.mu.Unlock()
+
+	ctxlog.Logger(ctx, s.logger).Debug(
+		"msg", "recorded identity certificate",
+		"id", r.ID,
+		"serial", sn,
+		"not_after", rec.NotAfter,
+		"renewed", rec.RenewedAt != nil,
+	)
+	return nil
+}
+
+// Authenticate records the identity certificate of the enrollment.
+func (s *Service) Authenticate(r *mdm.Request, m *mdm.Authenticate) error {
+	return s.record(r, m.Topic)
+}
+
+// TokenUpdate records the identity certificate of the enrollment.
+func (s *Service) TokenUpdate(r *mdm.Request, m *mdm.TokenUpdate) error {
+	return s.record(r, m.Topic)
+}
+
+// CommandAndReportResults records the identity certificate of the
+// enrollment. Renewed certificates are usually first seen here.
+func (s *Service) CommandAndReportResults(r *mdm.Request, _ *mdm.CommandResults) (*mdm.Command, error) {
+	return nil, s.record(r, "")
+}
@@ -0,0 +1,99 @@
+package certexpiry
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type enqueuer struct{ steps []*workflow.StepEnqueueing }
+
+func (e *enqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+// starter starts workflows on w.
+type starter struct{ w *Workflow }
+
+func (s *starter) StartWorkflow(ctx context.Context, _ string, _ []byte, ids []string, _ *workflow.Event, _ *workflow.MDMContext) (string, error) {
+	step := &workflow.StepStart{StepContext: workflow.StepContext{InstanceID: "inst1"}, IDs: ids}
+	return "inst1", s.w.Start(ctx, step)
+}
+
+func request(ctx context.Context, id string, serial int64, notAfter time.Time) *mdm.Request {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: id}
+	r.Certificate = &x509.Certificate{SerialNumber: big.NewInt(serial), NotAfter: notAfter}
+	return r
+}
+
+func TestRenewal(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	store := NewKVStore(kvmap.New())
+	s := NewService(store, WithClock(clk))
+
+	soon := clk.Now().Add(10 * 24 * time.Hour)
+	later := clk.Now().Add(365 * 24 * time.Hour)
+	if err := s.Authenticate(request(ctx, "ID1", 1, soon), &mdm.Authenticate{Topic: "topic1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CommandAndReportResults(request(ctx, "ID2", 2, later), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var topics []string
+	enq := new(enqueuer)
+	w, err := NewWorkflow(enq, store, func(_ context.Context, topic string) ([]byte, error) {
+		topics = append(topics, topic)
+		return []byte("<plist/>"), nil
+	}, WithWorkflowClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRenewer(store, &starter{w: w}, 30*24*time.Hour, WithRenewerClock(clk))
+
+	ids, err := r.Renew(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "ID1" || len(topics) != 1 || topics[0] != "topic1" || len(enq.steps) != 1 {
+		t.Fatalf("renew: ids: %v, topics: %v, steps: %d", ids, topics, len(enq.steps))
+	}
+	if _, ok := enq.steps[0].Commands[0].(*mdmcommands.InstallProfileCommand); !ok {
+		t.Error("incorrect command type")
+	}
+
+	// renewal started: not due again until the retry
+	if ids, err = r.Renew(ctx); err != nil || len(ids) != 0 {
+		t.Errorf("renew again: %v: %v", ids, err)
+	}
+
+	// the renewed certificate is recorded at the next connection
+	clk.Advance(time.Hour)
+	if _, err = s.CommandAndReportResults(request(ctx, "ID1", 3, later), nil); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := store.RetrieveRecord(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Serial != "3" || rec.Topic != "topic1" || rec.RenewedAt == nil || rec.RenewalStartedAt != nil {
+		t.Errorf("renewed record: %+v", rec)
+	}
+
+	expiring, err := Expiring(ctx, store, clk.Now().Add(30*24*time.Hour))
+	if err != nil || len(expiring) != 0 {
+		t.Errorf("expiring: %v: %v", expiring, err)
+	}
+}
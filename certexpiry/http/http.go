@@ -0,0 +1,105 @@
+// Package http provides the HTTP API for identity certificate expiry.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/certexpiry"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when an enrollment has no certificate record.
+	ErrNotFound = errors.New("no certificate record")
+)
+
+// GetCertificateHandler returns the identity certificate record of the
+// enrollment ID in the URL path.
+func GetCertificateHandler(store certexpiry.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		rec, err := store.RetrieveRecord(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving certificate record", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if rec == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, rec, logger)
+	}
+}
+
+// ExpiringHandler returns the identity certificate records that expire
+// within the duration of the "within" query parameter (default within)
+// sorted by expiry.
+func ExpiringHandler(store certexpiry.Store, within time.Duration, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		d := within
+		if v := r.URL.Query().Get("within"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil {
+				httpapi.JSONError(w, fmt.Errorf("parsing within: %w", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		records, err := certexpiry.Expiring(r.Context(), store, time.Now().Add(d))
+		if err != nil {
+			logger.Info("msg", "retrieving expiring certificates", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if records == nil {
+			records = []*certexpiry.Record{}
+		}
+
+		httpapi.WriteJSON(w, records, logger)
+	}
+}
+
+// HandleAPIv1 registers the certificate expiry API handlers into mux.
+// Within is the default expiry window of the expiring certificates.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store certexpiry.Store, within time.Duration) {
+	mux.Handle(
+		prefix+"/enrollments/:id/certificate",
+		GetCertificateHandler(store, logger.With("handler", "get-certificate")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/certificates/expiring",
+		ExpiringHandler(store, within, logger.With("handler", "expiring-certificates")),
+		"GET",
+	)
+}
@@ -0,0 +1,69 @@
+package certexpiry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores identity certificate records in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new record store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreRecord stores the identity certificate record of an enrollment.
+func (s *KVStore) StoreRecord(ctx context.Context, r *Record) error {
+	if r == nil || r.ID == "" {
+		return errors.New("invalid record")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	return s.b.Set(ctx, r.ID, v)
+}
+
+// RetrieveRecord retrieves the identity certificate record of id.
+func (s *KVStore) RetrieveRecord(ctx context.Context, id string) (*Record, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Record)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal record: %w", err)
+	}
+	return r, nil
+}
+
+// RetrieveRecords retrieves all identity certificate records.
+func (s *KVStore) RetrieveRecords(ctx context.Context) ([]*Record, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0, len(keys))
+	for _, k := range keys {
+		r, err := s.RetrieveRecord(ctx, k)
+		if err != nil {
+			return records, fmt.Errorf("retrieving record %s: %w", k, err)
+		}
+		if r != nil {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
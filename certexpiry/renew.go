@@ -0,0 +1,132 @@
+package certexpiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultRetry is the default time after which a renewal is started
+// again if the certificate still wasn't renewed.
+const DefaultRetry = 7 * 24 * time.Hour
+
+// WorkflowStarter starts workflows.
+type WorkflowStarter interface {
+	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+}
+
+// Renewer periodically starts the renewal workflow for enrollments
+// whose identity certificates expire soon.
+type Renewer struct {
+	store   Store
+	starter WorkflowStarter
+	window  time.Duration
+	retry   time.Duration
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// RenewerOption configures a Renewer.
+type RenewerOption func(*Renewer)
+
+// WithRetry starts renewals again if certificates still weren't
+// renewed after d. See [DefaultRetry].
+func WithRetry(d time.Duration) RenewerOption {
+	return func(r *Renewer) {
+		r.retry = d
+	}
+}
+
+// WithRenewerLogger configures a logger for the renewer.
+func WithRenewerLogger(logger log.Logger) RenewerOption {
+	return func(r *Renewer) {
+		r.logger = logger
+	}
+}
+
+// WithRenewerClock configures the clock of the renewer.
+func WithRenewerClock(c clock.Clock) RenewerOption {
+	return func(r *Renewer) {
+		r.clock = c
+	}
+}
+
+// NewRenewer creates a new renewer starting the renewal workflow with
+// starter for certificates that expire within window.
+func NewRenewer(store Store, starter WorkflowStarter, window time.Duration, opts ...RenewerOption) *Renewer {
+	if store == nil {
+		panic("nil store")
+	}
+	if starter == nil {
+		panic("nil starter")
+	}
+	r := &Renewer{
+		store:   store,
+		starter: starter,
+		window:  window,
+		retry:   DefaultRetry,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// due returns the enrollment IDs whose certificates are due for renewal.
+func (r *Renewer) due(ctx context.Context) ([]string, error) {
+	now := r.clock.Now()
+	expiring, err := Expiring(ctx, r.store, now.Add(r.window))
+	if err != nil {
+		return nil, fmt.Errorf("retrieving expiring certificates: %w", err)
+	}
+	var ids []string
+	for _, rec := range expiring {
+		if rec.RenewalStartedAt != nil && now.Sub(*rec.RenewalStartedAt) < r.retry {
+			continue
+		}
+		ids = append(ids, rec.ID)
+	}
+	return ids, nil
+}
+
+// Renew starts the renewal workflow for enrollments whose certificates
+// are due for renewal and returns their IDs.
+func (r *Renewer) Renew(ctx context.Context) ([]string, error) {
+	ids, err := r.due(ctx)
+	if err != nil || len(ids) < 1 {
+		return nil, err
+	}
+	instanceID, err := r.starter.StartWorkflow(ctx, WorkflowName, nil, ids, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting workflow: %w", err)
+	}
+	r.logger.Debug("msg", "started renewals", "instance_id", instanceID, "count", len(ids))
+	return ids, nil
+}
+
+// Run renews every interval until ctx is done.
+func (r *Renewer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if _, err := r.Renew(ctx); err != nil {
+				r.logger.Info("msg", "renewing certificates", "err", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package certexpiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/logkeys"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const WorkflowName = "io.micromdm.nanohub.wf.certrenew.v1"
+
+// ProfileFunc returns the enrollment profile that renews the identity
+// certificate of an enrollment with the push topic.
+// The topic is empty if the enrollment's topic is unknown.
+type ProfileFunc func(ctx context.Context, topic string) ([]byte, error)
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Workflow renews identity certificates by installing an updated
+// enrollment profile. The profile must have the same identifier,
+// server URL, and topic as the installed enrollment profile.
+type Workflow struct {
+	enq     workflow.StepEnqueuer
+	ider    IDer
+	store   Store
+	profile ProfileFunc
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// WorkflowOption configures the workflow.
+type WorkflowOption func(*Workflow)
+
+// WithWorkflowLogger configures a logger for the workflow.
+func WithWorkflowLogger(logger log.Logger) WorkflowOption {
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithIDer configures the command UUID generator.
+func WithIDer(ider IDer) WorkflowOption {
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithWorkflowClock configures the clock of the workflow.
+func WithWorkflowClock(c clock.Clock) WorkflowOption {
+	return func(w *Workflow) {
+		w.clock = c
+	}
+}
+
+// NewWorkflow creates a new renewal workflow installing profiles from
+// profile. Renewal progress is recorded in store.
+func NewWorkflow(q workflow.StepEnqueuer, store Store, profile ProfileFunc, opts ...WorkflowOption) (*Workflow, error) {
+	if q == nil {
+		return nil, errors.New("nil step enqueuer")
+	}
+	if store == nil {
+		return nil, errors.New("nil store")
+	}
+	if profile == nil {
+		return nil, errors.New("nil profile func")
+	}
+	w := &Workflow{
+		enq:     q,
+		ider:    uuid.NewUUID(),
+		store:   store,
+		profile: profile,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = w.logger.With(logkeys.WorkflowName, w.Name())
+	return w, nil
+}
+
+func (w *Workflow) Name() string {
+	return WorkflowName
+}
+
+func (w *Workflow) Config() *workflow.Config {
+	return nil
+}
+
+func (w *Workflow) NewContextValue(name string) workflow.ContextMarshaler {
+	return nil
+}
+
+// update updates the record of id with fn.
+// Enrollments without a record are not updated.
+func (w *Workflow) update(ctx context.Context, id string, fn func(*Record)) error {
+	rec, err := w.store.RetrieveRecord(ctx, id)
+	if err != nil || rec == nil {
+		return err
+	}
+	fn(rec)
+	return w.store.StoreRecord(ctx, rec)
+}
+
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	for _, id := range step.IDs {
+		rec, err := w.store.RetrieveRecord(ctx, id)
+		if err != nil {
+			return fmt.Errorf("retrieving record for %s: %w", id, err)
+		}
+		var topic string
+		if rec != nil {
+			topic = rec.Topic
+		}
+
+		// profiles may contain one-time SCEP challenges so each
+		// enrollment gets its own
+		profile, err := w.profile(ctx, topic)
+		if err != nil {
+			return fmt.Errorf("generating profile for %s: %w", id, err)
+		}
+
+		cmd := mdmcommands.NewInstallProfileCommand(w.ider.ID())
+		cmd.Command.Payload = profile
+
+		se := step.NewStepEnqueueing()
+		se.IDs = []string{id} // scope to just this ID we're iterating over
+		se.Commands = []interface{}{cmd}
+
+		if err = w.enq.EnqueueStep(ctx, w, se); err != nil {
+			return fmt.Errorf("enqueueing step for %s: %w", id, err)
+		}
+
+		now := w.clock.Now()
+		err = w.update(ctx, id, func(r *Record) {
+			r.RenewalStartedAt = &now
+			r.RenewalInstanceID = step.InstanceID
+			r.RenewalStatus = ""
+			r.RenewalError = ""
+		})
+		if err != nil {
+			return fmt.Errorf("updating record for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if len(stepResult.CommandResults) != 1 {
+		return workflow.ErrStepResultCommandLenMismatch
+	}
+	genResper, ok := stepResult.CommandResults[0].(mdmcommands.GenericResponser)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	response := genResper.GetGenericResponse()
+	validErr := response.Validate()
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "renewal profile installed",
+		"status", response.Status,
+	)
+
+	err := w.update(ctx, stepResult.ID, func(r *Record) {
+		r.RenewalStatus = response.Status
+		if validErr != nil {
+			r.RenewalError = validErr.Error()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("updating record for %s: %w", stepResult.ID, err)
+	}
+
+	if validErr != nil {
+		return fmt.Errorf("validating install profile response: %w", validErr)
+	}
+	return nil
+}
+
+func (w *Workflow) StepTimeout(_ context.Context, _ *workflow.StepResult) error {
+	return workflow.ErrTimeoutNotUsed
+}
+
+func (w *Workflow) Event(_ context.Context, _ *workflow.Event, _ string, _ *workflow.MDMContext) error {
+	return workflow.ErrEventsNotSupported
+}
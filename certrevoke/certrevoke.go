@@ -0,0 +1,279 @@
+// Package certrevoke checks MDM client identity certificates for
+// revocation with OCSP and CRLs.
+//
+// The verifier only checks revocation. It fetches the URLs of the
+// certificates it checks so it must only be used after the certificates
+// were verified against the trusted CAs (e.g. by a pool verifier).
+package certrevoke
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultCacheTTL is the default maximum time OCSP responses and CRLs
+// are cached.
+const DefaultCacheTTL = time.Hour
+
+// maxResponseSize limits the size of OCSP responses and CRLs.
+const maxResponseSize = 10 << 20
+
+var (
+	// ErrRevoked is returned for revoked certificates.
+	ErrRevoked = errors.New("certificate revoked")
+
+	// ErrNoIssuer is returned when the issuer of a certificate is not
+	// one of the configured CA certificates.
+	ErrNoIssuer = errors.New("issuer not found")
+)
+
+// cached is a cached revocation status source.
+type cached struct {
+	expires time.Time
+
+	// revoked is the set of revoked serial numbers (CRLs) or whether
+	// the certificate is revoked (OCSP, keyed by "").
+	revoked map[string]bool
+}
+
+// Verifier checks certificates for revocation.
+type Verifier struct {
+	issuers  []*x509.Certificate
+	ocsp     bool
+	crl      bool
+	hardFail bool
+	ttl      time.Duration
+	client   *http.Client
+	logger   log.Logger
+	clock    clock.Clock
+
+	mu     sync.Mutex
+	cache  map[string]*cached
+	pruned time.Time
+}
+
+// Option configures the verifier.
+type Option func(*Verifier)
+
+// WithOCSP enables checking certificates with the OCSP responders in
+// their authority information access extension.
+func WithOCSP() Option {
+	return func(v *Verifier) {
+		v.ocsp = true
+	}
+}
+
+// WithCRL enables checking certificates against the CRLs of their
+// CRL distribution points. OCSP is checked first if also enabled.
+func WithCRL() Option {
+	return func(v *Verifier) {
+		v.crl = true
+	}
+}
+
+// WithHardFail rejects certificates whose revocation status can't be
+// determined, e.g. because the OCSP responder is unreachable.
+// By default these failures are logged and the certificates accepted.
+func WithHardFail() Option {
+	return func(v *Verifier) {
+		v.hardFail = true
+	}
+}
+
+// WithCacheTTL caches OCSP responses and CRLs for at most ttl.
+// They are cached shorter if they are updated sooner.
+// See [DefaultCacheTTL].
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(v *Verifier) {
+		v.ttl = ttl
+	}
+}
+
+// WithClient configures the HTTP client for OCSP and CRL requests.
+func WithClient(client *http.Client) Option {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(v *Verifier) {
+		v.client = client
+	}
+}
+
+// WithLogger configures a logger for the verifier.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(v *Verifier) {
+		v.logger = logger
+	}
+}
+
+// WithClock configures the clock of the verifier.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(v *Verifier) {
+		v.clock = c
+	}
+}
+
+// ParseCertificates parses the PEM certificates in data.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// New creates a new verifier checking certificates issued by issuers.
+// At least one of OCSP or CRL checking must be enabled.
+func New(issuers []*x509.Certificate, opts ...Option) (*Verifier, error) {
+	if len(issuers) < 1 {
+		return nil, errors.New("no issuers")
+	}
+	v := &Verifier{
+		issuers: issuers,
+		ttl:     DefaultCacheTTL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+		cache:   make(map[string]*cached),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if !v.ocsp && !v.crl {
+		return nil, errors.New("neither OCSP nor CRL checking enabled")
+	}
+	return v, nil
+}
+
+// issuer returns the configured issuer of cert or nil.
+func (v *Verifier) issuer(cert *x509.Certificate) *x509.Certificate {
+	for _, issuer := range v.issuers {
+		if bytes.Equal(cert.RawIssuer, issuer.RawSubject) && cert.CheckSignatureFrom(issuer) == nil {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// lookup returns the unexpired cache entry of key or nil.
+func (v *Verifier) lookup(key string) *cached {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := v.cache[key]
+	if c == nil {
+		return nil
+	}
+	if !v.clock.Now().Before(c.expires) {
+		delete(v.cache, key)
+		return nil
+	}
+	return c
+}
+
+// store caches revoked under key until nextUpdate, at most for the TTL.
+func (v *Verifier) store(key string, revoked map[string]bool, nextUpdate time.Time) {
+	now := v.clock.Now()
+	expires := now.Add(v.ttl)
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		expires = nextUpdate
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.pruned) >= v.ttl {
+		// remove expired entries of certificates that weren't seen again
+		for k, c := range v.cache {
+			if !now.Before(c.expires) {
+				delete(v.cache, k)
+			}
+		}
+		v.pruned = now
+	}
+	v.cache[key] = &cached{expires: expires, revoked: revoked}
+}
+
+// Verify returns an error wrapping ErrRevoked if cert is revoked.
+// Certificates without OCSP responders or CRL distribution points
+// pass. See [WithHardFail] for certificates whose status can't be
+// determined.
+func (v *Verifier) Verify(ctx context.Context, cert *x509.Certificate) error {
+	if cert == nil {
+		return errors.New("nil certificate")
+	}
+	issuer := v.issuer(cert)
+	if issuer == nil {
+		return v.unknown(ctx, cert, ErrNoIssuer)
+	}
+
+	var errs []error
+	if v.ocsp && len(cert.OCSPServer) > 0 {
+		revoked, err := v.checkOCSP(ctx, cert, issuer)
+		if err == nil {
+			return v.result(cert, revoked)
+		}
+		errs = append(errs, fmt.Errorf("ocsp: %w", err))
+	}
+	if v.crl && len(cert.CRLDistributionPoints) > 0 {
+		revoked, err := v.checkCRL(ctx, cert, issuer)
+		if err == nil {
+			return v.result(cert, revoked)
+		}
+		errs = append(errs, fmt.Errorf("crl: %w", err))
+	}
+
+	if len(errs) > 0 {
+		// report the last error, usually the CRL fallback
+		return v.unknown(ctx, cert, errs[len(errs)-1])
+	}
+	return nil
+}
+
+// result returns an error if the certificate is revoked.
+func (v *Verifier) result(cert *x509.Certificate, revoked bool) error {
+	if revoked {
+		return fmt.Errorf("%w: serial %s", ErrRevoked, cert.SerialNumber.Text(16))
+	}
+	return nil
+}
+
+// unknown handles certificates whose revocation status couldn't be
+// determined because of err.
+func (v *Verifier) unknown(ctx context.Context, cert *x509.Certificate, err error) error {
+	if v.hardFail {
+		return fmt.Errorf("checking revocation: %w", err)
+	}
+	ctxlog.Logger(ctx, v.logger).Info(
+		"msg", "revocation status unknown",
+		"serial", cert.SerialNumber.Text(16),
+		"err", err,
+	)
+	return nil
+}
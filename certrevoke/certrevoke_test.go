@@ -0,0 +1,106 @@
+package certrevoke
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCRL(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(2), RevocationTime: now},
+		},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches++
+		w.Write(crl)
+	}))
+	defer srv.Close()
+
+	leaf := func(serial int64, crlURL string) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "device"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+			CRLDistributionPoints: []string{crlURL},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	ctx := context.Background()
+	v, err := New([]*x509.Certificate{ca}, WithCRL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Verify(ctx, leaf(2, srv.URL)); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked: have %v, want %v", err, ErrRevoked)
+	}
+	if err = v.Verify(ctx, leaf(3, srv.URL)); err != nil {
+		t.Errorf("good: %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("fetches: have %d, want 1", fetches)
+	}
+
+	// unreachable CRLs only fail with hard-fail
+	down := leaf(4, "http://127.0.0.1:1/crl")
+	if err = v.Verify(ctx, down); err != nil {
+		t.Errorf("soft-fail: %v", err)
+	}
+	v, err = New([]*x509.Certificate{ca}, WithCRL(), WithHardFail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Verify(ctx, down); err == nil {
+		t.Error("hard-fail: expected error")
+	}
+}
@@ -0,0 +1,132 @@
+package certrevoke
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// do performs req and returns the response body.
+func (v *Verifier) do(req *http.Request) ([]byte, error) {
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxResponseSize {
+		return nil, errors.New("response too large")
+	}
+	return body, nil
+}
+
+// checkOCSP checks cert with its first OCSP responder that responds.
+func (v *Verifier) checkOCSP(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	fp := sha256.Sum256(issuer.Raw)
+	key := "ocsp." + hex.EncodeToString(fp[:]) + "." + cert.SerialNumber.Text(16)
+	if c := v.lookup(key); c != nil {
+		return c.revoked[""], nil
+	}
+
+	ocspReq, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+	var body []byte
+	for _, url := range cert.OCSPServer {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(ocspReq))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/ocsp-request")
+		if body, err = v.do(req); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return false, fmt.Errorf("parsing response: %w", err)
+	}
+	var revoked bool
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		revoked = true
+	default:
+		return false, errors.New("unknown certificate status")
+	}
+	v.store(key, map[string]bool{"": revoked}, resp.NextUpdate)
+	return revoked, nil
+}
+
+// checkCRL checks cert against the CRL of its first HTTP CRL
+// distribution point that can be retrieved.
+func (v *Verifier) checkCRL(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	serial := cert.SerialNumber.Text(16)
+	err := errors.New("no HTTP distribution point")
+	for _, url := range cert.CRLDistributionPoints {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			continue
+		}
+		var revoked map[string]bool
+		if revoked, err = v.crlRevoked(ctx, url, issuer); err == nil {
+			return revoked[serial], nil
+		}
+	}
+	return false, err
+}
+
+// crlRevoked returns the revoked serial numbers of the CRL at url.
+func (v *Verifier) crlRevoked(ctx context.Context, url string, issuer *x509.Certificate) (map[string]bool, error) {
+	key := "crl." + url
+	if c := v.lookup(key); c != nil {
+		return c.revoked, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := v.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRL: %w", err)
+	}
+	if err = crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("verifying CRL: %w", err)
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificates))
+	for _, rc := range crl.RevokedCertificates {
+		revoked[rc.SerialNumber.Text(16)] = true
+	}
+	v.store(key, revoked, crl.NextUpdate)
+	return revoked, nil
+}
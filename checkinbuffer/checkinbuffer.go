@@ -0,0 +1,395 @@
+// Package checkinbuffer buffers check-in storage writes during storage
+// outages and replays them once the storage backend recovers.
+package checkinbuffer
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+// DefaultMaxEntries is the default maximum number of buffered writes.
+const DefaultMaxEntries = 10000
+
+// Buffered write operations.
+const (
+	OpAuthenticate      = "Authenticate"
+	OpTokenUpdate       = "TokenUpdate"
+	OpUserAuthenticate  = "UserAuthenticate"
+	OpDisable           = "Disable"
+	OpAssociateCertHash = "AssociateCertHash"
+)
+
+// ErrBufferFull is returned when a write can't be buffered.
+var ErrBufferFull = errors.New("check-in buffer full")
+
+// Unavailable reports whether err indicates that the storage backend
+// is unavailable (as opposed to e.g. rejecting the write).
+func Unavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr)
+}
+
+// Entry is a buffered check-in storage write.
+type Entry struct {
+	Op         string            `json:"op"`
+	EnrollType mdm.EnrollType    `json:"enroll_type"`
+	ID         string            `json:"id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Cert       []byte            `json:"cert,omitempty"` // DER
+	Params     map[string]string `json:"params,omitempty"`
+	Raw        []byte            `json:"raw,omitempty"`  // raw check-in message
+	Hash       string            `json:"hash,omitempty"` // certificate hash
+	BufferedAt time.Time         `json:"buffered_at"`
+}
+
+// Stats are the counters of a buffer.
+type Stats struct {
+	Pending    int       `json:"pending"`
+	Buffered   uint64    `json:"buffered"`
+	Replayed   uint64    `json:"replayed"`
+	Failed     uint64    `json:"failed"`
+	Rejected   uint64    `json:"rejected"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastReplay time.Time `json:"last_replay,omitempty"`
+}
+
+// Buffer is NanoMDM storage that buffers check-in writes when the
+// underlying storage is unavailable. Buffered writes are replayed in
+// order by Run. While writes are pending all new check-in writes are
+// buffered as well to keep them in order. Reads are not buffered.
+type Buffer struct {
+	storage.AllStorage
+
+	bucket      kv.Bucket
+	max         int
+	unavailable func(error) bool
+	logger      log.Logger
+	clock       clock.Clock
+
+	mu    sync.Mutex
+	seq   uint64
+	stats Stats
+
+	// replaying serializes replays
+	replaying sync.Mutex
+}
+
+// Option configures the buffer.
+type Option func(*Buffer)
+
+// WithMaxEntries configures the maximum number of buffered writes.
+// Check-in writes fail with ErrBufferFull while the buffer is full.
+func WithMaxEntries(n int) Option {
+	return func(b *Buffer) {
+		if n > 0 {
+			b.max = n
+		}
+	}
+}
+
+// WithUnavailable configures the function that reports whether
+// a storage error means the storage is unavailable.
+func WithUnavailable(f func(error) bool) Option {
+	if f == nil {
+		panic("nil func")
+	}
+	return func(b *Buffer) {
+		b.unavailable = f
+	}
+}
+
+// WithLogger configures a logger for the buffer.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(b *Buffer) {
+		b.logger = logger
+	}
+}
+
+// WithClock configures the clock of the buffer.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(b *Buffer) {
+		b.clock = c
+	}
+}
+
+// New creates a new buffer for store.
+// Writes are buffered in bucket which should be local storage that
+// remains available when store is not. Writes already in bucket
+// (e.g. from before a restart) are replayed by Run.
+func New(store storage.AllStorage, bucket kv.Bucket, opts ...Option) (*Buffer, error) {
+	if store == nil {
+		panic("nil store")
+	}
+	if bucket == nil {
+		panic("nil bucket")
+	}
+	b := &Buffer{
+		AllStorage:  store,
+		bucket:      bucket,
+		max:         DefaultMaxEntries,
+		unavailable: Unavailable,
+		logger:      log.NopLogger,
+		clock:       clock.Real,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	keys, err := bucket.KeysPrefix(context.Background(), "")
+	if err != nil {
+		return nil, fmt.Errorf("listing buffered writes: %w", err)
+	}
+	b.stats.Pending = len(keys)
+	for _, k := range keys {
+		var seq uint64
+		if _, err := fmt.Sscanf(k, "%d", &seq); err == nil && seq > b.seq {
+			b.seq = seq
+		}
+	}
+	return b, nil
+}
+
+// Stats returns the buffer counters.
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// newEntry creates a new entry for an operation on the enrollment of r.
+func (b *Buffer) newEntry(r *mdm.Request, op string) *Entry {
+	e := &Entry{Op: op, Params: r.Params, BufferedAt: b.clock.Now()}
+	if r.EnrollID != nil {
+		e.EnrollType = r.Type
+		e.ID = r.ID
+		e.ParentID = r.ParentID
+	}
+	if r.Certificate != nil {
+		e.Cert = r.Certificate.Raw
+	}
+	return e
+}
+
+// write calls f unless writes are pending and buffers e if
+// the write is buffered or the storage is unavailable.
+func (b *Buffer) write(ctx context.Context, e *Entry, f func() error) error {
+	b.mu.Lock()
+	pending := b.stats.Pending > 0
+	b.mu.Unlock()
+	if !pending {
+		err := f()
+		if !b.unavailable(err) {
+			return err
+		}
+		b.mu.Lock()
+		b.stats.LastError = err.Error()
+		b.mu.Unlock()
+		if bufErr := b.buffer(ctx, e); bufErr != nil {
+			return fmt.Errorf("%w: %v", err, bufErr)
+		}
+		return nil
+	}
+	return b.buffer(ctx, e)
+}
+
+// buffer appends e to the buffer.
+func (b *Buffer) buffer(ctx context.Context, e *Entry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal entry: %w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stats.Pending >= b.max {
+		b.stats.Rejected++
+		return ErrBufferFull
+	}
+	b.seq++
+	// zero-padded keys sort in write order
+	if err = b.bucket.Set(ctx, fmt.Sprintf("%020d", b.seq), v); err != nil {
+		b.stats.Rejected++
+		return fmt.Errorf("buffering write: %w", err)
+	}
+	b.stats.Pending++
+	b.stats.Buffered++
+	ctxlog.Logger(ctx, b.logger).Info("msg", "buffered write", "op", e.Op, "id", e.ID, "pending", b.stats.Pending)
+	return nil
+}
+
+// StoreAuthenticate stores or buffers an Authenticate check-in.
+func (b *Buffer) StoreAuthenticate(r *mdm.Request, msg *mdm.Authenticate) error {
+	e := b.newEntry(r, OpAuthenticate)
+	e.Raw = msg.Raw
+	return b.write(r.Context(), e, func() error { return b.AllStorage.StoreAuthenticate(r, msg) })
+}
+
+// StoreTokenUpdate stores or buffers a TokenUpdate check-in.
+func (b *Buffer) StoreTokenUpdate(r *mdm.Request, msg *mdm.TokenUpdate) error {
+	e := b.newEntry(r, OpTokenUpdate)
+	e.Raw = msg.Raw
+	return b.write(r.Context(), e, func() error { return b.AllStorage.StoreTokenUpdate(r, msg) })
+}
+
+// StoreUserAuthenticate stores or buffers a UserAuthenticate check-in.
+func (b *Buffer) StoreUserAuthenticate(r *mdm.Request, msg *mdm.UserAuthenticate) error {
+	e := b.newEntry(r, OpUserAuthenticate)
+	e.Raw = msg.Raw
+	return b.write(r.Context(), e, func() error { return b.AllStorage.StoreUserAuthenticate(r, msg) })
+}
+
+// Disable disables or buffers disabling the enrollment.
+func (b *Buffer) Disable(r *mdm.Request) error {
+	return b.write(r.Context(), b.newEntry(r, OpDisable), func() error { return b.AllStorage.Disable(r) })
+}
+
+// AssociateCertHash associates or buffers associating hash with the enrollment.
+func (b *Buffer) AssociateCertHash(r *mdm.Request, hash string) error {
+	e := b.newEntry(r, OpAssociateCertHash)
+	e.Hash = hash
+	return b.write(r.Context(), e, func() error { return b.AllStorage.AssociateCertHash(r, hash) })
+}
+
+// apply applies e to the underlying storage.
+func (b *Buffer) apply(ctx context.Context, e *Entry) error {
+	var cert *x509.Certificate
+	if len(e.Cert) > 0 {
+		var err error
+		if cert, err = x509.ParseCertificate(e.Cert); err != nil {
+			return fmt.Errorf("parsing certificate: %w", err)
+		}
+	}
+	r := mdm.NewRequestWithContext(ctx, cert)
+	r.EnrollID = &mdm.EnrollID{Type: e.EnrollType, ID: e.ID, ParentID: e.ParentID}
+	r.Params = e.Params
+
+	switch e.Op {
+	case OpDisable:
+		return b.AllStorage.Disable(r)
+	case OpAssociateCertHash:
+		return b.AllStorage.AssociateCertHash(r, e.Hash)
+	}
+
+	msg, err := mdm.DecodeCheckin(e.Raw)
+	if err != nil {
+		return fmt.Errorf("decoding check-in: %w", err)
+	}
+	switch m := msg.(type) {
+	case *mdm.Authenticate:
+		return b.AllStorage.StoreAuthenticate(r, m)
+	case *mdm.TokenUpdate:
+		return b.AllStorage.StoreTokenUpdate(r, m)
+	case *mdm.UserAuthenticate:
+		return b.AllStorage.StoreUserAuthenticate(r, m)
+	default:
+		return fmt.Errorf("unexpected check-in for %s: %T", e.Op, msg)
+	}
+}
+
+// Replay replays buffered writes in order until the storage is
+// unavailable. Writes that fail for other reasons are dropped.
+// It returns the number of replayed writes.
+func (b *Buffer) Replay(ctx context.Context) (int, error) {
+	b.replaying.Lock()
+	defer b.replaying.Unlock()
+	logger := ctxlog.Logger(ctx, b.logger)
+
+	keys, err := b.bucket.KeysPrefix(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing buffered writes: %w", err)
+	}
+	var replayed int
+	for _, k := range keys {
+		v, err := b.bucket.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return replayed, fmt.Errorf("getting buffered write %s: %w", k, err)
+		}
+		e := new(Entry)
+		if err = json.Unmarshal(v, e); err == nil {
+			err = b.apply(ctx, e)
+		}
+		if b.unavailable(err) {
+			b.mu.Lock()
+			b.stats.LastError = err.Error()
+			b.mu.Unlock()
+			return replayed, fmt.Errorf("storage unavailable: %w", err)
+		}
+		if err != nil {
+			logger.Info("msg", "dropping buffered write", "key", k, "op", e.Op, "id", e.ID, "err", err)
+		}
+		if delErr := b.bucket.Delete(ctx, k); delErr != nil {
+			return replayed, fmt.Errorf("deleting buffered write %s: %w", k, delErr)
+		}
+		b.mu.Lock()
+		b.stats.Pending--
+		if err != nil {
+			b.stats.Failed++
+		} else {
+			b.stats.Replayed++
+		}
+		b.mu.Unlock()
+		if err == nil {
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		b.mu.Lock()
+		b.stats.LastReplay = b.clock.Now()
+		b.mu.Unlock()
+		logger.Info("msg", "replayed buffered writes", "count", replayed)
+	}
+	return replayed, nil
+}
+
+// Run replays buffered writes every interval until ctx is done.
+func (b *Buffer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := b.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if b.Stats().Pending < 1 {
+				continue
+			}
+			if _, err := b.Replay(ctx); err != nil {
+				b.logger.Debug("msg", "replaying buffered writes", "err", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
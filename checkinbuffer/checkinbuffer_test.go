@@ -0,0 +1,83 @@
+package checkinbuffer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+var errDown = errors.New("storage down")
+
+type store struct {
+	storage.AllStorage
+	down     bool
+	disabled []string
+}
+
+func (s *store) Disable(r *mdm.Request) error {
+	if s.down {
+		return errDown
+	}
+	s.disabled = append(s.disabled, r.ID)
+	return nil
+}
+
+func TestBuffer(t *testing.T) {
+	ctx := context.Background()
+	s := &store{down: true}
+	b, err := New(s, kvmap.New(), WithMaxEntries(2), WithUnavailable(func(err error) bool {
+		return errors.Is(err, errDown)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disable := func(id string) error {
+		r := mdm.NewRequestWithContext(ctx, nil)
+		r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+		return b.Disable(r)
+	}
+
+	// writes are buffered while the storage is down
+	for _, id := range []string{"ID1", "ID2"} {
+		if err = disable(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = disable("ID3"); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("have: %v, want: %v", err, ErrBufferFull)
+	}
+
+	if _, err = b.Replay(ctx); err == nil {
+		t.Error("expected replay error")
+	}
+
+	s.down = false
+	n, err := b.Replay(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if len(s.disabled) != 2 || s.disabled[0] != "ID1" || s.disabled[1] != "ID2" {
+		t.Errorf("unexpected replay order: %v", s.disabled)
+	}
+	stats := b.Stats()
+	if stats.Pending != 0 || stats.Buffered != 2 || stats.Replayed != 2 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// writes go to the storage once the buffer is empty
+	if err = disable("ID4"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(s.disabled), 3; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
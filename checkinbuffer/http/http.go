@@ -0,0 +1,57 @@
+// Package http provides the HTTP API for the check-in buffer.
+package http
+
+import (
+	"net/http"
+
+	"github.com/micromdm/nanohub/checkinbuffer"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// GetStatsHandler returns the check-in buffer counters.
+func GetStatsHandler(b *checkinbuffer.Buffer, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil buffer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpapi.WriteJSON(w, b.Stats(), ctxlog.Logger(r.Context(), logger))
+	}
+}
+
+// ReplayHandler replays the buffered writes and returns the check-in buffer counters.
+func ReplayHandler(b *checkinbuffer.Buffer, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil buffer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		if _, err := b.Replay(r.Context()); err != nil {
+			logger.Info("msg", "replaying buffered writes", "err", err)
+			httpapi.JSONError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+
+		httpapi.WriteJSON(w, b.Stats(), logger)
+	}
+}
+
+// HandleAPIv1 registers the check-in buffer API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, b *checkinbuffer.Buffer) {
+	mux.Handle(
+		prefix+"/checkinbuffer",
+		GetStatsHandler(b, logger.With("handler", "get-checkin-buffer")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/checkinbuffer/replay",
+		ReplayHandler(b, logger.With("handler", "replay-checkin-buffer")),
+		"POST",
+	)
+}
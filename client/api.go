@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/micromdm/nanohub/cmdqueue"
+)
+
+// API path prefixes.
+const (
+	PrefixNanoMDM = "/api/v1/nanomdm"
+	PrefixNanoCMD = "/api/v1/nanocmd"
+	PrefixDDM     = "/api/v1/ddm"
+	PrefixNanoHUB = "/api/v1/nanohub"
+)
+
+// ErrNoIDs is returned when no enrollment IDs are provided.
+var ErrNoIDs = errors.New("no enrollment IDs")
+
+// EnrollmentResult is the push or enqueue result of an enrollment.
+type EnrollmentResult struct {
+	PushError    string `json:"push_error,omitempty"`
+	PushID       string `json:"push_result,omitempty"`
+	CommandError string `json:"command_error,omitempty"`
+}
+
+// Result is the result of the NanoMDM push and enqueue APIs.
+type Result struct {
+	Status       map[string]EnrollmentResult `json:"status,omitempty"`
+	NoPush       bool                        `json:"no_push,omitempty"`
+	PushError    string                      `json:"push_error,omitempty"`
+	CommandError string                      `json:"command_error,omitempty"`
+	CommandUUID  string                      `json:"command_uuid,omitempty"`
+	RequestType  string                      `json:"request_type,omitempty"`
+}
+
+// pathIDs returns the path-escaped comma-separated enrollment ids.
+func pathIDs(ids []string) (string, error) {
+	if len(ids) < 1 {
+		return "", ErrNoIDs
+	}
+	escaped := make([]string, len(ids))
+	for i, id := range ids {
+		escaped[i] = url.PathEscape(id)
+	}
+	return strings.Join(escaped, ","), nil
+}
+
+// notifyQuery returns the KMFDDM query parameters for notify.
+func notifyQuery(notify bool) url.Values {
+	if notify {
+		return nil
+	}
+	return url.Values{"nonotify": {"1"}}
+}
+
+// doResult sends req and returns the push or enqueue result.
+// The result is also returned with unsuccessful responses if it
+// was in the response body.
+func (c *Client) doResult(ctx context.Context, req *request) (*Result, error) {
+	body, err := c.do(ctx, req)
+	var httpErr *HTTPError
+	if err != nil && !errors.As(err, &httpErr) {
+		return nil, err
+	}
+	result := new(Result)
+	if jsonErr := json.Unmarshal(body, result); jsonErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, jsonErr
+	}
+	return result, err
+}
+
+// Enqueue enqueues the raw command plist to ids and pushes to them
+// unless noPush is set.
+func (c *Client) Enqueue(ctx context.Context, ids []string, command []byte, noPush bool) (*Result, error) {
+	path, err := pathIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{
+		method:      http.MethodPut,
+		path:        PrefixNanoMDM + "/enqueue/" + path,
+		body:        command,
+		contentType: "application/x-apple-aspen-mdm",
+	}
+	if noPush {
+		req.query = url.Values{"nopush": {"1"}}
+	}
+	return c.doResult(ctx, req)
+}
+
+// Push sends APNs push notifications to ids.
+func (c *Client) Push(ctx context.Context, ids []string) (*Result, error) {
+	path, err := pathIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	return c.doResult(ctx, &request{
+		method:     http.MethodGet,
+		path:       PrefixNanoMDM + "/push/" + path,
+		idempotent: true,
+	})
+}
+
+// StartWorkflow starts the NanoCMD workflow name for ids with the
+// optional workflow context wfCtx and returns the instance ID.
+func (c *Client) StartWorkflow(ctx context.Context, name string, ids []string, wfCtx []byte) (string, error) {
+	if len(ids) < 1 {
+		return "", ErrNoIDs
+	}
+	query := url.Values{"id": ids}
+	if len(wfCtx) > 0 {
+		query.Set("context", string(wfCtx))
+	}
+	resp := new(struct {
+		InstanceID string `json:"instance_id"`
+	})
+	err := c.doJSON(ctx, &request{
+		method: http.MethodPost,
+		path:   PrefixNanoCMD + "/workflow/" + url.PathEscape(name) + "/start",
+		query:  query,
+	}, resp)
+	return resp.InstanceID, err
+}
+
+// getList retrieves the JSON string array at path.
+func (c *Client) getList(ctx context.Context, path string) ([]string, error) {
+	var list []string
+	return list, c.doJSON(ctx, &request{method: http.MethodGet, path: path, idempotent: true}, &list)
+}
+
+// Declarations retrieves the declaration identifiers.
+func (c *Client) Declarations(ctx context.Context) ([]string, error) {
+	return c.getList(ctx, PrefixDDM+"/declarations")
+}
+
+// Declaration retrieves the JSON of declaration id.
+func (c *Client) Declaration(ctx context.Context, id string) (json.RawMessage, error) {
+	body, err := c.do(ctx, &request{
+		method:     http.MethodGet,
+		path:       PrefixDDM + "/declarations/" + url.PathEscape(id),
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// PutDeclaration stores the JSON declaration.
+// Affected enrollments are notified if notify is set.
+func (c *Client) PutDeclaration(ctx context.Context, declaration []byte, notify bool) error {
+	_, err := c.do(ctx, &request{
+		method:     http.MethodPut,
+		path:       PrefixDDM + "/declarations",
+		query:      notifyQuery(notify),
+		body:       declaration,
+		idempotent: true,
+	})
+	return err
+}
+
+// DeleteDeclaration deletes declaration id.
+func (c *Client) DeleteDeclaration(ctx context.Context, id string) error {
+	_, err := c.do(ctx, &request{
+		method:     http.MethodDelete,
+		path:       PrefixDDM + "/declarations/" + url.PathEscape(id),
+		idempotent: true,
+	})
+	return err
+}
+
+// Sets retrieves the set names.
+func (c *Client) Sets(ctx context.Context) ([]string, error) {
+	return c.getList(ctx, PrefixDDM+"/sets")
+}
+
+// SetDeclarations retrieves the declaration identifiers of set.
+func (c *Client) SetDeclarations(ctx context.Context, set string) ([]string, error) {
+	return c.getList(ctx, PrefixDDM+"/set-declarations/"+url.PathEscape(set))
+}
+
+// setMember adds (PUT) or removes (DELETE) the query member of the
+// set or enrollment at path.
+func (c *Client) setMember(ctx context.Context, method, path, key, value string, notify bool) error {
+	query := notifyQuery(notify)
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set(key, value)
+	_, err := c.do(ctx, &request{method: method, path: path, query: query, idempotent: true})
+	return err
+}
+
+// PutSetDeclaration adds declaration id to set.
+// Affected enrollments are notified if notify is set.
+func (c *Client) PutSetDeclaration(ctx context.Context, set, id string, notify bool) error {
+	return c.setMember(ctx, http.MethodPut, PrefixDDM+"/set-declarations/"+url.PathEscape(set), "declaration", id, notify)
+}
+
+// DeleteSetDeclaration removes declaration id from set.
+// Affected enrollments are notified if notify is set.
+func (c *Client) DeleteSetDeclaration(ctx context.Context, set, id string, notify bool) error {
+	return c.setMember(ctx, http.MethodDelete, PrefixDDM+"/set-declarations/"+url.PathEscape(set), "declaration", id, notify)
+}
+
+// EnrollmentSets retrieves the set names of enrollment id.
+func (c *Client) EnrollmentSets(ctx context.Context, id string) ([]string, error) {
+	return c.getList(ctx, PrefixDDM+"/enrollment-sets/"+url.PathEscape(id))
+}
+
+// PutEnrollmentSet adds set to enrollment id.
+// The enrollment is notified if notify is set.
+func (c *Client) PutEnrollmentSet(ctx context.Context, id, set string, notify bool) error {
+	return c.setMember(ctx, http.MethodPut, PrefixDDM+"/enrollment-sets/"+url.PathEscape(id), "set", set, notify)
+}
+
+// DeleteEnrollmentSet removes set from enrollment id.
+// The enrollment is notified if notify is set.
+func (c *Client) DeleteEnrollmentSet(ctx context.Context, id, set string, notify bool) error {
+	return c.setMember(ctx, http.MethodDelete, PrefixDDM+"/enrollment-sets/"+url.PathEscape(id), "set", set, notify)
+}
+
+// environmentLabel is the environment of an enrollment.
+type environmentLabel struct {
+	Environment string `json:"environment"`
+}
+
+// Environment retrieves the environment of enrollment id.
+func (c *Client) Environment(ctx context.Context, id string) (string, error) {
+	label := new(environmentLabel)
+	err := c.doJSON(ctx, &request{
+		method:     http.MethodGet,
+		path:       PrefixNanoHUB + "/enrollments/" + url.PathEscape(id) + "/environment",
+		idempotent: true,
+	}, label)
+	return label.Environment, err
+}
+
+// SetEnvironment labels enrollment id with env.
+func (c *Client) SetEnvironment(ctx context.Context, id, env string) error {
+	body, err := json.Marshal(&environmentLabel{Environment: env})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, &request{
+		method:     http.MethodPut,
+		path:       PrefixNanoHUB + "/enrollments/" + url.PathEscape(id) + "/environment",
+		body:       body,
+		idempotent: true,
+	})
+	return err
+}
+
+// Queue retrieves the queued commands of enrollment id.
+func (c *Client) Queue(ctx context.Context, id string) ([]*cmdqueue.QueuedCommand, error) {
+	var cmds []*cmdqueue.QueuedCommand
+	return cmds, c.doJSON(ctx, &request{
+		method:     http.MethodGet,
+		path:       PrefixNanoHUB + "/queue/" + url.PathEscape(id),
+		idempotent: true,
+	}, &cmds)
+}
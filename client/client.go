@@ -0,0 +1,244 @@
+// Package client is a Go client for the NanoHUB HTTP APIs.
+// It covers the aggregated NanoMDM, NanoCMD, KMFDDM, and NanoHUB APIs
+// and handles authentication and retries.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIUsername is the HTTP Basic authentication username of the API key.
+const APIUsername = "nanohub"
+
+// Defaults of the retry handling.
+const (
+	DefaultRetries   = 3
+	DefaultRetryWait = time.Second
+)
+
+// HTTPError is a non-successful API response.
+type HTTPError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP status %d: %s", e.Method, e.Path, e.StatusCode, strings.TrimSpace(string(e.Body)))
+}
+
+// IsNotFound reports whether err is an API response with a 404 status.
+func IsNotFound(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
+
+// Client is a NanoHUB API client.
+type Client struct {
+	baseURL   string
+	apiKey    string
+	token     string
+	client    *http.Client
+	retries   int
+	retryWait time.Duration
+}
+
+// Option configures the client.
+type Option func(*Client)
+
+// WithAPIKey authenticates requests with the NanoHUB API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithBearerToken authenticates requests with a delegation token.
+// It takes precedence over the API key.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient configures the HTTP client used for API requests.
+func WithHTTPClient(client *http.Client) Option {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithRetries configures the number of retries of failed requests and
+// the wait before the first retry. The wait doubles for every retry.
+// Zero retries disables retrying.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryWait = wait
+	}
+}
+
+// New creates a new client for the NanoHUB server at baseURL
+// (e.g. "https://nanohub.example.com").
+func New(baseURL string, opts ...Option) *Client {
+	if baseURL == "" {
+		panic("empty base URL")
+	}
+	c := &Client{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		client:    http.DefaultClient,
+		retries:   DefaultRetries,
+		retryWait: DefaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// request is an API request.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   []byte
+
+	// contentType of the body. Defaults to JSON.
+	contentType string
+
+	// idempotent requests are retried after network errors and
+	// gateway errors as they may be safely repeated.
+	idempotent bool
+}
+
+// retryable reports whether the response status or error of req
+// should be retried.
+func retryable(req *request, statusCode int, err error) bool {
+	switch {
+	case err != nil:
+		return req.idempotent
+	case statusCode == http.StatusTooManyRequests, statusCode == http.StatusServiceUnavailable:
+		// the request was not processed
+		return true
+	case statusCode == http.StatusBadGateway, statusCode == http.StatusGatewayTimeout:
+		return req.idempotent
+	}
+	return false
+}
+
+// retryAfter returns the wait of the Retry-After header of resp in
+// seconds or def.
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	if resp == nil {
+		return def
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return def
+}
+
+// newHTTPRequest creates the authenticated HTTP request of req.
+func (c *Client) newHTTPRequest(ctx context.Context, req *request) (*http.Request, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if req.body != nil {
+		contentType := req.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.apiKey != "" {
+		httpReq.SetBasicAuth(APIUsername, c.apiKey)
+	}
+	return httpReq, nil
+}
+
+// send sends req once and returns the response body.
+func (c *Client) send(ctx context.Context, req *request) (*http.Response, []byte, error) {
+	httpReq, err := c.newHTTPRequest(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	return resp, respBody, err
+}
+
+// do sends req retrying failures and returns the response body.
+// Non-successful responses are returned as an HTTPError with the body.
+func (c *Client) do(ctx context.Context, req *request) ([]byte, error) {
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.send(ctx, req)
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		if err == nil && statusCode >= 200 && statusCode < 300 {
+			return body, nil
+		}
+		if attempt >= c.retries || !retryable(req, statusCode, err) {
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", req.method, req.path, err)
+			}
+			return body, &HTTPError{Method: req.method, Path: req.path, StatusCode: statusCode, Body: body}
+		}
+
+		timer := time.NewTimer(retryAfter(resp, wait))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// doJSON sends req and unmarshals the JSON response body into out.
+func (c *Client) doJSON(ctx context.Context, req *request, out interface{}) error {
+	body, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(body) < 1 {
+		return nil
+	}
+	if err = json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unmarshal %s %s response: %w", req.method, req.path, err)
+	}
+	return nil
+}
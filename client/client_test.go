@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnqueueRetry(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if user, pass, ok := r.BasicAuth(); !ok || user != APIUsername || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/api/v1/nanomdm/enqueue/ID1,ID2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if attempts < 2 {
+			// not processed: retried
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":{"ID1":{},"ID2":{}},"command_uuid":"uuid1"}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithAPIKey("secret"), WithRetries(2, 0))
+	result, err := c.Enqueue(context.Background(), []string{"ID1", "ID2"}, []byte("<plist/>"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := attempts, 2; have != want {
+		t.Errorf("attempts: have: %v, want: %v", have, want)
+	}
+	if have, want := result.CommandUUID, "uuid1"; have != want {
+		t.Errorf("command uuid: have: %v, want: %v", have, want)
+	}
+	if have, want := len(result.Status), 2; have != want {
+		t.Errorf("status: have: %v, want: %v", have, want)
+	}
+
+	// gateway errors are not retried for non-idempotent requests
+	attempts = 0
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	if _, err = c.StartWorkflow(context.Background(), "wf", []string{"ID1"}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if have, want := attempts, 1; have != want {
+		t.Errorf("attempts: have: %v, want: %v", have, want)
+	}
+	if _, err = c.Declarations(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if have, want := attempts, 4; have != want {
+		t.Errorf("attempts: have: %v, want: %v", have, want)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/nanohub/events/stream" || r.URL.Query().Get("type") != "a,b" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(": heartbeat\n\nevent: a\ndata: {\"id\":1}\n\nevent: b\ndata: {\"id\":2}\n\n"))
+	}))
+	defer srv.Close()
+
+	var types []string
+	err := New(srv.URL).StreamEvents(context.Background(), []string{"a", "b"}, nil, func(e *Event) error {
+		types = append(types, e.Type+" "+string(e.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(types, ";"), `a {"id":1};b {"id":2}`; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Event is a device event of the event stream.
+type Event struct {
+	// Type is the event type (e.g. "enrollment.enrolled").
+	Type string
+
+	// Data is the JSON event.
+	Data json.RawMessage
+}
+
+// Inventory retrieves the NanoCMD inventory values of ids.
+func (c *Client) Inventory(ctx context.Context, ids []string) (map[string]map[string]interface{}, error) {
+	if len(ids) < 1 {
+		return nil, ErrNoIDs
+	}
+	inventory := make(map[string]map[string]interface{})
+	return inventory, c.doJSON(ctx, &request{
+		method:     http.MethodGet,
+		path:       PrefixNanoCMD + "/inventory",
+		query:      url.Values{"id": ids},
+		idempotent: true,
+	}, &inventory)
+}
+
+// StreamEvents streams live device events of the types and enrollment
+// ids (all if empty) to fn until ctx is done, the stream ends, or fn
+// returns an error. The stream is not retried.
+func (c *Client) StreamEvents(ctx context.Context, types, ids []string, fn func(*Event) error) error {
+	query := url.Values{}
+	if len(types) > 0 {
+		query.Set("type", strings.Join(types, ","))
+	}
+	if len(ids) > 0 {
+		query.Set("id", strings.Join(ids, ","))
+	}
+	req := &request{method: http.MethodGet, path: PrefixNanoHUB + "/events/stream", query: query}
+	httpReq, err := c.newHTTPRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", req.method, req.path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &HTTPError{Method: req.method, Path: req.path, StatusCode: resp.StatusCode, Body: body}
+	}
+
+	err = readEvents(resp.Body, fn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// readEvents reads server-sent events from r and calls fn for each.
+// Comments and fields other than "event" and "data" are ignored.
+func readEvents(r io.Reader, fn func(*Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	event := new(Event)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// a blank line dispatches the event
+			if len(data) > 0 {
+				event.Data = json.RawMessage(strings.Join(data, "\n"))
+				if err := fn(event); err != nil {
+					return err
+				}
+			}
+			event = new(Event)
+			data = nil
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package clock abstracts time so that time-dependent behavior
+// (such as expiry, rate limits, and periodic tasks) can be tested
+// deterministically and accelerated.
+//
+// NanoHUB's services, workflows, background tasks, event and audit
+// timestamps, and the stores they use accept a clock. Times outside of
+// NanoHUB's control always use the system clock: the NanoMDM, NanoCMD
+// (including the workflow engine worker), and KMFDDM components,
+// HTTP API handlers, the NanoCMD idle event of check-ins, and the
+// certificates and request signatures of the DEP client.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker returns a new ticker with period d.
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fake is a manually advanced clock.
+// It is safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake creates a new fake clock starting at now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the current time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker returns a new ticker with period d that ticks as the fake clock is advanced.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{f: f, period: d, next: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the fake clock forward by d firing any tickers due.
+// Like real tickers, ticks are dropped for slow receivers.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	f      *Fake
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+// Stop removes the ticker from its fake clock.
+func (t *fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	for i, ft := range t.f.tickers {
+		if ft == t {
+			t.f.tickers = append(t.f.tickers[:i], t.f.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	c.Advance(30 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("unexpected tick")
+	default:
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case tick := <-ticker.C():
+		if want := start.Add(time.Minute); !tick.Equal(want) {
+			t.Errorf("have: %v, want: %v", tick, want)
+		}
+	default:
+		t.Fatal("expected tick")
+	}
+
+	if have, want := c.Now(), start.Add(time.Minute); !have.Equal(want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
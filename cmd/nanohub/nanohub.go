@@ -3,14 +3,144 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/micromdm/nanohub/accountenroll"
+	"github.com/micromdm/nanohub/anomaly"
+	"github.com/micromdm/nanohub/apnscheck"
+	"github.com/micromdm/nanohub/apnstoken"
+	"github.com/micromdm/nanohub/attest"
+	attesthttp "github.com/micromdm/nanohub/attest/http"
+	"github.com/micromdm/nanohub/audit"
+	audithttp "github.com/micromdm/nanohub/audit/http"
+	"github.com/micromdm/nanohub/authpolicy"
+	"github.com/micromdm/nanohub/bstoken"
+	bstokenhttp "github.com/micromdm/nanohub/bstoken/http"
+	"github.com/micromdm/nanohub/capability"
+	capabilityhttp "github.com/micromdm/nanohub/capability/http"
+	"github.com/micromdm/nanohub/census"
+	censushttp "github.com/micromdm/nanohub/census/http"
+	"github.com/micromdm/nanohub/certassoc"
+	certassochttp "github.com/micromdm/nanohub/certassoc/http"
+	"github.com/micromdm/nanohub/certexpiry"
+	certexpiryhttp "github.com/micromdm/nanohub/certexpiry/http"
+	"github.com/micromdm/nanohub/certrevoke"
+	"github.com/micromdm/nanohub/checkinbuffer"
+	checkinbufferhttp "github.com/micromdm/nanohub/checkinbuffer/http"
+	"github.com/micromdm/nanohub/cmdcodec"
+	"github.com/micromdm/nanohub/cmdexpiry"
+	"github.com/micromdm/nanohub/cmdqueue"
+	cmdqueuehttp "github.com/micromdm/nanohub/cmdqueue/http"
+	"github.com/micromdm/nanohub/cmdresponse"
+	cmdresphttp "github.com/micromdm/nanohub/cmdresponse/http"
+	"github.com/micromdm/nanohub/configapi"
+	configapihttp "github.com/micromdm/nanohub/configapi/http"
+	"github.com/micromdm/nanohub/ddmadapter"
+	"github.com/micromdm/nanohub/ddmasset"
+	ddmassethttp "github.com/micromdm/nanohub/ddmasset/http"
+	"github.com/micromdm/nanohub/ddmidentity"
+	ddmidentityhttp "github.com/micromdm/nanohub/ddmidentity/http"
+	"github.com/micromdm/nanohub/ddmpredicate"
+	ddmpredicatehttp "github.com/micromdm/nanohub/ddmpredicate/http"
+	"github.com/micromdm/nanohub/delegation"
+	delegationhttp "github.com/micromdm/nanohub/delegation/http"
+	"github.com/micromdm/nanohub/dep"
+	dephttp "github.com/micromdm/nanohub/dep/http"
+	"github.com/micromdm/nanohub/deviceerror"
+	"github.com/micromdm/nanohub/directory"
+	dirhttp "github.com/micromdm/nanohub/directory/http"
+	"github.com/micromdm/nanohub/dmchangelog"
+	dmchangeloghttp "github.com/micromdm/nanohub/dmchangelog/http"
+	dmdrifthttp "github.com/micromdm/nanohub/dmdrift/http"
+	"github.com/micromdm/nanohub/dmgc"
+	dmgchttp "github.com/micromdm/nanohub/dmgc/http"
+	"github.com/micromdm/nanohub/dmnotify"
+	dmnotifyhttp "github.com/micromdm/nanohub/dmnotify/http"
+	"github.com/micromdm/nanohub/dmshard"
+	"github.com/micromdm/nanohub/dmstatusreport"
+	dmstatusreporthttp "github.com/micromdm/nanohub/dmstatusreport/http"
+	"github.com/micromdm/nanohub/dmversion"
+	dmversionhttp "github.com/micromdm/nanohub/dmversion/http"
+	"github.com/micromdm/nanohub/dynset"
+	dynsethttp "github.com/micromdm/nanohub/dynset/http"
+	"github.com/micromdm/nanohub/enqueue"
+	"github.com/micromdm/nanohub/enrollprofile"
+	enrollprofilehttp "github.com/micromdm/nanohub/enrollprofile/http"
+	"github.com/micromdm/nanohub/environment"
+	envhttp "github.com/micromdm/nanohub/environment/http"
+	"github.com/micromdm/nanohub/escalation"
+	escalationhttp "github.com/micromdm/nanohub/escalation/http"
+	"github.com/micromdm/nanohub/event"
+	eventhttp "github.com/micromdm/nanohub/event/http"
+	"github.com/micromdm/nanohub/eventstream"
+	eventstreamhttp "github.com/micromdm/nanohub/eventstream/http"
+	"github.com/micromdm/nanohub/health"
+	healthhttp "github.com/micromdm/nanohub/health/http"
+	"github.com/micromdm/nanohub/identity"
+	identityhttp "github.com/micromdm/nanohub/identity/http"
+	"github.com/micromdm/nanohub/idresolve"
+	"github.com/micromdm/nanohub/idtransform"
+	"github.com/micromdm/nanohub/inbound"
+	inboundhttp "github.com/micromdm/nanohub/inbound/http"
+	"github.com/micromdm/nanohub/invquery"
+	invqueryhttp "github.com/micromdm/nanohub/invquery/http"
+	"github.com/micromdm/nanohub/jsonlog"
+	"github.com/micromdm/nanohub/kv/kvdiskv"
+	"github.com/micromdm/nanohub/lease"
+	"github.com/micromdm/nanohub/lifecycle"
+	lifecyclehttp "github.com/micromdm/nanohub/lifecycle/http"
+	"github.com/micromdm/nanohub/loglevel"
+	"github.com/micromdm/nanohub/migration"
+	migrationhttp "github.com/micromdm/nanohub/migration/http"
 	"github.com/micromdm/nanohub/nanohub"
+	"github.com/micromdm/nanohub/notes"
+	noteshttp "github.com/micromdm/nanohub/notes/http"
+	"github.com/micromdm/nanohub/notnow"
+	notnowhttp "github.com/micromdm/nanohub/notnow/http"
+	"github.com/micromdm/nanohub/osupdate"
+	osupdatehttp "github.com/micromdm/nanohub/osupdate/http"
+	"github.com/micromdm/nanohub/ping"
+	pinghttp "github.com/micromdm/nanohub/ping/http"
+	"github.com/micromdm/nanohub/portal"
+	"github.com/micromdm/nanohub/pushcert"
+	pushcerthttp "github.com/micromdm/nanohub/pushcert/http"
+	"github.com/micromdm/nanohub/pushfeedback"
+	pushfeedbackhttp "github.com/micromdm/nanohub/pushfeedback/http"
+	"github.com/micromdm/nanohub/pushpayload"
+	"github.com/micromdm/nanohub/pushretry"
+	pushretryhttp "github.com/micromdm/nanohub/pushretry/http"
+	"github.com/micromdm/nanohub/ratelimit"
+	"github.com/micromdm/nanohub/readonly"
+	"github.com/micromdm/nanohub/retention"
+	"github.com/micromdm/nanohub/runtimestats"
+	runtimestatshttp "github.com/micromdm/nanohub/runtimestats/http"
+	"github.com/micromdm/nanohub/scepchallenge"
+	scepchallengehttp "github.com/micromdm/nanohub/scepchallenge/http"
+	"github.com/micromdm/nanohub/search"
+	searchhttp "github.com/micromdm/nanohub/search/http"
+	"github.com/micromdm/nanohub/setbatch"
+	setbatchhttp "github.com/micromdm/nanohub/setbatch/http"
+	"github.com/micromdm/nanohub/statustrigger"
+	statustriggerhttp "github.com/micromdm/nanohub/statustrigger/http"
+	"github.com/micromdm/nanohub/tags"
+	tagshttp "github.com/micromdm/nanohub/tags/http"
+	"github.com/micromdm/nanohub/wfchain"
+	wfchainhttp "github.com/micromdm/nanohub/wfchain/http"
+	"github.com/micromdm/nanohub/wfhistory"
+	wfhistoryhttp "github.com/micromdm/nanohub/wfhistory/http"
+	"github.com/micromdm/nanohub/wfplugin"
+	"github.com/micromdm/nanohub/wfpolicy"
+	wfpolicyhttp "github.com/micromdm/nanohub/wfpolicy/http"
+	"github.com/micromdm/nanohub/xfcc"
 
 	"github.com/alexedwards/flow"
 	"github.com/jessepeterson/kmfddm/ddm"
@@ -18,13 +148,17 @@ import (
 	ddmhttp "github.com/jessepeterson/kmfddm/http/ddm"
 	"github.com/micromdm/nanocmd/engine"
 	cmdenghttp "github.com/micromdm/nanocmd/engine/http"
+	cmdstorage "github.com/micromdm/nanocmd/engine/storage"
+	"github.com/micromdm/nanocmd/workflow"
 	"github.com/micromdm/nanolib/envflag"
 	nanolibhttp "github.com/micromdm/nanolib/http"
 	"github.com/micromdm/nanolib/http/trace"
+	"github.com/micromdm/nanolib/log"
 	"github.com/micromdm/nanolib/log/stdlogfmt"
 	nanoapi "github.com/micromdm/nanomdm/http/api"
 	"github.com/micromdm/nanomdm/http/authproxy"
 	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
 	"github.com/micromdm/nanomdm/push/nanopush"
 	pushservice "github.com/micromdm/nanomdm/push/service"
 )
@@ -32,6 +166,16 @@ import (
 // overridden by -ldflags -X
 var version = "unknown"
 
+// Run modes.
+const (
+	modeServer = "server"
+	modeWorker = "worker"
+)
+
+// leaderTTL is the time after which the leader lease of a stopped
+// replica expires. It is renewed every third of it.
+const leaderTTL = 30 * time.Second
+
 func getCerts(rootsPath, intsPath string) (rootBytes []byte, intBytes []byte, err error) {
 	if rootsPath == "" {
 		err = errors.New("no path to CA root")
@@ -56,19 +200,127 @@ func main() {
 		flStorage    = flag.String("storage", "file", "storage backend")
 		flDSN        = flag.String("storage-dsn", "", "storage backend data source name")
 		flOptions    = flag.String("storage-options", "", "storage backend options")
+		flWStorage   = flag.String("worker-storage", "", "storage backend for workflow steps and worker bookkeeping (default same as -storage)")
+		flWDSN       = flag.String("worker-storage-dsn", "", "worker storage backend data source name")
 		flRootsPath  = flag.String("ca", "", "path to PEM CA cert(s)")
 		flIntsPath   = flag.String("intermediate", "", "path to PEM intermediate cert(s)")
+		flRevoke     = flag.String("cert-revocation", "", "check identity certificates for revocation (comma-separated ocsp and/or crl)")
+		flRevokeHard = flag.Bool("cert-revocation-hard-fail", false, "reject identity certificates whose revocation status can't be determined")
 		flDump       = flag.Bool("dump", false, "dump MDM requests and responses to stdout")
 		flCertHeader = flag.String("cert-header", "", "HTTP header containing TLS client certificate")
+		flXFCC       = flag.Bool("cert-header-xfcc", false, "extract the client certificate from an Envoy x-forwarded-client-cert header")
 		flAPIKey     = flag.String("api-key", "", "API key for API endpoints")
 		flDMShard    = flag.Bool("dmshard", false, "enable DM shard management properties declaration")
+		flShardCount = flag.Int("dmshard-count", dmshard.DefaultCount, "number of DM shards (100 for percentage-based rollouts)")
+		flShardBy    = flag.String("dmshard-by", "enrollment", "hash DM shards on the enrollment ID or device serial number (enrollment or serial)")
+		flShardSalt  = flag.String("dmshard-salt", "", "salt for hashing DM shards")
 		flWebhookURL = flag.String("webhook-url", "", "URL to send requests to")
 		flAuthProxy  = flag.String("auth-proxy-url", "", "Reverse proxy URL target for MDM-authenticated HTTP requests")
+		flAPPolicy   = flag.String("auth-proxy-policy", "", "comma-separated policies authproxy requests must pass")
+		flAPIDXform  = flag.String("auth-proxy-id-transform", "", "transform authproxy enrollment IDs (hmac, jwt, or serial)")
+		flAPIDKey    = flag.String("auth-proxy-id-key", "", "secret key for hmac and jwt authproxy ID transforms")
 		flUAZLChal   = flag.Bool("ua-zl-dc", false, "reply with zero-length DigestChallenge for UserAuthenticate")
 		flMigration  = flag.Bool("migration", false, "HTTP endpoint for enrollment migrations")
 		flWorkSec    = flag.Uint("worker-interval", uint(engine.DefaultDuration/time.Second), "interval for worker in seconds")
+		flWorkLease  = flag.Bool("worker-lease", false, "only run the worker of the replica holding the worker lease (requires mysql storage)")
+		flLeader     = flag.Bool("leader-election", false, "only run shared background jobs on the replica holding the leader lease (requires mysql storage)")
 		flPushSec    = flag.Uint("repush-interval", uint(engine.DefaultRePushDuration/time.Second), "interval for repushes in seconds")
+		flEscalation = flag.String("repush-escalation", "", "re-push escalation ladder (e.g. priority=1h,alert=6h,unresponsive=72h)")
+		flNotNowSec  = flag.Uint("notnow-delay", uint(notnow.DefaultDelay/time.Second), "delay before re-pushing enrollments that responded NotNow in seconds (0 disables)")
+		flNotNowMax  = flag.Uint("notnow-max-delay", uint(notnow.DefaultMaxDelay/time.Second), "maximum delay between NotNow re-pushes in seconds")
 		flRetro      = flag.Bool("retro", false, "Allow retroactive certificate-authorization association")
+		flAudit      = flag.Bool("audit", false, "record API actions to the audit log")
+		flAuditAge   = flag.Uint("audit-retention-age", 0, "age after which audit events are pruned in seconds (0 keeps all)")
+		flAuditMax   = flag.Int("audit-retention-count", 0, "number of newest audit events kept (0 keeps all)")
+		flDMChanges  = flag.Bool("dm-changelog", false, "record DM declaration and set mutations to the DM change log")
+		flDMVersions = flag.Bool("dm-versions", false, "keep prior versions of declarations for history, rollback, and pinning")
+		flDMAsync    = flag.Bool("dm-notify-async", false, "queue DM notifications and notify enrollments in the background")
+		flActions    = flag.String("event-actions", "", "path to JSON event actions config")
+		flActionSec  = flag.Uint("event-action-timeout", uint(event.DefaultTimeout/time.Second), "timeout of event action and webhook HTTP requests in seconds")
+		flEvStream   = flag.Bool("event-stream", false, "enable the live server-sent event stream API")
+		flLogFormat  = flag.String("log-format", "logfmt", "log output format (logfmt or json)")
+		flLogLevels  = flag.String("log-levels", "", "per-service log levels (e.g. worker=debug,nanomdm=info)")
+		flDirURL     = flag.String("directory-url", "", "SCIM service URL for directory sync")
+		flDirToken   = flag.String("directory-token", "", "bearer token for directory sync")
+		flDirSec     = flag.Uint("directory-interval", 3600, "interval for directory sync in seconds")
+		flIDResURL   = flag.String("id-resolver-url", "", "URL of an external service resolving identifiers to enrollment IDs")
+		flIDResKinds = flag.String("id-resolver-kinds", "asset", "comma-separated identifier kinds resolved by the -id-resolver-url service")
+		flAnomalySec = flag.Uint("anomaly-interval", 0, "window for check-in anomaly detection in seconds (0 disables)")
+		flDynSetSec  = flag.Uint("dynset-interval", 300, "interval for syncing dynamic DM set memberships in seconds (0 disables)")
+		flCensusSec  = flag.Uint("census-interval", 3600, "interval for updating the daily fleet census snapshot in seconds (0 disables)")
+		flExpirySec  = flag.Uint("expiry-interval", 60, "interval for expiring commands in seconds")
+		flRetainSec  = flag.Uint("retention-interval", 3600, "interval for pruning status reports and command results in seconds (0 disables)")
+		flStatusAge  = flag.Uint("status-retention-age", 0, "age after which DM status reports are pruned in seconds (0 keeps all)")
+		flStatusMax  = flag.Int("status-retention-count", 0, "number of newest DM status reports kept per enrollment (0 keeps all)")
+		flResultAge  = flag.Uint("result-retention-age", 0, "age after which command results are pruned in seconds (0 keeps all)")
+		flResultMax  = flag.Int("result-retention-count", 0, "number of newest command results kept per enrollment (0 keeps all)")
+		flPingSec    = flag.Uint("ping-timeout", 300, "time after which unanswered pings time out in seconds")
+		flDelegTTL   = flag.Uint("delegation-max-ttl", 86400, "maximum lifetime of delegation tokens in seconds")
+		flMaxBody    = flag.Int64("max-body-size", 0, "maximum MDM request body size in bytes (0 is unlimited)")
+		flMaxStatus  = flag.Int("dm-max-status-size", 0, "maximum DM status item size in bytes (0 is unlimited)")
+		flDMTemplate = flag.Bool("dm-templates", false, "render declaration placeholders per enrollment")
+		flDMStatusEv = flag.Bool("dm-status-events", false, "send DM status reports as events")
+		flDMReports  = flag.Bool("dm-status-reports", false, "keep queryable summaries of DM status reports")
+		flDMAssets   = flag.Bool("dm-assets", false, "host DM asset data for enrollments with MDM authentication")
+		flDMIdentity = flag.String("dm-identity", "", "path to JSON config for per-enrollment DM identity declarations")
+		flConfigAPI  = flag.Bool("config-api", false, "enable the declarative config API with webhooks and workflow schedules")
+		flSchedSec   = flag.Uint("schedule-interval", 60, "interval for starting scheduled workflows in seconds (0 disables)")
+		flRateEnr    = flag.Float64("rate-enrollment", 0, "MDM requests per second allowed per enrollment (0 disables)")
+		flRateEnrB   = flag.Int("rate-enrollment-burst", 10, "MDM request burst allowed per enrollment")
+		flRateGlobal = flag.Float64("rate-global", 0, "MDM requests per second allowed for all enrollments (0 disables)")
+		flPortal     = flag.String("portal-profile", "", "path to enrollment profile template for the enrollment portal")
+		flPortalHdr  = flag.String("portal-user-header", portal.DefaultUserHeader, "HTTP header containing the SSO-authenticated portal user")
+		flPortalTTL  = flag.Uint("portal-token-ttl", uint(portal.DefaultTokenTTL/time.Second), "lifetime of unused portal enrollment tokens in seconds")
+		flRateGlobB  = flag.Int("rate-global-burst", 100, "MDM request burst allowed for all enrollments")
+		flReadOnly   = flag.Bool("read-only", false, "serve only the read API without MDM endpoints or background jobs")
+		flMode       = flag.String("mode", modeServer, "run mode (server or worker)")
+		flDebugAPI   = flag.Bool("debug-api", false, "enable the authenticated pprof and runtime statistics API")
+		flPushCerts  = flag.String("push-certs", "", "comma-separated paths to PEM push certificate and key files")
+		flEnvDefault = flag.String("environment-default", "", "environment of enrollments without an environment label")
+		flEnvReq     = flag.Bool("environment-required", false, "require API requests that change enrollments to specify an environment")
+		flBatchMS    = flag.Uint("push-batch-window", 0, "window for coalescing DM and workflow pushes in milliseconds (0 disables)")
+		flBatchSize  = flag.Int("push-batch-size", enqueue.DefaultBatchSize, "maximum enrollments per coalesced push batch")
+		flDMDebounce = flag.Uint("dm-debounce-window", 0, "window for coalescing DM notification commands in milliseconds (0 disables)")
+		flDMGCSec    = flag.Uint("dm-gc-interval", 0, "interval for collecting orphaned DM declarations and assets in seconds (0 disables)")
+		flDMGCGrace  = flag.Uint("dm-gc-grace", 168, "hours a DM declaration or asset must be orphaned before it is deleted")
+		flDMGCDelete = flag.Bool("dm-gc-delete", false, "delete orphaned DM declarations and assets after the grace period")
+		flAPNSKey    = flag.String("apns-key", "", "path to APNs .p8 signing key for token-based push")
+		flAPNSKeyID  = flag.String("apns-key-id", "", "APNs signing key ID (default from key file name)")
+		flAPNSTeam   = flag.String("apns-team-id", "", "Apple Developer team ID for token-based push")
+		flAPNSCheck  = flag.Bool("apns-check", false, "check APNs connectivity and credentials at startup and periodically")
+		flAPNSChkSec = flag.Uint("apns-check-interval", 3600, "interval for APNs checks in seconds (0 checks only at startup)")
+		flAPNSChkTop = flag.String("apns-check-topics", "", "comma-separated push topics to check (default from -push-certs)")
+		flPushPay    = flag.String("push-payload", "", "JSON object of extra fields to add to APNs push payloads")
+		flDevErrors  = flag.String("device-errors", "", "path to JSON config of error response bodies for device endpoints")
+		flPushPrune  = flag.Bool("push-prune-invalid", false, "stop pushing to enrollments whose push tokens APNs reports as invalid")
+		flCheckinBuf = flag.String("checkin-buffer", "", "path to local directory for buffering check-in writes during storage outages")
+		flCheckinMax = flag.Int("checkin-buffer-max", checkinbuffer.DefaultMaxEntries, "maximum number of buffered check-in writes")
+		flSCEPChal   = flag.Bool("scep-challenges", false, "issue and validate one-time SCEP challenges")
+		flSCEPTTL    = flag.Uint("scep-challenge-ttl", uint(scepchallenge.DefaultTTL/time.Second), "lifetime of SCEP challenges in seconds")
+		flSCEPCA     = flag.String("scep-ca", "", "path to SCEP CA certificate PEM file to trust for MDM client certificates")
+		flEnrollURL  = flag.String("enroll-url", "", "base URL of this server for generated enrollment profiles")
+		flQueueCodec = flag.String("queue-codec", "", "comma-separated codecs for stored command queue payloads (gzip, plist)")
+		flAcctEnr    = flag.Bool("account-enroll", true, "enable account-driven User Enrollment (requires -enroll-url)")
+		flAcctEnrHdr = flag.String("account-enroll-token-header", accountenroll.DefaultAccessTokenHeader, "HTTP header containing the SSO identity provider access token")
+		flEnrollTop  = flag.String("enroll-topic", "", "push topic for generated enrollment profiles (default from -push-certs)")
+		flEnrollSCEP = flag.String("enroll-scep-url", "", "SCEP server URL for generated enrollment profiles")
+		flEnrollCert = flag.String("enroll-sign-cert", "", "path to PEM certificate for signing generated enrollment profiles")
+		flEnrollKey  = flag.String("enroll-sign-key", "", "path to PEM private key for signing generated enrollment profiles")
+		flRetries    = flag.Int("push-retries", pushretry.DefaultRetries, "number of retries of transiently failed APNs pushes")
+		flDEP        = flag.Bool("dep", false, "enable the DEP API and device syncer")
+		flDEPSec     = flag.Uint("dep-interval", 1800, "interval for DEP device sync in seconds (0 disables)")
+		flCapGate    = flag.String("capability-gate", "", "check commands against device OS capabilities (warn or enforce)")
+		flCapMatrix  = flag.String("capability-matrix", "", "path to JSON capability matrix merged over the built-in matrix")
+		flAttestRoot = flag.String("attest-roots", "", "path to Apple attestation root CA PEM file; enables device attestation")
+		flIdentity   = flag.String("identity-map", "", "map identity certificate fields to enrollment identities (e.g. user=san.email,asset=subject.serialnumber)")
+		flCertExp    = flag.Bool("cert-expiry", false, "track identity certificate expiry and enable the renewal workflow")
+		flCertWindow = flag.Uint("cert-renew-window", 720, "hours before identity certificates expire that they are renewed")
+		flCertRenSec = flag.Uint("cert-renew-interval", 0, "interval for starting identity certificate renewals in seconds (0 disables)")
+		flCertProf   = flag.String("cert-renew-profile", "", "path to enrollment profile for identity certificate renewals (default generated, see -enroll-url)")
+		flCertAssoc  = flag.Bool("cert-associations", false, "record identity certificate associations and enable the association API")
+		flLifecycle  = flag.Bool("enrollment-lifecycle", false, "enable the enrollment disable, re-enable, and delete API")
+		flWFPlugins  = flag.String("workflow-plugins", "", "comma-separated paths of workflow plugin executables")
+		flWFCallouts = flag.String("workflow-callouts", "", "comma-separated URLs of workflow callout services")
 	)
 
 	envflag.Parse("NANOHUB_", []string{"version"})
@@ -78,13 +330,139 @@ func main() {
 		return
 	}
 
-	logger := stdlogfmt.New(stdlogfmt.WithDebugFlag(*flDebug))
+	// debug logging is always enabled in the underlying logger.
+	// the service log levels filter debug logging instead.
+	var logger log.Logger
+	switch *flLogFormat {
+	case "logfmt":
+		logger = stdlogfmt.New(stdlogfmt.WithDebug())
+	case "json":
+		logger = jsonlog.New(jsonlog.WithDebug())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown log format: %s\n", *flLogFormat)
+		os.Exit(2)
+	}
+
+	logLevels := loglevel.NewLevels(loglevel.Info)
+	if *flDebug {
+		logLevels.Set(loglevel.DefaultService, loglevel.Debug)
+	}
+	if err := logLevels.Parse(*flLogLevels); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing log levels: %v\n", err)
+		os.Exit(2)
+	}
+	logger = loglevel.New(logger, logLevels)
+
+	switch *flMode {
+	case modeServer:
+	case modeWorker:
+		if *flReadOnly {
+			logger.Info("err", "-mode worker can't be used with -read-only")
+			os.Exit(2)
+		}
+		if *flWorkSec < 1 {
+			logger.Info("err", "-mode worker requires -worker-interval")
+			os.Exit(2)
+		}
+	default:
+		logger.Info("err", fmt.Sprintf("unknown mode: %s", *flMode))
+		os.Exit(2)
+	}
 
 	store, dmStore, cmdstore, err := NewStore(*flStorage, *flDSN, *flOptions, logger)
 	if err != nil {
 		logger.Info("err", err)
 		os.Exit(1)
 	}
+	// store is wrapped below; the enrollment lifecycle needs the storage backend
+	mdmBackend := store
+
+	if *flWStorage != "" && cmdstore != nil {
+		cmdstore, err = NewWorkerStore(*flWStorage, *flWDSN, cmdstore)
+		if err != nil {
+			logger.Info("msg", "creating worker storage", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var checkinBuf *checkinbuffer.Buffer
+	if *flCheckinBuf != "" {
+		checkinBuf, err = checkinbuffer.New(
+			store,
+			kvdiskv.New(*flCheckinBuf),
+			checkinbuffer.WithMaxEntries(*flCheckinMax),
+			checkinbuffer.WithLogger(logger.With("service", "checkin-buffer")),
+		)
+		if err != nil {
+			logger.Info("msg", "creating check-in buffer", "err", err)
+			os.Exit(1)
+		}
+		store = checkinBuf
+	}
+
+	buckets, err := newKVBuckets(*flStorage, *flDSN)
+	if err != nil {
+		logger.Info("err", err)
+		os.Exit(1)
+	}
+
+	if *flQueueCodec != "" {
+		codec, err := cmdcodec.Parse(*flQueueCodec)
+		if err != nil {
+			logger.Info("msg", "parsing queue codecs", "err", err)
+			os.Exit(2)
+		}
+		store = cmdcodec.New(
+			store,
+			buckets.bucket("cmd-payloads"),
+			codec,
+			cmdcodec.WithLogger(logger.With("service", "cmdcodec")),
+		)
+	}
+
+	var certAssocs *certassoc.Store
+	if *flCertAssoc {
+		certAssocs = certassoc.New(
+			store,
+			buckets.bucket("cert-associations"),
+			certassoc.WithLogger(logger.With("service", "cert-associations")),
+		)
+		store = certAssocs
+	}
+
+	notesStore := notes.NewKVStore(buckets.bucket("notes"))
+	respStore := cmdresponse.NewKVStore(buckets.bucket("responses"))
+	envStore := environment.NewKVStore(buckets.bucket("environments"))
+	tagStore := tags.NewKVStore(buckets.bucket("tags"))
+
+	var dirSource directory.Source
+	if *flDirURL != "" {
+		if dirSource, err = directory.NewSCIM(*flDirURL, *flDirToken, nil); err != nil {
+			logger.Info("err", err)
+			os.Exit(1)
+		}
+	}
+	dir := directory.New(
+		directory.NewKVStore(buckets.bucket("directory")),
+		dirSource,
+		logger.With("service", "directory"),
+	)
+
+	idResOpts := []idresolve.Option{
+		idresolve.WithLogger(logger.With("service", "idresolve")),
+		idresolve.WithResolver("serial", idresolve.Serial(respStore)),
+		idresolve.WithResolver("user", idresolve.User(dir.Store())),
+		idresolve.WithResolver("group", idresolve.ResolverFunc(dir.GroupEnrollments)),
+		idresolve.WithResolver("tag", idresolve.Tag(tagStore)),
+	}
+	if *flIDResURL != "" {
+		for _, kind := range strings.Split(*flIDResKinds, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				idResOpts = append(idResOpts, idresolve.WithResolver(kind, idresolve.NewHTTP(*flIDResURL, kind, nil)))
+			}
+		}
+	}
+	idResolver := idresolve.New(idResOpts...)
 
 	roots, ints, err := getCerts(*flRootsPath, *flIntsPath)
 	if err != nil {
@@ -92,7 +470,183 @@ func main() {
 		os.Exit(1)
 	}
 
-	pushService := pushservice.New(store, store, nanopush.NewFactory(), logger.With("service", "push"))
+	if *flSCEPCA != "" {
+		// certificates issued by the SCEP CA are valid MDM client identities
+		scepCA, err := os.ReadFile(*flSCEPCA)
+		if err != nil {
+			logger.Info("msg", "reading SCEP CA", "err", err)
+			os.Exit(1)
+		}
+		roots = append(append(roots, '\n'), scepCA...)
+	}
+
+	var scepChallenges *scepchallenge.Issuer
+	if *flSCEPChal {
+		scepChallenges = scepchallenge.New(
+			scepchallenge.NewKVStore(buckets.bucket("scep-challenges")),
+			scepchallenge.WithTTL(time.Second*time.Duration(*flSCEPTTL)),
+			scepchallenge.WithLogger(logger.With("service", "scep-challenge")),
+		)
+	}
+
+	var pushCerts *pushcert.Loader
+	if *flPushCerts != "" {
+		if *flReadOnly {
+			logger.Info("err", "-push-certs can't be used with -read-only")
+			os.Exit(1)
+		}
+		pushCerts = pushcert.NewLoader(store, strings.Split(*flPushCerts, ","), logger.With("service", "pushcert"))
+		if _, err = pushCerts.Load(context.Background()); err != nil {
+			logger.Info("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var identities *identity.KVStore
+	var identityMapper identity.FieldMapper
+	if *flIdentity != "" {
+		if identityMapper, err = identity.ParseFieldMapper(*flIdentity); err != nil {
+			logger.Info("msg", "parsing identity map", "err", err)
+			os.Exit(2)
+		}
+		identities = identity.NewKVStore(buckets.bucket("identity"))
+	}
+
+	// actionClient sends the HTTP requests of event actions and webhooks
+	actionClient := &http.Client{Timeout: time.Second * time.Duration(*flActionSec)}
+
+	// configStore holds the webhooks and workflow schedules of the config API
+	var configStore *configapi.KVStore
+	var webhooks *configapi.Webhooks
+	if *flConfigAPI {
+		configStore = configapi.NewKVStore(buckets.bucket("config"))
+		webhooks = configapi.NewWebhooks(configStore, actionClient)
+	}
+
+	var eventSink event.Sink
+	var actions event.MultiSink
+	if *flActions != "" {
+		actions, err = event.LoadActions(*flActions, actionClient)
+		if err != nil {
+			logger.Info("msg", "loading event actions", "err", err)
+			os.Exit(1)
+		}
+	}
+	if webhooks != nil {
+		actions = append(actions, webhooks)
+	}
+	if len(actions) > 0 {
+		// include enrollment notes and ownership records with events
+		eventSink = notes.NewEnricher(notesStore, actions)
+		if identities != nil {
+			eventSink = identity.NewEnricher(identities, eventSink)
+		}
+	}
+
+	var payload pushpayload.Customizer
+	if *flPushPay != "" {
+		if payload, err = pushpayload.ParseStatic(*flPushPay); err != nil {
+			logger.Info("msg", "parsing push payload", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	var pushService push.Pusher
+	var apnsSigner *apnstoken.Signer
+	if *flAPNSKey != "" {
+		if *flAPNSTeam == "" {
+			logger.Info("err", "-apns-team-id is required with -apns-key")
+			os.Exit(2)
+		}
+		// the key file is re-read when it changes to allow key rotation
+		apnsKey, err := apnstoken.NewFileKey(*flAPNSKey, *flAPNSKeyID)
+		if err != nil {
+			logger.Info("msg", "loading APNs key", "err", err)
+			os.Exit(1)
+		}
+		apnsPusher := apnstoken.New(
+			store,
+			apnsKey,
+			*flAPNSTeam,
+			apnstoken.WithLogger(logger.With("service", "push")),
+			apnstoken.WithPayload(payload),
+		)
+		apnsSigner = apnsPusher.Signer()
+		pushService = apnsPusher
+	} else {
+		var factoryOpts []nanopush.Option
+		if payload != nil {
+			factoryOpts = append(factoryOpts, nanopush.WithNewClient(pushpayload.NewClient(payload)))
+		}
+		pushService = pushservice.New(store, store, nanopush.NewFactory(factoryOpts...), logger.With("service", "push"))
+	}
+
+	pushFailures := pushretry.NewKVStore(buckets.bucket("push-failures"))
+	pushService = pushretry.New(
+		pushService,
+		pushretry.WithRetries(*flRetries),
+		pushretry.WithRecorder(pushFailures),
+		pushretry.WithLogger(logger.With("service", "push-retry")),
+	)
+
+	var apnsChecker *apnscheck.Checker
+	if *flAPNSCheck {
+		checkOpts := []apnscheck.Option{apnscheck.WithLogger(logger.With("service", "apns-check"))}
+		if *flAPNSChkTop != "" {
+			topics := strings.Split(*flAPNSChkTop, ",")
+			checkOpts = append(checkOpts, apnscheck.WithTopics(func() []string { return topics }))
+		} else if pushCerts != nil {
+			checkOpts = append(checkOpts, apnscheck.WithTopics(func() []string {
+				var topics []string
+				for _, info := range pushCerts.Loaded() {
+					topics = append(topics, info.Topic)
+				}
+				return topics
+			}))
+		} else if apnsSigner == nil {
+			logger.Info("err", "-apns-check requires -apns-check-topics or -push-certs without -apns-key")
+			os.Exit(2)
+		}
+		if apnsSigner != nil {
+			checkOpts = append(checkOpts, apnscheck.WithToken(apnsSigner))
+		} else {
+			checkOpts = append(checkOpts, apnscheck.WithCertificates(store))
+		}
+		apnsChecker = apnscheck.New(checkOpts...)
+		// preflight: surface broken egress or credentials at startup
+		if status := apnsChecker.Check(context.Background()); status.OK {
+			logger.Info("msg", "APNs check succeeded", "results", len(status.Results))
+		}
+		if *flAPNSChkSec > 0 {
+			go apnsChecker.Run(context.Background(), time.Second*time.Duration(*flAPNSChkSec))
+		}
+	}
+
+	var pushPruner *pushfeedback.Pruner
+	if *flPushPrune {
+		pushPruner = pushfeedback.New(
+			pushfeedback.NewKVStore(buckets.bucket("push-invalid")),
+			pushfeedback.WithLogger(logger.With("service", "push-feedback")),
+			pushfeedback.WithSink(eventSink),
+		)
+		pushService = pushPruner.Wrap(pushService)
+	}
+
+	var (
+		depStore  *dep.KVStore
+		depClient *dep.Client
+		depSyncer *dep.Syncer
+	)
+	if *flDEP {
+		depStore = dep.NewKVStore(buckets.bucket("dep"))
+		depClient = dep.NewClient(depStore)
+		depSyncer = dep.NewSyncer(
+			depClient,
+			depStore,
+			dep.WithLogger(logger.With("service", "dep")),
+			dep.WithSink(eventSink),
+		)
+	}
 
 	hubOpts := []nanohub.Option{
 		nanohub.WithLogger(logger),
@@ -102,10 +656,80 @@ func main() {
 		nanohub.WithUADefault(*flUAZLChal),
 	}
 
+	if pushPruner != nil {
+		hubOpts = append(hubOpts, nanohub.WithService(pushPruner))
+	}
+
+	if *flRevoke != "" {
+		var revokeOpts []certrevoke.Option
+		for _, method := range strings.Split(*flRevoke, ",") {
+			switch strings.TrimSpace(method) {
+			case "ocsp":
+				revokeOpts = append(revokeOpts, certrevoke.WithOCSP())
+			case "crl":
+				revokeOpts = append(revokeOpts, certrevoke.WithCRL())
+			default:
+				logger.Info("msg", "invalid revocation method", "method", method)
+				os.Exit(2)
+			}
+		}
+		if *flRevokeHard {
+			revokeOpts = append(revokeOpts, certrevoke.WithHardFail())
+		}
+		hubOpts = append(hubOpts, nanohub.WithRevocationCheck(revokeOpts...))
+	}
+
+	var capGate *capability.Gate
+	if *flCapGate != "" {
+		matrix := capability.DefaultMatrix()
+		if *flCapMatrix != "" {
+			matrixJSON, err := os.ReadFile(*flCapMatrix)
+			if err != nil {
+				logger.Info("msg", "reading capability matrix", "err", err)
+				os.Exit(1)
+			}
+			if matrix, err = capability.ParseMatrix(matrixJSON); err != nil {
+				logger.Info("msg", "parsing capability matrix", "err", err)
+				os.Exit(1)
+			}
+		}
+		capOpts := []capability.Option{capability.WithLogger(logger.With("service", "capability"))}
+		switch *flCapGate {
+		case "enforce":
+			capOpts = append(capOpts, capability.WithEnforce())
+		case "warn":
+		default:
+			logger.Info("msg", "invalid capability gate mode", "mode", *flCapGate)
+			os.Exit(1)
+		}
+		if dmStore != nil {
+			capOpts = append(capOpts, capability.WithDeclarationStore(dmStore))
+		}
+		capGate = capability.New(capability.NewKVStore(buckets.bucket("capability")), matrix, capOpts...)
+		hubOpts = append(hubOpts, nanohub.WithCapabilityGate(capGate))
+	}
+
+	var pushBatcher *enqueue.Batcher
+	if *flBatchMS > 0 {
+		pushBatcher = enqueue.NewBatcher(
+			pushService,
+			enqueue.WithBatchSize(*flBatchSize),
+			enqueue.WithBatchLogger(logger.With("service", "push-batcher")),
+		)
+		hubOpts = append(hubOpts, nanohub.WithPushBatcher(pushBatcher))
+	}
+	if *flDMDebounce > 0 {
+		hubOpts = append(hubOpts, nanohub.WithDMDebounce(time.Millisecond*time.Duration(*flDMDebounce)))
+	}
+
 	if *flRetro {
 		hubOpts = append(hubOpts, nanohub.WithAllowRetroactive())
 	}
 
+	if *flMaxBody > 0 {
+		hubOpts = append(hubOpts, nanohub.WithMaxBodySize(*flMaxBody))
+	}
+
 	if *flCheckin {
 		hubOpts = append(hubOpts,
 			nanohub.WithCheckinHandler(),
@@ -113,17 +737,80 @@ func main() {
 		)
 	}
 
+	var dmReports *dmstatusreport.KVStore
+	var dmAssets *ddmasset.KVStore
 	if dmStore != nil {
 		hubOpts = append(hubOpts,
 			nanohub.WithDM(dmStore),
 			nanohub.WithDMStatusStore(dmStore, getStatusID),
 		)
 		if *flDMShard {
-			hubOpts = append(hubOpts, nanohub.WithDMShard(nil))
+			shardOpts := []dmshard.Option{
+				dmshard.WithCount(*flShardCount),
+				dmshard.WithSalt(*flShardSalt),
+				dmshard.WithLogger(logger.With("service", "dmshard")),
+			}
+			switch *flShardBy {
+			case "enrollment":
+			case "serial":
+				shardOpts = append(shardOpts, dmshard.WithSerialNumbers(respStore))
+			default:
+				logger.Info("msg", "invalid DM shard hashing", "by", *flShardBy)
+				os.Exit(1)
+			}
+			hubOpts = append(hubOpts, nanohub.WithDMShard(dmshard.New(shardOpts...).ShardFunc()))
+		}
+		if *flMaxStatus > 0 {
+			hubOpts = append(hubOpts, nanohub.WithDMMaxStatusSize(*flMaxStatus))
+		}
+		if *flDMStatusEv {
+			if eventSink == nil {
+				logger.Info("err", "-dm-status-events requires -event-actions")
+				os.Exit(1)
+			}
+			hubOpts = append(hubOpts, nanohub.WithDMSecondaryStatusStore("events", ddmadapter.NewStatusEventStore(eventSink)))
+		}
+		if *flDMAssets {
+			dmAssets = ddmasset.NewKVStore(buckets.bucket("dmassets"))
+		}
+		if *flDMReports {
+			dmReports = dmstatusreport.NewKVStore(buckets.bucket("dmstatusreport"))
+			hubOpts = append(hubOpts, nanohub.WithDMSecondaryStatusStore("reports", dmstatusreport.New(dmReports)))
+		}
+	}
+
+	osUpdates := osupdate.NewTracker(
+		osupdate.NewKVStore(buckets.bucket("osupdate")),
+		osupdate.WithSink(eventSink),
+		osupdate.WithLogger(logger.With("service", "osupdate")),
+	)
+
+	var osPostureOpts []osupdate.ReporterOption
+	if dmStore != nil {
+		osPostureOpts = append(osPostureOpts, osupdate.WithDeclarations(dmStore))
+	}
+	osPostures := osupdate.NewReporter(osUpdates, respStore, osPostureOpts...)
+
+	// the DM notifier is created by NanoHUB below.
+	// the OS update workflow notifies enrollments once it exists.
+	var dmNotifier nanohub.DMNotifier
+	var osUpdateOpts []osupdate.WorkflowOption
+	if dmStore != nil {
+		hubOpts = append(hubOpts, nanohub.WithDMStatusHandler(osupdate.StatusPath, osUpdates.StatusHandler))
+		if capGate != nil {
+			osUpdateOpts = append(osUpdateOpts, osupdate.WithDDM(dmStore, osupdate.NotifierFunc(
+				func(ctx context.Context, declarations []string, sets []string, ids []string) error {
+					if dmNotifier == nil {
+						return errors.New("DM notifier not created")
+					}
+					return dmNotifier.Changed(ctx, declarations, sets, ids)
+				},
+			), capGate))
 		}
 	}
 
 	var subsysStore *subsystemStorage
+	var invSearcher invquery.Searcher
 	if cmdstore != nil {
 		hubOpts = append(hubOpts,
 			nanohub.WithWF(cmdstore),
@@ -135,11 +822,61 @@ func main() {
 			logger.Info("err", err)
 			os.Exit(1)
 		}
+		if searcher, ok := subsysStore.inventory.(invquery.Searcher); ok {
+			invSearcher = searcher
+		} else if subsysStore.inventory != nil {
+			// index the inventory of backends that can't query it
+			index := invquery.NewIndex(subsysStore.inventory, buckets.bucket("inventory"))
+			subsysStore.inventory = index
+			invSearcher = index
+		}
 
-		hubOpts = append(hubOpts, workflows(logger, subsysStore)...)
+		hubOpts = append(hubOpts, workflows(logger, subsysStore, eventSink, osUpdates, osUpdateOpts...)...)
+	}
+
+	if *flWFPlugins != "" {
+		for _, path := range strings.Split(*flWFPlugins, ",") {
+			path := path
+			hubOpts = append(hubOpts, nanohub.WithWorkflow(
+				func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+					if w, err = wfplugin.New(e, path, wfplugin.WithLogger(logger.With("workflow", "plugin"))); err != nil {
+						err = fmt.Errorf("creating plugin workflow %s: %w", path, err)
+					}
+					return
+				},
+			))
+		}
+	}
+
+	if *flWFCallouts != "" {
+		for _, url := range strings.Split(*flWFCallouts, ",") {
+			url := url
+			hubOpts = append(hubOpts, nanohub.WithWorkflow(
+				func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+					if w, err = wfplugin.NewCallout(e, url, wfplugin.WithLogger(logger.With("workflow", "callout"))); err != nil {
+						err = fmt.Errorf("creating callout workflow: %w", err)
+					}
+					return
+				},
+			))
+		}
+	}
+
+	if *flDMTemplate {
+		if dmStore == nil || subsysStore == nil || subsysStore.inventory == nil {
+			logger.Info("err", "-dm-templates requires DM and inventory storage")
+			os.Exit(1)
+		}
+		hubOpts = append(hubOpts, nanohub.WithDMTemplateValues(ddmadapter.InventoryTemplateValues(subsysStore.inventory)))
 	}
 
-	if *flCertHeader != "" {
+	if *flXFCC {
+		header := *flCertHeader
+		if header == "" {
+			header = xfcc.Header
+		}
+		hubOpts = append(hubOpts, nanohub.WithXFCCHeader(header))
+	} else if *flCertHeader != "" {
 		hubOpts = append(hubOpts, nanohub.WithCertHeader(*flCertHeader))
 	} else {
 		// default to Mdm-Signature
@@ -158,23 +895,605 @@ func main() {
 		hubOpts = append(hubOpts, nanohub.WithWebhook(*flWebhookURL))
 	}
 
+	if eventSink != nil {
+		hubOpts = append(hubOpts, nanohub.WithEventSink(eventSink))
+	}
+
+	var eventBroker *eventstream.Broker
+	if *flEvStream {
+		eventBroker = eventstream.New(eventstream.WithLogger(logger.With("service", "event-stream")))
+		hubOpts = append(hubOpts, nanohub.WithEventStream(eventBroker))
+		if dmStore != nil {
+			hubOpts = append(hubOpts, nanohub.WithDMSecondaryStatusStore("stream", ddmadapter.NewStatusEventStore(eventBroker)))
+		}
+	}
+
+	// the workflow engine is created by NanoHUB below.
+	// workflows are notified of removed commands once it exists.
+	var cmdEngine nanohub.Engine
+	cmdQueue := cmdqueue.New(
+		store,
+		cmdqueue.WithLogger(logger.With("service", "cmdqueue")),
+		cmdqueue.WithResponseReceiver(cmdqueue.ResponseReceiverFunc(
+			func(ctx context.Context, id, uuid string, raw []byte, mdmCtx *workflow.MDMContext) error {
+				if cmdEngine == nil {
+					return nil
+				}
+				return cmdEngine.MDMCommandResponseEvent(ctx, id, uuid, raw, mdmCtx)
+			},
+		)),
+	)
+
+	// workflow history records the steps retried by workflow policies
+	var wfHistory *wfhistory.Recorder
+	var wfHistoryStore *wfhistory.KVStore
+	if cmdstore != nil {
+		wfHistoryStore = wfhistory.NewKVStore(buckets.bucket("wfhistory"))
+		wfHistory = wfhistory.New(
+			wfHistoryStore,
+			cmdstore,
+			wfhistory.WithLogger(logger.With("service", "wfhistory")),
+		)
+		hubOpts = append(hubOpts,
+			nanohub.WithStepEnqueuerWrapper(wfHistory.WrapEnqueuer),
+			nanohub.WithService(wfHistory),
+		)
+	}
+
+	// workflow policies retry timed out steps before chains see them
+	var wfPolicies *wfpolicy.KVStore
+	if cmdstore != nil {
+		wfPolicies = wfpolicy.NewKVStore(buckets.bucket("wfpolicy"))
+		retrier := wfpolicy.New(wfPolicies, wfpolicy.WithLogger(logger.With("service", "wfpolicy")))
+		hubOpts = append(hubOpts,
+			nanohub.WithStepEnqueuerWrapper(retrier.WrapEnqueuer),
+			nanohub.WithWorkflowWrapper(retrier.Wrap),
+		)
+	}
+
+	// workflows start the next workflows of their chains on completion
+	var wfChains *wfchain.KVStore
+	if cmdstore != nil {
+		wfChains = wfchain.NewKVStore(buckets.bucket("wfchain"))
+		chainer := wfchain.New(
+			wfChains,
+			wfchain.WorkflowStarterFunc(
+				func(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error) {
+					if cmdEngine == nil {
+						return "", errors.New("workflow engine not created")
+					}
+					return cmdEngine.StartWorkflow(ctx, name, context, ids, e, mdmCtx)
+				},
+			),
+			cmdstore,
+			wfchain.WithLogger(logger.With("service", "wfchain")),
+		)
+		hubOpts = append(hubOpts, nanohub.WithWorkflowWrapper(chainer.Wrap))
+	}
+	if wfHistory != nil {
+		// the outermost workflow wrapper sees timeouts before any retries
+		hubOpts = append(hubOpts, nanohub.WithWorkflowWrapper(wfHistory.Wrap))
+	}
+
+	expiryStore := cmdexpiry.NewKVStore(buckets.bucket("expiry"))
+	expirer := cmdexpiry.New(
+		expiryStore,
+		cmdQueue,
+		eventSink,
+		logger.With("service", "expiry"),
+	)
+	hubOpts = append(hubOpts, nanohub.WithService(expirer))
+
+	notNowOpts := []notnow.Option{notnow.WithLogger(logger.With("service", "notnow"))}
+	if *flNotNowSec > 0 {
+		notNowOpts = append(notNowOpts, notnow.WithDelay(
+			time.Second*time.Duration(*flNotNowSec),
+			time.Second*time.Duration(*flNotNowMax),
+		))
+	}
+	notNow := notnow.New(notnow.NewKVStore(buckets.bucket("notnow")), pushService, notNowOpts...)
+	hubOpts = append(hubOpts, nanohub.WithService(notNow))
+
+	pinger := ping.New(
+		ping.NewKVStore(buckets.bucket("ping")),
+		ping.WithTimeout(time.Second*time.Duration(*flPingSec)),
+		ping.WithLogger(logger.With("service", "ping")),
+	)
+	hubOpts = append(hubOpts, nanohub.WithService(pinger))
+
+	bsEscrow := bstoken.New(
+		store,
+		bstoken.NewKVStore(buckets.bucket("bootstraptoken")),
+		bstoken.WithSink(eventSink),
+		bstoken.WithLogger(logger.With("service", "bootstraptoken")),
+	)
+	hubOpts = append(hubOpts, nanohub.WithService(bsEscrow))
+
+	var attester *attest.Attester
+	if *flAttestRoot != "" {
+		rootsPEM, err := os.ReadFile(*flAttestRoot)
+		if err != nil {
+			logger.Info("msg", "reading attestation roots", "err", err)
+			os.Exit(1)
+		}
+		attestRoots := x509.NewCertPool()
+		if !attestRoots.AppendCertsFromPEM(rootsPEM) {
+			logger.Info("msg", "no certificates in attestation roots")
+			os.Exit(1)
+		}
+		attestOpts := []attest.Option{
+			attest.WithSink(eventSink),
+			attest.WithLogger(logger.With("service", "attest")),
+		}
+		if subsysStore != nil && subsysStore.inventory != nil {
+			attestOpts = append(attestOpts, attest.WithInventory(subsysStore.inventory))
+		}
+		attester = attest.New(attest.NewKVStore(buckets.bucket("attest")), attestRoots, attestOpts...)
+		hubOpts = append(hubOpts, nanohub.WithService(attester))
+	}
+
+	if identities != nil {
+		identityOpts := []identity.Option{identity.WithLogger(logger.With("service", "identity"))}
+		if subsysStore != nil && subsysStore.inventory != nil {
+			identityOpts = append(identityOpts, identity.WithInventory(subsysStore.inventory))
+		}
+		hubOpts = append(hubOpts, nanohub.WithService(identity.NewService(identities, identityMapper, identityOpts...)))
+	}
+
+	var detector *anomaly.Detector
+	if *flAnomalySec > 0 {
+		// anomalies are always logged even without event actions
+		var sink event.Sink = event.MultiSink{}
+		if eventSink != nil {
+			sink = eventSink
+		}
+		detector = anomaly.New(sink, anomaly.WithLogger(logger.With("service", "anomaly")))
+		hubOpts = append(hubOpts, nanohub.WithService(anomaly.NewService(detector)))
+	}
+
+	// the command enqueuer is created by NanoHUB below.
+	// status triggers enqueue commands (and start workflows) once the
+	// enqueuer (and workflow engine) exist.
+	var hubEnqueuer capability.Enqueuer
+	var statusTriggers *statustrigger.KVStore
+	if dmStore != nil {
+		statusTriggers = statustrigger.NewKVStore(buckets.bucket("statustrigger"))
+		hubOpts = append(hubOpts, nanohub.WithService(statustrigger.New(
+			statusTriggers,
+			statustrigger.EnqueuerFunc(func(ctx context.Context, ids []string, rawCmd []byte) error {
+				if hubEnqueuer == nil {
+					return errors.New("enqueuer not created")
+				}
+				return hubEnqueuer.Enqueue(ctx, ids, rawCmd)
+			}),
+			statustrigger.WithWorkflowStarter(statustrigger.WorkflowStarterFunc(
+				func(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error) {
+					if cmdEngine == nil {
+						return "", statustrigger.ErrNoStarter
+					}
+					return cmdEngine.StartWorkflow(ctx, name, context, ids, e, mdmCtx)
+				},
+			)),
+			statustrigger.WithSink(eventSink),
+			statustrigger.WithLogger(logger.With("service", "statustrigger")),
+		)))
+	}
+
+	// dmAPIStore records DM storage mutations (if enabled)
+	var dmChanges *dmchangelog.KVStore
+	var dmAPIStore dmchangelog.Storage = dmStore
+	if dmStore != nil && *flDMChanges {
+		dmChanges = dmchangelog.NewKVStore(buckets.bucket("dmchangelog"))
+		dmAPIStore = dmchangelog.New(dmStore, dmChanges,
+			dmchangelog.WithLogger(logger.With("service", "dmchangelog")),
+		)
+	}
+
+	// lateDMNotifier notifies using the DM notifier created by NanoHUB below
+	lateDMNotifier := dynset.NotifierFunc(
+		func(ctx context.Context, declarations []string, sets []string, ids []string) error {
+			if dmNotifier == nil {
+				return errors.New("DM notifier not created")
+			}
+			return dmNotifier.Changed(ctx, declarations, sets, ids)
+		},
+	)
+
+	// dmVersions keeps prior versions of declarations (if enabled)
+	var dmVersions *dmversion.Versioner
+	if dmStore != nil && *flDMVersions {
+		dmVersions = dmversion.New(dmAPIStore, dmversion.NewKVStore(buckets.bucket("dmversion")), lateDMNotifier,
+			dmversion.WithLogger(logger.With("service", "dmversion")),
+		)
+		dmAPIStore = dmVersions
+	}
+
+	var dynSets *dynset.Syncer
+	var dynSetStore *dynset.KVStore
+	if dmStore != nil {
+		dynSetStore = dynset.NewKVStore(buckets.bucket("dynset"))
+		dynSetOpts := []dynset.Option{
+			dynset.WithLogger(logger.With("service", "dynset")),
+			dynset.WithTags(tagStore),
+		}
+		if subsysStore != nil && subsysStore.inventory != nil {
+			dynSetOpts = append(dynSetOpts, dynset.WithInventory(subsysStore.inventory))
+		}
+		dynSets = dynset.New(dynSetStore, respStore, dmAPIStore, lateDMNotifier, dynSetOpts...)
+	}
+
+	censusOpts := []census.Option{census.WithLogger(logger.With("service", "census"))}
+	if dmStore != nil {
+		censusOpts = append(censusOpts, census.WithSets(dmStore))
+	}
+	statusPolicy := retention.Policy{MaxAge: time.Second * time.Duration(*flStatusAge), MaxCount: *flStatusMax}
+	resultPolicy := retention.Policy{MaxAge: time.Second * time.Duration(*flResultAge), MaxCount: *flResultMax}
+	retentionOpts := []retention.Option{retention.WithLogger(logger.With("service", "retention"))}
+	if dmStore != nil {
+		if pruner := buckets.statusReportPruner(); pruner != nil {
+			retentionOpts = append(retentionOpts, retention.WithPruner("status-reports", pruner, statusPolicy))
+		} else if statusPolicy != (retention.Policy{}) {
+			logger.Info("msg", "DM status report retention requires mysql storage")
+		}
+		if dmReports != nil {
+			retentionOpts = append(retentionOpts, retention.WithPruner("status-report-summaries", dmReports, statusPolicy))
+		}
+	}
+	if pruner := buckets.commandResultPruner(); pruner != nil {
+		retentionOpts = append(retentionOpts, retention.WithPruner("command-results", pruner, resultPolicy))
+	} else if resultPolicy != (retention.Policy{}) {
+		logger.Info("msg", "command result retention requires mysql storage")
+	}
+	if wfHistoryStore != nil {
+		retentionOpts = append(retentionOpts, retention.WithPruner("workflow-history", wfHistoryStore, resultPolicy))
+	}
+	var auditStore *audit.KVStore
+	if *flAudit {
+		auditStore = audit.NewKVStore(buckets.bucket("audit"))
+		auditPolicy := retention.Policy{MaxAge: time.Second * time.Duration(*flAuditAge), MaxCount: *flAuditMax}
+		retentionOpts = append(retentionOpts, retention.WithPruner("audit-events", auditStore, auditPolicy))
+	}
+	retainer := retention.New(retentionOpts...)
+
+	var lifecycleMgr *lifecycle.Manager
+	if *flLifecycle {
+		lifecycleOpts := []lifecycle.Option{lifecycle.WithLogger(logger.With("service", "lifecycle"))}
+		if cmdstore != nil {
+			lifecycleOpts = append(lifecycleOpts,
+				lifecycle.WithDisableCleaner("workflow-steps", lifecycle.CleanerFunc(
+					func(ctx context.Context, id string) error {
+						return cmdstore.CancelSteps(ctx, id, "")
+					},
+				)),
+				lifecycle.WithDeleteCleaner("workflow-status", lifecycle.CleanerFunc(cmdstore.ClearWorkflowStatus)),
+			)
+		}
+		if wfHistoryStore != nil {
+			lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("workflow-history", lifecycle.CleanerFunc(wfHistoryStore.DeleteInstances)))
+		}
+		if dmStore != nil {
+			lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("dm-sets", lifecycle.CleanerFunc(
+				func(ctx context.Context, id string) error {
+					_, err := dmAPIStore.RemoveAllEnrollmentSets(ctx, id)
+					return err
+				},
+			)))
+			if cleaner := buckets.statusCleaner(dmStore); cleaner != nil {
+				lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("dm-status", cleaner))
+			}
+		}
+		if subsysStore != nil && subsysStore.inventory != nil {
+			// FileVault PRKs are stored in the inventory
+			lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("inventory", lifecycle.CleanerFunc(subsysStore.inventory.DeleteInventory)))
+		}
+		if certAssocs != nil {
+			lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("cert-associations", lifecycle.CleanerFunc(
+				func(ctx context.Context, id string) error {
+					if _, err := certAssocs.Revoke(ctx, id); err != nil && !errors.Is(err, certassoc.ErrNotFound) {
+						return err
+					}
+					return nil
+				},
+			)))
+		}
+		lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("tags", lifecycle.CleanerFunc(
+			func(ctx context.Context, id string) error {
+				return tagStore.StoreTags(ctx, id, nil)
+			},
+		)))
+		lifecycleOpts = append(lifecycleOpts,
+			lifecycle.WithDeleteCleaner("notes", lifecycle.CleanerFunc(notesStore.DeleteRecord)),
+			lifecycle.WithDeleteCleaner("environment", lifecycle.CleanerFunc(
+				func(ctx context.Context, id string) error {
+					return envStore.StoreEnvironment(ctx, id, "")
+				},
+			)),
+			lifecycle.WithDeleteCleaner("command-responses", lifecycle.CleanerFunc(respStore.DeleteResponses)),
+		)
+		if identities != nil {
+			lifecycleOpts = append(lifecycleOpts, lifecycle.WithDeleteCleaner("identity", lifecycle.CleanerFunc(identities.DeleteIdentity)))
+		}
+		if enrollments := buckets.enrollmentStore(mdmBackend); enrollments != nil {
+			lifecycleOpts = append(lifecycleOpts,
+				lifecycle.WithDeleteCleaner("mdm-enrollment", enrollments),
+				lifecycle.WithEnabler(enrollments),
+			)
+		}
+		lifecycleMgr = lifecycle.New(
+			lifecycle.NewKVStore(buckets.bucket("lifecycle")),
+			store,
+			lifecycleOpts...,
+		)
+		hubOpts = append(hubOpts, nanohub.WithService(lifecycleMgr))
+	}
+
+	fleetCensus := census.New(census.NewKVStore(buckets.bucket("census")), respStore, censusOpts...)
+
+	hubOpts = append(hubOpts, nanohub.WithService(
+		cmdresponse.NewService(respStore, logger.With("service", "cmdresponse")),
+	))
+
+	hubOpts = append(hubOpts, nanohub.WithService(
+		environment.NewService(envStore, logger.With("service", "environment")),
+	))
+
+	var enrollPortal *portal.Portal
+	if *flPortal != "" {
+		template, err := os.ReadFile(*flPortal)
+		if err != nil {
+			logger.Info("msg", "reading portal profile", "err", err)
+			os.Exit(1)
+		}
+		generator, err := portal.NewGenerator(template)
+		if err != nil {
+			logger.Info("msg", "portal profile", "err", err)
+			os.Exit(1)
+		}
+		portalOpts := []portal.Option{portal.WithTokenTTL(time.Second * time.Duration(*flPortalTTL))}
+		if scepChallenges != nil {
+			portalOpts = append(portalOpts, portal.WithChallenges(func(ctx context.Context) (string, error) {
+				c, err := scepChallenges.Issue(ctx)
+				if err != nil {
+					return "", err
+				}
+				return c.Challenge, nil
+			}))
+		}
+		enrollPortal = portal.New(
+			portal.NewKVStore(buckets.bucket("portal")),
+			generator,
+			dir.Store(),
+			logger.With("service", "portal"),
+			portalOpts...,
+		)
+		hubOpts = append(hubOpts, nanohub.WithService(enrollPortal))
+	}
+
+	var enrollProfiles *enrollprofile.Generator
+	if *flEnrollURL != "" {
+		enrollConfig := enrollprofile.Config{
+			ServerURL: strings.TrimRight(*flEnrollURL, "/") + "/mdm",
+			Topic:     *flEnrollTop,
+			SCEP:      enrollprofile.SCEP{URL: *flEnrollSCEP},
+		}
+		if *flCheckin {
+			enrollConfig.CheckInURL = strings.TrimRight(*flEnrollURL, "/") + "/checkin"
+		}
+		if enrollConfig.Topic == "" && pushCerts != nil && len(pushCerts.Loaded()) == 1 {
+			enrollConfig.Topic = pushCerts.Loaded()[0].Topic
+		}
+		var enrollOpts []enrollprofile.Option
+		if *flEnrollCert != "" {
+			certPEM, err := os.ReadFile(*flEnrollCert)
+			if err != nil {
+				logger.Info("msg", "reading enrollment profile signing certificate", "err", err)
+				os.Exit(1)
+			}
+			keyPEM, err := os.ReadFile(*flEnrollKey)
+			if err != nil {
+				logger.Info("msg", "reading enrollment profile signing key", "err", err)
+				os.Exit(1)
+			}
+			signer, err := enrollprofile.NewSigner(certPEM, keyPEM)
+			if err != nil {
+				logger.Info("msg", "loading enrollment profile signer", "err", err)
+				os.Exit(1)
+			}
+			enrollOpts = append(enrollOpts, enrollprofile.WithSigner(signer))
+		}
+		if scepChallenges != nil {
+			enrollOpts = append(enrollOpts, enrollprofile.WithChallenges(func(ctx context.Context) (string, error) {
+				c, err := scepChallenges.Issue(ctx)
+				if err != nil {
+					return "", err
+				}
+				return c.Challenge, nil
+			}))
+		}
+		enrollProfiles = enrollprofile.NewGenerator(enrollConfig, enrollOpts...)
+	}
+
+	var acctEnroller *accountenroll.Enroller
+	if enrollProfiles != nil && *flAcctEnr {
+		acctEnroller = accountenroll.New(
+			accountenroll.NewKVStore(buckets.bucket("account-enroll")),
+			enrollProfiles.UserEnrollmentProfile,
+			accountenroll.WithAssigner(dir.Store()),
+			accountenroll.WithLogger(logger.With("service", "account-enroll")),
+		)
+		hubOpts = append(hubOpts,
+			nanohub.WithService(acctEnroller),
+			nanohub.WithGetTokenForServiceType(accountenroll.ServiceTypeMAID, acctEnroller),
+		)
+	}
+
+	var certRecords *certexpiry.KVStore
+	if *flCertExp {
+		certRecords = certexpiry.NewKVStore(buckets.bucket("cert-expiry"))
+		hubOpts = append(hubOpts, nanohub.WithService(certexpiry.NewService(
+			certRecords,
+			certexpiry.WithLogger(logger.With("service", "cert-expiry")),
+		)))
+
+		var renewalProfile certexpiry.ProfileFunc
+		if *flCertProf != "" {
+			profile, err := os.ReadFile(*flCertProf)
+			if err != nil {
+				logger.Info("msg", "reading renewal profile", "err", err)
+				os.Exit(1)
+			}
+			renewalProfile = func(context.Context, string) ([]byte, error) { return profile, nil }
+		} else if enrollProfiles != nil {
+			renewalProfile = enrollProfiles.Profile
+		}
+		if renewalProfile != nil {
+			hubOpts = append(hubOpts, nanohub.WithWorkflow(
+				func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+					if w, err = certexpiry.NewWorkflow(e, certRecords, renewalProfile, certexpiry.WithWorkflowLogger(logger)); err != nil {
+						err = fmt.Errorf("creating certrenew workflow: %w", err)
+					}
+					return
+				},
+			))
+		} else if *flCertRenSec > 0 {
+			logger.Info("err", "-cert-renew-interval requires -cert-renew-profile or -enroll-url")
+			os.Exit(2)
+		}
+	}
+
+	var dmIdentities *ddmidentity.Manager
+	if *flDMIdentity != "" {
+		if dmAssets == nil || *flEnrollURL == "" {
+			logger.Info("err", "-dm-identity requires -dm-assets and -enroll-url")
+			os.Exit(2)
+		}
+		configJSON, err := os.ReadFile(*flDMIdentity)
+		if err != nil {
+			logger.Info("msg", "reading DM identity config", "err", err)
+			os.Exit(1)
+		}
+		identityConfig, err := ddmidentity.ParseConfig(configJSON)
+		if err != nil {
+			logger.Info("msg", "DM identity config", "err", err)
+			os.Exit(2)
+		}
+		identityOpts := []ddmidentity.Option{ddmidentity.WithLogger(logger.With("service", "dm-identity"))}
+		if scepChallenges != nil {
+			identityOpts = append(identityOpts, ddmidentity.WithChallenges(func(ctx context.Context) (string, error) {
+				c, err := scepChallenges.Issue(ctx)
+				if err != nil {
+					return "", err
+				}
+				return c.Challenge, nil
+			}))
+		}
+		dmIdentities, err = ddmidentity.NewManager(
+			identityConfig,
+			ddmidentity.NewKVStore(buckets.bucket("dm-identity")),
+			dmStore,
+			dmAssets,
+			ddmidentity.NotifierFunc(func(ctx context.Context, declarations []string, sets []string, ids []string) error {
+				if dmNotifier == nil {
+					return errors.New("DM notifier not created")
+				}
+				return dmNotifier.Changed(ctx, declarations, sets, ids)
+			}),
+			*flEnrollURL,
+			identityOpts...,
+		)
+		if err != nil {
+			logger.Info("msg", "creating DM identity manager", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flAPPolicy != "" {
+		policies, err := authpolicy.Parse(*flAPPolicy, respStore)
+		if err != nil {
+			logger.Info("msg", "parsing authproxy policies", "err", err)
+			os.Exit(2)
+		}
+		hubOpts = append(hubOpts, nanohub.WithAuthProxyPolicy(policies...))
+	}
+
+	if *flAPIDXform != "" {
+		idXform, err := idtransform.New(*flAPIDXform, []byte(*flAPIDKey), respStore)
+		if err != nil {
+			logger.Info("msg", "authproxy ID transform", "err", err)
+			os.Exit(2)
+		}
+		hubOpts = append(hubOpts, nanohub.WithAuthProxyIDTransform(idXform))
+	}
+
 	if *flMigration {
-		hubOpts = append(hubOpts, nanohub.WithMigration())
+		migrationOpts := []migration.Option{migration.WithCertAssociator(store)}
+		if pushCerts != nil {
+			// only migrate enrollments with topics we can push to
+			migrationOpts = append(migrationOpts, migration.WithTopics(func() []string {
+				var topics []string
+				for _, info := range pushCerts.Loaded() {
+					topics = append(topics, info.Topic)
+				}
+				return topics
+			}))
+		}
+		hubOpts = append(hubOpts, nanohub.WithMigration(migrationOpts...))
 	}
 
 	if *flWorkSec > 0 {
 		hubOpts = append(hubOpts, nanohub.WithWFWorkerDuration(time.Second*time.Duration(*flWorkSec)))
 	}
 
+	var escalator *escalation.Escalator
+	var workerHeartbeat *health.Heartbeat
+	var workerLease *lease.Lease
 	if *flWorkSec > 0 {
+		var workerStore cmdstorage.WorkerStorage = cmdstore
+		if *flWorkLease {
+			locker := buckets.locker()
+			if locker == nil {
+				logger.Info("err", "-worker-lease requires mysql storage")
+				os.Exit(2)
+			}
+			// expires after missing a few polls
+			workerLease = lease.New(
+				locker,
+				"worker",
+				3*time.Second*time.Duration(*flWorkSec),
+				lease.WithLogger(logger.With("service", "worker-lease")),
+			)
+			workerStore = &leaseWorkerStore{WorkerStorage: workerStore, lease: workerLease}
+		}
+		if !*flReadOnly {
+			// unhealthy after missing a few polls
+			workerHeartbeat = health.NewHeartbeat(3*time.Second*time.Duration(*flWorkSec), nil)
+			workerStore = &heartbeatWorkerStore{WorkerStorage: workerStore, heartbeat: workerHeartbeat}
+		}
 		hubOpts = append(hubOpts, []nanohub.Option{
-			nanohub.WithWFWorker(cmdstore),
+			nanohub.WithWFWorker(workerStore),
 			nanohub.WithWFWorkerDuration(time.Second * time.Duration(*flWorkSec)),
 		}...)
 
 		if *flPushSec > 0 {
 			hubOpts = append(hubOpts, nanohub.WithWFWorkerRePushDuration(time.Second*time.Duration(*flPushSec)))
 		}
+
+		if *flEscalation != "" {
+			ladder, err := escalation.ParseLadder(*flEscalation)
+			if err != nil {
+				logger.Info("msg", "parsing re-push escalation", "err", err)
+				os.Exit(2)
+			}
+			escalator = escalation.New(
+				escalation.NewKVStore(buckets.bucket("escalation")),
+				*ladder,
+				escalation.WithLogger(logger.With("service", "escalation")),
+				// priority pushes bypass any push batching
+				escalation.WithPriorityPusher(pushService),
+				escalation.WithSink(eventSink),
+			)
+			hubOpts = append(hubOpts, nanohub.WithWFWorkerRePushEscalation(escalator))
+		}
 	}
 
 	nh, err := nanohub.New(store, hubOpts...)
@@ -182,45 +1501,354 @@ func main() {
 		logger.Info("err", err)
 		os.Exit(1)
 	}
+	cmdEngine = nh.Engine()
+	dmNotifier = nh.DMNotifier()
+
+	var dmQueue *dmnotify.Queue
+	if dmStore != nil && *flDMAsync {
+		dmQueue = dmnotify.New(
+			dmnotify.NewKVStore(buckets.bucket("dmnotify")),
+			dmNotifier,
+			dmStore,
+			dmnotify.WithLogger(logger.With("service", "dmnotify")),
+		)
+		dmNotifier = dmQueue
+	}
+
+	var dmGC *dmgc.Collector
+	if dmStore != nil {
+		gcOpts := []dmgc.Option{
+			dmgc.WithGrace(time.Hour * time.Duration(*flDMGCGrace)),
+			dmgc.WithLogger(logger.With("service", "dmgc")),
+		}
+		if dmAssets != nil {
+			gcOpts = append(gcOpts, dmgc.WithAssets(dmAssets))
+		}
+		if *flDMGCDelete {
+			gcOpts = append(gcOpts, dmgc.WithDelete())
+		}
+		dmGC = dmgc.New(dmgc.NewKVStore(buckets.bucket("dmgc")), dmAPIStore, gcOpts...)
+	}
+	hubEnqueuer = nh.Enqueuer()
+
+	var configDM *configapi.DM
+	var scheduler *configapi.Scheduler
+	if *flConfigAPI {
+		if dmStore != nil {
+			configDM = configapi.NewDM(dmAPIStore, dmNotifier)
+		}
+		if cmdEngine != nil {
+			schedOpts := []configapi.Option{
+				configapi.WithLogger(logger.With("service", "scheduler")),
+				configapi.WithResolver(idResolver),
+			}
+			if dmStore != nil {
+				schedOpts = append(schedOpts, configapi.WithSets(dmStore))
+			}
+			scheduler = configapi.NewScheduler(configStore, cmdEngine, schedOpts...)
+		}
+	}
 
 	mux := http.NewServeMux()
 
 	mux.Handle("/version", nanolibhttp.NewJSONVersionHandler(version))
 
-	mux.Handle("/mdm", nh.ServerHandler())
+	// liveness only checks that this process works: a failure restarts it
+	liveChecks := health.Checks{}
+	if workerHeartbeat != nil {
+		liveChecks["worker"] = workerHeartbeat
+	}
+	healthChecks := health.Checks{}
+	for name, checker := range liveChecks {
+		healthChecks[name] = checker
+	}
+	if checker := buckets.healthChecker(); checker != nil {
+		healthChecks["storage"] = checker
+	}
+	if apnsChecker != nil {
+		healthChecks["apns"] = apnsChecker
+	}
+	// worker instances only serve the health endpoints
+	healthMux := http.NewServeMux()
+	healthMux.Handle(healthhttp.HealthPath, healthhttp.Handler(healthChecks, logger.With("handler", "health")))
+	healthMux.Handle(healthhttp.LivenessPath, healthhttp.Handler(liveChecks, logger.With("handler", "healthz")))
+	healthMux.Handle(healthhttp.ReadinessPath, healthhttp.Handler(healthChecks, logger.With("handler", "readyz")))
+	for _, path := range []string{healthhttp.HealthPath, healthhttp.LivenessPath, healthhttp.ReadinessPath} {
+		mux.Handle(path, healthMux)
+	}
+	mux.Handle(eventhttp.SchemasPath, eventhttp.SchemasHandler(logger.With("handler", "event-schemas")))
+
+	rateOpts := []ratelimit.Option{ratelimit.WithLogger(logger.With("service", "ratelimit"))}
+	if *flRateEnr > 0 {
+		rateOpts = append(rateOpts, ratelimit.WithEnrollmentLimit(*flRateEnr, *flRateEnrB))
+	}
+	if *flRateGlobal > 0 {
+		rateOpts = append(rateOpts, ratelimit.WithGlobalLimit(*flRateGlobal, *flRateGlobB))
+	}
+	rateMW := ratelimit.New(rateOpts...)
 
-	if *flAuthProxy != "" {
-		ap, err := nh.NewAuthProxy(
-			*flAuthProxy,
-			"X-Enrollment-ID",
-			authproxy.WithHeaderFunc("X-Trace-ID", trace.GetTraceID),
-		)
-		if err != nil {
-			logger.Info("err", err)
+	// device endpoints return no internal error details by default
+	var deviceErrors deviceerror.Config
+	if *flDevErrors != "" {
+		if deviceErrors, err = deviceerror.LoadConfig(*flDevErrors); err != nil {
+			logger.Info("msg", "loading device error config", "err", err)
 			os.Exit(1)
 		}
-		if ap == nil {
-			logger.Info("err", "nil authproxy handler?")
-			os.Exit(1)
+	}
+	devErrLogger := logger.With("handler", "device-errors")
+
+	// read-only instances serve no device-facing endpoints
+	if !*flReadOnly {
+		mux.Handle("/mdm", deviceErrors.Middleware("mdm", rateMW.Wrap(nh.ServerHandler()), devErrLogger))
+
+		if *flAuthProxy != "" {
+			ap, err := nh.NewAuthProxy(
+				*flAuthProxy,
+				"X-Enrollment-ID",
+				authproxy.WithHeaderFunc("X-Trace-ID", trace.GetTraceID),
+			)
+			if err != nil {
+				logger.Info("err", err)
+				os.Exit(1)
+			}
+			if ap == nil {
+				logger.Info("err", "nil authproxy handler?")
+				os.Exit(1)
+			}
+
+			mux.Handle(
+				"/authproxy/",
+				deviceErrors.Middleware("authproxy", ap, devErrLogger),
+			)
 		}
 
-		mux.Handle(
-			"/authproxy/",
-			ap,
-		)
-	}
+		if dmAssets != nil {
+			assetHandler := nh.IDAuthMiddleware(ddmasset.Handler(dmAssets, logger.With("handler", "dm-assets")))
+			if assetHandler == nil {
+				logger.Info("err", "DM assets require MDM authentication")
+				os.Exit(1)
+			}
+			mux.Handle(ddmasset.AssetsPath, deviceErrors.Middleware("assets", rateMW.Wrap(assetHandler), devErrLogger))
+		}
+
+		if nh.CheckInHandler() != nil {
+			mux.Handle("/checkin", deviceErrors.Middleware("checkin", rateMW.Wrap(nh.CheckInHandler()), devErrLogger))
+		}
+
+		if enrollPortal != nil {
+			portalLogger := logger.With("handler", "portal")
+			mux.Handle("/enroll/", deviceErrors.Middleware("portal", portal.PageHandler(*flPortalHdr, portalLogger), devErrLogger))
+			mux.Handle("/enroll/profile", deviceErrors.Middleware("portal", portal.ProfileHandler(enrollPortal, *flPortalHdr, portalLogger), devErrLogger))
+		}
 
-	if nh.CheckInHandler() != nil {
-		mux.Handle("/checkin", nh.CheckInHandler())
+		if acctEnroller != nil {
+			acctLogger := logger.With("handler", "account-enroll")
+			enrollBase := strings.TrimRight(*flEnrollURL, "/") + "/enroll/account"
+			mux.Handle(accountenroll.DiscoveryPath, deviceErrors.Middleware("account-enroll", accountenroll.DiscoveryHandler(enrollBase, acctLogger), devErrLogger))
+			mux.Handle("/enroll/account", deviceErrors.Middleware("account-enroll", accountenroll.EnrollHandler(acctEnroller, enrollBase+"/login", acctLogger), devErrLogger))
+			mux.Handle("/enroll/account/login", deviceErrors.Middleware("account-enroll", accountenroll.LoginHandler(acctEnroller, *flPortalHdr, *flAcctEnrHdr, acctLogger), devErrLogger))
+		}
 	}
 
 	if *flAPIKey != "" {
-		authMW := func(h http.Handler) http.Handler {
+		basicAuthMW := func(h http.Handler) http.Handler {
 			return nanolibhttp.NewSimpleBasicAuthHandler(h, "nanohub", *flAPIKey, "NanoHUB API")
 		}
 
+		// auditMW wraps API handlers in audit logging (if enabled)
+		auditMW := func(string, audit.TargetsFn) func(http.Handler) http.Handler {
+			return func(h http.Handler) http.Handler { return h }
+		}
+
+		var auditor *audit.Auditor
+		if auditStore != nil {
+			auditor = audit.New(auditStore,
+				audit.WithLogger(logger.With("service", "audit")),
+				audit.WithActorFn(delegation.Actor(audit.BasicAuthActor)),
+			)
+			auditMW = auditor.Middleware
+		}
+
+		delegations := delegation.New(
+			delegation.NewKVStore(buckets.bucket("delegations")),
+			delegation.WithAuditor(auditor),
+			delegation.WithMaxTTL(time.Second*time.Duration(*flDelegTTL)),
+			delegation.WithLogger(logger.With("service", "delegation")),
+		)
+
+		// authMW accepts the API key or scoped delegation tokens
+		authMW := delegations.AuthMiddleware(basicAuthMW)
+
+		// delegMW restricts delegation tokens to their scope
+		delegMW := func(authz delegation.Authorizer, targetsFn audit.TargetsFn) func(http.Handler) http.Handler {
+			return delegation.Guard(authz, targetsFn, logger.With("handler", "delegation-guard"))
+		}
+
+		envOpts := []environment.GuardOption{
+			environment.WithLogger(logger.With("handler", "environment-guard")),
+			environment.WithDefault(*flEnvDefault),
+		}
+		if *flEnvReq {
+			envOpts = append(envOpts, environment.WithRequired())
+		}
+		envGuard := environment.NewGuard(envStore, envOpts...)
+
+		hubMux := flow.New()
+		hubMux.Use(authMW)
+		hubMux.Use(auditMW("nanohub", paramTargets))
+		hubMux.Use(delegMW(delegation.AuthorizeRead, paramTargets))
+
+		// environment labels are managed outside of the environment guard
+		envhttp.HandleAPIv1("", hubMux, logger, envStore)
+		tagshttp.HandleAPIv1("", hubMux, logger, tagStore)
+		hubMux.Use(envGuard.Middleware(paramTargets))
+		if dmChanges != nil || dmVersions != nil {
+			// attribute DM changes made with NanoHUB APIs
+			hubMux.Use(dmchangelog.Middleware(delegation.Actor(audit.BasicAuthActor)))
+		}
+
+		if auditStore != nil {
+			audithttp.HandleAPIv1("", hubMux, logger, auditStore)
+		}
+		delegationhttp.HandleAPIv1("", hubMux, logger, delegations)
+
+		hubMux.Handle("/loglevels", loglevel.Handler(logLevels, logger.With("handler", "loglevels")), "GET", "PUT")
+		noteshttp.HandleAPIv1("", hubMux, logger, notesStore)
+		cmdresphttp.HandleAPIv1("", hubMux, logger, respStore)
+		cmdqueuehttp.HandleAPIv1("", hubMux, logger, cmdQueue, buckets.queueLister(store))
+		pinghttp.HandleAPIv1("", hubMux, logger, pinger, nh.Enqueuer())
+		bstokenhttp.HandleAPIv1("", hubMux, logger, bsEscrow)
+		censushttp.HandleAPIv1("", hubMux, logger, fleetCensus)
+		osupdatehttp.HandleAPIv1("", hubMux, logger, osUpdates, osPostures)
+		if attester != nil {
+			attesthttp.HandleAPIv1("", hubMux, logger, attester, nh.Enqueuer())
+		}
+		dirhttp.HandleAPIv1("", hubMux, logger, dir)
+		pushcerthttp.HandleAPIv1("", hubMux, logger, pushCerts, store)
+		pushretryhttp.HandleAPIv1("", hubMux, logger, pushFailures)
+		searchSources := []search.Source{
+			search.Enrollments(respStore, dir.Store()),
+			search.Workflows(nh.Workflows()),
+			search.Commands(expiryStore, respStore),
+		}
+		if dmStore != nil {
+			ddmpredicatehttp.HandleAPIv1("", hubMux, logger, ddmpredicate.NewSimulator(dmStore))
+			dmdrifthttp.HandleAPIv1("", hubMux, logger, dmStore)
+			searchSources = append(searchSources, search.Declarations(dmStore), search.Sets(dmStore))
+			statustriggerhttp.HandleAPIv1("", hubMux, logger, statusTriggers)
+			setbatchhttp.HandleAPIv1("", hubMux, logger, setbatch.New(
+				setbatch.NewKVStore(buckets.bucket("setbatch")),
+				dmAPIStore,
+				nh.DMNotifier(),
+				setbatch.WithLogger(logger.With("service", "setbatch")),
+			))
+			if dmChanges != nil {
+				dmchangeloghttp.HandleAPIv1("", hubMux, logger, dmChanges)
+			}
+			if dmReports != nil {
+				dmstatusreporthttp.HandleAPIv1("", hubMux, logger, dmReports)
+			}
+			if dmAssets != nil {
+				ddmassethttp.HandleAPIv1("", hubMux, logger, dmAssets, *flEnrollURL)
+			}
+			if dmIdentities != nil {
+				ddmidentityhttp.HandleAPIv1("", hubMux, logger, dmIdentities)
+			}
+			if dmQueue != nil {
+				dmnotifyhttp.HandleAPIv1("", hubMux, logger, dmQueue)
+			}
+			if dmGC != nil {
+				dmgchttp.HandleAPIv1("", hubMux, logger, dmGC)
+			}
+			if dmVersions != nil {
+				dmversionhttp.HandleAPIv1("", hubMux, logger, dmVersions)
+			}
+			dynsethttp.HandleAPIv1("", hubMux, logger, dynSetStore, dynSets)
+		}
+		if *flConfigAPI {
+			configapihttp.HandleAPIv1("", hubMux, logger, configDM, webhooks, scheduler)
+		}
+		if cmdEngine != nil {
+			inboundRules := inbound.NewKVStore(buckets.bucket("inbound"))
+			inboundhttp.HandleAPIv1("", hubMux, logger, inboundRules, inbound.New(
+				inboundRules,
+				cmdEngine,
+				inbound.WithResolver(idResolver),
+				inbound.WithLogger(logger.With("service", "inbound")),
+			))
+		}
+		if wfChains != nil {
+			wfchainhttp.HandleAPIv1("", hubMux, logger, wfChains)
+		}
+		if wfPolicies != nil {
+			wfpolicyhttp.HandleAPIv1("", hubMux, logger, wfPolicies)
+		}
+		if wfHistory != nil {
+			wfhistoryhttp.HandleAPIv1("", hubMux, logger, wfHistory)
+		}
+		if invSearcher != nil {
+			var invSets invqueryhttp.SetEnrollmentRetriever
+			if dmStore != nil {
+				invSets = dmStore
+			}
+			invqueryhttp.HandleAPIv1("", hubMux, logger, invSearcher, invSets)
+		}
+		searchhttp.HandleAPIv1("", hubMux, logger, search.New(logger.With("service", "search"), searchSources...))
+		if enrollProfiles != nil {
+			enrollprofilehttp.HandleAPIv1("", hubMux, logger, enrollProfiles)
+		}
+		if scepChallenges != nil {
+			scepchallengehttp.HandleAPIv1("", hubMux, logger, scepChallenges)
+		}
+		if checkinBuf != nil {
+			checkinbufferhttp.HandleAPIv1("", hubMux, logger, checkinBuf)
+		}
+		if capGate != nil {
+			capabilityhttp.HandleAPIv1("", hubMux, logger, capGate)
+		}
+		if depSyncer != nil {
+			dephttp.HandleAPIv1("", hubMux, logger, depStore, depClient, depSyncer)
+		}
+		if pushPruner != nil {
+			pushfeedbackhttp.HandleAPIv1("", hubMux, logger, pushPruner)
+		}
+		if escalator != nil {
+			escalationhttp.HandleAPIv1("", hubMux, logger, escalator)
+		}
+		notnowhttp.HandleAPIv1("", hubMux, logger, notNow)
+		if eventBroker != nil {
+			eventstreamhttp.HandleAPIv1("", hubMux, logger, eventBroker)
+		}
+		if identities != nil {
+			identityhttp.HandleAPIv1("", hubMux, logger, identities)
+		}
+		if nh.Migrator() != nil {
+			migrationhttp.HandleAPIv1("", hubMux, logger, nh.Migrator())
+		}
+		if certRecords != nil {
+			certexpiryhttp.HandleAPIv1("", hubMux, logger, certRecords, time.Hour*time.Duration(*flCertWindow))
+		}
+		if certAssocs != nil {
+			certassochttp.HandleAPIv1("", hubMux, logger, certAssocs)
+		}
+		if lifecycleMgr != nil {
+			lifecyclehttp.HandleAPIv1("", hubMux, logger, lifecycleMgr)
+		}
+
+		mux.Handle("/api/v1/nanohub/",
+			http.StripPrefix("/api/v1/nanohub", hubMux),
+		)
+
 		nanoMux := nanolibhttp.NewMWMux(http.NewServeMux())
 		nanoMux.Use(authMW)
+		nanoMux.Use(idResolver.PathMiddleware())
+		nanoMux.Use(auditMW("nanomdm", audit.PathTargets))
+		nanoMux.Use(delegMW(delegation.AuthorizeEnqueue, audit.PathTargets))
+		nanoMux.Use(envGuard.Middleware(audit.PathTargets))
+		if capGate != nil {
+			nanoMux.Use(capability.EnqueueMiddleware(capGate, logger.With("handler", "enqueue-capability")))
+		}
+		nanoMux.Use(cmdexpiry.EnqueueMiddleware(expirer, logger.With("handler", "enqueue-expiry")))
 		nanoapi.HandleAPIv1("", nanoMux, logger, store, pushService)
 		mux.Handle("/api/v1/nanomdm/",
 			http.StripPrefix("/api/v1/nanomdm", nanoMux),
@@ -228,6 +1856,10 @@ func main() {
 
 		cmdMux := flow.New()
 		cmdMux.Use(authMW)
+		cmdMux.Use(idResolver.QueryMiddleware())
+		cmdMux.Use(auditMW("nanocmd", audit.QueryTargets))
+		cmdMux.Use(delegMW(delegation.AuthorizeWorkflows, audit.QueryTargets))
+		cmdMux.Use(envGuard.Middleware(audit.QueryTargets))
 		// register engine endpoints
 		cmdenghttp.HandleAPIv1("", cmdMux, logger, nh.Engine(), cmdstore)
 		// register subsystem endpoints
@@ -238,7 +1870,13 @@ func main() {
 
 		ddmMux := flow.New()
 		ddmMux.Use(authMW)
-		ddmapi.HandleAPIv1("", ddmMux, logger, dmStore, nh.DMNotifier())
+		ddmMux.Use(auditMW("ddm", audit.QueryTargets))
+		ddmMux.Use(delegMW(delegation.Deny, audit.QueryTargets))
+		ddmMux.Use(envGuard.Middleware(ddmTargets))
+		if dmChanges != nil || dmVersions != nil {
+			ddmMux.Use(dmchangelog.Middleware(delegation.Actor(audit.BasicAuthActor)))
+		}
+		ddmapi.HandleAPIv1("", ddmMux, logger, dmAPIStore, dmNotifier)
 		ddmMux.Handle(
 			"/declaration-items",
 			ddmhttp.TokensOrDeclarationItemsHandler(dmStore, false, logger.With("handler", "declaration-items")),
@@ -260,16 +1898,186 @@ func main() {
 			http.StripPrefix("/api/v1/ddm", ddmMux),
 		)
 
-		if nh.MigrationHandler() != nil {
-			mux.Handle("/migration", authMW(nh.MigrationHandler()))
+		if nh.MigrationHandler() != nil && !*flReadOnly {
+			mux.Handle("/migration", authMW(auditMW("migration", nil)(delegMW(delegation.Deny, nil)(nh.MigrationHandler()))))
+		}
+
+		if *flDebugAPI {
+			// profiles expose server internals: deny delegation tokens
+			debugMux := flow.New()
+			runtimestatshttp.HandleAPIv1("", debugMux, logger, runtimestats.New(version))
+			mux.Handle("/api/v1/nanohub/debug/",
+				authMW(auditMW("debug", nil)(delegMW(delegation.Deny, nil)(http.StripPrefix("/api/v1/nanohub", debugMux)))),
+			)
 		}
 	}
 
-	if *flWorkSec > 0 {
-		nh.GoStartEngineRunner(context.Background())
+	// read-only instances run no background jobs that change storage
+	var leader *lease.Leader
+	leaderDone := make(chan struct{})
+	leaderCtx, stopLeader := context.WithCancel(context.Background())
+	defer stopLeader()
+	if !*flReadOnly {
+		if *flLeader {
+			locker := buckets.locker()
+			if locker == nil {
+				logger.Info("err", "-leader-election requires mysql storage")
+				os.Exit(2)
+			}
+			leader = lease.NewLeader(lease.New(
+				locker,
+				"leader",
+				leaderTTL,
+				lease.WithLogger(logger.With("service", "leader")),
+			))
+		}
+		// goShared runs a background job that changes shared storage.
+		// With -leader-election only the leading replica runs it.
+		goShared := func(name string, task lease.Task) {
+			if leader != nil {
+				leader.Go(name, task)
+				return
+			}
+			go task(context.Background())
+		}
+
+		if *flWorkSec > 0 {
+			goShared("engine-worker", func(ctx context.Context) error {
+				nh.GoStartEngineRunner(ctx)
+				<-ctx.Done()
+				return ctx.Err()
+			})
+		}
+		nh.GoStartDMDebouncer(context.Background())
+
+		if dmQueue != nil {
+			goShared("dm-notify", func(ctx context.Context) error {
+				return dmQueue.Run(ctx, time.Minute)
+			})
+		}
+
+		if dmGC != nil && *flDMGCSec > 0 {
+			goShared("dm-gc", func(ctx context.Context) error {
+				return dmGC.Run(ctx, time.Second*time.Duration(*flDMGCSec))
+			})
+		}
+
+		if dirSource != nil && *flDirSec > 0 {
+			goShared("directory", func(ctx context.Context) error {
+				return dir.Run(ctx, time.Second*time.Duration(*flDirSec))
+			})
+		}
+
+		if detector != nil {
+			go detector.Run(context.Background(), time.Second*time.Duration(*flAnomalySec))
+		}
+
+		if dynSets != nil && *flDynSetSec > 0 {
+			goShared("dynset", func(ctx context.Context) error {
+				return dynSets.Run(dmchangelog.WithActor(ctx, "dynset"), time.Second*time.Duration(*flDynSetSec))
+			})
+		}
+
+		if *flCensusSec > 0 {
+			goShared("census", func(ctx context.Context) error {
+				return fleetCensus.Run(ctx, time.Second*time.Duration(*flCensusSec))
+			})
+		}
+
+		if depSyncer != nil && *flDEPSec > 0 {
+			goShared("dep-sync", func(ctx context.Context) error {
+				return depSyncer.Run(ctx, time.Second*time.Duration(*flDEPSec))
+			})
+		}
+
+		if checkinBuf != nil {
+			go checkinBuf.Run(context.Background(), 10*time.Second)
+		}
+
+		if pushBatcher != nil {
+			go pushBatcher.Run(context.Background(), time.Millisecond*time.Duration(*flBatchMS))
+		}
+
+		if *flNotNowSec > 0 {
+			goShared("notnow", func(ctx context.Context) error {
+				return notNow.Run(ctx, time.Minute)
+			})
+		}
+
+		if *flExpirySec > 0 {
+			goShared("command-expiry", func(ctx context.Context) error {
+				return expirer.Run(ctx, time.Second*time.Duration(*flExpirySec))
+			})
+		}
+
+		if enrollPortal != nil {
+			goShared("portal-tokens", func(ctx context.Context) error {
+				return enrollPortal.Run(ctx, time.Hour)
+			})
+		}
+
+		if retainer.Enabled() && *flRetainSec > 0 {
+			goShared("retention", func(ctx context.Context) error {
+				return retainer.Run(ctx, time.Second*time.Duration(*flRetainSec))
+			})
+		}
+
+		if scheduler != nil && *flSchedSec > 0 {
+			goShared("scheduler", func(ctx context.Context) error {
+				return scheduler.Run(ctx, time.Second*time.Duration(*flSchedSec))
+			})
+		}
+
+		if certRecords != nil && cmdEngine != nil && *flCertRenSec > 0 {
+			renewer := certexpiry.NewRenewer(
+				certRecords,
+				cmdEngine,
+				time.Hour*time.Duration(*flCertWindow),
+				certexpiry.WithRenewerLogger(logger.With("service", "cert-renewer")),
+			)
+			goShared("cert-renewer", func(ctx context.Context) error {
+				return renewer.Run(ctx, time.Second*time.Duration(*flCertRenSec))
+			})
+		}
+
+		if leader != nil {
+			go func() {
+				defer close(leaderDone)
+				leader.Run(leaderCtx, leaderTTL/3)
+			}()
+		}
+	}
+
+	if *flMode == modeWorker {
+		// worker instances only run the background jobs
+		logger.Info("msg", "starting worker", "listen", *flListen)
+		go func() {
+			if err := http.ListenAndServe(*flListen, healthMux); err != nil {
+				logger.Info("msg", "health server stopped", "err", err)
+				os.Exit(3)
+			}
+		}()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		logger.Info("msg", "worker stopped", "signal", <-sig)
+		if leader != nil {
+			// release the leader lease so another replica takes over
+			stopLeader()
+			<-leaderDone
+		}
+		if workerLease != nil {
+			// let another replica take over without waiting for expiry
+			if err := workerLease.Release(context.Background()); err != nil {
+				logger.Info("msg", "releasing worker lease", "err", err)
+			}
+		}
+		return
 	}
 
 	var handler http.Handler = mux
+	if *flReadOnly {
+		handler = readonly.Middleware(handler)
+	}
 
 	handler = trace.NewTraceLoggingHandler(handler, logger.With("handler", "log"), newTraceID)
 
@@ -294,3 +2102,25 @@ func newTraceID(_ *http.Request) string {
 func getStatusID(r *mdm.Request, _ *ddm.StatusReport) (string, error) {
 	return trace.GetTraceID(r.Context()), nil
 }
+
+// paramTargets returns the enrollment IDs of NanoHUB API requests.
+// NanoHUB APIs use the "id" path parameter or query parameters.
+func paramTargets(r *http.Request) []string {
+	ids := audit.QueryTargets(r)
+	if id := flow.Param(r.Context(), "id"); id != "" {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ddmTargets returns the enrollment IDs of DDM API requests.
+// Only the enrollment sets API has enrollment IDs in the path.
+func ddmTargets(r *http.Request) []string {
+	ids := audit.QueryTargets(r)
+	if strings.HasPrefix(r.URL.Path, "/enrollment-sets/") {
+		if id := flow.Param(r.Context(), "id"); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
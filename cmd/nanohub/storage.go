@@ -1,27 +1,51 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"hash"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/cmdqueue"
+	cmdqueuemysql "github.com/micromdm/nanohub/cmdqueue/mysql"
+	"github.com/micromdm/nanohub/health"
+	invquerymysql "github.com/micromdm/nanohub/invquery/mysql"
+	"github.com/micromdm/nanohub/kv"
+	"github.com/micromdm/nanohub/kv/kvdiskv"
+	"github.com/micromdm/nanohub/kv/kvmap"
+	"github.com/micromdm/nanohub/kv/kvmysql"
+	"github.com/micromdm/nanohub/lease"
+	leasemysql "github.com/micromdm/nanohub/lease/mysql"
+	"github.com/micromdm/nanohub/lifecycle"
+	lifecyclekv "github.com/micromdm/nanohub/lifecycle/kv"
+	lifecyclemysql "github.com/micromdm/nanohub/lifecycle/mysql"
+	"github.com/micromdm/nanohub/retention"
+	retentionmysql "github.com/micromdm/nanohub/retention/mysql"
 
 	"github.com/cespare/xxhash"
 	dmstorage "github.com/jessepeterson/kmfddm/storage"
-	dmfile "github.com/jessepeterson/kmfddm/storage/diskv"
 	dminmem "github.com/jessepeterson/kmfddm/storage/inmem"
+	dmkv "github.com/jessepeterson/kmfddm/storage/kv"
 	dmmysql "github.com/jessepeterson/kmfddm/storage/mysql"
 	cmdstorage "github.com/micromdm/nanocmd/engine/storage"
 	cmdfile "github.com/micromdm/nanocmd/engine/storage/diskv"
 	cmdinmem "github.com/micromdm/nanocmd/engine/storage/inmem"
 	cmdmysql "github.com/micromdm/nanocmd/engine/storage/mysql"
 	"github.com/micromdm/nanolib/log"
+	nlkv "github.com/micromdm/nanolib/storage/kv"
+	nlkvdiskv "github.com/micromdm/nanolib/storage/kv/kvdiskv"
+	nlkvtxn "github.com/micromdm/nanolib/storage/kv/kvtxn"
 	mdmstorage "github.com/micromdm/nanomdm/storage"
 	mdmfile "github.com/micromdm/nanomdm/storage/diskv"
 	mdminmem "github.com/micromdm/nanomdm/storage/inmem"
+	mdmkv "github.com/micromdm/nanomdm/storage/kv"
 	mdmmysql "github.com/micromdm/nanomdm/storage/mysql"
+	"github.com/peterbourgon/diskv/v3"
 
 	stgcmdplan "github.com/micromdm/nanocmd/subsystem/cmdplan/storage"
 	stgcmdplandiskv "github.com/micromdm/nanocmd/subsystem/cmdplan/storage/diskv"
@@ -88,8 +112,8 @@ func NewStore(storage, dsn, options string, logger log.Logger) (mdmstorage.AllSt
 		if err := os.Mkdir(dsn, 0755); err != nil && !errors.Is(err, os.ErrExist) {
 			return nil, nil, nil, err
 		}
-		mdmstore := mdmfile.New(filepath.Join(dsn, "mdm"))
-		dmstore := dmfile.New(filepath.Join(dsn, "dm"), hasher)
+		mdmstore := newMDMFileStore(filepath.Join(dsn, "mdm"))
+		dmstore := newDMFileStore(filepath.Join(dsn, "dm"))
 		cmdstore := cmdfile.New(filepath.Join(dsn, "cmd"))
 		return mdmstore, dmstore, cmdstore, nil
 	case "mysql":
@@ -122,6 +146,107 @@ func NewStore(storage, dsn, options string, logger log.Logger) (mdmstorage.AllSt
 	}
 }
 
+// newDiskvBucket creates a diskv bucket like the NanoMDM and KMFDDM
+// file storage backends do.
+func newDiskvBucket(path, name string, transform diskv.TransformFunction) nlkv.TxnBucketWithCRUD {
+	return nlkvtxn.New(nlkvdiskv.New(diskv.New(diskv.Options{
+		BasePath:     filepath.Join(path, name),
+		Transform:    transform,
+		CacheSizeMax: 1024 * 1024,
+	})))
+}
+
+// mdmFileStore is NanoMDM file storage that shares its buckets with
+// its enrollment store so that the diskv caches stay consistent.
+type mdmFileStore struct {
+	*mdmkv.KV
+	enrollments *lifecyclekv.Enrollments
+}
+
+// newMDMFileStore creates NanoMDM file storage at path with the same
+// layout as the NanoMDM diskv storage backend.
+func newMDMFileStore(path string) *mdmFileStore {
+	users := newDiskvBucket(path, "users", mdmfile.Split2X2Transform)
+	certAuth := newDiskvBucket(path, "cert_auth", mdmfile.Split2X2Transform)
+	queue := newDiskvBucket(path, "queue", mdmfile.Split2X2Transform)
+	pushCert := newDiskvBucket(
+		path,
+		"push_cert",
+		mdmfile.StripPrefixTransform(mdmfile.Split2X2Transform, "com.apple.mgmt.External."),
+	)
+	devices := newDiskvBucket(path, "devices", mdmfile.Split2X2Transform)
+	enrollments := newDiskvBucket(path, "enrollments", mdmfile.Split2X2Transform)
+	return &mdmFileStore{
+		KV:          mdmkv.New(users, certAuth, queue, pushCert, devices, enrollments),
+		enrollments: lifecyclekv.NewEnrollments(devices, enrollments, users, queue, certAuth),
+	}
+}
+
+// dmFileStore is KMFDDM file storage that shares its status bucket
+// with its status cleaner so that the diskv caches stay consistent.
+type dmFileStore struct {
+	*dmkv.KV
+	cleaner *lifecyclekv.Status
+}
+
+// newDMFileStore creates KMFDDM file storage at path with the same
+// layout as the KMFDDM diskv storage backend.
+func newDMFileStore(path string) *dmFileStore {
+	status := newDiskvBucket(path, "status", nlkvdiskv.FlatTransform)
+	return &dmFileStore{
+		KV: dmkv.New(
+			hasher,
+			newDiskvBucket(path, "declarations", nlkvdiskv.FlatTransform),
+			newDiskvBucket(path, "sets", nlkvdiskv.FlatTransform),
+			newDiskvBucket(path, "enrollments", nlkvdiskv.FlatTransform),
+			status,
+		),
+		cleaner: lifecyclekv.NewStatus(status),
+	}
+}
+
+// NewWorkerStore creates the workflow storage for workflow steps and
+// worker bookkeeping from a separate storage backend than the rest of
+// the workflow storage. The worker polls the steps the engine stores so
+// both use this storage. Event subscriptions remain in events.
+func NewWorkerStore(storage, dsn string, events cmdstorage.EventSubscriptionStorage) (cmdstorage.AllStorage, error) {
+	var steps cmdstorage.AllStorage
+	switch storage {
+	case "file":
+		if dsn == "" {
+			dsn = "db"
+		} else {
+			dsn = strings.TrimRight(dsn, string(os.PathSeparator))
+		}
+		if err := os.Mkdir(dsn, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		steps = cmdfile.New(filepath.Join(dsn, "worker"))
+	case "mysql":
+		var err error
+		if steps, err = cmdmysql.New(cmdmysql.WithDSN(dsn)); err != nil {
+			return nil, err
+		}
+	case "inmem":
+		steps = cmdinmem.New()
+	default:
+		return nil, fmt.Errorf("unknown worker storage type: %s", storage)
+	}
+	return &workerStore{
+		Storage:                  steps,
+		WorkerStorage:            steps,
+		EventSubscriptionStorage: events,
+	}, nil
+}
+
+// workerStore combines workflow step storage with the event
+// subscription storage of another backend.
+type workerStore struct {
+	cmdstorage.Storage
+	cmdstorage.WorkerStorage
+	cmdstorage.EventSubscriptionStorage
+}
+
 type subsystemStorage struct {
 	inventory stginv.Storage
 	profile   stgprof.Storage
@@ -166,10 +291,182 @@ func SubsystemStorage(storage, dsn string) (*subsystemStorage, error) {
 			return nil, fmt.Errorf("creating profile subsystem storage: %w", err)
 		}
 
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("opening mysql inventory database: %w", err)
+		}
+
 		return &subsystemStorage{
-			profile: prof,
+			inventory: invquerymysql.New(db),
+			profile:   prof,
 		}, nil
 	}
 
 	return &subsystemStorage{}, nil
 }
+
+// kvBuckets creates key-value buckets for NanoHUB's own subsystems.
+type kvBuckets struct {
+	storage string
+	dsn     string
+	db      *sql.DB
+}
+
+func newKVBuckets(storage, dsn string) (*kvBuckets, error) {
+	b := &kvBuckets{storage: storage, dsn: dsn}
+	switch storage {
+	case "file":
+		if b.dsn == "" {
+			b.dsn = "db"
+		}
+	case "mysql":
+		var err error
+		if b.db, err = sql.Open("mysql", dsn); err != nil {
+			return nil, fmt.Errorf("opening mysql kv database: %w", err)
+		}
+	case "inmem":
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", storage)
+	}
+	return b, nil
+}
+
+// bucket returns the key-value bucket named name.
+func (b *kvBuckets) bucket(name string) kv.Bucket {
+	switch b.storage {
+	case "file":
+		return kvdiskv.New(filepath.Join(b.dsn, "hub-"+name))
+	case "mysql":
+		return kvmysql.New(b.db, name)
+	default:
+		return kvmap.New()
+	}
+}
+
+// queueLister returns a command queue lister for the storage backend.
+// Only MySQL supports listing full command queues; other backends
+// fall back to listing the next command from store.
+func (b *kvBuckets) queueLister(store cmdqueue.Store) cmdqueue.Lister {
+	if b.db != nil {
+		return cmdqueuemysql.New(b.db)
+	}
+	return cmdqueue.NewNextLister(store)
+}
+
+// statusReportPruner returns a DM status report pruner for the storage
+// backend. Only MySQL supports pruning; nil is returned otherwise.
+func (b *kvBuckets) statusReportPruner() retention.Pruner {
+	if b.db != nil {
+		return retentionmysql.NewStatusReports(b.db)
+	}
+	return nil
+}
+
+// commandResultPruner returns a command result pruner for the storage
+// backend. Only MySQL supports pruning; nil is returned otherwise.
+func (b *kvBuckets) commandResultPruner() retention.Pruner {
+	if b.db != nil {
+		return retentionmysql.NewCommandResults(b.db)
+	}
+	return nil
+}
+
+// enrollmentStore deletes and re-enables NanoMDM enrollments.
+type enrollmentStore interface {
+	lifecycle.Cleaner
+	lifecycle.Enabler
+}
+
+// enrollmentStore returns a NanoMDM enrollment store for the storage
+// backend of store as returned by NewStore. Only MySQL and file storage
+// support deleting and re-enabling enrollments; nil is returned otherwise.
+func (b *kvBuckets) enrollmentStore(store mdmstorage.AllStorage) enrollmentStore {
+	if b.db != nil {
+		return lifecyclemysql.NewEnrollments(b.db)
+	}
+	if s, ok := store.(*mdmFileStore); ok {
+		return s.enrollments
+	}
+	return nil
+}
+
+// statusCleaner returns a DM status cleaner for the storage backend of
+// dmStore as returned by NewStore. Only MySQL and file storage support
+// deleting DM status; nil is returned otherwise.
+func (b *kvBuckets) statusCleaner(dmStore nhdmstore) lifecycle.Cleaner {
+	if b.db != nil {
+		return lifecyclemysql.NewStatus(b.db)
+	}
+	if s, ok := dmStore.(*dmFileStore); ok {
+		return s.cleaner
+	}
+	return nil
+}
+
+// locker returns a lease locker shared by replicas for the storage
+// backend. Only MySQL supports shared leases; nil is returned otherwise.
+func (b *kvBuckets) locker() lease.Locker {
+	if b.db != nil {
+		return leasemysql.New(b.db)
+	}
+	return nil
+}
+
+// healthChecker returns the storage connectivity health check for the
+// storage backend or nil if it has none.
+func (b *kvBuckets) healthChecker() health.Checker {
+	switch b.storage {
+	case "file":
+		return health.DirChecker(b.dsn)
+	case "mysql":
+		return health.DBChecker(b.db)
+	default:
+		return nil
+	}
+}
+
+// heartbeatWorkerStore beats on each polling of the workflow engine
+// worker for worker liveness checks.
+type heartbeatWorkerStore struct {
+	cmdstorage.WorkerStorage
+	heartbeat *health.Heartbeat
+}
+
+// RetrieveStepsToEnqueue beats and retrieves steps from the wrapped storage.
+// The worker calls it first on every poll.
+func (s *heartbeatWorkerStore) RetrieveStepsToEnqueue(ctx context.Context, pushTime time.Time) ([]*cmdstorage.StepEnqueueing, error) {
+	s.heartbeat.Beat()
+	return s.WorkerStorage.RetrieveStepsToEnqueue(ctx, pushTime)
+}
+
+// leaseWorkerStore only retrieves work for the workflow engine worker
+// while holding its lease so that only one replica's worker processes
+// steps and re-pushes at a time.
+type leaseWorkerStore struct {
+	cmdstorage.WorkerStorage
+	lease *lease.Lease
+}
+
+// RetrieveStepsToEnqueue retrieves steps from the wrapped storage if the lease is held.
+func (s *leaseWorkerStore) RetrieveStepsToEnqueue(ctx context.Context, pushTime time.Time) ([]*cmdstorage.StepEnqueueing, error) {
+	if !s.lease.Held(ctx) {
+		return nil, nil
+	}
+	return s.WorkerStorage.RetrieveStepsToEnqueue(ctx, pushTime)
+}
+
+// RetrieveTimedOutSteps retrieves steps from the wrapped storage if the lease is held.
+func (s *leaseWorkerStore) RetrieveTimedOutSteps(ctx context.Context) ([]*cmdstorage.StepResult, error) {
+	if !s.lease.Held(ctx) {
+		return nil, nil
+	}
+	return s.WorkerStorage.RetrieveTimedOutSteps(ctx)
+}
+
+// RetrieveAndMarkRePushed retrieves IDs from the wrapped storage if the lease is held.
+func (s *leaseWorkerStore) RetrieveAndMarkRePushed(ctx context.Context, ifBefore time.Time, pushTime time.Time) ([]string, error) {
+	if !s.lease.Held(ctx) {
+		return nil, nil
+	}
+	return s.WorkerStorage.RetrieveAndMarkRePushed(ctx, ifBefore, pushTime)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/lease"
+
+	cmdstorage "github.com/micromdm/nanocmd/engine/storage"
+	cmdinmem "github.com/micromdm/nanocmd/engine/storage/inmem"
+)
+
+// storeStep stores a step of the workflow for enrollment id with a
+// single command. The step is delayed until notUntil and times out at
+// timeout if they are not zero.
+func storeStep(t *testing.T, s cmdstorage.Storage, id, uuid string, notUntil, timeout time.Time) {
+	t.Helper()
+	step := &cmdstorage.StepEnqueuingWithConfig{
+		StepEnqueueing: cmdstorage.StepEnqueueing{
+			StepContext: cmdstorage.StepContext{WorkflowName: "com.example.wf.test.v1", InstanceID: "I-" + uuid, Name: "step"},
+			IDs:         []string{id},
+			Commands:    []cmdstorage.StepCommandRaw{{CommandUUID: uuid, RequestType: "DeviceInformation", Command: []byte("<plist/>")}},
+		},
+		NotUntil: notUntil,
+		Timeout:  timeout,
+	}
+	if err := s.StoreStep(context.Background(), step, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseWorkerStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := cmdinmem.New()
+	storeStep(t, store, "ID1", "UUID1", now.Add(-time.Second), time.Time{})
+	storeStep(t, store, "ID2", "UUID2", time.Time{}, now.Add(-time.Second))
+
+	locker := lease.NewMemLocker(clock.Real)
+	a := &leaseWorkerStore{WorkerStorage: store, lease: lease.New(locker, "worker", time.Minute, lease.WithHolder("a"))}
+	b := &leaseWorkerStore{WorkerStorage: store, lease: lease.New(locker, "worker", time.Minute, lease.WithHolder("b"))}
+	if !a.lease.Held(ctx) {
+		t.Fatal("a: lease not held")
+	}
+
+	// the replica without the lease retrieves nothing
+	steps, err := b.RetrieveStepsToEnqueue(ctx, now)
+	if err != nil || len(steps) != 0 {
+		t.Errorf("b: have %d steps (err %v), want 0", len(steps), err)
+	}
+	results, err := b.RetrieveTimedOutSteps(ctx)
+	if err != nil || len(results) != 0 {
+		t.Errorf("b: have %d timed out steps (err %v), want 0", len(results), err)
+	}
+	ids, err := b.RetrieveAndMarkRePushed(ctx, now.Add(time.Hour), now)
+	if err != nil || len(ids) != 0 {
+		t.Errorf("b: have %d re-pushes (err %v), want 0", len(ids), err)
+	}
+
+	// the replica with the lease retrieves the work
+	steps, err = a.RetrieveStepsToEnqueue(ctx, now)
+	if err != nil || len(steps) != 1 {
+		t.Errorf("a: have %d steps (err %v), want 1", len(steps), err)
+	}
+	results, err = a.RetrieveTimedOutSteps(ctx)
+	if err != nil || len(results) != 1 {
+		t.Errorf("a: have %d timed out steps (err %v), want 1", len(results), err)
+	}
+	ids, err = a.RetrieveAndMarkRePushed(ctx, now.Add(time.Hour), now)
+	if err != nil || len(ids) != 1 {
+		t.Errorf("a: have %d re-pushes (err %v), want 1", len(ids), err)
+	}
+}
+
+func TestNewWorkerStore(t *testing.T) {
+	ctx := context.Background()
+	primary := cmdinmem.New()
+	store, err := NewWorkerStore("inmem", "", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// steps stored by the engine are retrieved by the worker
+	storeStep(t, store, "ID1", "UUID1", time.Now().Add(-time.Second), time.Time{})
+	steps, err := store.RetrieveStepsToEnqueue(ctx, time.Now())
+	if err != nil || len(steps) != 1 {
+		t.Errorf("have %d steps (err %v), want 1", len(steps), err)
+	}
+	if steps, _ = primary.RetrieveStepsToEnqueue(ctx, time.Now()); len(steps) != 0 {
+		t.Errorf("primary: have %d steps, want 0", len(steps))
+	}
+
+	// event subscriptions remain in the primary backend
+	es := &cmdstorage.EventSubscription{Event: "Enrollment", Workflow: "com.example.wf.test.v1"}
+	if err = store.StoreEventSubscription(ctx, "test", es); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := primary.RetrieveEventSubscriptions(ctx, []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs["test"] == nil || subs["test"].Workflow != es.Workflow {
+		t.Errorf("primary: invalid event subscription: %v", subs["test"])
+	}
+}
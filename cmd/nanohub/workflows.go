@@ -12,11 +12,16 @@ import (
 	"github.com/micromdm/nanocmd/workflow/inventory"
 	"github.com/micromdm/nanocmd/workflow/lock"
 	"github.com/micromdm/nanocmd/workflow/profile"
+	"github.com/micromdm/nanohub/appinstall"
+	"github.com/micromdm/nanohub/erase"
+	"github.com/micromdm/nanohub/event"
 	"github.com/micromdm/nanohub/nanohub"
+	"github.com/micromdm/nanohub/osupdate"
+	"github.com/micromdm/nanohub/recoverylock"
 	"github.com/micromdm/nanolib/log"
 )
 
-func workflows(logger log.Logger, s *subsystemStorage) (opts []nanohub.Option) {
+func workflows(logger log.Logger, s *subsystemStorage, sink event.Sink, osUpdates *osupdate.Tracker, osUpdateOpts ...osupdate.WorkflowOption) (opts []nanohub.Option) {
 	if s.inventory != nil {
 		opts = append(opts, nanohub.WithWorkflow(
 			func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
@@ -35,6 +40,33 @@ func workflows(logger log.Logger, s *subsystemStorage) (opts []nanohub.Option) {
 				return
 			},
 		))
+
+		opts = append(opts, nanohub.WithWorkflow(
+			func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+				if w, err = erase.New(e, s.inventory, erase.WithLogger(logger), erase.WithSink(sink)); err != nil {
+					err = fmt.Errorf("creating erase workflow: %w", err)
+				}
+				return
+			},
+		))
+
+		opts = append(opts, nanohub.WithWorkflow(
+			func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+				if w, err = recoverylock.New(e, s.inventory, recoverylock.WithLogger(logger)); err != nil {
+					err = fmt.Errorf("creating recoverylock workflow: %w", err)
+				}
+				return
+			},
+		))
+
+		opts = append(opts, nanohub.WithWorkflow(
+			func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+				if w, err = appinstall.New(e, s.inventory, appinstall.WithLogger(logger), appinstall.WithSink(sink)); err != nil {
+					err = fmt.Errorf("creating appinstall workflow: %w", err)
+				}
+				return
+			},
+		))
 	}
 
 	if s.profile != nil {
@@ -89,6 +121,15 @@ func workflows(logger log.Logger, s *subsystemStorage) (opts []nanohub.Option) {
 		))
 	}
 
+	opts = append(opts, nanohub.WithWorkflow(
+		func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
+			if w, err = osupdate.NewWorkflow(e, osUpdates, append(osUpdateOpts, osupdate.WithWorkflowLogger(logger))...); err != nil {
+				err = fmt.Errorf("creating osupdate workflow: %w", err)
+			}
+			return
+		},
+	))
+
 	opts = append(opts, nanohub.WithWorkflow(
 		func(e workflow.StepEnqueuer) (w workflow.Workflow, err error) {
 			if w, err = devinfolog.New(e, logger); err != nil {
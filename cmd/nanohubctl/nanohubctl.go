@@ -0,0 +1,382 @@
+// Package main is a command-line client for the NanoHUB APIs.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/micromdm/nanohub/client"
+)
+
+// overridden by -ldflags -X
+var version = "unknown"
+
+// errUsage is returned for invalid command arguments.
+var errUsage = errors.New("invalid arguments")
+
+// command is a nanohubctl subcommand.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = map[string]*command{
+	"enqueue": {
+		usage: "[-no-push] <command-plist-file|-> <id>...",
+		help:  "enqueue a raw command plist to enrollments",
+		run:   runEnqueue,
+	},
+	"push": {
+		usage: "<id>...",
+		help:  "send APNs push notifications to enrollments",
+		run:   runPush,
+	},
+	"queue": {
+		usage: "<id>",
+		help:  "list the queued commands of an enrollment",
+		run:   runQueue,
+	},
+	"decl-list": {
+		help: "list declaration identifiers",
+		run:  runDeclList,
+	},
+	"decl-get": {
+		usage: "<identifier>",
+		help:  "print a declaration",
+		run:   runDeclGet,
+	},
+	"decl-put": {
+		usage: "[-no-notify] <declaration-json-file|->",
+		help:  "store a declaration",
+		run:   runDeclPut,
+	},
+	"decl-delete": {
+		usage: "<identifier>",
+		help:  "delete a declaration",
+		run:   runDeclDelete,
+	},
+	"set-list": {
+		help: "list set names",
+		run:  runSetList,
+	},
+	"set-decls": {
+		usage: "<set>",
+		help:  "list the declarations of a set",
+		run:   runSetDecls,
+	},
+	"set-add": {
+		usage: "[-no-notify] <set> <identifier>",
+		help:  "add a declaration to a set",
+		run:   runSetMember(true),
+	},
+	"set-remove": {
+		usage: "[-no-notify] <set> <identifier>",
+		help:  "remove a declaration from a set",
+		run:   runSetMember(false),
+	},
+	"enroll-sets": {
+		usage: "<id>",
+		help:  "list the sets of an enrollment",
+		run:   runEnrollSets,
+	},
+	"enroll-set-add": {
+		usage: "[-no-notify] <id> <set>",
+		help:  "add a set to an enrollment",
+		run:   runEnrollSet(true),
+	},
+	"enroll-set-remove": {
+		usage: "[-no-notify] <id> <set>",
+		help:  "remove a set from an enrollment",
+		run:   runEnrollSet(false),
+	},
+	"workflow-start": {
+		usage: "[-context <string>] <workflow> <id>...",
+		help:  "start a workflow for enrollments",
+		run:   runWorkflowStart,
+	},
+	"inventory": {
+		usage: "<id>...",
+		help:  "print the inventory of enrollments",
+		run:   runInventory,
+	},
+	"events": {
+		usage: "[-type <type>] [-id <id>]",
+		help:  "tail live device events (requires -event-stream on the server)",
+		run:   runEvents,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <command> [command flags] [args]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-18s %s\n", name, commands[name].help)
+	}
+}
+
+func main() {
+	var (
+		flURL     = flag.String("url", os.Getenv("NANOHUB_URL"), "NanoHUB server URL [NANOHUB_URL]")
+		flAPIKey  = flag.String("api-key", os.Getenv("NANOHUB_API_KEY"), "NanoHUB API key [NANOHUB_API_KEY]")
+		flToken   = flag.String("token", os.Getenv("NANOHUB_TOKEN"), "delegation token (instead of the API key) [NANOHUB_TOKEN]")
+		flVersion = flag.Bool("version", false, "print version and exit")
+	)
+	flag.Usage = usage
+	flag.Parse()
+
+	if *flVersion {
+		fmt.Println(version)
+		return
+	}
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		os.Exit(2)
+	}
+	if *flURL == "" {
+		fmt.Fprintln(os.Stderr, "-url is required")
+		os.Exit(2)
+	}
+
+	c := client.New(*flURL, client.WithAPIKey(*flAPIKey), client.WithBearerToken(*flToken))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := cmd.run(ctx, c, flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], flag.Arg(0), cmd.usage)
+		os.Exit(2)
+	} else if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readInput reads the file at path or stdin if path is "-".
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// parseFlags parses the command flags of fs from args and requires at
+// least min arguments.
+func parseFlags(fs *flag.FlagSet, args []string, min int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() < min {
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// printResult prints the push or enqueue result and returns err.
+func printResult(result *client.Result, err error) error {
+	if result != nil {
+		if printErr := printJSON(result); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+func runEnqueue(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	noPush := fs.Bool("no-push", false, "don't push to enrollments")
+	args, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	command, err := readInput(args[0])
+	if err != nil {
+		return err
+	}
+	return printResult(c.Enqueue(ctx, args[1:], command, *noPush))
+}
+
+func runPush(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	return printResult(c.Push(ctx, args))
+}
+
+func runQueue(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	cmds, err := c.Queue(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(cmds)
+}
+
+// printList prints list one item per line.
+func printList(list []string, err error) error {
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		fmt.Println(strings.Join(list, "\n"))
+	}
+	return nil
+}
+
+func runDeclList(ctx context.Context, c *client.Client, _ []string) error {
+	return printList(c.Declarations(ctx))
+}
+
+func runDeclGet(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	decl, err := c.Declaration(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(decl)
+}
+
+func runDeclPut(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("decl-put", flag.ContinueOnError)
+	noNotify := fs.Bool("no-notify", false, "don't notify affected enrollments")
+	args, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	decl, err := readInput(args[0])
+	if err != nil {
+		return err
+	}
+	return c.PutDeclaration(ctx, decl, !*noNotify)
+}
+
+func runDeclDelete(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return c.DeleteDeclaration(ctx, args[0])
+}
+
+func runSetList(ctx context.Context, c *client.Client, _ []string) error {
+	return printList(c.Sets(ctx))
+}
+
+func runSetDecls(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return printList(c.SetDeclarations(ctx, args[0]))
+}
+
+func runSetMember(add bool) func(context.Context, *client.Client, []string) error {
+	return func(ctx context.Context, c *client.Client, args []string) error {
+		fs := flag.NewFlagSet("set", flag.ContinueOnError)
+		noNotify := fs.Bool("no-notify", false, "don't notify affected enrollments")
+		args, err := parseFlags(fs, args, 2)
+		if err != nil {
+			return err
+		}
+		if add {
+			return c.PutSetDeclaration(ctx, args[0], args[1], !*noNotify)
+		}
+		return c.DeleteSetDeclaration(ctx, args[0], args[1], !*noNotify)
+	}
+}
+
+func runEnrollSets(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return printList(c.EnrollmentSets(ctx, args[0]))
+}
+
+func runEnrollSet(add bool) func(context.Context, *client.Client, []string) error {
+	return func(ctx context.Context, c *client.Client, args []string) error {
+		fs := flag.NewFlagSet("enroll-set", flag.ContinueOnError)
+		noNotify := fs.Bool("no-notify", false, "don't notify the enrollment")
+		args, err := parseFlags(fs, args, 2)
+		if err != nil {
+			return err
+		}
+		if add {
+			return c.PutEnrollmentSet(ctx, args[0], args[1], !*noNotify)
+		}
+		return c.DeleteEnrollmentSet(ctx, args[0], args[1], !*noNotify)
+	}
+}
+
+func runWorkflowStart(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("workflow-start", flag.ContinueOnError)
+	wfCtx := fs.String("context", "", "workflow context")
+	args, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	instanceID, err := c.StartWorkflow(ctx, args[0], args[1:], []byte(*wfCtx))
+	if err != nil {
+		return err
+	}
+	fmt.Println(instanceID)
+	return nil
+}
+
+func runInventory(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	inventory, err := c.Inventory(ctx, args)
+	if err != nil {
+		return err
+	}
+	return printJSON(inventory)
+}
+
+func runEvents(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	types := fs.String("type", "", "comma-separated event types")
+	ids := fs.String("id", "", "comma-separated enrollment IDs")
+	if _, err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	// one compact JSON event per line
+	return c.StreamEvents(ctx, split(*types), split(*ids), func(e *client.Event) error {
+		_, err := fmt.Printf("%s\n", e.Data)
+		return err
+	})
+}
@@ -0,0 +1,74 @@
+package cmdcodec
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+)
+
+// queue is a single command queue shared by all enrollments.
+type queue struct {
+	storage.AllStorage
+	cmd *mdm.Command
+}
+
+func (q *queue) EnqueueCommand(_ context.Context, ids []string, cmd *mdm.Command) (map[string]error, error) {
+	q.cmd = cmd
+	return nil, nil
+}
+
+func (q *queue) RetrieveNextCommand(*mdm.Request, bool) (*mdm.Command, error) {
+	if q.cmd == nil {
+		return nil, nil
+	}
+	cmd := *q.cmd
+	return &cmd, nil
+}
+
+func (q *queue) StoreCommandReport(*mdm.Request, *mdm.CommandResults) error {
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	q := new(queue)
+	b := kvmap.New()
+	s := New(q, b, Chain{Gzip{}})
+
+	raw := []byte(`<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict><key>CommandUUID</key><string>UUID</string></dict></plist>`)
+	cmd := &mdm.Command{CommandUUID: "UUID", Raw: raw}
+	cmd.Command.RequestType = "InstallProfile"
+	if _, err := s.EnqueueCommand(ctx, []string{"A", "B"}, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if string(q.cmd.Raw) == string(raw) {
+		t.Error("expected stub to be enqueued")
+	}
+
+	for _, id := range []string{"A", "B"} {
+		r := mdm.NewRequestWithContext(ctx, nil)
+		r.EnrollID = &mdm.EnrollID{ID: id}
+		next, err := s.RetrieveNextCommand(r, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := string(next.Raw), string(raw); have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+		if err = s.StoreCommandReport(r, &mdm.CommandResults{CommandUUID: "UUID", Status: "Acknowledged"}); err != nil {
+			t.Fatal(err)
+		}
+		has, err := b.Has(ctx, keyPfxPayload+"UUID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the payload is deleted after the last enrollment reports
+		if want := id == "A"; has != want {
+			t.Errorf("%s: payload exists: have: %v, want: %v", id, has, want)
+		}
+	}
+}
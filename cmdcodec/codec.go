@@ -0,0 +1,135 @@
+// Package cmdcodec stores queued MDM command payloads encoded (e.g.
+// compressed) in a key-value bucket. The NanoMDM command queue holds
+// only a small stub of each command and each payload is stored once
+// no matter how many enrollments it is queued for.
+package cmdcodec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/micromdm/plist"
+)
+
+// Codec encodes and decodes raw command payloads.
+type Codec interface {
+	// Name is the name of the codec as used in Parse.
+	Name() string
+	Encode(raw []byte) ([]byte, error)
+	Decode(encoded []byte) ([]byte, error)
+}
+
+// Gzip is a codec that compresses payloads with gzip.
+type Gzip struct{}
+
+// Name returns "gzip".
+func (Gzip) Name() string { return "gzip" }
+
+// Encode compresses raw.
+func (Gzip) Encode(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses encoded.
+func (Gzip) Decode(encoded []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Plist is a codec that re-encodes payloads in a compact plist normal
+// form. Insignificant whitespace, comments, and indentation are removed
+// and dictionary keys are sorted. The payload is still an XML plist so
+// decoding is a no-op.
+type Plist struct{}
+
+// Name returns "plist".
+func (Plist) Name() string { return "plist" }
+
+// Encode re-encodes raw in normal form.
+func (Plist) Encode(raw []byte) ([]byte, error) {
+	var v interface{}
+	if err := plist.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("unmarshal command: %w", err)
+	}
+	return plist.Marshal(v)
+}
+
+// Decode returns encoded.
+func (Plist) Decode(encoded []byte) ([]byte, error) {
+	return encoded, nil
+}
+
+// Chain applies codecs in order when encoding and in reverse order
+// when decoding.
+type Chain []Codec
+
+// Name returns the comma-separated names of the codecs.
+func (c Chain) Name() string {
+	names := make([]string, 0, len(c))
+	for _, codec := range c {
+		names = append(names, codec.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Encode encodes raw with each codec.
+func (c Chain) Encode(raw []byte) ([]byte, error) {
+	var err error
+	for _, codec := range c {
+		if raw, err = codec.Encode(raw); err != nil {
+			return nil, fmt.Errorf("%s encode: %w", codec.Name(), err)
+		}
+	}
+	return raw, nil
+}
+
+// Decode decodes encoded with each codec in reverse.
+func (c Chain) Decode(encoded []byte) ([]byte, error) {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if encoded, err = c[i].Decode(encoded); err != nil {
+			return nil, fmt.Errorf("%s decode: %w", c[i].Name(), err)
+		}
+	}
+	return encoded, nil
+}
+
+// Parse parses comma-separated codec names into a codec.
+// Known names are "gzip" and "plist". For example "plist,gzip"
+// normalizes then compresses payloads.
+func Parse(s string) (Codec, error) {
+	var c Chain
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "gzip":
+			c = append(c, Gzip{})
+		case "plist":
+			c = append(c, Plist{})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown codec: %s", name)
+		}
+	}
+	if len(c) < 1 {
+		return nil, fmt.Errorf("no codecs: %q", s)
+	}
+	return c, nil
+}
@@ -0,0 +1,222 @@
+package cmdcodec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/storage"
+	"github.com/micromdm/plist"
+)
+
+const (
+	keyPfxPayload = "cmd."
+	keyPfxRef     = "ref."
+)
+
+// stub is the command enqueued in place of the full command.
+type stub struct {
+	CommandUUID string
+	Command     struct {
+		RequestType string
+	}
+}
+
+// Store is NanoMDM storage that stores queued command payloads encoded
+// with a codec in a bucket. Payloads are decoded when retrieved from the
+// queue and removed once no enrollment has the command queued.
+// Commands enqueued without the store are passed through unchanged.
+type Store struct {
+	storage.AllStorage
+
+	bucket kv.Bucket
+	codec  Codec
+	logger log.Logger
+}
+
+// Option configures the store.
+type Option func(*Store)
+
+// WithLogger configures a logger for the store.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// New creates a new store for store that encodes payloads with codec.
+func New(store storage.AllStorage, bucket kv.Bucket, codec Codec, opts ...Option) *Store {
+	if store == nil {
+		panic("nil store")
+	}
+	if bucket == nil {
+		panic("nil bucket")
+	}
+	if codec == nil {
+		panic("nil codec")
+	}
+	s := &Store{
+		AllStorage: store,
+		bucket:     bucket,
+		codec:      codec,
+		logger:     log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// refKey is the key of the reference of enrollment id to command uuid.
+func refKey(uuid, id string) string {
+	return keyPfxRef + uuid + "." + id
+}
+
+// encode encodes raw with the codec of s.
+// The codec name is prepended to decode with the same codec later.
+func (s *Store) encode(raw []byte) ([]byte, error) {
+	encoded, err := s.codec.Encode(raw)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(s.codec.Name()+"\n"), encoded...), nil
+}
+
+// decode decodes a payload encoded by encode.
+func decode(payload []byte) ([]byte, error) {
+	i := bytes.IndexByte(payload, '\n')
+	if i < 0 {
+		return nil, errors.New("invalid payload")
+	}
+	codec, err := Parse(string(payload[:i]))
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(payload[i+1:])
+}
+
+// EnqueueCommand stores the encoded payload of cmd and enqueues a stub
+// of cmd for ids.
+func (s *Store) EnqueueCommand(ctx context.Context, ids []string, cmd *mdm.Command) (map[string]error, error) {
+	if cmd == nil || cmd.CommandUUID == "" || strings.Contains(cmd.CommandUUID, ".") {
+		// keys can't distinguish UUIDs containing our separator
+		return s.AllStorage.EnqueueCommand(ctx, ids, cmd)
+	}
+
+	payload, err := s.encode(cmd.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("encoding command: %w", err)
+	}
+	st := &stub{CommandUUID: cmd.CommandUUID}
+	st.Command.RequestType = cmd.Command.RequestType
+	stubCmd := *cmd
+	if stubCmd.Raw, err = plist.Marshal(st); err != nil {
+		return nil, fmt.Errorf("marshal command stub: %w", err)
+	}
+
+	if err = s.bucket.Set(ctx, keyPfxPayload+cmd.CommandUUID, payload); err != nil {
+		return nil, fmt.Errorf("storing command payload: %w", err)
+	}
+	for _, id := range ids {
+		if err = s.bucket.Set(ctx, refKey(cmd.CommandUUID, id), []byte("1")); err != nil {
+			return nil, fmt.Errorf("storing command reference: %w", err)
+		}
+	}
+
+	idErrs, err := s.AllStorage.EnqueueCommand(ctx, ids, &stubCmd)
+	// release the references of failed enqueues
+	for _, id := range ids {
+		if err != nil || idErrs[id] != nil {
+			s.release(ctx, cmd.CommandUUID, id)
+		}
+	}
+	return idErrs, err
+}
+
+// RetrieveNextCommand retrieves the next queued command and replaces
+// its stub with the decoded payload.
+func (s *Store) RetrieveNextCommand(r *mdm.Request, skipNotNow bool) (*mdm.Command, error) {
+	cmd, err := s.AllStorage.RetrieveNextCommand(r, skipNotNow)
+	if err != nil || cmd == nil {
+		return cmd, err
+	}
+	payload, err := s.bucket.Get(r.Context(), keyPfxPayload+cmd.CommandUUID)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return cmd, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("retrieving command payload: %w", err)
+	}
+	if cmd.Raw, err = decode(payload); err != nil {
+		return nil, fmt.Errorf("decoding command payload %s: %w", cmd.CommandUUID, err)
+	}
+	return cmd, nil
+}
+
+// StoreCommandReport stores report and releases the payload reference
+// of the enrollment once the command is no longer queued.
+func (s *Store) StoreCommandReport(r *mdm.Request, report *mdm.CommandResults) error {
+	if err := s.AllStorage.StoreCommandReport(r, report); err != nil {
+		return err
+	}
+	if report != nil && report.CommandUUID != "" && report.Status != "NotNow" && r.EnrollID != nil {
+		s.release(r.Context(), report.CommandUUID, r.ID)
+	}
+	return nil
+}
+
+// ClearQueue clears the queue of the enrollment and releases its
+// payload references.
+func (s *Store) ClearQueue(r *mdm.Request) error {
+	if err := s.AllStorage.ClearQueue(r); err != nil {
+		return err
+	}
+	if r.EnrollID == nil {
+		return nil
+	}
+	keys, err := s.bucket.KeysPrefix(r.Context(), keyPfxRef)
+	if err != nil {
+		ctxlog.Logger(r.Context(), s.logger).Info("msg", "listing command references", "err", err)
+		return nil
+	}
+	for _, k := range keys {
+		uuid, id, ok := strings.Cut(strings.TrimPrefix(k, keyPfxRef), ".")
+		if ok && id == r.ID {
+			s.release(r.Context(), uuid, id)
+		}
+	}
+	return nil
+}
+
+// release removes the reference of enrollment id to command uuid and
+// deletes the payload if it was the last reference.
+// Errors are only logged as the queue itself was already updated.
+func (s *Store) release(ctx context.Context, uuid, id string) {
+	logger := ctxlog.Logger(ctx, s.logger)
+	if err := s.bucket.Delete(ctx, refKey(uuid, id)); err != nil {
+		logger.Info("msg", "deleting command reference", "command_uuid", uuid, "id", id, "err", err)
+		return
+	}
+	refs, err := s.bucket.KeysPrefix(ctx, keyPfxRef+uuid+".")
+	if err != nil {
+		logger.Info("msg", "listing command references", "command_uuid", uuid, "err", err)
+		return
+	}
+	if len(refs) > 0 {
+		return
+	}
+	if err = s.bucket.Delete(ctx, keyPfxPayload+uuid); err != nil {
+		logger.Info("msg", "deleting command payload", "command_uuid", uuid, "err", err)
+		return
+	}
+	logger.Debug("msg", "deleted command payload", "command_uuid", uuid)
+}
@@ -0,0 +1,212 @@
+// Package cmdexpiry expires enqueued MDM commands that enrollments
+// have not fetched within a time-to-live.
+package cmdexpiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdqueue"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Expiry is the expiration of an enqueued command.
+type Expiry struct {
+	// IDs are the enrollment IDs that have not yet fetched the command.
+	IDs       []string  `json:"ids"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store stores command expirations.
+type Store interface {
+	// StoreExpiry stores (replaces) the expiry of command uuid.
+	// An expiry with no IDs removes it.
+	StoreExpiry(ctx context.Context, uuid string, e *Expiry) error
+
+	// RetrieveExpiry retrieves the expiry of command uuid.
+	// Returns a nil expiry if uuid has no expiry.
+	RetrieveExpiry(ctx context.Context, uuid string) (*Expiry, error)
+
+	// RetrieveExpiries retrieves all command expirations keyed by command UUID.
+	RetrieveExpiries(ctx context.Context) (map[string]*Expiry, error)
+}
+
+// Remover removes commands from enrollment command queues.
+// See the cmdqueue package.
+type Remover interface {
+	Remove(ctx context.Context, id, uuid, domain, description string) error
+}
+
+// Expirer tracks and expires enqueued commands.
+// It is also a NanoMDM service that tracks command delivery.
+type Expirer struct {
+	service.CheckinAndCommandService
+
+	store   Store
+	remover Remover
+	sink    event.Sink
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures an expirer.
+type Option func(*Expirer)
+
+// WithClock configures the clock used for expiry times and sweeps.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(e *Expirer) {
+		e.clock = c
+	}
+}
+
+// New creates a new command expirer. Expired commands are removed
+// using remover and expiration events are sent to sink.
+// The sink may be nil.
+func New(store Store, remover Remover, sink event.Sink, logger log.Logger, opts ...Option) *Expirer {
+	if store == nil {
+		panic("nil store")
+	}
+	if remover == nil {
+		panic("nil remover")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	e := &Expirer{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		remover:                  remover,
+		sink:                     sink,
+		logger:                   logger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Expire sets the expiry of the enqueued command uuid for ids to ttl from now.
+func (e *Expirer) Expire(ctx context.Context, uuid string, ids []string, ttl time.Duration) error {
+	if uuid == "" {
+		return errors.New("empty command uuid")
+	}
+	if len(ids) < 1 {
+		return errors.New("no ids")
+	}
+	if ttl <= 0 {
+		return errors.New("invalid ttl")
+	}
+	return e.store.StoreExpiry(ctx, uuid, &Expiry{IDs: ids, ExpiresAt: e.clock.Now().Add(ttl)})
+}
+
+// CommandAndReportResults marks the command reported by the enrollment as fetched.
+// NotNow reports do not count as the command will be delivered again.
+func (e *Expirer) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results.CommandUUID == "" || results.Status == "NotNow" {
+		return nil, nil
+	}
+	exp, err := e.store.RetrieveExpiry(r.Context(), results.CommandUUID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving command expiry: %w", err)
+	}
+	if exp == nil {
+		return nil, nil
+	}
+	var ids []string
+	for _, id := range exp.IDs {
+		if id != r.ID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == len(exp.IDs) {
+		return nil, nil
+	}
+	exp.IDs = ids
+	if err = e.store.StoreExpiry(r.Context(), results.CommandUUID, exp); err != nil {
+		return nil, fmt.Errorf("storing command expiry: %w", err)
+	}
+	return nil, nil
+}
+
+// Sweep dequeues commands that expired before now from the enrollments
+// that have not fetched them and sends expiration events.
+// Returns the number of expired enrollment commands.
+func (e *Expirer) Sweep(ctx context.Context, now time.Time) (int, error) {
+	expiries, err := e.store.RetrieveExpiries(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving command expiries: %w", err)
+	}
+	var n int
+	for uuid, exp := range expiries {
+		if exp.ExpiresAt.After(now) {
+			continue
+		}
+		var remaining []string
+		for _, id := range exp.IDs {
+			if err = e.expire(ctx, uuid, id); err != nil {
+				ctxlog.Logger(ctx, e.logger).Info("msg", "expiring command", "command_uuid", uuid, "id", id, "err", err)
+				remaining = append(remaining, id)
+				continue
+			}
+			n++
+		}
+		// keep any failures around to try again on the next sweep
+		exp.IDs = remaining
+		if err = e.store.StoreExpiry(ctx, uuid, exp); err != nil {
+			return n, fmt.Errorf("storing command expiry: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// expire removes command uuid for enrollment id and sends an expiration event.
+func (e *Expirer) expire(ctx context.Context, uuid, id string) error {
+	err := e.remover.Remove(ctx, id, uuid, cmdqueue.ErrorDomainExpired, "Command expired before delivery")
+	if err != nil {
+		return err
+	}
+
+	if e.sink != nil {
+		ev := event.New(e.clock, event.TypeCommandExpired, id)
+		ev.Fields["command_uuid"] = uuid
+		if err = e.sink.Send(ctx, ev); err != nil {
+			ctxlog.Logger(ctx, e.logger).Info("msg", "sending event", "type", ev.Type, "err", err)
+		}
+	}
+	return nil
+}
+
+// Run sweeps expired commands every interval until ctx is done.
+func (e *Expirer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := e.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+
+		n, err := e.Sweep(ctx, e.clock.Now())
+		if err != nil {
+			e.logger.Info("msg", "sweeping expired commands", "err", err)
+		} else if n > 0 {
+			e.logger.Info("msg", "expired commands", "count", n)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cmdexpiry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type remover struct {
+	removed map[string]string
+}
+
+func (r *remover) Remove(_ context.Context, id, uuid, _, _ string) error {
+	r.removed[id] = uuid
+	return nil
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	rem := &remover{removed: make(map[string]string)}
+	var events []*event.Event
+	sink := event.SinkFunc(func(_ context.Context, e *event.Event) error {
+		events = append(events, e)
+		return nil
+	})
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	e := New(NewKVStore(kvmap.New()), rem, sink, nil, WithClock(c))
+
+	if err := e.Expire(ctx, "CMD1", []string{"ID1", "ID2"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// ID1 fetches the command
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	if _, err := e.CommandAndReportResults(r, &mdm.CommandResults{CommandUUID: "CMD1", Status: "Acknowledged"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing has expired yet
+	if n, err := e.Sweep(ctx, c.Now()); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("have: %v, want: %v", n, 0)
+	}
+
+	c.Advance(2 * time.Minute)
+	n, err := e.Sweep(ctx, c.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 1; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if rem.removed["ID2"] != "CMD1" {
+		t.Error("expected command removed for ID2")
+	}
+	if _, ok := rem.removed["ID1"]; ok {
+		t.Error("unexpected command removed for ID1")
+	}
+	if len(events) != 1 || events[0].Type != event.TypeCommandExpired || events[0].Fields["command_uuid"] != "CMD1" {
+		t.Errorf("unexpected events: %v", events)
+	}
+
+	// expired commands are only expired once
+	if n, err = e.Sweep(ctx, c.Now()); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("have: %v, want: %v", n, 0)
+	}
+}
@@ -0,0 +1,90 @@
+package cmdexpiry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// TTLParam is the query parameter containing the command TTL in seconds.
+const TTLParam = "ttl"
+
+// enqueueResult is the subset of the NanoMDM API enqueue result we need.
+type enqueueResult struct {
+	Status map[string]struct {
+		CommandError string `json:"command_error"`
+	} `json:"status"`
+	CommandUUID string `json:"command_uuid"`
+}
+
+// bufferedWriter buffers the response body.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// EnqueueMiddleware wraps the NanoMDM command enqueue API handler.
+// Errors setting the expiry are logged but do not change the response.
+// If the TTL query parameter is present the enqueued command is
+// expired for the enrollments that enqueued successfully.
+func EnqueueMiddleware(e *Expirer, logger log.Logger) func(http.Handler) http.Handler {
+	if e == nil {
+		panic("nil expirer")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ttlParam := r.URL.Query().Get(TTLParam)
+			if ttlParam == "" || !strings.Contains(r.URL.Path, "/enqueue/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			logger := ctxlog.Logger(r.Context(), logger)
+
+			ttl, err := strconv.Atoi(ttlParam)
+			if err != nil || ttl < 1 {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+
+			bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(bw, r)
+
+			result := new(enqueueResult)
+			if err = json.Unmarshal(bw.body.Bytes(), result); err == nil && result.CommandUUID != "" {
+				// the enqueue API takes comma-separated IDs as the last path element
+				var ids []string
+				for _, id := range strings.Split(path.Base(r.URL.Path), ",") {
+					if id != "" && result.Status[id].CommandError == "" {
+						ids = append(ids, id)
+					}
+				}
+				if len(ids) > 0 {
+					if err = e.Expire(r.Context(), result.CommandUUID, ids, time.Duration(ttl)*time.Second); err != nil {
+						logger.Info("msg", "setting command expiry", "command_uuid", result.CommandUUID, "err", err)
+					} else {
+						logger.Debug("msg", "set command expiry", "command_uuid", result.CommandUUID, "ttl", ttl)
+					}
+				}
+			}
+
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+		})
+	}
+}
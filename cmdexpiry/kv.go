@@ -0,0 +1,72 @@
+package cmdexpiry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores command expirations in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new expiry store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreExpiry stores the expiry of command uuid.
+func (s *KVStore) StoreExpiry(ctx context.Context, uuid string, e *Expiry) error {
+	if uuid == "" {
+		return errors.New("empty command uuid")
+	}
+	if e == nil || len(e.IDs) < 1 {
+		return s.b.Delete(ctx, uuid)
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal expiry: %w", err)
+	}
+	return s.b.Set(ctx, uuid, v)
+}
+
+// RetrieveExpiry retrieves the expiry of command uuid.
+func (s *KVStore) RetrieveExpiry(ctx context.Context, uuid string) (*Expiry, error) {
+	v, err := s.b.Get(ctx, uuid)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e := new(Expiry)
+	if err = json.Unmarshal(v, e); err != nil {
+		return nil, fmt.Errorf("unmarshal expiry: %w", err)
+	}
+	return e, nil
+}
+
+// RetrieveExpiries retrieves all command expirations.
+func (s *KVStore) RetrieveExpiries(ctx context.Context) (map[string]*Expiry, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	ret := make(map[string]*Expiry, len(keys))
+	for _, uuid := range keys {
+		e, err := s.RetrieveExpiry(ctx, uuid)
+		if err != nil {
+			return ret, fmt.Errorf("retrieving expiry %s: %w", uuid, err)
+		}
+		if e != nil {
+			ret[uuid] = e
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,160 @@
+// Package cmdqueue removes MDM commands from enrollment command queues.
+// Commands are removed by storing an error command report on behalf
+// of the enrollment which works with any NanoMDM storage backend.
+package cmdqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+// Error domains of the error reports stored for removed commands.
+const (
+	ErrorDomainCanceled = "NanoHUBCommandCanceled"
+	ErrorDomainExpired  = "NanoHUBCommandExpired"
+)
+
+// maxRemoveAll limits the number of commands removed by RemoveAll.
+const maxRemoveAll = 1000
+
+// Store stores MDM command reports and retrieves queued commands.
+// This is a subset of NanoMDM storage.
+type Store interface {
+	StoreCommandReport(r *mdm.Request, report *mdm.CommandResults) error
+	RetrieveNextCommand(r *mdm.Request, skipNotNow bool) (*mdm.Command, error)
+}
+
+// ResponseReceiver receives MDM command responses.
+// This is a subset of a NanoCMD workflow engine.
+type ResponseReceiver interface {
+	MDMCommandResponseEvent(ctx context.Context, id, uuid string, raw []byte, mdmCtx *workflow.MDMContext) error
+}
+
+// ResponseReceiverFunc adapts a function to a ResponseReceiver.
+type ResponseReceiverFunc func(ctx context.Context, id, uuid string, raw []byte, mdmCtx *workflow.MDMContext) error
+
+// MDMCommandResponseEvent calls f.
+func (f ResponseReceiverFunc) MDMCommandResponseEvent(ctx context.Context, id, uuid string, raw []byte, mdmCtx *workflow.MDMContext) error {
+	return f(ctx, id, uuid, raw, mdmCtx)
+}
+
+// Queue removes commands from enrollment command queues.
+type Queue struct {
+	store    Store
+	receiver ResponseReceiver
+	logger   log.Logger
+}
+
+// Option configures a queue.
+type Option func(*Queue)
+
+// WithLogger configures the queue logger.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(q *Queue) {
+		q.logger = logger
+	}
+}
+
+// WithResponseReceiver sends the error reports of removed commands to r.
+// This notifies any workflows awaiting the command response.
+func WithResponseReceiver(r ResponseReceiver) Option {
+	return func(q *Queue) {
+		q.receiver = r
+	}
+}
+
+// New creates a new queue using store.
+func New(store Store, opts ...Option) *Queue {
+	if store == nil {
+		panic("nil store")
+	}
+	q := &Queue{store: store, logger: log.NopLogger}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Remove removes command uuid from the queue of enrollment id.
+// The error report uses domain and description.
+func (q *Queue) Remove(ctx context.Context, id, uuid, domain, description string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if uuid == "" {
+		return errors.New("empty command uuid")
+	}
+
+	report := &mdm.CommandResults{
+		CommandUUID: uuid,
+		Status:      "Error",
+		ErrorChain: []mdm.ErrorChain{{
+			ErrorDomain:          domain,
+			LocalizedDescription: description,
+			USEnglishDescription: description,
+		}},
+	}
+	var err error
+	if report.Raw, err = plist.Marshal(report); err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: id}
+	if err = q.store.StoreCommandReport(r, report); err != nil {
+		return fmt.Errorf("storing command report: %w", err)
+	}
+
+	if q.receiver != nil {
+		err = q.receiver.MDMCommandResponseEvent(ctx, id, uuid, report.Raw, &workflow.MDMContext{})
+		if err != nil {
+			// the command is removed at this point so just log
+			ctxlog.Logger(ctx, q.logger).Info(
+				"msg", "sending response to workflow engine",
+				"id", id,
+				"command_uuid", uuid,
+				"err", err,
+			)
+		}
+	}
+	return nil
+}
+
+// RemoveAll removes all queued commands of enrollment id.
+// The error reports use domain and description.
+// Returns the UUIDs of the removed commands.
+func (q *Queue) RemoveAll(ctx context.Context, id, domain, description string) ([]string, error) {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: id}
+
+	var uuids []string
+	seen := make(map[string]bool)
+	for i := 0; i < maxRemoveAll; i++ {
+		cmd, err := q.store.RetrieveNextCommand(r, false)
+		if err != nil {
+			return uuids, fmt.Errorf("retrieving next command: %w", err)
+		}
+		if cmd == nil {
+			return uuids, nil
+		}
+		if seen[cmd.CommandUUID] {
+			return uuids, fmt.Errorf("command not removed from queue: %s", cmd.CommandUUID)
+		}
+		seen[cmd.CommandUUID] = true
+		if err = q.Remove(ctx, id, cmd.CommandUUID, domain, description); err != nil {
+			return uuids, err
+		}
+		uuids = append(uuids, cmd.CommandUUID)
+	}
+	return uuids, fmt.Errorf("more than %d commands in queue", maxRemoveAll)
+}
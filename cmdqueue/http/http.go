@@ -0,0 +1,157 @@
+// Package http provides the HTTP API for inspecting and managing enrollment command queues.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/cmdqueue"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoIDs is returned when no enrollment IDs are provided.
+	ErrNoIDs = errors.New("no ids provided")
+
+	// ErrNoUUID is returned when no command UUID is provided.
+	ErrNoUUID = errors.New("no command uuid provided")
+)
+
+// cancelDescription is the error description of canceled commands.
+const cancelDescription = "Command canceled"
+
+// CancelResult is the result of a cancellation.
+type CancelResult struct {
+	// Canceled contains the enrollment IDs or command UUIDs canceled.
+	Canceled []string `json:"canceled,omitempty"`
+
+	// Errors contains errors keyed by enrollment ID.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// CancelCommandHandler cancels the command UUID in the URL path for
+// the enrollment IDs in the "id" query parameters.
+func CancelCommandHandler(q *cmdqueue.Queue, logger log.Logger) http.HandlerFunc {
+	if q == nil {
+		panic("nil queue")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		uuid := flow.Param(r.Context(), "uuid")
+		if uuid == "" {
+			httpapi.JSONError(w, ErrNoUUID, http.StatusBadRequest)
+			return
+		}
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		result := new(CancelResult)
+		for _, id := range ids {
+			err := q.Remove(r.Context(), id, uuid, cmdqueue.ErrorDomainCanceled, cancelDescription)
+			if err != nil {
+				logger.Info("msg", "canceling command", "id", id, "command_uuid", uuid, "err", err)
+				if result.Errors == nil {
+					result.Errors = make(map[string]string)
+				}
+				result.Errors[id] = err.Error()
+				continue
+			}
+			result.Canceled = append(result.Canceled, id)
+		}
+
+		logger.Debug("msg", "canceled command", "command_uuid", uuid, "count", len(result.Canceled))
+		if len(result.Errors) > 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		httpapi.WriteJSON(w, result, logger)
+	}
+}
+
+// CancelQueueHandler cancels all queued commands for the enrollment ID in the URL path.
+func CancelQueueHandler(q *cmdqueue.Queue, logger log.Logger) http.HandlerFunc {
+	if q == nil {
+		panic("nil queue")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		result := new(CancelResult)
+		var err error
+		result.Canceled, err = q.RemoveAll(r.Context(), id, cmdqueue.ErrorDomainCanceled, cancelDescription)
+		if err != nil {
+			logger.Info("msg", "canceling queue", "id", id, "err", err)
+			result.Errors = map[string]string{id: err.Error()}
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			logger.Debug("msg", "canceled queue", "id", id, "count", len(result.Canceled))
+		}
+		httpapi.WriteJSON(w, result, logger)
+	}
+}
+
+// GetQueueHandler lists the queued commands of the enrollment ID in the URL path.
+func GetQueueHandler(lister cmdqueue.Lister, logger log.Logger) http.HandlerFunc {
+	if lister == nil {
+		panic("nil lister")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		cmds, err := lister.RetrieveQueue(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving queue", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if cmds == nil {
+			// always return a JSON array
+			cmds = []*cmdqueue.QueuedCommand{}
+		}
+
+		httpapi.WriteJSON(w, cmds, logger)
+	}
+}
+
+// HandleAPIv1 registers the command queue API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, q *cmdqueue.Queue, lister cmdqueue.Lister) {
+	mux.Handle(
+		prefix+"/queue/:id",
+		GetQueueHandler(lister, logger.With("handler", "get-queue")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/commands/:uuid",
+		CancelCommandHandler(q, logger.With("handler", "cancel-command")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/queue/:id",
+		CancelQueueHandler(q, logger.With("handler", "cancel-queue")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,67 @@
+package cmdqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+// QueuedCommand is a command in an enrollment command queue.
+type QueuedCommand struct {
+	CommandUUID string `json:"command_uuid"`
+	RequestType string `json:"request_type,omitempty"`
+
+	// EnqueuedAt is the time the command was enqueued.
+	// It is the zero time if unknown.
+	EnqueuedAt time.Time `json:"enqueued_at,omitempty"`
+
+	// Priority is the queue priority of the command.
+	// Higher priority commands are delivered first.
+	Priority int `json:"priority"`
+
+	// Status is "NotNow" if the device deferred the command.
+	// Otherwise it is empty as the command was not yet delivered.
+	Status string `json:"status,omitempty"`
+}
+
+// Lister lists the queued commands of an enrollment.
+type Lister interface {
+	// RetrieveQueue retrieves the queued (undelivered or NotNow)
+	// commands of enrollment id in delivery order.
+	RetrieveQueue(ctx context.Context, id string) ([]*QueuedCommand, error)
+}
+
+// NextLister lists only the next queued command of an enrollment.
+// NanoMDM storage can only retrieve the next queued command so this is
+// a fallback for storage backends without a full queue Lister.
+// The enqueue time and priority are not available.
+type NextLister struct {
+	store Store
+}
+
+// NewNextLister creates a new next command lister using store.
+func NewNextLister(store Store) *NextLister {
+	if store == nil {
+		panic("nil store")
+	}
+	return &NextLister{store: store}
+}
+
+// RetrieveQueue retrieves the next queued command of enrollment id.
+func (l *NextLister) RetrieveQueue(ctx context.Context, id string) ([]*QueuedCommand, error) {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: id}
+	cmd, err := l.store.RetrieveNextCommand(r, false)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving next command: %w", err)
+	}
+	if cmd == nil {
+		return nil, nil
+	}
+	return []*QueuedCommand{{
+		CommandUUID: cmd.CommandUUID,
+		RequestType: cmd.Command.RequestType,
+	}}, nil
+}
@@ -0,0 +1,69 @@
+// Package mysql lists enrollment command queues directly from
+// NanoMDM's MySQL storage tables.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/cmdqueue"
+)
+
+// Lister lists enrollment command queues from NanoMDM MySQL storage.
+type Lister struct {
+	db *sql.DB
+}
+
+// New creates a new lister using db.
+// The database must contain the NanoMDM schema.
+func New(db *sql.DB) *Lister {
+	if db == nil {
+		panic("nil db")
+	}
+	return &Lister{db: db}
+}
+
+// RetrieveQueue retrieves the queued commands of enrollment id in delivery order.
+func (l *Lister) RetrieveQueue(ctx context.Context, id string) ([]*cmdqueue.QueuedCommand, error) {
+	rows, err := l.db.QueryContext(
+		ctx,
+		`SELECT
+    c.command_uuid,
+    c.request_type,
+    UNIX_TIMESTAMP(q.created_at),
+    q.priority,
+    COALESCE(r.status, '')
+FROM
+    enrollment_queue q
+    INNER JOIN commands c
+        ON q.command_uuid = c.command_uuid
+    LEFT JOIN command_results r
+        ON r.command_uuid = q.command_uuid AND r.id = q.id
+WHERE
+    q.id = ? AND
+    q.active = 1 AND
+    (r.status IS NULL OR r.status = 'NotNow')
+ORDER BY
+    q.priority DESC,
+    q.created_at;`,
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying queue: %w", err)
+	}
+	defer rows.Close()
+
+	var ret []*cmdqueue.QueuedCommand
+	for rows.Next() {
+		c := new(cmdqueue.QueuedCommand)
+		var created int64
+		if err = rows.Scan(&c.CommandUUID, &c.RequestType, &created, &c.Priority, &c.Status); err != nil {
+			return ret, fmt.Errorf("scanning queue row: %w", err)
+		}
+		c.EnqueuedAt = time.Unix(created, 0)
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,83 @@
+// Package cmdresponse decodes common MDM command responses into typed models.
+package cmdresponse
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/plist"
+)
+
+// Request types of the supported command responses.
+const (
+	DeviceInformationType        = "DeviceInformation"
+	SecurityInfoType             = "SecurityInfo"
+	ProfileListType              = "ProfileList"
+	InstalledApplicationListType = "InstalledApplicationList"
+	AvailableOSUpdatesType       = "AvailableOSUpdates"
+)
+
+// ErrUnknownResponse is returned when a command response is not of a supported type.
+var ErrUnknownResponse = errors.New("unknown command response")
+
+// Response is a decoded command response.
+// Exactly one of the typed response fields is set.
+type Response struct {
+	RequestType string    `json:"request_type"`
+	CommandUUID string    `json:"command_uuid,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	ReceivedAt  time.Time `json:"received_at,omitempty"`
+
+	DeviceInformation        *DeviceInformation `json:"device_information,omitempty"`
+	SecurityInfo             *SecurityInfo      `json:"security_info,omitempty"`
+	ProfileList              []Profile          `json:"profile_list,omitempty"`
+	InstalledApplicationList []Application      `json:"installed_application_list,omitempty"`
+	AvailableOSUpdates       []OSUpdate         `json:"available_os_updates,omitempty"`
+}
+
+// rawResponse contains the keys of all supported command responses.
+type rawResponse struct {
+	CommandUUID string
+	Status      string
+
+	QueryResponses           *DeviceInformation
+	SecurityInfo             *SecurityInfo
+	ProfileList              *[]Profile
+	InstalledApplicationList *[]Application
+	AvailableOSUpdates       *[]OSUpdate
+}
+
+// Decode decodes the raw command response plist.
+// The request type is determined by the keys present in the response.
+// ErrUnknownResponse is returned for unsupported responses.
+func Decode(raw []byte) (*Response, error) {
+	rr := new(rawResponse)
+	if err := plist.Unmarshal(raw, rr); err != nil {
+		return nil, fmt.Errorf("unmarshal command response: %w", err)
+	}
+	r := &Response{
+		CommandUUID: rr.CommandUUID,
+		Status:      rr.Status,
+	}
+	switch {
+	case rr.QueryResponses != nil:
+		r.RequestType = DeviceInformationType
+		r.DeviceInformation = rr.QueryResponses
+	case rr.SecurityInfo != nil:
+		r.RequestType = SecurityInfoType
+		r.SecurityInfo = rr.SecurityInfo
+	case rr.ProfileList != nil:
+		r.RequestType = ProfileListType
+		r.ProfileList = *rr.ProfileList
+	case rr.InstalledApplicationList != nil:
+		r.RequestType = InstalledApplicationListType
+		r.InstalledApplicationList = *rr.InstalledApplicationList
+	case rr.AvailableOSUpdates != nil:
+		r.RequestType = AvailableOSUpdatesType
+		r.AvailableOSUpdates = *rr.AvailableOSUpdates
+	default:
+		return r, ErrUnknownResponse
+	}
+	return r, nil
+}
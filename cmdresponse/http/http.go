@@ -0,0 +1,94 @@
+// Package http provides the HTTP API for decoded command responses.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// GetResponsesHandler returns the latest decoded command responses
+// for the enrollment ID in the URL path. The optional "type" query
+// parameter selects a single request type.
+func GetResponsesHandler(store cmdresponse.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		responses, err := store.RetrieveResponses(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving responses", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		if t := r.URL.Query().Get("type"); t != "" {
+			resp, ok := responses[t]
+			if !ok {
+				httpapi.JSONError(w, fmt.Errorf("no %s response for %s", t, id), http.StatusNotFound)
+				return
+			}
+			httpapi.WriteJSON(w, resp, logger)
+			return
+		}
+
+		httpapi.WriteJSON(w, responses, logger)
+	}
+}
+
+// DecodeHandler decodes the raw command response plist in the request
+// body and returns it as JSON.
+func DecodeHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			httpapi.JSONError(w, fmt.Errorf("reading body: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := cmdresponse.Decode(raw)
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		httpapi.WriteJSON(w, resp, logger)
+	}
+}
+
+// HandleAPIv1 registers the command response API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store cmdresponse.Store) {
+	mux.Handle(
+		prefix+"/responses/:id",
+		GetResponsesHandler(store, logger.With("handler", "get-responses")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/responses/decode",
+		DecodeHandler(logger.With("handler", "decode-response")),
+		"POST",
+	)
+}
@@ -0,0 +1,101 @@
+package cmdresponse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// requestTypes are the supported request types.
+var requestTypes = []string{
+	DeviceInformationType,
+	SecurityInfoType,
+	ProfileListType,
+	InstalledApplicationListType,
+	AvailableOSUpdatesType,
+}
+
+// KVStore stores command responses in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new response store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreResponse stores the response for id.
+func (s *KVStore) StoreResponse(ctx context.Context, id string, r *Response) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if r == nil || r.RequestType == "" {
+		return errors.New("invalid response")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal response: %w", err)
+	}
+	return s.b.Set(ctx, r.RequestType+"."+id, v)
+}
+
+// RetrieveResponses retrieves the responses for id.
+func (s *KVStore) RetrieveResponses(ctx context.Context, id string) (map[string]*Response, error) {
+	ret := make(map[string]*Response)
+	for _, t := range requestTypes {
+		v, err := s.b.Get(ctx, t+"."+id)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return ret, fmt.Errorf("getting %s response: %w", t, err)
+		}
+		r := new(Response)
+		if err = json.Unmarshal(v, r); err != nil {
+			return ret, fmt.Errorf("unmarshal %s response: %w", t, err)
+		}
+		ret[t] = r
+	}
+	return ret, nil
+}
+
+// DeleteResponses deletes the responses for id.
+func (s *KVStore) DeleteResponses(ctx context.Context, id string) error {
+	for _, t := range requestTypes {
+		if err := s.b.Delete(ctx, t+"."+id); err != nil {
+			return fmt.Errorf("deleting %s response: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// RetrieveResponsesByType retrieves the responses of requestType for
+// all enrollments keyed by enrollment ID.
+func (s *KVStore) RetrieveResponsesByType(ctx context.Context, requestType string) (map[string]*Response, error) {
+	prefix := requestType + "."
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*Response, len(keys))
+	for _, k := range keys {
+		v, err := s.b.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return ret, fmt.Errorf("getting response %s: %w", k, err)
+		}
+		r := new(Response)
+		if err = json.Unmarshal(v, r); err != nil {
+			return ret, fmt.Errorf("unmarshal response %s: %w", k, err)
+		}
+		ret[k[len(prefix):]] = r
+	}
+	return ret, nil
+}
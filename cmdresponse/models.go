@@ -0,0 +1,133 @@
+package cmdresponse
+
+import "time"
+
+// DeviceInformation contains common DeviceInformation query responses.
+// See https://developer.apple.com/documentation/devicemanagement/deviceinformationresponse/queryresponses
+type DeviceInformation struct {
+	UDID                       string   `plist:",omitempty" json:"udid,omitempty"`
+	DeviceName                 string   `plist:",omitempty" json:"device_name,omitempty"`
+	SerialNumber               string   `plist:",omitempty" json:"serial_number,omitempty"`
+	Model                      string   `plist:",omitempty" json:"model,omitempty"`
+	ModelName                  string   `plist:",omitempty" json:"model_name,omitempty"`
+	ProductName                string   `plist:",omitempty" json:"product_name,omitempty"`
+	OSVersion                  string   `plist:",omitempty" json:"os_version,omitempty"`
+	BuildVersion               string   `plist:",omitempty" json:"build_version,omitempty"`
+	SupplementalOSVersionExtra string   `plist:",omitempty" json:"supplemental_os_version_extra,omitempty"`
+	DeviceCapacity             float64  `plist:",omitempty" json:"device_capacity,omitempty"`
+	AvailableDeviceCapacity    float64  `plist:",omitempty" json:"available_device_capacity,omitempty"`
+	BatteryLevel               float64  `plist:",omitempty" json:"battery_level,omitempty"`
+	IsSupervised               bool     `plist:",omitempty" json:"is_supervised,omitempty"`
+	IsActivationLockEnabled    bool     `plist:",omitempty" json:"is_activation_lock_enabled,omitempty"`
+	IsMDMLostModeEnabled       bool     `plist:",omitempty" json:"is_mdm_lost_mode_enabled,omitempty"`
+	IsAppleSilicon             bool     `plist:",omitempty" json:"is_apple_silicon,omitempty"`
+	WiFiMAC                    string   `plist:",omitempty" json:"wifi_mac,omitempty"`
+	BluetoothMAC               string   `plist:",omitempty" json:"bluetooth_mac,omitempty"`
+	EthernetMACs               []string `plist:",omitempty" json:"ethernet_macs,omitempty"`
+	IMEI                       string   `plist:",omitempty" json:"imei,omitempty"`
+	MEID                       string   `plist:",omitempty" json:"meid,omitempty"`
+}
+
+// FirewallSettings contains the macOS firewall settings of SecurityInfo.
+type FirewallSettings struct {
+	FirewallEnabled  bool `plist:",omitempty" json:"firewall_enabled"`
+	BlockAllIncoming bool `plist:",omitempty" json:"block_all_incoming"`
+	StealthMode      bool `plist:",omitempty" json:"stealth_mode"`
+}
+
+// FirmwarePasswordStatus contains the macOS firmware password status of SecurityInfo.
+type FirmwarePasswordStatus struct {
+	PasswordExists bool `plist:",omitempty" json:"password_exists"`
+	ChangePending  bool `plist:",omitempty" json:"change_pending"`
+	AllowOroms     bool `plist:",omitempty" json:"allow_oroms"`
+}
+
+// ManagementStatus contains the enrollment status of SecurityInfo.
+type ManagementStatus struct {
+	EnrolledViaDEP         bool `plist:",omitempty" json:"enrolled_via_dep"`
+	UserApprovedEnrollment bool `plist:",omitempty" json:"user_approved_enrollment"`
+	IsUserEnrollment       bool `plist:",omitempty" json:"is_user_enrollment"`
+}
+
+// SecureBoot contains the secure boot settings of SecurityInfo.
+type SecureBoot struct {
+	SecureBootLevel   string `plist:",omitempty" json:"secure_boot_level,omitempty"`
+	ExternalBootLevel string `plist:",omitempty" json:"external_boot_level,omitempty"`
+}
+
+// SecurityInfo contains common SecurityInfo responses.
+// See https://developer.apple.com/documentation/devicemanagement/securityinforesponse/securityinfo
+type SecurityInfo struct {
+	HardwareEncryptionCaps           int                     `plist:",omitempty" json:"hardware_encryption_caps,omitempty"`
+	PasscodePresent                  bool                    `plist:",omitempty" json:"passcode_present"`
+	PasscodeCompliant                bool                    `plist:",omitempty" json:"passcode_compliant"`
+	PasscodeCompliantWithProfiles    bool                    `plist:",omitempty" json:"passcode_compliant_with_profiles"`
+	FDEEnabled                       bool                    `plist:"FDE_Enabled,omitempty" json:"fde_enabled"`
+	FDEHasPersonalRecoveryKey        bool                    `plist:"FDE_HasPersonalRecoveryKey,omitempty" json:"fde_has_personal_recovery_key"`
+	FDEHasInstitutionalRecoveryKey   bool                    `plist:"FDE_HasInstitutionalRecoveryKey,omitempty" json:"fde_has_institutional_recovery_key"`
+	SystemIntegrityProtectionEnabled bool                    `plist:",omitempty" json:"system_integrity_protection_enabled"`
+	AuthenticatedRootVolumeEnabled   bool                    `plist:",omitempty" json:"authenticated_root_volume_enabled"`
+	IsRecoveryLockEnabled            bool                    `plist:",omitempty" json:"is_recovery_lock_enabled"`
+	FirewallSettings                 *FirewallSettings       `plist:",omitempty" json:"firewall_settings,omitempty"`
+	FirmwarePasswordStatus           *FirmwarePasswordStatus `plist:",omitempty" json:"firmware_password_status,omitempty"`
+	ManagementStatus                 *ManagementStatus       `plist:",omitempty" json:"management_status,omitempty"`
+	SecureBoot                       *SecureBoot             `plist:",omitempty" json:"secure_boot,omitempty"`
+}
+
+// ProfilePayload is a payload of an installed profile.
+type ProfilePayload struct {
+	PayloadIdentifier  string `plist:",omitempty" json:"payload_identifier,omitempty"`
+	PayloadType        string `plist:",omitempty" json:"payload_type,omitempty"`
+	PayloadDisplayName string `plist:",omitempty" json:"payload_display_name,omitempty"`
+	PayloadVersion     int    `plist:",omitempty" json:"payload_version,omitempty"`
+}
+
+// Profile is an installed profile of a ProfileList response.
+// See https://developer.apple.com/documentation/devicemanagement/profilelistresponse/profilelistitem
+type Profile struct {
+	PayloadIdentifier        string           `plist:",omitempty" json:"payload_identifier"`
+	PayloadUUID              string           `plist:",omitempty" json:"payload_uuid,omitempty"`
+	PayloadDisplayName       string           `plist:",omitempty" json:"payload_display_name,omitempty"`
+	PayloadDescription       string           `plist:",omitempty" json:"payload_description,omitempty"`
+	PayloadOrganization      string           `plist:",omitempty" json:"payload_organization,omitempty"`
+	PayloadVersion           int              `plist:",omitempty" json:"payload_version,omitempty"`
+	PayloadRemovalDisallowed bool             `plist:",omitempty" json:"payload_removal_disallowed,omitempty"`
+	HasRemovalPasscode       bool             `plist:",omitempty" json:"has_removal_passcode,omitempty"`
+	IsEncrypted              bool             `plist:",omitempty" json:"is_encrypted,omitempty"`
+	IsManaged                bool             `plist:",omitempty" json:"is_managed,omitempty"`
+	PayloadContent           []ProfilePayload `plist:",omitempty" json:"payload_content,omitempty"`
+}
+
+// Application is an installed application of an InstalledApplicationList response.
+// See https://developer.apple.com/documentation/devicemanagement/installedapplicationlistresponse/installedapplicationlistitem
+type Application struct {
+	Identifier         string `plist:",omitempty" json:"identifier,omitempty"`
+	Name               string `plist:",omitempty" json:"name,omitempty"`
+	ShortVersion       string `plist:",omitempty" json:"short_version,omitempty"`
+	Version            string `plist:",omitempty" json:"version,omitempty"`
+	BundleSize         int64  `plist:",omitempty" json:"bundle_size,omitempty"`
+	DynamicSize        int64  `plist:",omitempty" json:"dynamic_size,omitempty"`
+	IsValidated        bool   `plist:",omitempty" json:"is_validated,omitempty"`
+	Installing         bool   `plist:",omitempty" json:"installing,omitempty"`
+	AppStoreVendable   bool   `plist:",omitempty" json:"app_store_vendable,omitempty"`
+	DeviceBasedVPP     bool   `plist:",omitempty" json:"device_based_vpp,omitempty"`
+	BetaApp            bool   `plist:",omitempty" json:"beta_app,omitempty"`
+	AdHocCodeSigned    bool   `plist:",omitempty" json:"ad_hoc_code_signed,omitempty"`
+	HasUpdateAvailable bool   `plist:",omitempty" json:"has_update_available,omitempty"`
+}
+
+// OSUpdate is an available OS update of an AvailableOSUpdates response.
+// See https://developer.apple.com/documentation/devicemanagement/availableosupdate
+type OSUpdate struct {
+	ProductKey         string     `plist:",omitempty" json:"product_key,omitempty"`
+	HumanReadableName  string     `plist:",omitempty" json:"human_readable_name,omitempty"`
+	ProductName        string     `plist:",omitempty" json:"product_name,omitempty"`
+	Version            string     `plist:",omitempty" json:"version,omitempty"`
+	Build              string     `plist:",omitempty" json:"build,omitempty"`
+	DeferredUntil      *time.Time `plist:",omitempty" json:"deferred_until,omitempty"`
+	IsCritical         bool       `plist:",omitempty" json:"is_critical,omitempty"`
+	IsMajorOSUpdate    bool       `plist:",omitempty" json:"is_major_os_update,omitempty"`
+	IsSecurityResponse bool       `plist:",omitempty" json:"is_security_response,omitempty"`
+	RestartRequired    bool       `plist:",omitempty" json:"restart_required,omitempty"`
+	AllowsInstallLater bool       `plist:",omitempty" json:"allows_install_later,omitempty"`
+}
@@ -0,0 +1,89 @@
+package cmdresponse
+
+import (
+	"context"
+	"errors"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Store stores the latest decoded command responses of enrollments.
+type Store interface {
+	// StoreResponse stores (replaces) the response of its request type for id.
+	StoreResponse(ctx context.Context, id string, r *Response) error
+
+	// RetrieveResponses retrieves the latest responses for id keyed by request type.
+	RetrieveResponses(ctx context.Context, id string) (map[string]*Response, error)
+}
+
+// Service is a NanoMDM service that stores decoded command responses.
+type Service struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the service.
+type Option func(*Service)
+
+// WithClock configures the clock used for response receipt times.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// NewService creates a new service that stores decoded command responses in store.
+func NewService(store Store, logger log.Logger, opts ...Option) *Service {
+	if store == nil {
+		panic("nil store")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	s := &Service{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		logger:                   logger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// CommandAndReportResults decodes and stores supported acknowledged command responses.
+// Decoding and storage errors are logged but not returned to the MDM client.
+func (s *Service) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results.Status != "Acknowledged" {
+		return nil, nil
+	}
+	logger := ctxlog.Logger(r.Context(), s.logger)
+
+	resp, err := Decode(results.Raw)
+	if errors.Is(err, ErrUnknownResponse) {
+		return nil, nil
+	} else if err != nil {
+		logger.Info("msg", "decoding command response", "command_uuid", results.CommandUUID, "err", err)
+		return nil, nil
+	}
+	resp.ReceivedAt = s.clock.Now()
+
+	if err = s.store.StoreResponse(r.Context(), r.ID, resp); err != nil {
+		logger.Info("msg", "storing command response", "command_uuid", results.CommandUUID, "err", err)
+		return nil, nil
+	}
+	logger.Debug("msg", "stored command response", "request_type", resp.RequestType, "command_uuid", resp.CommandUUID)
+	return nil, nil
+}
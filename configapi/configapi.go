@@ -0,0 +1,282 @@
+// Package configapi provides declarative management of NanoHUB
+// configuration for infrastructure-as-code tools.
+//
+// Resources (declarations, sets, webhooks, and workflow schedules) are
+// identified by stable IDs and are replaced as a whole by idempotent
+// PUTs. Every resource has a content hash of its configuration so
+// tools can detect drift without comparing the configuration itself.
+package configapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+var (
+	// ErrNotFound is returned when a resource does not exist.
+	ErrNotFound = errors.New("resource not found")
+
+	// ErrInvalid is returned for invalid resources.
+	ErrInvalid = errors.New("invalid resource")
+
+	// ErrIDMismatch is returned when the ID of a resource differs from
+	// the ID it is stored as.
+	ErrIDMismatch = errors.New("resource ID mismatch")
+)
+
+// Resource is the state of a resource after a change.
+type Resource struct {
+	ID   string `json:"id"`
+	Hash string `json:"hash"`
+
+	// Changed reports whether the change modified the resource.
+	Changed bool `json:"changed"`
+}
+
+// hashJSON returns the hex SHA-256 hash of the canonical JSON encoding
+// of the JSON document raw. Object keys are sorted and insignificant
+// whitespace is removed so equal documents have equal hashes.
+func hashJSON(raw []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(canonical)), nil
+}
+
+// hash returns the content hash of v.
+func hash(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return hashJSON(b)
+}
+
+// DMStore stores declarations and set declarations.
+type DMStore interface {
+	StoreDeclaration(ctx context.Context, d *ddm.Declaration) (bool, error)
+	RetrieveDeclaration(ctx context.Context, declarationID string) (*ddm.Declaration, error)
+	DeleteDeclaration(ctx context.Context, declarationID string) (bool, error)
+	RetrieveDeclarations(ctx context.Context) ([]string, error)
+	RetrieveSetDeclarations(ctx context.Context, setName string) ([]string, error)
+	StoreSetDeclaration(ctx context.Context, setName, declarationID string) (bool, error)
+	RemoveSetDeclaration(ctx context.Context, setName, declarationID string) (bool, error)
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// Declaration is a declaration resource.
+type Declaration struct {
+	ID          string          `json:"id"`
+	Hash        string          `json:"hash"`
+	Declaration json.RawMessage `json:"declaration"`
+}
+
+// Set is a set resource.
+type Set struct {
+	ID   string `json:"id,omitempty"`
+	Hash string `json:"hash,omitempty"`
+
+	// Declarations are the declaration identifiers of the set.
+	Declarations []string `json:"declarations"`
+}
+
+// DM manages declarations and sets.
+// Enrollments affected by changes are notified.
+type DM struct {
+	store    DMStore
+	notifier Notifier
+}
+
+// NewDM creates a new declaration and set manager.
+func NewDM(store DMStore, notifier Notifier) *DM {
+	if store == nil {
+		panic("nil store")
+	}
+	if notifier == nil {
+		panic("nil notifier")
+	}
+	return &DM{store: store, notifier: notifier}
+}
+
+// PutDeclaration stores the declaration JSON raw as declaration id.
+func (m *DM) PutDeclaration(ctx context.Context, id string, raw []byte) (*Resource, error) {
+	d, err := ddm.ParseDeclaration(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing declaration: %v", ErrInvalid, err)
+	}
+	if !d.Valid() {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, ddm.ErrInvalidDeclaration)
+	}
+	if d.Identifier != id {
+		return nil, fmt.Errorf("%w: %s", ErrIDMismatch, d.Identifier)
+	}
+	res := &Resource{ID: id}
+	if res.Hash, err = hashJSON(raw); err != nil {
+		return nil, fmt.Errorf("hashing declaration: %w", err)
+	}
+	if res.Changed, err = m.store.StoreDeclaration(ctx, d); err != nil {
+		return nil, fmt.Errorf("storing declaration: %w", err)
+	}
+	if res.Changed {
+		if err = m.notifier.Changed(ctx, []string{id}, nil, nil); err != nil {
+			return res, fmt.Errorf("notifying: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// exists reports whether declaration id exists.
+func (m *DM) exists(ctx context.Context, id string) (bool, error) {
+	ids, err := m.store.RetrieveDeclarations(ctx)
+	if err != nil {
+		return false, fmt.Errorf("retrieving declarations: %w", err)
+	}
+	for _, v := range ids {
+		if v == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Declaration retrieves declaration id.
+func (m *DM) Declaration(ctx context.Context, id string) (*Declaration, error) {
+	d, err := m.store.RetrieveDeclaration(ctx, id)
+	if err != nil || d == nil {
+		// missing declarations are reported as errors by some backends
+		if ok, existsErr := m.exists(ctx, id); existsErr != nil {
+			return nil, existsErr
+		} else if !ok {
+			return nil, ErrNotFound
+		}
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, fmt.Errorf("retrieving declaration: %w", err)
+	}
+	raw := d.Raw
+	if len(raw) < 1 {
+		if raw, err = json.Marshal(d); err != nil {
+			return nil, fmt.Errorf("marshal declaration: %w", err)
+		}
+	}
+	decl := &Declaration{ID: id, Declaration: raw}
+	if decl.Hash, err = hashJSON(raw); err != nil {
+		return nil, fmt.Errorf("hashing declaration: %w", err)
+	}
+	return decl, nil
+}
+
+// DeleteDeclaration deletes declaration id.
+// Deleting a declaration that does not exist is not an error.
+func (m *DM) DeleteDeclaration(ctx context.Context, id string) (*Resource, error) {
+	ok, err := m.exists(ctx, id)
+	if err != nil || !ok {
+		return &Resource{ID: id}, err
+	}
+	res := &Resource{ID: id}
+	if res.Changed, err = m.store.DeleteDeclaration(ctx, id); err != nil {
+		return nil, fmt.Errorf("deleting declaration: %w", err)
+	}
+	return res, nil
+}
+
+// setHash returns the content hash of the declarations of a set.
+func setHash(declarations []string) (string, error) {
+	sorted := append([]string{}, declarations...)
+	sort.Strings(sorted)
+	return hash(sorted)
+}
+
+// PutSet makes declarations the declarations of set name.
+// Declarations not listed are removed from the set.
+func (m *DM) PutSet(ctx context.Context, name string, declarations []string) (*Resource, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("%w: set name: %q", ErrInvalid, name)
+	}
+	current, err := m.store.RetrieveSetDeclarations(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving set declarations: %w", err)
+	}
+	want := make(map[string]bool, len(declarations))
+	for _, id := range declarations {
+		want[id] = true
+	}
+	res := &Resource{ID: name}
+	if res.Hash, err = setHash(declarations); err != nil {
+		return nil, fmt.Errorf("hashing set: %w", err)
+	}
+
+	for _, id := range current {
+		if want[id] {
+			delete(want, id)
+			continue
+		}
+		changed, err := m.store.RemoveSetDeclaration(ctx, name, id)
+		if err != nil {
+			return nil, fmt.Errorf("removing declaration %s: %w", id, err)
+		}
+		res.Changed = res.Changed || changed
+	}
+	for _, id := range declarations {
+		if !want[id] {
+			continue
+		}
+		delete(want, id)
+		changed, err := m.store.StoreSetDeclaration(ctx, name, id)
+		if err != nil {
+			return nil, fmt.Errorf("adding declaration %s: %w", id, err)
+		}
+		res.Changed = res.Changed || changed
+	}
+
+	if res.Changed {
+		if err = m.notifier.Changed(ctx, nil, []string{name}, nil); err != nil {
+			return res, fmt.Errorf("notifying: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// Set retrieves set name.
+func (m *DM) Set(ctx context.Context, name string) (*Set, error) {
+	declarations, err := m.store.RetrieveSetDeclarations(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving set declarations: %w", err)
+	}
+	if len(declarations) < 1 {
+		// sets only exist with declarations
+		return nil, ErrNotFound
+	}
+	sort.Strings(declarations)
+	set := &Set{ID: name, Declarations: declarations}
+	if set.Hash, err = setHash(declarations); err != nil {
+		return nil, fmt.Errorf("hashing set: %w", err)
+	}
+	return set, nil
+}
+
+// DeleteSet removes all declarations from set name.
+func (m *DM) DeleteSet(ctx context.Context, name string) (*Resource, error) {
+	res, err := m.PutSet(ctx, name, nil)
+	if res != nil {
+		res.Hash = ""
+	}
+	return res, err
+}
@@ -0,0 +1,108 @@
+package configapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	w := NewWebhooks(NewKVStore(kvmap.New()), nil)
+
+	put := func() *Resource {
+		t.Helper()
+		res, err := w.Put(ctx, "wh1", &event.ActionConfig{URL: "http://localhost/hook", Events: []string{"Enrollment"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	first, second := put(), put()
+	if !first.Changed || second.Changed {
+		t.Errorf("changed: have: %v, %v, want: true, false", first.Changed, second.Changed)
+	}
+	if first.Hash != second.Hash {
+		t.Errorf("hash: have: %v, want: %v", second.Hash, first.Hash)
+	}
+
+	if _, err := w.Put(ctx, "wh2", &event.ActionConfig{Name: "other", URL: "http://localhost"}); !errors.Is(err, ErrIDMismatch) {
+		t.Errorf("have: %v, want: %v", err, ErrIDMismatch)
+	}
+
+	if res, err := w.Delete(ctx, "wh1"); err != nil || !res.Changed {
+		t.Fatalf("delete: %v, %v", res, err)
+	}
+	if res, err := w.Delete(ctx, "wh1"); err != nil || res.Changed {
+		t.Fatalf("repeated delete: %v, %v", res, err)
+	}
+	if _, err := w.Get(ctx, "wh1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("have: %v, want: %v", err, ErrNotFound)
+	}
+}
+
+type starter []string
+
+func (s *starter) StartWorkflow(_ context.Context, name string, _ []byte, _ []string, _ *workflow.Event, _ *workflow.MDMContext) (string, error) {
+	*s = append(*s, name)
+	return "", nil
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	started := new(starter)
+	s := NewScheduler(NewKVStore(kvmap.New()), started, WithClock(c))
+
+	if _, err := s.Put(ctx, "s1", &Schedule{Workflow: "wf1", IDs: []string{"ID1"}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalid)
+	}
+	if _, err := s.Put(ctx, "s1", &Schedule{Workflow: "wf1", IDs: []string{"ID1"}, Interval: 3600}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, advance := range []time.Duration{0, time.Minute, time.Hour} {
+		c.Advance(advance)
+		if err := s.RunDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have, want := len(*started), 2; have != want {
+		t.Errorf("started: have: %v, want: %v", have, want)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC))
+	started := new(starter)
+	s := NewScheduler(NewKVStore(kvmap.New()), started, WithClock(c))
+
+	if _, err := s.Put(ctx, "s1", &Schedule{Workflow: "wf1", IDs: []string{"ID1"}, Interval: 3600, Cron: "@daily"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalid)
+	}
+	if _, err := s.Put(ctx, "s1", &Schedule{Workflow: "wf1", Sets: []string{"set1"}, Cron: "0 2 * * *"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("sets: have: %v, want: %v", err, ErrInvalid)
+	}
+	if _, err := s.Put(ctx, "s1", &Schedule{Workflow: "wf1", IDs: []string{"ID1"}, Cron: "0 2 * * *"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// not started when first seen, then at 02:00 each day
+	for _, advance := range []time.Duration{0, time.Hour, time.Hour, time.Hour, 24 * time.Hour} {
+		c.Advance(advance)
+		if err := s.RunDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have, want := len(*started), 2; have != want {
+		t.Errorf("started: have: %v, want: %v", have, want)
+	}
+}
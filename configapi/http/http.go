@@ -0,0 +1,248 @@
+// Package http provides the HTTP API for declarative configuration.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/micromdm/nanohub/configapi"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no resource ID is provided.
+var ErrNoID = errors.New("no resource ID provided")
+
+// errStatus returns the HTTP status code for err.
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, configapi.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, configapi.ErrInvalid), errors.Is(err, configapi.ErrIDMismatch):
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// writeResource writes v as JSON with hash as the ETag.
+func writeResource(w http.ResponseWriter, v interface{}, hash string, logger log.Logger) {
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+	httpapi.WriteJSON(w, v, logger)
+}
+
+// handler adapts a function returning a resource to an HTTP handler.
+// The resource ID is taken from the URL path.
+func handler(logger log.Logger, action string, fn func(r *http.Request, id string) (interface{}, string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		v, hash, err := fn(r, id)
+		if err != nil {
+			status := errStatus(err)
+			if status == 0 {
+				logger.Info("msg", action, "id", id, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		if res, ok := v.(*configapi.Resource); ok && res.Changed {
+			logger.Debug("msg", action, "id", id, "hash", res.Hash)
+		}
+		writeResource(w, v, hash, logger)
+	}
+}
+
+// decode decodes the JSON request body into v.
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: decoding body: %v", configapi.ErrInvalid, err)
+	}
+	return nil
+}
+
+// handleDM registers the declaration and set handlers.
+func handleDM(prefix string, mux httpapi.Mux, logger log.Logger, dm *configapi.DM) {
+	mux.Handle(
+		prefix+"/config/declarations/:id",
+		handler(logger.With("handler", "get-config-declaration"), "retrieving declaration", func(r *http.Request, id string) (interface{}, string, error) {
+			d, err := dm.Declaration(r.Context(), id)
+			if err != nil {
+				return nil, "", err
+			}
+			return d, d.Hash, nil
+		}),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/config/declarations/:id",
+		handler(logger.With("handler", "put-config-declaration"), "storing declaration", func(r *http.Request, id string) (interface{}, string, error) {
+			raw, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, "", fmt.Errorf("reading body: %w", err)
+			}
+			res, err := dm.PutDeclaration(r.Context(), id, raw)
+			if err != nil {
+				return nil, "", err
+			}
+			return res, res.Hash, nil
+		}),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/config/declarations/:id",
+		handler(logger.With("handler", "delete-config-declaration"), "deleting declaration", func(r *http.Request, id string) (interface{}, string, error) {
+			res, err := dm.DeleteDeclaration(r.Context(), id)
+			return res, "", err
+		}),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/config/sets/:id",
+		handler(logger.With("handler", "get-config-set"), "retrieving set", func(r *http.Request, id string) (interface{}, string, error) {
+			set, err := dm.Set(r.Context(), id)
+			if err != nil {
+				return nil, "", err
+			}
+			return set, set.Hash, nil
+		}),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/config/sets/:id",
+		handler(logger.With("handler", "put-config-set"), "storing set", func(r *http.Request, id string) (interface{}, string, error) {
+			set := new(configapi.Set)
+			if err := decode(r, set); err != nil {
+				return nil, "", err
+			}
+			res, err := dm.PutSet(r.Context(), id, set.Declarations)
+			if err != nil {
+				return nil, "", err
+			}
+			return res, res.Hash, nil
+		}),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/config/sets/:id",
+		handler(logger.With("handler", "delete-config-set"), "deleting set", func(r *http.Request, id string) (interface{}, string, error) {
+			res, err := dm.DeleteSet(r.Context(), id)
+			return res, "", err
+		}),
+		"DELETE",
+	)
+}
+
+// handleWebhooks registers the webhook handlers.
+func handleWebhooks(prefix string, mux httpapi.Mux, logger log.Logger, webhooks *configapi.Webhooks) {
+	mux.Handle(
+		prefix+"/config/webhooks/:id",
+		handler(logger.With("handler", "get-config-webhook"), "retrieving webhook", func(r *http.Request, id string) (interface{}, string, error) {
+			wh, err := webhooks.Get(r.Context(), id)
+			if err != nil {
+				return nil, "", err
+			}
+			return wh, wh.Hash, nil
+		}),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/config/webhooks/:id",
+		handler(logger.With("handler", "put-config-webhook"), "storing webhook", func(r *http.Request, id string) (interface{}, string, error) {
+			c := new(event.ActionConfig)
+			if err := decode(r, c); err != nil {
+				return nil, "", err
+			}
+			res, err := webhooks.Put(r.Context(), id, c)
+			if err != nil {
+				return nil, "", err
+			}
+			return res, res.Hash, nil
+		}),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/config/webhooks/:id",
+		handler(logger.With("handler", "delete-config-webhook"), "deleting webhook", func(r *http.Request, id string) (interface{}, string, error) {
+			res, err := webhooks.Delete(r.Context(), id)
+			return res, "", err
+		}),
+		"DELETE",
+	)
+}
+
+// handleSchedules registers the workflow schedule handlers.
+func handleSchedules(prefix string, mux httpapi.Mux, logger log.Logger, scheduler *configapi.Scheduler) {
+	mux.Handle(
+		prefix+"/config/schedules/:id",
+		handler(logger.With("handler", "get-config-schedule"), "retrieving schedule", func(r *http.Request, id string) (interface{}, string, error) {
+			sch, err := scheduler.Get(r.Context(), id)
+			if err != nil {
+				return nil, "", err
+			}
+			return sch, sch.Hash, nil
+		}),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/config/schedules/:id",
+		handler(logger.With("handler", "put-config-schedule"), "storing schedule", func(r *http.Request, id string) (interface{}, string, error) {
+			sch := new(configapi.Schedule)
+			if err := decode(r, sch); err != nil {
+				return nil, "", err
+			}
+			res, err := scheduler.Put(r.Context(), id, sch)
+			if err != nil {
+				return nil, "", err
+			}
+			return res, res.Hash, nil
+		}),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/config/schedules/:id",
+		handler(logger.With("handler", "delete-config-schedule"), "deleting schedule", func(r *http.Request, id string) (interface{}, string, error) {
+			res, err := scheduler.Delete(r.Context(), id)
+			return res, "", err
+		}),
+		"DELETE",
+	)
+}
+
+// HandleAPIv1 registers the declarative configuration API handlers into mux.
+// Handlers are only registered for the non-nil managers.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, dm *configapi.DM, webhooks *configapi.Webhooks, scheduler *configapi.Scheduler) {
+	if dm != nil {
+		handleDM(prefix, mux, logger, dm)
+	}
+	if webhooks != nil {
+		handleWebhooks(prefix, mux, logger, webhooks)
+	}
+	if scheduler != nil {
+		handleSchedules(prefix, mux, logger, scheduler)
+	}
+}
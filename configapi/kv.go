@@ -0,0 +1,161 @@
+package configapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPfxWebhook  = "webhook."
+	keyPfxSchedule = "schedule."
+	keyPfxLastRun  = "lastrun."
+)
+
+// KVStore stores webhooks and schedules in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new webhook and schedule store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// get unmarshals the JSON value of key into v.
+// False is returned if key does not exist.
+func (s *KVStore) get(ctx context.Context, key string, v interface{}) (bool, error) {
+	b, err := s.b.Get(ctx, key)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("unmarshal %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// set marshals v to JSON and sets it as the value of key.
+func (s *KVStore) set(ctx context.Context, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	return s.b.Set(ctx, key, b)
+}
+
+// keys returns the keys with prefix without the prefix.
+func (s *KVStore) keys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	for i := range keys {
+		keys[i] = keys[i][len(prefix):]
+	}
+	return keys, nil
+}
+
+// StoreWebhook stores c.
+func (s *KVStore) StoreWebhook(ctx context.Context, c *event.ActionConfig) error {
+	if c == nil || c.Name == "" {
+		return errors.New("invalid webhook")
+	}
+	return s.set(ctx, keyPfxWebhook+c.Name, c)
+}
+
+// RetrieveWebhook retrieves webhook name.
+func (s *KVStore) RetrieveWebhook(ctx context.Context, name string) (*event.ActionConfig, error) {
+	c := new(event.ActionConfig)
+	if ok, err := s.get(ctx, keyPfxWebhook+name, c); !ok {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RetrieveWebhooks retrieves all webhooks.
+func (s *KVStore) RetrieveWebhooks(ctx context.Context) ([]*event.ActionConfig, error) {
+	names, err := s.keys(ctx, keyPfxWebhook)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []*event.ActionConfig
+	for _, name := range names {
+		c, err := s.RetrieveWebhook(ctx, name)
+		if err != nil {
+			return webhooks, err
+		} else if c != nil {
+			webhooks = append(webhooks, c)
+		}
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes webhook name.
+func (s *KVStore) DeleteWebhook(ctx context.Context, name string) error {
+	return s.b.Delete(ctx, keyPfxWebhook+name)
+}
+
+// StoreSchedule stores sch.
+func (s *KVStore) StoreSchedule(ctx context.Context, sch *Schedule) error {
+	if sch == nil || sch.Name == "" {
+		return errors.New("invalid schedule")
+	}
+	return s.set(ctx, keyPfxSchedule+sch.Name, sch)
+}
+
+// RetrieveSchedule retrieves schedule name.
+func (s *KVStore) RetrieveSchedule(ctx context.Context, name string) (*Schedule, error) {
+	sch := new(Schedule)
+	if ok, err := s.get(ctx, keyPfxSchedule+name, sch); !ok {
+		return nil, err
+	}
+	return sch, nil
+}
+
+// RetrieveSchedules retrieves all schedules.
+func (s *KVStore) RetrieveSchedules(ctx context.Context) ([]*Schedule, error) {
+	names, err := s.keys(ctx, keyPfxSchedule)
+	if err != nil {
+		return nil, err
+	}
+	var schedules []*Schedule
+	for _, name := range names {
+		sch, err := s.RetrieveSchedule(ctx, name)
+		if err != nil {
+			return schedules, err
+		} else if sch != nil {
+			schedules = append(schedules, sch)
+		}
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule deletes schedule name and when it last ran.
+func (s *KVStore) DeleteSchedule(ctx context.Context, name string) error {
+	if err := s.b.Delete(ctx, keyPfxLastRun+name); err != nil {
+		return err
+	}
+	return s.b.Delete(ctx, keyPfxSchedule+name)
+}
+
+// StoreLastRun stores when schedule name last ran.
+func (s *KVStore) StoreLastRun(ctx context.Context, name string, t time.Time) error {
+	return s.set(ctx, keyPfxLastRun+name, t)
+}
+
+// RetrieveLastRun retrieves when schedule name last ran.
+func (s *KVStore) RetrieveLastRun(ctx context.Context, name string) (t time.Time, err error) {
+	_, err = s.get(ctx, keyPfxLastRun+name, &t)
+	return
+}
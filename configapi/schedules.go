@@ -0,0 +1,373 @@
+package configapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cron"
+
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Schedule starts a workflow for enrollments every interval or at the
+// times of a cron expression.
+type Schedule struct {
+	Name     string   `json:"name"`
+	Workflow string   `json:"workflow"`
+	IDs      []string `json:"ids"`
+
+	// Sets are DM sets whose enrollments the workflow is started for.
+	// The members are looked up every time the workflow starts.
+	Sets []string `json:"sets,omitempty"`
+
+	// Context is the optional workflow context.
+	Context string `json:"context,omitempty"`
+
+	// Interval is the time between workflow starts in seconds.
+	Interval int `json:"interval"`
+
+	// Cron is a cron expression of the workflow start times (in UTC).
+	// Either Interval or Cron is required.
+	Cron string `json:"cron,omitempty"`
+
+	// Disabled schedules don't start workflows.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// Validate checks s.
+func (s *Schedule) Validate() error {
+	switch {
+	case s.Workflow == "":
+		return fmt.Errorf("%w: schedule: no workflow", ErrInvalid)
+	case len(s.IDs) < 1 && len(s.Sets) < 1:
+		return fmt.Errorf("%w: schedule: no enrollment IDs or sets", ErrInvalid)
+	case s.Cron != "" && s.Interval != 0:
+		return fmt.Errorf("%w: schedule: both interval and cron", ErrInvalid)
+	case s.Cron != "":
+		if _, err := cron.Parse(s.Cron); err != nil {
+			return fmt.Errorf("%w: schedule: %v", ErrInvalid, err)
+		}
+	case s.Interval < 60:
+		return fmt.Errorf("%w: schedule: interval less than 60 seconds", ErrInvalid)
+	}
+	return nil
+}
+
+// due reports whether s is due at now after it last ran at lastRun.
+func (s *Schedule) due(now, lastRun time.Time) (bool, error) {
+	if s.Cron == "" {
+		return lastRun.IsZero() || now.Sub(lastRun) >= time.Duration(s.Interval)*time.Second, nil
+	}
+	c, err := cron.Parse(s.Cron)
+	if err != nil {
+		return false, err
+	}
+	next := c.Next(lastRun.UTC())
+	return !next.IsZero() && !next.After(now), nil
+}
+
+// ScheduleStore stores schedules and when they last ran.
+type ScheduleStore interface {
+	StoreSchedule(ctx context.Context, s *Schedule) error
+
+	// RetrieveSchedule retrieves schedule name.
+	// Nil is returned if the schedule does not exist.
+	RetrieveSchedule(ctx context.Context, name string) (*Schedule, error)
+
+	RetrieveSchedules(ctx context.Context) ([]*Schedule, error)
+	DeleteSchedule(ctx context.Context, name string) error
+
+	StoreLastRun(ctx context.Context, name string, t time.Time) error
+
+	// RetrieveLastRun retrieves when schedule name last ran.
+	// The zero time is returned if it never ran.
+	RetrieveLastRun(ctx context.Context, name string) (time.Time, error)
+}
+
+// WorkflowStarter starts workflows.
+type WorkflowStarter interface {
+	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+}
+
+// IDResolver resolves identifiers (such as "group:<name>") to enrollment IDs.
+type IDResolver interface {
+	Resolve(ctx context.Context, ids []string) ([]string, bool, error)
+}
+
+// SetEnrollmentRetriever retrieves the enrollment IDs of DM sets.
+type SetEnrollmentRetriever interface {
+	RetrieveEnrollmentIDs(ctx context.Context, declarations []string, sets []string, ids []string) ([]string, error)
+}
+
+// registry reports whether workflows are registered.
+type registry interface {
+	WorkflowRegistered(name string) bool
+}
+
+// ScheduleResource is a schedule resource.
+type ScheduleResource struct {
+	ID       string    `json:"id"`
+	Hash     string    `json:"hash"`
+	Schedule *Schedule `json:"schedule"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+}
+
+// Scheduler manages schedules and starts their workflows.
+type Scheduler struct {
+	store    ScheduleStore
+	starter  WorkflowStarter
+	resolver IDResolver
+	sets     SetEnrollmentRetriever
+	logger   log.Logger
+	clock    clock.Clock
+}
+
+// Option configures the scheduler.
+type Option func(*Scheduler)
+
+// WithLogger configures a logger for the scheduler.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Scheduler) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the scheduler.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// WithResolver resolves the enrollment IDs of schedules with r every
+// time their workflows start.
+func WithResolver(r IDResolver) Option {
+	if r == nil {
+		panic("nil resolver")
+	}
+	return func(s *Scheduler) {
+		s.resolver = r
+	}
+}
+
+// WithSets enables schedules for the enrollments of DM sets.
+func WithSets(sets SetEnrollmentRetriever) Option {
+	if sets == nil {
+		panic("nil sets")
+	}
+	return func(s *Scheduler) {
+		s.sets = sets
+	}
+}
+
+// NewScheduler creates a new scheduler.
+func NewScheduler(store ScheduleStore, starter WorkflowStarter, opts ...Option) *Scheduler {
+	if store == nil {
+		panic("nil store")
+	}
+	if starter == nil {
+		panic("nil starter")
+	}
+	s := &Scheduler{
+		store:   store,
+		starter: starter,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Put stores schedule sch as schedule name.
+func (s *Scheduler) Put(ctx context.Context, name string, sch *Schedule) (*Resource, error) {
+	if sch.Name == "" {
+		sch.Name = name
+	} else if sch.Name != name {
+		return nil, fmt.Errorf("%w: %s", ErrIDMismatch, sch.Name)
+	}
+	if err := sch.Validate(); err != nil {
+		return nil, err
+	}
+	if len(sch.Sets) > 0 && s.sets == nil {
+		return nil, fmt.Errorf("%w: schedule: sets not supported", ErrInvalid)
+	}
+	if r, ok := s.starter.(registry); ok && !r.WorkflowRegistered(sch.Workflow) {
+		return nil, fmt.Errorf("%w: schedule: workflow not registered: %s", ErrInvalid, sch.Workflow)
+	}
+	res := &Resource{ID: name}
+	var err error
+	if res.Hash, err = hash(sch); err != nil {
+		return nil, fmt.Errorf("hashing schedule: %w", err)
+	}
+
+	current, err := s.store.RetrieveSchedule(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving schedule: %w", err)
+	}
+	if current != nil {
+		if currentHash, err := hash(current); err == nil && currentHash == res.Hash {
+			return res, nil
+		}
+	}
+
+	if err = s.store.StoreSchedule(ctx, sch); err != nil {
+		return nil, fmt.Errorf("storing schedule: %w", err)
+	}
+	res.Changed = true
+	return res, nil
+}
+
+// Get retrieves schedule name.
+func (s *Scheduler) Get(ctx context.Context, name string) (*ScheduleResource, error) {
+	sch, err := s.store.RetrieveSchedule(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving schedule: %w", err)
+	} else if sch == nil {
+		return nil, ErrNotFound
+	}
+	res := &ScheduleResource{ID: name, Schedule: sch}
+	if res.Hash, err = hash(sch); err != nil {
+		return nil, fmt.Errorf("hashing schedule: %w", err)
+	}
+	if res.LastRun, err = s.store.RetrieveLastRun(ctx, name); err != nil {
+		return nil, fmt.Errorf("retrieving last run: %w", err)
+	}
+	return res, nil
+}
+
+// Delete deletes schedule name.
+// Deleting a schedule that does not exist is not an error.
+func (s *Scheduler) Delete(ctx context.Context, name string) (*Resource, error) {
+	sch, err := s.store.RetrieveSchedule(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving schedule: %w", err)
+	} else if sch == nil {
+		return &Resource{ID: name}, nil
+	}
+	if err = s.store.DeleteSchedule(ctx, name); err != nil {
+		return nil, fmt.Errorf("deleting schedule: %w", err)
+	}
+	return &Resource{ID: name, Changed: true}, nil
+}
+
+// targets returns the enrollment IDs of sch.
+func (s *Scheduler) targets(ctx context.Context, sch *Schedule) ([]string, error) {
+	ids := sch.IDs
+	if s.resolver != nil && len(ids) > 0 {
+		var err error
+		if ids, _, err = s.resolver.Resolve(ctx, ids); err != nil {
+			return nil, fmt.Errorf("resolving IDs: %w", err)
+		}
+	}
+	if len(sch.Sets) < 1 {
+		return ids, nil
+	}
+	if s.sets == nil {
+		return nil, errors.New("sets not supported")
+	}
+	members, err := s.sets.RetrieveEnrollmentIDs(ctx, nil, sch.Sets, nil)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving set enrollments: %w", err)
+	}
+	seen := make(map[string]bool, len(ids)+len(members))
+	var r []string
+	for _, list := range [][]string{ids, members} {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				r = append(r, id)
+			}
+		}
+	}
+	return r, nil
+}
+
+// RunDue starts the workflows of the enabled schedules that are due.
+func (s *Scheduler) RunDue(ctx context.Context) error {
+	logger := ctxlog.Logger(ctx, s.logger)
+	schedules, err := s.store.RetrieveSchedules(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving schedules: %w", err)
+	}
+	now := s.clock.Now()
+	for _, sch := range schedules {
+		if sch.Disabled {
+			continue
+		}
+		lastRun, err := s.store.RetrieveLastRun(ctx, sch.Name)
+		if err != nil {
+			logger.Info("msg", "retrieving last run", "schedule", sch.Name, "err", err)
+			continue
+		}
+		if lastRun.IsZero() && sch.Cron != "" {
+			// first start at the next cron time rather than now
+			if err = s.store.StoreLastRun(ctx, sch.Name, now); err != nil {
+				logger.Info("msg", "storing last run", "schedule", sch.Name, "err", err)
+			}
+			continue
+		}
+		if due, err := sch.due(now, lastRun); err != nil {
+			logger.Info("msg", "checking schedule", "schedule", sch.Name, "err", err)
+			continue
+		} else if !due {
+			continue
+		}
+		// record the run first so failing workflows don't start every tick
+		if err = s.store.StoreLastRun(ctx, sch.Name, now); err != nil {
+			logger.Info("msg", "storing last run", "schedule", sch.Name, "err", err)
+			continue
+		}
+		var wfCtx []byte
+		if sch.Context != "" {
+			wfCtx = []byte(sch.Context)
+		}
+		ids, err := s.targets(ctx, sch)
+		if err != nil {
+			logger.Info("msg", "retrieving targets", "schedule", sch.Name, "err", err)
+			continue
+		} else if len(ids) < 1 {
+			logger.Debug("msg", "no enrollments to start workflow for", "schedule", sch.Name, "workflow", sch.Workflow)
+			continue
+		}
+		instanceID, err := s.starter.StartWorkflow(ctx, sch.Workflow, wfCtx, ids, nil, nil)
+		if err != nil {
+			logger.Info("msg", "starting workflow", "schedule", sch.Name, "workflow", sch.Workflow, "err", err)
+			continue
+		}
+		logger.Debug("msg", "started workflow", "schedule", sch.Name, "workflow", sch.Workflow, "instance_id", instanceID, "count", len(ids))
+	}
+	return nil
+}
+
+// Run starts due workflows every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.RunDue(ctx); err != nil {
+			ctxlog.Logger(ctx, s.logger).Info("msg", "running schedules", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package configapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+)
+
+// WebhookRefresh is how long loaded webhooks are used before they are
+// reloaded from storage, e.g. to pick up changes from other instances.
+const WebhookRefresh = time.Minute
+
+// WebhookStore stores webhooks.
+type WebhookStore interface {
+	StoreWebhook(ctx context.Context, c *event.ActionConfig) error
+
+	// RetrieveWebhook retrieves webhook name.
+	// Nil is returned if the webhook does not exist.
+	RetrieveWebhook(ctx context.Context, name string) (*event.ActionConfig, error)
+
+	RetrieveWebhooks(ctx context.Context) ([]*event.ActionConfig, error)
+	DeleteWebhook(ctx context.Context, name string) error
+}
+
+// Webhook is a webhook resource.
+type Webhook struct {
+	ID      string              `json:"id"`
+	Hash    string              `json:"hash"`
+	Webhook *event.ActionConfig `json:"webhook"`
+}
+
+// Webhooks manages webhooks: event actions configured with the API.
+// It is an event sink that sends events to the webhooks.
+type Webhooks struct {
+	store  WebhookStore
+	client *http.Client
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	sinks    event.MultiSink
+	loadedAt time.Time
+}
+
+// WebhookOption configures the webhook manager.
+type WebhookOption func(*Webhooks)
+
+// WithWebhookClock configures the clock used to reload webhooks.
+func WithWebhookClock(c clock.Clock) WebhookOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(w *Webhooks) {
+		w.clock = c
+	}
+}
+
+// NewWebhooks creates a new webhook manager using store.
+// Webhooks are sent with client (see [event.NewAction]).
+func NewWebhooks(store WebhookStore, client *http.Client, opts ...WebhookOption) *Webhooks {
+	if store == nil {
+		panic("nil store")
+	}
+	w := &Webhooks{store: store, client: client, clock: clock.Real}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Put stores webhook c as webhook name.
+func (w *Webhooks) Put(ctx context.Context, name string, c *event.ActionConfig) (*Resource, error) {
+	if c.Name == "" {
+		c.Name = name
+	} else if c.Name != name {
+		return nil, fmt.Errorf("%w: %s", ErrIDMismatch, c.Name)
+	}
+	if _, err := event.NewAction(c, nil); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	res := &Resource{ID: name}
+	var err error
+	if res.Hash, err = hash(c); err != nil {
+		return nil, fmt.Errorf("hashing webhook: %w", err)
+	}
+
+	current, err := w.store.RetrieveWebhook(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving webhook: %w", err)
+	}
+	if current != nil {
+		if currentHash, err := hash(current); err == nil && currentHash == res.Hash {
+			return res, nil
+		}
+	}
+
+	if err = w.store.StoreWebhook(ctx, c); err != nil {
+		return nil, fmt.Errorf("storing webhook: %w", err)
+	}
+	res.Changed = true
+	w.invalidate()
+	return res, nil
+}
+
+// Get retrieves webhook name.
+func (w *Webhooks) Get(ctx context.Context, name string) (*Webhook, error) {
+	c, err := w.store.RetrieveWebhook(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving webhook: %w", err)
+	} else if c == nil {
+		return nil, ErrNotFound
+	}
+	wh := &Webhook{ID: name, Webhook: c}
+	if wh.Hash, err = hash(c); err != nil {
+		return nil, fmt.Errorf("hashing webhook: %w", err)
+	}
+	return wh, nil
+}
+
+// Delete deletes webhook name.
+// Deleting a webhook that does not exist is not an error.
+func (w *Webhooks) Delete(ctx context.Context, name string) (*Resource, error) {
+	c, err := w.store.RetrieveWebhook(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving webhook: %w", err)
+	} else if c == nil {
+		return &Resource{ID: name}, nil
+	}
+	if err = w.store.DeleteWebhook(ctx, name); err != nil {
+		return nil, fmt.Errorf("deleting webhook: %w", err)
+	}
+	w.invalidate()
+	return &Resource{ID: name, Changed: true}, nil
+}
+
+// invalidate reloads the webhooks with the next event.
+func (w *Webhooks) invalidate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.loadedAt = time.Time{}
+}
+
+// load returns the webhook sinks reloading them if needed.
+func (w *Webhooks) load(ctx context.Context) (event.MultiSink, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.loadedAt.IsZero() && w.clock.Now().Sub(w.loadedAt) < WebhookRefresh {
+		return w.sinks, nil
+	}
+	configs, err := w.store.RetrieveWebhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving webhooks: %w", err)
+	}
+	var sinks event.MultiSink
+	for _, c := range configs {
+		a, err := event.NewAction(c, w.client)
+		if err != nil {
+			// stored webhooks were valid
+			continue
+		}
+		sinks = append(sinks, a)
+	}
+	w.sinks, w.loadedAt = sinks, w.clock.Now()
+	return sinks, nil
+}
+
+// Send sends e to all webhooks.
+func (w *Webhooks) Send(ctx context.Context, e *event.Event) error {
+	sinks, err := w.load(ctx)
+	if err != nil {
+		return err
+	}
+	return sinks.Send(ctx, e)
+}
@@ -0,0 +1,195 @@
+// Package cron parses cron expressions and computes their occurrences.
+//
+// Expressions have the five standard fields: minute (0-59), hour (0-23),
+// day of month (1-31), month (1-12 or JAN-DEC), and day of week (0-7 or
+// SUN-SAT, both 0 and 7 are Sunday). Fields are "*", values, ranges
+// ("1-5"), steps ("*/15" or "0-30/10"), or comma-separated lists of
+// these. The macros @yearly (@annually), @monthly, @weekly, @daily
+// (@midnight), and @hourly are also supported.
+//
+// Like cron, if both the day of month and the day of week are
+// restricted then days matching either field match.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned for invalid expressions.
+var ErrInvalid = errors.New("invalid cron expression")
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// field describes the values of a field.
+type field struct {
+	name     string
+	min, max int
+	names    []string // names of values from min
+}
+
+var fields = []field{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, monthNames},
+	{"day of week", 0, 7, dayNames},
+}
+
+// bits is a set of field values.
+type bits uint64
+
+func (b bits) has(v int) bool {
+	return b&(1<<uint(v)) != 0
+}
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow bits
+
+	// star fields are unrestricted ("*")
+	domStar, dowStar bool
+}
+
+// value parses the number or name of s in f.
+func (f field) value(s string) (int, error) {
+	for i, n := range f.names {
+		if strings.EqualFold(s, n) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%w: %s: %q", ErrInvalid, f.name, s)
+	}
+	return v, nil
+}
+
+// parse parses the field expression s.
+func (f field) parse(s string) (bits, bool, error) {
+	var b bits
+	star := s == "*"
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, false, fmt.Errorf("%w: %s: step: %q", ErrInvalid, f.name, stepStr)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loStr); err != nil {
+				return 0, false, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiStr); err != nil {
+					return 0, false, err
+				}
+			} else if hasStep {
+				// "N/S" starts at N
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, false, fmt.Errorf("%w: %s: range: %q", ErrInvalid, f.name, rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			b |= 1 << uint(v)
+		}
+	}
+	return b, star, nil
+}
+
+// Parse parses the cron expression expr.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("%w: expected %d fields: %q", ErrInvalid, len(fields), expr)
+	}
+	var parsed [5]bits
+	var stars [5]bool
+	for i, f := range fields {
+		var err error
+		if parsed[i], stars[i], err = f.parse(parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	s := &Schedule{
+		minute:  parsed[0],
+		hour:    parsed[1],
+		dom:     parsed[2],
+		month:   parsed[3],
+		dow:     parsed[4],
+		domStar: stars[2],
+		dowStar: stars[4],
+	}
+	if s.dow.has(7) {
+		// 7 is Sunday, too
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// dayMatches reports whether the day of t matches s.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first occurrence of s after t in the location of t.
+// The zero time is returned if s has no occurrence within five years
+// (e.g. February 30th).
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !s.month.has(int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
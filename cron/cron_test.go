@@ -0,0 +1,45 @@
+package cron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// a Monday
+	from := time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC)
+	for _, test := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * sun", time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week
+		{"0 0 15 * fri", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"30 10 1,2 1 *", time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if have := s.Next(from); !have.Equal(test.want) {
+			t.Errorf("%s: have %v, want %v", test.expr, have, test.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: have %v, want %v", expr, err, ErrInvalid)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/micromdm/nanolib/log"
 	"github.com/micromdm/nanolib/log/ctxlog"
 	"github.com/micromdm/nanomdm/mdm"
+	"github.com/valyala/fastjson"
 )
 
 // ErrUnknownDMEndpoint occurs when an unknown "Endpoint" field value
@@ -53,12 +54,32 @@ func ContextJSONMux(ctx context.Context) (out context.Context, mux *jsonpath.Pat
 // StatusIDFns generate IDs for status reports.
 type StatusIDFn func(*mdm.Request, *ddm.StatusReport) (string, error)
 
+// StatusHandler handles the status report value v at path for the
+// enrollment of r. See [jsonpath.PathMux] for path semantics.
+type StatusHandler func(r *mdm.Request, path string, v *fastjson.Value) error
+
+// secondaryStatusStore is a named secondary status store.
+type secondaryStatusStore struct {
+	name  string
+	store storage.StatusStorer
+}
+
+// statusHandler is a StatusHandler registered for a path.
+type statusHandler struct {
+	path string
+	h    StatusHandler
+}
+
 // DMAdapter adapts KMFDDM to NanoMDM.
 type DMAdapter struct {
 	logger           log.Logger
 	declarationStore storage.EnrollmentDeclarationStorage
 	statusStore      storage.StatusStorer
+	secondaryStores  []secondaryStatusStore
 	statusIDFn       StatusIDFn
+	statusHandlers   []statusHandler
+	maxStatusSize    int
+	templater        *templater
 }
 
 // Options configure the adapter.
@@ -92,6 +113,66 @@ func WithStatusStore(s storage.StatusStorer) Option {
 	}
 }
 
+// WithSecondaryStatusStore additionally stores status reports in s.
+// Secondary stores (for example analytics or streaming sinks) are
+// independent of the primary status store and each other: their
+// failures are logged but do not fail the DM check-in.
+// The name identifies s in logs.
+func WithSecondaryStatusStore(name string, s storage.StatusStorer) Option {
+	return func(dma *DMAdapter) error {
+		if s == nil {
+			return errors.New("nil secondary status store")
+		}
+		dma.secondaryStores = append(dma.secondaryStores, secondaryStatusStore{name: name, store: s})
+		return nil
+	}
+}
+
+// WithStatusHandler registers h for status report values at path.
+// Status items the built-in handlers do not parse (for example
+// software update status) can be processed this way. Reports are
+// parsed one status item at a time so path must be a status item
+// (or below one) or a wildcard path.
+func WithStatusHandler(path string, h StatusHandler) Option {
+	return func(dma *DMAdapter) error {
+		if h == nil {
+			return errors.New("nil status handler")
+		}
+		dma.statusHandlers = append(dma.statusHandlers, statusHandler{path: path, h: h})
+		return nil
+	}
+}
+
+// WithMaxStatusSize skips DM status items larger than size bytes.
+// Status reports are parsed one status item at a time and parsing an
+// item builds its JSON document in memory which can be many times the
+// size of the item itself. Larger items are logged and not parsed
+// while the rest of the report is still processed.
+func WithMaxStatusSize(size int) Option {
+	return func(dma *DMAdapter) error {
+		if size < 0 {
+			return errors.New("invalid max status size")
+		}
+		dma.maxStatusSize = size
+		return nil
+	}
+}
+
+// WithTemplateValues renders placeholders like "${serial_number}" in
+// declarations per-enrollment with the values returned by fn.
+// The server tokens of rendered declarations (and the declarations
+// token) are derived from the rendered values so that enrollments
+// synchronize again when their values change.
+func WithTemplateValues(fn TemplateValuesFn) Option {
+	return func(dma *DMAdapter) error {
+		if fn == nil {
+			return errors.New("nil template values function")
+		}
+		dma.templater = &templater{valuesFn: fn, names: make(map[string][]string)}
+		return nil
+	}
+}
+
 // New creates a new KMFDDM to NanoMDM adapter.
 func New(declarationStore storage.EnrollmentDeclarationStorage, opts ...Option) (*DMAdapter, error) {
 	if declarationStore == nil {
@@ -123,13 +204,33 @@ func (dma *DMAdapter) handleStatus(r *mdm.Request, msg *mdm.DeclarativeManagemen
 	// register the default handlers
 	ddm.RegisterStatusHandlers(mux, status)
 
-	unhandled, err := ddm.ParseStatusUsingMux(status.Raw, mux)
-	if err != nil {
-		return fmt.Errorf("parsing status: %w", err)
+	// register any additional handlers
+	for _, sh := range dma.statusHandlers {
+		h := sh.h
+		mux.Handle(sh.path, jsonpath.HandlerFunc(func(path string, v *fastjson.Value) ([]string, error) {
+			return nil, h(r, path, v)
+		}))
 	}
 
 	logger := ctxlog.Logger(ctx, dma.logger)
 
+	parser := &statusParser{
+		mux:     mux,
+		maxItem: dma.maxStatusSize,
+		skipped: func(path string, size int) {
+			logger.Info(
+				"msg", "status item too large",
+				"path", path,
+				"size", size,
+				"max", dma.maxStatusSize,
+			)
+		},
+	}
+	unhandled, err := parser.parse(status.Raw)
+	if err != nil {
+		return fmt.Errorf("parsing status: %w", err)
+	}
+
 	for _, path := range unhandled {
 		// log the unhandled status paths
 		// these are the root paths the jsonpath muxer did not handle.
@@ -156,20 +257,30 @@ func (dma *DMAdapter) handleStatus(r *mdm.Request, msg *mdm.DeclarativeManagemen
 		logkeys.ValueCount, len(status.Values),
 	)
 
-	if dma.statusStore == nil {
-		// skip storing the report entirely.
-		// this still allows for any custom parsers to run.
-		return nil
+	var storeErr error
+	if dma.statusStore != nil {
+		storeErr = dma.statusStore.StoreDeclarationStatus(ctx, r.ID, status)
+		if storeErr != nil {
+			// log the error with our additional context
+			logger.Info("msg", "storing status", "err", storeErr)
+		} else {
+			logger.Debug("msg", "stored status")
+		}
 	}
-
-	err = dma.statusStore.StoreDeclarationStatus(ctx, r.ID, status)
-	if err != nil {
-		// log the error with our additional context
-		logger.Info("msg", "storing status", "err", err)
-		return fmt.Errorf("storing status: %w", err)
+	// a nil status store skips storing the report in the primary store.
+	// this still allows for any custom parsers and secondary stores to run.
+
+	// secondary stores are independent of the primary store
+	// and each other: their failures are only logged.
+	for _, s := range dma.secondaryStores {
+		if err = s.store.StoreDeclarationStatus(ctx, r.ID, status); err != nil {
+			logger.Info("msg", "storing status in secondary store", "store", s.name, "err", err)
+		}
 	}
 
-	logger.Debug("msg", "stored status")
+	if storeErr != nil {
+		return fmt.Errorf("storing status: %w", storeErr)
+	}
 	return nil
 }
 
@@ -180,6 +291,12 @@ func (dma *DMAdapter) handleTokens(r *mdm.Request) ([]byte, error) {
 		return ret, fmt.Errorf("retrieving tokens: %w", err)
 	}
 
+	if dma.templater != nil {
+		if ret, err = dma.renderTokens(r, ret); err != nil {
+			return nil, fmt.Errorf("rendering tokens: %w", err)
+		}
+	}
+
 	ctxlog.Logger(r.Context(), dma.logger).Debug("msg", "retrieved tokens")
 	return ret, nil
 }
@@ -191,6 +308,12 @@ func (dma *DMAdapter) handleDeclarationItems(r *mdm.Request) ([]byte, error) {
 		return ret, fmt.Errorf("retrieving declaration items: %w", err)
 	}
 
+	if dma.templater != nil {
+		if ret, _, err = dma.renderDeclarationItems(r, ret); err != nil {
+			return nil, fmt.Errorf("rendering declaration items: %w", err)
+		}
+	}
+
 	ctxlog.Logger(r.Context(), dma.logger).Debug("msg", "retrieved declaration items")
 	return ret, nil
 }
@@ -214,6 +337,13 @@ func (dma *DMAdapter) handleDeclaration(r *mdm.Request, path string) ([]byte, er
 		return ret, fmt.Errorf("retrieveing declaration: %s: %w", declarationID, err)
 	}
 
+	if dma.templater != nil {
+		if ret, err = dma.renderDeclaration(r, ret); err != nil {
+			logger.Info("msg", "rendering declaration", "err", err)
+			return nil, fmt.Errorf("rendering declaration: %s: %w", declarationID, err)
+		}
+	}
+
 	logger.Debug("msg", "retrieved declaration")
 	return ret, nil
 }
@@ -2,12 +2,16 @@ package ddmadapter
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"hash"
 	"hash/fnv"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/jessepeterson/kmfddm/jsonpath"
 	"github.com/jessepeterson/kmfddm/storage/inmem"
 	"github.com/micromdm/nanomdm/mdm"
 	"github.com/micromdm/nanomdm/test/enrollment"
@@ -102,3 +106,178 @@ func TestStatus(t *testing.T) {
 		t.Errorf("have: %v, want: %v", have, want)
 	}
 }
+
+// templateStore is a declaration store with a single templated configuration.
+type templateStore struct{}
+
+func (templateStore) RetrieveTokensJSON(_ context.Context, _ string) ([]byte, error) {
+	return []byte(`{"SyncTokens":{"DeclarationsToken":"dt","Timestamp":"2024-01-01T00:00:00Z"}}`), nil
+}
+
+func (templateStore) RetrieveDeclarationItemsJSON(_ context.Context, _ string) ([]byte, error) {
+	return []byte(`{"Declarations":{"Activations":[{"Identifier":"act","ServerToken":"a1"}],"Assets":[],"Configurations":[{"Identifier":"cfg","ServerToken":"c1"}],"Management":[]},"DeclarationsToken":"dt"}`), nil
+}
+
+func (templateStore) RetrieveEnrollmentDeclarationJSON(_ context.Context, declarationID, _, _ string) ([]byte, error) {
+	if declarationID == "cfg" {
+		return []byte(`{"Identifier":"cfg","ServerToken":"c1","Type":"com.apple.configuration.management.test","Payload":{"Echo":"${serial_number}/${udid}"}}`), nil
+	}
+	return []byte(`{"Identifier":"act","ServerToken":"a1","Type":"com.apple.activation.simple","Payload":{"StandardConfigurations":["cfg"]}}`), nil
+}
+
+func TestTemplate(t *testing.T) {
+	serial := "SERIAL1"
+	a, err := New(templateStore{}, WithTemplateValues(func(r *mdm.Request) (map[string]string, error) {
+		return map[string]string{VarSerialNumber: serial, VarUDID: r.ID}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mdm.NewRequestWithContext(context.Background(), nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	dm := func(endpoint string, v interface{}) {
+		t.Helper()
+		b, err := a.DeclarativeManagement(r, &mdm.DeclarativeManagement{Endpoint: endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var decl struct {
+		ServerToken string
+		Payload     struct{ Echo string }
+	}
+	dm("declaration/configuration/cfg", &decl)
+	if have, want := decl.Payload.Echo, "SERIAL1/ID1"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+	if decl.ServerToken == "c1" {
+		t.Error("server token not rendered")
+	}
+
+	items := new(declarationItems)
+	dm("declaration-items", items)
+	if have, want := items.Declarations["Configurations"][0].ServerToken, decl.ServerToken; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+	if have, want := items.Declarations["Activations"][0].ServerToken, "a1"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+
+	var tokens struct {
+		SyncTokens struct{ DeclarationsToken string }
+	}
+	dm("tokens", &tokens)
+	if have, want := tokens.SyncTokens.DeclarationsToken, items.DeclarationsToken; have != want || have == "dt" {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+
+	// a changed value changes the tokens
+	serial = "SERIAL2"
+	dm("tokens", &tokens)
+	if tokens.SyncTokens.DeclarationsToken == items.DeclarationsToken {
+		t.Error("declarations token not changed")
+	}
+}
+
+type statusStoreFunc func(context.Context, string, *ddm.StatusReport) error
+
+func (f statusStoreFunc) StoreDeclarationStatus(ctx context.Context, id string, status *ddm.StatusReport) error {
+	return f(ctx, id, status)
+}
+
+func TestSecondaryStatusStores(t *testing.T) {
+	var stored []string
+	store := func(name string, err error) statusStoreFunc {
+		return func(context.Context, string, *ddm.StatusReport) error {
+			stored = append(stored, name)
+			return err
+		}
+	}
+
+	a, err := New(templateStore{},
+		WithStatusStore(store("primary", nil)),
+		WithSecondaryStatusStore("failing", store("failing", errors.New("unavailable"))),
+		WithSecondaryStatusStore("events", store("events", nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mdm.NewRequestWithContext(context.Background(), nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	_, err = a.DeclarativeManagement(r, &mdm.DeclarativeManagement{Endpoint: "status", Data: []byte(`{"StatusItems":{}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := stored, []string{"primary", "failing", "events"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestStatusParser(t *testing.T) {
+	raw := []byte(`{
+    "StatusItems": {
+        "device": {
+            "identifier": {"udid": "testUUID", "serial-number": "SERIAL"},
+            "operating-system": {"version": "14.0", "build-version": "23A344"},
+            "test": {"large": "` + strings.Repeat("x", 1024) + `"}
+        },
+        "management": {
+            "client-capabilities": {"supported-versions": ["1.0.0"]},
+            "declarations": {
+                "activations": [{"identifier": "act", "active": true, "valid": "valid", "server-token": "a1"}],
+                "configurations": [{"identifier": "cfg", "active": true, "valid": "valid", "server-token": "c1"}],
+                "assets": [],
+                "management": []
+            }
+        }
+    },
+    "Errors": [{"StatusItem": "device.model.family", "Reasons": [{"Code": "Error.NotSupported"}]}]
+}`)
+
+	// the incremental parser matches parsing the entire report
+	_, want, err := ddm.ParseStatus(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := &ddm.StatusReport{Raw: raw}
+	mux := jsonpath.NewPathMux()
+	ddm.RegisterStatusHandlers(mux, have)
+	p := &statusParser{mux: mux}
+	if _, err = p.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// items larger than the maximum are skipped
+	var skipped []string
+	have = &ddm.StatusReport{Raw: raw}
+	mux = jsonpath.NewPathMux()
+	ddm.RegisterStatusHandlers(mux, have)
+	p = &statusParser{mux: mux, maxItem: 512, skipped: func(path string, _ int) {
+		skipped = append(skipped, path)
+	}}
+	if _, err = p.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".StatusItems.device.test"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped: have: %v, want: %v", skipped, want)
+	}
+	if len(have.Declarations) != 2 || len(have.Errors) != 1 || len(have.Values) != len(want.Values)-1 {
+		t.Errorf("incomplete report: %v", have)
+	}
+
+	// invalid reports are rejected
+	for _, raw := range []string{`[]`, `{"StatusItems": {"device": }`, `{} {}`} {
+		if _, err = (&statusParser{mux: jsonpath.NewPathMux()}).parse([]byte(raw)); err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package ddmadapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jessepeterson/kmfddm/jsonpath"
+	"github.com/valyala/fastjson"
+)
+
+// statusItemsKey is the top-level key of the status items of a report.
+const statusItemsKey = "StatusItems"
+
+// statusParser parses DM status reports incrementally.
+//
+// Rather than parsing the entire report into a single JSON document
+// each status item (i.e. ".StatusItems.<category>.<item>") and each
+// other top-level value of the report is parsed and dispatched to the
+// mux separately. This bounds the memory used by parsing to that of
+// the largest item rather than the entire report. Handlers of the mux
+// must therefore be registered at or below status items (or as
+// wildcards) to see complete values.
+type statusParser struct {
+	mux *jsonpath.PathMux
+
+	// maxItem skips items larger than this many bytes if non-zero.
+	maxItem int
+
+	// skipped is called for items skipped for their size.
+	skipped func(path string, size int)
+
+	dec       *json.Decoder
+	raw       []byte
+	unhandled []string
+	seen      map[string]bool
+}
+
+// parse parses the raw status report returning the unhandled paths.
+func (p *statusParser) parse(raw []byte) ([]string, error) {
+	p.raw = raw
+	p.seen = make(map[string]bool)
+	p.dec = json.NewDecoder(bytes.NewReader(raw))
+	p.dec.UseNumber()
+
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("reading status report: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("status report not an object")
+	}
+	err = p.object(nil, func(path []string, tok json.Token) error {
+		if len(path) == 1 && path[0] == statusItemsKey && tok == json.Delim('{') {
+			// descend into the categories of status items
+			return p.object(path, func(path []string, tok json.Token) error {
+				if tok == json.Delim('{') {
+					// descend into the status items of the category
+					return p.object(path, p.dispatch)
+				}
+				return p.dispatch(path, tok)
+			})
+		}
+		return p.dispatch(path, tok)
+	})
+	if err != nil {
+		return p.unhandled, err
+	}
+	if _, err = p.dec.Token(); err != io.EOF {
+		return p.unhandled, errors.New("trailing data after status report")
+	}
+	return p.unhandled, nil
+}
+
+// object reads the members of the object whose opening delimiter was
+// just read calling fn with the path and first token of each value.
+func (p *statusParser) object(path []string, fn func([]string, json.Token) error) error {
+	for p.dec.More() {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return fmt.Errorf("reading status report: %w", err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return errors.New("invalid status report object key")
+		}
+		if tok, err = p.dec.Token(); err != nil {
+			return fmt.Errorf("reading status report: %w", err)
+		}
+		// copy the path so it isn't shared between siblings
+		keyPath := append(append([]string{}, path...), key)
+		if err = fn(keyPath, tok); err != nil {
+			return err
+		}
+	}
+	// read the closing delimiter
+	_, err := p.dec.Token()
+	return err
+}
+
+// value returns the raw JSON of the value whose first token tok was
+// just read.
+func (p *statusParser) value(tok json.Token) ([]byte, error) {
+	if tok != json.Delim('{') && tok != json.Delim('[') {
+		// scalar values are complete tokens
+		return json.Marshal(tok)
+	}
+	start := p.dec.InputOffset() - 1
+	for depth := 1; depth > 0; {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("reading status report: %w", err)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return p.raw[start:p.dec.InputOffset()], nil
+}
+
+// dispatch parses the value at path whose first token tok was just read
+// and dispatches it to the mux.
+func (p *statusParser) dispatch(path []string, tok json.Token) error {
+	raw, err := p.value(tok)
+	if err != nil {
+		return err
+	}
+	if p.maxItem > 0 && len(raw) > p.maxItem {
+		if p.skipped != nil {
+			p.skipped(jsonPath(path), len(raw))
+		}
+		return nil
+	}
+
+	// wrap the value in its parent objects so that the mux sees it
+	// at its path in the report.
+	var doc []byte
+	for _, key := range path {
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		doc = append(append(append(doc, '{'), keyJSON...), ':')
+	}
+	doc = append(doc, raw...)
+	doc = append(doc, bytes.Repeat([]byte{'}'}, len(path))...)
+
+	v, err := fastjson.ParseBytes(doc)
+	if err != nil {
+		return fmt.Errorf("parsing json at %s: %w", jsonPath(path), err)
+	}
+	unhandled, err := p.mux.JSONPath("", v)
+	for _, path := range unhandled {
+		// items of unhandled categories report the same paths
+		if !p.seen[path] {
+			p.seen[path] = true
+			p.unhandled = append(p.unhandled, path)
+		}
+	}
+	return err
+}
+
+// jsonPath returns the mux path of path.
+func jsonPath(path []string) string {
+	var s string
+	for _, key := range path {
+		s += "." + key
+	}
+	return s
+}
@@ -0,0 +1,36 @@
+package ddmadapter
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+)
+
+// StatusEventStore is a status store that sends DM status reports as
+// events to a sink. It is intended as a secondary status store.
+type StatusEventStore struct {
+	sink event.Sink
+}
+
+// NewStatusEventStore creates a new status event store sending to sink.
+func NewStatusEventStore(sink event.Sink) *StatusEventStore {
+	if sink == nil {
+		panic("nil sink")
+	}
+	return &StatusEventStore{sink: sink}
+}
+
+// StoreDeclarationStatus sends a status report event for enrollmentID.
+func (s *StatusEventStore) StoreDeclarationStatus(ctx context.Context, enrollmentID string, status *ddm.StatusReport) error {
+	e := event.New(clock.Real, event.TypeDMStatus, enrollmentID)
+	if status.ID != "" {
+		e.Fields["status_id"] = status.ID
+	}
+	e.Fields["declarations"] = strconv.Itoa(len(status.Declarations))
+	e.Fields["errors"] = strconv.Itoa(len(status.Errors))
+	e.Fields["values"] = strconv.Itoa(len(status.Values))
+	return s.sink.Send(ctx, e)
+}
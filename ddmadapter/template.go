@@ -0,0 +1,288 @@
+package ddmadapter
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+// Template variables available to all enrollments.
+const (
+	VarEnrollmentID = "enrollment_id"
+	VarUDID         = "udid"
+	VarSerialNumber = "serial_number"
+
+	// VarInventoryPrefix prefixes the inventory values of an enrollment.
+	// For example "${inventory.model}".
+	VarInventoryPrefix = "inventory."
+)
+
+// maxTemplateCache is the number of declarations whose placeholders
+// are cached before the cache is reset.
+const maxTemplateCache = 10000
+
+// placeholderRe matches declaration placeholders like "${serial_number}".
+var placeholderRe = regexp.MustCompile(`\$\{([A-Za-z0-9_.\-]+)\}`)
+
+// TemplateValuesFn returns the template variable values for the
+// enrollment of r. Missing variables render as empty strings.
+type TemplateValuesFn func(r *mdm.Request) (map[string]string, error)
+
+// InventoryTemplateValues returns template variable values from the
+// inventory of the enrollment in store.
+// The UDID is the enrollment ID of device channel enrollments and
+// the parent ID of user channel enrollments.
+func InventoryTemplateValues(store storage.ReadStorage) TemplateValuesFn {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(r *mdm.Request) (map[string]string, error) {
+		vars := map[string]string{VarEnrollmentID: r.ID, VarUDID: r.ID}
+		if r.ParentID != "" {
+			vars[VarUDID] = r.ParentID
+		}
+
+		inv, err := store.RetrieveInventory(r.Context(), &storage.SearchOptions{IDs: []string{r.ID}})
+		if err != nil {
+			return vars, fmt.Errorf("retrieving inventory: %w", err)
+		}
+		for k, v := range inv[r.ID] {
+			vars[VarInventoryPrefix+k] = fmt.Sprint(v)
+		}
+		if serial, ok := inv[r.ID][storage.KeySerialNumber].(string); ok {
+			vars[VarSerialNumber] = serial
+		}
+		return vars, nil
+	}
+}
+
+// placeholders returns the sorted unique placeholder names in b.
+func placeholders(b []byte) []string {
+	seen := make(map[string]struct{})
+	var names []string
+	for _, m := range placeholderRe.FindAllSubmatch(b, -1) {
+		name := string(m[1])
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// render replaces the placeholders in the JSON document b with vars.
+// Values are escaped as JSON string contents as placeholders are
+// expected to be within JSON strings.
+func render(b []byte, vars map[string]string) []byte {
+	return placeholderRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		v, _ := json.Marshal(vars[string(m[2:len(m)-1])])
+		return v[1 : len(v)-1]
+	})
+}
+
+// renderedToken derives the server token of a rendered declaration
+// from its stored token and the values of its placeholders names.
+func renderedToken(token string, names []string, vars map[string]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", token)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, vars[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// templater renders declaration placeholders for enrollments.
+type templater struct {
+	valuesFn TemplateValuesFn
+
+	mu sync.RWMutex
+	// names caches the placeholder names of declarations by their
+	// stored server token. Server tokens change with the declaration.
+	names map[string][]string
+}
+
+// templateVars lazily retrieves the template variables for a request.
+type templateVars struct {
+	t    *templater
+	r    *mdm.Request
+	vars map[string]string
+}
+
+func (tv *templateVars) get() (map[string]string, error) {
+	if tv.vars != nil {
+		return tv.vars, nil
+	}
+	vars, err := tv.t.valuesFn(tv.r)
+	if err != nil {
+		return nil, err
+	}
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	tv.vars = vars
+	return vars, nil
+}
+
+func (t *templater) cachedNames(token string) ([]string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names, ok := t.names[token]
+	return names, ok
+}
+
+func (t *templater) cacheNames(token string, names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.names) >= maxTemplateCache {
+		t.names = make(map[string][]string)
+	}
+	t.names[token] = names
+}
+
+// declarationPaths maps the declaration item categories to the
+// declaration types of the declaration endpoint path.
+var declarationPaths = map[string]string{
+	"Activations":    "activation",
+	"Assets":         "asset",
+	"Configurations": "configuration",
+	"Management":     "management",
+}
+
+type declarationItem struct {
+	Identifier  string
+	ServerToken string
+}
+
+type declarationItems struct {
+	Declarations      map[string][]declarationItem
+	DeclarationsToken string
+}
+
+// renderDeclaration renders the declaration JSON b and replaces its
+// server token with the rendered token.
+func (dma *DMAdapter) renderDeclaration(r *mdm.Request, b []byte) ([]byte, error) {
+	names := placeholders(b)
+	if len(names) < 1 {
+		return b, nil
+	}
+
+	tv := &templateVars{t: dma.templater, r: r}
+	vars, err := tv.get()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving template values: %w", err)
+	}
+
+	decl := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(render(b, vars), &decl); err != nil {
+		return nil, fmt.Errorf("unmarshal rendered declaration: %w", err)
+	}
+
+	var token string
+	if err = json.Unmarshal(decl["ServerToken"], &token); err != nil {
+		return nil, fmt.Errorf("unmarshal server token: %w", err)
+	}
+	dma.templater.cacheNames(token, names)
+
+	decl["ServerToken"], err = json.Marshal(renderedToken(token, names, vars))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decl)
+}
+
+// templateNames returns the placeholder names of the declaration of
+// item with declarationType for the enrollment of r.
+func (dma *DMAdapter) templateNames(r *mdm.Request, declarationType string, item declarationItem) ([]string, error) {
+	if names, ok := dma.templater.cachedNames(item.ServerToken); ok {
+		return names, nil
+	}
+	b, err := dma.declarationStore.RetrieveEnrollmentDeclarationJSON(r.Context(), item.Identifier, declarationType, r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration: %s: %w", item.Identifier, err)
+	}
+	names := placeholders(b)
+	dma.templater.cacheNames(item.ServerToken, names)
+	return names, nil
+}
+
+// renderDeclarationItems replaces the server tokens of templated
+// declarations in the declaration items JSON b with their rendered
+// tokens. The declarations token is derived from the rendered tokens.
+func (dma *DMAdapter) renderDeclarationItems(r *mdm.Request, b []byte) ([]byte, string, error) {
+	items := new(declarationItems)
+	if err := json.Unmarshal(b, items); err != nil {
+		return nil, "", fmt.Errorf("unmarshal declaration items: %w", err)
+	}
+
+	tv := &templateVars{t: dma.templater, r: r}
+	var rendered []string
+	for category, declarationType := range declarationPaths {
+		for i, item := range items.Declarations[category] {
+			names, err := dma.templateNames(r, declarationType, item)
+			if err != nil {
+				return nil, "", err
+			}
+			if len(names) < 1 {
+				continue
+			}
+			vars, err := tv.get()
+			if err != nil {
+				return nil, "", fmt.Errorf("retrieving template values: %w", err)
+			}
+			token := renderedToken(item.ServerToken, names, vars)
+			items.Declarations[category][i].ServerToken = token
+			rendered = append(rendered, token)
+		}
+	}
+
+	if len(rendered) < 1 {
+		return b, items.DeclarationsToken, nil
+	}
+
+	sort.Strings(rendered)
+	items.DeclarationsToken = renderedToken(items.DeclarationsToken, rendered, nil)
+	out, err := json.Marshal(items)
+	return out, items.DeclarationsToken, err
+}
+
+// renderTokens replaces the declarations token in the tokens JSON b
+// with the declarations token of the rendered declaration items.
+func (dma *DMAdapter) renderTokens(r *mdm.Request, b []byte) ([]byte, error) {
+	itemsJSON, err := dma.declarationStore.RetrieveDeclarationItemsJSON(r.Context(), r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration items: %w", err)
+	}
+	_, declarationsToken, err := dma.renderDeclarationItems(r, itemsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("unmarshal tokens: %w", err)
+	}
+	syncTokens, ok := tokens["SyncTokens"]
+	if !ok {
+		return nil, errors.New("no sync tokens")
+	}
+	var token string
+	if err = json.Unmarshal(syncTokens["DeclarationsToken"], &token); err != nil {
+		return nil, fmt.Errorf("unmarshal declarations token: %w", err)
+	}
+	if token == declarationsToken {
+		return b, nil
+	}
+	if syncTokens["DeclarationsToken"], err = json.Marshal(declarationsToken); err != nil {
+		return nil, err
+	}
+	return json.Marshal(tokens)
+}
@@ -0,0 +1,129 @@
+// Package ddmasset hosts Declarative Management asset data.
+//
+// Assets are served to enrollments at stable URLs that can be
+// referenced by com.apple.asset.data declarations using MDM
+// authentication, so no separate file server is needed.
+package ddmasset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	nanohttpmdm "github.com/micromdm/nanomdm/http/mdm"
+)
+
+// AssetsPath is the URL path under which assets are served to enrollments.
+const AssetsPath = "/assets/"
+
+var (
+	// ErrNotFound is returned when an asset does not exist.
+	ErrNotFound = errors.New("asset not found")
+
+	// ErrInvalidName is returned for invalid asset names.
+	ErrInvalidName = errors.New("invalid asset name")
+)
+
+// Asset describes hosted asset data.
+type Asset struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+
+	// Hash is the hex SHA-256 hash of the asset data.
+	Hash string `json:"hash"`
+
+	Modified time.Time `json:"modified"`
+}
+
+// NewAsset creates a new asset description for data.
+// The content type is detected from data if empty.
+func NewAsset(name, contentType string, data []byte, modified time.Time) (*Asset, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &Asset{
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Hash:        fmt.Sprintf("%x", sha256.Sum256(data)),
+		Modified:    modified,
+	}, nil
+}
+
+// Reference is the Reference of a com.apple.asset.data declaration.
+type Reference struct {
+	DataURL     string `json:"DataURL"`
+	ContentType string `json:"ContentType"`
+	Size        int64  `json:"Size"`
+	Hash        string `json:"Hash-SHA-256"`
+}
+
+// Reference returns the declaration reference to a for a server with
+// the base URL baseURL.
+func (a *Asset) Reference(baseURL string) *Reference {
+	return &Reference{
+		DataURL:     strings.TrimRight(baseURL, "/") + AssetsPath + url.PathEscape(a.Name),
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		Hash:        a.Hash,
+	}
+}
+
+// Store stores assets.
+type Store interface {
+	StoreAsset(ctx context.Context, a *Asset, data []byte) error
+
+	// RetrieveAsset retrieves asset name and its data.
+	// ErrNotFound is returned if the asset does not exist.
+	RetrieveAsset(ctx context.Context, name string) (*Asset, []byte, error)
+
+	RetrieveAssets(ctx context.Context) ([]*Asset, error)
+	DeleteAsset(ctx context.Context, name string) error
+}
+
+// Handler serves assets to enrollments.
+// The asset name is the request URL path with any AssetsPath prefix
+// removed. The handler should be wrapped in MDM authentication.
+func Handler(store Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), AssetsPath))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		a, data, err := store.RetrieveAsset(r.Context(), name)
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving asset", "name", name, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Debug("msg", "serving asset", "name", name, "id", nanohttpmdm.GetEnrollmentID(r.Context()))
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("ETag", `"`+a.Hash+`"`)
+		// ServeContent handles conditional and range requests
+		http.ServeContent(w, r, a.Name, a.Modified, bytes.NewReader(data))
+	}
+}
@@ -0,0 +1,61 @@
+package ddmasset
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+func TestHandler(t *testing.T) {
+	store := NewKVStore(kvmap.New())
+	a, err := NewAsset("logo.png", "image/png", []byte("not really a png"), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.StoreAsset(context.Background(), a, []byte("not really a png")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewAsset("../logo.png", "", nil, time.Time{}); err == nil {
+		t.Error("expected invalid name error")
+	}
+
+	h := Handler(store, log.NopLogger)
+	for _, test := range []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"found", "/assets/logo.png", "", http.StatusOK},
+		{"missing", "/assets/other.png", "", http.StatusNotFound},
+		{"not modified", "/assets/logo.png", `"` + a.Hash + `"`, http.StatusNotModified},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", test.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Fatalf("status: have: %v, want: %v", w.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if have, want := w.Header().Get("Content-Type"), "image/png"; have != want {
+				t.Errorf("content type: have: %v, want: %v", have, want)
+			}
+			if have, want := w.Header().Get("ETag"), `"`+a.Hash+`"`; have != want {
+				t.Errorf("etag: have: %v, want: %v", have, want)
+			}
+		})
+	}
+}
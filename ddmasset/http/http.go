@@ -0,0 +1,182 @@
+// Package http provides the HTTP API for managing DM assets.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/ddmasset"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoName is returned when no asset name is provided.
+var ErrNoName = errors.New("no name provided")
+
+// Asset is an asset with its declaration reference.
+type Asset struct {
+	*ddmasset.Asset
+
+	// Reference is only present if the server base URL is known.
+	Reference *ddmasset.Reference `json:"reference,omitempty"`
+}
+
+func newAsset(a *ddmasset.Asset, baseURL string) *Asset {
+	ret := &Asset{Asset: a}
+	if baseURL != "" {
+		ret.Reference = a.Reference(baseURL)
+	}
+	return ret
+}
+
+// GetAssetsHandler returns all assets.
+func GetAssetsHandler(store ddmasset.Store, baseURL string, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		assets, err := store.RetrieveAssets(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving assets", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		ret := make([]*Asset, 0, len(assets))
+		for _, a := range assets {
+			ret = append(ret, newAsset(a, baseURL))
+		}
+		httpapi.WriteJSON(w, ret, logger)
+	}
+}
+
+// GetAssetHandler returns the asset named in the URL path.
+func GetAssetHandler(store ddmasset.Store, baseURL string, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		a, _, err := store.RetrieveAsset(r.Context(), name)
+		if errors.Is(err, ddmasset.ErrNotFound) {
+			httpapi.JSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving asset", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, newAsset(a, baseURL), logger)
+	}
+}
+
+// PutAssetHandler stores the request body as the asset named in the
+// URL path. The request Content-Type is the asset content type.
+func PutAssetHandler(store ddmasset.Store, baseURL string, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			httpapi.JSONError(w, fmt.Errorf("reading body: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		a, err := ddmasset.NewAsset(name, r.Header.Get("Content-Type"), data, time.Now())
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err = store.StoreAsset(r.Context(), a, data); err != nil {
+			logger.Info("msg", "storing asset", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored asset", "name", name, "size", a.Size)
+		httpapi.WriteJSON(w, newAsset(a, baseURL), logger)
+	}
+}
+
+// DeleteAssetHandler deletes the asset named in the URL path.
+func DeleteAssetHandler(store ddmasset.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteAsset(r.Context(), name); err != nil {
+			logger.Info("msg", "deleting asset", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted asset", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the DM asset API handlers into mux.
+// Asset references are returned if baseURL is not empty.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store ddmasset.Store, baseURL string) {
+	mux.Handle(
+		prefix+"/dm/assets",
+		GetAssetsHandler(store, baseURL, logger.With("handler", "get-dm-assets")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/assets/:name",
+		GetAssetHandler(store, baseURL, logger.With("handler", "get-dm-asset")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/assets/:name",
+		PutAssetHandler(store, baseURL, logger.With("handler", "put-dm-asset")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dm/assets/:name",
+		DeleteAssetHandler(store, logger.With("handler", "delete-dm-asset")),
+		"DELETE",
+	)
+}
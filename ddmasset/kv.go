@@ -0,0 +1,101 @@
+package ddmasset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPfxAsset = "asset."
+	keyPfxData  = "data."
+)
+
+// KVStore stores assets in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new asset store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreAsset stores a and its data.
+func (s *KVStore) StoreAsset(ctx context.Context, a *Asset, data []byte) error {
+	if a == nil || a.Name == "" {
+		return errors.New("invalid asset")
+	}
+	v, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshal asset: %w", err)
+	}
+	// store the data first so the asset never references missing data
+	if err = s.b.Set(ctx, keyPfxData+a.Name, data); err != nil {
+		return fmt.Errorf("storing data: %w", err)
+	}
+	return s.b.Set(ctx, keyPfxAsset+a.Name, v)
+}
+
+// retrieveAsset retrieves asset name without its data.
+func (s *KVStore) retrieveAsset(ctx context.Context, name string) (*Asset, error) {
+	v, err := s.b.Get(ctx, keyPfxAsset+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	a := new(Asset)
+	if err = json.Unmarshal(v, a); err != nil {
+		return nil, fmt.Errorf("unmarshal asset %s: %w", name, err)
+	}
+	return a, nil
+}
+
+// RetrieveAsset retrieves asset name and its data.
+func (s *KVStore) RetrieveAsset(ctx context.Context, name string) (*Asset, []byte, error) {
+	a, err := s.retrieveAsset(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := s.b.Get(ctx, keyPfxData+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("getting data: %w", err)
+	}
+	return a, data, nil
+}
+
+// RetrieveAssets retrieves all assets without their data.
+func (s *KVStore) RetrieveAssets(ctx context.Context) ([]*Asset, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPfxAsset)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var assets []*Asset
+	for _, key := range keys {
+		a, err := s.retrieveAsset(ctx, key[len(keyPfxAsset):])
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return assets, err
+		}
+		assets = append(assets, a)
+	}
+	return assets, nil
+}
+
+// DeleteAsset deletes asset name and its data.
+func (s *KVStore) DeleteAsset(ctx context.Context, name string) error {
+	if err := s.b.Delete(ctx, keyPfxAsset+name); err != nil {
+		return err
+	}
+	return s.b.Delete(ctx, keyPfxData+name)
+}
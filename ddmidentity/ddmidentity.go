@@ -0,0 +1,444 @@
+// Package ddmidentity generates per-enrollment Declarative Management
+// identity declarations.
+//
+// Each enrollment is assigned a DM set with a credential asset
+// declaration (SCEP or ACME) and a com.apple.configuration.security.identity
+// declaration referencing it. The credential data is hosted as a
+// ddmasset asset. Assigning again generates new credential data (e.g.
+// a new one-time SCEP challenge) which makes enrollments obtain a new
+// identity, so certificate renewal can be driven declaratively.
+package ddmidentity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/ddmasset"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Credential types.
+const (
+	TypeSCEP = "scep"
+	TypeACME = "acme"
+)
+
+const (
+	// ConfigurationType is the type of the identity declarations.
+	ConfigurationType = "com.apple.configuration.security.identity"
+
+	// IdentifierPrefix prefixes the identifiers of the declarations
+	// and the names of the sets generated by this package.
+	IdentifierPrefix = "io.micromdm.nanohub.ddmidentity."
+
+	// assetPrefix prefixes the names of the credential assets.
+	assetPrefix = "ddmidentity-"
+)
+
+var (
+	// ErrInvalidConfig is returned for invalid identity configurations.
+	ErrInvalidConfig = errors.New("invalid identity config")
+
+	// ErrNoIDs is returned when no enrollment IDs are provided.
+	ErrNoIDs = errors.New("no ids provided")
+)
+
+// assetTypes maps credential types to their asset declaration types.
+var assetTypes = map[string]string{
+	TypeSCEP: "com.apple.asset.credential.scep",
+	TypeACME: "com.apple.asset.credential.acme",
+}
+
+// credentialTypes maps credential types to their asset data types.
+var credentialTypes = map[string]string{
+	TypeSCEP: "com.apple.credential.scep",
+	TypeACME: "com.apple.credential.acme",
+}
+
+// Config configures the generated identity declarations.
+type Config struct {
+	// Type is the credential type, TypeSCEP or TypeACME.
+	Type string `json:"type"`
+
+	// Credential is the value of the credential asset data, e.g. the
+	// URL, Subject, and KeyType of a SCEP credential.
+	// SCEP credentials get a Challenge from the challenge function if
+	// configured. ACME credentials get the enrollment ID as their
+	// ClientIdentifier unless set.
+	Credential map[string]interface{} `json:"credential"`
+
+	AllowAllAppsAccess bool `json:"allow_all_apps_access,omitempty"`
+	KeyIsExtractable   bool `json:"key_is_extractable,omitempty"`
+}
+
+// Validate checks c for required fields.
+func (c *Config) Validate() error {
+	if c == nil {
+		return fmt.Errorf("%w: nil config", ErrInvalidConfig)
+	}
+	var required string
+	switch c.Type {
+	case TypeSCEP:
+		required = "URL"
+	case TypeACME:
+		required = "DirectoryURL"
+	default:
+		return fmt.Errorf("%w: unknown type: %q", ErrInvalidConfig, c.Type)
+	}
+	if s, _ := c.Credential[required].(string); s == "" {
+		return fmt.Errorf("%w: missing credential %s", ErrInvalidConfig, required)
+	}
+	return nil
+}
+
+// ParseConfig parses and validates a JSON identity configuration.
+func ParseConfig(data []byte) (*Config, error) {
+	c := new(Config)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return c, c.Validate()
+}
+
+// Record is the identity assignment of an enrollment.
+type Record struct {
+	ID string `json:"id"`
+
+	// Asset is the name of the current credential asset.
+	Asset string `json:"asset"`
+
+	Set          string   `json:"set"`
+	Declarations []string `json:"declarations"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store stores identity assignment records.
+type Store interface {
+	StoreRecord(ctx context.Context, r *Record) error
+
+	// RetrieveRecord retrieves the record of id.
+	// Nil is returned if id has no record.
+	RetrieveRecord(ctx context.Context, id string) (*Record, error)
+
+	DeleteRecord(ctx context.Context, id string) error
+}
+
+// DeclarationStore stores declarations and their DM sets.
+type DeclarationStore interface {
+	StoreDeclaration(ctx context.Context, d *ddm.Declaration) (bool, error)
+	DeleteDeclaration(ctx context.Context, declarationID string) (bool, error)
+	StoreSetDeclaration(ctx context.Context, setName, declarationID string) (bool, error)
+	RemoveSetDeclaration(ctx context.Context, setName, declarationID string) (bool, error)
+	StoreEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+	RemoveEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+}
+
+// AssetStore stores credential assets.
+type AssetStore interface {
+	StoreAsset(ctx context.Context, a *ddmasset.Asset, data []byte) error
+	DeleteAsset(ctx context.Context, name string) error
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(ctx context.Context, declarations []string, sets []string, ids []string) error
+
+// Changed calls f(ctx, declarations, sets, ids).
+func (f NotifierFunc) Changed(ctx context.Context, declarations []string, sets []string, ids []string) error {
+	return f(ctx, declarations, sets, ids)
+}
+
+// ChallengeFunc issues one-time SCEP challenges.
+type ChallengeFunc func(ctx context.Context) (string, error)
+
+// Manager assigns identity declarations to enrollments.
+type Manager struct {
+	config   *Config
+	store    Store
+	decls    DeclarationStore
+	assets   AssetStore
+	notifier Notifier
+	baseURL  string
+
+	challenge ChallengeFunc
+	logger    log.Logger
+	clock     clock.Clock
+}
+
+// Option configures the manager.
+type Option func(*Manager)
+
+// WithChallenges issues SCEP challenges for each generated credential.
+func WithChallenges(f ChallengeFunc) Option {
+	return func(m *Manager) {
+		m.challenge = f
+	}
+}
+
+// WithLogger configures a logger for the manager.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithClock configures the clock of the manager.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// NewManager creates a new identity manager generating declarations
+// from config. Credential assets are served from baseURL.
+func NewManager(config *Config, store Store, decls DeclarationStore, assets AssetStore, notifier Notifier, baseURL string, opts ...Option) (*Manager, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if store == nil || decls == nil || assets == nil || notifier == nil {
+		panic("nil dependency")
+	}
+	if baseURL == "" {
+		return nil, errors.New("empty base URL")
+	}
+	m := &Manager{
+		config:   config,
+		store:    store,
+		decls:    decls,
+		assets:   assets,
+		notifier: notifier,
+		baseURL:  baseURL,
+		logger:   log.NopLogger,
+		clock:    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
+}
+
+// SetName returns the name of the DM set of enrollment id.
+func SetName(id string) string {
+	return IdentifierPrefix + id
+}
+
+// assetName returns a new unguessable credential asset name.
+// Assets are served to any enrollment so the name protects the
+// credential (e.g. its challenge) of the enrollment.
+func assetName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return assetPrefix + hex.EncodeToString(b) + ".json", nil
+}
+
+// credential generates the credential asset data for enrollment id.
+func (m *Manager) credential(ctx context.Context, id string) ([]byte, error) {
+	value := make(map[string]interface{}, len(m.config.Credential)+1)
+	for k, v := range m.config.Credential {
+		value[k] = v
+	}
+	switch m.config.Type {
+	case TypeSCEP:
+		if m.challenge != nil {
+			c, err := m.challenge(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("issuing challenge: %w", err)
+			}
+			value["Challenge"] = c
+		}
+	case TypeACME:
+		if _, ok := value["ClientIdentifier"]; !ok {
+			value["ClientIdentifier"] = id
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"Type":  credentialTypes[m.config.Type],
+		"Value": value,
+	})
+}
+
+// Declarations generates the credential asset and identity
+// declarations of enrollment id referencing asset a.
+func (m *Manager) Declarations(id string, a *ddmasset.Asset) ([]*ddm.Declaration, error) {
+	assetID := IdentifierPrefix + id + ".credential"
+	assetPayload, err := json.Marshal(map[string]interface{}{
+		"Reference":      a.Reference(m.baseURL),
+		"Authentication": map[string]string{"Type": "MDM"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal asset payload: %w", err)
+	}
+	identityPayload, err := json.Marshal(map[string]interface{}{
+		"CredentialAssetReference": assetID,
+		"AllowAllAppsAccess":       m.config.AllowAllAppsAccess,
+		"KeyIsExtractable":         m.config.KeyIsExtractable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal identity payload: %w", err)
+	}
+	return []*ddm.Declaration{
+		{
+			Identifier: assetID,
+			Type:       assetTypes[m.config.Type],
+			Payload:    assetPayload,
+		},
+		{
+			Identifier: IdentifierPrefix + id + ".identity",
+			Type:       ConfigurationType,
+			Payload:    identityPayload,
+		},
+	}, nil
+}
+
+// assign generates a new credential for id and assigns its declarations.
+func (m *Manager) assign(ctx context.Context, id string) error {
+	prev, err := m.store.RetrieveRecord(ctx, id)
+	if err != nil {
+		return fmt.Errorf("retrieving record: %w", err)
+	}
+
+	data, err := m.credential(ctx, id)
+	if err != nil {
+		return err
+	}
+	name, err := assetName()
+	if err != nil {
+		return fmt.Errorf("generating asset name: %w", err)
+	}
+	a, err := ddmasset.NewAsset(name, "application/json", data, m.clock.Now())
+	if err != nil {
+		return err
+	}
+	if err = m.assets.StoreAsset(ctx, a, data); err != nil {
+		return fmt.Errorf("storing asset: %w", err)
+	}
+
+	decls, err := m.Declarations(id, a)
+	if err != nil {
+		return err
+	}
+	rec := &Record{ID: id, Asset: name, Set: SetName(id), UpdatedAt: m.clock.Now()}
+	for _, d := range decls {
+		if _, err = m.decls.StoreDeclaration(ctx, d); err != nil {
+			return fmt.Errorf("storing declaration %s: %w", d.Identifier, err)
+		}
+		if _, err = m.decls.StoreSetDeclaration(ctx, rec.Set, d.Identifier); err != nil {
+			return fmt.Errorf("storing set declaration %s: %w", d.Identifier, err)
+		}
+		rec.Declarations = append(rec.Declarations, d.Identifier)
+	}
+	if _, err = m.decls.StoreEnrollmentSet(ctx, id, rec.Set); err != nil {
+		return fmt.Errorf("storing set: %w", err)
+	}
+	if err = m.store.StoreRecord(ctx, rec); err != nil {
+		return fmt.Errorf("storing record: %w", err)
+	}
+
+	// the declarations no longer reference the previous credential
+	if prev != nil && prev.Asset != "" && prev.Asset != name {
+		if err = m.assets.DeleteAsset(ctx, prev.Asset); err != nil && !errors.Is(err, ddmasset.ErrNotFound) {
+			return fmt.Errorf("deleting previous asset: %w", err)
+		}
+	}
+	return nil
+}
+
+// Assign assigns identity declarations with newly generated credentials
+// to ids and notifies them. Assigning enrollments that already have
+// identity declarations renews their identities.
+func (m *Manager) Assign(ctx context.Context, ids []string) error {
+	if len(ids) < 1 {
+		return ErrNoIDs
+	}
+	for _, id := range ids {
+		if err := m.assign(ctx, id); err != nil {
+			return fmt.Errorf("assigning identity to %s: %w", id, err)
+		}
+	}
+	ctxlog.Logger(ctx, m.logger).Debug(
+		"msg", "assigned identities",
+		"count", len(ids),
+	)
+	return m.notifier.Changed(ctx, nil, nil, ids)
+}
+
+// remove removes the identity declarations and credential of id.
+// It reports whether id had identity declarations.
+func (m *Manager) remove(ctx context.Context, id string) (bool, error) {
+	rec, err := m.store.RetrieveRecord(ctx, id)
+	if err != nil || rec == nil {
+		return false, err
+	}
+	if _, err = m.decls.RemoveEnrollmentSet(ctx, id, rec.Set); err != nil {
+		return true, fmt.Errorf("removing set: %w", err)
+	}
+	// delete the identity before the asset it references
+	for i := len(rec.Declarations) - 1; i >= 0; i-- {
+		d := rec.Declarations[i]
+		if _, err = m.decls.RemoveSetDeclaration(ctx, rec.Set, d); err != nil {
+			return true, fmt.Errorf("removing set declaration %s: %w", d, err)
+		}
+		if _, err = m.decls.DeleteDeclaration(ctx, d); err != nil {
+			return true, fmt.Errorf("deleting declaration %s: %w", d, err)
+		}
+	}
+	if err = m.assets.DeleteAsset(ctx, rec.Asset); err != nil && !errors.Is(err, ddmasset.ErrNotFound) {
+		return true, fmt.Errorf("deleting asset: %w", err)
+	}
+	return true, m.store.DeleteRecord(ctx, id)
+}
+
+// Remove removes the identity declarations from ids and notifies the
+// enrollments that had them. Removing the declarations removes the
+// identities from the enrollments.
+func (m *Manager) Remove(ctx context.Context, ids []string) error {
+	if len(ids) < 1 {
+		return ErrNoIDs
+	}
+	var removed []string
+	for _, id := range ids {
+		found, err := m.remove(ctx, id)
+		if err != nil {
+			return fmt.Errorf("removing identity from %s: %w", id, err)
+		}
+		if found {
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) < 1 {
+		return nil
+	}
+	ctxlog.Logger(ctx, m.logger).Debug(
+		"msg", "removed identities",
+		"count", len(removed),
+	)
+	return m.notifier.Changed(ctx, nil, nil, removed)
+}
+
+// Record retrieves the identity assignment of id.
+// Nil is returned if id has no identity declarations.
+func (m *Manager) Record(ctx context.Context, id string) (*Record, error) {
+	return m.store.RetrieveRecord(ctx, id)
+}
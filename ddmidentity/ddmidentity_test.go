@@ -0,0 +1,152 @@
+package ddmidentity
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/micromdm/nanohub/ddmasset"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+type declStore struct {
+	decls   map[string]*ddm.Declaration
+	setDecl map[string]map[string]bool
+	enrSets map[string]string
+}
+
+func (s *declStore) StoreDeclaration(_ context.Context, d *ddm.Declaration) (bool, error) {
+	s.decls[d.Identifier] = d
+	return true, nil
+}
+
+func (s *declStore) DeleteDeclaration(_ context.Context, declarationID string) (bool, error) {
+	delete(s.decls, declarationID)
+	return true, nil
+}
+
+func (s *declStore) StoreSetDeclaration(_ context.Context, setName, declarationID string) (bool, error) {
+	if s.setDecl[setName] == nil {
+		s.setDecl[setName] = make(map[string]bool)
+	}
+	s.setDecl[setName][declarationID] = true
+	return true, nil
+}
+
+func (s *declStore) RemoveSetDeclaration(_ context.Context, setName, declarationID string) (bool, error) {
+	delete(s.setDecl[setName], declarationID)
+	return true, nil
+}
+
+func (s *declStore) StoreEnrollmentSet(_ context.Context, enrollmentID, setName string) (bool, error) {
+	s.enrSets[enrollmentID] = setName
+	return true, nil
+}
+
+func (s *declStore) RemoveEnrollmentSet(_ context.Context, enrollmentID, _ string) (bool, error) {
+	delete(s.enrSets, enrollmentID)
+	return true, nil
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+
+	config, err := ParseConfig([]byte(`{"type":"scep","credential":{"URL":"https://ca.example.com/scep","Subject":[[["CN","test"]]]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls := &declStore{
+		decls:   make(map[string]*ddm.Declaration),
+		setDecl: make(map[string]map[string]bool),
+		enrSets: make(map[string]string),
+	}
+	assets := ddmasset.NewKVStore(kvmap.New())
+	var notified []string
+	notifier := NotifierFunc(func(_ context.Context, _, _, ids []string) error {
+		notified = append(notified, ids...)
+		return nil
+	})
+	challenges := 0
+	m, err := NewManager(config, NewKVStore(kvmap.New()), decls, assets, notifier, "https://mdm.example.com/",
+		WithChallenges(func(context.Context) (string, error) {
+			challenges++
+			return "challenge", nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Assign(ctx, []string{"AAA"}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := decls.enrSets["AAA"], SetName("AAA"); have != want {
+		t.Errorf("set: have %q, want %q", have, want)
+	}
+	if have, want := len(decls.setDecl[SetName("AAA")]), 2; have != want {
+		t.Fatalf("set declarations: have %d, want %d", have, want)
+	}
+	rec, err := m.Record(ctx, "AAA")
+	if err != nil || rec == nil {
+		t.Fatalf("record: %v %v", rec, err)
+	}
+	_, data, err := assets.RetrieveAsset(ctx, rec.Asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cred struct {
+		Type  string
+		Value map[string]interface{}
+	}
+	if err = json.Unmarshal(data, &cred); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := cred.Type, "com.apple.credential.scep"; have != want {
+		t.Errorf("credential type: have %q, want %q", have, want)
+	}
+	if have, want := cred.Value["Challenge"], "challenge"; have != want {
+		t.Errorf("challenge: have %v, want %q", have, want)
+	}
+
+	identity := decls.decls[IdentifierPrefix+"AAA.identity"]
+	if identity == nil || identity.Type != ConfigurationType {
+		t.Fatalf("identity declaration: %v", identity)
+	}
+	var payload struct{ CredentialAssetReference string }
+	if err = json.Unmarshal(identity.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if decls.decls[payload.CredentialAssetReference] == nil {
+		t.Errorf("missing asset declaration %q", payload.CredentialAssetReference)
+	}
+
+	// renewing replaces the credential asset
+	if err = m.Assign(ctx, []string{"AAA"}); err != nil {
+		t.Fatal(err)
+	}
+	renewed, _ := m.Record(ctx, "AAA")
+	if renewed.Asset == rec.Asset {
+		t.Error("asset not replaced")
+	}
+	if _, _, err = assets.RetrieveAsset(ctx, rec.Asset); err != ddmasset.ErrNotFound {
+		t.Errorf("previous asset: have %v, want %v", err, ddmasset.ErrNotFound)
+	}
+	if have, want := challenges, 2; have != want {
+		t.Errorf("challenges: have %d, want %d", have, want)
+	}
+
+	if err = m.Remove(ctx, []string{"AAA", "BBB"}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(decls.decls), 0; have != want {
+		t.Errorf("declarations: have %d, want %d", have, want)
+	}
+	if rec, _ = m.Record(ctx, "AAA"); rec != nil {
+		t.Errorf("record not removed: %v", rec)
+	}
+	if have, want := len(notified), 3; have != want {
+		t.Errorf("notified: have %d, want %d", have, want)
+	}
+}
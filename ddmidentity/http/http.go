@@ -0,0 +1,126 @@
+// Package http provides the HTTP API for DM identity declarations.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/ddmidentity"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when an enrollment has no identity declarations.
+	ErrNotFound = errors.New("no identity declarations")
+)
+
+// AssignHandler assigns identity declarations with new credentials to
+// the enrollment IDs in the "id" query parameters.
+func AssignHandler(m *ddmidentity.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ddmidentity.ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		if err := m.Assign(r.Context(), ids); err != nil {
+			logger.Info("msg", "assigning identities", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RemoveHandler removes the identity declarations from the enrollment
+// IDs in the "id" query parameters.
+func RemoveHandler(m *ddmidentity.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ddmidentity.ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		if err := m.Remove(r.Context(), ids); err != nil {
+			logger.Info("msg", "removing identities", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetHandler returns the identity assignment of the enrollment ID in
+// the URL path.
+func GetHandler(m *ddmidentity.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		rec, err := m.Record(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving identity record", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if rec == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, rec, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM identity API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, m *ddmidentity.Manager) {
+	mux.Handle(
+		prefix+"/dm/identities",
+		AssignHandler(m, logger.With("handler", "assign-dm-identities")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dm/identities",
+		RemoveHandler(m, logger.With("handler", "remove-dm-identities")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/dm/identity",
+		GetHandler(m, logger.With("handler", "get-dm-identity")),
+		"GET",
+	)
+}
@@ -0,0 +1,55 @@
+package ddmidentity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores identity assignment records in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new record store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreRecord stores r, replacing the record of r.ID.
+func (s *KVStore) StoreRecord(ctx context.Context, r *Record) error {
+	if r == nil || r.ID == "" {
+		return errors.New("invalid record")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	return s.b.Set(ctx, r.ID, v)
+}
+
+// RetrieveRecord retrieves the record of enrollment id.
+func (s *KVStore) RetrieveRecord(ctx context.Context, id string) (*Record, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Record)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal record: %w", err)
+	}
+	return r, nil
+}
+
+// DeleteRecord deletes the record of enrollment id.
+func (s *KVStore) DeleteRecord(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
@@ -0,0 +1,79 @@
+// Package http provides the HTTP API for DDM predicate simulation.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/ddmpredicate"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNoPredicate is returned when neither a declaration nor a predicate is provided.
+	ErrNoPredicate = errors.New("no declaration or predicate provided")
+)
+
+// SimulateHandler evaluates a predicate for an enrollment.
+// The "id" query parameter is the enrollment ID. The "declaration"
+// query parameter selects an activation declaration whose predicate
+// is evaluated or the "predicate" query parameter provides one directly.
+func SimulateHandler(s *ddmpredicate.Simulator, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil simulator")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := r.URL.Query()
+		id := q.Get("id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		var result *ddmpredicate.Result
+		var err error
+		if declaration := q.Get("declaration"); declaration != "" {
+			result, err = s.Activation(r.Context(), id, declaration)
+		} else if predicate := q.Get("predicate"); predicate != "" {
+			result, err = s.Predicate(r.Context(), id, predicate)
+		} else {
+			err = ErrNoPredicate
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, ErrNoPredicate),
+				errors.Is(err, ddmpredicate.ErrSyntax),
+				errors.Is(err, ddmpredicate.ErrNotActivation):
+				status = http.StatusBadRequest
+			case errors.Is(err, ddmpredicate.ErrNotFound):
+				status = http.StatusNotFound
+			default:
+				logger.Info("msg", "simulating predicate", "id", id, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		logger.Debug("msg", "simulated predicate", "id", id, "result", result.Result)
+		httpapi.WriteJSON(w, result, logger)
+	}
+}
+
+// HandleAPIv1 registers the predicate simulation API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, s *ddmpredicate.Simulator) {
+	mux.Handle(
+		prefix+"/ddm/predicate",
+		SimulateHandler(s, logger.With("handler", "simulate-predicate")),
+		"GET",
+	)
+}
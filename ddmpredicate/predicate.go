@@ -0,0 +1,587 @@
+// Package ddmpredicate evaluates Declarative Device Management
+// activation predicates against an enrollment's management properties
+// and status values.
+//
+// Predicates use a subset of the NSPredicate syntax that Apple devices
+// evaluate: comparisons of @status(item) and @property(key) values
+// with literals combined with AND, OR, and NOT.
+package ddmpredicate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrSyntax is returned for predicates that can't be parsed.
+var ErrSyntax = errors.New("predicate syntax error")
+
+// Values resolves the values referenced by a predicate.
+// A nil value means the value was not found.
+type Values interface {
+	Status(item string) interface{}
+	Property(key string) interface{}
+}
+
+// Predicate is a parsed predicate.
+type Predicate struct {
+	src  string
+	root node
+}
+
+// Parse parses a predicate.
+func Parse(s string) (*Predicate, error) {
+	p := &parser{lex: &lexer{src: s}}
+	p.next()
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return &Predicate{src: s, root: root}, nil
+}
+
+// String returns the source of the predicate.
+func (p *Predicate) String() string {
+	return p.src
+}
+
+// Evaluate evaluates the predicate with v.
+// The trace explains the result of each comparison.
+func (p *Predicate) Evaluate(v Values) (result bool, trace []string) {
+	e := &evaluator{values: v}
+	result = p.root.eval(e)
+	return result, e.trace
+}
+
+type evaluator struct {
+	values Values
+	trace  []string
+}
+
+func (e *evaluator) tracef(format string, args ...interface{}) {
+	e.trace = append(e.trace, fmt.Sprintf(format, args...))
+}
+
+// nodes
+
+type node interface {
+	eval(e *evaluator) bool
+}
+
+type boolNode bool
+
+func (n boolNode) eval(e *evaluator) bool {
+	if n {
+		e.tracef("TRUEPREDICATE: true")
+	} else {
+		e.tracef("FALSEPREDICATE: false")
+	}
+	return bool(n)
+}
+
+type notNode struct{ n node }
+
+func (n *notNode) eval(e *evaluator) bool { return !n.n.eval(e) }
+
+type andNode struct{ l, r node }
+
+// eval short-circuits like the device does.
+func (n *andNode) eval(e *evaluator) bool { return n.l.eval(e) && n.r.eval(e) }
+
+type orNode struct{ l, r node }
+
+func (n *orNode) eval(e *evaluator) bool { return n.l.eval(e) || n.r.eval(e) }
+
+// operand is a literal or a reference to a status item or property.
+type operand struct {
+	kind  string // "status", "property", or "" for literals
+	name  string
+	value interface{}
+}
+
+func (o *operand) resolve(e *evaluator) interface{} {
+	switch o.kind {
+	case "status":
+		return e.values.Status(o.name)
+	case "property":
+		return e.values.Property(o.name)
+	}
+	return o.value
+}
+
+func (o *operand) String() string {
+	if o.kind != "" {
+		return "@" + o.kind + "(" + o.name + ")"
+	}
+	return format(o.value)
+}
+
+type compareNode struct {
+	l, r            *operand
+	op              string
+	caseInsensitive bool
+}
+
+func (n *compareNode) eval(e *evaluator) bool {
+	l, r := n.l.resolve(e), n.r.resolve(e)
+	result := compare(n.op, l, r, n.caseInsensitive)
+	var refs []string
+	for i, o := range []*operand{n.l, n.r} {
+		if o.kind == "" {
+			continue
+		}
+		v := l
+		if i > 0 {
+			v = r
+		}
+		if v == nil {
+			refs = append(refs, o.String()+" is not set")
+		} else {
+			refs = append(refs, o.String()+" is "+format(v))
+		}
+	}
+	detail := ""
+	if len(refs) > 0 {
+		detail = " (" + strings.Join(refs, ", ") + ")"
+	}
+	e.tracef("%s %s %s: %t%s", n.l, n.op, n.r, result, detail)
+	return result
+}
+
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NIL"
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		s := make([]string, len(v))
+		for i := range v {
+			s[i] = format(v[i])
+		}
+		return "{" + strings.Join(s, ", ") + "}"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// number returns v as a number if possible.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// order compares l and r and reports whether they are comparable.
+func order(l, r interface{}, ci bool) (int, bool) {
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		if ci {
+			ls, rs = strings.ToLower(ls), strings.ToLower(rs)
+		}
+		return strings.Compare(ls, rs), true
+	}
+	lf, lok := number(l)
+	rf, rok := number(r)
+	if !lok || !rok {
+		return 0, false
+	}
+	switch {
+	case lf < rf:
+		return -1, true
+	case lf > rf:
+		return 1, true
+	}
+	return 0, true
+}
+
+func equal(l, r interface{}, ci bool) bool {
+	if l == nil || r == nil {
+		return l == nil && r == nil
+	}
+	c, ok := order(l, r, ci)
+	return ok && c == 0
+}
+
+func compare(op string, l, r interface{}, ci bool) bool {
+	switch op {
+	case "==":
+		return equal(l, r, ci)
+	case "!=":
+		return !equal(l, r, ci)
+	case "<", "<=", ">", ">=":
+		if l == nil || r == nil {
+			return false
+		}
+		c, ok := order(l, r, ci)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	case "IN":
+		return contains(r, l, ci)
+	case "CONTAINS":
+		return contains(l, r, ci)
+	}
+
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if !lok || !rok {
+		return false
+	}
+	if ci {
+		ls, rs = strings.ToLower(ls), strings.ToLower(rs)
+	}
+	switch op {
+	case "BEGINSWITH":
+		return strings.HasPrefix(ls, rs)
+	case "ENDSWITH":
+		return strings.HasSuffix(ls, rs)
+	case "LIKE":
+		rs = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(rs))
+		fallthrough
+	case "MATCHES":
+		re, err := regexp.Compile("^(?:" + rs + ")$")
+		return err == nil && re.MatchString(ls)
+	}
+	return false
+}
+
+// contains reports whether the array or string container contains v.
+func contains(container, v interface{}, ci bool) bool {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if equal(item, v, ci) {
+				return true
+			}
+		}
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		if ci {
+			c, s = strings.ToLower(c), strings.ToLower(s)
+		}
+		return strings.Contains(c, s)
+	}
+	return false
+}
+
+// lexer
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokRef // @status(...) or @property(...)
+	tokPunct
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '"' || c == '\'':
+		var b strings.Builder
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			switch l.src[l.pos] {
+			case c:
+				l.pos++
+				return token{kind: tokString, text: b.String(), pos: start}, nil
+			case '\\':
+				if l.pos+1 < len(l.src) {
+					l.pos++
+				}
+			}
+			b.WriteByte(l.src[l.pos])
+		}
+		return token{}, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, start)
+	case c == '@':
+		i := strings.IndexByte(l.src[l.pos:], ')')
+		if i < 0 {
+			return token{}, fmt.Errorf("%w: unterminated reference at %d", ErrSyntax, start)
+		}
+		l.pos += i + 1
+		return token{kind: tokRef, text: l.src[start:l.pos], pos: start}, nil
+	case c >= '0' && c <= '9' || c == '-' || c == '.':
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			c := l.src[l.pos]
+			if !(c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E') {
+				break
+			}
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case unicode.IsLetter(rune(c)) || c == '_':
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			c := rune(l.src[l.pos])
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+				break
+			}
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	case c == '[':
+		i := strings.IndexByte(l.src[l.pos:], ']')
+		if i < 0 {
+			return token{}, fmt.Errorf("%w: unterminated option at %d", ErrSyntax, start)
+		}
+		l.pos += i + 1
+		return token{kind: tokPunct, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, p := range []string{"==", "!=", "<>", "<=", ">=", "=<", "=>", "&&", "||", "(", ")", "{", "}", ",", "<", ">", "=", "!"} {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos += len(p)
+			return token{kind: tokPunct, text: p, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, start)
+}
+
+// parser
+
+type parser struct {
+	lex *lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("%w: %s at %d", ErrSyntax, fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+// keyword reports whether the current token is one of the (case-insensitive) keywords.
+func (p *parser) keyword(kw ...string) bool {
+	if p.tok.kind != tokIdent && p.tok.kind != tokPunct {
+		return false
+	}
+	for _, k := range kw {
+		if strings.EqualFold(p.tok.text, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR", "||") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &orNode{l, r}
+	}
+	return l, p.err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND", "&&") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &andNode{l, r}
+	}
+	return l, p.err
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.keyword("NOT", "!") {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	switch {
+	case p.err != nil:
+		return nil, p.err
+	case p.keyword("("):
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return n, nil
+	case p.keyword("TRUEPREDICATE"):
+		p.next()
+		return boolNode(true), nil
+	case p.keyword("FALSEPREDICATE"):
+		p.next()
+		return boolNode(false), nil
+	}
+	return p.parseComparison()
+}
+
+var operators = map[string]string{
+	"==": "==", "=": "==", "!=": "!=", "<>": "!=",
+	"<": "<", "<=": "<=", "=<": "<=", ">": ">", ">=": ">=", "=>": ">=",
+	"BEGINSWITH": "BEGINSWITH", "ENDSWITH": "ENDSWITH", "CONTAINS": "CONTAINS",
+	"LIKE": "LIKE", "MATCHES": "MATCHES", "IN": "IN",
+}
+
+func (p *parser) parseComparison() (node, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := operators[strings.ToUpper(p.tok.text)]
+	if !ok || (p.tok.kind != tokIdent && p.tok.kind != tokPunct) {
+		return nil, p.errorf("expected operator, got %q", p.tok.text)
+	}
+	n := &compareNode{l: l, op: op}
+	p.next()
+	if p.tok.kind == tokPunct && strings.HasPrefix(p.tok.text, "[") {
+		// [c] is case-insensitive, [d] (diacritic-insensitive) is ignored
+		n.caseInsensitive = strings.ContainsAny(p.tok.text, "cC")
+		p.next()
+	}
+	if n.r, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (p *parser) parseOperand() (*operand, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokRef:
+		i := strings.IndexByte(tok.text, '(')
+		if i < 0 {
+			return nil, p.errorf("invalid reference %s", tok.text)
+		}
+		kind := strings.ToLower(tok.text[1:i])
+		if kind != "status" && kind != "property" {
+			return nil, p.errorf("unknown reference %s", tok.text)
+		}
+		p.next()
+		return &operand{kind: kind, name: strings.TrimSpace(tok.text[i+1 : len(tok.text)-1])}, p.err
+	case tokString:
+		p.next()
+		return &operand{value: tok.text}, p.err
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.text)
+		}
+		p.next()
+		return &operand{value: f}, p.err
+	case tokIdent:
+		var v interface{}
+		switch strings.ToUpper(tok.text) {
+		case "TRUE", "YES":
+			v = true
+		case "FALSE", "NO":
+			v = false
+		case "NIL", "NULL":
+			v = nil
+		default:
+			return nil, p.errorf("unexpected %q", tok.text)
+		}
+		p.next()
+		return &operand{value: v}, p.err
+	}
+	if p.keyword("{") {
+		var items []interface{}
+		for p.next(); !p.keyword("}"); {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if o.kind != "" {
+				return nil, p.errorf("references are not allowed in arrays")
+			}
+			items = append(items, o.value)
+			if p.keyword(",") {
+				p.next()
+			} else if !p.keyword("}") {
+				return nil, p.errorf("expected , or }")
+			}
+		}
+		p.next()
+		return &operand{value: items}, p.err
+	}
+	return nil, p.errorf("expected value, got %q", tok.text)
+}
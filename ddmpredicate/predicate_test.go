@@ -0,0 +1,69 @@
+package ddmpredicate
+
+import (
+	"errors"
+	"testing"
+)
+
+type testValues map[string]interface{}
+
+func (v testValues) Status(item string) interface{} { return v["status:"+item] }
+
+func (v testValues) Property(key string) interface{} { return v["property:"+key] }
+
+func TestEvaluate(t *testing.T) {
+	v := testValues{
+		"status:device.model.family":           "iPad",
+		"status:device.operating-system.major": 17.0,
+		"status:device.operating-system.build": "21A329",
+		"property:shard":                       42.0,
+		"property:groups":                      []interface{}{"eng", "ops"},
+	}
+	for _, test := range []struct {
+		predicate string
+		result    bool
+	}{
+		{`TRUEPREDICATE`, true},
+		{`@status(device.model.family) == "iPad"`, true},
+		{`@status(device.model.family) = 'ipad'`, false},
+		{`@status(device.model.family) ==[c] 'ipad'`, true},
+		{`@status(device.operating-system.major) >= 17`, true},
+		{`@status(device.operating-system.build) BEGINSWITH "21"`, true},
+		{`@property(shard) < 50 AND @property(shard) >= 0`, true},
+		{`@property(shard) < 10 OR NOT (@status(device.model.family) IN {"Mac", "iPhone"})`, true},
+		{`@property(groups) CONTAINS "ops"`, true},
+		{`@property(missing) == nil`, true},
+		{`@property(missing) != "x"`, true},
+		{`@property(missing) > 1`, false},
+		{`@status(device.operating-system.build) LIKE "21A*"`, true},
+		{`@status(device.operating-system.build) MATCHES "[0-9]+A[0-9]+"`, true},
+	} {
+		p, err := Parse(test.predicate)
+		if err != nil {
+			t.Errorf("%s: %v", test.predicate, err)
+			continue
+		}
+		result, trace := p.Evaluate(v)
+		if result != test.result {
+			t.Errorf("%s: have: %v, want: %v (trace: %v)", test.predicate, result, test.result, trace)
+		}
+		if len(trace) < 1 {
+			t.Errorf("%s: empty trace", test.predicate)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, predicate := range []string{
+		``,
+		`@status(device.model.family) ==`,
+		`@status(device.model.family == "iPad"`,
+		`(@property(a) == 1`,
+		`@foo(a) == 1`,
+		`"unterminated`,
+	} {
+		if _, err := Parse(predicate); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: expected syntax error: %v", predicate, err)
+		}
+	}
+}
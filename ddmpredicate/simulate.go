@@ -0,0 +1,179 @@
+package ddmpredicate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	ddmstorage "github.com/jessepeterson/kmfddm/storage"
+)
+
+// Declaration types used by the simulator.
+const (
+	TypeActivation = "com.apple.activation.simple"
+	TypeProperties = "com.apple.management.properties"
+)
+
+var (
+	// ErrNotActivation is returned when the declaration is not an activation.
+	ErrNotActivation = errors.New("not an activation declaration")
+
+	// ErrNotFound is returned when the declaration does not exist.
+	ErrNotFound = errors.New("declaration not found")
+)
+
+// Store retrieves declarations and status values.
+type Store interface {
+	RetrieveDeclaration(ctx context.Context, declarationID string) (*ddm.Declaration, error)
+	RetrieveDeclarationItems(ctx context.Context, enrollmentID string) ([]*ddm.Declaration, error)
+	RetrieveEnrollmentDeclarationJSON(ctx context.Context, declarationID, declarationType, enrollmentID string) ([]byte, error)
+	RetrieveStatusValues(ctx context.Context, enrollmentIDs []string, pathPrefix string) (map[string][]ddmstorage.StatusValue, error)
+}
+
+// Result is the result of a predicate simulation.
+type Result struct {
+	EnrollmentID string   `json:"enrollment_id"`
+	Declaration  string   `json:"declaration,omitempty"`
+	Predicate    string   `json:"predicate"`
+	Result       bool     `json:"result"`
+	Trace        []string `json:"trace"`
+}
+
+// Simulator evaluates activation predicates for enrollments.
+type Simulator struct {
+	store Store
+}
+
+// NewSimulator creates a new simulator.
+func NewSimulator(store Store) *Simulator {
+	if store == nil {
+		panic("nil store")
+	}
+	return &Simulator{store: store}
+}
+
+// Activation evaluates the predicate of the activation declaration
+// declarationID for enrollment id. Activations without a predicate
+// always apply.
+func (s *Simulator) Activation(ctx context.Context, id, declarationID string) (*Result, error) {
+	d, err := s.store.RetrieveDeclaration(ctx, declarationID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration: %w", err)
+	}
+	if d == nil {
+		return nil, ErrNotFound
+	}
+	if d.Type != TypeActivation {
+		return nil, fmt.Errorf("%w: %s", ErrNotActivation, d.Type)
+	}
+	payload := struct{ Predicate string }{}
+	if err = json.Unmarshal(d.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("unmarshal activation payload: %w", err)
+	}
+	src := payload.Predicate
+	if strings.TrimSpace(src) == "" {
+		src = "TRUEPREDICATE"
+	}
+	r, err := s.Predicate(ctx, id, src)
+	if r != nil {
+		r.Declaration = declarationID
+	}
+	return r, err
+}
+
+// Predicate evaluates the predicate src for enrollment id.
+func (s *Simulator) Predicate(ctx context.Context, id, src string) (*Result, error) {
+	p, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	v, err := s.values(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r := &Result{EnrollmentID: id, Predicate: p.String()}
+	r.Result, r.Trace = p.Evaluate(v)
+	return r, nil
+}
+
+// values retrieves the management properties and status values of id.
+func (s *Simulator) values(ctx context.Context, id string) (*values, error) {
+	v := &values{status: make(map[string]interface{}), properties: make(map[string]interface{})}
+
+	items, err := s.store.RetrieveDeclarationItems(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration items: %w", err)
+	}
+	for _, item := range items {
+		if item.Type != TypeProperties {
+			continue
+		}
+		raw, err := s.store.RetrieveEnrollmentDeclarationJSON(ctx, item.Identifier, ddm.ManifestType(item.Type), id)
+		if errors.Is(err, ddmstorage.ErrDeclarationNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("retrieving declaration %s: %w", item.Identifier, err)
+		}
+		d, err := ddm.ParseDeclaration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing declaration %s: %w", item.Identifier, err)
+		}
+		props := make(map[string]interface{})
+		if err = json.Unmarshal(d.Payload, &props); err != nil {
+			return nil, fmt.Errorf("unmarshal properties %s: %w", item.Identifier, err)
+		}
+		for k, p := range props {
+			v.properties[k] = normalize(p)
+		}
+	}
+
+	statusValues, err := s.store.RetrieveStatusValues(ctx, []string{id}, "")
+	if err != nil {
+		return nil, fmt.Errorf("retrieving status values: %w", err)
+	}
+	for _, sv := range statusValues[id] {
+		var value interface{}
+		if err := json.Unmarshal([]byte(sv.Value), &value); err != nil {
+			// not JSON-encoded
+			value = sv.Value
+		}
+		v.status[statusItem(sv.Path)] = normalize(value)
+	}
+	return v, nil
+}
+
+// statusItem converts a status value path (such as
+// ".StatusItems.device.model.family") to a status item name.
+func statusItem(path string) string {
+	path = strings.TrimPrefix(path, ".")
+	return strings.TrimPrefix(path, "StatusItems.")
+}
+
+// normalize converts JSON values to predicate values.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, float64, bool, nil:
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	default:
+		// objects are not comparable
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+type values struct {
+	status     map[string]interface{}
+	properties map[string]interface{}
+}
+
+func (v *values) Status(item string) interface{} { return v.status[item] }
+
+func (v *values) Property(key string) interface{} { return v.properties[key] }
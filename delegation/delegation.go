@@ -0,0 +1,278 @@
+// Package delegation manages scoped, short-lived API tokens.
+// Administrators mint delegation tokens that permit specific actions
+// (e.g. enqueueing a DeviceLock command) against specific enrollments
+// for a limited time. Helpdesk tooling uses these tokens as HTTP Bearer
+// tokens in place of the API key.
+package delegation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/audit"
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultMaxTTL is the default maximum lifetime of delegation tokens.
+const DefaultMaxTTL = 24 * time.Hour
+
+var (
+	// ErrInvalidToken is returned for unknown or expired tokens.
+	ErrInvalidToken = errors.New("invalid delegation token")
+
+	// ErrNoIDs is returned when minting a delegation without enrollment IDs.
+	ErrNoIDs = errors.New("no enrollment ids")
+
+	// ErrNoScope is returned when minting a delegation that permits nothing.
+	ErrNoScope = errors.New("no commands, workflows, or read access")
+)
+
+// Delegation is a scoped API token grant.
+// The token itself is not stored; ID is the hash of the token.
+type Delegation struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// IDs are the enrollment IDs the delegation may act on.
+	IDs []string `json:"ids"`
+
+	// Commands are the MDM command request types that may be enqueued.
+	Commands []string `json:"commands,omitempty"`
+
+	// Workflows are the NanoCMD workflow names that may be started.
+	Workflows []string `json:"workflows,omitempty"`
+
+	// Read permits reading NanoHUB APIs of the enrollments.
+	Read bool `json:"read,omitempty"`
+
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired reports whether d is expired at t.
+func (d *Delegation) Expired(t time.Time) bool {
+	return !t.Before(d.ExpiresAt)
+}
+
+// Covers reports whether d permits acting on all of ids.
+// An empty ids is never covered.
+func (d *Delegation) Covers(ids []string) bool {
+	if len(ids) < 1 {
+		return false
+	}
+	for _, id := range ids {
+		if !contains(d.IDs, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Store stores delegations by ID.
+type Store interface {
+	StoreDelegation(ctx context.Context, d *Delegation) error
+
+	// RetrieveDelegation retrieves delegation id.
+	// Nil is returned if it does not exist.
+	RetrieveDelegation(ctx context.Context, id string) (*Delegation, error)
+
+	DeleteDelegation(ctx context.Context, id string) error
+	RetrieveDelegations(ctx context.Context) ([]*Delegation, error)
+}
+
+// Manager mints, authenticates, and revokes delegations.
+type Manager struct {
+	store   Store
+	auditor *audit.Auditor
+	maxTTL  time.Duration
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the manager.
+type Option func(*Manager)
+
+// WithAuditor records minted and revoked delegations with a.
+func WithAuditor(a *audit.Auditor) Option {
+	return func(m *Manager) {
+		m.auditor = a
+	}
+}
+
+// WithMaxTTL limits the lifetime of minted delegations to ttl.
+func WithMaxTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.maxTTL = ttl
+	}
+}
+
+// WithLogger configures a logger for the manager.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithClock configures the clock of the manager.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// New creates a new delegation manager.
+func New(store Store, opts ...Option) *Manager {
+	if store == nil {
+		panic("nil store")
+	}
+	m := &Manager{
+		store:  store,
+		maxTTL: DefaultMaxTTL,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// hashToken returns the delegation ID of token.
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Mint creates delegation d valid for ttl and returns its token.
+// The ttl is capped at the maximum lifetime. The ID, CreatedBy, and
+// timestamps of d are populated.
+func (m *Manager) Mint(ctx context.Context, d *Delegation, ttl time.Duration, createdBy string) (string, error) {
+	if d == nil {
+		return "", errors.New("nil delegation")
+	}
+	if len(d.IDs) < 1 {
+		return "", ErrNoIDs
+	}
+	if len(d.Commands) < 1 && len(d.Workflows) < 1 && !d.Read {
+		return "", ErrNoScope
+	}
+	if ttl <= 0 || (m.maxTTL > 0 && ttl > m.maxTTL) {
+		ttl = m.maxTTL
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	d.ID = hashToken(token)
+	d.CreatedBy = createdBy
+	d.CreatedAt = m.clock.Now()
+	d.ExpiresAt = d.CreatedAt.Add(ttl)
+	if err := m.store.StoreDelegation(ctx, d); err != nil {
+		return "", fmt.Errorf("storing delegation: %w", err)
+	}
+
+	ctxlog.Logger(ctx, m.logger).Info(
+		"msg", "minted delegation",
+		"name", d.Name,
+		"created_by", createdBy,
+		"expires_at", d.ExpiresAt,
+	)
+	m.record(ctx, createdBy, "delegation.mint", d)
+	return token, nil
+}
+
+// Revoke deletes delegation id.
+func (m *Manager) Revoke(ctx context.Context, id, revokedBy string) error {
+	d, err := m.store.RetrieveDelegation(ctx, id)
+	if err != nil {
+		return fmt.Errorf("retrieving delegation: %w", err)
+	}
+	if err = m.store.DeleteDelegation(ctx, id); err != nil {
+		return fmt.Errorf("deleting delegation: %w", err)
+	}
+	if d != nil {
+		ctxlog.Logger(ctx, m.logger).Info("msg", "revoked delegation", "name", d.Name, "revoked_by", revokedBy)
+		m.record(ctx, revokedBy, "delegation.revoke", d)
+	}
+	return nil
+}
+
+// Delegations returns the unexpired delegations.
+// Expired delegations are deleted.
+func (m *Manager) Delegations(ctx context.Context) ([]*Delegation, error) {
+	all, err := m.store.RetrieveDelegations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving delegations: %w", err)
+	}
+	now := m.clock.Now()
+	ds := make([]*Delegation, 0, len(all))
+	for _, d := range all {
+		if d.Expired(now) {
+			if err = m.store.DeleteDelegation(ctx, d.ID); err != nil {
+				ctxlog.Logger(ctx, m.logger).Info("msg", "deleting expired delegation", "name", d.Name, "err", err)
+			}
+			continue
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Authenticate returns the delegation of token.
+// ErrInvalidToken is returned for unknown or expired tokens.
+func (m *Manager) Authenticate(ctx context.Context, token string) (*Delegation, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	d, err := m.store.RetrieveDelegation(ctx, hashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("retrieving delegation: %w", err)
+	}
+	if d == nil || d.Expired(m.clock.Now()) {
+		return nil, ErrInvalidToken
+	}
+	return d, nil
+}
+
+// record records action on d to the auditor, if configured.
+func (m *Manager) record(ctx context.Context, actor, action string, d *Delegation) {
+	if m.auditor == nil {
+		return
+	}
+	e := &audit.Event{
+		Actor:   actor,
+		Action:  action,
+		Targets: d.IDs,
+		Outcome: audit.OutcomeSuccess,
+	}
+	if err := m.auditor.Record(ctx, e); err != nil {
+		ctxlog.Logger(ctx, m.logger).Info("msg", "recording audit event", "action", action, "err", err)
+	}
+}
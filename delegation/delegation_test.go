@@ -0,0 +1,76 @@
+package delegation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+func TestDelegation(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	m := New(NewKVStore(kvmap.New()), WithClock(c), WithMaxTTL(time.Hour))
+
+	d := &Delegation{Name: "helpdesk", IDs: []string{"A"}, Read: true}
+	token, err := m.Mint(ctx, d, 24*time.Hour, "nanohub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.ExpiresAt.Equal(c.Now().Add(time.Hour)) {
+		t.Errorf("ttl not capped: %v", d.ExpiresAt)
+	}
+
+	basicAuth := func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	targets := func(r *http.Request) []string {
+		return []string{r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]}
+	}
+	h := m.AuthMiddleware(basicAuth)(Guard(AuthorizeRead, targets, log.NopLogger)(ok))
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"GET", "/notes/A", token, http.StatusOK},
+		{"GET", "/notes/B", token, http.StatusForbidden},
+		{"PUT", "/notes/A", token, http.StatusForbidden},
+		{"GET", "/notes/A", "", http.StatusUnauthorized},
+		{"GET", "/notes/A", "invalid", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s (token %q): have: %d, want: %d", tc.method, tc.path, tc.token, w.Code, tc.want)
+		}
+	}
+
+	c.Advance(2 * time.Hour)
+	if _, err = m.Authenticate(ctx, token); err != ErrInvalidToken {
+		t.Errorf("have: %v, want: %v", err, ErrInvalidToken)
+	}
+	ds, err := m.Delegations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 0 {
+		t.Errorf("expected expired delegations to be pruned: %v", ds)
+	}
+}
@@ -0,0 +1,180 @@
+package delegation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/audit"
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrForbidden is returned when a request is outside of a delegation's scope.
+var ErrForbidden = errors.New("not permitted by delegation")
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx with d attached.
+func NewContext(ctx context.Context, d *Delegation) context.Context {
+	return context.WithValue(ctx, ctxKey{}, d)
+}
+
+// FromContext returns the delegation attached to ctx or nil.
+func FromContext(ctx context.Context) *Delegation {
+	d, _ := ctx.Value(ctxKey{}).(*Delegation)
+	return d
+}
+
+// bearerToken returns the Bearer token of r, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// AuthMiddleware returns HTTP middleware that authenticates requests
+// with delegation Bearer tokens. Authenticated delegations are attached
+// to the request context. Requests without a Bearer token are handled
+// by the fallback authentication middleware.
+func (m *Manager) AuthMiddleware(fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if fallback == nil {
+		panic("nil fallback")
+	}
+	return func(next http.Handler) http.Handler {
+		fallbackNext := fallback(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				fallbackNext.ServeHTTP(w, r)
+				return
+			}
+			d, err := m.Authenticate(r.Context(), token)
+			if errors.Is(err, ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="NanoHUB API"`)
+				httpapi.JSONError(w, err, http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				ctxlog.Logger(r.Context(), m.logger).Info("msg", "authenticating delegation", "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), d)))
+		})
+	}
+}
+
+// Actor returns an audit actor function that identifies delegations
+// as "delegation:<name>". Otherwise the actor of fallback is used.
+func Actor(fallback audit.ActorFn) audit.ActorFn {
+	if fallback == nil {
+		panic("nil fallback")
+	}
+	return func(r *http.Request) string {
+		if d := FromContext(r.Context()); d != nil {
+			return "delegation:" + d.Name
+		}
+		return fallback(r)
+	}
+}
+
+// Authorizer returns an error if delegation d does not permit r.
+type Authorizer func(r *http.Request, d *Delegation) error
+
+// Deny permits no requests.
+func Deny(_ *http.Request, _ *Delegation) error {
+	return ErrForbidden
+}
+
+// AuthorizeRead permits reading if d has read access.
+func AuthorizeRead(r *http.Request, d *Delegation) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if d.Read {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+// AuthorizeEnqueue permits pushes and enqueueing the delegated commands
+// using the NanoMDM API.
+func AuthorizeEnqueue(r *http.Request, d *Delegation) error {
+	if strings.Contains(r.URL.Path, "/push/") {
+		return nil
+	}
+	if !strings.Contains(r.URL.Path, "/enqueue/") || r.Body == nil {
+		return ErrForbidden
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	requestType, err := capability.RequestType(body)
+	if err != nil || !contains(d.Commands, requestType) {
+		return fmt.Errorf("%w: command %s", ErrForbidden, requestType)
+	}
+	return nil
+}
+
+// AuthorizeWorkflows permits starting the delegated workflows using
+// the NanoCMD API.
+func AuthorizeWorkflows(r *http.Request, d *Delegation) error {
+	name := flow.Param(r.Context(), "name")
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/start") || !contains(d.Workflows, name) {
+		return fmt.Errorf("%w: workflow %s", ErrForbidden, name)
+	}
+	return nil
+}
+
+// Guard returns HTTP middleware that restricts delegation-authenticated
+// requests to the delegation's scope. Requests must target (per targetsFn)
+// only delegated enrollments and be permitted by authz. Requests without
+// a delegation are not restricted.
+func Guard(authz Authorizer, targetsFn audit.TargetsFn, logger log.Logger) func(http.Handler) http.Handler {
+	if authz == nil {
+		panic("nil authorizer")
+	}
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := FromContext(r.Context())
+			if d == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var ids []string
+			if targetsFn != nil {
+				ids = targetsFn(r)
+			}
+			err := authz(r, d)
+			if err == nil && !d.Covers(ids) {
+				err = fmt.Errorf("%w: enrollments %s", ErrForbidden, strings.Join(ids, ", "))
+			}
+			if err != nil {
+				ctxlog.Logger(r.Context(), logger).Info(
+					"msg", "delegation guard",
+					"name", d.Name,
+					"path", r.URL.Path,
+					"err", err,
+				)
+				httpapi.JSONError(w, err, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
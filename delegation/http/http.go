@@ -0,0 +1,146 @@
+// Package http provides the HTTP API for delegation tokens.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/audit"
+	"github.com/micromdm/nanohub/delegation"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no delegation ID is provided.
+	ErrNoID = errors.New("no delegation id provided")
+
+	// ErrDelegated is returned when a delegation tries to manage delegations.
+	ErrDelegated = errors.New("delegations cannot manage delegations")
+)
+
+// MintRequest is a request to mint a delegation token.
+type MintRequest struct {
+	Name      string   `json:"name"`
+	IDs       []string `json:"ids"`
+	Commands  []string `json:"commands,omitempty"`
+	Workflows []string `json:"workflows,omitempty"`
+	Read      bool     `json:"read,omitempty"`
+
+	// TTL is the lifetime of the token in seconds.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// MintResponse is a minted delegation and its token.
+// The token is only returned once.
+type MintResponse struct {
+	Token      string                 `json:"token"`
+	Delegation *delegation.Delegation `json:"delegation"`
+}
+
+// adminFn returns an HTTP handler that rejects delegation-authenticated requests.
+func adminFn(logger log.Logger, next func(http.ResponseWriter, *http.Request, log.Logger)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if delegation.FromContext(r.Context()) != nil {
+			httpapi.JSONError(w, ErrDelegated, http.StatusForbidden)
+			return
+		}
+		next(w, r, ctxlog.Logger(r.Context(), logger))
+	}
+}
+
+// MintHandler mints a delegation token from the JSON MintRequest body.
+func MintHandler(m *delegation.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return adminFn(logger, func(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+		req := new(MintRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		d := &delegation.Delegation{
+			Name:      req.Name,
+			IDs:       req.IDs,
+			Commands:  req.Commands,
+			Workflows: req.Workflows,
+			Read:      req.Read,
+		}
+		token, err := m.Mint(r.Context(), d, time.Duration(req.TTL)*time.Second, audit.BasicAuthActor(r))
+		if errors.Is(err, delegation.ErrNoIDs) || errors.Is(err, delegation.ErrNoScope) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "minting delegation", "name", req.Name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, &MintResponse{Token: token, Delegation: d}, logger)
+	})
+}
+
+// GetDelegationsHandler returns the unexpired delegations.
+func GetDelegationsHandler(m *delegation.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return adminFn(logger, func(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+		ds, err := m.Delegations(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving delegations", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		httpapi.WriteJSON(w, ds, logger)
+	})
+}
+
+// RevokeHandler revokes the delegation ID in the URL path.
+func RevokeHandler(m *delegation.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return adminFn(logger, func(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+		id := flow.Param(r.Context(), "delegation")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		if err := m.Revoke(r.Context(), id, audit.BasicAuthActor(r)); err != nil {
+			logger.Info("msg", "revoking delegation", "delegation", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleAPIv1 registers the delegation API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, m *delegation.Manager) {
+	mux.Handle(
+		prefix+"/delegations",
+		MintHandler(m, logger.With("handler", "mint-delegation")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/delegations",
+		GetDelegationsHandler(m, logger.With("handler", "get-delegations")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/delegations/:delegation",
+		RevokeHandler(m, logger.With("handler", "revoke-delegation")),
+		"DELETE",
+	)
+}
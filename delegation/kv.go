@@ -0,0 +1,74 @@
+package delegation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores delegations in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new delegation store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreDelegation stores d.
+func (s *KVStore) StoreDelegation(ctx context.Context, d *Delegation) error {
+	if d == nil || d.ID == "" {
+		return errors.New("invalid delegation")
+	}
+	v, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("marshal delegation: %w", err)
+	}
+	return s.b.Set(ctx, d.ID, v)
+}
+
+// RetrieveDelegation retrieves delegation id.
+func (s *KVStore) RetrieveDelegation(ctx context.Context, id string) (*Delegation, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d := new(Delegation)
+	if err = json.Unmarshal(v, d); err != nil {
+		return nil, fmt.Errorf("unmarshal delegation: %w", err)
+	}
+	return d, nil
+}
+
+// DeleteDelegation deletes delegation id.
+func (s *KVStore) DeleteDelegation(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
+
+// RetrieveDelegations retrieves all delegations.
+func (s *KVStore) RetrieveDelegations(ctx context.Context) ([]*Delegation, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]*Delegation, 0, len(keys))
+	for _, k := range keys {
+		d, err := s.RetrieveDelegation(ctx, k)
+		if err != nil {
+			return ds, fmt.Errorf("retrieving delegation %s: %w", k, err)
+		}
+		if d != nil {
+			ds = append(ds, d)
+		}
+	}
+	return ds, nil
+}
@@ -0,0 +1,327 @@
+package dep
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the base URL of the Apple DEP API.
+const DefaultBaseURL = "https://mdmenrollment.apple.com"
+
+// ErrNoTokens is returned when a DEP name has no valid tokens.
+var ErrNoTokens = errors.New("no DEP tokens")
+
+// HTTPError is a non-successful DEP API response.
+type HTTPError struct {
+	Action     string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("DEP %s: HTTP status %d: %s", e.Action, e.StatusCode, strings.TrimSpace(string(e.Body)))
+}
+
+// IsCursorExpired reports whether err is a DEP API error for an
+// expired or invalid sync cursor.
+func IsCursorExpired(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return bytes.Contains(httpErr.Body, []byte("EXPIRED_CURSOR")) ||
+		bytes.Contains(httpErr.Body, []byte("INVALID_CURSOR"))
+}
+
+// Client is a DEP API client for multiple DEP names.
+// It authenticates with the tokens of each name and caches the
+// resulting session tokens.
+type Client struct {
+	tokens  TokenRetriever
+	client  *http.Client
+	baseURL string
+
+	mu       sync.Mutex
+	sessions map[string]string
+}
+
+// ClientOption configures the client.
+type ClientOption func(*Client)
+
+// WithBaseURL configures the base URL of the DEP API.
+func WithBaseURL(u string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimRight(u, "/")
+	}
+}
+
+// WithHTTPClient configures the HTTP client used for DEP API requests.
+func WithHTTPClient(client *http.Client) ClientOption {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// NewClient creates a new DEP API client using tokens from tokens.
+func NewClient(tokens TokenRetriever, opts ...ClientOption) *Client {
+	if tokens == nil {
+		panic("nil token retriever")
+	}
+	c := &Client{
+		tokens:   tokens,
+		client:   http.DefaultClient,
+		baseURL:  DefaultBaseURL,
+		sessions: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// DevicesResponse is the response of the fetch and sync device APIs.
+type DevicesResponse struct {
+	Devices      []*Device `json:"devices"`
+	Cursor       string    `json:"cursor"`
+	FetchedUntil time.Time `json:"fetched_until"`
+	MoreToFollow bool      `json:"more_to_follow"`
+}
+
+type devicesRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// FetchDevices fetches the devices assigned to name starting at cursor.
+func (c *Client) FetchDevices(ctx context.Context, name, cursor string, limit int) (*DevicesResponse, error) {
+	resp := new(DevicesResponse)
+	return resp, c.do(ctx, name, "fetch devices", "POST", "/server/devices", &devicesRequest{Cursor: cursor, Limit: limit}, resp)
+}
+
+// SyncDevices fetches the device changes of name since cursor.
+func (c *Client) SyncDevices(ctx context.Context, name, cursor string, limit int) (*DevicesResponse, error) {
+	resp := new(DevicesResponse)
+	return resp, c.do(ctx, name, "sync devices", "POST", "/devices/sync", &devicesRequest{Cursor: cursor, Limit: limit}, resp)
+}
+
+// ProfileResponse is the response of the define and assign profile APIs.
+type ProfileResponse struct {
+	ProfileUUID string `json:"profile_uuid"`
+
+	// Devices maps device serial numbers to their assignment result.
+	Devices map[string]string `json:"devices,omitempty"`
+}
+
+// DefineProfile defines the DEP enrollment profile in name.
+// Profile is passed to the DEP API as-is.
+func (c *Client) DefineProfile(ctx context.Context, name string, profile interface{}) (*ProfileResponse, error) {
+	resp := new(ProfileResponse)
+	return resp, c.do(ctx, name, "define profile", "POST", "/profile", profile, resp)
+}
+
+// AssignProfile assigns the profile with uuid to devices in name.
+func (c *Client) AssignProfile(ctx context.Context, name, uuid string, serials []string) (*ProfileResponse, error) {
+	req := &struct {
+		ProfileUUID string   `json:"profile_uuid"`
+		Devices     []string `json:"devices"`
+	}{uuid, serials}
+	resp := new(ProfileResponse)
+	return resp, c.do(ctx, name, "assign profile", "PUT", "/profile/devices", req, resp)
+}
+
+// do performs a DEP API request for name. The request is retried once
+// with a new session if the session has expired.
+func (c *Client) do(ctx context.Context, name, action, method, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("marshal %s request: %w", action, err)
+	}
+	for retried := false; ; retried = true {
+		session, err := c.session(ctx, name, retried)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-ADM-Auth-Session", session)
+		req.Header.Set("X-Server-Protocol-Version", "3")
+		req.Header.Set("Content-Type", "application/json;charset=UTF8")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("DEP %s: %w", action, err)
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("DEP %s: reading body: %w", action, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			// session expired
+			continue
+		}
+		if newSession := resp.Header.Get("X-ADM-Auth-Session"); newSession != "" {
+			c.setSession(name, newSession)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &HTTPError{Action: action, StatusCode: resp.StatusCode, Body: respBody}
+		}
+		if out == nil {
+			return nil
+		}
+		if err = json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("unmarshal %s response: %w", action, err)
+		}
+		return nil
+	}
+}
+
+func (c *Client) setSession(name, session string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[name] = session
+}
+
+// session returns the cached session token of name or
+// authenticates a new session if there is none or renew is true.
+func (c *Client) session(ctx context.Context, name string, renew bool) (string, error) {
+	if !renew {
+		c.mu.Lock()
+		session := c.sessions[name]
+		c.mu.Unlock()
+		if session != "" {
+			return session, nil
+		}
+	}
+
+	tokens, err := c.tokens.RetrieveTokens(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("retrieving DEP tokens: %w", err)
+	}
+	if !tokens.Valid() {
+		return "", ErrNoTokens
+	}
+
+	session, err := c.authenticate(ctx, tokens)
+	if err != nil {
+		return "", err
+	}
+	c.setSession(name, session)
+	return session, nil
+}
+
+// authenticate retrieves a new session token using OAuth 1.0a.
+func (c *Client) authenticate(ctx context.Context, tokens *OAuth1Tokens) (string, error) {
+	u := c.baseURL + "/session"
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	params := map[string]string{
+		"oauth_consumer_key":     tokens.ConsumerKey,
+		"oauth_token":            tokens.AccessToken,
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(time.Now().Unix(), 10),
+		"oauth_nonce":            hex.EncodeToString(nonce),
+		"oauth_version":          "1.0",
+	}
+	params["oauth_signature"] = oauthSignature("GET", u, params, tokens.ConsumerSecret, tokens.AccessSecret)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", oauthHeader(params))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("DEP session: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("DEP session: reading body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{Action: "session", StatusCode: resp.StatusCode, Body: body}
+	}
+	session := new(struct {
+		AuthSessionToken string `json:"auth_session_token"`
+	})
+	if err = json.Unmarshal(body, session); err != nil {
+		return "", fmt.Errorf("unmarshal session response: %w", err)
+	}
+	if session.AuthSessionToken == "" {
+		return "", errors.New("DEP session: empty session token")
+	}
+	return session.AuthSessionToken, nil
+}
+
+// oauthEscape percent-encodes s per RFC 5849 section 3.6.
+func oauthEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// oauthSignature returns the HMAC-SHA1 signature of a request to
+// baseURL (without query) with params per RFC 5849 section 3.4.
+func oauthSignature(method, baseURL string, params map[string]string, consumerSecret, tokenSecret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(params))
+	for _, k := range keys {
+		pairs = append(pairs, oauthEscape(k)+"="+oauthEscape(params[k]))
+	}
+	base := strings.ToUpper(method) + "&" + oauthEscape(baseURL) + "&" + oauthEscape(strings.Join(pairs, "&"))
+	mac := hmac.New(sha1.New, []byte(oauthEscape(consumerSecret)+"&"+oauthEscape(tokenSecret)))
+	mac.Write([]byte(base))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// oauthHeader returns the OAuth Authorization header value for params.
+func oauthHeader(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{`realm="ADM"`}
+	for _, k := range keys {
+		parts = append(parts, oauthEscape(k)+`="`+oauthEscape(params[k])+`"`)
+	}
+	return "OAuth " + strings.Join(parts, ", ")
+}
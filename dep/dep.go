@@ -0,0 +1,132 @@
+// Package dep integrates Apple Business Manager and Apple School Manager
+// device enrollment (DEP) into NanoHUB. It stores DEP server tokens,
+// syncs the assigned devices using the DEP API, and defines and assigns
+// enrollment profiles.
+package dep
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidName is returned for invalid DEP names.
+var ErrInvalidName = errors.New("invalid DEP name")
+
+// ValidName reports whether name is a valid DEP name.
+// DEP names identify a DEP server token (an MDM server in
+// Apple Business Manager) and are used in storage keys.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/.")
+}
+
+// OAuth1Tokens are the OAuth 1.0a credentials of a DEP server token.
+type OAuth1Tokens struct {
+	ConsumerKey       string    `json:"consumer_key"`
+	ConsumerSecret    string    `json:"consumer_secret"`
+	AccessToken       string    `json:"access_token"`
+	AccessSecret      string    `json:"access_secret"`
+	AccessTokenExpiry time.Time `json:"access_token_expiry"`
+}
+
+// Valid reports whether all of the credentials are present.
+func (t *OAuth1Tokens) Valid() bool {
+	return t != nil &&
+		t.ConsumerKey != "" &&
+		t.ConsumerSecret != "" &&
+		t.AccessToken != "" &&
+		t.AccessSecret != ""
+}
+
+// Device is a device assigned to a DEP server.
+type Device struct {
+	SerialNumber       string    `json:"serial_number"`
+	Model              string    `json:"model,omitempty"`
+	Description        string    `json:"description,omitempty"`
+	Color              string    `json:"color,omitempty"`
+	AssetTag           string    `json:"asset_tag,omitempty"`
+	OS                 string    `json:"os,omitempty"`
+	DeviceFamily       string    `json:"device_family,omitempty"`
+	ProfileStatus      string    `json:"profile_status,omitempty"`
+	ProfileUUID        string    `json:"profile_uuid,omitempty"`
+	ProfileAssignTime  time.Time `json:"profile_assign_time"`
+	DeviceAssignedDate time.Time `json:"device_assigned_date"`
+	DeviceAssignedBy   string    `json:"device_assigned_by,omitempty"`
+
+	// OpType and OpDate are only present for synced devices.
+	OpType string    `json:"op_type,omitempty"`
+	OpDate time.Time `json:"op_date"`
+}
+
+// Device operation types reported by the DEP sync API.
+const (
+	OpAdded    = "added"
+	OpModified = "modified"
+	OpDeleted  = "deleted"
+)
+
+// Cursor is the device sync position of a DEP name.
+type Cursor struct {
+	// Cursor is the DEP API cursor.
+	Cursor string `json:"cursor,omitempty"`
+
+	// Fetched is true once all devices have been fetched and
+	// further changes are synced from Cursor.
+	Fetched bool `json:"fetched"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TokenPKI is the key pair used to decrypt DEP server tokens
+// downloaded from Apple Business Manager.
+type TokenPKI struct {
+	CertPEM []byte `json:"cert"`
+	KeyPEM  []byte `json:"key"`
+}
+
+// TokenRetriever retrieves DEP server tokens.
+type TokenRetriever interface {
+	// RetrieveTokens retrieves the tokens of name.
+	// Nil is returned if no tokens exist.
+	RetrieveTokens(ctx context.Context, name string) (*OAuth1Tokens, error)
+}
+
+// Store stores DEP tokens, sync state, and devices.
+type Store interface {
+	TokenRetriever
+
+	// StoreTokens stores the tokens of name.
+	StoreTokens(ctx context.Context, name string, tokens *OAuth1Tokens) error
+
+	// RetrieveNames retrieves the names that have tokens.
+	RetrieveNames(ctx context.Context) ([]string, error)
+
+	// StoreTokenPKI stores the token decryption key pair of name.
+	StoreTokenPKI(ctx context.Context, name string, pki *TokenPKI) error
+
+	// RetrieveTokenPKI retrieves the token decryption key pair of name.
+	// Nil is returned if no key pair exists.
+	RetrieveTokenPKI(ctx context.Context, name string) (*TokenPKI, error)
+
+	// StoreCursor stores the sync cursor of name.
+	StoreCursor(ctx context.Context, name string, cursor *Cursor) error
+
+	// RetrieveCursor retrieves the sync cursor of name.
+	// Nil is returned if name has not been synced.
+	RetrieveCursor(ctx context.Context, name string) (*Cursor, error)
+
+	// StoreAssignerProfile stores the profile UUID assigned to newly
+	// added devices of name. An empty UUID disables assignment.
+	StoreAssignerProfile(ctx context.Context, name, uuid string) error
+
+	// RetrieveAssignerProfile retrieves the assigner profile UUID of name.
+	RetrieveAssignerProfile(ctx context.Context, name string) (string, error)
+
+	// StoreDevices stores synced devices of name.
+	// Devices with the deleted operation type are removed.
+	StoreDevices(ctx context.Context, name string, devices []*Device) error
+
+	// RetrieveDevices retrieves the synced devices of name.
+	RetrieveDevices(ctx context.Context, name string) ([]*Device, error)
+}
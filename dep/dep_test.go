@@ -0,0 +1,99 @@
+package dep
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+func TestOAuthSignature(t *testing.T) {
+	// RFC 5849 section 1.2
+	params := map[string]string{
+		"file":                   "vacation.jpg",
+		"size":                   "original",
+		"oauth_consumer_key":     "dpf43f3p2l4k3l03",
+		"oauth_token":            "nnch734d00sl2jdk",
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        "137131202",
+		"oauth_nonce":            "chapoH",
+	}
+	sig := oauthSignature("GET", "http://photos.example.net/photos", params, "kd94hf93k423kf44", "pfkkdhi9sl3r4s00")
+	if have, want := sig, "MdpQcU8iPSUjWoN/UDMsK2sui9I="; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	var assigned []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auth_session_token":"S1"}`))
+	})
+	mux.HandleFunc("/server/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ADM-Auth-Session") != "S1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"devices":[{"serial_number":"A1","profile_status":"empty"},{"serial_number":"B2","profile_status":"assigned"}],"cursor":"C1","more_to_follow":false}`))
+	})
+	mux.HandleFunc("/devices/sync", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"devices":[{"serial_number":"A1","op_type":"deleted"}],"cursor":"C2","more_to_follow":false}`))
+	})
+	mux.HandleFunc("/profile/devices", func(w http.ResponseWriter, r *http.Request) {
+		req := new(struct {
+			Devices []string `json:"devices"`
+		})
+		json.NewDecoder(r.Body).Decode(req)
+		assigned = append(assigned, req.Devices...)
+		w.Write([]byte(`{"profile_uuid":"P1","devices":{"A1":"SUCCESS"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewKVStore(kvmap.New())
+	err := store.StoreTokens(ctx, "abm", &OAuth1Tokens{
+		ConsumerKey:    "CK",
+		ConsumerSecret: "CS",
+		AccessToken:    "AT",
+		AccessSecret:   "AS",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.StoreAssignerProfile(ctx, "abm", "P1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSyncer(NewClient(store, WithBaseURL(srv.URL)), store)
+	for i, want := range []int{2, 1} {
+		if _, err = s.Sync(ctx, "abm"); err != nil {
+			t.Fatal(err)
+		}
+		devices, err := store.RetrieveDevices(ctx, "abm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := len(devices); have != want {
+			t.Errorf("sync %d: devices: have: %v, want: %v", i, have, want)
+		}
+	}
+
+	if have, want := len(assigned), 1; have != want {
+		t.Fatalf("assigned: have: %v, want: %v", have, want)
+	}
+	if have, want := assigned[0], "A1"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	cursor, err := store.RetrieveCursor(ctx, "abm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := cursor.Cursor, "C2"; have != want {
+		t.Errorf("cursor: have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,454 @@
+// Package http provides the HTTP API for DEP.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/micromdm/nanohub/dep"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// TokenPKIValidity is the validity of generated token certificates.
+const TokenPKIValidity = 365 * 24 * time.Hour
+
+var (
+	// ErrNoProfileUUID is returned when no profile UUID is provided.
+	ErrNoProfileUUID = errors.New("no profile UUID provided")
+
+	// ErrNoDevices is returned when no devices are provided.
+	ErrNoDevices = errors.New("no devices provided")
+)
+
+// NameStatus is the status of a DEP name.
+type NameStatus struct {
+	Name              string      `json:"name"`
+	AccessTokenExpiry time.Time   `json:"access_token_expiry"`
+	Cursor            *dep.Cursor `json:"cursor,omitempty"`
+	AssignerProfile   string      `json:"assigner_profile_uuid,omitempty"`
+}
+
+// AssignRequest is the body of a profile assignment request.
+type AssignRequest struct {
+	ProfileUUID string   `json:"profile_uuid"`
+	Devices     []string `json:"devices"`
+}
+
+// name returns the valid DEP name in the URL path or writes an error.
+func name(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := flow.Param(r.Context(), "name")
+	if !dep.ValidName(name) {
+		httpapi.JSONError(w, dep.ErrInvalidName, http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+func status(r *http.Request, store dep.Store, name string) (*NameStatus, error) {
+	s := &NameStatus{Name: name}
+	tokens, err := store.RetrieveTokens(r.Context(), name)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving tokens: %w", err)
+	} else if tokens != nil {
+		s.AccessTokenExpiry = tokens.AccessTokenExpiry
+	}
+	if s.Cursor, err = store.RetrieveCursor(r.Context(), name); err != nil {
+		return nil, fmt.Errorf("retrieving cursor: %w", err)
+	}
+	if s.AssignerProfile, err = store.RetrieveAssignerProfile(r.Context(), name); err != nil {
+		return nil, fmt.Errorf("retrieving assigner profile: %w", err)
+	}
+	return s, nil
+}
+
+// GetNamesHandler returns the status of all DEP names.
+func GetNamesHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		names, err := store.RetrieveNames(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving names", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		ret := make([]*NameStatus, 0, len(names))
+		for _, name := range names {
+			s, err := status(r, store, name)
+			if err != nil {
+				logger.Info("msg", "retrieving status", "name", name, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			ret = append(ret, s)
+		}
+
+		httpapi.WriteJSON(w, ret, logger)
+	}
+}
+
+// GetTokenPKIHandler returns the PEM certificate used to encrypt the
+// DEP server token of the DEP name in the URL path. A new key pair is
+// generated if none exists.
+func GetTokenPKIHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		pki, err := store.RetrieveTokenPKI(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving token key pair", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if pki == nil {
+			if pki, err = dep.NewTokenPKI("nanohub-dep-"+name, TokenPKIValidity); err != nil {
+				logger.Info("msg", "generating token key pair", "name", name, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			if err = store.StoreTokenPKI(r.Context(), name, pki); err != nil {
+				logger.Info("msg", "storing token key pair", "name", name, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			logger.Debug("msg", "generated token key pair", "name", name)
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.pem"`)
+		w.Write(pki.CertPEM)
+	}
+}
+
+// PutTokenPKIHandler decrypts and stores the DEP server token file
+// (.p7m) in the request body for the DEP name in the URL path.
+func PutTokenPKIHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		smime, err := io.ReadAll(r.Body)
+		if err != nil {
+			httpapi.JSONError(w, fmt.Errorf("reading body: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		pki, err := store.RetrieveTokenPKI(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving token key pair", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		tokens, err := dep.DecryptTokens(smime, pki)
+		if err != nil {
+			logger.Info("msg", "decrypting tokens", "name", name, "err", err)
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		storeTokens(w, r, store, name, tokens, logger)
+	}
+}
+
+// PutTokensHandler stores the raw JSON OAuth tokens in the request body
+// for the DEP name in the URL path.
+func PutTokensHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		tokens := new(dep.OAuth1Tokens)
+		if err := json.NewDecoder(r.Body).Decode(tokens); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+		if !tokens.Valid() {
+			httpapi.JSONError(w, dep.ErrNoTokens, http.StatusBadRequest)
+			return
+		}
+
+		storeTokens(w, r, store, name, tokens, logger)
+	}
+}
+
+func storeTokens(w http.ResponseWriter, r *http.Request, store dep.Store, name string, tokens *dep.OAuth1Tokens, logger log.Logger) {
+	if err := store.StoreTokens(r.Context(), name, tokens); err != nil {
+		logger.Info("msg", "storing tokens", "name", name, "err", err)
+		httpapi.JSONError(w, err, 0)
+		return
+	}
+	logger.Debug("msg", "stored tokens", "name", name, "expiry", tokens.AccessTokenExpiry)
+
+	s, err := status(r, store, name)
+	if err != nil {
+		logger.Info("msg", "retrieving status", "name", name, "err", err)
+		httpapi.JSONError(w, err, 0)
+		return
+	}
+	httpapi.WriteJSON(w, s, logger)
+}
+
+// GetDevicesHandler returns the synced devices of the DEP name in the URL path.
+func GetDevicesHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		devices, err := store.RetrieveDevices(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving devices", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, devices, logger)
+	}
+}
+
+// SyncHandler syncs the devices of the DEP name in the URL path.
+func SyncHandler(s *dep.Syncer, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil syncer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		n, err := s.Sync(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "syncing devices", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, map[string]int{"devices": n}, logger)
+	}
+}
+
+// DefineProfileHandler defines the DEP profile in the request body in
+// the DEP name in the URL path. If the assigner query parameter is true
+// the profile becomes the assigner profile for newly added devices.
+func DefineProfileHandler(client *dep.Client, store dep.Store, logger log.Logger) http.HandlerFunc {
+	if client == nil {
+		panic("nil client")
+	}
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		var assigner bool
+		if v := r.URL.Query().Get("assigner"); v != "" {
+			var err error
+			if assigner, err = strconv.ParseBool(v); err != nil {
+				httpapi.JSONError(w, fmt.Errorf("parsing assigner: %w", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var profile json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := client.DefineProfile(r.Context(), name, profile)
+		if err != nil {
+			logger.Info("msg", "defining profile", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		logger.Debug("msg", "defined profile", "name", name, "profile_uuid", resp.ProfileUUID)
+
+		if assigner {
+			if err = store.StoreAssignerProfile(r.Context(), name, resp.ProfileUUID); err != nil {
+				logger.Info("msg", "storing assigner profile", "name", name, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+		}
+
+		httpapi.WriteJSON(w, resp, logger)
+	}
+}
+
+// PutAssignerHandler sets the assigner profile UUID of the DEP name in
+// the URL path. An empty profile UUID disables assignment.
+func PutAssignerHandler(store dep.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		req := new(AssignRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreAssignerProfile(r.Context(), name, req.ProfileUUID); err != nil {
+			logger.Info("msg", "storing assigner profile", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored assigner profile", "name", name, "profile_uuid", req.ProfileUUID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AssignProfileHandler assigns a profile to devices in the DEP name
+// in the URL path.
+func AssignProfileHandler(client *dep.Client, logger log.Logger) http.HandlerFunc {
+	if client == nil {
+		panic("nil client")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		name, ok := name(w, r)
+		if !ok {
+			return
+		}
+
+		req := new(AssignRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+		if req.ProfileUUID == "" {
+			httpapi.JSONError(w, ErrNoProfileUUID, http.StatusBadRequest)
+			return
+		}
+		if len(req.Devices) < 1 {
+			httpapi.JSONError(w, ErrNoDevices, http.StatusBadRequest)
+			return
+		}
+
+		resp, err := client.AssignProfile(r.Context(), name, req.ProfileUUID, req.Devices)
+		if err != nil {
+			logger.Info("msg", "assigning profile", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, resp, logger)
+	}
+}
+
+// HandleAPIv1 registers the DEP API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store dep.Store, client *dep.Client, s *dep.Syncer) {
+	mux.Handle(
+		prefix+"/dep/names",
+		GetNamesHandler(store, logger.With("handler", "get-dep-names")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/tokenpki",
+		GetTokenPKIHandler(store, logger.With("handler", "get-dep-tokenpki")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/tokenpki",
+		PutTokenPKIHandler(store, logger.With("handler", "put-dep-tokenpki")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/tokens",
+		PutTokensHandler(store, logger.With("handler", "put-dep-tokens")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/devices",
+		GetDevicesHandler(store, logger.With("handler", "get-dep-devices")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/sync",
+		SyncHandler(s, logger.With("handler", "sync-dep")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/profile",
+		DefineProfileHandler(client, store, logger.With("handler", "define-dep-profile")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/profile/devices",
+		AssignProfileHandler(client, logger.With("handler", "assign-dep-profile")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dep/names/:name/assigner",
+		PutAssignerHandler(store, logger.With("handler", "put-dep-assigner")),
+		"PUT",
+	)
+}
@@ -0,0 +1,180 @@
+package dep
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyTokens   = "tokens."
+	keyPKI      = "pki."
+	keyCursor   = "cursor."
+	keyAssigner = "assigner."
+	keyDevice   = "device."
+)
+
+// KVStore stores DEP data in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new DEP store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+func (s *KVStore) set(ctx context.Context, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	return s.b.Set(ctx, key, data)
+}
+
+// get unmarshals key into v. It reports whether key exists.
+func (s *KVStore) get(ctx context.Context, key string, v interface{}) (bool, error) {
+	data, err := s.b.Get(ctx, key)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("unmarshal %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// StoreTokens stores the tokens of name.
+func (s *KVStore) StoreTokens(ctx context.Context, name string, tokens *OAuth1Tokens) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	return s.set(ctx, keyTokens+name, tokens)
+}
+
+// RetrieveTokens retrieves the tokens of name.
+func (s *KVStore) RetrieveTokens(ctx context.Context, name string) (*OAuth1Tokens, error) {
+	tokens := new(OAuth1Tokens)
+	if ok, err := s.get(ctx, keyTokens+name, tokens); !ok {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RetrieveNames retrieves the names that have tokens.
+func (s *KVStore) RetrieveNames(ctx context.Context) ([]string, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyTokens)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, strings.TrimPrefix(k, keyTokens))
+	}
+	return names, nil
+}
+
+// StoreTokenPKI stores the token decryption key pair of name.
+func (s *KVStore) StoreTokenPKI(ctx context.Context, name string, pki *TokenPKI) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	return s.set(ctx, keyPKI+name, pki)
+}
+
+// RetrieveTokenPKI retrieves the token decryption key pair of name.
+func (s *KVStore) RetrieveTokenPKI(ctx context.Context, name string) (*TokenPKI, error) {
+	pki := new(TokenPKI)
+	if ok, err := s.get(ctx, keyPKI+name, pki); !ok {
+		return nil, err
+	}
+	return pki, nil
+}
+
+// StoreCursor stores the sync cursor of name.
+func (s *KVStore) StoreCursor(ctx context.Context, name string, cursor *Cursor) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	return s.set(ctx, keyCursor+name, cursor)
+}
+
+// RetrieveCursor retrieves the sync cursor of name.
+func (s *KVStore) RetrieveCursor(ctx context.Context, name string) (*Cursor, error) {
+	cursor := new(Cursor)
+	if ok, err := s.get(ctx, keyCursor+name, cursor); !ok {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// StoreAssignerProfile stores the assigner profile UUID of name.
+func (s *KVStore) StoreAssignerProfile(ctx context.Context, name, uuid string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	if uuid == "" {
+		return s.b.Delete(ctx, keyAssigner+name)
+	}
+	return s.b.Set(ctx, keyAssigner+name, []byte(uuid))
+}
+
+// RetrieveAssignerProfile retrieves the assigner profile UUID of name.
+func (s *KVStore) RetrieveAssignerProfile(ctx context.Context, name string) (string, error) {
+	uuid, err := s.b.Get(ctx, keyAssigner+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return "", nil
+	}
+	return string(uuid), err
+}
+
+// StoreDevices stores synced devices of name.
+func (s *KVStore) StoreDevices(ctx context.Context, name string, devices []*Device) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	for _, d := range devices {
+		if d == nil || d.SerialNumber == "" || strings.Contains(d.SerialNumber, "/") {
+			continue
+		}
+		key := keyDevice + name + "." + d.SerialNumber
+		var err error
+		if d.OpType == OpDeleted {
+			err = s.b.Delete(ctx, key)
+		} else {
+			err = s.set(ctx, key, d)
+		}
+		if err != nil {
+			return fmt.Errorf("storing device %s: %w", d.SerialNumber, err)
+		}
+	}
+	return nil
+}
+
+// RetrieveDevices retrieves the synced devices of name.
+func (s *KVStore) RetrieveDevices(ctx context.Context, name string) ([]*Device, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyDevice+name+".")
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*Device, 0, len(keys))
+	for _, k := range keys {
+		d := new(Device)
+		ok, err := s.get(ctx, k, d)
+		if err != nil {
+			return devices, err
+		} else if ok {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,239 @@
+package dep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultLimit is the default number of devices requested per page.
+const DefaultLimit = 500
+
+// Syncer periodically syncs the devices of all DEP names and assigns
+// the assigner profile to newly added devices.
+type Syncer struct {
+	client *Client
+	store  Store
+	limit  int
+	logger log.Logger
+	clock  clock.Clock
+	sink   event.Sink
+
+	mu sync.Mutex // serializes syncs
+}
+
+// SyncerOption configures the syncer.
+type SyncerOption func(*Syncer)
+
+// WithLimit configures the number of devices requested per page.
+func WithLimit(limit int) SyncerOption {
+	return func(s *Syncer) {
+		s.limit = limit
+	}
+}
+
+// WithLogger configures a logger for the syncer.
+func WithLogger(logger log.Logger) SyncerOption {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Syncer) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock used for sync timestamps and intervals.
+func WithClock(c clock.Clock) SyncerOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Syncer) {
+		s.clock = c
+	}
+}
+
+// WithSink sends an event to sink for every synced device change.
+func WithSink(sink event.Sink) SyncerOption {
+	return func(s *Syncer) {
+		s.sink = sink
+	}
+}
+
+// NewSyncer creates a new syncer using client and store.
+func NewSyncer(client *Client, store Store, opts ...SyncerOption) *Syncer {
+	if client == nil {
+		panic("nil client")
+	}
+	if store == nil {
+		panic("nil store")
+	}
+	s := &Syncer{
+		client: client,
+		store:  store,
+		limit:  DefaultLimit,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Sync fetches or syncs the devices of name from its stored cursor
+// until no more devices follow. It returns the number of devices.
+// If the cursor has expired all devices are fetched again.
+func (s *Syncer) Sync(ctx context.Context, name string) (int, error) {
+	if !ValidName(name) {
+		return 0, ErrInvalidName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logger := ctxlog.Logger(ctx, s.logger).With("name", name)
+
+	cursor, err := s.store.RetrieveCursor(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving cursor: %w", err)
+	}
+	if cursor == nil {
+		cursor = new(Cursor)
+	}
+	assigner, err := s.store.RetrieveAssignerProfile(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving assigner profile: %w", err)
+	}
+
+	var total int
+	reset := false
+	for {
+		var resp *DevicesResponse
+		if cursor.Fetched {
+			resp, err = s.client.SyncDevices(ctx, name, cursor.Cursor, s.limit)
+		} else {
+			resp, err = s.client.FetchDevices(ctx, name, cursor.Cursor, s.limit)
+		}
+		if IsCursorExpired(err) && !reset {
+			logger.Info("msg", "cursor expired, fetching all devices")
+			cursor, reset = new(Cursor), true
+			continue
+		} else if err != nil {
+			return total, err
+		}
+		total += len(resp.Devices)
+
+		if err = s.store.StoreDevices(ctx, name, resp.Devices); err != nil {
+			return total, fmt.Errorf("storing devices: %w", err)
+		}
+		s.assign(ctx, logger, name, assigner, resp.Devices)
+		s.send(ctx, name, resp.Devices)
+
+		if resp.Cursor != "" {
+			cursor.Cursor = resp.Cursor
+		}
+		if !resp.MoreToFollow {
+			cursor.Fetched = true
+		}
+		cursor.UpdatedAt = s.clock.Now()
+		if err = s.store.StoreCursor(ctx, name, cursor); err != nil {
+			return total, fmt.Errorf("storing cursor: %w", err)
+		}
+		if !resp.MoreToFollow {
+			break
+		}
+	}
+	logger.Debug("msg", "synced devices", "count", total)
+	return total, nil
+}
+
+// assign assigns the assigner profile to newly added devices
+// that have no profile.
+func (s *Syncer) assign(ctx context.Context, logger log.Logger, name, uuid string, devices []*Device) {
+	if uuid == "" {
+		return
+	}
+	var serials []string
+	for _, d := range devices {
+		if d == nil || (d.OpType != "" && d.OpType != OpAdded) {
+			// devices fetched (rather than synced) have no op type
+			continue
+		}
+		if d.ProfileStatus == "" || d.ProfileStatus == "empty" {
+			serials = append(serials, d.SerialNumber)
+		}
+	}
+	if len(serials) < 1 {
+		return
+	}
+	resp, err := s.client.AssignProfile(ctx, name, uuid, serials)
+	if err != nil {
+		logger.Info("msg", "assigning profile", "profile_uuid", uuid, "count", len(serials), "err", err)
+		return
+	}
+	for serial, result := range resp.Devices {
+		if result != "SUCCESS" {
+			logger.Info("msg", "assigning profile", "profile_uuid", uuid, "serial_number", serial, "result", result)
+		}
+	}
+	logger.Debug("msg", "assigned profile", "profile_uuid", uuid, "count", len(serials))
+}
+
+// send sends a device event for each device to the sink.
+func (s *Syncer) send(ctx context.Context, name string, devices []*Device) {
+	if s.sink == nil {
+		return
+	}
+	for _, d := range devices {
+		if d == nil {
+			continue
+		}
+		e := event.New(s.clock, event.TypeDEPDevice, "")
+		e.Timestamp = s.clock.Now()
+		e.Fields["dep_name"] = name
+		e.Fields["serial_number"] = d.SerialNumber
+		e.Fields["op_type"] = d.OpType
+		e.Fields["profile_status"] = d.ProfileStatus
+		if err := s.sink.Send(ctx, e); err != nil {
+			ctxlog.Logger(ctx, s.logger).Info("msg", "sending event", "type", e.Type, "err", err)
+		}
+	}
+}
+
+// SyncAll syncs all DEP names. Errors are logged.
+func (s *Syncer) SyncAll(ctx context.Context) {
+	names, err := s.store.RetrieveNames(ctx)
+	if err != nil {
+		s.logger.Info("msg", "retrieving DEP names", "err", err)
+		return
+	}
+	for _, name := range names {
+		if _, err = s.Sync(ctx, name); err != nil {
+			s.logger.Info("msg", "DEP sync", "name", name, "err", err)
+		}
+	}
+}
+
+// Run syncs all DEP names every interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.SyncAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package dep
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/textproto"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// ErrNoTokenPKI is returned when decrypting tokens without a key pair.
+var ErrNoTokenPKI = errors.New("no token key pair")
+
+// NewTokenPKI generates a new key pair and self-signed certificate for
+// decrypting DEP server tokens. The certificate is uploaded to the MDM
+// server in Apple Business Manager.
+func NewTokenPKI(cn string, validity time.Duration) (*TokenPKI, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPKI{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}, nil
+}
+
+// parse parses the certificate and private key of pki.
+func (pki *TokenPKI) parse() (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(pki.CertPEM)
+	if certBlock == nil {
+		return nil, nil, errors.New("no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	keyBlock, _ := pem.Decode(pki.KeyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("no PEM private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	return cert, key, nil
+}
+
+// DecryptTokens decrypts the S/MIME DEP server token file (.p7m)
+// downloaded from Apple Business Manager using pki.
+func DecryptTokens(smime []byte, pki *TokenPKI) (*OAuth1Tokens, error) {
+	if pki == nil {
+		return nil, ErrNoTokenPKI
+	}
+	cert, key, err := pki.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// the token file is a MIME entity with a base64 PKCS#7 body
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(smime)))
+	if _, err = r.ReadMIMEHeader(); err != nil {
+		return nil, fmt.Errorf("reading S/MIME header: %w", err)
+	}
+	var b64 bytes.Buffer
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			break
+		}
+		b64.WriteString(line)
+	}
+	der, err := base64.StdEncoding.DecodeString(b64.String())
+	if err != nil {
+		return nil, fmt.Errorf("decoding S/MIME body: %w", err)
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing PKCS#7: %w", err)
+	}
+	content, err := p7.Decrypt(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting tokens: %w", err)
+	}
+
+	// the decrypted content wraps the JSON tokens in message markers
+	const begin, end = "-----BEGIN MESSAGE-----", "-----END MESSAGE-----"
+	i := bytes.Index(content, []byte(begin))
+	j := bytes.Index(content, []byte(end))
+	if i < 0 || j < i {
+		return nil, errors.New("no message in decrypted tokens")
+	}
+	tokens := new(OAuth1Tokens)
+	if err = json.Unmarshal(content[i+len(begin):j], tokens); err != nil {
+		return nil, fmt.Errorf("unmarshal tokens: %w", err)
+	}
+	if !tokens.Valid() {
+		return nil, ErrNoTokens
+	}
+	return tokens, nil
+}
@@ -0,0 +1,202 @@
+// Package deviceerror controls the error response bodies of device endpoints.
+//
+// Error responses of device-facing handlers may contain internal
+// details (e.g. from proxied services) and some proxies log response
+// bodies. By default the body of every 4xx and 5xx response is
+// replaced with the HTTP status text and the original body is logged
+// instead. Handlers can be configured with custom bodies or to pass
+// their own error bodies through.
+package deviceerror
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultContentType is the content type of replaced error bodies.
+const DefaultContentType = "text/plain; charset=utf-8"
+
+// maxDetail is the maximum number of bytes of an original error body
+// that are logged.
+const maxDetail = 1024
+
+// Policy configures the error responses of a handler.
+type Policy struct {
+	// Passthrough returns the original error bodies of the handler.
+	Passthrough bool `json:"passthrough,omitempty"`
+
+	// ContentType is the content type of the bodies.
+	// DefaultContentType is used if empty.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Bodies are the response bodies keyed by status code (e.g. "404")
+	// or status class ("4xx" or "5xx"). The status text is returned
+	// for statuses without a body.
+	Bodies map[string]string `json:"bodies,omitempty"`
+}
+
+// body returns the response body and content type for status.
+func (p *Policy) body(status int) (string, string) {
+	contentType := DefaultContentType
+	if p != nil && p.ContentType != "" {
+		contentType = p.ContentType
+	}
+	if p != nil {
+		if body, ok := p.Bodies[strconv.Itoa(status)]; ok {
+			return body, contentType
+		}
+		if body, ok := p.Bodies[fmt.Sprintf("%dxx", status/100)]; ok {
+			return body, contentType
+		}
+	}
+	// same as http.Error
+	return http.StatusText(status) + "\n", DefaultContentType
+}
+
+// Config is the error response policies keyed by handler name.
+// The policy named "*" applies to handlers without a policy.
+type Config map[string]*Policy
+
+// LoadConfig loads the JSON config at path.
+func LoadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("unmarshal device error config: %w", err)
+	}
+	for name, p := range c {
+		if p == nil {
+			return nil, fmt.Errorf("handler %s: empty policy", name)
+		}
+		for key := range p.Bodies {
+			if !validKey(key) {
+				return nil, fmt.Errorf("handler %s: invalid status: %q", name, key)
+			}
+		}
+	}
+	return c, nil
+}
+
+// validKey reports whether key is a 4xx or 5xx status code or class.
+func validKey(key string) bool {
+	if key == "4xx" || key == "5xx" {
+		return true
+	}
+	status, err := strconv.Atoi(key)
+	return err == nil && status >= 400 && status < 600
+}
+
+// Policy returns the policy of handler name.
+// The strict default policy (nil) is returned if none is configured.
+func (c Config) Policy(name string) *Policy {
+	if p, ok := c[name]; ok {
+		return p
+	}
+	return c["*"]
+}
+
+// Middleware applies the error response policy of handler name to h.
+// Replaced error bodies are logged to logger.
+func (c Config) Middleware(name string, h http.Handler, logger log.Logger) http.Handler {
+	policy := c.Policy(name)
+	if policy != nil && policy.Passthrough {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w, policy: policy}
+		h.ServeHTTP(ew, r)
+		if ew.status == 0 {
+			return
+		}
+		logs := []interface{}{"msg", "replaced error response", "handler", name, "status", ew.status}
+		if len(ew.detail) > 0 {
+			logs = append(logs, "detail", string(ew.detail))
+		}
+		logger := ctxlog.Logger(r.Context(), logger)
+		if ew.status >= 500 {
+			logger.Info(logs...)
+		} else {
+			logger.Debug(logs...)
+		}
+	})
+}
+
+// errorWriter replaces the body of error responses.
+type errorWriter struct {
+	http.ResponseWriter
+	policy      *Policy
+	wroteHeader bool
+
+	// status is the status of a replaced error response.
+	status int
+
+	// detail is the start of the original error body.
+	detail []byte
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status) // let net/http log this
+		return
+	}
+	w.wroteHeader = true
+	if status < 400 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	body, contentType := w.policy.body(status)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.ResponseWriter.WriteHeader(status)
+	io.WriteString(w.ResponseWriter, body)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+	if n := maxDetail - len(w.detail); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.detail = append(w.detail, b[:n]...)
+	}
+	return len(b), nil
+}
+
+// Flush supports streaming handlers (e.g. reverse proxies).
+func (w *errorWriter) Flush() {
+	if w.status != 0 {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack supports handlers that take over the connection.
+func (w *errorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
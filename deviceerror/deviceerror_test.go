@@ -0,0 +1,51 @@
+package deviceerror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+func TestMiddleware(t *testing.T) {
+	internal := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte("ok"))
+		case "/missing":
+			http.Error(w, "no such table: enrollments", http.StatusNotFound)
+		default:
+			http.Error(w, "dial tcp 10.0.0.1:3306: connection refused", http.StatusInternalServerError)
+		}
+	})
+
+	c := Config{
+		"mdm":   {Bodies: map[string]string{"5xx": "try again later"}},
+		"proxy": {Passthrough: true},
+	}
+
+	for _, test := range []struct {
+		handler string
+		path    string
+		status  int
+		body    string
+	}{
+		{"mdm", "/ok", http.StatusOK, "ok"},
+		{"mdm", "/missing", http.StatusNotFound, "Not Found\n"},
+		{"mdm", "/error", http.StatusInternalServerError, "try again later"},
+		{"checkin", "/error", http.StatusInternalServerError, "Internal Server Error\n"},
+		{"proxy", "/error", http.StatusInternalServerError, "dial tcp 10.0.0.1:3306: connection refused\n"},
+	} {
+		t.Run(test.handler+test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.Middleware(test.handler, internal, log.NopLogger).ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+			if w.Code != test.status {
+				t.Errorf("status: have: %v, want: %v", w.Code, test.status)
+			}
+			if have := w.Body.String(); have != test.body {
+				t.Errorf("body: have: %q, want: %q", have, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Package directory synchronizes users and groups from an external
+// directory and assigns them to enrollments.
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// User is a directory user.
+type User struct {
+	// UserName is the unique directory user name.
+	UserName string `json:"user_name"`
+
+	// Email is the (primary) email address of the user.
+	// This is typically the Managed Apple ID of the user.
+	Email string `json:"email,omitempty"`
+
+	// Groups is the list of group names the user is a member of.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Matches reports whether name refers to u by either user name or email.
+func (u *User) Matches(name string) bool {
+	return strings.EqualFold(u.UserName, name) || (u.Email != "" && strings.EqualFold(u.Email, name))
+}
+
+// Source retrieves users from a directory.
+// A SCIM source is provided. Other directories (such as LDAP) may be
+// supported by implementing this interface.
+type Source interface {
+	Users(ctx context.Context) ([]*User, error)
+}
+
+// Store stores directory users and enrollment assignments.
+type Store interface {
+	// StoreUsers replaces all directory users with users.
+	StoreUsers(ctx context.Context, users []*User) error
+
+	// RetrieveUsers retrieves all directory users.
+	RetrieveUsers(ctx context.Context) ([]*User, error)
+
+	// StoreAssignment assigns enrollment id to user name.
+	// An empty user name removes the assignment.
+	StoreAssignment(ctx context.Context, id, user string) error
+
+	// RetrieveAssignments retrieves all assignments of enrollment IDs to user names.
+	RetrieveAssignments(ctx context.Context) (map[string]string, error)
+}
+
+// ErrUserNotFound is returned when a user is not in the directory.
+var ErrUserNotFound = errors.New("user not found")
+
+// Directory resolves users and groups to enrollments.
+type Directory struct {
+	store  Store
+	source Source
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures a directory.
+type Option func(*Directory)
+
+// WithClock configures the clock used for periodic syncs.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(d *Directory) {
+		d.clock = c
+	}
+}
+
+// New creates a new directory using store.
+// The source may be nil in which case only assignments are managed.
+func New(store Store, source Source, logger log.Logger, opts ...Option) *Directory {
+	if store == nil {
+		panic("nil store")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	d := &Directory{store: store, source: source, logger: logger, clock: clock.Real}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Store returns the underlying directory store.
+func (d *Directory) Store() Store {
+	return d.store
+}
+
+// Sync retrieves users from the source and stores them.
+func (d *Directory) Sync(ctx context.Context) (int, error) {
+	if d.source == nil {
+		return 0, errors.New("no directory source configured")
+	}
+	users, err := d.source.Users(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving users: %w", err)
+	}
+	if err = d.store.StoreUsers(ctx, users); err != nil {
+		return 0, fmt.Errorf("storing users: %w", err)
+	}
+	return len(users), nil
+}
+
+// Run periodically syncs users from the source every interval.
+// Blocks until ctx is done.
+func (d *Directory) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := d.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := d.Sync(ctx)
+		if err != nil {
+			d.logger.Info("msg", "directory sync", "err", err)
+		} else {
+			d.logger.Debug("msg", "directory sync", "users", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
+
+// user finds the user by name in users.
+func user(users []*User, name string) *User {
+	for _, u := range users {
+		if u.Matches(name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// EnrollmentUser returns the user assigned to enrollment id.
+func (d *Directory) EnrollmentUser(ctx context.Context, id string) (*User, error) {
+	assignments, err := d.store.RetrieveAssignments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving assignments: %w", err)
+	}
+	name, ok := assignments[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	users, err := d.store.RetrieveUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving users: %w", err)
+	}
+	if u := user(users, name); u != nil {
+		return u, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+// GroupEnrollments returns the enrollment IDs assigned to members of group.
+func (d *Directory) GroupEnrollments(ctx context.Context, group string) ([]string, error) {
+	assignments, err := d.store.RetrieveAssignments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving assignments: %w", err)
+	}
+	users, err := d.store.RetrieveUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving users: %w", err)
+	}
+	ids := []string{}
+	for id, name := range assignments {
+		u := user(users, name)
+		if u == nil {
+			continue
+		}
+		for _, g := range u.Groups {
+			if strings.EqualFold(g, group) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,70 @@
+package directory
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+func TestSCIMGroupEnrollments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if have, want := r.Header.Get("Authorization"), "Bearer secret"; have != want {
+			t.Errorf("have: %v, want: %v", have, want)
+		}
+		// return a single user per page to exercise paging
+		switch r.URL.Query().Get("startIndex") {
+		case "1":
+			fmt.Fprint(w, `{"totalResults":2,"Resources":[{"userName":"alice","emails":[{"value":"alice@example.com","primary":true}],"groups":[{"display":"Engineering"}]}]}`)
+		case "2":
+			fmt.Fprint(w, `{"totalResults":2,"Resources":[{"userName":"bob","groups":[{"display":"Sales"}]}]}`)
+		default:
+			t.Errorf("unexpected start index: %s", r.URL.Query().Get("startIndex"))
+		}
+	}))
+	defer srv.Close()
+
+	src, err := NewSCIM(srv.URL, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	d := New(NewKVStore(kvmap.New()), src, nil)
+
+	n, err := d.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// assign by email and by user name
+	if err = d.Store().StoreAssignment(ctx, "AAAA", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Store().StoreAssignment(ctx, "BBBB", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := d.GroupEnrollments(ctx, "engineering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := ids, []string{"AAAA"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	u, err := d.EnrollmentUser(ctx, "BBBB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := u.UserName, "bob"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,166 @@
+// Package http provides the HTTP API for the directory.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/directory"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// UsersHandler returns the synchronized directory users.
+func UsersHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		users, err := d.Store().RetrieveUsers(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving users", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if users == nil {
+			users = []*directory.User{}
+		}
+		httpapi.WriteJSON(w, users, logger)
+	}
+}
+
+// GroupEnrollmentsHandler returns the enrollment IDs assigned to
+// members of the group in the URL path.
+func GroupEnrollmentsHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		group := flow.Param(r.Context(), "group")
+		ids, err := d.GroupEnrollments(r.Context(), group)
+		if err != nil {
+			logger.Info("msg", "retrieving group enrollments", "group", group, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		httpapi.WriteJSON(w, ids, logger)
+	}
+}
+
+// EnrollmentUserHandler returns the user assigned to the enrollment ID in the URL path.
+func EnrollmentUserHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		id := flow.Param(r.Context(), "id")
+		u, err := d.EnrollmentUser(r.Context(), id)
+		if errors.Is(err, directory.ErrUserNotFound) {
+			httpapi.JSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving enrollment user", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		httpapi.WriteJSON(w, u, logger)
+	}
+}
+
+type assignment struct {
+	User string `json:"user"`
+}
+
+// PutAssignmentHandler assigns the enrollment ID in the URL path to
+// the user in the JSON body.
+func PutAssignmentHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		id := flow.Param(r.Context(), "id")
+		a := new(assignment)
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding assignment: %w", err), http.StatusBadRequest)
+			return
+		}
+		if a.User == "" {
+			httpapi.JSONError(w, errors.New("empty user"), http.StatusBadRequest)
+			return
+		}
+		if err := d.Store().StoreAssignment(r.Context(), id, a.User); err != nil {
+			logger.Info("msg", "storing assignment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteAssignmentHandler removes the user assignment of the enrollment ID in the URL path.
+func DeleteAssignmentHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		id := flow.Param(r.Context(), "id")
+		if err := d.Store().StoreAssignment(r.Context(), id, ""); err != nil {
+			logger.Info("msg", "deleting assignment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SyncHandler immediately syncs users from the directory source.
+func SyncHandler(d *directory.Directory, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		n, err := d.Sync(r.Context())
+		if err != nil {
+			logger.Info("msg", "directory sync", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		httpapi.WriteJSON(w, map[string]int{"users": n}, logger)
+	}
+}
+
+// HandleAPIv1 registers the directory API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, d *directory.Directory) {
+	if d == nil {
+		panic("nil directory")
+	}
+
+	mux.Handle(
+		prefix+"/directory/users",
+		UsersHandler(d, logger.With("handler", "directory-users")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/directory/groups/:group/enrollments",
+		GroupEnrollmentsHandler(d, logger.With("handler", "directory-group-enrollments")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/directory/assignments/:id",
+		EnrollmentUserHandler(d, logger.With("handler", "directory-get-assignment")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/directory/assignments/:id",
+		PutAssignmentHandler(d, logger.With("handler", "directory-put-assignment")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/directory/assignments/:id",
+		DeleteAssignmentHandler(d, logger.With("handler", "directory-delete-assignment")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/directory/sync",
+		SyncHandler(d, logger.With("handler", "directory-sync")),
+		"POST",
+	)
+}
@@ -0,0 +1,83 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyUsers          = "users"
+	keyPfxAssignments = "assign."
+)
+
+// KVStore stores directory users and assignments in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new directory store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreUsers replaces all directory users with users.
+func (s *KVStore) StoreUsers(ctx context.Context, users []*User) error {
+	v, err := json.Marshal(users)
+	if err != nil {
+		return fmt.Errorf("marshal users: %w", err)
+	}
+	return s.b.Set(ctx, keyUsers, v)
+}
+
+// RetrieveUsers retrieves all directory users.
+func (s *KVStore) RetrieveUsers(ctx context.Context) ([]*User, error) {
+	v, err := s.b.Get(ctx, keyUsers)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []*User
+	if err = json.Unmarshal(v, &users); err != nil {
+		return nil, fmt.Errorf("unmarshal users: %w", err)
+	}
+	return users, nil
+}
+
+// StoreAssignment assigns enrollment id to user name.
+func (s *KVStore) StoreAssignment(ctx context.Context, id, user string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if user == "" {
+		return s.b.Delete(ctx, keyPfxAssignments+id)
+	}
+	return s.b.Set(ctx, keyPfxAssignments+id, []byte(user))
+}
+
+// RetrieveAssignments retrieves all assignments of enrollment IDs to user names.
+func (s *KVStore) RetrieveAssignments(ctx context.Context) (map[string]string, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPfxAssignments)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, err := s.b.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return ret, err
+		}
+		ret[strings.TrimPrefix(k, keyPfxAssignments)] = string(v)
+	}
+	return ret, nil
+}
@@ -0,0 +1,127 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// scimPageSize is the number of users requested per SCIM page.
+const scimPageSize = 100
+
+// SCIM is a directory source that retrieves users from a SCIM 2.0 service.
+type SCIM struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewSCIM creates a new SCIM directory source.
+// The base URL is the SCIM service root (i.e. the URL to which
+// "/Users" is appended). The token is sent as a bearer token if not empty.
+// If client is nil then [http.DefaultClient] is used.
+func NewSCIM(baseURL, token string, client *http.Client) (*SCIM, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("parsing SCIM URL: %w", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &SCIM{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  client,
+	}, nil
+}
+
+type scimUser struct {
+	UserName string `json:"userName"`
+	Active   *bool  `json:"active"`
+	Emails   []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	} `json:"emails"`
+	Groups []struct {
+		Display string `json:"display"`
+	} `json:"groups"`
+}
+
+type scimListResponse struct {
+	TotalResults int        `json:"totalResults"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []scimUser `json:"Resources"`
+}
+
+// page retrieves a single page of SCIM users.
+func (s *SCIM) page(ctx context.Context, startIndex int) (*scimListResponse, error) {
+	v := url.Values{}
+	v.Set("startIndex", strconv.Itoa(startIndex))
+	v.Set("count", strconv.Itoa(scimPageSize))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/Users?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/scim+json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	list := new(scimListResponse)
+	if err = json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("decoding SCIM response: %w", err)
+	}
+	return list, nil
+}
+
+// Users retrieves all active users (and their group memberships) from the SCIM service.
+func (s *SCIM) Users(ctx context.Context) ([]*User, error) {
+	var users []*User
+	for start := 1; ; {
+		list, err := s.page(ctx, start)
+		if err != nil {
+			return nil, err
+		}
+		for _, su := range list.Resources {
+			if su.Active != nil && !*su.Active {
+				continue
+			}
+			u := &User{UserName: su.UserName}
+			for i, e := range su.Emails {
+				if e.Primary || i == 0 {
+					u.Email = e.Value
+				}
+			}
+			for _, g := range su.Groups {
+				u.Groups = append(u.Groups, g.Display)
+			}
+			users = append(users, u)
+		}
+		if len(list.Resources) < 1 {
+			break
+		}
+		start += len(list.Resources)
+		if start > list.TotalResults {
+			break
+		}
+	}
+	if users == nil {
+		// refuse to replace the stored users with an empty directory
+		return nil, errors.New("no users returned")
+	}
+	return users, nil
+}
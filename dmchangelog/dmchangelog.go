@@ -0,0 +1,399 @@
+// Package dmchangelog records mutations of declarations, set
+// declarations, and enrollment sets in DM storage as a machine-readable
+// change log. Changes include the actor and hashes of the state of the
+// mutated object before and after the change.
+package dmchangelog
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/audit"
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/jessepeterson/kmfddm/storage"
+	"github.com/micromdm/nanolib/http/trace"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Kinds of changed objects.
+const (
+	KindDeclaration = "declaration"
+	KindSet         = "set"
+	KindEnrollment  = "enrollment"
+)
+
+// Change operations.
+const (
+	OpStoreDeclaration  = "store_declaration"
+	OpDeleteDeclaration = "delete_declaration"
+	OpAddDeclaration    = "add_declaration"
+	OpRemoveDeclaration = "remove_declaration"
+	OpAddSet            = "add_set"
+	OpRemoveSet         = "remove_set"
+	OpRemoveAllSets     = "remove_all_sets"
+)
+
+// Change is a single mutation of DM storage.
+// The hashes are of the declaration JSON for declarations, of the
+// declaration identifiers of sets, and of the set names of enrollments.
+// Empty hashes mean the object did not exist (or was empty).
+type Change struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	Op        string    `json:"op"`
+	Kind      string    `json:"kind"`
+
+	// Subject is the declaration identifier, set name, or enrollment ID.
+	Subject string `json:"subject"`
+
+	// Object is the declaration identifier added to or removed from a
+	// set or the set name added to or removed from an enrollment.
+	Object string `json:"object,omitempty"`
+
+	BeforeHash string `json:"before_hash,omitempty"`
+	AfterHash  string `json:"after_hash,omitempty"`
+	TraceID    string `json:"trace_id,omitempty"`
+}
+
+// Query filters changes.
+// Zero-valued fields are not filtered on.
+type Query struct {
+	Kind    string
+	Subject string
+	Actor   string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Match reports whether c satisfies q.
+func (q *Query) Match(c *Change) bool {
+	if q == nil {
+		return true
+	}
+	if q.Kind != "" && q.Kind != c.Kind {
+		return false
+	}
+	if q.Subject != "" && q.Subject != c.Subject && q.Subject != c.Object {
+		return false
+	}
+	if q.Actor != "" && q.Actor != c.Actor {
+		return false
+	}
+	if !q.Since.IsZero() && c.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !c.Timestamp.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Store stores and retrieves changes.
+type Store interface {
+	// StoreChange stores c.
+	StoreChange(ctx context.Context, c *Change) error
+
+	// RetrieveChanges retrieves the changes matching q, newest first.
+	RetrieveChanges(ctx context.Context, q *Query) ([]*Change, error)
+}
+
+// Storage is the DM API storage whose mutations are recorded.
+// Enrollment ID retrieval is included for set membership tooling.
+type Storage interface {
+	storage.EnrollmentIDRetriever
+	storage.DeclarationAPIStorage
+	storage.SetDeclarationStorage
+	storage.SetRetreiver
+	storage.StatusAPIStorage
+	storage.EnrollmentSetStorage
+}
+
+type ctxActor struct{}
+
+// WithActor returns a copy of ctx with the actor of changes.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, ctxActor{}, actor)
+}
+
+// Actor returns the actor of changes in ctx.
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(ctxActor{}).(string)
+	return actor
+}
+
+// Middleware returns HTTP middleware that sets the actor of changes
+// made by requests using actorFn.
+func Middleware(actorFn audit.ActorFn) func(http.Handler) http.Handler {
+	if actorFn == nil {
+		panic("nil actor function")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithActor(r.Context(), actorFn(r))))
+		})
+	}
+}
+
+// Recorder wraps DM storage and records its mutations to a change store.
+// Mutations that do not change storage are not recorded.
+type Recorder struct {
+	Storage
+	changes Store
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the recorder.
+type Option func(*Recorder)
+
+// WithLogger configures a logger for the recorder.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(r *Recorder) {
+		r.logger = logger
+	}
+}
+
+// WithClock configures the clock of the recorder.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Recorder) {
+		r.clock = c
+	}
+}
+
+// New creates a new recorder of the mutations of store to changes.
+func New(store Storage, changes Store, opts ...Option) *Recorder {
+	if store == nil {
+		panic("nil storage")
+	}
+	if changes == nil {
+		panic("nil change store")
+	}
+	r := &Recorder{
+		Storage: store,
+		changes: changes,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// newID generates a new time-sortable change ID.
+func newID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%016x%x", t.UnixNano(), b)
+}
+
+// hashBytes returns the hex SHA-256 hash of b or an empty string for empty b.
+func hashBytes(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// hashList returns the hash of the sorted list l.
+func hashList(l []string) string {
+	if len(l) < 1 {
+		return ""
+	}
+	sorted := append([]string(nil), l...)
+	sort.Strings(sorted)
+	return hashBytes([]byte(strings.Join(sorted, "\n")))
+}
+
+// declarationHash returns the hash of the stored declaration id.
+func (r *Recorder) declarationHash(ctx context.Context, id string) string {
+	d, err := r.Storage.RetrieveDeclaration(ctx, id)
+	if err != nil || d == nil {
+		// missing declarations are reported as errors by some backends
+		return ""
+	}
+	return declarationHash(d)
+}
+
+func declarationHash(d *ddm.Declaration) string {
+	if len(d.Raw) > 0 {
+		return hashBytes(d.Raw)
+	}
+	b, _ := json.Marshal(d)
+	return hashBytes(b)
+}
+
+// setHash returns the hash of the declarations of set.
+func (r *Recorder) setHash(ctx context.Context, set string) string {
+	ids, err := r.Storage.RetrieveSetDeclarations(ctx, set)
+	if err != nil {
+		return ""
+	}
+	return hashList(ids)
+}
+
+// enrollmentHash returns the hash of the sets of enrollment id.
+func (r *Recorder) enrollmentHash(ctx context.Context, id string) string {
+	sets, err := r.Storage.RetrieveEnrollmentSets(ctx, id)
+	if err != nil {
+		return ""
+	}
+	return hashList(sets)
+}
+
+// record stores c logging any error.
+// Errors are not returned as the storage mutation already happened.
+func (r *Recorder) record(ctx context.Context, c *Change) {
+	c.Timestamp = r.clock.Now()
+	c.ID = newID(c.Timestamp)
+	c.Actor = Actor(ctx)
+	c.TraceID = trace.GetTraceID(ctx)
+	if err := r.changes.StoreChange(ctx, c); err != nil {
+		ctxlog.Logger(ctx, r.logger).Info(
+			"msg", "recording change",
+			"op", c.Op,
+			"subject", c.Subject,
+			"err", err,
+		)
+	}
+}
+
+// StoreDeclaration stores d and records the change.
+func (r *Recorder) StoreDeclaration(ctx context.Context, d *ddm.Declaration) (bool, error) {
+	before := r.declarationHash(ctx, d.Identifier)
+	changed, err := r.Storage.StoreDeclaration(ctx, d)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpStoreDeclaration,
+		Kind:       KindDeclaration,
+		Subject:    d.Identifier,
+		BeforeHash: before,
+		AfterHash:  declarationHash(d),
+	})
+	return changed, nil
+}
+
+// DeleteDeclaration deletes declaration id and records the change.
+func (r *Recorder) DeleteDeclaration(ctx context.Context, id string) (bool, error) {
+	before := r.declarationHash(ctx, id)
+	changed, err := r.Storage.DeleteDeclaration(ctx, id)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpDeleteDeclaration,
+		Kind:       KindDeclaration,
+		Subject:    id,
+		BeforeHash: before,
+	})
+	return changed, nil
+}
+
+// StoreSetDeclaration adds declaration id to set and records the change.
+func (r *Recorder) StoreSetDeclaration(ctx context.Context, set, id string) (bool, error) {
+	before := r.setHash(ctx, set)
+	changed, err := r.Storage.StoreSetDeclaration(ctx, set, id)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpAddDeclaration,
+		Kind:       KindSet,
+		Subject:    set,
+		Object:     id,
+		BeforeHash: before,
+		AfterHash:  r.setHash(ctx, set),
+	})
+	return changed, nil
+}
+
+// RemoveSetDeclaration removes declaration id from set and records the change.
+func (r *Recorder) RemoveSetDeclaration(ctx context.Context, set, id string) (bool, error) {
+	before := r.setHash(ctx, set)
+	changed, err := r.Storage.RemoveSetDeclaration(ctx, set, id)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpRemoveDeclaration,
+		Kind:       KindSet,
+		Subject:    set,
+		Object:     id,
+		BeforeHash: before,
+		AfterHash:  r.setHash(ctx, set),
+	})
+	return changed, nil
+}
+
+// StoreEnrollmentSet adds set to enrollment id and records the change.
+func (r *Recorder) StoreEnrollmentSet(ctx context.Context, id, set string) (bool, error) {
+	before := r.enrollmentHash(ctx, id)
+	changed, err := r.Storage.StoreEnrollmentSet(ctx, id, set)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpAddSet,
+		Kind:       KindEnrollment,
+		Subject:    id,
+		Object:     set,
+		BeforeHash: before,
+		AfterHash:  r.enrollmentHash(ctx, id),
+	})
+	return changed, nil
+}
+
+// RemoveEnrollmentSet removes set from enrollment id and records the change.
+func (r *Recorder) RemoveEnrollmentSet(ctx context.Context, id, set string) (bool, error) {
+	before := r.enrollmentHash(ctx, id)
+	changed, err := r.Storage.RemoveEnrollmentSet(ctx, id, set)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpRemoveSet,
+		Kind:       KindEnrollment,
+		Subject:    id,
+		Object:     set,
+		BeforeHash: before,
+		AfterHash:  r.enrollmentHash(ctx, id),
+	})
+	return changed, nil
+}
+
+// RemoveAllEnrollmentSets removes all sets from enrollment id and
+// records the change.
+func (r *Recorder) RemoveAllEnrollmentSets(ctx context.Context, id string) (bool, error) {
+	before := r.enrollmentHash(ctx, id)
+	changed, err := r.Storage.RemoveAllEnrollmentSets(ctx, id)
+	if err != nil || !changed {
+		return changed, err
+	}
+	r.record(ctx, &Change{
+		Op:         OpRemoveAllSets,
+		Kind:       KindEnrollment,
+		Subject:    id,
+		BeforeHash: before,
+	})
+	return changed, nil
+}
@@ -0,0 +1,76 @@
+package dmchangelog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+// sets is an in-memory enrollment set store.
+type sets struct {
+	Storage
+	m map[string][]string
+}
+
+func (s *sets) RetrieveEnrollmentSets(_ context.Context, id string) ([]string, error) {
+	return s.m[id], nil
+}
+
+func (s *sets) StoreEnrollmentSet(_ context.Context, id, set string) (bool, error) {
+	for _, v := range s.m[id] {
+		if v == set {
+			return false, nil
+		}
+	}
+	s.m[id] = append(s.m[id], set)
+	return true, nil
+}
+
+func (s *sets) RetrieveDeclaration(_ context.Context, _ string) (*ddm.Declaration, error) {
+	return nil, nil
+}
+
+func (s *sets) StoreDeclaration(_ context.Context, _ *ddm.Declaration) (bool, error) {
+	return true, nil
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := WithActor(context.Background(), "admin")
+	changes := NewKVStore(kvmap.New())
+	r := New(&sets{m: map[string][]string{"ID1": {"a"}}}, changes)
+
+	for _, set := range []string{"b", "b"} {
+		if _, err := r.StoreEnrollmentSet(ctx, "ID1", set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.StoreDeclaration(ctx, &ddm.Declaration{Identifier: "d1", Raw: []byte(`{"Identifier":"d1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := changes.RetrieveChanges(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unchanged second store is not recorded
+	if len(all) != 2 {
+		t.Fatalf("have: %d changes, want: 2", len(all))
+	}
+
+	c, err := changes.RetrieveChanges(ctx, &Query{Kind: KindEnrollment, Subject: "ID1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 {
+		t.Fatalf("have: %d changes, want: 1", len(c))
+	}
+	if c[0].Op != OpAddSet || c[0].Object != "b" || c[0].Actor != "admin" {
+		t.Errorf("incorrect change: %+v", c[0])
+	}
+	if c[0].BeforeHash != hashList([]string{"a"}) || c[0].AfterHash != hashList([]string{"b", "a"}) {
+		t.Errorf("incorrect hashes: %+v", c[0])
+	}
+}
@@ -0,0 +1,85 @@
+// Package http provides the HTTP API for querying the DM change log.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/dmchangelog"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultLimit is the number of changes returned if no limit is given.
+const DefaultLimit = 100
+
+// parseTime parses the RFC 3339 query parameter key from r.
+func parseTime(r *http.Request, key string) (t time.Time, err error) {
+	if v := r.URL.Query().Get(key); v != "" {
+		t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			err = fmt.Errorf("parsing %s: %w", key, err)
+		}
+	}
+	return
+}
+
+// ChangesHandler returns changes matching the query parameters
+// kind, subject, actor, since, until, and limit.
+func ChangesHandler(store dmchangelog.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := &dmchangelog.Query{
+			Kind:    r.URL.Query().Get("kind"),
+			Subject: r.URL.Query().Get("subject"),
+			Actor:   r.URL.Query().Get("actor"),
+		}
+
+		var err error
+		if q.Since, err = parseTime(r, "since"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Until, err = parseTime(r, "until"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Limit, err = httpapi.QueryInt(r, "limit", DefaultLimit); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if q.Limit < 1 {
+			httpapi.JSONError(w, errors.New("invalid limit"), http.StatusBadRequest)
+			return
+		}
+
+		changes, err := store.RetrieveChanges(r.Context(), q)
+		if err != nil {
+			logger.Info("msg", "retrieving changes", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if changes == nil {
+			changes = []*dmchangelog.Change{}
+		}
+
+		httpapi.WriteJSON(w, changes, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM change log API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store dmchangelog.Store) {
+	mux.Handle(
+		prefix+"/dm/changes",
+		ChangesHandler(store, logger.With("handler", "dm-changes")),
+		"GET",
+	)
+}
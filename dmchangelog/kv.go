@@ -0,0 +1,64 @@
+package dmchangelog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores changes in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new change store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreChange stores c keyed by its (time-sortable) ID.
+func (s *KVStore) StoreChange(ctx context.Context, c *Change) error {
+	if c == nil || c.ID == "" {
+		return errors.New("invalid change")
+	}
+	v, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal change: %w", err)
+	}
+	return s.b.Set(ctx, c.ID, v)
+}
+
+// RetrieveChanges retrieves the changes matching q, newest first.
+func (s *KVStore) RetrieveChanges(ctx context.Context, q *Query) ([]*Change, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var changes []*Change
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, err := s.b.Get(ctx, keys[i])
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return changes, fmt.Errorf("getting change %s: %w", keys[i], err)
+		}
+		c := new(Change)
+		if err = json.Unmarshal(v, c); err != nil {
+			return changes, fmt.Errorf("unmarshal change %s: %w", keys[i], err)
+		}
+		if !q.Match(c) {
+			continue
+		}
+		changes = append(changes, c)
+		if q != nil && q.Limit > 0 && len(changes) >= q.Limit {
+			break
+		}
+	}
+	return changes, nil
+}
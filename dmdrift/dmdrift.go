@@ -0,0 +1,161 @@
+// Package dmdrift compares the declarations the server expects an
+// enrollment to have with the declaration statuses it last reported.
+package dmdrift
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+// Declaration states.
+const (
+	// StateInSync declarations are reported with the expected server token and are valid.
+	StateInSync = "in_sync"
+
+	// StateMissing declarations are expected but not reported.
+	StateMissing = "missing"
+
+	// StateStale declarations are reported with a different server
+	// token: the enrollment has not applied the current declaration.
+	StateStale = "stale"
+
+	// StateFailing declarations are reported as invalid.
+	StateFailing = "failing"
+
+	// StateUnexpected declarations are reported but not expected,
+	// e.g. the enrollment has not removed them yet.
+	StateUnexpected = "unexpected"
+)
+
+// Store retrieves the expected declarations and the reported
+// declaration statuses of enrollments.
+type Store interface {
+	RetrieveDeclarationItemsJSON(ctx context.Context, enrollmentID string) ([]byte, error)
+	RetrieveDeclarationStatus(ctx context.Context, enrollmentIDs []string) (map[string][]ddm.DeclarationQueryStatus, error)
+}
+
+// Declaration is the state of a declaration of an enrollment.
+type Declaration struct {
+	Identifier string `json:"identifier"`
+	State      string `json:"state"`
+
+	// Category is the declaration items category, e.g. "Configurations".
+	// It is empty for unexpected declarations.
+	Category string `json:"category,omitempty"`
+
+	ServerToken         string `json:"server_token,omitempty"`
+	ReportedServerToken string `json:"reported_server_token,omitempty"`
+
+	Active         *bool       `json:"active,omitempty"`
+	Valid          string      `json:"valid,omitempty"`
+	Reasons        interface{} `json:"reasons,omitempty"`
+	StatusReceived *time.Time  `json:"status_received,omitempty"`
+}
+
+// Report is the drift of an enrollment.
+type Report struct {
+	EnrollmentID string `json:"enrollment_id"`
+
+	// InSync is true if all declarations are in sync.
+	InSync bool `json:"in_sync"`
+
+	// Counts are the number of declarations by state.
+	Counts map[string]int `json:"counts"`
+
+	Declarations []*Declaration `json:"declarations"`
+}
+
+// declarationItems is the declaration items JSON.
+type declarationItems struct {
+	Declarations map[string][]struct {
+		Identifier  string
+		ServerToken string
+	}
+}
+
+// Compare compares the expected declarations of enrollment id to its
+// last reported declaration statuses.
+func Compare(ctx context.Context, store Store, id string) (*Report, error) {
+	itemsJSON, err := store.RetrieveDeclarationItemsJSON(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration items: %w", err)
+	}
+	var items declarationItems
+	if err = json.Unmarshal(itemsJSON, &items); err != nil {
+		return nil, fmt.Errorf("unmarshal declaration items: %w", err)
+	}
+
+	statuses, err := store.RetrieveDeclarationStatus(ctx, []string{id})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration status: %w", err)
+	}
+	reported := make(map[string]ddm.DeclarationQueryStatus)
+	for _, status := range statuses[id] {
+		reported[status.Identifier] = status
+	}
+
+	report := &Report{
+		EnrollmentID: id,
+		Counts:       make(map[string]int),
+		Declarations: []*Declaration{},
+	}
+	add := func(d *Declaration) {
+		report.Declarations = append(report.Declarations, d)
+		report.Counts[d.State]++
+	}
+
+	for category, declarations := range items.Declarations {
+		for _, item := range declarations {
+			d := &Declaration{
+				Identifier:  item.Identifier,
+				Category:    category,
+				ServerToken: item.ServerToken,
+			}
+			status, ok := reported[item.Identifier]
+			delete(reported, item.Identifier)
+			if ok {
+				setStatus(d, status)
+			}
+			switch {
+			case !ok:
+				d.State = StateMissing
+			case status.ServerToken != item.ServerToken:
+				d.State = StateStale
+			case status.Valid == "invalid":
+				d.State = StateFailing
+			default:
+				d.State = StateInSync
+			}
+			add(d)
+		}
+	}
+	for _, status := range reported {
+		d := &Declaration{Identifier: status.Identifier, State: StateUnexpected}
+		setStatus(d, status)
+		add(d)
+	}
+
+	sort.Slice(report.Declarations, func(i, j int) bool {
+		return report.Declarations[i].Identifier < report.Declarations[j].Identifier
+	})
+	report.InSync = report.Counts[StateInSync] == len(report.Declarations)
+	return report, nil
+}
+
+// setStatus sets the reported status of d.
+func setStatus(d *Declaration, status ddm.DeclarationQueryStatus) {
+	active := status.Active
+	d.Active = &active
+	d.Valid = status.Valid
+	d.ReportedServerToken = status.ServerToken
+	d.Reasons = status.Reasons
+	if !status.StatusReceived.IsZero() {
+		received := status.StatusReceived
+		d.StatusReceived = &received
+	}
+}
@@ -0,0 +1,59 @@
+package dmdrift
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+type store struct {
+	items    string
+	statuses []ddm.DeclarationQueryStatus
+}
+
+func (s *store) RetrieveDeclarationItemsJSON(context.Context, string) ([]byte, error) {
+	return []byte(s.items), nil
+}
+
+func (s *store) RetrieveDeclarationStatus(_ context.Context, ids []string) (map[string][]ddm.DeclarationQueryStatus, error) {
+	return map[string][]ddm.DeclarationQueryStatus{ids[0]: s.statuses}, nil
+}
+
+func TestCompare(t *testing.T) {
+	status := func(id, token, valid string) ddm.DeclarationQueryStatus {
+		return ddm.DeclarationQueryStatus{DeclarationStatus: ddm.DeclarationStatus{Identifier: id, ServerToken: token, Valid: valid, Active: true}}
+	}
+	s := &store{
+		items: `{"Declarations":{"Activations":[{"Identifier":"a1","ServerToken":"t1"}],"Configurations":[{"Identifier":"c1","ServerToken":"t2"},{"Identifier":"c2","ServerToken":"t3"},{"Identifier":"c3","ServerToken":"t4"}]}}`,
+		statuses: []ddm.DeclarationQueryStatus{
+			status("a1", "t1", "valid"),
+			status("c1", "old", "valid"),
+			status("c2", "t3", "invalid"),
+			status("x1", "t5", "valid"),
+		},
+	}
+
+	report, err := Compare(context.Background(), s, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.InSync {
+		t.Error("report in sync")
+	}
+	want := map[string]string{
+		"a1": StateInSync,
+		"c1": StateStale,
+		"c2": StateFailing,
+		"c3": StateMissing,
+		"x1": StateUnexpected,
+	}
+	if have, want := len(report.Declarations), len(want); have != want {
+		t.Fatalf("declarations: have: %v, want: %v", have, want)
+	}
+	for _, d := range report.Declarations {
+		if d.State != want[d.Identifier] {
+			t.Errorf("%s: have: %v, want: %v", d.Identifier, d.State, want[d.Identifier])
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package http provides the HTTP API for DM drift reports.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/dmdrift"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// DriftHandler returns the drift report of the enrollment in the URL path.
+func DriftHandler(store dmdrift.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		report, err := dmdrift.Compare(r.Context(), store, id)
+		if err != nil {
+			logger.Info("msg", "comparing declarations", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, report, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM drift API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store dmdrift.Store) {
+	mux.Handle(
+		prefix+"/dm/drift/:id",
+		DriftHandler(store, logger.With("handler", "get-dm-drift")),
+		"GET",
+	)
+}
@@ -0,0 +1,380 @@
+// Package dmgc finds and collects orphaned DM declarations and assets.
+//
+// Declarations in DM sets are in use. So are the declarations they
+// reference by identifier in their payloads (e.g. the configurations
+// of activations and the asset declarations of configurations). All
+// other declarations are orphaned. Hosted DM assets not referenced by
+// the data URL of a declaration in use are orphaned too.
+package dmgc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/ddmasset"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultGrace is the default time an item must be orphaned before it
+// is deleted.
+const DefaultGrace = 7 * 24 * time.Hour
+
+// Orphan kinds.
+const (
+	KindDeclaration = "declaration"
+	KindAsset       = "asset"
+)
+
+// Orphan is an orphaned declaration or asset.
+type Orphan struct {
+	Kind string `json:"kind"`
+
+	// ID is the declaration identifier or asset name.
+	ID string `json:"id"`
+
+	// Since is when the item was first found orphaned.
+	Since time.Time `json:"since"`
+
+	Deleted bool   `json:"deleted,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Report is the result of a collection.
+type Report struct {
+	RunAt time.Time `json:"run_at"`
+
+	// Delete is true if orphans past the grace period were deleted.
+	Delete bool `json:"delete"`
+
+	// GraceSeconds is the grace period before orphans are deleted.
+	GraceSeconds int64 `json:"grace_seconds"`
+
+	Declarations int `json:"declarations"`
+	Assets       int `json:"assets"`
+
+	Orphans []*Orphan `json:"orphans"`
+}
+
+// Store stores when items were first found orphaned and the last report.
+type Store interface {
+	// RetrieveOrphans retrieves when the orphaned items of kind were
+	// first found orphaned, keyed by ID.
+	RetrieveOrphans(ctx context.Context, kind string) (map[string]time.Time, error)
+
+	// StoreOrphans replaces the orphaned items of kind.
+	StoreOrphans(ctx context.Context, kind string, orphans map[string]time.Time) error
+
+	StoreReport(ctx context.Context, r *Report) error
+
+	// RetrieveReport retrieves the last report.
+	// Nil is returned if no collection ran.
+	RetrieveReport(ctx context.Context) (*Report, error)
+}
+
+// DMStore retrieves and deletes declarations and retrieves sets.
+type DMStore interface {
+	RetrieveDeclarations(ctx context.Context) ([]string, error)
+	RetrieveDeclaration(ctx context.Context, declarationID string) (*ddm.Declaration, error)
+	DeleteDeclaration(ctx context.Context, declarationID string) (bool, error)
+	RetrieveSets(ctx context.Context) ([]string, error)
+	RetrieveSetDeclarations(ctx context.Context, setName string) ([]string, error)
+}
+
+// Collector finds and collects orphaned declarations and assets.
+type Collector struct {
+	store  Store
+	dm     DMStore
+	assets ddmasset.Store
+	grace  time.Duration
+	delete bool
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the collector.
+type Option func(*Collector)
+
+// WithAssets includes the hosted DM assets in store.
+func WithAssets(store ddmasset.Store) Option {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(c *Collector) {
+		c.assets = store
+	}
+}
+
+// WithGrace configures the time an item must be orphaned before it
+// is deleted.
+func WithGrace(d time.Duration) Option {
+	return func(c *Collector) {
+		if d >= 0 {
+			c.grace = d
+		}
+	}
+}
+
+// WithDelete deletes items orphaned longer than the grace period.
+// Without it orphans are only reported.
+func WithDelete() Option {
+	return func(c *Collector) {
+		c.delete = true
+	}
+}
+
+// WithLogger configures a logger for the collector.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(c *Collector) {
+		c.logger = logger
+	}
+}
+
+// WithClock configures the clock of the collector.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(col *Collector) {
+		col.clock = c
+	}
+}
+
+// New creates a new collector.
+func New(store Store, dm DMStore, opts ...Option) *Collector {
+	if store == nil {
+		panic("nil store")
+	}
+	if dm == nil {
+		panic("nil DM store")
+	}
+	c := &Collector{
+		store:  store,
+		dm:     dm,
+		grace:  DefaultGrace,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Report retrieves the last report.
+func (c *Collector) Report(ctx context.Context) (*Report, error) {
+	return c.store.RetrieveReport(ctx)
+}
+
+// inUse returns the declarations in use and their payloads.
+func (c *Collector) inUse(ctx context.Context, declarations map[string]bool) (map[string]json.RawMessage, error) {
+	sets, err := c.dm.RetrieveSets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving sets: %w", err)
+	}
+	var queue []string
+	for _, set := range sets {
+		ids, err := c.dm.RetrieveSetDeclarations(ctx, set)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving set %s declarations: %w", set, err)
+		}
+		queue = append(queue, ids...)
+	}
+
+	used := make(map[string]json.RawMessage)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := used[id]; ok || !declarations[id] {
+			continue
+		}
+		d, err := c.dm.RetrieveDeclaration(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving declaration %s: %w", id, err)
+		} else if d == nil {
+			continue
+		}
+		used[id] = d.Payload
+		for _, s := range payloadStrings(d.Payload) {
+			if declarations[s] {
+				queue = append(queue, s)
+			}
+		}
+	}
+	return used, nil
+}
+
+// payloadStrings returns all string values in the JSON payload.
+func payloadStrings(payload json.RawMessage) (ret []string) {
+	var v interface{}
+	if json.Unmarshal(payload, &v) != nil {
+		return nil
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			ret = append(ret, v)
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return
+}
+
+// Collect finds orphaned declarations and assets, deletes those past
+// the grace period (if enabled), and stores and returns the report.
+func (c *Collector) Collect(ctx context.Context) (*Report, error) {
+	now := c.clock.Now()
+	report := &Report{
+		RunAt:   now,
+		Delete:  c.delete,
+		Orphans: []*Orphan{},
+
+		GraceSeconds: int64(c.grace / time.Second),
+	}
+
+	ids, err := c.dm.RetrieveDeclarations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declarations: %w", err)
+	}
+	declarations := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		declarations[id] = true
+	}
+	report.Declarations = len(ids)
+	used, err := c.inUse(ctx, declarations)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphaned []string
+	for _, id := range ids {
+		if _, ok := used[id]; !ok {
+			orphaned = append(orphaned, id)
+		}
+	}
+	err = c.collect(ctx, report, KindDeclaration, orphaned, func(ctx context.Context, id string) error {
+		_, err := c.dm.DeleteDeclaration(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.assets != nil {
+		assets, err := c.assets.RetrieveAssets(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving assets: %w", err)
+		}
+		report.Assets = len(assets)
+		var payloads []string
+		for _, payload := range used {
+			payloads = append(payloads, payloadStrings(payload)...)
+		}
+		orphaned = nil
+		for _, a := range assets {
+			if !referenced(payloads, ddmasset.AssetsPath+url.PathEscape(a.Name)) {
+				orphaned = append(orphaned, a.Name)
+			}
+		}
+		if err = c.collect(ctx, report, KindAsset, orphaned, c.assets.DeleteAsset); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(report.Orphans, func(i, j int) bool {
+		if report.Orphans[i].Kind != report.Orphans[j].Kind {
+			return report.Orphans[i].Kind < report.Orphans[j].Kind
+		}
+		return report.Orphans[i].ID < report.Orphans[j].ID
+	})
+	if err = c.store.StoreReport(ctx, report); err != nil {
+		return nil, fmt.Errorf("storing report: %w", err)
+	}
+	return report, nil
+}
+
+// referenced reports whether a payload string ends with path.
+func referenced(payloads []string, path string) bool {
+	for _, s := range payloads {
+		if strings.HasSuffix(s, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect records the orphaned items of kind in report and deletes
+// those past the grace period (if enabled).
+func (c *Collector) collect(ctx context.Context, report *Report, kind string, orphaned []string, deleteFn func(context.Context, string) error) error {
+	since, err := c.store.RetrieveOrphans(ctx, kind)
+	if err != nil {
+		return fmt.Errorf("retrieving %s orphans: %w", kind, err)
+	}
+	now := c.clock.Now()
+	orphans := make(map[string]time.Time, len(orphaned))
+	for _, id := range orphaned {
+		o := &Orphan{Kind: kind, ID: id, Since: now}
+		if t, ok := since[id]; ok {
+			o.Since = t
+		}
+		report.Orphans = append(report.Orphans, o)
+		if !c.delete || now.Sub(o.Since) < c.grace {
+			orphans[id] = o.Since
+			continue
+		}
+		if err = deleteFn(ctx, id); err != nil {
+			o.Error = err.Error()
+			orphans[id] = o.Since
+			c.logger.Info("msg", "deleting orphan", "kind", kind, "id", id, "err", err)
+			continue
+		}
+		o.Deleted = true
+		c.logger.Debug("msg", "deleted orphan", "kind", kind, "id", id, "since", o.Since)
+	}
+	if err = c.store.StoreOrphans(ctx, kind, orphans); err != nil {
+		return fmt.Errorf("storing %s orphans: %w", kind, err)
+	}
+	return nil
+}
+
+// Run collects every interval until ctx is done.
+func (c *Collector) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			report, err := c.Collect(ctx)
+			if err != nil {
+				c.logger.Info("msg", "collecting orphans", "err", err)
+				continue
+			}
+			c.logger.Debug("msg", "collected orphans", "orphans", len(report.Orphans))
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
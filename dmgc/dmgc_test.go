@@ -0,0 +1,116 @@
+package dmgc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/ddmasset"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+type dmStore struct {
+	declarations map[string]string
+	sets         map[string][]string
+}
+
+func (s *dmStore) RetrieveDeclarations(context.Context) (ids []string, _ error) {
+	for id := range s.declarations {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *dmStore) RetrieveDeclaration(_ context.Context, id string) (*ddm.Declaration, error) {
+	return &ddm.Declaration{Identifier: id, Payload: json.RawMessage(s.declarations[id])}, nil
+}
+
+func (s *dmStore) DeleteDeclaration(_ context.Context, id string) (bool, error) {
+	delete(s.declarations, id)
+	return true, nil
+}
+
+func (s *dmStore) RetrieveSets(context.Context) (sets []string, _ error) {
+	for set := range s.sets {
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func (s *dmStore) RetrieveSetDeclarations(_ context.Context, set string) ([]string, error) {
+	return s.sets[set], nil
+}
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	dm := &dmStore{
+		declarations: map[string]string{
+			"act":    `{"StandardConfigurations":["cfg"]}`,
+			"cfg":    `{"Credential":{"AssetReference":"asset"}}`,
+			"asset":  `{"Reference":{"DataURL":"https://example.com/assets/a%20b"}}`,
+			"orphan": `{"StandardConfigurations":["cfg2"]}`,
+			"cfg2":   `{}`,
+		},
+		sets: map[string][]string{"set": {"act"}},
+	}
+	assets := ddmasset.NewKVStore(kvmap.New())
+	for _, name := range []string{"a b", "unused"} {
+		a, err := ddmasset.NewAsset(name, "", []byte(name), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assets.StoreAsset(ctx, a, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	col := New(NewKVStore(kvmap.New()), dm, WithAssets(assets), WithGrace(time.Hour), WithDelete(), WithClock(c))
+
+	r, err := col.Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, o := range r.Orphans {
+		if o.Deleted {
+			t.Errorf("deleted before grace period: %s", o.ID)
+		}
+		have = append(have, o.Kind+":"+o.ID)
+	}
+	want := []string{"asset:unused", "declaration:cfg2", "declaration:orphan"}
+	if len(have) != len(want) {
+		t.Fatalf("orphans: have: %v, want: %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("orphans: have: %v, want: %v", have, want)
+		}
+	}
+
+	c.Advance(2 * time.Hour)
+	if r, err = col.Collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range r.Orphans {
+		if !o.Deleted {
+			t.Errorf("not deleted after grace period: %s", o.ID)
+		}
+	}
+	if _, ok := dm.declarations["orphan"]; ok {
+		t.Error("orphan declaration not deleted")
+	}
+	if _, ok := dm.declarations["cfg"]; !ok {
+		t.Error("referenced declaration deleted")
+	}
+	if _, _, err = assets.RetrieveAsset(ctx, "unused"); err == nil {
+		t.Error("orphan asset not deleted")
+	}
+
+	if r, err = col.Report(ctx); err != nil || r == nil || len(r.Orphans) != 3 {
+		t.Errorf("report: have: %v, %v", r, err)
+	}
+}
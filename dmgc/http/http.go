@@ -0,0 +1,76 @@
+// Package http provides the HTTP API for DM garbage collection.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/dmgc"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoReport is returned when no collection ran yet.
+var ErrNoReport = errors.New("no report")
+
+// GetReportHandler returns the last collection report.
+func GetReportHandler(c *dmgc.Collector, logger log.Logger) http.HandlerFunc {
+	if c == nil {
+		panic("nil collector")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		report, err := c.Report(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving report", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if report == nil {
+			httpapi.JSONError(w, ErrNoReport, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, report, logger)
+	}
+}
+
+// CollectHandler runs a collection and returns its report.
+func CollectHandler(c *dmgc.Collector, logger log.Logger) http.HandlerFunc {
+	if c == nil {
+		panic("nil collector")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		report, err := c.Collect(r.Context())
+		if err != nil {
+			logger.Info("msg", "collecting orphans", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "collected orphans", "orphans", len(report.Orphans))
+		httpapi.WriteJSON(w, report, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM garbage collection API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, c *dmgc.Collector) {
+	mux.Handle(
+		prefix+"/dm/gc",
+		GetReportHandler(c, logger.With("handler", "get-dm-gc")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/gc",
+		CollectHandler(c, logger.With("handler", "run-dm-gc")),
+		"POST",
+	)
+}
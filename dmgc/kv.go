@@ -0,0 +1,87 @@
+package dmgc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPfxOrphans = "orphans."
+	keyReport     = "report"
+)
+
+// KVStore stores orphans and reports in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new orphan store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// RetrieveOrphans retrieves when the orphaned items of kind were first found orphaned.
+func (s *KVStore) RetrieveOrphans(ctx context.Context, kind string) (map[string]time.Time, error) {
+	v, err := s.b.Get(ctx, keyPfxOrphans+kind)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var orphans map[string]time.Time
+	if err = json.Unmarshal(v, &orphans); err != nil {
+		return nil, fmt.Errorf("unmarshal orphans: %w", err)
+	}
+	return orphans, nil
+}
+
+// StoreOrphans replaces the orphaned items of kind.
+func (s *KVStore) StoreOrphans(ctx context.Context, kind string, orphans map[string]time.Time) error {
+	if len(orphans) < 1 {
+		err := s.b.Delete(ctx, keyPfxOrphans+kind)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			err = nil
+		}
+		return err
+	}
+	v, err := json.Marshal(orphans)
+	if err != nil {
+		return fmt.Errorf("marshal orphans: %w", err)
+	}
+	return s.b.Set(ctx, keyPfxOrphans+kind, v)
+}
+
+// StoreReport stores r as the last report.
+func (s *KVStore) StoreReport(ctx context.Context, r *Report) error {
+	if r == nil {
+		return errors.New("nil report")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	return s.b.Set(ctx, keyReport, v)
+}
+
+// RetrieveReport retrieves the last report.
+func (s *KVStore) RetrieveReport(ctx context.Context) (*Report, error) {
+	v, err := s.b.Get(ctx, keyReport)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Report)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal report: %w", err)
+	}
+	return r, nil
+}
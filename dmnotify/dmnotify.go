@@ -0,0 +1,316 @@
+// Package dmnotify queues DM notifications to be processed in the
+// background. Notifying enrollments of a change to a widely assigned
+// declaration or set can take a long time. Queueing lets API requests
+// return immediately while the notification progress is reported.
+package dmnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultChunkSize is the default number of enrollments per notification
+// and progress update.
+const DefaultChunkSize = 500
+
+// DefaultRetention is the default time finished jobs are kept.
+const DefaultRetention = 24 * time.Hour
+
+// Job statuses.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Job is a queued DM notification and its progress.
+type Job struct {
+	ID string `json:"id"`
+
+	Declarations []string `json:"declarations,omitempty"`
+	Sets         []string `json:"sets,omitempty"`
+	IDs          []string `json:"ids,omitempty"`
+
+	Status string `json:"status"`
+
+	// Error is the error that stopped a failed job.
+	Error string `json:"error,omitempty"`
+
+	// Total is the number of enrollments the change applies to.
+	Total    int `json:"total"`
+	Notified int `json:"notified"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// Store stores jobs.
+type Store interface {
+	StoreJob(ctx context.Context, j *Job) error
+
+	// RetrieveJob retrieves job id.
+	// Nil is returned if the job does not exist.
+	RetrieveJob(ctx context.Context, id string) (*Job, error)
+
+	RetrieveJobs(ctx context.Context) ([]*Job, error)
+	DeleteJob(ctx context.Context, id string) error
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// EnrollmentIDFinder retrieves the enrollment IDs a DM change applies to.
+type EnrollmentIDFinder interface {
+	RetrieveEnrollmentIDs(ctx context.Context, declarations []string, sets []string, ids []string) ([]string, error)
+}
+
+// IDer generates job IDs.
+type IDer interface {
+	ID() string
+}
+
+// Queue queues DM notifications and notifies enrollments in the background.
+// It satisfies the DM notifier interface.
+type Queue struct {
+	store     Store
+	notifier  Notifier
+	finder    EnrollmentIDFinder
+	logger    log.Logger
+	clock     clock.Clock
+	ider      IDer
+	chunkSize int
+	retention time.Duration
+	signal    chan struct{}
+}
+
+// Option configures the queue.
+type Option func(*Queue)
+
+// WithLogger configures a logger for the queue.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(q *Queue) {
+		q.logger = logger
+	}
+}
+
+// WithClock configures the clock of the queue.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(q *Queue) {
+		q.clock = c
+	}
+}
+
+// WithIDer configures the generator of job IDs.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(q *Queue) {
+		q.ider = ider
+	}
+}
+
+// WithChunkSize configures the number of enrollments per notification
+// and progress update.
+func WithChunkSize(n int) Option {
+	return func(q *Queue) {
+		if n > 0 {
+			q.chunkSize = n
+		}
+	}
+}
+
+// WithRetention configures how long finished jobs are kept.
+func WithRetention(d time.Duration) Option {
+	return func(q *Queue) {
+		if d > 0 {
+			q.retention = d
+		}
+	}
+}
+
+// New creates a new queue notifying enrollments with notifier.
+func New(store Store, notifier Notifier, finder EnrollmentIDFinder, opts ...Option) *Queue {
+	if store == nil {
+		panic("nil store")
+	}
+	if notifier == nil {
+		panic("nil notifier")
+	}
+	if finder == nil {
+		panic("nil finder")
+	}
+	q := &Queue{
+		store:     store,
+		notifier:  notifier,
+		finder:    finder,
+		logger:    log.NopLogger,
+		clock:     clock.Real,
+		ider:      uuid.NewUUID(),
+		chunkSize: DefaultChunkSize,
+		retention: DefaultRetention,
+		signal:    make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Changed queues a notification job for the changes and returns.
+// The enrollments are notified when the queue is run.
+func (q *Queue) Changed(ctx context.Context, declarations []string, sets []string, ids []string) error {
+	if len(declarations) < 1 && len(sets) < 1 && len(ids) < 1 {
+		return nil
+	}
+	j := &Job{
+		ID:           q.ider.ID(),
+		Declarations: declarations,
+		Sets:         sets,
+		IDs:          ids,
+		Status:       StatusQueued,
+		CreatedAt:    q.clock.Now(),
+	}
+	if err := q.store.StoreJob(ctx, j); err != nil {
+		return fmt.Errorf("storing job: %w", err)
+	}
+	ctxlog.Logger(ctx, q.logger).Debug("msg", "queued notification", "job", j.ID)
+
+	// wake the queue runner
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Job retrieves the progress of job id.
+func (q *Queue) Job(ctx context.Context, id string) (*Job, error) {
+	return q.store.RetrieveJob(ctx, id)
+}
+
+// Jobs retrieves the progress of all jobs ordered by creation time.
+func (q *Queue) Jobs(ctx context.Context) ([]*Job, error) {
+	jobs, err := q.store.RetrieveJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// Process runs all queued jobs and deletes finished jobs older than
+// the retention. It returns the number of jobs run.
+func (q *Queue) Process(ctx context.Context) (int, error) {
+	jobs, err := q.Jobs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving jobs: %w", err)
+	}
+	var run int
+	for _, j := range jobs {
+		switch j.Status {
+		case StatusQueued:
+			q.run(ctx, j)
+			run++
+		case StatusCompleted, StatusFailed:
+			if q.clock.Now().Sub(j.CompletedAt) < q.retention {
+				continue
+			}
+			if err = q.store.DeleteJob(ctx, j.ID); err != nil {
+				return run, fmt.Errorf("deleting job %s: %w", j.ID, err)
+			}
+		}
+	}
+	return run, nil
+}
+
+// Run processes jobs when they are queued and every interval until
+// ctx is done.
+func (q *Queue) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := q.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := q.Process(ctx); err != nil {
+			q.logger.Info("msg", "processing notification jobs", "err", err)
+		}
+		select {
+		case <-q.signal:
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run notifies the enrollments of j in chunks and stores its progress.
+func (q *Queue) run(ctx context.Context, j *Job) {
+	logger := ctxlog.Logger(ctx, q.logger).With("job", j.ID)
+
+	j.Status = StatusRunning
+	j.StartedAt = q.clock.Now()
+	ids, err := q.finder.RetrieveEnrollmentIDs(ctx, j.Declarations, j.Sets, j.IDs)
+	if err != nil {
+		j.Status = StatusFailed
+		j.Error = fmt.Sprintf("retrieving enrollment IDs: %v", err)
+	}
+	j.Total = len(ids)
+	if err = q.store.StoreJob(ctx, j); err != nil {
+		logger.Info("msg", "storing job progress", "err", err)
+	}
+
+	for start := 0; j.Status == StatusRunning && start < len(ids); start += q.chunkSize {
+		end := start + q.chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err = q.notifier.Changed(ctx, nil, nil, ids[start:end]); err != nil {
+			j.Status = StatusFailed
+			j.Error = fmt.Sprintf("notifying enrollments: %v", err)
+			break
+		}
+		j.Notified = end
+		if end < len(ids) {
+			if err = q.store.StoreJob(ctx, j); err != nil {
+				logger.Info("msg", "storing job progress", "err", err)
+			}
+		}
+	}
+
+	if j.Status == StatusRunning {
+		j.Status = StatusCompleted
+	}
+	j.CompletedAt = q.clock.Now()
+	if err = q.store.StoreJob(ctx, j); err != nil {
+		logger.Info("msg", "storing job report", "err", err)
+	}
+	logs := []interface{}{"msg", "job finished", "status", j.Status, "total", j.Total, "notified", j.Notified}
+	if j.Status == StatusFailed {
+		logger.Info(append(logs, "err", j.Error)...)
+	} else {
+		logger.Debug(logs...)
+	}
+}
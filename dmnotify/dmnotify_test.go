@@ -0,0 +1,74 @@
+package dmnotify
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+type ider int
+
+func (i *ider) ID() string {
+	*i++
+	return fmt.Sprintf("JOB%d", *i)
+}
+
+type notifier struct{ calls [][]string }
+
+func (n *notifier) Changed(_ context.Context, _, _, ids []string) error {
+	n.calls = append(n.calls, ids)
+	return nil
+}
+
+type finder []string
+
+func (f finder) RetrieveEnrollmentIDs(context.Context, []string, []string, []string) ([]string, error) {
+	return f, nil
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	n := new(notifier)
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := New(NewKVStore(kvmap.New()), n, finder{"ID1", "ID2", "ID3"}, WithChunkSize(2), WithIDer(new(ider)), WithClock(c))
+
+	if err := q.Changed(ctx, []string{"d1"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.calls) != 0 {
+		t.Error("notified before processing")
+	}
+	j, err := q.Job(ctx, "JOB1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j == nil || j.Status != StatusQueued {
+		t.Fatalf("incorrect job: %v", j)
+	}
+
+	if run, err := q.Process(ctx); err != nil || run != 1 {
+		t.Fatalf("have: %v, %v, want: 1, nil", run, err)
+	}
+	if have, want := len(n.calls), 2; have != want {
+		t.Errorf("notifications: have: %v, want: %v", have, want)
+	}
+	if j, err = q.Job(ctx, "JOB1"); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != StatusCompleted || j.Total != 3 || j.Notified != 3 {
+		t.Errorf("incorrect job: %v", j)
+	}
+
+	// finished jobs are deleted after the retention
+	c.Advance(DefaultRetention + time.Second)
+	if _, err = q.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if j, err = q.Job(ctx, "JOB1"); err != nil || j != nil {
+		t.Errorf("have: %v, %v, want: nil, nil", j, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Package http provides the HTTP API for queued DM notification jobs.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/dmnotify"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no job ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when a job does not exist.
+	ErrNotFound = errors.New("job not found")
+)
+
+// GetJobsHandler returns the progress of all jobs.
+func GetJobsHandler(q *dmnotify.Queue, logger log.Logger) http.HandlerFunc {
+	if q == nil {
+		panic("nil queue")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		jobs, err := q.Jobs(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving jobs", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, jobs, logger)
+	}
+}
+
+// GetJobHandler returns the progress of the job ID in the URL path.
+func GetJobHandler(q *dmnotify.Queue, logger log.Logger) http.HandlerFunc {
+	if q == nil {
+		panic("nil queue")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		j, err := q.Job(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving job", "job", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if j == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, j, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM notification job API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, q *dmnotify.Queue) {
+	mux.Handle(
+		prefix+"/dm/notifications",
+		GetJobsHandler(q, logger.With("handler", "get-dm-notifications")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/notifications/:id",
+		GetJobHandler(q, logger.With("handler", "get-dm-notification")),
+		"GET",
+	)
+}
@@ -0,0 +1,74 @@
+package dmnotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores DM notification jobs in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new job store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreJob stores j.
+func (s *KVStore) StoreJob(ctx context.Context, j *Job) error {
+	if j == nil || j.ID == "" {
+		return errors.New("invalid job")
+	}
+	v, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("marshal job: %w", err)
+	}
+	return s.b.Set(ctx, j.ID, v)
+}
+
+// RetrieveJob retrieves job id.
+func (s *KVStore) RetrieveJob(ctx context.Context, id string) (*Job, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	j := new(Job)
+	if err = json.Unmarshal(v, j); err != nil {
+		return nil, fmt.Errorf("unmarshal job: %w", err)
+	}
+	return j, nil
+}
+
+// RetrieveJobs retrieves all jobs.
+func (s *KVStore) RetrieveJobs(ctx context.Context) ([]*Job, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(keys))
+	for _, k := range keys {
+		j, err := s.RetrieveJob(ctx, k)
+		if err != nil {
+			return jobs, fmt.Errorf("retrieving job %s: %w", k, err)
+		}
+		if j != nil {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+// DeleteJob deletes job id.
+func (s *KVStore) DeleteJob(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
@@ -0,0 +1,144 @@
+// Package dmshard computes the shard values of the DM shard management
+// properties declaration. Shards can be used in activation predicates
+// to stage the rollout of declarations, e.g. to 10% of enrollments.
+package dmshard
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/jessepeterson/kmfddm/storage/shard"
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultCount is the default number of shards.
+// Shards are 0 through 100 inclusive by default, matching KMFDDM.
+const DefaultCount = 101
+
+// PercentCount is the number of shards for percentage-based rollouts.
+// Shards are 0 through 99 and each is one percent of enrollments.
+const PercentCount = 100
+
+// ResponseStore retrieves the latest command responses of enrollments.
+type ResponseStore interface {
+	RetrieveResponses(ctx context.Context, id string) (map[string]*cmdresponse.Response, error)
+}
+
+// Sharder computes the shards of enrollments.
+type Sharder struct {
+	count     int
+	salt      string
+	responses ResponseStore
+	logger    log.Logger
+}
+
+// Option configures the sharder.
+type Option func(*Sharder)
+
+// WithCount configures the number of shards.
+// Shards are 0 through count-1.
+func WithCount(count int) Option {
+	return func(s *Sharder) {
+		if count > 0 {
+			s.count = count
+		}
+	}
+}
+
+// WithPercent configures PercentCount shards for percentage-based rollouts.
+func WithPercent() Option {
+	return WithCount(PercentCount)
+}
+
+// WithSalt prefixes the hashed input with salt.
+// Changing the salt reshuffles enrollments into different shards.
+func WithSalt(salt string) Option {
+	return func(s *Sharder) {
+		s.salt = salt
+	}
+}
+
+// WithSerialNumbers hashes the serial numbers of devices (from their
+// DeviceInformation responses in store) instead of their enrollment
+// IDs. Devices keep their shard across re-enrollments. Enrollments
+// without a known serial number are sharded by their enrollment ID.
+func WithSerialNumbers(store ResponseStore) Option {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(s *Sharder) {
+		s.responses = store
+	}
+}
+
+// WithLogger configures a logger for the sharder.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Sharder) {
+		s.logger = logger
+	}
+}
+
+// New creates a new sharder.
+func New(opts ...Option) *Sharder {
+	s := &Sharder{
+		count:  DefaultCount,
+		logger: log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Count returns the number of shards.
+func (s *Sharder) Count() int {
+	return s.count
+}
+
+// input returns the hashed input for enrollment id.
+func (s *Sharder) input(id string) string {
+	if s.responses == nil {
+		return id
+	}
+	responses, err := s.responses.RetrieveResponses(context.Background(), id)
+	if err != nil {
+		s.logger.Info("msg", "retrieving responses", "id", id, "err", err)
+		return id
+	}
+	if r := responses[cmdresponse.DeviceInformationType]; r != nil && r.DeviceInformation != nil && r.DeviceInformation.SerialNumber != "" {
+		return r.DeviceInformation.SerialNumber
+	}
+	return id
+}
+
+// Shard returns the shard of enrollment id.
+func (s *Sharder) Shard(id string) int {
+	hash := fnv.New32()
+	hash.Write([]byte(s.salt + s.input(id)))
+	return int(hash.Sum32() % uint32(s.count))
+}
+
+// ShardFunc returns the shard function of the DM shard declaration.
+func (s *Sharder) ShardFunc() shard.ShardFunc {
+	return func(id string) string {
+		return strconv.Itoa(s.Shard(id))
+	}
+}
+
+// Threshold returns the shard below which percent of enrollments are.
+// The activation predicate "@property(shard) < threshold" selects
+// about percent of enrollments.
+func (s *Sharder) Threshold(percent float64) int {
+	if percent <= 0 {
+		return 0
+	} else if percent >= 100 {
+		return s.count
+	}
+	return int(percent*float64(s.count)/100 + 0.5)
+}
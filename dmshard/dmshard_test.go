@@ -0,0 +1,46 @@
+package dmshard
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+)
+
+type responses map[string]string
+
+func (r responses) RetrieveResponses(_ context.Context, id string) (map[string]*cmdresponse.Response, error) {
+	if r[id] == "" {
+		return nil, nil
+	}
+	return map[string]*cmdresponse.Response{
+		cmdresponse.DeviceInformationType: {DeviceInformation: &cmdresponse.DeviceInformation{SerialNumber: r[id]}},
+	}, nil
+}
+
+func TestSharder(t *testing.T) {
+	s := New(WithPercent())
+	counts := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		shard := s.Shard(string(rune('A'+i%26)) + string(rune(i)))
+		if shard < 0 || shard >= PercentCount {
+			t.Fatalf("shard out of range: %v", shard)
+		}
+		counts[shard]++
+	}
+	if len(counts) != PercentCount {
+		t.Errorf("have: %v shards, want: %v", len(counts), PercentCount)
+	}
+	if have, want := s.Threshold(10), 10; have != want {
+		t.Errorf("threshold: have: %v, want: %v", have, want)
+	}
+
+	// re-enrolled devices keep their shard
+	s = New(WithCount(10), WithSerialNumbers(responses{"ID1": "C02X", "ID2": "C02X"}))
+	if s.Shard("ID1") != s.Shard("ID2") {
+		t.Error("shards of the same serial number differ")
+	}
+	if have, want := New(WithCount(10), WithSalt("a")).Shard("ID1"), New(WithCount(10), WithSalt("a")).Shard("ID1"); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,166 @@
+// Package dmstatusreport keeps queryable summaries of DM status reports.
+// Summaries include the declaration statuses and errors of each report
+// and can be filtered by enrollment, declaration, error presence, and
+// time range.
+package dmstatusreport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+// Declaration is the status of a declaration in a status report.
+type Declaration struct {
+	Identifier  string `json:"identifier"`
+	Active      bool   `json:"active"`
+	Valid       string `json:"valid"`
+	ServerToken string `json:"server_token,omitempty"`
+}
+
+// Error is an error in a status report.
+type Error struct {
+	Path  string          `json:"path"`
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// Report is the summary of a status report.
+type Report struct {
+	ID           string        `json:"id"`
+	EnrollmentID string        `json:"enrollment_id"`
+	StatusID     string        `json:"status_id,omitempty"`
+	Timestamp    time.Time     `json:"timestamp"`
+	Declarations []Declaration `json:"declarations,omitempty"`
+	Errors       []Error       `json:"errors,omitempty"`
+}
+
+// Query filters reports.
+// Zero-valued fields are not filtered on.
+type Query struct {
+	EnrollmentID string
+
+	// Declaration matches reports with a status for this declaration identifier.
+	Declaration string
+
+	// HasErrors matches reports with (true) or without (false) errors.
+	HasErrors *bool
+
+	Since time.Time
+	Until time.Time
+
+	// Cursor matches reports older than the report with this ID.
+	Cursor string
+
+	Limit int
+}
+
+// Match reports whether r satisfies q.
+func (q *Query) Match(r *Report) bool {
+	if q == nil {
+		return true
+	}
+	if q.EnrollmentID != "" && q.EnrollmentID != r.EnrollmentID {
+		return false
+	}
+	if q.HasErrors != nil && *q.HasErrors != (len(r.Errors) > 0) {
+		return false
+	}
+	if !q.Since.IsZero() && r.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Timestamp.Before(q.Until) {
+		return false
+	}
+	if q.Cursor != "" && r.ID >= q.Cursor {
+		return false
+	}
+	if q.Declaration != "" {
+		for _, d := range r.Declarations {
+			if d.Identifier == q.Declaration {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Store stores and retrieves reports.
+type Store interface {
+	// StoreReport stores r.
+	StoreReport(ctx context.Context, r *Report) error
+
+	// RetrieveReports retrieves the reports matching q, newest first.
+	RetrieveReports(ctx context.Context, q *Query) ([]*Report, error)
+}
+
+// Recorder is a DM status store that stores status report summaries.
+// It is intended as a secondary status store.
+type Recorder struct {
+	store Store
+	clock clock.Clock
+}
+
+// Option configures the recorder.
+type Option func(*Recorder)
+
+// WithClock configures the clock of the recorder.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Recorder) {
+		r.clock = c
+	}
+}
+
+// New creates a new recorder storing summaries in store.
+func New(store Store, opts ...Option) *Recorder {
+	if store == nil {
+		panic("nil store")
+	}
+	r := &Recorder{store: store, clock: clock.Real}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// newID generates a new time-sortable report ID.
+func newID(t time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%016x%x", t.UnixNano(), b)
+}
+
+// StoreDeclarationStatus stores the summary of status for enrollmentID.
+func (r *Recorder) StoreDeclarationStatus(ctx context.Context, enrollmentID string, status *ddm.StatusReport) error {
+	report := &Report{
+		EnrollmentID: enrollmentID,
+		StatusID:     status.ID,
+		Timestamp:    r.clock.Now(),
+	}
+	report.ID = newID(report.Timestamp)
+	for _, d := range status.Declarations {
+		report.Declarations = append(report.Declarations, Declaration{
+			Identifier:  d.Identifier,
+			Active:      d.Active,
+			Valid:       d.Valid,
+			ServerToken: d.ServerToken,
+		})
+	}
+	for _, e := range status.Errors {
+		reportErr := Error{Path: e.Path}
+		if json.Valid(e.ErrorJSON) {
+			reportErr.Error = e.ErrorJSON
+		}
+		report.Errors = append(report.Errors, reportErr)
+	}
+	return r.store.StoreReport(ctx, report)
+}
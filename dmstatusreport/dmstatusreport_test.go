@@ -0,0 +1,77 @@
+package dmstatusreport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := New(store, WithClock(c))
+
+	reports := []struct {
+		id     string
+		status *ddm.StatusReport
+	}{
+		{"ID1", &ddm.StatusReport{Declarations: []ddm.DeclarationStatus{{Identifier: "d1", Active: true, Valid: "valid"}}}},
+		{"ID2", &ddm.StatusReport{Errors: []ddm.StatusError{{Path: ".StatusItems.x", ErrorJSON: []byte(`{"code":1}`)}}}},
+		{"ID1", &ddm.StatusReport{Declarations: []ddm.DeclarationStatus{{Identifier: "d2", Valid: "invalid"}}}},
+	}
+	for _, report := range reports {
+		c.Advance(time.Minute)
+		if err := r.StoreDeclarationStatus(ctx, report.id, report.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := store.RetrieveReports(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("have: %d reports, want: 3", len(all))
+	}
+	if have, want := all[0].Declarations[0].Identifier, "d2"; have != want {
+		t.Errorf("newest report: have: %v, want: %v", have, want)
+	}
+
+	hasErrors := true
+	for _, test := range []struct {
+		name string
+		q    *Query
+		want int
+	}{
+		{"enrollment", &Query{EnrollmentID: "ID1"}, 2},
+		{"declaration", &Query{Declaration: "d1"}, 1},
+		{"errors", &Query{HasErrors: &hasErrors}, 1},
+		{"since", &Query{Since: c.Now().Add(-time.Minute)}, 2},
+		{"cursor", &Query{Cursor: all[0].ID, Limit: 1}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := store.RetrieveReports(ctx, test.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != test.want {
+				t.Errorf("have: %d reports, want: %d", len(found), test.want)
+			}
+		})
+	}
+
+	// keep only the newest report of each enrollment
+	deleted, err := store.Prune(ctx, time.Time{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := deleted, int64(1); have != want {
+		t.Errorf("deleted: have: %v, want: %v", have, want)
+	}
+}
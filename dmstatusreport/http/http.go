@@ -0,0 +1,111 @@
+// Package http provides the HTTP API for querying DM status reports.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/micromdm/nanohub/dmstatusreport"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultLimit is the number of reports returned if no limit is given.
+const DefaultLimit = 100
+
+// Page is a page of reports.
+type Page struct {
+	Reports []*dmstatusreport.Report `json:"reports"`
+
+	// NextCursor is the cursor of the next page if there is one.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// parseTime parses the RFC 3339 query parameter key from r.
+func parseTime(r *http.Request, key string) (t time.Time, err error) {
+	if v := r.URL.Query().Get(key); v != "" {
+		t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			err = fmt.Errorf("parsing %s: %w", key, err)
+		}
+	}
+	return
+}
+
+// ReportsHandler returns a page of reports matching the query parameters
+// enrollment_id, declaration, errors, since, until, cursor, and limit.
+func ReportsHandler(store dmstatusreport.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := &dmstatusreport.Query{
+			EnrollmentID: r.URL.Query().Get("enrollment_id"),
+			Declaration:  r.URL.Query().Get("declaration"),
+			Cursor:       r.URL.Query().Get("cursor"),
+		}
+
+		var err error
+		if v := r.URL.Query().Get("errors"); v != "" {
+			hasErrors, err := strconv.ParseBool(v)
+			if err != nil {
+				httpapi.JSONError(w, fmt.Errorf("parsing errors: %w", err), http.StatusBadRequest)
+				return
+			}
+			q.HasErrors = &hasErrors
+		}
+		if q.Since, err = parseTime(r, "since"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Until, err = parseTime(r, "until"); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		limit, err := httpapi.QueryInt(r, "limit", DefaultLimit)
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if limit < 1 {
+			httpapi.JSONError(w, errors.New("invalid limit"), http.StatusBadRequest)
+			return
+		}
+
+		// retrieve one more report to know whether there is a next page
+		q.Limit = limit + 1
+		reports, err := store.RetrieveReports(r.Context(), q)
+		if err != nil {
+			logger.Info("msg", "retrieving status reports", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		page := &Page{Reports: reports}
+		if len(reports) > limit {
+			page.Reports = reports[:limit]
+			page.NextCursor = reports[limit-1].ID
+		}
+		if page.Reports == nil {
+			page.Reports = []*dmstatusreport.Report{}
+		}
+
+		httpapi.WriteJSON(w, page, logger)
+	}
+}
+
+// HandleAPIv1 registers the DM status report API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store dmstatusreport.Store) {
+	mux.Handle(
+		prefix+"/dm/statusreports",
+		ReportsHandler(store, logger.With("handler", "dm-status-reports")),
+		"GET",
+	)
+}
@@ -0,0 +1,100 @@
+package dmstatusreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores reports in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new report store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreReport stores r keyed by its (time-sortable) ID.
+func (s *KVStore) StoreReport(ctx context.Context, r *Report) error {
+	if r == nil || r.ID == "" {
+		return errors.New("invalid report")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	return s.b.Set(ctx, r.ID, v)
+}
+
+// RetrieveReports retrieves the reports matching q, newest first.
+func (s *KVStore) RetrieveReports(ctx context.Context, q *Query) ([]*Report, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var reports []*Report
+	for i := len(keys) - 1; i >= 0; i-- {
+		if q != nil && q.Cursor != "" && keys[i] >= q.Cursor {
+			continue
+		}
+		v, err := s.b.Get(ctx, keys[i])
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return reports, fmt.Errorf("getting report %s: %w", keys[i], err)
+		}
+		r := new(Report)
+		if err = json.Unmarshal(v, r); err != nil {
+			return reports, fmt.Errorf("unmarshal report %s: %w", keys[i], err)
+		}
+		if !q.Match(r) {
+			continue
+		}
+		reports = append(reports, r)
+		if q != nil && q.Limit > 0 && len(reports) >= q.Limit {
+			break
+		}
+	}
+	return reports, nil
+}
+
+// Prune deletes the reports older than before (if not zero) and all but
+// the newest maxCount reports of each enrollment (if not zero).
+func (s *KVStore) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing keys: %w", err)
+	}
+	var deleted int64
+	counts := make(map[string]int)
+	for i := len(keys) - 1; i >= 0; i-- {
+		v, err := s.b.Get(ctx, keys[i])
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return deleted, fmt.Errorf("getting report %s: %w", keys[i], err)
+		}
+		r := new(Report)
+		if err = json.Unmarshal(v, r); err != nil {
+			return deleted, fmt.Errorf("unmarshal report %s: %w", keys[i], err)
+		}
+		counts[r.EnrollmentID]++
+		if (before.IsZero() || !r.Timestamp.Before(before)) && (maxCount < 1 || counts[r.EnrollmentID] <= maxCount) {
+			continue
+		}
+		if err = s.b.Delete(ctx, keys[i]); err != nil {
+			return deleted, fmt.Errorf("deleting report %s: %w", keys[i], err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
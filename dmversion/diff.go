@@ -0,0 +1,86 @@
+package dmversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Difference operations.
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+)
+
+// Difference is a difference between two JSON documents.
+type Difference struct {
+	// Path is the JSON Pointer (RFC 6901) of the changed value.
+	Path string `json:"path"`
+
+	Op     string      `json:"op"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Diff returns the differences from the JSON document a to b.
+// Empty documents are treated as missing.
+func Diff(a, b []byte) ([]*Difference, error) {
+	var va, vb interface{}
+	if len(a) > 0 {
+		if err := json.Unmarshal(a, &va); err != nil {
+			return nil, fmt.Errorf("unmarshal before: %w", err)
+		}
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &vb); err != nil {
+			return nil, fmt.Errorf("unmarshal after: %w", err)
+		}
+	}
+	var diff []*Difference
+	diffValues("", va, vb, &diff)
+	return diff, nil
+}
+
+// escapePointer escapes a JSON Pointer reference token.
+var escapePointer = strings.NewReplacer("~", "~0", "/", "~1").Replace
+
+// diffValues appends the differences from a to b at path to diff.
+// Objects are compared by key; all other values as a whole.
+func diffValues(path string, a, b interface{}, diff *[]*Difference) {
+	switch {
+	case a == nil && b == nil:
+		return
+	case a == nil:
+		*diff = append(*diff, &Difference{Path: path, Op: OpAdd, After: b})
+		return
+	case b == nil:
+		*diff = append(*diff, &Difference{Path: path, Op: OpRemove, Before: a})
+		return
+	}
+
+	ma, okA := a.(map[string]interface{})
+	mb, okB := b.(map[string]interface{})
+	if !okA || !okB {
+		if !reflect.DeepEqual(a, b) {
+			*diff = append(*diff, &Difference{Path: path, Op: OpReplace, Before: a, After: b})
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(ma)+len(mb))
+	for k := range ma {
+		keys = append(keys, k)
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		diffValues(path+"/"+escapePointer(k), ma[k], mb[k], diff)
+	}
+}
@@ -0,0 +1,367 @@
+// Package dmversion keeps prior versions of declarations.
+//
+// Every change of a declaration in DM storage records a new version
+// with its author, timestamp, and a diff to the previous version.
+// Declarations can be rolled back to prior versions and sets can be
+// pinned to a version of a declaration.
+package dmversion
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/dmchangelog"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNotFound is returned when a version or pin does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrDeleted is returned when rolling back to or pinning a
+	// version that deleted its declaration.
+	ErrDeleted = errors.New("version deleted the declaration")
+)
+
+// Version is a version of a declaration.
+type Version struct {
+	Identifier string    `json:"identifier"`
+	Version    int       `json:"version"`
+	Timestamp  time.Time `json:"timestamp"`
+	Author     string    `json:"author,omitempty"`
+
+	// Hash is the hex SHA-256 hash of the declaration JSON.
+	Hash string `json:"hash,omitempty"`
+
+	// Deleted versions record the deletion of the declaration.
+	Deleted bool `json:"deleted,omitempty"`
+
+	Declaration json.RawMessage `json:"declaration,omitempty"`
+
+	// Diff are the differences to the previous version.
+	Diff []*Difference `json:"diff,omitempty"`
+}
+
+// Pin pins a declaration of a set to a version.
+type Pin struct {
+	Set        string `json:"set"`
+	Identifier string `json:"identifier"`
+	Version    int    `json:"version"`
+
+	// PinnedIdentifier is the identifier of the copy of the
+	// declaration version that is in the set instead.
+	PinnedIdentifier string `json:"pinned_identifier"`
+}
+
+// PinnedIdentifier returns the identifier of the copy of version of
+// declaration id.
+func PinnedIdentifier(id string, version int) string {
+	return fmt.Sprintf("%s.v%d", id, version)
+}
+
+// Store stores versions and pins.
+type Store interface {
+	// StoreVersion stores v.
+	// The version number of v must be the next version of the declaration.
+	StoreVersion(ctx context.Context, v *Version) error
+
+	// RetrieveVersion retrieves version of declaration id.
+	// A version of 0 retrieves the latest version.
+	// ErrNotFound is returned if the version does not exist.
+	RetrieveVersion(ctx context.Context, id string, version int) (*Version, error)
+
+	// RetrieveVersions retrieves the versions of declaration id,
+	// newest first.
+	RetrieveVersions(ctx context.Context, id string) ([]*Version, error)
+
+	StorePin(ctx context.Context, p *Pin) error
+
+	// RetrievePin retrieves the pin of declaration id in set.
+	// ErrNotFound is returned if the pin does not exist.
+	RetrievePin(ctx context.Context, set, id string) (*Pin, error)
+
+	// RetrievePins retrieves the pins of set or of all sets if set is empty.
+	RetrievePins(ctx context.Context, set string) ([]*Pin, error)
+
+	DeletePin(ctx context.Context, set, id string) error
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// Versioner wraps DM storage and records versions of declarations.
+// Mutations that do not change storage are not recorded.
+type Versioner struct {
+	dmchangelog.Storage
+	store    Store
+	notifier Notifier
+	logger   log.Logger
+	clock    clock.Clock
+}
+
+// Option configures the versioner.
+type Option func(*Versioner)
+
+// WithLogger configures a logger for the versioner.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(v *Versioner) {
+		v.logger = logger
+	}
+}
+
+// WithClock configures the clock of the versioner.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(v *Versioner) {
+		v.clock = c
+	}
+}
+
+// New creates a new versioner of the declarations of storage.
+// Enrollments are notified of rollbacks and pins with notifier.
+func New(storage dmchangelog.Storage, store Store, notifier Notifier, opts ...Option) *Versioner {
+	if storage == nil {
+		panic("nil storage")
+	}
+	if store == nil {
+		panic("nil version store")
+	}
+	if notifier == nil {
+		panic("nil notifier")
+	}
+	v := &Versioner{
+		Storage:  storage,
+		store:    store,
+		notifier: notifier,
+		logger:   log.NopLogger,
+		clock:    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// rawDeclaration returns the JSON of d.
+func rawDeclaration(d *ddm.Declaration) json.RawMessage {
+	if len(d.Raw) > 0 {
+		return d.Raw
+	}
+	b, _ := json.Marshal(d)
+	return b
+}
+
+// record stores the next version of declaration id logging any error.
+// Errors are not returned as the storage mutation already happened.
+func (v *Versioner) record(ctx context.Context, id string, raw json.RawMessage) {
+	logger := ctxlog.Logger(ctx, v.logger)
+	version := &Version{
+		Identifier:  id,
+		Version:     1,
+		Timestamp:   v.clock.Now(),
+		Author:      dmchangelog.Actor(ctx),
+		Deleted:     raw == nil,
+		Declaration: raw,
+	}
+	if raw != nil {
+		version.Hash = fmt.Sprintf("%x", sha256.Sum256(raw))
+	}
+
+	prev, err := v.store.RetrieveVersion(ctx, id, 0)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		logger.Info("msg", "retrieving latest version", "identifier", id, "err", err)
+		return
+	}
+	var prevRaw json.RawMessage
+	if prev != nil {
+		version.Version = prev.Version + 1
+		prevRaw = prev.Declaration
+	}
+	if version.Diff, err = Diff(prevRaw, raw); err != nil {
+		logger.Info("msg", "diffing versions", "identifier", id, "err", err)
+	}
+
+	if err = v.store.StoreVersion(ctx, version); err != nil {
+		logger.Info("msg", "storing version", "identifier", id, "err", err)
+	}
+}
+
+// StoreDeclaration stores d and records a new version.
+func (v *Versioner) StoreDeclaration(ctx context.Context, d *ddm.Declaration) (bool, error) {
+	changed, err := v.Storage.StoreDeclaration(ctx, d)
+	if err != nil || !changed {
+		return changed, err
+	}
+	v.record(ctx, d.Identifier, rawDeclaration(d))
+	return changed, nil
+}
+
+// DeleteDeclaration deletes declaration id and records its deletion.
+func (v *Versioner) DeleteDeclaration(ctx context.Context, id string) (bool, error) {
+	changed, err := v.Storage.DeleteDeclaration(ctx, id)
+	if err != nil || !changed {
+		return changed, err
+	}
+	v.record(ctx, id, nil)
+	return changed, nil
+}
+
+// History retrieves the versions of declaration id, newest first.
+func (v *Versioner) History(ctx context.Context, id string) ([]*Version, error) {
+	return v.store.RetrieveVersions(ctx, id)
+}
+
+// Version retrieves version of declaration id.
+func (v *Versioner) Version(ctx context.Context, id string, version int) (*Version, error) {
+	return v.store.RetrieveVersion(ctx, id, version)
+}
+
+// declaration parses the declaration of version of declaration id.
+func (v *Versioner) declaration(ctx context.Context, id string, version int) (*ddm.Declaration, error) {
+	ver, err := v.store.RetrieveVersion(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	if ver.Deleted {
+		return nil, ErrDeleted
+	}
+	d, err := ddm.ParseDeclaration(ver.Declaration)
+	if err != nil {
+		return nil, fmt.Errorf("parsing declaration: %w", err)
+	}
+	return d, nil
+}
+
+// Rollback stores version of declaration id as the current declaration.
+// The rollback is recorded as a new version which is returned.
+func (v *Versioner) Rollback(ctx context.Context, id string, version int) (*Version, error) {
+	d, err := v.declaration(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := v.StoreDeclaration(ctx, d)
+	if err != nil {
+		return nil, fmt.Errorf("storing declaration: %w", err)
+	}
+	if changed {
+		if err = v.notifier.Changed(ctx, []string{id}, nil, nil); err != nil {
+			return nil, fmt.Errorf("notifying: %w", err)
+		}
+	}
+	return v.store.RetrieveVersion(ctx, id, 0)
+}
+
+// Pin replaces declaration id in set with a copy of version of the
+// declaration. The copy has the identifier [PinnedIdentifier].
+func (v *Versioner) Pin(ctx context.Context, set, id string, version int) (*Pin, error) {
+	d, err := v.declaration(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy the declaration JSON with the pinned identifier
+	var m map[string]interface{}
+	if err = json.Unmarshal(d.Raw, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal declaration: %w", err)
+	}
+	pin := &Pin{Set: set, Identifier: id, Version: version, PinnedIdentifier: PinnedIdentifier(id, version)}
+	m["Identifier"] = pin.PinnedIdentifier
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal declaration: %w", err)
+	}
+	pinned, err := ddm.ParseDeclaration(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing pinned declaration: %w", err)
+	}
+	// pinned copies are not versioned themselves
+	if _, err = v.Storage.StoreDeclaration(ctx, pinned); err != nil {
+		return nil, fmt.Errorf("storing pinned declaration: %w", err)
+	}
+
+	prev, err := v.store.RetrievePin(ctx, set, id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("retrieving pin: %w", err)
+	}
+	if err = v.store.StorePin(ctx, pin); err != nil {
+		return nil, fmt.Errorf("storing pin: %w", err)
+	}
+	if _, err = v.Storage.StoreSetDeclaration(ctx, set, pin.PinnedIdentifier); err != nil {
+		return nil, fmt.Errorf("adding pinned declaration: %w", err)
+	}
+	if _, err = v.Storage.RemoveSetDeclaration(ctx, set, id); err != nil {
+		return nil, fmt.Errorf("removing declaration: %w", err)
+	}
+	if prev != nil && prev.PinnedIdentifier != pin.PinnedIdentifier {
+		if err = v.removePinned(ctx, prev); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = v.notifier.Changed(ctx, nil, []string{set}, nil); err != nil {
+		return pin, fmt.Errorf("notifying: %w", err)
+	}
+	return pin, nil
+}
+
+// removePinned removes the pinned declaration of p from its set.
+// The pinned declaration is deleted if no other set pins it.
+func (v *Versioner) removePinned(ctx context.Context, p *Pin) error {
+	if _, err := v.Storage.RemoveSetDeclaration(ctx, p.Set, p.PinnedIdentifier); err != nil {
+		return fmt.Errorf("removing pinned declaration: %w", err)
+	}
+	pins, err := v.store.RetrievePins(ctx, "")
+	if err != nil {
+		return fmt.Errorf("retrieving pins: %w", err)
+	}
+	for _, other := range pins {
+		if other.PinnedIdentifier == p.PinnedIdentifier {
+			return nil
+		}
+	}
+	if _, err = v.Storage.DeleteDeclaration(ctx, p.PinnedIdentifier); err != nil {
+		return fmt.Errorf("deleting pinned declaration: %w", err)
+	}
+	return nil
+}
+
+// Unpin restores the current declaration id in set.
+func (v *Versioner) Unpin(ctx context.Context, set, id string) error {
+	pin, err := v.store.RetrievePin(ctx, set, id)
+	if err != nil {
+		return err
+	}
+	if _, err = v.Storage.StoreSetDeclaration(ctx, set, id); err != nil {
+		return fmt.Errorf("adding declaration: %w", err)
+	}
+	if err = v.store.DeletePin(ctx, set, id); err != nil {
+		return fmt.Errorf("deleting pin: %w", err)
+	}
+	if err = v.removePinned(ctx, pin); err != nil {
+		return err
+	}
+	if err = v.notifier.Changed(ctx, nil, []string{set}, nil); err != nil {
+		return fmt.Errorf("notifying: %w", err)
+	}
+	return nil
+}
+
+// Pins retrieves the pins of set or of all sets if set is empty.
+func (v *Versioner) Pins(ctx context.Context, set string) ([]*Pin, error) {
+	return v.store.RetrievePins(ctx, set)
+}
@@ -0,0 +1,177 @@
+package dmversion
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/dmchangelog"
+	"github.com/micromdm/nanohub/kv"
+	"github.com/micromdm/nanohub/kv/kvdiskv"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+// storage is an in-memory declaration and set store.
+type storage struct {
+	dmchangelog.Storage
+	declarations map[string][]byte
+	sets         map[string]map[string]bool
+}
+
+func (s *storage) StoreDeclaration(_ context.Context, d *ddm.Declaration) (bool, error) {
+	if string(s.declarations[d.Identifier]) == string(d.Raw) {
+		return false, nil
+	}
+	s.declarations[d.Identifier] = d.Raw
+	return true, nil
+}
+
+func (s *storage) DeleteDeclaration(_ context.Context, id string) (bool, error) {
+	_, ok := s.declarations[id]
+	delete(s.declarations, id)
+	return ok, nil
+}
+
+func (s *storage) StoreSetDeclaration(_ context.Context, set, id string) (bool, error) {
+	if s.sets[set] == nil {
+		s.sets[set] = make(map[string]bool)
+	}
+	s.sets[set][id] = true
+	return true, nil
+}
+
+func (s *storage) RemoveSetDeclaration(_ context.Context, set, id string) (bool, error) {
+	delete(s.sets[set], id)
+	return true, nil
+}
+
+type notifier struct{}
+
+func (notifier) Changed(context.Context, []string, []string, []string) error { return nil }
+
+func TestVersioner(t *testing.T) {
+	ctx := dmchangelog.WithActor(context.Background(), "admin")
+	s := &storage{declarations: make(map[string][]byte), sets: make(map[string]map[string]bool)}
+	v := New(s, NewKVStore(kvmap.New()), notifier{})
+
+	for _, raw := range []string{
+		`{"Identifier":"d1","Type":"com.apple.configuration.test","Payload":{"Echo":"one"}}`,
+		`{"Identifier":"d1","Type":"com.apple.configuration.test","Payload":{"Echo":"two"}}`,
+		`{"Identifier":"d1","Type":"com.apple.configuration.test","Payload":{"Echo":"two"}}`,
+	} {
+		d, err := ddm.ParseDeclaration([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = v.StoreDeclaration(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := v.History(ctx, "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(versions), 2; have != want {
+		t.Fatalf("versions: have: %v, want: %v", have, want)
+	}
+	latest := versions[0]
+	if latest.Version != 2 || latest.Author != "admin" {
+		t.Errorf("latest: have: %v by %q, want: 2 by admin", latest.Version, latest.Author)
+	}
+	if len(latest.Diff) != 1 || latest.Diff[0].Path != "/Payload/Echo" || latest.Diff[0].Op != OpReplace {
+		t.Errorf("unexpected diff: %v", latest.Diff)
+	}
+
+	rolledBack, err := v.Rollback(ctx, "d1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack.Version != 3 || rolledBack.Hash != versions[1].Hash {
+		t.Errorf("rollback: have: version %v hash %v, want: version 3 hash %v", rolledBack.Version, rolledBack.Hash, versions[1].Hash)
+	}
+
+	s.sets["set1"] = map[string]bool{"d1": true}
+	pin, err := v.Pin(ctx, "set1", "d1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.sets["set1"]["d1"] || !s.sets["set1"][pin.PinnedIdentifier] {
+		t.Errorf("pinned set: have: %v", s.sets["set1"])
+	}
+	if err = v.Unpin(ctx, "set1", "d1"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.sets["set1"]["d1"] || len(s.sets["set1"]) != 1 {
+		t.Errorf("unpinned set: have: %v", s.sets["set1"])
+	}
+	if _, ok := s.declarations[pin.PinnedIdentifier]; ok {
+		t.Error("pinned declaration not deleted")
+	}
+}
+
+func TestKVStore(t *testing.T) {
+	for name, b := range map[string]kv.Bucket{
+		"kvmap":   kvmap.New(),
+		"kvdiskv": kvdiskv.New(t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewKVStore(b)
+
+			// identifiers sharing a prefix don't share versions
+			for _, v := range []*Version{
+				{Identifier: "com.example.d1", Version: 2},
+				{Identifier: "com.example.d1", Version: 10},
+				{Identifier: "com.example.d1.sub/x", Version: 1},
+			} {
+				if err := s.StoreVersion(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			versions, err := s.RetrieveVersions(ctx, "com.example.d1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || versions[0].Version != 10 || versions[1].Version != 2 {
+				t.Errorf("versions: have: %v", versions)
+			}
+			latest, err := s.RetrieveVersion(ctx, "com.example.d1.sub/x", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if latest.Version != 1 {
+				t.Errorf("latest: have: %v, want: 1", latest.Version)
+			}
+			if _, err = s.RetrieveVersion(ctx, "com.example.d1", 3); err != ErrNotFound {
+				t.Errorf("have: %v, want: %v", err, ErrNotFound)
+			}
+
+			for _, p := range []*Pin{
+				{Set: "default", Identifier: "com.example.d1", Version: 2},
+				{Set: "default.sub", Identifier: "com.example.d1", Version: 10},
+			} {
+				if err = s.StorePin(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pins, err := s.RetrievePins(ctx, "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pins) != 1 || pins[0].Version != 2 {
+				t.Errorf("pins: have: %v", pins)
+			}
+			if pins, err = s.RetrievePins(ctx, ""); err != nil || len(pins) != 2 {
+				t.Errorf("all pins: have: %d (err %v), want: 2", len(pins), err)
+			}
+			if err = s.DeletePin(ctx, "default", "com.example.d1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = s.RetrievePin(ctx, "default", "com.example.d1"); err != ErrNotFound {
+				t.Errorf("have: %v, want: %v", err, ErrNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Package http provides the HTTP API for declaration versions and pins.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/micromdm/nanohub/dmversion"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no declaration identifier is provided.
+	ErrNoID = errors.New("no declaration identifier provided")
+
+	// ErrNoSet is returned when no set name is provided.
+	ErrNoSet = errors.New("no set name provided")
+
+	// ErrInvalidVersion is returned for invalid version numbers.
+	ErrInvalidVersion = errors.New("invalid version")
+)
+
+// errStatus returns the HTTP status code for err.
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, dmversion.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dmversion.ErrDeleted):
+		return http.StatusConflict
+	}
+	return 0
+}
+
+// version parses the version s.
+func version(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+	}
+	return v, nil
+}
+
+// HistoryHandler returns the versions of the declaration in the URL path.
+func HistoryHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		versions, err := v.History(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving versions", "identifier", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if len(versions) < 1 {
+			httpapi.JSONError(w, dmversion.ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, versions, logger)
+	}
+}
+
+// VersionHandler returns the declaration version in the URL path.
+func VersionHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		n, err := version(flow.Param(r.Context(), "version"))
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ver, err := v.Version(r.Context(), id, n)
+		if err != nil {
+			status := errStatus(err)
+			if status == 0 {
+				logger.Info("msg", "retrieving version", "identifier", id, "version", n, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		httpapi.WriteJSON(w, ver, logger)
+	}
+}
+
+// RollbackHandler rolls the declaration in the URL path back to the
+// version in the URL path and returns the new version.
+func RollbackHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		n, err := version(flow.Param(r.Context(), "version"))
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ver, err := v.Rollback(r.Context(), id, n)
+		if err != nil {
+			status := errStatus(err)
+			if status == 0 {
+				logger.Info("msg", "rolling back", "identifier", id, "version", n, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		logger.Debug("msg", "rolled back", "identifier", id, "version", n, "new_version", ver.Version)
+		httpapi.WriteJSON(w, ver, logger)
+	}
+}
+
+// PinsHandler returns the pins of the set query parameter (or all pins).
+func PinsHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		pins, err := v.Pins(r.Context(), r.URL.Query().Get("set"))
+		if err != nil {
+			logger.Info("msg", "retrieving pins", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if pins == nil {
+			pins = []*dmversion.Pin{}
+		}
+
+		httpapi.WriteJSON(w, pins, logger)
+	}
+}
+
+// PinHandler pins the declaration in the URL path of the set in the
+// URL path to the version query parameter.
+func PinHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		set := flow.Param(r.Context(), "set")
+		if set == "" {
+			httpapi.JSONError(w, ErrNoSet, http.StatusBadRequest)
+			return
+		}
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		n, err := version(r.URL.Query().Get("version"))
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		pin, err := v.Pin(r.Context(), set, id, n)
+		if err != nil {
+			status := errStatus(err)
+			if status == 0 {
+				logger.Info("msg", "pinning", "set", set, "identifier", id, "version", n, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		logger.Debug("msg", "pinned", "set", set, "identifier", id, "version", n)
+		httpapi.WriteJSON(w, pin, logger)
+	}
+}
+
+// UnpinHandler unpins the declaration in the URL path of the set in
+// the URL path.
+func UnpinHandler(v *dmversion.Versioner, logger log.Logger) http.HandlerFunc {
+	if v == nil {
+		panic("nil versioner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		set := flow.Param(r.Context(), "set")
+		if set == "" {
+			httpapi.JSONError(w, ErrNoSet, http.StatusBadRequest)
+			return
+		}
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := v.Unpin(r.Context(), set, id); err != nil {
+			status := errStatus(err)
+			if status == 0 {
+				logger.Info("msg", "unpinning", "set", set, "identifier", id, "err", err)
+			}
+			httpapi.JSONError(w, err, status)
+			return
+		}
+
+		logger.Debug("msg", "unpinned", "set", set, "identifier", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the declaration version API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, v *dmversion.Versioner) {
+	mux.Handle(
+		prefix+"/dm/declarations/:id/versions",
+		HistoryHandler(v, logger.With("handler", "get-dm-versions")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/declarations/:id/versions/:version",
+		VersionHandler(v, logger.With("handler", "get-dm-version")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/declarations/:id/versions/:version/rollback",
+		RollbackHandler(v, logger.With("handler", "rollback-dm-version")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/dm/pins",
+		PinsHandler(v, logger.With("handler", "get-dm-pins")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dm/sets/:set/pins/:id",
+		PinHandler(v, logger.With("handler", "put-dm-pin")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dm/sets/:set/pins/:id",
+		UnpinHandler(v, logger.With("handler", "delete-dm-pin")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,173 @@
+package dmversion
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPfxVersion = "version."
+	keyPfxPin     = "pin."
+)
+
+// KVStore stores versions and pins in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new version store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// keyPart hex-encodes s for use in a key. Identifiers may contain
+// periods and other characters that aren't valid in keys of all
+// backends.
+func keyPart(s string) string {
+	return hex.EncodeToString([]byte(s))
+}
+
+// versionPrefix returns the key prefix of the versions of declaration id.
+func versionPrefix(id string) string {
+	return keyPfxVersion + keyPart(id) + "."
+}
+
+// versionKey returns the key of version of declaration id.
+// Versions are zero-padded so that keys sort by version.
+func versionKey(id string, version int) string {
+	return fmt.Sprintf("%s%010d", versionPrefix(id), version)
+}
+
+// pinPrefix returns the key prefix of the pins of set.
+func pinPrefix(set string) string {
+	return keyPfxPin + keyPart(set) + "."
+}
+
+func pinKey(set, id string) string {
+	return pinPrefix(set) + keyPart(id)
+}
+
+// get unmarshals the JSON value of key into v.
+// ErrNotFound is returned if key does not exist.
+func (s *KVStore) get(ctx context.Context, key string, v interface{}) error {
+	b, err := s.b.Get(ctx, key)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("unmarshal %s: %w", key, err)
+	}
+	return nil
+}
+
+// set marshals v to JSON and sets it as the value of key.
+func (s *KVStore) set(ctx context.Context, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	return s.b.Set(ctx, key, b)
+}
+
+// StoreVersion stores v.
+func (s *KVStore) StoreVersion(ctx context.Context, v *Version) error {
+	if v == nil || v.Identifier == "" || v.Version < 1 {
+		return errors.New("invalid version")
+	}
+	return s.set(ctx, versionKey(v.Identifier, v.Version), v)
+}
+
+// RetrieveVersion retrieves version of declaration id.
+// A version of 0 retrieves the latest version.
+func (s *KVStore) RetrieveVersion(ctx context.Context, id string, version int) (*Version, error) {
+	key := versionKey(id, version)
+	if version == 0 {
+		keys, err := s.b.KeysPrefix(ctx, versionPrefix(id))
+		if err != nil {
+			return nil, fmt.Errorf("listing keys: %w", err)
+		}
+		if len(keys) < 1 {
+			return nil, ErrNotFound
+		}
+		key = keys[len(keys)-1]
+	}
+	v := new(Version)
+	if err := s.get(ctx, key, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// RetrieveVersions retrieves the versions of declaration id, newest first.
+func (s *KVStore) RetrieveVersions(ctx context.Context, id string) ([]*Version, error) {
+	keys, err := s.b.KeysPrefix(ctx, versionPrefix(id))
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var versions []*Version
+	for i := len(keys) - 1; i >= 0; i-- {
+		v := new(Version)
+		if err = s.get(ctx, keys[i], v); errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return versions, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// StorePin stores p.
+func (s *KVStore) StorePin(ctx context.Context, p *Pin) error {
+	if p == nil || p.Set == "" || p.Identifier == "" {
+		return errors.New("invalid pin")
+	}
+	return s.set(ctx, pinKey(p.Set, p.Identifier), p)
+}
+
+// RetrievePin retrieves the pin of declaration id in set.
+func (s *KVStore) RetrievePin(ctx context.Context, set, id string) (*Pin, error) {
+	p := new(Pin)
+	if err := s.get(ctx, pinKey(set, id), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RetrievePins retrieves the pins of set or of all sets if set is empty.
+func (s *KVStore) RetrievePins(ctx context.Context, set string) ([]*Pin, error) {
+	prefix := keyPfxPin
+	if set != "" {
+		prefix = pinPrefix(set)
+	}
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	var pins []*Pin
+	for _, key := range keys {
+		p := new(Pin)
+		if err = s.get(ctx, key, p); errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return pins, err
+		}
+		pins = append(pins, p)
+	}
+	return pins, nil
+}
+
+// DeletePin deletes the pin of declaration id in set.
+func (s *KVStore) DeletePin(ctx context.Context, set, id string) error {
+	return s.b.Delete(ctx, pinKey(set, id))
+}
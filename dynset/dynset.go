@@ -0,0 +1,422 @@
+// Package dynset computes DM set memberships from rules.
+//
+// A rule owns a DM set: its predicate is evaluated for every device and
+// the device is added to or removed from the set accordingly. Rule
+// predicates use the DDM activation predicate syntax (see the
+// ddmpredicate package) with @property(key) referencing device
+// properties and @status(item) referencing DM status items.
+package dynset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/ddmpredicate"
+
+	ddmstorage "github.com/jessepeterson/kmfddm/storage"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// PropertyPlatform is the device property of the platform of a device
+// (e.g. "macOS") derived from its product name.
+const PropertyPlatform = "platform"
+
+// PropertyTagPrefix prefixes the keys of enrollment tags in device
+// properties (e.g. "tag.department").
+const PropertyTagPrefix = "tag."
+
+var (
+	// ErrNoSet is returned for rules without a set name.
+	ErrNoSet = errors.New("no set name")
+
+	// ErrInvalidSet is returned for set names with invalid characters.
+	ErrInvalidSet = errors.New("invalid set name")
+)
+
+// Rule computes the membership of a DM set.
+type Rule struct {
+	Set       string `json:"set"`
+	Predicate string `json:"predicate"`
+
+	// Disabled rules neither add nor remove enrollments.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// Validate checks r and parses its predicate.
+func (r *Rule) Validate() error {
+	if r == nil || r.Set == "" {
+		return ErrNoSet
+	}
+	if strings.Contains(r.Set, "/") {
+		return fmt.Errorf("%w: %s", ErrInvalidSet, r.Set)
+	}
+	_, err := ddmpredicate.Parse(r.Predicate)
+	return err
+}
+
+// Store stores rules.
+type Store interface {
+	StoreRule(ctx context.Context, r *Rule) error
+
+	// RetrieveRule retrieves the rule of set.
+	// Nil is returned if the rule does not exist.
+	RetrieveRule(ctx context.Context, set string) (*Rule, error)
+
+	RetrieveRules(ctx context.Context) ([]*Rule, error)
+	DeleteRule(ctx context.Context, set string) error
+}
+
+// ResponseStore retrieves command responses of all enrollments.
+type ResponseStore interface {
+	RetrieveResponsesByType(ctx context.Context, requestType string) (map[string]*cmdresponse.Response, error)
+}
+
+// SetStore retrieves and changes DM set memberships and status values.
+type SetStore interface {
+	RetrieveEnrollmentIDs(ctx context.Context, declarations []string, sets []string, ids []string) ([]string, error)
+	StoreEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+	RemoveEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+	RetrieveStatusValues(ctx context.Context, enrollmentIDs []string, pathPrefix string) (map[string][]ddmstorage.StatusValue, error)
+}
+
+// TagStore retrieves the tags of enrollments.
+type TagStore interface {
+	RetrieveTags(ctx context.Context, id string) (map[string]string, error)
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(ctx context.Context, declarations []string, sets []string, ids []string) error
+
+// Changed calls f(ctx, declarations, sets, ids).
+func (f NotifierFunc) Changed(ctx context.Context, declarations []string, sets []string, ids []string) error {
+	return f(ctx, declarations, sets, ids)
+}
+
+// Result is the result of a sync.
+type Result struct {
+	Evaluated int `json:"evaluated"`
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+
+	// Notified is the number of enrollments whose sets changed.
+	Notified int `json:"notified"`
+
+	// Errors are the rules and enrollments that failed to evaluate.
+	Errors []string `json:"errors,omitempty"`
+
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// Syncer keeps DM set memberships in sync with rules.
+type Syncer struct {
+	store     Store
+	responses ResponseStore
+	sets      SetStore
+	notifier  Notifier
+	inventory storage.ReadStorage
+	tags      TagStore
+	logger    log.Logger
+	clock     clock.Clock
+	mu        sync.Mutex
+}
+
+// Option configures the syncer.
+type Option func(*Syncer)
+
+// WithInventory adds the inventory values of enrollments to their
+// device properties.
+func WithInventory(store storage.ReadStorage) Option {
+	return func(s *Syncer) {
+		s.inventory = store
+	}
+}
+
+// WithTags adds the tags of enrollments to their device properties
+// as "tag.<key>" properties.
+func WithTags(store TagStore) Option {
+	return func(s *Syncer) {
+		s.tags = store
+	}
+}
+
+// WithLogger configures a logger for the syncer.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Syncer) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the syncer.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Syncer) {
+		s.clock = c
+	}
+}
+
+// New creates a new syncer.
+// Devices are the enrollments with DeviceInformation responses in responses.
+func New(store Store, responses ResponseStore, sets SetStore, notifier Notifier, opts ...Option) *Syncer {
+	if store == nil {
+		panic("nil store")
+	}
+	if responses == nil {
+		panic("nil response store")
+	}
+	if sets == nil {
+		panic("nil set store")
+	}
+	if notifier == nil {
+		panic("nil notifier")
+	}
+	s := &Syncer{
+		store:     store,
+		responses: responses,
+		sets:      sets,
+		notifier:  notifier,
+		logger:    log.NopLogger,
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// values are the predicate values of an enrollment.
+type values struct {
+	status     map[string]interface{}
+	properties map[string]interface{}
+}
+
+func (v *values) Status(item string) interface{} { return v.status[item] }
+
+func (v *values) Property(key string) interface{} { return v.properties[key] }
+
+// normalize converts v to a predicate value.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, float64, bool, nil:
+		return v
+	case int:
+		return float64(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// values retrieves the predicate values of enrollment id with device
+// information di.
+func (s *Syncer) values(ctx context.Context, id string, di *cmdresponse.DeviceInformation) (*values, error) {
+	v := &values{status: make(map[string]interface{}), properties: make(map[string]interface{})}
+
+	if di != nil {
+		// the device information keys are its JSON keys (e.g. "os_version")
+		b, err := json.Marshal(di)
+		if err != nil {
+			return nil, fmt.Errorf("marshal device information: %w", err)
+		}
+		var props map[string]interface{}
+		if err = json.Unmarshal(b, &props); err != nil {
+			return nil, fmt.Errorf("unmarshal device information: %w", err)
+		}
+		for k, p := range props {
+			v.properties[k] = normalize(p)
+		}
+		v.properties[PropertyPlatform] = capability.PlatformOf(di.ProductName)
+	}
+
+	if s.inventory != nil {
+		inv, err := s.inventory.RetrieveInventory(ctx, &storage.SearchOptions{IDs: []string{id}})
+		if err != nil {
+			return nil, fmt.Errorf("retrieving inventory: %w", err)
+		}
+		for k, p := range inv[id] {
+			v.properties[k] = normalize(p)
+		}
+	}
+
+	if s.tags != nil {
+		tags, err := s.tags.RetrieveTags(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving tags: %w", err)
+		}
+		for k, t := range tags {
+			v.properties[PropertyTagPrefix+k] = t
+		}
+	}
+
+	statusValues, err := s.sets.RetrieveStatusValues(ctx, []string{id}, "")
+	if err != nil {
+		return nil, fmt.Errorf("retrieving status values: %w", err)
+	}
+	for _, sv := range statusValues[id] {
+		var value interface{}
+		if err := json.Unmarshal([]byte(sv.Value), &value); err != nil {
+			// not JSON-encoded
+			value = sv.Value
+		}
+		item := strings.TrimPrefix(strings.TrimPrefix(sv.Path, "."), "StatusItems.")
+		v.status[item] = normalize(value)
+	}
+	return v, nil
+}
+
+// Sync evaluates the enabled rules for all devices (and current set
+// members) and adds and removes enrollments to and from the rule sets.
+// Enrollments whose sets changed are notified.
+func (s *Syncer) Sync(ctx context.Context) (*Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logger := ctxlog.Logger(ctx, s.logger)
+	res := &Result{SyncedAt: s.clock.Now()}
+
+	rules, err := s.store.RetrieveRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving rules: %w", err)
+	}
+	type rule struct {
+		set       string
+		predicate *ddmpredicate.Predicate
+		members   map[string]bool
+	}
+	var enabled []*rule
+	for _, r := range rules {
+		if r.Disabled {
+			continue
+		}
+		p, err := ddmpredicate.Parse(r.Predicate)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("rule %s: %v", r.Set, err))
+			continue
+		}
+		enabled = append(enabled, &rule{set: r.Set, predicate: p, members: make(map[string]bool)})
+	}
+	if len(enabled) < 1 {
+		return res, nil
+	}
+
+	devInfos, err := s.responses.RetrieveResponsesByType(ctx, cmdresponse.DeviceInformationType)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving device information: %w", err)
+	}
+
+	// evaluate devices and the current members of the rule sets
+	ids := make(map[string]*cmdresponse.DeviceInformation, len(devInfos))
+	for id, r := range devInfos {
+		ids[id] = r.DeviceInformation
+	}
+	for _, r := range enabled {
+		members, err := s.sets.RetrieveEnrollmentIDs(ctx, nil, []string{r.set}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving enrollments of set %s: %w", r.set, err)
+		}
+		for _, id := range members {
+			r.members[id] = true
+			if _, ok := ids[id]; !ok {
+				ids[id] = nil
+			}
+		}
+	}
+
+	var changed []string
+	for id, di := range ids {
+		v, err := s.values(ctx, id, di)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("enrollment %s: %v", id, err))
+			continue
+		}
+		res.Evaluated++
+
+		var idChanged bool
+		for _, r := range enabled {
+			match, _ := r.predicate.Evaluate(v)
+			if match == r.members[id] {
+				continue
+			}
+			var ok bool
+			if match {
+				ok, err = s.sets.StoreEnrollmentSet(ctx, id, r.set)
+			} else {
+				ok, err = s.sets.RemoveEnrollmentSet(ctx, id, r.set)
+			}
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("enrollment %s set %s: %v", id, r.set, err))
+				continue
+			}
+			if !ok {
+				continue
+			}
+			idChanged = true
+			if match {
+				res.Added++
+			} else {
+				res.Removed++
+			}
+		}
+		if idChanged {
+			changed = append(changed, id)
+		}
+	}
+
+	if len(changed) > 0 {
+		if err = s.notifier.Changed(ctx, nil, nil, changed); err != nil {
+			return res, fmt.Errorf("notifying enrollments: %w", err)
+		}
+		res.Notified = len(changed)
+	}
+
+	logger.Debug(
+		"msg", "synced dynamic sets",
+		"evaluated", res.Evaluated,
+		"added", res.Added,
+		"removed", res.Removed,
+		"errors", len(res.Errors),
+	)
+	return res, nil
+}
+
+// Run syncs every interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Sync(ctx); err != nil {
+			ctxlog.Logger(ctx, s.logger).Info("msg", "syncing dynamic sets", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package dynset
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/storage"
+)
+
+type responses map[string]*cmdresponse.Response
+
+func (r responses) RetrieveResponsesByType(_ context.Context, _ string) (map[string]*cmdresponse.Response, error) {
+	return r, nil
+}
+
+// sets is an in-memory set store of enrollment IDs by set.
+type sets map[string]map[string]bool
+
+func (s sets) RetrieveEnrollmentIDs(_ context.Context, _ []string, names []string, _ []string) (ids []string, _ error) {
+	for id := range s[names[0]] {
+		ids = append(ids, id)
+	}
+	return
+}
+
+func (s sets) StoreEnrollmentSet(_ context.Context, id, set string) (bool, error) {
+	if s[set] == nil {
+		s[set] = make(map[string]bool)
+	}
+	changed := !s[set][id]
+	s[set][id] = true
+	return changed, nil
+}
+
+func (s sets) RemoveEnrollmentSet(_ context.Context, id, set string) (bool, error) {
+	changed := s[set][id]
+	delete(s[set], id)
+	return changed, nil
+}
+
+func (s sets) RetrieveStatusValues(_ context.Context, _ []string, _ string) (map[string][]storage.StatusValue, error) {
+	return nil, nil
+}
+
+func device(productName, osVersion string) *cmdresponse.Response {
+	return &cmdresponse.Response{DeviceInformation: &cmdresponse.DeviceInformation{
+		ProductName: productName,
+		OSVersion:   osVersion,
+	}}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	err := store.StoreRule(ctx, &Rule{
+		Set:       "sonoma",
+		Predicate: `@property(platform) == "macOS" AND @property(os_version) BEGINSWITH "14."`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memberships := sets{"sonoma": {"ID2": true, "ID3": true}}
+	var notified []string
+	s := New(
+		store,
+		responses{
+			"ID1": device("MacBookPro18,3", "14.2"),
+			"ID2": device("MacBookPro18,3", "13.6"),
+			"ID3": device("Mac14,2", "14.1"),
+			"ID4": device("iPhone15,2", "14.1"),
+		},
+		memberships,
+		NotifierFunc(func(_ context.Context, _, _, ids []string) error {
+			notified = append(notified, ids...)
+			return nil
+		}),
+	)
+
+	res, err := s.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Evaluated != 4 || res.Added != 1 || res.Removed != 1 {
+		t.Errorf("incorrect result: %+v", res)
+	}
+	sort.Strings(notified)
+	if have, want := notified, []string{"ID1", "ID2"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := memberships["sonoma"], map[string]bool{"ID1": true, "ID3": true}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// nothing changes when in sync
+	notified = nil
+	if _, err = s.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) > 0 {
+		t.Errorf("notified: %v", notified)
+	}
+}
@@ -0,0 +1,192 @@
+// Package http provides the HTTP API for dynamic DM set rules.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/dynset"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoSet is returned when no set name is provided.
+	ErrNoSet = errors.New("no set provided")
+
+	// ErrNotFound is returned when a rule does not exist.
+	ErrNotFound = errors.New("rule not found")
+)
+
+// GetRulesHandler returns all rules.
+func GetRulesHandler(store dynset.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		rules, err := store.RetrieveRules(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving rules", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, rules, logger)
+	}
+}
+
+// GetRuleHandler returns the rule of the set in the URL path.
+func GetRuleHandler(store dynset.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		set := flow.Param(r.Context(), "set")
+		if set == "" {
+			httpapi.JSONError(w, ErrNoSet, http.StatusBadRequest)
+			return
+		}
+
+		rule, err := store.RetrieveRule(r.Context(), set)
+		if err != nil {
+			logger.Info("msg", "retrieving rule", "set", set, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if rule == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, rule, logger)
+	}
+}
+
+// PutRuleHandler stores the JSON rule in the request body for the set
+// in the URL path.
+func PutRuleHandler(store dynset.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		set := flow.Param(r.Context(), "set")
+		if set == "" {
+			httpapi.JSONError(w, ErrNoSet, http.StatusBadRequest)
+			return
+		}
+
+		rule := new(dynset.Rule)
+		if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding rule: %w", err), http.StatusBadRequest)
+			return
+		}
+		rule.Set = set
+		if err := rule.Validate(); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreRule(r.Context(), rule); err != nil {
+			logger.Info("msg", "storing rule", "set", set, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored rule", "set", set)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteRuleHandler deletes the rule of the set in the URL path.
+// Set memberships are not changed.
+func DeleteRuleHandler(store dynset.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		set := flow.Param(r.Context(), "set")
+		if set == "" {
+			httpapi.JSONError(w, ErrNoSet, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteRule(r.Context(), set); err != nil {
+			logger.Info("msg", "deleting rule", "set", set, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted rule", "set", set)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SyncHandler syncs the set memberships with the rules and returns the result.
+func SyncHandler(syncer *dynset.Syncer, logger log.Logger) http.HandlerFunc {
+	if syncer == nil {
+		panic("nil syncer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		res, err := syncer.Sync(r.Context())
+		if err != nil {
+			logger.Info("msg", "syncing dynamic sets", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, res, logger)
+	}
+}
+
+// HandleAPIv1 registers the dynamic set API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store dynset.Store, syncer *dynset.Syncer) {
+	mux.Handle(
+		prefix+"/dynsets",
+		GetRulesHandler(store, logger.With("handler", "get-dynsets")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dynsets/sync",
+		SyncHandler(syncer, logger.With("handler", "sync-dynsets")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/dynsets/:set",
+		GetRuleHandler(store, logger.With("handler", "get-dynset")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/dynsets/:set",
+		PutRuleHandler(store, logger.With("handler", "put-dynset")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/dynsets/:set",
+		DeleteRuleHandler(store, logger.With("handler", "delete-dynset")),
+		"DELETE",
+	)
+}
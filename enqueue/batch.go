@@ -0,0 +1,217 @@
+package enqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanomdm/push"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of IDs per push.
+	DefaultBatchSize = 1000
+
+	// DefaultBatchWorkers is the default number of concurrent pushes.
+	DefaultBatchWorkers = 4
+)
+
+// Batcher coalesces APNs pushes to enrollments.
+// Pushes requested for the same enrollment within a window are sent
+// once. Pending pushes are sent in batches by a pool of workers.
+type Batcher struct {
+	pusher  push.Pusher
+	size    int
+	workers int
+	logger  log.Logger
+	clock   clock.Clock
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+
+	// flushing serializes flushes
+	flushing sync.Mutex
+}
+
+// BatchOption configures a batcher.
+type BatchOption func(*Batcher)
+
+// WithBatchSize flushes pending pushes once size enrollments are
+// pending and limits the number of IDs per push to size.
+func WithBatchSize(size int) BatchOption {
+	return func(b *Batcher) {
+		if size > 0 {
+			b.size = size
+		}
+	}
+}
+
+// WithBatchWorkers configures the number of concurrent pushes.
+func WithBatchWorkers(n int) BatchOption {
+	return func(b *Batcher) {
+		if n > 0 {
+			b.workers = n
+		}
+	}
+}
+
+// WithBatchLogger configures a logger for the batcher.
+func WithBatchLogger(logger log.Logger) BatchOption {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(b *Batcher) {
+		b.logger = logger
+	}
+}
+
+// WithBatchClock configures the clock of the batcher's window ticker.
+func WithBatchClock(c clock.Clock) BatchOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(b *Batcher) {
+		b.clock = c
+	}
+}
+
+// NewBatcher creates a new push batcher that pushes with pusher.
+func NewBatcher(pusher push.Pusher, opts ...BatchOption) *Batcher {
+	if pusher == nil {
+		panic("nil pusher")
+	}
+	b := &Batcher{
+		pusher:  pusher,
+		size:    DefaultBatchSize,
+		workers: DefaultBatchWorkers,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+		pending: make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Add queues pushes to ids.
+// If the batch size is reached the pending pushes are flushed in the background.
+func (b *Batcher) Add(ids []string) {
+	b.mu.Lock()
+	for _, id := range ids {
+		b.pending[id] = struct{}{}
+	}
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+	if full {
+		go b.Flush(context.Background())
+	}
+}
+
+// Pending returns the number of enrollments with pending pushes.
+func (b *Batcher) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Flush sends all pending pushes.
+// It returns the number of enrollments pushed to successfully.
+func (b *Batcher) Flush(ctx context.Context) int {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.mu.Lock()
+	if len(b.pending) < 1 {
+		b.mu.Unlock()
+		return 0
+	}
+	ids := make([]string, 0, len(b.pending))
+	for id := range b.pending {
+		ids = append(ids, id)
+	}
+	b.pending = make(map[string]struct{})
+	b.mu.Unlock()
+	sort.Strings(ids)
+
+	batches := make(chan []string)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		pushed   int
+		failures int
+	)
+	for i := 0; i < b.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				ok, failed := b.push(ctx, batch)
+				mu.Lock()
+				pushed += ok
+				failures += failed
+				mu.Unlock()
+			}
+		}()
+	}
+	for len(ids) > 0 {
+		n := b.size
+		if len(ids) < n {
+			n = len(ids)
+		}
+		batches <- ids[:n]
+		ids = ids[n:]
+	}
+	close(batches)
+	wg.Wait()
+
+	logs := []interface{}{"msg", "flushed pushes", "pushed", pushed}
+	if failures > 0 {
+		b.logger.Info(append(logs, "failed", failures)...)
+	} else {
+		b.logger.Debug(logs...)
+	}
+	return pushed
+}
+
+// push pushes to a batch of ids and returns the success and failure counts.
+func (b *Batcher) push(ctx context.Context, ids []string) (ok, failed int) {
+	resp, err := b.pusher.Push(ctx, ids)
+	if err != nil {
+		b.logger.Info("msg", "push", "count", len(ids), "err", err)
+		return 0, len(ids)
+	}
+	for _, id := range ids {
+		r := resp[id]
+		if r == nil || r.Err != nil {
+			failed++
+			continue
+		}
+		ok++
+	}
+	return
+}
+
+// Run flushes pending pushes every window until ctx is done.
+// Any remaining pushes are flushed before returning.
+func (b *Batcher) Run(ctx context.Context, window time.Duration) error {
+	if window <= 0 {
+		return errors.New("invalid window")
+	}
+	ticker := b.clock.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			b.Flush(ctx)
+		case <-ctx.Done():
+			b.Flush(context.Background())
+			return ctx.Err()
+		}
+	}
+}
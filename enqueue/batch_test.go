@@ -0,0 +1,100 @@
+package enqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/micromdm/nanomdm/push"
+)
+
+type pusher struct {
+	mu     sync.Mutex
+	pushes [][]string
+}
+
+func (p *pusher) Push(_ context.Context, ids []string) (map[string]*push.Response, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pushes = append(p.pushes, ids)
+	resp := make(map[string]*push.Response)
+	for _, id := range ids {
+		resp[id] = &push.Response{Id: "APNS-" + id}
+	}
+	return resp, nil
+}
+
+func TestBatcher(t *testing.T) {
+	p := new(pusher)
+	b := NewBatcher(p, WithBatchSize(100), WithBatchWorkers(1))
+
+	// duplicate pushes are coalesced
+	b.Add([]string{"ID1", "ID2"})
+	b.Add([]string{"ID2", "ID3"})
+	if have, want := b.Pending(), 3; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+
+	if have, want := b.Flush(context.Background()), 3; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := len(p.pushes), 1; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+	if have, want := b.Pending(), 0; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// pushes are split into batches
+	b = NewBatcher(p, WithBatchSize(2), WithBatchWorkers(2))
+	b.pending = map[string]struct{}{"A": {}, "B": {}, "C": {}, "D": {}, "E": {}}
+	p.pushes = nil
+	if have, want := b.Flush(context.Background()), 5; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := len(p.pushes), 3; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
+
+type dmEnqueuer struct {
+	multi bool
+	calls [][]string
+}
+
+func (e *dmEnqueuer) EnqueueDMCommand(_ context.Context, ids []string, _ []byte) error {
+	e.calls = append(e.calls, ids)
+	return nil
+}
+
+func (e *dmEnqueuer) SupportsMultiCommands() bool { return e.multi }
+
+func TestDebouncer(t *testing.T) {
+	ctx := context.Background()
+	e := new(dmEnqueuer)
+	d := NewDebouncer(e)
+
+	// repeated notifications are coalesced per enrollment
+	for i := 0; i < 3; i++ {
+		if err := d.EnqueueDMCommand(ctx, []string{"ID1", "ID2"}, []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have, want := d.Flush(ctx), 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := len(e.calls), 2; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+	if have, want := d.Pending(), 0; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// multi-command enqueuers are sent a single command
+	e.multi, e.calls = true, nil
+	d.EnqueueDMCommand(ctx, []string{"ID1", "ID2", "ID3"}, nil)
+	d.Flush(ctx)
+	if have, want := len(e.calls), 1; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,161 @@
+package enqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/kmfddm/notifier"
+	"github.com/micromdm/nanolib/log"
+)
+
+// Debouncer coalesces DeclarativeManagement commands to enrollments.
+// Commands requested for the same enrollment within a window are
+// enqueued once at the end of the window.
+// It satisfies the DM notifier enqueuer interface.
+type Debouncer struct {
+	next   notifier.Enqueuer
+	logger log.Logger
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+
+	// flushing serializes flushes
+	flushing sync.Mutex
+}
+
+// DebounceOption configures a debouncer.
+type DebounceOption func(*Debouncer)
+
+// WithDebounceLogger configures a logger for the debouncer.
+func WithDebounceLogger(logger log.Logger) DebounceOption {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(d *Debouncer) {
+		d.logger = logger
+	}
+}
+
+// WithDebounceClock configures the clock of the debouncer's window ticker.
+func WithDebounceClock(c clock.Clock) DebounceOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(d *Debouncer) {
+		d.clock = c
+	}
+}
+
+// NewDebouncer creates a new debouncer that enqueues commands with next.
+func NewDebouncer(next notifier.Enqueuer, opts ...DebounceOption) *Debouncer {
+	if next == nil {
+		panic("nil enqueuer")
+	}
+	d := &Debouncer{
+		next:    next,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+		pending: make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// EnqueueDMCommand queues DeclarativeManagement commands to ids.
+// The tokensJSON is ignored as the tokens may change before the
+// commands are enqueued. Enrollments retrieve the tokens themselves.
+func (d *Debouncer) EnqueueDMCommand(_ context.Context, ids []string, _ []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range ids {
+		d.pending[id] = struct{}{}
+	}
+	return nil
+}
+
+// SupportsMultiCommands always returns true: the commands are only
+// queued and the debouncer supports queueing many enrollments at once.
+func (d *Debouncer) SupportsMultiCommands() bool {
+	return true
+}
+
+// Pending returns the number of enrollments with pending commands.
+func (d *Debouncer) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// Flush enqueues all pending commands.
+// It returns the number of enrollments enqueued to successfully.
+func (d *Debouncer) Flush(ctx context.Context) int {
+	d.flushing.Lock()
+	defer d.flushing.Unlock()
+
+	d.mu.Lock()
+	if len(d.pending) < 1 {
+		d.mu.Unlock()
+		return 0
+	}
+	ids := make([]string, 0, len(d.pending))
+	for id := range d.pending {
+		ids = append(ids, id)
+	}
+	d.pending = make(map[string]struct{})
+	d.mu.Unlock()
+	sort.Strings(ids)
+
+	var enqueued, failures int
+	if d.next.SupportsMultiCommands() {
+		if err := d.next.EnqueueDMCommand(ctx, ids, nil); err != nil {
+			d.logger.Info("msg", "enqueueing DM command", "count", len(ids), "err", err)
+			failures = len(ids)
+		} else {
+			enqueued = len(ids)
+		}
+	} else {
+		for _, id := range ids {
+			if err := d.next.EnqueueDMCommand(ctx, []string{id}, nil); err != nil {
+				d.logger.Info("msg", "enqueueing DM command", "id", id, "err", err)
+				failures++
+				continue
+			}
+			enqueued++
+		}
+	}
+
+	logs := []interface{}{"msg", "flushed DM commands", "enqueued", enqueued}
+	if failures > 0 {
+		d.logger.Info(append(logs, "failed", failures)...)
+	} else {
+		d.logger.Debug(logs...)
+	}
+	return enqueued
+}
+
+// Run flushes pending commands every window until ctx is done.
+// Any remaining commands are flushed before returning.
+func (d *Debouncer) Run(ctx context.Context, window time.Duration) error {
+	if window <= 0 {
+		return errors.New("invalid window")
+	}
+	ticker := d.clock.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			d.Flush(ctx)
+		case <-ctx.Done():
+			d.Flush(context.Background())
+			return ctx.Err()
+		}
+	}
+}
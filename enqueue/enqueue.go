@@ -23,17 +23,36 @@ type IDer interface {
 
 // Enqueue enqueues MDM commands to enrollments.
 type Enqueue struct {
-	ce     RawCommandEnqueuer
-	ider   IDer
-	noPush bool
+	ce      RawCommandEnqueuer
+	ider    IDer
+	noPush  bool
+	batcher *Batcher
+}
+
+// Option configures the enqueuer.
+type Option func(*Enqueue)
+
+// WithBatcher coalesces and batches APNs pushes with b instead of
+// pushing with every enqueue. The batcher must be run separately.
+func WithBatcher(b *Batcher) Option {
+	if b == nil {
+		panic("nil batcher")
+	}
+	return func(e *Enqueue) {
+		e.batcher = b
+	}
 }
 
 // New creates a new enqueuer.
-func New(ce RawCommandEnqueuer) *Enqueue {
-	return &Enqueue{
+func New(ce RawCommandEnqueuer, opts ...Option) *Enqueue {
+	e := &Enqueue{
 		ce:   ce,
 		ider: uuid.NewUUID(),
 	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
 }
 
 // EnqueueDMCommand enqueues a Declarative Management MDM command.
@@ -48,12 +67,17 @@ func (e *Enqueue) EnqueueDMCommand(ctx context.Context, ids []string, tokensJSON
 }
 
 // Enqueue enqueues rawCmd to enrollment ids and sends an APNs push.
+// With a batcher the push is queued in the batcher instead.
 func (e *Enqueue) Enqueue(ctx context.Context, ids []string, rawCmd []byte) error {
-	r, _, err := e.ce.RawCommandEnqueueWithPush(ctx, rawCmd, ids, e.noPush)
+	r, _, err := e.ce.RawCommandEnqueueWithPush(ctx, rawCmd, ids, e.noPush || e.batcher != nil)
 	if err != nil {
 		return fmt.Errorf("raw push enqueue: %w", err)
 	}
 
+	if e.batcher != nil && !e.noPush {
+		e.batcher.Add(ids)
+	}
+
 	return r.Error()
 }
 
@@ -68,5 +92,10 @@ func (e *Enqueue) Push(ctx context.Context, ids []string) error {
 		return nil
 	}
 
+	if e.batcher != nil {
+		e.batcher.Add(ids)
+		return nil
+	}
+
 	return e.Enqueue(ctx, ids, nil)
 }
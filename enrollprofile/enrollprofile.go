@@ -0,0 +1,283 @@
+// Package enrollprofile generates MDM enrollment profiles.
+package enrollprofile
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/micromdm/plist"
+)
+
+const (
+	// DefaultAccessRights allows all MDM access rights.
+	DefaultAccessRights = 8191
+
+	// DefaultIdentifier is the default payload identifier prefix.
+	DefaultIdentifier = "com.github.micromdm.nanohub.enroll"
+
+	// DefaultKeySize is the default SCEP key size.
+	DefaultKeySize = 2048
+
+	// EnrollmentModeBYOD is the enrollment mode of account-driven
+	// User Enrollment.
+	EnrollmentModeBYOD = "BYOD"
+)
+
+// ErrNoTopic is returned when no push topic is configured.
+var ErrNoTopic = errors.New("no push topic")
+
+// SCEP configures the SCEP identity payload.
+type SCEP struct {
+	URL       string
+	Name      string // CA-IDENT
+	Challenge string
+	Subject   string // common name; default is the MDM topic
+	KeySize   int
+}
+
+// Config configures an enrollment profile.
+type Config struct {
+	ServerURL           string
+	CheckInURL          string // optional
+	Topic               string
+	AccessRights        int
+	SignMessage         bool
+	CheckOutWhenRemoved bool
+
+	Identifier   string
+	DisplayName  string
+	Organization string
+
+	// EnrollmentMode and AssignedManagedAppleID configure
+	// account-driven enrollment profiles.
+	EnrollmentMode         string
+	AssignedManagedAppleID string
+
+	SCEP SCEP
+}
+
+// Generate generates an unsigned enrollment profile from c.
+func Generate(c *Config) ([]byte, error) {
+	if c == nil {
+		return nil, errors.New("nil config")
+	}
+	if c.ServerURL == "" {
+		return nil, errors.New("no server URL")
+	}
+	if c.Topic == "" {
+		return nil, ErrNoTopic
+	}
+	if c.SCEP.URL == "" {
+		return nil, errors.New("no SCEP URL")
+	}
+
+	id := c.Identifier
+	if id == "" {
+		id = DefaultIdentifier
+	}
+	accessRights := c.AccessRights
+	if accessRights == 0 {
+		accessRights = DefaultAccessRights
+	}
+	keySize := c.SCEP.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	subject := c.SCEP.Subject
+	if subject == "" {
+		subject = c.Topic
+	}
+	displayName := c.DisplayName
+	if displayName == "" {
+		displayName = "MDM Enrollment"
+	}
+
+	scepUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	scepContent := map[string]interface{}{
+		"URL":       c.SCEP.URL,
+		"Key Type":  "RSA",
+		"Keysize":   keySize,
+		"Key Usage": 5, // signing and encryption
+		"Subject":   [][][]string{{{"CN", subject}}},
+	}
+	if c.SCEP.Name != "" {
+		scepContent["Name"] = c.SCEP.Name
+	}
+	if c.SCEP.Challenge != "" {
+		scepContent["Challenge"] = c.SCEP.Challenge
+	}
+	scepPayload := map[string]interface{}{
+		"PayloadType":        "com.apple.security.scep",
+		"PayloadVersion":     1,
+		"PayloadIdentifier":  id + ".scep",
+		"PayloadUUID":        scepUUID,
+		"PayloadDisplayName": "MDM Identity",
+		"PayloadContent":     scepContent,
+	}
+
+	mdmUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	mdmPayload := map[string]interface{}{
+		"PayloadType":             "com.apple.mdm",
+		"PayloadVersion":          1,
+		"PayloadIdentifier":       id + ".mdm",
+		"PayloadUUID":             mdmUUID,
+		"PayloadDisplayName":      "MDM",
+		"ServerURL":               c.ServerURL,
+		"Topic":                   c.Topic,
+		"AccessRights":            accessRights,
+		"IdentityCertificateUUID": scepUUID,
+		"SignMessage":             c.SignMessage,
+		"CheckOutWhenRemoved":     c.CheckOutWhenRemoved,
+	}
+	if c.CheckInURL != "" {
+		mdmPayload["CheckInURL"] = c.CheckInURL
+	}
+	if c.EnrollmentMode != "" {
+		mdmPayload["EnrollmentMode"] = c.EnrollmentMode
+		mdmPayload["AssignedManagedAppleID"] = c.AssignedManagedAppleID
+	} else {
+		// user enrollments support neither capability
+		mdmPayload["ServerCapabilities"] = []string{"com.apple.mdm.per-user-connections", "com.apple.mdm.bootstraptoken"}
+	}
+
+	profileUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	profile := map[string]interface{}{
+		"PayloadType":        "Configuration",
+		"PayloadVersion":     1,
+		"PayloadIdentifier":  id,
+		"PayloadUUID":        profileUUID,
+		"PayloadDisplayName": displayName,
+		"PayloadContent":     []interface{}{scepPayload, mdmPayload},
+	}
+	if c.Organization != "" {
+		profile["PayloadOrganization"] = c.Organization
+	}
+	return plist.MarshalIndent(profile, "\t")
+}
+
+// newUUID returns a new random UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating uuid: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ChallengeFunc issues a one-time SCEP challenge.
+type ChallengeFunc func(ctx context.Context) (string, error)
+
+// Generator generates (optionally signed) enrollment profiles from
+// a base configuration.
+type Generator struct {
+	config    Config
+	signer    *Signer
+	challenge ChallengeFunc
+}
+
+// Option configures the generator.
+type Option func(*Generator)
+
+// WithSigner signs generated profiles with s.
+func WithSigner(s *Signer) Option {
+	return func(g *Generator) {
+		g.signer = s
+	}
+}
+
+// WithChallenges sets a new SCEP challenge from f in each profile.
+func WithChallenges(f ChallengeFunc) Option {
+	return func(g *Generator) {
+		g.challenge = f
+	}
+}
+
+// NewGenerator creates a new generator with the base configuration c.
+func NewGenerator(c Config, opts ...Option) *Generator {
+	g := &Generator{config: c}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Profile generates an enrollment profile.
+// If topic is not empty it overrides the configured topic.
+func (g *Generator) Profile(ctx context.Context, topic string) ([]byte, error) {
+	c := g.config
+	if topic != "" {
+		c.Topic = topic
+	}
+	return g.generate(ctx, c)
+}
+
+// UserEnrollmentProfile generates an account-driven User Enrollment
+// profile for managedAppleID. Params are added to the query of the
+// MDM server and check-in URLs.
+func (g *Generator) UserEnrollmentProfile(ctx context.Context, managedAppleID string, params url.Values) ([]byte, error) {
+	if managedAppleID == "" {
+		return nil, errors.New("no managed Apple ID")
+	}
+	c := g.config
+	c.EnrollmentMode = EnrollmentModeBYOD
+	c.AssignedManagedAppleID = managedAppleID
+	var err error
+	if c.ServerURL, err = addParams(c.ServerURL, params); err != nil {
+		return nil, err
+	}
+	if c.CheckInURL, err = addParams(c.CheckInURL, params); err != nil {
+		return nil, err
+	}
+	return g.generate(ctx, c)
+}
+
+// addParams adds params to the query of URL u.
+func addParams(u string, params url.Values) (string, error) {
+	if u == "" || len(params) < 1 {
+		return u, nil
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", fmt.Errorf("parsing URL: %w", err)
+	}
+	q := parsed.Query()
+	for k, vs := range params {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	parsed.RawQuery = q.Encode()
+	return parsed.String(), nil
+}
+
+// generate generates a (signed) profile from c.
+func (g *Generator) generate(ctx context.Context, c Config) ([]byte, error) {
+	if g.challenge != nil {
+		var err error
+		if c.SCEP.Challenge, err = g.challenge(ctx); err != nil {
+			return nil, fmt.Errorf("issuing challenge: %w", err)
+		}
+	}
+	profile, err := Generate(&c)
+	if err != nil {
+		return nil, err
+	}
+	if g.signer == nil {
+		return profile, nil
+	}
+	return g.signer.Sign(profile)
+}
@@ -0,0 +1,46 @@
+package enrollprofile
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/plist"
+)
+
+func TestProfile(t *testing.T) {
+	g := NewGenerator(
+		Config{
+			ServerURL: "https://mdm.example.com/mdm",
+			SCEP:      SCEP{URL: "https://mdm.example.com/scep"},
+		},
+		WithChallenges(func(context.Context) (string, error) { return "secret", nil }),
+	)
+	if _, err := g.Profile(context.Background(), ""); err != ErrNoTopic {
+		t.Errorf("have: %v, want: %v", err, ErrNoTopic)
+	}
+
+	b, err := g.Profile(context.Background(), "com.apple.mgmt.External.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile struct {
+		PayloadContent []map[string]interface{}
+	}
+	if err = plist.Unmarshal(b, &profile); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(profile.PayloadContent), 2; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+	scep, mdm := profile.PayloadContent[0], profile.PayloadContent[1]
+	if have, want := mdm["IdentityCertificateUUID"], scep["PayloadUUID"]; have != want {
+		t.Errorf("identity: have: %v, want: %v", have, want)
+	}
+	if have, want := mdm["Topic"], "com.apple.mgmt.External.test"; have != want {
+		t.Errorf("topic: have: %v, want: %v", have, want)
+	}
+	content, _ := scep["PayloadContent"].(map[string]interface{})
+	if have, want := content["Challenge"], "secret"; have != want {
+		t.Errorf("challenge: have: %v, want: %v", have, want)
+	}
+}
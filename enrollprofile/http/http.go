@@ -0,0 +1,49 @@
+// Package http provides the HTTP API for enrollment profiles.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/enrollprofile"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ProfileHandler returns a new enrollment profile.
+// The "topic" query parameter overrides the configured push topic.
+func ProfileHandler(g *enrollprofile.Generator, logger log.Logger) http.HandlerFunc {
+	if g == nil {
+		panic("nil generator")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		profile, err := g.Profile(r.Context(), r.URL.Query().Get("topic"))
+		if errors.Is(err, enrollprofile.ErrNoTopic) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "generating enrollment profile", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "generated enrollment profile")
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Header().Set("Content-Disposition", `attachment; filename="enroll.mobileconfig"`)
+		w.Write(profile)
+	}
+}
+
+// HandleAPIv1 registers the enrollment profile API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, g *enrollprofile.Generator) {
+	mux.Handle(
+		prefix+"/enrollprofile",
+		ProfileHandler(g, logger.With("handler", "get-enrollment-profile")),
+		"GET",
+	)
+}
@@ -0,0 +1,56 @@
+package enrollprofile
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// Signer signs profiles.
+type Signer struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.PrivateKey
+}
+
+// NewSigner creates a new signer from a PEM certificate (followed by
+// any intermediate certificates) and its PEM private key.
+func NewSigner(certPEM, keyPEM []byte) (*Signer, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading signing certificate: %w", err)
+	}
+	if len(pair.Certificate) < 1 {
+		return nil, errors.New("no signing certificate")
+	}
+	s := &Signer{key: pair.PrivateKey}
+	for i, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signing certificate: %w", err)
+		}
+		if i == 0 {
+			s.cert = cert
+		} else {
+			s.chain = append(s.chain, cert)
+		}
+	}
+	return s, nil
+}
+
+// Sign returns profile signed as a CMS (PKCS #7) SignedData.
+func (s *Signer) Sign(profile []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(profile)
+	if err != nil {
+		return nil, fmt.Errorf("creating signed data: %w", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err = sd.AddSignerChain(s.cert, s.key, s.chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("adding signer: %w", err)
+	}
+	return sd.Finish()
+}
@@ -0,0 +1,227 @@
+// Package environment labels enrollments with an environment (such as
+// "staging" or "production") and guards API requests against targeting
+// enrollments outside of a requested environment.
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+const (
+	// ParamName is the URL query parameter of the MDM ServerURL or
+	// CheckInURL in the enrollment profile that labels enrollments.
+	ParamName = "env"
+
+	// HeaderName is the HTTP header of API requests that scopes
+	// the request to an environment.
+	HeaderName = "X-NanoHUB-Environment"
+)
+
+var (
+	// ErrNoEnvironment is returned when an environment is required
+	// but the API request does not specify one.
+	ErrNoEnvironment = errors.New("no environment specified")
+
+	// ErrWrongEnvironment is returned when an API request targets
+	// enrollments outside of its environment.
+	ErrWrongEnvironment = errors.New("enrollments outside of environment")
+)
+
+// Store stores enrollment environment labels.
+type Store interface {
+	// StoreEnvironment labels id with env. An empty env removes the label.
+	StoreEnvironment(ctx context.Context, id, env string) error
+
+	// RetrieveEnvironment retrieves the label of id.
+	// An empty string is returned for unlabeled enrollments.
+	RetrieveEnvironment(ctx context.Context, id string) (string, error)
+
+	// RetrieveEnrollments retrieves the enrollment IDs labeled with env.
+	RetrieveEnrollments(ctx context.Context, env string) ([]string, error)
+}
+
+// deviceID returns the device channel ID of an enrollment ID.
+// User channel enrollments share the environment of their device.
+func deviceID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// Lookup retrieves the environment of id from store.
+// User channel IDs use the environment of their device, if labeled,
+// and otherwise default to env.
+func Lookup(ctx context.Context, store Store, id, env string) (string, error) {
+	label, err := store.RetrieveEnvironment(ctx, deviceID(id))
+	if err != nil {
+		return "", err
+	}
+	if label == "" {
+		return env, nil
+	}
+	return label, nil
+}
+
+// Service is a NanoMDM service that labels enrollments with the
+// environment in the enrollment profile's MDM URLs.
+type Service struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	logger log.Logger
+}
+
+// NewService creates a new environment labeling service.
+func NewService(store Store, logger log.Logger) *Service {
+	if store == nil {
+		panic("nil store")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	return &Service{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		logger:                   logger,
+	}
+}
+
+// label stores the environment of the enrollment if the request has one.
+func (s *Service) label(r *mdm.Request) error {
+	env := r.Params[ParamName]
+	if env == "" || r.ID == "" {
+		return nil
+	}
+	id := deviceID(r.ID)
+	if err := s.store.StoreEnvironment(r.Context(), id, env); err != nil {
+		return fmt.Errorf("storing environment: %w", err)
+	}
+	ctxlog.Logger(r.Context(), s.logger).Debug("msg", "labeled enrollment", "id", id, "environment", env)
+	return nil
+}
+
+// Authenticate labels the enrollment.
+func (s *Service) Authenticate(r *mdm.Request, _ *mdm.Authenticate) error {
+	return s.label(r)
+}
+
+// TokenUpdate labels the enrollment.
+func (s *Service) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	return s.label(r)
+}
+
+// Guard restricts API requests to enrollments in an environment.
+type Guard struct {
+	store      Store
+	logger     log.Logger
+	defaultEnv string
+	required   bool
+}
+
+// GuardOption configures a guard.
+type GuardOption func(*Guard)
+
+// WithLogger configures a logger for the guard.
+func WithLogger(logger log.Logger) GuardOption {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(g *Guard) {
+		g.logger = logger
+	}
+}
+
+// WithDefault assigns unlabeled enrollments to env.
+func WithDefault(env string) GuardOption {
+	return func(g *Guard) {
+		g.defaultEnv = env
+	}
+}
+
+// WithRequired requires API requests that change enrollments to specify
+// an environment. Otherwise requests without an environment are unscoped.
+func WithRequired() GuardOption {
+	return func(g *Guard) {
+		g.required = true
+	}
+}
+
+// NewGuard creates a new environment guard.
+func NewGuard(store Store, opts ...GuardOption) *Guard {
+	if store == nil {
+		panic("nil store")
+	}
+	g := &Guard{store: store, logger: log.NopLogger}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Check returns ErrWrongEnvironment if any of ids are not in env.
+func (g *Guard) Check(ctx context.Context, env string, ids []string) error {
+	var outside []string
+	for _, id := range ids {
+		label, err := Lookup(ctx, g.store, id, g.defaultEnv)
+		if err != nil {
+			return fmt.Errorf("retrieving environment for %s: %w", id, err)
+		}
+		if label != env {
+			outside = append(outside, id)
+		}
+	}
+	if len(outside) > 0 {
+		return fmt.Errorf("%w %s: %s", ErrWrongEnvironment, env, strings.Join(outside, ", "))
+	}
+	return nil
+}
+
+// Middleware rejects API requests with targets (from targetsFn) outside of
+// the environment in the request's HeaderName header.
+func (g *Guard) Middleware(targetsFn func(*http.Request) []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ids := targetsFn(r)
+			if len(ids) < 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			env := r.Header.Get(HeaderName)
+			if env == "" {
+				switch r.Method {
+				case http.MethodGet, http.MethodHead, http.MethodOptions:
+				default:
+					if g.required {
+						httpapi.JSONError(w, ErrNoEnvironment, http.StatusBadRequest)
+						return
+					}
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			logger := ctxlog.Logger(r.Context(), g.logger)
+			if err := g.Check(r.Context(), env, ids); errors.Is(err, ErrWrongEnvironment) {
+				logger.Info("msg", "environment guard", "environment", env, "err", err)
+				httpapi.JSONError(w, err, http.StatusForbidden)
+				return
+			} else if err != nil {
+				logger.Info("msg", "environment guard", "environment", env, "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
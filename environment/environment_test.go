@@ -0,0 +1,84 @@
+package environment
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+func TestGuard(t *testing.T) {
+	store := NewKVStore(kvmap.New())
+
+	// label enrollments from their MDM URL parameter
+	svc := NewService(store, nil)
+	for id, env := range map[string]string{"ID1": "production", "ID2": "staging"} {
+		r := &mdm.Request{EnrollID: &mdm.EnrollID{ID: id}, Params: map[string]string{ParamName: env}}
+		if err := svc.TokenUpdate(r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		opts   []GuardOption
+		method string
+		env    string
+		ids    string
+		status int
+	}{
+		{"unscoped", nil, "POST", "", "ID1,ID2", http.StatusOK},
+		{"no-targets", []GuardOption{WithRequired()}, "POST", "", "", http.StatusOK},
+		{"required", []GuardOption{WithRequired()}, "POST", "", "ID1", http.StatusBadRequest},
+		{"required-read", []GuardOption{WithRequired()}, "GET", "", "ID1", http.StatusOK},
+		{"matched", nil, "POST", "production", "ID1", http.StatusOK},
+		{"matched-user-channel", nil, "POST", "production", "ID1:USER1", http.StatusOK},
+		{"mismatched", nil, "POST", "production", "ID1,ID2", http.StatusForbidden},
+		{"mismatched-read", nil, "GET", "staging", "ID1", http.StatusForbidden},
+		{"unlabeled", nil, "POST", "production", "ID3", http.StatusForbidden},
+		{"default", []GuardOption{WithDefault("production")}, "POST", "production", "ID1,ID3", http.StatusOK},
+		{"default-mismatched", []GuardOption{WithDefault("production")}, "POST", "staging", "ID3", http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			targets := func(r *http.Request) []string {
+				if ids := r.URL.Query().Get("id"); ids != "" {
+					return strings.Split(ids, ",")
+				}
+				return nil
+			}
+			h := NewGuard(store, test.opts...).Middleware(targets)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+			r := httptest.NewRequest(test.method, "/?id="+test.ids, nil)
+			if test.env != "" {
+				r.Header.Set(HeaderName, test.env)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != test.status {
+				t.Errorf("have status %d, want %d: %s", rec.Code, test.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	if err := store.StoreEnvironment(ctx, "ID1", "production"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"ID1": "production", "ID1:USER1": "production", "ID2": "default"} {
+		have, err := Lookup(ctx, store, id, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: have %q, want %q", id, have, want)
+		}
+	}
+}
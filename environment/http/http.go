@@ -0,0 +1,171 @@
+// Package http provides the HTTP API for enrollment environments.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/environment"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNoEnvironment is returned when no environment is provided.
+	ErrNoEnvironment = errors.New("no environment provided")
+)
+
+// Label is the environment label of an enrollment.
+type Label struct {
+	Environment string `json:"environment"`
+}
+
+// GetEnrollmentsHandler returns the enrollment IDs in the environment in the URL path.
+func GetEnrollmentsHandler(store environment.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		env := flow.Param(r.Context(), "env")
+		if env == "" {
+			httpapi.JSONError(w, ErrNoEnvironment, http.StatusBadRequest)
+			return
+		}
+
+		ids, err := store.RetrieveEnrollments(r.Context(), env)
+		if err != nil {
+			logger.Info("msg", "retrieving enrollments", "environment", env, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, ids, logger)
+	}
+}
+
+// GetLabelHandler returns the environment of the enrollment ID in the URL path.
+func GetLabelHandler(store environment.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		env, err := store.RetrieveEnvironment(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving environment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, &Label{Environment: env}, logger)
+	}
+}
+
+// PutLabelHandler labels the enrollment ID in the URL path with the
+// environment in the JSON request body.
+func PutLabelHandler(store environment.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		label := new(Label)
+		if err := json.NewDecoder(r.Body).Decode(label); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding label: %w", err), http.StatusBadRequest)
+			return
+		}
+		if label.Environment == "" {
+			httpapi.JSONError(w, ErrNoEnvironment, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreEnvironment(r.Context(), id, label.Environment); err != nil {
+			logger.Info("msg", "storing environment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored environment", "id", id, "environment", label.Environment)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteLabelHandler removes the environment of the enrollment ID in the URL path.
+func DeleteLabelHandler(store environment.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreEnvironment(r.Context(), id, ""); err != nil {
+			logger.Info("msg", "deleting environment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted environment", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the environment API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store environment.Store) {
+	mux.Handle(
+		prefix+"/environments/:env/enrollments",
+		GetEnrollmentsHandler(store, logger.With("handler", "get-environment-enrollments")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/environment",
+		GetLabelHandler(store, logger.With("handler", "get-environment")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/environment",
+		PutLabelHandler(store, logger.With("handler", "put-environment")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/environment",
+		DeleteLabelHandler(store, logger.With("handler", "delete-environment")),
+		"DELETE",
+	)
+}
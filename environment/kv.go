@@ -0,0 +1,83 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPrefixID  = "id."
+	keyPrefixEnv = "env."
+)
+
+// KVStore stores enrollment environment labels in a key-value bucket.
+// An index of enrollments by environment is kept for listing.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new environment store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreEnvironment labels id with env. An empty env removes the label.
+func (s *KVStore) StoreEnvironment(ctx context.Context, id, env string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if strings.Contains(env, ".") {
+		return errors.New("invalid environment")
+	}
+	prev, err := s.RetrieveEnvironment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if prev == env {
+		return nil
+	}
+	if prev != "" {
+		if err = s.b.Delete(ctx, keyPrefixEnv+prev+"."+id); err != nil {
+			return fmt.Errorf("deleting index: %w", err)
+		}
+	}
+	if env == "" {
+		return s.b.Delete(ctx, keyPrefixID+id)
+	}
+	if err = s.b.Set(ctx, keyPrefixEnv+env+"."+id, []byte{}); err != nil {
+		return fmt.Errorf("setting index: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixID+id, []byte(env))
+}
+
+// RetrieveEnvironment retrieves the label of id.
+func (s *KVStore) RetrieveEnvironment(ctx context.Context, id string) (string, error) {
+	v, err := s.b.Get(ctx, keyPrefixID+id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("getting environment: %w", err)
+	}
+	return string(v), nil
+}
+
+// RetrieveEnrollments retrieves the enrollment IDs labeled with env.
+func (s *KVStore) RetrieveEnrollments(ctx context.Context, env string) ([]string, error) {
+	prefix := keyPrefixEnv + env + "."
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing enrollments: %w", err)
+	}
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, strings.TrimPrefix(k, prefix))
+	}
+	return ids, nil
+}
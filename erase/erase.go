@@ -0,0 +1,232 @@
+// Package erase implements a remote wipe (EraseDevice) workflow.
+// A Find My PIN is generated and escrowed to inventory for Intel Macs
+// which require it to unlock the Mac after erasing.
+package erase
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/logkeys"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const WorkflowName = "io.micromdm.nanohub.wf.erase.v1"
+
+// Inventory keys set by the workflow.
+const (
+	KeyPIN      = WorkflowName + ".pin"
+	KeySent     = WorkflowName + ".sent"
+	KeyReceived = WorkflowName + ".received"
+	KeyStatus   = WorkflowName + ".status"
+)
+
+// PINLength is the length of generated Find My PINs.
+const PINLength = 6
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Workflow erases devices.
+type Workflow struct {
+	enq    workflow.StepEnqueuer
+	ider   IDer
+	store  storage.Storage
+	sink   event.Sink
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the workflow.
+type Option func(*Workflow)
+
+// WithLogger configures a logger for the workflow.
+func WithLogger(logger log.Logger) Option {
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithSink sends erase completion events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(w *Workflow) {
+		w.sink = sink
+	}
+}
+
+// WithIDer configures the command UUID generator.
+func WithIDer(ider IDer) Option {
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithClock configures the clock of the workflow.
+func WithClock(c clock.Clock) Option {
+	return func(w *Workflow) {
+		w.clock = c
+	}
+}
+
+// New creates a new erase workflow.
+// The PINs and results of erases are stored in store.
+func New(q workflow.StepEnqueuer, store storage.Storage, opts ...Option) (*Workflow, error) {
+	if q == nil {
+		return nil, errors.New("nil step enqueuer")
+	}
+	if store == nil {
+		return nil, errors.New("nil inventory storage")
+	}
+	w := &Workflow{
+		enq:    q,
+		ider:   uuid.NewUUID(),
+		store:  store,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = w.logger.With(logkeys.WorkflowName, w.Name())
+	return w, nil
+}
+
+func (w *Workflow) Name() string {
+	return WorkflowName
+}
+
+func (w *Workflow) Config() *workflow.Config {
+	return nil
+}
+
+func (w *Workflow) NewContextValue(name string) workflow.ContextMarshaler {
+	return nil
+}
+
+// randomPIN generates a random numeric PIN.
+func randomPIN() (string, error) {
+	digits := make([]byte, PINLength)
+	for i := range digits {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits[i] = byte('0' + n.Int64())
+	}
+	return string(digits), nil
+}
+
+// intelMac reports whether inventory values v are of an Intel Mac.
+// Only Macs report whether they are Apple silicon.
+func intelMac(v storage.Values) bool {
+	appleSilicon, ok := v[storage.KeyAppleSilicon].(bool)
+	return ok && !appleSilicon
+}
+
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	inv, err := w.store.RetrieveInventory(ctx, &storage.SearchOptions{IDs: step.IDs})
+	if err != nil {
+		return fmt.Errorf("retrieving inventory: %w", err)
+	}
+
+	for _, id := range step.IDs {
+		cmd := mdmcommands.NewEraseDeviceCommand(w.ider.ID())
+		values := storage.Values{
+			KeySent:               w.clock.Now(),
+			storage.KeyLastSource: WorkflowName,
+		}
+
+		if intelMac(inv[id]) {
+			pin, err := randomPIN()
+			if err != nil {
+				return fmt.Errorf("generating pin for %s: %w", id, err)
+			}
+			cmd.Command.PIN = &pin
+			values[KeyPIN] = pin
+		}
+
+		// escrow the PIN before the device can be erased with it
+		if err = w.store.StoreInventoryValues(ctx, id, values); err != nil {
+			return fmt.Errorf("store inventory values for %s: %w", id, err)
+		}
+
+		se := step.NewStepEnqueueing()
+		se.IDs = []string{id} // scope to just this ID we're iterating over
+		se.Commands = []interface{}{cmd}
+
+		if err = w.enq.EnqueueStep(ctx, w, se); err != nil {
+			return fmt.Errorf("enqueueing step for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if len(stepResult.CommandResults) != 1 {
+		return workflow.ErrStepResultCommandLenMismatch
+	}
+	genResper, ok := stepResult.CommandResults[0].(mdmcommands.GenericResponser)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	response := genResper.GetGenericResponse()
+	validErr := response.Validate()
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "erase received",
+		"status", response.Status,
+	)
+
+	err := w.store.StoreInventoryValues(ctx, stepResult.ID, storage.Values{
+		KeyReceived:           w.clock.Now(),
+		KeyStatus:             response.Status,
+		storage.KeyLastSource: WorkflowName,
+	})
+	if err != nil {
+		return fmt.Errorf("update inventory values for %s: %w", stepResult.ID, err)
+	}
+
+	if w.sink != nil {
+		ev := event.New(w.clock, event.TypeEraseCompleted, stepResult.ID)
+		ev.Fields["status"] = response.Status
+		ev.Fields["command_uuid"] = response.CommandUUID
+		if validErr != nil {
+			ev.Fields["error"] = validErr.Error()
+		}
+		if err = w.sink.Send(ctx, ev); err != nil {
+			ctxlog.Logger(ctx, w.logger).Info(
+				logkeys.InstanceID, stepResult.InstanceID,
+				logkeys.Message, "sending event",
+				logkeys.Error, err,
+			)
+		}
+	}
+
+	if validErr != nil {
+		return fmt.Errorf("validating erase response: %w", validErr)
+	}
+	return nil
+}
+
+func (w *Workflow) StepTimeout(_ context.Context, _ *workflow.StepResult) error {
+	return workflow.ErrTimeoutNotUsed
+}
+
+func (w *Workflow) Event(_ context.Context, _ *workflow.Event, _ string, _ *workflow.MDMContext) error {
+	return workflow.ErrEventsNotSupported
+}
@@ -0,0 +1,80 @@
+package erase
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+// inventory is an in-memory inventory store.
+type inventory map[string]storage.Values
+
+func (inv inventory) RetrieveInventory(_ context.Context, opt *storage.SearchOptions) (map[string]storage.Values, error) {
+	ret := make(map[string]storage.Values)
+	for _, id := range opt.IDs {
+		if v, ok := inv[id]; ok {
+			ret[id] = v
+		}
+	}
+	return ret, nil
+}
+
+func (inv inventory) StoreInventoryValues(_ context.Context, id string, values storage.Values) error {
+	if inv[id] == nil {
+		inv[id] = make(storage.Values)
+	}
+	for k, v := range values {
+		inv[id][k] = v
+	}
+	return nil
+}
+
+func (inv inventory) DeleteInventory(_ context.Context, id string) error {
+	delete(inv, id)
+	return nil
+}
+
+type enqueuer struct{ steps []*workflow.StepEnqueueing }
+
+func (e *enqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	inv := inventory{
+		"intel":   {storage.KeyAppleSilicon: false},
+		"silicon": {storage.KeyAppleSilicon: true},
+	}
+	enq := new(enqueuer)
+	w, err := New(enq, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Start(context.Background(), &workflow.StepStart{IDs: []string{"intel", "silicon", "iphone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enq.steps) != 3 {
+		t.Fatalf("have: %d steps, want: 3", len(enq.steps))
+	}
+
+	for i, id := range []string{"intel", "silicon", "iphone"} {
+		cmd, ok := enq.steps[i].Commands[0].(*mdmcommands.EraseDeviceCommand)
+		if !ok {
+			t.Fatalf("%s: incorrect command type", id)
+		}
+		pin, _ := inv[id][KeyPIN].(string)
+		if id == "intel" {
+			if len(pin) != PINLength || cmd.Command.PIN == nil || *cmd.Command.PIN != pin {
+				t.Errorf("%s: pin not escrowed: %q", id, pin)
+			}
+		} else if cmd.Command.PIN != nil || pin != "" {
+			t.Errorf("%s: unexpected pin", id)
+		}
+	}
+}
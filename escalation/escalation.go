@@ -0,0 +1,317 @@
+// Package escalation escalates the NanoCMD worker's APNs re-pushes to
+// enrollments that don't respond: from pushing, to pushing immediately
+// with a separate pusher, to alerting, to marking them unresponsive.
+package escalation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Escalation stages.
+const (
+	StagePush         = "push"
+	StagePriority     = "priority"
+	StageAlert        = "alert"
+	StageUnresponsive = "unresponsive"
+)
+
+// State is the escalation state of an enrollment that is being re-pushed.
+type State struct {
+	ID        string    `json:"id"`
+	Stage     string    `json:"stage"`
+	Since     time.Time `json:"since"` // time of the first re-push
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store stores escalation states.
+type Store interface {
+	StoreState(ctx context.Context, s *State) error
+
+	// RetrieveState retrieves the state of id.
+	// A nil state is returned if id is not being escalated.
+	RetrieveState(ctx context.Context, id string) (*State, error)
+
+	DeleteState(ctx context.Context, id string) error
+
+	// RetrieveStates retrieves all states.
+	RetrieveStates(ctx context.Context) ([]*State, error)
+}
+
+// Ladder configures how long after the first re-push each stage begins.
+// A zero duration disables the stage.
+type Ladder struct {
+	Priority     time.Duration
+	Alert        time.Duration
+	Unresponsive time.Duration
+}
+
+// ParseLadder parses a ladder in the form "priority=1h,alert=6h,unresponsive=72h".
+func ParseLadder(s string) (*Ladder, error) {
+	l := new(Ladder)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid stage: %s", kv)
+		}
+		d, err := time.ParseDuration(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %w", kv[:i], err)
+		}
+		switch kv[:i] {
+		case StagePriority:
+			l.Priority = d
+		case StageAlert:
+			l.Alert = d
+		case StageUnresponsive:
+			l.Unresponsive = d
+		default:
+			return nil, fmt.Errorf("unknown stage: %s", kv[:i])
+		}
+	}
+	return l, nil
+}
+
+// stage returns the stage for an enrollment first re-pushed elapsed ago.
+func (l *Ladder) stage(elapsed time.Duration) string {
+	switch {
+	case l.Unresponsive > 0 && elapsed >= l.Unresponsive:
+		return StageUnresponsive
+	case l.Alert > 0 && elapsed >= l.Alert:
+		return StageAlert
+	case l.Priority > 0 && elapsed >= l.Priority:
+		return StagePriority
+	default:
+		return StagePush
+	}
+}
+
+// PushEnqueuer enqueues commands and sends pushes.
+// It is the interface the NanoCMD worker uses to re-push enrollments.
+type PushEnqueuer interface {
+	Enqueue(ctx context.Context, ids []string, rawCmd []byte) error
+	SupportsMultiCommands() bool
+	Push(ctx context.Context, ids []string) error
+}
+
+// Escalator escalates re-pushes to unresponsive enrollments.
+// It is also a NanoMDM service that resets the escalation of
+// enrollments once they contact the MDM server.
+type Escalator struct {
+	service.CheckinAndCommandService
+
+	store    Store
+	ladder   Ladder
+	priority push.Pusher
+	sink     event.Sink
+	logger   log.Logger
+	clock    clock.Clock
+}
+
+// Option configures the escalator.
+type Option func(*Escalator)
+
+// WithLogger configures a logger for the escalator.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(e *Escalator) {
+		e.logger = logger
+	}
+}
+
+// WithClock configures the clock of the escalator.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(e *Escalator) {
+		e.clock = c
+	}
+}
+
+// WithPriorityPusher configures the pusher for the priority stage.
+// This is typically the APNs pusher itself so that priority pushes are
+// sent immediately, bypassing any push batching. Without a priority
+// pusher the priority stage pushes as normal.
+func WithPriorityPusher(p push.Pusher) Option {
+	return func(e *Escalator) {
+		e.priority = p
+	}
+}
+
+// WithSink configures an event sink for alerts and unresponsive enrollments.
+func WithSink(sink event.Sink) Option {
+	return func(e *Escalator) {
+		e.sink = sink
+	}
+}
+
+// New creates a new escalator.
+func New(store Store, ladder Ladder, opts ...Option) *Escalator {
+	if store == nil {
+		panic("nil store")
+	}
+	e := &Escalator{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		ladder:                   ladder,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Wrap returns a push enqueuer whose pushes are escalated.
+// Enqueues are passed to next unchanged.
+func (e *Escalator) Wrap(next PushEnqueuer) PushEnqueuer {
+	if next == nil {
+		panic("nil push enqueuer")
+	}
+	return &escalatingPushEnqueuer{PushEnqueuer: next, e: e}
+}
+
+type escalatingPushEnqueuer struct {
+	PushEnqueuer
+	e *Escalator
+}
+
+// Push escalates (re-)pushes to ids.
+func (p *escalatingPushEnqueuer) Push(ctx context.Context, ids []string) error {
+	return p.e.push(ctx, p.PushEnqueuer, ids)
+}
+
+// push advances the escalation of ids and pushes according to their stage.
+func (e *Escalator) push(ctx context.Context, next PushEnqueuer, ids []string) error {
+	logger := ctxlog.Logger(ctx, e.logger)
+	now := e.clock.Now()
+	var normal, priority []string
+	for _, id := range ids {
+		state, err := e.store.RetrieveState(ctx, id)
+		if err != nil {
+			return fmt.Errorf("retrieving state for %s: %w", id, err)
+		}
+		if state == nil {
+			state = &State{ID: id, Stage: StagePush, Since: now}
+		}
+		if state.Stage == StageUnresponsive {
+			// don't push to unresponsive enrollments
+			continue
+		}
+		stage := e.ladder.stage(now.Sub(state.Since))
+		if stage != state.Stage || state.UpdatedAt.IsZero() {
+			if stage != state.Stage {
+				logger.Info("msg", "escalated re-push", "id", id, "stage", stage, "since", state.Since)
+				e.send(ctx, id, stage, state.Since)
+			}
+			state.Stage = stage
+			state.UpdatedAt = now
+			if err = e.store.StoreState(ctx, state); err != nil {
+				return fmt.Errorf("storing state for %s: %w", id, err)
+			}
+		}
+		switch stage {
+		case StagePush:
+			normal = append(normal, id)
+		case StagePriority, StageAlert:
+			priority = append(priority, id)
+		}
+	}
+	if len(priority) > 0 && e.priority != nil {
+		if _, err := e.priority.Push(ctx, priority); err != nil {
+			return fmt.Errorf("priority push: %w", err)
+		}
+	} else {
+		normal = append(normal, priority...)
+	}
+	if len(normal) < 1 {
+		return nil
+	}
+	return next.Push(ctx, normal)
+}
+
+// send sends an event for an escalated stage.
+func (e *Escalator) send(ctx context.Context, id, stage string, since time.Time) {
+	var eventType string
+	switch stage {
+	case StageAlert:
+		eventType = event.TypeRePushAlert
+	case StageUnresponsive:
+		eventType = event.TypeUnresponsive
+	default:
+		return
+	}
+	if e.sink == nil {
+		return
+	}
+	ev := event.New(e.clock, eventType, id)
+	ev.Timestamp = e.clock.Now()
+	ev.Fields["since"] = since.Format(time.RFC3339)
+	if err := e.sink.Send(ctx, ev); err != nil {
+		ctxlog.Logger(ctx, e.logger).Info("msg", "sending event", "type", eventType, "err", err)
+	}
+}
+
+// Reset clears the escalation of id.
+func (e *Escalator) Reset(ctx context.Context, id string) error {
+	return e.store.DeleteState(ctx, id)
+}
+
+// States returns the enrollments being escalated sorted by ID.
+func (e *Escalator) States(ctx context.Context) ([]*State, error) {
+	states, err := e.store.RetrieveStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states, nil
+}
+
+// reset clears the escalation of the enrollment of r, if any.
+func (e *Escalator) reset(r *mdm.Request) error {
+	if r.ID == "" {
+		return nil
+	}
+	state, err := e.store.RetrieveState(r.Context(), r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving state: %w", err)
+	}
+	if state == nil {
+		return nil
+	}
+	if err = e.store.DeleteState(r.Context(), r.ID); err != nil {
+		return fmt.Errorf("deleting state: %w", err)
+	}
+	ctxlog.Logger(r.Context(), e.logger).Info("msg", "enrollment responded", "id", r.ID, "stage", state.Stage)
+	return nil
+}
+
+// TokenUpdate resets the escalation of the enrollment.
+func (e *Escalator) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	return e.reset(r)
+}
+
+// CommandAndReportResults resets the escalation of the enrollment.
+func (e *Escalator) CommandAndReportResults(r *mdm.Request, _ *mdm.CommandResults) (*mdm.Command, error) {
+	return nil, e.reset(r)
+}
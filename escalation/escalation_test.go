@@ -0,0 +1,102 @@
+package escalation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+)
+
+type pushEnqueuer struct {
+	pushed []string
+}
+
+func (p *pushEnqueuer) Enqueue(context.Context, []string, []byte) error { return nil }
+
+func (p *pushEnqueuer) SupportsMultiCommands() bool { return true }
+
+func (p *pushEnqueuer) Push(_ context.Context, ids []string) error {
+	p.pushed = append(p.pushed, ids...)
+	return nil
+}
+
+type pusher struct {
+	pushed []string
+}
+
+func (p *pusher) Push(_ context.Context, ids []string) (map[string]*push.Response, error) {
+	p.pushed = append(p.pushed, ids...)
+	return nil, nil
+}
+
+func TestEscalation(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	var events []string
+	sink := event.SinkFunc(func(_ context.Context, e *event.Event) error {
+		events = append(events, e.Type)
+		return nil
+	})
+	ladder, err := ParseLadder("priority=1h,alert=6h,unresponsive=72h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prio := new(pusher)
+	e := New(NewKVStore(kvmap.New()), *ladder, WithClock(c), WithSink(sink), WithPriorityPusher(prio))
+	next := new(pushEnqueuer)
+	enq := e.Wrap(next)
+
+	for _, test := range []struct {
+		advance time.Duration
+		normal  int
+		prio    int
+		stage   string
+	}{
+		{0, 1, 0, StagePush},
+		{2 * time.Hour, 1, 1, StagePriority},
+		{5 * time.Hour, 1, 2, StageAlert},
+		{72 * time.Hour, 1, 2, StageUnresponsive},
+		{time.Hour, 1, 2, StageUnresponsive}, // no longer pushed
+	} {
+		c.Advance(test.advance)
+		if err = enq.Push(ctx, []string{"ID1"}); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := len(next.pushed), test.normal; have != want {
+			t.Errorf("normal pushes: have: %v, want: %v", have, want)
+		}
+		if have, want := len(prio.pushed), test.prio; have != want {
+			t.Errorf("priority pushes: have: %v, want: %v", have, want)
+		}
+		state, err := e.store.RetrieveState(ctx, "ID1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := state.Stage, test.stage; have != want {
+			t.Errorf("stage: have: %v, want: %v", have, want)
+		}
+	}
+
+	if have, want := len(events), 2; have != want {
+		t.Fatalf("events: have: %v, want: %v", have, want)
+	}
+	if have, want := events[1], event.TypeUnresponsive; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// the enrollment responds
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	if _, err = e.CommandAndReportResults(r, &mdm.CommandResults{Status: "Idle"}); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := e.store.RetrieveState(ctx, "ID1"); state != nil {
+		t.Errorf("expected reset escalation: %v", state)
+	}
+}
@@ -0,0 +1,90 @@
+// Package http provides the HTTP API for re-push escalations.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/escalation"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// GetStatesHandler returns the enrollments being escalated.
+// The "stage" query parameter filters by escalation stage.
+func GetStatesHandler(e *escalation.Escalator, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil escalator")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		states, err := e.States(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving escalations", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		if stage := r.URL.Query().Get("stage"); stage != "" {
+			filtered := states[:0]
+			for _, s := range states {
+				if s.Stage == stage {
+					filtered = append(filtered, s)
+				}
+			}
+			states = filtered
+		}
+
+		httpapi.WriteJSON(w, states, logger)
+	}
+}
+
+// DeleteStateHandler resets the escalation of the enrollment ID in the URL path.
+// Unresponsive enrollments are re-pushed again.
+func DeleteStateHandler(e *escalation.Escalator, logger log.Logger) http.HandlerFunc {
+	if e == nil {
+		panic("nil escalator")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := e.Reset(r.Context(), id); err != nil {
+			logger.Info("msg", "resetting escalation", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "reset escalation", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the escalation API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, e *escalation.Escalator) {
+	mux.Handle(
+		prefix+"/escalations",
+		GetStatesHandler(e, logger.With("handler", "get-escalations")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/escalations/:id",
+		DeleteStateHandler(e, logger.With("handler", "delete-escalation")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,74 @@
+package escalation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores escalation states in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new escalation store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreState stores the escalation state of an enrollment.
+func (s *KVStore) StoreState(ctx context.Context, state *State) error {
+	if state == nil || state.ID == "" {
+		return errors.New("invalid state")
+	}
+	v, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return s.b.Set(ctx, state.ID, v)
+}
+
+// RetrieveState retrieves the escalation state of id.
+func (s *KVStore) RetrieveState(ctx context.Context, id string) (*State, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := new(State)
+	if err = json.Unmarshal(v, state); err != nil {
+		return nil, fmt.Errorf("unmarshal state: %w", err)
+	}
+	return state, nil
+}
+
+// DeleteState deletes the escalation state of id.
+func (s *KVStore) DeleteState(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
+
+// RetrieveStates retrieves all escalation states.
+func (s *KVStore) RetrieveStates(ctx context.Context) ([]*State, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*State, 0, len(keys))
+	for _, k := range keys {
+		state, err := s.RetrieveState(ctx, k)
+		if err != nil {
+			return states, fmt.Errorf("retrieving state %s: %w", k, err)
+		}
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
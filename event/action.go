@@ -0,0 +1,144 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+)
+
+// DefaultTimeout is the default time an action's HTTP request may take.
+const DefaultTimeout = 30 * time.Second
+
+// ActionConfig configures a templated HTTP action.
+// Actions are, for example, used to open tickets in external systems.
+type ActionConfig struct {
+	// Name identifies the action in logs.
+	Name string `json:"name"`
+
+	// Events is the list of event types that trigger the action.
+	// An empty list triggers on all events.
+	Events []string `json:"events"`
+
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+
+	// Body is a Go text/template rendered with the [Event].
+	// The "json" template function JSON-encodes its argument.
+	Body string `json:"body"`
+}
+
+// Action is an event sink that makes templated HTTP requests.
+type Action struct {
+	config *ActionConfig
+	body   *template.Template
+	client *http.Client
+	events map[string]struct{}
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewAction creates a new templated HTTP action from config.
+// If client is nil then an HTTP client with [DefaultTimeout] is used.
+func NewAction(config *ActionConfig, client *http.Client) (*Action, error) {
+	if config == nil {
+		return nil, errors.New("nil config")
+	}
+	if config.URL == "" {
+		return nil, fmt.Errorf("action %s: empty URL", config.Name)
+	}
+	tmpl, err := template.New(config.Name).Funcs(templateFuncs).Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("action %s: parsing body template: %w", config.Name, err)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	a := &Action{
+		config: config,
+		body:   tmpl,
+		client: client,
+		events: make(map[string]struct{}),
+	}
+	for _, t := range config.Events {
+		a.events[t] = struct{}{}
+	}
+	return a, nil
+}
+
+// Send renders the action template with e and sends the HTTP request.
+// Events not configured for this action are ignored.
+func (a *Action) Send(ctx context.Context, e *Event) error {
+	if e == nil {
+		return errors.New("nil event")
+	}
+	if len(a.events) > 0 {
+		if _, ok := a.events[e.Type]; !ok {
+			return nil
+		}
+	}
+
+	body := new(bytes.Buffer)
+	if err := a.body.Execute(body, e); err != nil {
+		return fmt.Errorf("action %s: rendering body: %w", a.config.Name, err)
+	}
+
+	method := a.config.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.config.URL, body)
+	if err != nil {
+		return fmt.Errorf("action %s: creating request: %w", a.config.Name, err)
+	}
+	for k, v := range a.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("action %s: %w", a.config.Name, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("action %s: unexpected HTTP status: %s", a.config.Name, resp.Status)
+	}
+	return nil
+}
+
+// LoadActions reads a JSON array of [ActionConfig] from path and
+// creates the actions.
+func LoadActions(path string, client *http.Client) (MultiSink, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []*ActionConfig
+	if err = json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("unmarshal actions: %w", err)
+	}
+	var sinks MultiSink
+	for _, config := range configs {
+		a, err := NewAction(config, client)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, a)
+	}
+	return sinks, nil
+}
@@ -0,0 +1,50 @@
+package event
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestAction(t *testing.T) {
+	var body, contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer srv.Close()
+
+	a, err := NewAction(&ActionConfig{
+		Name:    "test",
+		Events:  []string{TypeCheckOut},
+		URL:     srv.URL,
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"id":{{json .EnrollmentID}},"type":{{json .Type}}}`,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an event type not configured for the action is ignored
+	if err = a.Send(context.Background(), New(clock.Real, TypeAuthenticate, "AAAA")); err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		t.Error("unexpected request for unconfigured event type")
+	}
+
+	if err = a.Send(context.Background(), New(clock.Real, TypeCheckOut, "AAAA")); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := body, `{"id":"AAAA","type":"enrollment.checkout"}`; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := contentType, "application/json"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
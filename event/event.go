@@ -0,0 +1,130 @@
+// Package event dispatches NanoHUB device events to sinks.
+package event
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+// Event types generated by NanoHUB.
+const (
+	TypeAuthenticate = "enrollment.authenticate"
+	TypeTokenUpdate  = "enrollment.tokenupdate"
+	TypeCheckOut     = "enrollment.checkout"
+	TypeCommandError = "command.error"
+
+	// TypeCommandResult is sent for every command response (other than
+	// Idle) to services created with [WithCommandResults].
+	TypeCommandResult = "command.result"
+
+	// TypeCommandExpired is sent when an enqueued command was not
+	// fetched by an enrollment before its expiry.
+	TypeCommandExpired = "command.expired"
+
+	// TypeAnomalySpike and TypeAnomalyDrop are sent when the rate of
+	// a fleet-wide metric deviates from its baseline.
+	// These events have no enrollment ID.
+	TypeAnomalySpike = "anomaly.spike"
+	TypeAnomalyDrop  = "anomaly.drop"
+
+	// TypeRePushAlert is sent when an enrollment has not responded to
+	// re-pushes long enough to reach the alert escalation stage.
+	TypeRePushAlert = "push.alert"
+
+	// TypeUnresponsive is sent when an enrollment is marked unresponsive
+	// and is no longer re-pushed.
+	TypeUnresponsive = "enrollment.unresponsive"
+
+	// TypePushInvalid is sent when APNs reports the push token of an
+	// enrollment as invalid and it is no longer pushed to.
+	TypePushInvalid = "push.invalid_token"
+
+	// TypeDEPDevice is sent when a DEP sync reports an added, modified,
+	// or deleted device. These events have no enrollment ID.
+	TypeDEPDevice = "dep.device"
+
+	// TypeAttestationFailed is sent when a device attestation response
+	// fails verification.
+	TypeAttestationFailed = "attestation.failed"
+
+	// TypeBootstrapTokenEscrowed and TypeBootstrapTokenCleared are sent
+	// when the escrowed Bootstrap Token of an enrollment changes.
+	TypeBootstrapTokenEscrowed = "bootstraptoken.escrowed"
+	TypeBootstrapTokenCleared  = "bootstraptoken.cleared"
+
+	// TypeEraseCompleted is sent when an enrollment responds to the
+	// EraseDevice command of the erase workflow.
+	TypeEraseCompleted = "erase.completed"
+
+	// TypeOSUpdateProgress is sent when the progress of an OS update
+	// started by the OS update workflow changes.
+	TypeOSUpdateProgress = "osupdate.progress"
+
+	// TypeAppInstallCompleted is sent when an app installation started
+	// by the app install workflow is confirmed or fails.
+	TypeAppInstallCompleted = "appinstall.completed"
+
+	// TypeStatusTriggered is sent when a DM status trigger rule
+	// enqueues its commands.
+	TypeStatusTriggered = "statustrigger.triggered"
+
+	// TypeDMStatus is sent for DM status reports when status events
+	// are enabled.
+	TypeDMStatus = "dm.status"
+)
+
+// Event is a device event.
+type Event struct {
+	Type string `json:"type"`
+
+	// SchemaVersion is the version of the schema of the event type.
+	// See [Schemas].
+	SchemaVersion int `json:"schema_version"`
+
+	Timestamp    time.Time         `json:"timestamp"`
+	EnrollmentID string            `json:"enrollment_id,omitempty"`
+	Fields       map[string]string `json:"fields,omitempty"`
+}
+
+// New creates a new event of type for enrollment id timestamped by c.
+func New(c clock.Clock, eventType, id string) *Event {
+	return &Event{
+		Type:          eventType,
+		SchemaVersion: SchemaVersion(eventType),
+		Timestamp:     c.Now(),
+		EnrollmentID:  id,
+		Fields:        make(map[string]string),
+	}
+}
+
+// Sink receives events.
+type Sink interface {
+	Send(ctx context.Context, e *Event) error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(context.Context, *Event) error
+
+// Send calls f(ctx, e).
+func (f SinkFunc) Send(ctx context.Context, e *Event) error {
+	return f(ctx, e)
+}
+
+// MultiSink sends events to every sink.
+type MultiSink []Sink
+
+// Send sends e to every sink in m.
+// All sinks are sent the event even if one errors.
+// The first error is returned.
+func (m MultiSink) Send(ctx context.Context, e *Event) error {
+	var first error
+	for i, s := range m {
+		if err := s.Send(ctx, e); err != nil && first == nil {
+			first = fmt.Errorf("sink %d: %w", i, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,31 @@
+// Package http provides the HTTP API for event payload schemas.
+package http
+
+import (
+	"net/http"
+
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// SchemasPath is the well-known path of the event schemas.
+const SchemasPath = "/.well-known/nanohub/event-schemas"
+
+// schemas is the event schemas response.
+type schemas struct {
+	Schemas          []*event.Schema     `json:"schemas"`
+	EnrichmentFields []event.SchemaField `json:"enrichment_fields"`
+}
+
+// SchemasHandler returns the registered event schemas.
+func SchemasHandler(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpapi.WriteJSON(w, &schemas{
+			Schemas:          event.Schemas(),
+			EnrichmentFields: event.EnrichmentFields,
+		}, ctxlog.Logger(r.Context(), logger))
+	}
+}
@@ -0,0 +1,119 @@
+package event
+
+import (
+	"sort"
+	"sync"
+)
+
+// SchemaField is a field of an event schema.
+type SchemaField struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Optional fields are not included in every event.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// Schema describes the payload of an event type.
+// The version is incremented when fields are changed or removed.
+// Consumers should ignore unknown fields: added fields do not
+// increment the version.
+type Schema struct {
+	Type        string        `json:"type"`
+	Version     int           `json:"version"`
+	Description string        `json:"description,omitempty"`
+	Fields      []SchemaField `json:"fields"`
+
+	// NoEnrollment events have no enrollment ID.
+	NoEnrollment bool `json:"no_enrollment,omitempty"`
+}
+
+// EnrichmentFields are the optional fields added to the events of
+// enrollments with notes or a mapped identity.
+var EnrichmentFields = []SchemaField{
+	{Name: "owner", Description: "notes owner", Optional: true},
+	{Name: "location", Description: "notes location", Optional: true},
+	{Name: "notes", Description: "notes", Optional: true},
+	{Name: "identity_user", Description: "mapped identity user", Optional: true},
+	{Name: "identity_asset", Description: "mapped identity asset tag", Optional: true},
+	{Name: "identity_<name>", Description: "mapped identity attributes", Optional: true},
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[string]*Schema{}
+)
+
+func init() {
+	// f returns the fields of names. A "?" prefix marks optional fields.
+	f := func(names ...string) []SchemaField {
+		fields := make([]SchemaField, 0, len(names))
+		for _, name := range names {
+			optional := name[0] == '?'
+			if optional {
+				name = name[1:]
+			}
+			fields = append(fields, SchemaField{Name: name, Optional: optional})
+		}
+		return fields
+	}
+	for _, s := range []*Schema{
+		{Type: TypeAuthenticate, Description: "enrollment sent an Authenticate check-in", Fields: f("enrollment_type", "serial_number", "topic")},
+		{Type: TypeTokenUpdate, Description: "enrollment sent a TokenUpdate check-in", Fields: f("enrollment_type")},
+		{Type: TypeCheckOut, Description: "enrollment sent a CheckOut check-in", Fields: f("enrollment_type")},
+		{Type: TypeCommandError, Description: "command response with an Error status", Fields: f("command_uuid", "error_codes", "error_description")},
+		{Type: TypeCommandResult, Description: "command response (event streams only)", Fields: f("command_uuid", "status")},
+		{Type: TypeCommandExpired, Description: "enqueued command expired", Fields: f("command_uuid")},
+		{Type: TypeAnomalySpike, Description: "fleet-wide metric above its baseline", Fields: f("metric", "count", "baseline"), NoEnrollment: true},
+		{Type: TypeAnomalyDrop, Description: "fleet-wide metric below its baseline", Fields: f("metric", "count", "baseline"), NoEnrollment: true},
+		{Type: TypeRePushAlert, Description: "enrollment reached the re-push alert stage", Fields: f("since")},
+		{Type: TypeUnresponsive, Description: "enrollment marked unresponsive", Fields: f("since")},
+		{Type: TypePushInvalid, Description: "APNs reported an invalid push token", Fields: f("reason")},
+		{Type: TypeDEPDevice, Description: "DEP sync device change", Fields: f("dep_name", "serial_number", "op_type", "profile_status"), NoEnrollment: true},
+		{Type: TypeAttestationFailed, Description: "device attestation failed verification", Fields: f("command_uuid", "error")},
+		{Type: TypeBootstrapTokenEscrowed, Description: "Bootstrap Token escrowed", Fields: f()},
+		{Type: TypeBootstrapTokenCleared, Description: "Bootstrap Token cleared", Fields: f()},
+		{Type: TypeEraseCompleted, Description: "erase workflow EraseDevice response", Fields: f("status", "command_uuid", "?error")},
+		{Type: TypeOSUpdateProgress, Description: "OS update workflow progress changed", Fields: f("method", "target_os_version", "?command_status", "?install_state", "?pending_version", "?failure_reason")},
+		{Type: TypeAppInstallCompleted, Description: "app install workflow confirmed or failed", Fields: f("identifier", "state", "status")},
+		{Type: TypeStatusTriggered, Description: "DM status trigger rule enqueued commands or started a workflow", Fields: f("rule", "path", "value", "command_uuids", "?workflow", "?instance_id")},
+		{Type: TypeDMStatus, Description: "DM status report", Fields: f("?status_id", "declarations", "errors", "values")},
+	} {
+		s.Version = 1
+		RegisterSchema(s)
+	}
+}
+
+// RegisterSchema registers (or replaces) the schema of s.Type.
+// Embedders sending their own event types should register them.
+func RegisterSchema(s *Schema) {
+	if s == nil || s.Type == "" {
+		panic("invalid schema")
+	}
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemas[s.Type] = s
+}
+
+// SchemaVersion returns the schema version of eventType.
+// Zero is returned for unregistered event types.
+func SchemaVersion(eventType string) int {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	if s := schemas[eventType]; s != nil {
+		return s.Version
+	}
+	return 0
+}
+
+// Schemas returns the registered schemas ordered by type.
+func Schemas() []*Schema {
+	schemasMu.RLock()
+	ret := make([]*Schema, 0, len(schemas))
+	for _, s := range schemas {
+		ret = append(ret, s)
+	}
+	schemasMu.RUnlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Type < ret[j].Type })
+	return ret
+}
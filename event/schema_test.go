@@ -0,0 +1,20 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	if have, want := New(clock.Real, TypeCommandError, "ID1").SchemaVersion, 1; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	if have, want := New(clock.Real, "example.custom", "ID1").SchemaVersion, 0; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+	RegisterSchema(&Schema{Type: "example.custom", Version: 2})
+	if have, want := New(clock.Real, "example.custom", "ID1").SchemaVersion, 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
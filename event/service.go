@@ -0,0 +1,133 @@
+package event
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Service is a NanoMDM service that sends device events to a sink.
+type Service struct {
+	service.CheckinAndCommandService
+
+	sink    Sink
+	logger  log.Logger
+	clock   clock.Clock
+	results bool
+}
+
+// ServiceOption configures the event service.
+type ServiceOption func(*Service)
+
+// WithCommandResults sends a [TypeCommandResult] event for every
+// command response. Otherwise only command errors are sent.
+func WithCommandResults() ServiceOption {
+	return func(s *Service) {
+		s.results = true
+	}
+}
+
+// WithClock configures the clock used for event timestamps.
+func WithClock(c clock.Clock) ServiceOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// NewService creates a new event service that sends events to sink.
+func NewService(sink Sink, logger log.Logger, opts ...ServiceOption) *Service {
+	if sink == nil {
+		panic("nil sink")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+
+	s := &Service{
+		CheckinAndCommandService: new(service.NopService),
+		sink:                     sink,
+		logger:                   logger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// send sends e to the sink and logs any error.
+// Event delivery errors are not returned to the MDM client.
+func (s *Service) send(r *mdm.Request, e *Event) {
+	if err := s.sink.Send(r.Context(), e); err != nil {
+		ctxlog.Logger(r.Context(), s.logger).Info(
+			"msg", "sending event",
+			"type", e.Type,
+			"err", err,
+		)
+	}
+}
+
+// newEnrollmentEvent creates a new event of type t that includes the
+// enrollment type of r.
+func (s *Service) newEnrollmentEvent(t string, r *mdm.Request) *Event {
+	e := New(s.clock, t, r.ID)
+	if r.EnrollID != nil && r.Type.Valid() {
+		e.Fields["enrollment_type"] = r.Type.String()
+	}
+	return e
+}
+
+// Authenticate sends an Authenticate event.
+func (s *Service) Authenticate(r *mdm.Request, m *mdm.Authenticate) error {
+	e := s.newEnrollmentEvent(TypeAuthenticate, r)
+	e.Fields["serial_number"] = m.SerialNumber
+	e.Fields["topic"] = m.Topic
+	s.send(r, e)
+	return nil
+}
+
+// TokenUpdate sends a TokenUpdate event.
+func (s *Service) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	s.send(r, s.newEnrollmentEvent(TypeTokenUpdate, r))
+	return nil
+}
+
+// CheckOut sends a CheckOut event.
+func (s *Service) CheckOut(r *mdm.Request, _ *mdm.CheckOut) error {
+	s.send(r, s.newEnrollmentEvent(TypeCheckOut, r))
+	return nil
+}
+
+// CommandAndReportResults sends an event for command errors.
+// With [WithCommandResults] an event is also sent for every response.
+func (s *Service) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if s.results && results.Status != "Idle" {
+		e := New(s.clock, TypeCommandResult, r.ID)
+		e.Fields["command_uuid"] = results.CommandUUID
+		e.Fields["status"] = results.Status
+		s.send(r, e)
+	}
+	if results.Status != "Error" {
+		return nil, nil
+	}
+	e := New(s.clock, TypeCommandError, r.ID)
+	e.Fields["command_uuid"] = results.CommandUUID
+	var codes, descs []string
+	for _, ec := range results.ErrorChain {
+		codes = append(codes, ec.ErrorDomain+":"+strconv.Itoa(ec.ErrorCode))
+		descs = append(descs, ec.USEnglishDescription)
+	}
+	e.Fields["error_codes"] = strings.Join(codes, ",")
+	e.Fields["error_description"] = strings.Join(descs, "; ")
+	s.send(r, e)
+	return nil, nil
+}
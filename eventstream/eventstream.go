@@ -0,0 +1,153 @@
+// Package eventstream fans out live device events to connected clients.
+package eventstream
+
+import (
+	"context"
+	"sync"
+
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// DefaultBuffer is the default number of events buffered per subscriber.
+const DefaultBuffer = 64
+
+// Filter selects the events of a subscription.
+type Filter struct {
+	// Types are the event types to receive. Empty receives all types.
+	Types []string
+
+	// IDs are the enrollment IDs to receive events of.
+	// Empty receives the events of all enrollments.
+	IDs []string
+}
+
+// subscriber is a subscription to the broker.
+type subscriber struct {
+	events chan *event.Event
+	types  map[string]struct{}
+	ids    map[string]struct{}
+}
+
+// set returns s as a set or nil if s is empty.
+func set(s []string) map[string]struct{} {
+	if len(s) < 1 {
+		return nil
+	}
+	ret := make(map[string]struct{}, len(s))
+	for _, v := range s {
+		ret[v] = struct{}{}
+	}
+	return ret
+}
+
+// match reports whether e matches the subscriber filter.
+func (s *subscriber) match(e *event.Event) bool {
+	if s.types != nil {
+		if _, ok := s.types[e.Type]; !ok {
+			return false
+		}
+	}
+	if s.ids != nil {
+		if _, ok := s.ids[e.EnrollmentID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Broker sends events to subscribers.
+// It is an event sink.
+type Broker struct {
+	buffer int
+	logger log.Logger
+
+	mu   sync.RWMutex
+	subs map[*subscriber]struct{}
+}
+
+// Option configures the broker.
+type Option func(*Broker)
+
+// WithBuffer configures the number of events buffered per subscriber.
+// Events are dropped for subscribers with full buffers.
+func WithBuffer(n int) Option {
+	return func(b *Broker) {
+		if n > 0 {
+			b.buffer = n
+		}
+	}
+}
+
+// WithLogger configures a logger for the broker.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(b *Broker) {
+		b.logger = logger
+	}
+}
+
+// New creates a new broker.
+func New(opts ...Option) *Broker {
+	b := &Broker{
+		buffer: DefaultBuffer,
+		logger: log.NopLogger,
+		subs:   make(map[*subscriber]struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Send sends e to the matching subscribers without blocking.
+// Events are dropped for subscribers that can't keep up.
+func (b *Broker) Send(_ context.Context, e *event.Event) error {
+	if e == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			b.logger.Debug("msg", "dropped event for slow subscriber", "type", e.Type)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the events matching f.
+// The returned function unsubscribes and must be called when done.
+func (b *Broker) Subscribe(f Filter) (<-chan *event.Event, func()) {
+	s := &subscriber{
+		events: make(chan *event.Event, b.buffer),
+		types:  set(f.Types),
+		ids:    set(f.IDs),
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Subscribers returns the number of subscribers.
+func (b *Broker) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
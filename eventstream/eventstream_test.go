@@ -0,0 +1,43 @@
+package eventstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+)
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	b := New(WithBuffer(1))
+
+	all, unsubAll := b.Subscribe(Filter{})
+	defer unsubAll()
+	filtered, unsubFiltered := b.Subscribe(Filter{Types: []string{event.TypeCheckOut}, IDs: []string{"ID1"}})
+	if have, want := b.Subscribers(), 2; have != want {
+		t.Errorf("subscribers: have: %v, want: %v", have, want)
+	}
+
+	b.Send(ctx, event.New(clock.Real, event.TypeCheckOut, "ID2"))
+	// dropped for the full buffer of the unfiltered subscriber
+	b.Send(ctx, event.New(clock.Real, event.TypeCheckOut, "ID1"))
+
+	if e := <-all; e.EnrollmentID != "ID2" {
+		t.Errorf("have: %v, want: ID2", e.EnrollmentID)
+	}
+	select {
+	case e := <-all:
+		t.Errorf("unexpected event: %v", e)
+	default:
+	}
+	if e := <-filtered; e.EnrollmentID != "ID1" {
+		t.Errorf("have: %v, want: ID1", e.EnrollmentID)
+	}
+
+	unsubFiltered()
+	unsubFiltered()
+	if have, want := b.Subscribers(), 1; have != want {
+		t.Errorf("subscribers: have: %v, want: %v", have, want)
+	}
+}
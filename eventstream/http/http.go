@@ -0,0 +1,105 @@
+// Package http provides the server-sent events HTTP API for live device events.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/eventstream"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultHeartbeat is the default interval of keep-alive comments.
+const DefaultHeartbeat = 30 * time.Second
+
+// ErrStreamingUnsupported is returned when the response can't be flushed.
+var ErrStreamingUnsupported = errors.New("streaming unsupported")
+
+// split splits comma-separated and repeated query values.
+func split(values []string) (ret []string) {
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return
+}
+
+// StreamHandler streams the events of b as server-sent events.
+// The "type" and "id" query parameters filter the event types and
+// enrollment IDs. A comment is sent every heartbeat to keep idle
+// connections open.
+func StreamHandler(b *eventstream.Broker, heartbeat time.Duration, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil broker")
+	}
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			httpapi.JSONError(w, ErrStreamingUnsupported, 0)
+			return
+		}
+
+		events, unsubscribe := b.Subscribe(eventstream.Filter{
+			Types: split(r.URL.Query()["type"]),
+			IDs:   split(r.URL.Query()["id"]),
+		})
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		logger.Debug("msg", "event stream connected", "subscribers", b.Subscribers())
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case e := <-events:
+				var data []byte
+				if data, err = json.Marshal(e); err != nil {
+					logger.Info("msg", "marshal event", "type", e.Type, "err", err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			case <-ticker.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			case <-r.Context().Done():
+				logger.Debug("msg", "event stream disconnected")
+				return
+			}
+			if err != nil {
+				logger.Debug("msg", "writing event stream", "err", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// HandleAPIv1 registers the event stream API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, b *eventstream.Broker) {
+	mux.Handle(
+		prefix+"/events/stream",
+		StreamHandler(b, DefaultHeartbeat, logger.With("handler", "event-stream")),
+		"GET",
+	)
+}
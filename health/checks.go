@@ -0,0 +1,85 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+// DBChecker checks database connectivity by pinging db.
+func DBChecker(db *sql.DB) Checker {
+	if db == nil {
+		panic("nil db")
+	}
+	return CheckerFunc(func(ctx context.Context) error {
+		if err := db.PingContext(ctx); err != nil {
+			return fmt.Errorf("pinging database: %w", err)
+		}
+		return nil
+	})
+}
+
+// DirChecker checks that dir is writable by creating and removing a
+// temporary file in it.
+func DirChecker(dir string) Checker {
+	return CheckerFunc(func(_ context.Context) error {
+		f, err := os.CreateTemp(dir, ".health-*")
+		if err != nil {
+			return fmt.Errorf("writing to directory: %w", err)
+		}
+		f.Close()
+		if err = os.Remove(f.Name()); err != nil {
+			return fmt.Errorf("removing from directory: %w", err)
+		}
+		return nil
+	})
+}
+
+// Heartbeat checks the liveness of a periodic process.
+// It is unhealthy if the process hasn't beat within the maximum age.
+type Heartbeat struct {
+	clock  clock.Clock
+	maxAge time.Duration
+
+	mu   sync.RWMutex
+	last time.Time
+}
+
+// NewHeartbeat creates a new heartbeat with a maximum age of maxAge.
+// The creation counts as the first beat.
+func NewHeartbeat(maxAge time.Duration, clk clock.Clock) *Heartbeat {
+	if clk == nil {
+		clk = clock.Real
+	}
+	return &Heartbeat{clock: clk, maxAge: maxAge, last: clk.Now()}
+}
+
+// Beat records that the process is alive.
+func (h *Heartbeat) Beat() {
+	now := h.clock.Now()
+	h.mu.Lock()
+	h.last = now
+	h.mu.Unlock()
+}
+
+// Last returns the time of the last beat.
+func (h *Heartbeat) Last() time.Time {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.last
+}
+
+// CheckHealth reports an error if the last beat is older than the
+// maximum age.
+func (h *Heartbeat) CheckHealth(_ context.Context) error {
+	last := h.Last()
+	if age := h.clock.Now().Sub(last); age > h.maxAge {
+		return fmt.Errorf("no heartbeat since %s (%s ago)", last.Format(time.RFC3339), age.Truncate(time.Second))
+	}
+	return nil
+}
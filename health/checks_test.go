@@ -0,0 +1,35 @@
+package health
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestHeartbeat(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	hb := NewHeartbeat(time.Minute, clk)
+	checks := Checks{"worker": hb, "dir": DirChecker(t.TempDir())}
+
+	if report := checks.Check(context.Background()); !report.Healthy {
+		t.Errorf("expected healthy: %+v", report.Checks[1])
+	}
+
+	clk.Advance(2 * time.Minute)
+	report := checks.Check(context.Background())
+	if report.Healthy || report.Checks[1].Name != "worker" || report.Checks[1].Healthy {
+		t.Errorf("expected unhealthy worker: %+v", report.Checks[1])
+	}
+
+	hb.Beat()
+	if err := hb.CheckHealth(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if err := DirChecker(filepath.Join(t.TempDir(), "missing")).CheckHealth(context.Background()); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
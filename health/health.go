@@ -0,0 +1,54 @@
+// Package health reports the health of NanoHUB components for
+// readiness and liveness probes.
+package health
+
+import (
+	"context"
+	"sort"
+)
+
+// Checker reports the health of a component.
+// A nil error is healthy.
+type Checker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker.
+type CheckerFunc func(context.Context) error
+
+// CheckHealth calls f(ctx).
+func (f CheckerFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Result is the result of a named health check.
+type Result struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Report is the result of all health checks.
+type Report struct {
+	Healthy bool      `json:"healthy"`
+	Checks  []*Result `json:"checks"`
+}
+
+// Checks are named health checks.
+type Checks map[string]Checker
+
+// Check runs all checks. The report is healthy if every check is.
+func (c Checks) Check(ctx context.Context) *Report {
+	report := &Report{Healthy: true, Checks: make([]*Result, 0, len(c))}
+	for name, checker := range c {
+		r := &Result{Name: name, Healthy: true}
+		if err := checker.CheckHealth(ctx); err != nil {
+			r.Healthy = false
+			r.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, r)
+	}
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	return report
+}
@@ -0,0 +1,44 @@
+// Package http provides the HTTP health endpoint.
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/health"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Paths of the health endpoints.
+const (
+	HealthPath    = "/health"
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Timeout limits the time of all checks of a request.
+const Timeout = 5 * time.Second
+
+// Handler runs checks and returns the health report.
+// The status is 503 Service Unavailable if any check is unhealthy.
+func Handler(checks health.Checks, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+		defer cancel()
+
+		report := checks.Check(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			logger.Info("msg", "encoding health report", "err", err)
+		}
+	}
+}
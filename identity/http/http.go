@@ -0,0 +1,61 @@
+// Package http provides the HTTP API for enrollment identities.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/identity"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when an enrollment has no identity.
+	ErrNotFound = errors.New("no identity")
+)
+
+// GetIdentityHandler returns the identity of the enrollment ID in the URL path.
+func GetIdentityHandler(store identity.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		i, err := identity.Lookup(r.Context(), store, id)
+		if err != nil {
+			logger.Info("msg", "retrieving identity", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if i == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, i, logger)
+	}
+}
+
+// HandleAPIv1 registers the identity API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store identity.Store) {
+	mux.Handle(
+		prefix+"/enrollments/:id/identity",
+		GetIdentityHandler(store, logger.With("handler", "get-identity")),
+		"GET",
+	)
+}
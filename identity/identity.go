@@ -0,0 +1,386 @@
+// Package identity maps the MDM identity certificates of enrollments to
+// user and asset records. This is useful where identity certificates
+// encode the identity of the user (e.g. an email SAN) or the asset
+// (e.g. a subject serial number).
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Certificate fields available to the field mapper.
+const (
+	FieldSubjectCN           = "subject.cn"
+	FieldSubjectO            = "subject.o"
+	FieldSubjectOU           = "subject.ou"
+	FieldSubjectSerialNumber = "subject.serialnumber"
+	FieldSubjectUID          = "subject.uid"
+	FieldSANEmail            = "san.email"
+	FieldSANDNS              = "san.dns"
+	FieldSANURI              = "san.uri"
+)
+
+// Identity record names with dedicated fields.
+const (
+	NameUser  = "user"
+	NameAsset = "asset"
+)
+
+// oidUID is the LDAP userid attribute of certificate subjects.
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// Identity is the user and asset record of an enrollment.
+type Identity struct {
+	ID    string `json:"id"`
+	User  string `json:"user,omitempty"`
+	Asset string `json:"asset,omitempty"`
+
+	// Attributes are any additional mapped values by name.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Subject is the subject of the mapped certificate.
+	Subject   string    `json:"subject"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// equal reports whether i and o have the same mapped values.
+func (i *Identity) equal(o *Identity) bool {
+	return i.User == o.User && i.Asset == o.Asset && i.Subject == o.Subject &&
+		(len(i.Attributes) == 0 && len(o.Attributes) == 0 || reflect.DeepEqual(i.Attributes, o.Attributes))
+}
+
+// Fields returns the non-empty values of i by name.
+// Attributes are included by their names.
+func (i *Identity) Fields() map[string]string {
+	fields := make(map[string]string, len(i.Attributes)+2)
+	for k, v := range i.Attributes {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	if i.User != "" {
+		fields[NameUser] = i.User
+	}
+	if i.Asset != "" {
+		fields[NameAsset] = i.Asset
+	}
+	return fields
+}
+
+// Mapper maps identity certificates to identities.
+// Nil is returned if cert does not map to an identity.
+type Mapper interface {
+	Map(ctx context.Context, cert *x509.Certificate) (*Identity, error)
+}
+
+// MapperFunc adapts a function to a Mapper.
+type MapperFunc func(ctx context.Context, cert *x509.Certificate) (*Identity, error)
+
+// Map calls f(ctx, cert).
+func (f MapperFunc) Map(ctx context.Context, cert *x509.Certificate) (*Identity, error) {
+	return f(ctx, cert)
+}
+
+// FieldMapper maps identity record names to certificate fields.
+type FieldMapper map[string]string
+
+// ParseFieldMapper parses a field mapper in the form
+// "user=san.email,asset=subject.serialnumber". Names other than "user"
+// and "asset" are mapped to identity attributes.
+func ParseFieldMapper(s string) (FieldMapper, error) {
+	m := make(FieldMapper)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, field, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid mapping: %s", kv)
+		}
+		field = strings.ToLower(field)
+		if _, err := certField(&x509.Certificate{}, field); err != nil {
+			return nil, err
+		}
+		m[name] = field
+	}
+	if len(m) < 1 {
+		return nil, errors.New("no mappings")
+	}
+	return m, nil
+}
+
+// first returns the first of values or an empty string.
+func first(values []string) string {
+	if len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// certField returns the value of field in cert.
+func certField(cert *x509.Certificate, field string) (string, error) {
+	switch field {
+	case FieldSubjectCN:
+		return cert.Subject.CommonName, nil
+	case FieldSubjectO:
+		return first(cert.Subject.Organization), nil
+	case FieldSubjectOU:
+		return first(cert.Subject.OrganizationalUnit), nil
+	case FieldSubjectSerialNumber:
+		return cert.Subject.SerialNumber, nil
+	case FieldSubjectUID:
+		for _, atv := range cert.Subject.Names {
+			if atv.Type.Equal(oidUID) {
+				s, _ := atv.Value.(string)
+				return s, nil
+			}
+		}
+		return "", nil
+	case FieldSANEmail:
+		return first(cert.EmailAddresses), nil
+	case FieldSANDNS:
+		return first(cert.DNSNames), nil
+	case FieldSANURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown certificate field: %s", field)
+}
+
+// Map maps the fields of cert to an identity.
+// Nil is returned if no field has a value.
+func (m FieldMapper) Map(_ context.Context, cert *x509.Certificate) (*Identity, error) {
+	i := &Identity{Subject: cert.Subject.String()}
+	var found bool
+	for name, field := range m {
+		v, err := certField(cert, field)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" {
+			continue
+		}
+		found = true
+		switch name {
+		case NameUser:
+			i.User = v
+		case NameAsset:
+			i.Asset = v
+		default:
+			if i.Attributes == nil {
+				i.Attributes = make(map[string]string)
+			}
+			i.Attributes[name] = v
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return i, nil
+}
+
+// Store stores enrollment identities.
+type Store interface {
+	StoreIdentity(ctx context.Context, i *Identity) error
+
+	// RetrieveIdentity retrieves the identity of id.
+	// Nil is returned if id has no identity.
+	RetrieveIdentity(ctx context.Context, id string) (*Identity, error)
+}
+
+// deviceID returns the device channel ID of an enrollment ID.
+// User channel enrollments share the identity certificate of their device.
+func deviceID(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// Lookup retrieves the identity of id from store.
+// User channel IDs without an identity use the identity of their device.
+func Lookup(ctx context.Context, store Store, id string) (*Identity, error) {
+	i, err := store.RetrieveIdentity(ctx, id)
+	if err != nil || i != nil || deviceID(id) == id {
+		return i, err
+	}
+	return store.RetrieveIdentity(ctx, deviceID(id))
+}
+
+// InventoryStore stores inventory values.
+// See the NanoCMD inventory subsystem.
+type InventoryStore interface {
+	StoreInventoryValues(ctx context.Context, id string, values storage.Values) error
+}
+
+// Service is a NanoMDM service that maps the identity certificate of
+// enrollments to identities at check-in.
+type Service struct {
+	service.CheckinAndCommandService
+
+	store     Store
+	mapper    Mapper
+	inventory InventoryStore
+	logger    log.Logger
+	clock     clock.Clock
+}
+
+// Option configures the service.
+type Option func(*Service)
+
+// WithInventory stores mapped identities in the inventory as
+// "identity_"-prefixed values (e.g. "identity_user") for workflows.
+func WithInventory(inv InventoryStore) Option {
+	return func(s *Service) {
+		s.inventory = inv
+	}
+}
+
+// WithLogger configures a logger for the service.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the service.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// NewService creates a new identity mapping service.
+func NewService(store Store, mapper Mapper, opts ...Option) *Service {
+	if store == nil {
+		panic("nil store")
+	}
+	if mapper == nil {
+		panic("nil mapper")
+	}
+	s := &Service{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		mapper:                   mapper,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// update maps the identity certificate of the request.
+// The identity is only stored if it changed.
+func (s *Service) update(r *mdm.Request) error {
+	if r.ID == "" || r.Certificate == nil {
+		return nil
+	}
+	ctx := r.Context()
+	i, err := s.mapper.Map(ctx, r.Certificate)
+	if err != nil {
+		return fmt.Errorf("mapping identity: %w", err)
+	}
+	if i == nil {
+		return nil
+	}
+	i.ID = r.ID
+	prev, err := s.store.RetrieveIdentity(ctx, r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving identity: %w", err)
+	}
+	if prev != nil && prev.equal(i) {
+		return nil
+	}
+	i.UpdatedAt = s.clock.Now()
+	if err = s.store.StoreIdentity(ctx, i); err != nil {
+		return fmt.Errorf("storing identity: %w", err)
+	}
+	logger := ctxlog.Logger(ctx, s.logger)
+	logger.Debug("msg", "mapped identity", "id", r.ID, "user", i.User, "asset", i.Asset)
+
+	if s.inventory != nil {
+		values := make(storage.Values)
+		for k, v := range i.Fields() {
+			values["identity_"+k] = v
+		}
+		if err = s.inventory.StoreInventoryValues(ctx, r.ID, values); err != nil {
+			logger.Info("msg", "storing inventory", "id", r.ID, "err", err)
+		}
+	}
+	return nil
+}
+
+// Authenticate maps the identity of the enrollment.
+func (s *Service) Authenticate(r *mdm.Request, _ *mdm.Authenticate) error {
+	return s.update(r)
+}
+
+// TokenUpdate maps the identity of the enrollment.
+func (s *Service) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	return s.update(r)
+}
+
+// Enricher is an event sink that adds identity fields to events before
+// sending them to the next sink.
+type Enricher struct {
+	store Store
+	next  event.Sink
+}
+
+// NewEnricher creates a new enriching event sink.
+func NewEnricher(store Store, next event.Sink) *Enricher {
+	if store == nil {
+		panic("nil store")
+	}
+	if next == nil {
+		panic("nil sink")
+	}
+	return &Enricher{store: store, next: next}
+}
+
+// Send adds "identity_"-prefixed fields (e.g. "identity_user") to e if
+// the event's enrollment has an identity.
+func (en *Enricher) Send(ctx context.Context, e *event.Event) error {
+	if e != nil && e.EnrollmentID != "" {
+		i, err := Lookup(ctx, en.store, e.EnrollmentID)
+		if err != nil {
+			return err
+		}
+		if i != nil {
+			if e.Fields == nil {
+				e.Fields = make(map[string]string)
+			}
+			for k, v := range i.Fields() {
+				e.Fields["identity_"+k] = v
+			}
+		}
+	}
+	return en.next.Send(ctx, e)
+}
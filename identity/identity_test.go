@@ -0,0 +1,69 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type sink struct {
+	events []*event.Event
+}
+
+func (s *sink) Send(_ context.Context, e *event.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := ParseFieldMapper("user=san.email, asset=subject.serialNumber,dept=subject.ou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseFieldMapper("user=san.phone"); err == nil {
+		t.Error("expected error for unknown field")
+	}
+
+	store := NewKVStore(kvmap.New())
+	s := NewService(store, m)
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	r.Certificate = &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "device",
+			SerialNumber:       "C02ABC",
+			OrganizationalUnit: []string{"Sales"},
+		},
+		EmailAddresses: []string{"jane@example.com"},
+	}
+	if err = s.Authenticate(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := store.RetrieveIdentity(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i == nil || i.User != "jane@example.com" || i.Asset != "C02ABC" || i.Attributes["dept"] != "Sales" {
+		t.Fatalf("incorrect identity: %v", i)
+	}
+
+	// user channel events use the identity of their device
+	next := new(sink)
+	en := NewEnricher(store, next)
+	if err = en.Send(ctx, &event.Event{EnrollmentID: "ID1:user"}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := next.events[0].Fields["identity_user"], "jane@example.com"; have != want {
+		t.Errorf("have: %q, want: %q", have, want)
+	}
+}
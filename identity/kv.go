@@ -0,0 +1,55 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores enrollment identities in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new identity store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreIdentity stores the identity of an enrollment.
+func (s *KVStore) StoreIdentity(ctx context.Context, i *Identity) error {
+	if i == nil || i.ID == "" {
+		return errors.New("invalid identity")
+	}
+	v, err := json.Marshal(i)
+	if err != nil {
+		return fmt.Errorf("marshal identity: %w", err)
+	}
+	return s.b.Set(ctx, i.ID, v)
+}
+
+// RetrieveIdentity retrieves the identity of id.
+func (s *KVStore) RetrieveIdentity(ctx context.Context, id string) (*Identity, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	i := new(Identity)
+	if err = json.Unmarshal(v, i); err != nil {
+		return nil, fmt.Errorf("unmarshal identity: %w", err)
+	}
+	return i, nil
+}
+
+// DeleteIdentity deletes the identity of id.
+func (s *KVStore) DeleteIdentity(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
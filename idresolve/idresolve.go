@@ -0,0 +1,197 @@
+// Package idresolve resolves organization identifiers to enrollment IDs.
+//
+// Identifiers have the form "kind:value", e.g. "serial:C02XK0ABCDEF" or
+// "user:jane@example.com". Resolvers are registered for each kind.
+// IDs without a registered kind (i.e. enrollment IDs) are used as-is.
+package idresolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNotResolved is returned when an identifier resolves to no enrollments.
+var ErrNotResolved = errors.New("identifier not resolved")
+
+// Resolver resolves identifier values of one kind to enrollment IDs.
+type Resolver interface {
+	Resolve(ctx context.Context, value string) ([]string, error)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(ctx context.Context, value string) ([]string, error)
+
+// Resolve calls f(ctx, value).
+func (f ResolverFunc) Resolve(ctx context.Context, value string) ([]string, error) {
+	return f(ctx, value)
+}
+
+// IDResolver resolves identifiers using the resolvers of their kind.
+type IDResolver struct {
+	resolvers map[string]Resolver
+	logger    log.Logger
+}
+
+// Option configures the ID resolver.
+type Option func(*IDResolver)
+
+// WithResolver registers r for identifiers of kind.
+func WithResolver(kind string, r Resolver) Option {
+	if kind == "" || strings.Contains(kind, ":") {
+		panic("invalid kind")
+	}
+	if r == nil {
+		panic("nil resolver")
+	}
+	return func(ir *IDResolver) {
+		ir.resolvers[kind] = r
+	}
+}
+
+// WithLogger configures a logger for the ID resolver.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(ir *IDResolver) {
+		ir.logger = logger
+	}
+}
+
+// New creates a new ID resolver.
+func New(opts ...Option) *IDResolver {
+	ir := &IDResolver{
+		resolvers: make(map[string]Resolver),
+		logger:    log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(ir)
+	}
+	return ir
+}
+
+// resolver returns the resolver and value of identifier id.
+// A nil resolver is returned if id has no registered kind.
+func (ir *IDResolver) resolver(id string) (Resolver, string) {
+	i := strings.Index(id, ":")
+	if i < 1 {
+		return nil, ""
+	}
+	return ir.resolvers[id[:i]], id[i+1:]
+}
+
+// Resolve resolves ids to enrollment IDs.
+// The order of ids is kept and duplicate enrollment IDs are removed.
+// The second return value reports whether any identifier was resolved.
+func (ir *IDResolver) Resolve(ctx context.Context, ids []string) ([]string, bool, error) {
+	var resolved []string
+	var any bool
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		r, value := ir.resolver(id)
+		enrollmentIDs := []string{id}
+		if r != nil {
+			var err error
+			if enrollmentIDs, err = r.Resolve(ctx, value); err != nil {
+				return nil, false, fmt.Errorf("resolving %s: %w", id, err)
+			} else if len(enrollmentIDs) < 1 {
+				return nil, false, fmt.Errorf("%w: %s", ErrNotResolved, id)
+			}
+			any = true
+		}
+		for _, enrollmentID := range enrollmentIDs {
+			if !seen[enrollmentID] {
+				seen[enrollmentID] = true
+				resolved = append(resolved, enrollmentID)
+			}
+		}
+	}
+	return resolved, any, nil
+}
+
+// middleware returns HTTP middleware that resolves the IDs of requests.
+// ids returns the IDs of a request and with returns a copy of the
+// request with the resolved IDs.
+func (ir *IDResolver) middleware(ids func(*http.Request) []string, with func(*http.Request, []string) *http.Request) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := ctxlog.Logger(r.Context(), ir.logger)
+			resolved, any, err := ir.Resolve(r.Context(), ids(r))
+			if errors.Is(err, ErrNotResolved) {
+				httpapi.JSONError(w, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				logger.Info("msg", "resolving enrollment IDs", "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			if any {
+				logger.Debug("msg", "resolved enrollment IDs", "count", len(resolved))
+				r = with(r, resolved)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PathMiddleware returns HTTP middleware that resolves the
+// comma-separated IDs in the last path segment of requests.
+// This matches the NanoMDM API convention for enqueue and push.
+func (ir *IDResolver) PathMiddleware() func(http.Handler) http.Handler {
+	return ir.middleware(
+		func(r *http.Request) []string {
+			i := strings.LastIndex(r.URL.Path, "/")
+			if i < 0 {
+				return nil
+			}
+			return split([]string{r.URL.Path[i+1:]})
+		},
+		func(r *http.Request, ids []string) *http.Request {
+			u := *r.URL
+			u.Path = u.Path[:strings.LastIndex(u.Path, "/")+1] + strings.Join(ids, ",")
+			u.RawPath = ""
+			r2 := r.Clone(r.Context())
+			r2.URL = &u
+			return r2
+		},
+	)
+}
+
+// QueryMiddleware returns HTTP middleware that resolves the "id" query
+// parameters of requests. Comma-separated values are split.
+func (ir *IDResolver) QueryMiddleware() func(http.Handler) http.Handler {
+	return ir.middleware(
+		func(r *http.Request) []string {
+			return split(r.URL.Query()["id"])
+		},
+		func(r *http.Request, ids []string) *http.Request {
+			u := *r.URL
+			q := u.Query()
+			q["id"] = ids
+			u.RawQuery = q.Encode()
+			r2 := r.Clone(r.Context())
+			r2.URL = &u
+			return r2
+		},
+	)
+}
+
+// split splits the comma-separated values into non-empty IDs.
+func split(values []string) (ids []string) {
+	for _, v := range values {
+		for _, id := range strings.Split(v, ",") {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package idresolve
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	ir := New(WithResolver("serial", ResolverFunc(func(_ context.Context, value string) ([]string, error) {
+		if value == "S1" {
+			return []string{"ID1", "ID2"}, nil
+		}
+		return nil, nil
+	})))
+
+	ids, resolved, err := ir.Resolve(context.Background(), []string{"ID2", "serial:S1", "ID3:user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved {
+		t.Error("not resolved")
+	}
+	if have, want := ids, []string{"ID2", "ID1", "ID3:user"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if _, _, err = ir.Resolve(context.Background(), []string{"serial:S2"}); !errors.Is(err, ErrNotResolved) {
+		t.Errorf("have: %v, want: %v", err, ErrNotResolved)
+	}
+
+	var path, query string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.Query().Get("id")
+	}
+	r := httptest.NewRequest("PUT", "/push/serial:S1", nil)
+	ir.PathMiddleware()(http.HandlerFunc(h)).ServeHTTP(httptest.NewRecorder(), r)
+	if have, want := path, "/push/ID1,ID2"; have != want {
+		t.Errorf("path: have: %v, want: %v", have, want)
+	}
+	r = httptest.NewRequest("POST", "/workflow/w/start?id=serial:S1", nil)
+	ir.QueryMiddleware()(http.HandlerFunc(h)).ServeHTTP(httptest.NewRecorder(), r)
+	if have, want := query, "ID1"; have != want {
+		t.Errorf("query: have: %v, want: %v", have, want)
+	}
+}
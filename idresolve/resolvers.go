@@ -0,0 +1,140 @@
+package idresolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/directory"
+)
+
+// ResponseStore retrieves command responses of all enrollments.
+type ResponseStore interface {
+	RetrieveResponsesByType(ctx context.Context, requestType string) (map[string]*cmdresponse.Response, error)
+}
+
+// Serial resolves device serial numbers using the stored DeviceInformation responses.
+func Serial(store ResponseStore) Resolver {
+	if store == nil {
+		panic("nil store")
+	}
+	return ResolverFunc(func(ctx context.Context, serial string) ([]string, error) {
+		responses, err := store.RetrieveResponsesByType(ctx, cmdresponse.DeviceInformationType)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving responses: %w", err)
+		}
+		var ids []string
+		for id, r := range responses {
+			if r.DeviceInformation != nil && strings.EqualFold(r.DeviceInformation.SerialNumber, serial) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids, nil
+	})
+}
+
+// User resolves directory user names or emails to their assigned enrollments.
+func User(store directory.Store) Resolver {
+	if store == nil {
+		panic("nil store")
+	}
+	return ResolverFunc(func(ctx context.Context, name string) ([]string, error) {
+		users, err := store.RetrieveUsers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving users: %w", err)
+		}
+		userNames := make(map[string]bool)
+		for _, u := range users {
+			if u.Matches(name) {
+				userNames[u.UserName] = true
+			}
+		}
+		assignments, err := store.RetrieveAssignments(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving assignments: %w", err)
+		}
+		var ids []string
+		for id, userName := range assignments {
+			if userNames[userName] {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids, nil
+	})
+}
+
+// TagStore retrieves the enrollments tagged with a tag.
+type TagStore interface {
+	RetrieveEnrollments(ctx context.Context, key, value string) ([]string, error)
+}
+
+// Tag resolves tag selectors ("key=value" or "key" for any value) to
+// the tagged enrollments.
+func Tag(store TagStore) Resolver {
+	if store == nil {
+		panic("nil store")
+	}
+	return ResolverFunc(func(ctx context.Context, selector string) ([]string, error) {
+		key, value, _ := strings.Cut(selector, "=")
+		return store.RetrieveEnrollments(ctx, key, value)
+	})
+}
+
+// HTTP resolves identifiers using an external resolver service.
+// The service is called with the "kind" and "value" query parameters
+// and returns a JSON array of enrollment IDs.
+type HTTP struct {
+	url    string
+	kind   string
+	client *http.Client
+}
+
+// NewHTTP creates a new HTTP resolver for kind using the service at url.
+// If client is nil then [http.DefaultClient] is used.
+func NewHTTP(url, kind string, client *http.Client) *HTTP {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTP{url: url, kind: kind, client: client}
+}
+
+// Resolve resolves value by calling the resolver service.
+func (h *HTTP) Resolve(ctx context.Context, value string) ([]string, error) {
+	v := url.Values{}
+	v.Set("kind", h.kind)
+	v.Set("value", value)
+
+	sep := "?"
+	if strings.Contains(h.url, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url+sep+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	var ids []string
+	if err = json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, fmt.Errorf("decoding resolver response: %w", err)
+	}
+	return ids, nil
+}
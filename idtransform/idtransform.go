@@ -0,0 +1,170 @@
+// Package idtransform transforms enrollment IDs before they are sent to
+// downstream services so that they never see raw enrollment IDs.
+package idtransform
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Transformer transforms enrollment IDs.
+type Transformer interface {
+	Transform(ctx context.Context, id string) (string, error)
+}
+
+// TransformerFunc is an adapter to allow ordinary functions to be transformers.
+type TransformerFunc func(ctx context.Context, id string) (string, error)
+
+// Transform calls f(ctx, id).
+func (f TransformerFunc) Transform(ctx context.Context, id string) (string, error) {
+	return f(ctx, id)
+}
+
+// NewHMAC creates a transformer that replaces IDs with their hex-encoded
+// HMAC-SHA256 using key. The result is stable for an ID, so downstream
+// services can use it as an identifier.
+func NewHMAC(key []byte) Transformer {
+	if len(key) < 1 {
+		panic("empty key")
+	}
+	return TransformerFunc(func(_ context.Context, id string) (string, error) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(id))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	})
+}
+
+// NewJWT creates a transformer that wraps IDs in an HS256-signed JSON
+// Web Token with the ID as the subject, signed with key. Tokens expire
+// after ttl. If c is nil then the system clock is used.
+func NewJWT(key []byte, issuer string, ttl time.Duration, c clock.Clock) Transformer {
+	if len(key) < 1 {
+		panic("empty key")
+	}
+	if c == nil {
+		c = clock.Real
+	}
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	return TransformerFunc(func(_ context.Context, id string) (string, error) {
+		now := c.Now()
+		claims := map[string]interface{}{
+			"sub": id,
+			"iat": now.Unix(),
+			"exp": now.Add(ttl).Unix(),
+		}
+		if issuer != "" {
+			claims["iss"] = issuer
+		}
+		claimBytes, err := json.Marshal(claims)
+		if err != nil {
+			return "", err
+		}
+		signingInput := header + "." + enc.EncodeToString(claimBytes)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signingInput))
+		return signingInput + "." + enc.EncodeToString(mac.Sum(nil)), nil
+	})
+}
+
+// ErrNoSerial is returned when no serial number is known for an enrollment.
+var ErrNoSerial = errors.New("no serial number")
+
+// NewSerial creates a transformer that replaces IDs with the device serial
+// number from the latest DeviceInformation command response in store.
+// User channel IDs are replaced with the serial number of their device.
+func NewSerial(store cmdresponse.Store) Transformer {
+	if store == nil {
+		panic("nil store")
+	}
+	return TransformerFunc(func(ctx context.Context, id string) (string, error) {
+		if i := strings.IndexByte(id, ':'); i >= 0 {
+			id = id[:i]
+		}
+		responses, err := store.RetrieveResponses(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("retrieving responses: %w", err)
+		}
+		resp := responses[cmdresponse.DeviceInformationType]
+		if resp == nil || resp.DeviceInformation == nil || resp.DeviceInformation.SerialNumber == "" {
+			return "", ErrNoSerial
+		}
+		return resp.DeviceInformation.SerialNumber, nil
+	})
+}
+
+// New creates a transformer by name: "hmac" or "jwt" (using key),
+// or "serial" (using store).
+func New(name string, key []byte, store cmdresponse.Store) (Transformer, error) {
+	switch name {
+	case "hmac", "jwt":
+		if len(key) < 1 {
+			return nil, fmt.Errorf("%s transform: empty key", name)
+		}
+		if name == "hmac" {
+			return NewHMAC(key), nil
+		}
+		return NewJWT(key, "nanohub", 5*time.Minute, nil), nil
+	case "serial":
+		if store == nil {
+			return nil, errors.New("serial transform: no response store")
+		}
+		return NewSerial(store), nil
+	default:
+		return nil, fmt.Errorf("unknown transform: %s", name)
+	}
+}
+
+type ctxKeyID struct{}
+
+// FromContext returns the transformed ID from ctx.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyID{}).(string)
+	return id
+}
+
+// Middleware transforms the enrollment ID retrieved with getID and
+// stores the result in the request context (see [FromContext]).
+// Requests without a known serial number are responded to with a
+// 403 Forbidden status.
+func Middleware(next http.Handler, getID func(context.Context) string, t Transformer, logger log.Logger) http.Handler {
+	if t == nil {
+		panic("nil transformer")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := getID(r.Context())
+		if id == "" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		tID, err := t.Transform(r.Context(), id)
+		if errors.Is(err, ErrNoSerial) {
+			ctxlog.Logger(r.Context(), logger).Info("msg", "transforming id", "id", id, "err", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if err != nil || tID == "" {
+			ctxlog.Logger(r.Context(), logger).Info("msg", "transforming id", "id", id, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyID{}, tID)))
+	})
+}
@@ -0,0 +1,133 @@
+package idtransform
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/http/authproxy"
+)
+
+func TestTransforms(t *testing.T) {
+	ctx := context.Background()
+	store := cmdresponse.NewKVStore(kvmap.New())
+	err := store.StoreResponse(ctx, "ID1", &cmdresponse.Response{
+		RequestType:       cmdresponse.DeviceInformationType,
+		DeviceInformation: &cmdresponse.DeviceInformation{SerialNumber: "SERIAL1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		t     Transformer
+		id    string
+		want  string
+		error error
+	}{
+		{"hmac", NewHMAC([]byte("key")), "The quick brown fox jumps over the lazy dog", "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", nil},
+		{"serial", NewSerial(store), "ID1", "SERIAL1", nil},
+		{"serial-user-channel", NewSerial(store), "ID1:USER1", "SERIAL1", nil},
+		{"serial-unknown", NewSerial(store), "ID2", "", ErrNoSerial},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			have, err := test.t.Transform(ctx, test.id)
+			if !errors.Is(err, test.error) {
+				t.Fatalf("have error %v, want %v", err, test.error)
+			}
+			if have != test.want {
+				t.Errorf("have %q, want %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := []byte("key")
+	token, err := NewJWT(key, "nanohub", time.Minute, clock.NewFake(now)).Transform(context.Background(), "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("have %d token parts, want 3", len(parts))
+	}
+
+	enc := base64.RawURLEncoding
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if sig, _ := enc.DecodeString(parts[2]); !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Error("invalid signature")
+	}
+
+	claimBytes, err := enc.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := new(struct {
+		Sub string `json:"sub"`
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	})
+	if err = json.Unmarshal(claimBytes, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "ID1" || claims.Iss != "nanohub" || claims.Iat != now.Unix() || claims.Exp != now.Add(time.Minute).Unix() {
+		t.Errorf("invalid claims: %+v", claims)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var header string
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Enrollment-ID")
+	}))
+	defer dest.Close()
+
+	proxy, err := authproxy.New(dest.URL, authproxy.WithHeaderFunc("X-Enrollment-ID", FromContext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := TransformerFunc(func(_ context.Context, id string) (string, error) {
+		if id == "ID1" {
+			return "SERIAL1", nil
+		}
+		return "", ErrNoSerial
+	})
+
+	for _, test := range []struct {
+		id     string
+		status int
+		header string
+	}{
+		{"ID1", http.StatusOK, "SERIAL1"},
+		{"ID2", http.StatusForbidden, ""},
+		{"", http.StatusForbidden, ""},
+	} {
+		header = ""
+		getID := func(context.Context) string { return test.id }
+		rec := httptest.NewRecorder()
+		Middleware(proxy, getID, serial, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != test.status {
+			t.Errorf("%q: have status %d, want %d", test.id, rec.Code, test.status)
+		}
+		if header != test.header {
+			t.Errorf("%q: have header %q, want %q", test.id, header, test.header)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package http provides the HTTP API for inbound events and their rules.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/micromdm/nanohub/inbound"
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoName is returned when no rule name is provided.
+	ErrNoName = errors.New("no name provided")
+
+	// ErrNotFound is returned when a rule does not exist.
+	ErrNotFound = errors.New("rule not found")
+
+	// ErrNoSource is returned when no event source is provided.
+	ErrNoSource = errors.New("no source provided")
+)
+
+// maxPayloadSize is the largest accepted event payload.
+const maxPayloadSize = 1 << 20
+
+// GetRulesHandler returns all rules.
+func GetRulesHandler(store inbound.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		rules, err := store.RetrieveRules(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving rules", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, rules, logger)
+	}
+}
+
+// GetRuleHandler returns the rule named in the URL path.
+func GetRuleHandler(store inbound.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		rule, err := store.RetrieveRule(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if rule == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, rule, logger)
+	}
+}
+
+// PutRuleHandler stores the JSON rule in the request body under the
+// name in the URL path.
+func PutRuleHandler(store inbound.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		rule := new(inbound.Rule)
+		if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding rule: %w", err), http.StatusBadRequest)
+			return
+		}
+		rule.Name = name
+		if err := rule.Validate(); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreRule(r.Context(), rule); err != nil {
+			logger.Info("msg", "storing rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored rule", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteRuleHandler deletes the rule named in the URL path.
+func DeleteRuleHandler(store inbound.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteRule(r.Context(), name); err != nil {
+			logger.Info("msg", "deleting rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted rule", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// EventHandler starts the workflows of the rules matching the JSON event
+// payload in the request body of the source in the URL path.
+// The results of the matching rules are returned.
+func EventHandler(h *inbound.Handler, logger log.Logger) http.HandlerFunc {
+	if h == nil {
+		panic("nil handler")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		source := flow.Param(r.Context(), "source")
+		if source == "" {
+			httpapi.JSONError(w, ErrNoSource, http.StatusBadRequest)
+			return
+		}
+
+		payload, err := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize+1))
+		if err != nil {
+			httpapi.JSONError(w, fmt.Errorf("reading payload: %w", err), http.StatusBadRequest)
+			return
+		} else if len(payload) > maxPayloadSize {
+			httpapi.JSONError(w, errors.New("payload too large"), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		results, err := h.Handle(r.Context(), source, payload)
+		if errors.Is(err, inbound.ErrInvalidPayload) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "handling event", "source", source, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "handled event", "source", source, "count", len(results))
+		httpapi.WriteJSON(w, results, logger)
+	}
+}
+
+// HandleAPIv1 registers the inbound event API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store inbound.Store, h *inbound.Handler) {
+	mux.Handle(
+		prefix+"/inboundrules",
+		GetRulesHandler(store, logger.With("handler", "get-inbound-rules")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/inboundrules/:name",
+		GetRuleHandler(store, logger.With("handler", "get-inbound-rule")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/inboundrules/:name",
+		PutRuleHandler(store, logger.With("handler", "put-inbound-rule")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/inboundrules/:name",
+		DeleteRuleHandler(store, logger.With("handler", "delete-inbound-rule")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/inbound/:source",
+		EventHandler(h, logger.With("handler", "inbound-event")),
+		"POST",
+	)
+}
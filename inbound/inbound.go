@@ -0,0 +1,298 @@
+// Package inbound starts workflows from external events.
+//
+// External systems (such as ticketing systems or identity providers)
+// post JSON event payloads. Rules match the payloads by source and
+// values and map them to the workflow to start, its target enrollments,
+// and its context.
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrInvalidName is returned for empty rule names or names
+	// containing periods or slashes.
+	ErrInvalidName = errors.New("invalid rule name")
+
+	// ErrInvalidPayload is returned for payloads that are not JSON objects.
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+// Rule maps matching event payloads to a workflow start.
+// Paths are period-separated keys of the JSON payload where array
+// elements are selected by their index (e.g. "ticket.devices.0").
+type Rule struct {
+	Name string `json:"name"`
+
+	// Source limits the rule to the events of the source.
+	// Events of any source match if empty.
+	Source string `json:"source,omitempty"`
+
+	// Match maps payload paths to the JSON values they must have.
+	Match map[string]json.RawMessage `json:"match,omitempty"`
+
+	Workflow string `json:"workflow"`
+
+	// IDs is the payload path of the target identifiers: a string or
+	// an array of strings. Identifiers may be of any kind the ID
+	// resolver supports (e.g. "serial:C02XK0ABCDEF").
+	IDs string `json:"ids"`
+
+	// Context is the optional payload path of the workflow context.
+	// Strings are used as-is and other values as JSON.
+	Context string `json:"context,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// ValidName reports whether name is a valid rule name.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./")
+}
+
+// Validate checks r for errors.
+func (r *Rule) Validate() error {
+	if r == nil || !ValidName(r.Name) {
+		return ErrInvalidName
+	}
+	if r.Workflow == "" {
+		return errors.New("no workflow")
+	}
+	if r.IDs == "" {
+		return errors.New("no IDs path")
+	}
+	for path, v := range r.Match {
+		if !json.Valid(v) {
+			return fmt.Errorf("invalid JSON value of %s", path)
+		}
+	}
+	return nil
+}
+
+// Store stores rules.
+type Store interface {
+	StoreRule(ctx context.Context, r *Rule) error
+
+	// RetrieveRule retrieves the rule name.
+	// Nil is returned if the rule does not exist.
+	RetrieveRule(ctx context.Context, name string) (*Rule, error)
+
+	RetrieveRules(ctx context.Context) ([]*Rule, error)
+	DeleteRule(ctx context.Context, name string) error
+}
+
+// WorkflowStarter starts NanoCMD workflows.
+type WorkflowStarter interface {
+	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+}
+
+// IDResolver resolves identifiers to enrollment IDs.
+type IDResolver interface {
+	Resolve(ctx context.Context, ids []string) ([]string, bool, error)
+}
+
+// Result is the workflow start of a matching rule.
+type Result struct {
+	Rule       string   `json:"rule"`
+	IDs        []string `json:"ids,omitempty"`
+	InstanceID string   `json:"instance_id,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Handler starts the workflows of the rules matching events.
+type Handler struct {
+	store    Store
+	starter  WorkflowStarter
+	resolver IDResolver
+	logger   log.Logger
+}
+
+// Option configures the handler.
+type Option func(*Handler)
+
+// WithResolver resolves the target identifiers of events with r.
+func WithResolver(r IDResolver) Option {
+	if r == nil {
+		panic("nil resolver")
+	}
+	return func(h *Handler) {
+		h.resolver = r
+	}
+}
+
+// WithLogger configures a logger for the handler.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// New creates a new inbound event handler.
+func New(store Store, starter WorkflowStarter, opts ...Option) *Handler {
+	if store == nil {
+		panic("nil store")
+	}
+	if starter == nil {
+		panic("nil starter")
+	}
+	h := &Handler{store: store, starter: starter, logger: log.NopLogger}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// lookup returns the value at path in v.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// equal reports whether v equals the JSON value raw.
+func equal(v interface{}, raw json.RawMessage) bool {
+	var want interface{}
+	if json.Unmarshal(raw, &want) != nil {
+		return false
+	}
+	a, errA := json.Marshal(v)
+	b, errB := json.Marshal(want)
+	return errA == nil && errB == nil && string(a) == string(b)
+}
+
+// matches reports whether r matches the payload of source.
+func (r *Rule) matches(source string, payload interface{}) bool {
+	if r.Disabled || (r.Source != "" && r.Source != source) {
+		return false
+	}
+	for path, want := range r.Match {
+		if v, ok := lookup(payload, path); !ok || !equal(v, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// ids returns the target identifiers of the payload.
+func (r *Rule) ids(payload interface{}) ([]string, error) {
+	v, ok := lookup(payload, r.IDs)
+	if !ok {
+		return nil, fmt.Errorf("no IDs at %s", r.IDs)
+	}
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}, nil
+		}
+	case []interface{}:
+		var ids []string
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				ids = append(ids, s)
+			}
+		}
+		if len(ids) > 0 {
+			return ids, nil
+		}
+	}
+	return nil, fmt.Errorf("no IDs at %s", r.IDs)
+}
+
+// context returns the workflow context of the payload.
+func (r *Rule) context(payload interface{}) ([]byte, error) {
+	if r.Context == "" {
+		return nil, nil
+	}
+	v, ok := lookup(payload, r.Context)
+	if !ok || v == nil {
+		return nil, nil
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(v)
+}
+
+// start starts the workflow of r for the payload.
+func (h *Handler) start(ctx context.Context, r *Rule, payload interface{}) (*Result, error) {
+	res := &Result{Rule: r.Name}
+	ids, err := r.ids(payload)
+	if err != nil {
+		return res, err
+	}
+	if h.resolver != nil {
+		if ids, _, err = h.resolver.Resolve(ctx, ids); err != nil {
+			return res, fmt.Errorf("resolving IDs: %w", err)
+		}
+	}
+	res.IDs = ids
+	wfCtx, err := r.context(payload)
+	if err != nil {
+		return res, fmt.Errorf("workflow context: %w", err)
+	}
+	if res.InstanceID, err = h.starter.StartWorkflow(ctx, r.Workflow, wfCtx, ids, nil, nil); err != nil {
+		return res, fmt.Errorf("starting workflow: %w", err)
+	}
+	return res, nil
+}
+
+// Handle starts the workflows of the rules matching the JSON object
+// payload of an event of source. A result is returned for each matching
+// rule; rules whose workflow failed to start have the error set.
+func (h *Handler) Handle(ctx context.Context, source string, payload []byte) ([]*Result, error) {
+	logger := ctxlog.Logger(ctx, h.logger)
+	var p interface{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%w: not a JSON object", ErrInvalidPayload)
+	}
+	rules, err := h.store.RetrieveRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving rules: %w", err)
+	}
+	results := []*Result{}
+	for _, r := range rules {
+		if !r.matches(source, p) {
+			continue
+		}
+		res, err := h.start(ctx, r, p)
+		if err != nil {
+			logger.Info("msg", "starting workflow", "source", source, "rule", r.Name, "workflow", r.Workflow, "err", err)
+			res.Error = err.Error()
+		} else {
+			logger.Debug("msg", "started workflow", "source", source, "rule", r.Name, "workflow", r.Workflow, "instance_id", res.InstanceID, "count", len(res.IDs))
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,73 @@
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+type start struct {
+	name, context string
+	ids           []string
+}
+
+type starter []start
+
+func (s *starter) StartWorkflow(_ context.Context, name string, context []byte, ids []string, _ *workflow.Event, _ *workflow.MDMContext) (string, error) {
+	*s = append(*s, start{name, string(context), ids})
+	return "instance", nil
+}
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	for _, r := range []*Rule{
+		{
+			Name:     "lost",
+			Source:   "tickets",
+			Match:    map[string]json.RawMessage{"ticket.category": json.RawMessage(`"lost-device"`)},
+			Workflow: "wf.lock",
+			IDs:      "ticket.devices",
+			Context:  "ticket.message",
+		},
+		{Name: "other", Source: "idp", Workflow: "wf.other", IDs: "user"},
+	} {
+		if err := store.StoreRule(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	started := new(starter)
+	h := New(store, started)
+
+	results, err := h.Handle(ctx, "tickets", []byte(`{"ticket": {"category": "lost-device", "devices": ["serial:C02X", "ID2"], "message": "call IT"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Rule != "lost" || results[0].InstanceID != "instance" {
+		t.Errorf("results: have %+v", results)
+	}
+	want := starter{{"wf.lock", "call IT", []string{"serial:C02X", "ID2"}}}
+	if !reflect.DeepEqual(*started, want) {
+		t.Errorf("started: have %v, want %v", *started, want)
+	}
+
+	// not matching
+	if results, err = h.Handle(ctx, "tickets", []byte(`{"ticket": {"category": "other", "devices": ["ID1"]}}`)); err != nil || len(results) != 0 {
+		t.Errorf("have %v, %v, want no results", results, err)
+	}
+
+	// matching without IDs
+	if results, err = h.Handle(ctx, "idp", []byte(`{"event": "disabled"}`)); err != nil || len(results) != 1 || results[0].Error == "" {
+		t.Errorf("have %v, %v, want an error result", results, err)
+	}
+
+	if _, err = h.Handle(ctx, "idp", []byte(`[]`)); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("have %v, want %v", err, ErrInvalidPayload)
+	}
+}
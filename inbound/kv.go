@@ -0,0 +1,77 @@
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const keyPrefixRule = "rule."
+
+// KVStore stores rules in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new rule store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreRule stores r.
+func (s *KVStore) StoreRule(ctx context.Context, r *Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal rule: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixRule+r.Name, v)
+}
+
+// RetrieveRule retrieves the rule name.
+func (s *KVStore) RetrieveRule(ctx context.Context, name string) (*Rule, error) {
+	v, err := s.b.Get(ctx, keyPrefixRule+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Rule)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal rule: %w", err)
+	}
+	return r, nil
+}
+
+// RetrieveRules retrieves all rules.
+func (s *KVStore) RetrieveRules(ctx context.Context) ([]*Rule, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPrefixRule)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0, len(keys))
+	for _, k := range keys {
+		r, err := s.RetrieveRule(ctx, strings.TrimPrefix(k, keyPrefixRule))
+		if err != nil {
+			return rules, fmt.Errorf("retrieving rule %s: %w", k, err)
+		}
+		if r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// DeleteRule deletes the rule name.
+func (s *KVStore) DeleteRule(ctx context.Context, name string) error {
+	return s.b.Delete(ctx, keyPrefixRule+name)
+}
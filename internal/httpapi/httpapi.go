@@ -0,0 +1,51 @@
+// Package httpapi contains shared helpers for NanoHUB HTTP APIs.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// Mux can register HTTP handlers.
+// Ostensibly this is a flow mux.
+type Mux interface {
+	Handle(pattern string, handler http.Handler, methods ...string)
+}
+
+// errorResponse is the JSON error body returned by NanoHUB APIs.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// JSONError writes err as a JSON error body to w with HTTP status.
+// If status is zero then a 500 is used.
+func JSONError(w http.ResponseWriter, err error, status int) {
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
+
+// WriteJSON writes v as a JSON body to w.
+// Encoding errors are logged to logger.
+func WriteJSON(w http.ResponseWriter, v interface{}, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil && logger != nil {
+		logger.Info("msg", "encoding json", "err", err)
+	}
+}
+
+// QueryInt parses the integer HTTP query parameter key from r.
+// Returns def if the parameter was not present.
+func QueryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
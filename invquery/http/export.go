@@ -0,0 +1,175 @@
+package http
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/invquery"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Export formats.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// DefaultColumns are the inventory keys of CSV exports without columns.
+var DefaultColumns = []string{
+	storage.KeySerialNumber,
+	storage.KeyModel,
+	storage.KeyModelName,
+	storage.KeyDeviceName,
+	storage.KeyOSVersion,
+	storage.KeyBuildVersion,
+	storage.KeyLastSource,
+	storage.KeyModified,
+}
+
+// ErrNoSets is returned when exports are filtered by sets without DM storage.
+var ErrNoSets = errors.New("enrollment set filtering not supported")
+
+// SetEnrollmentRetriever retrieves the enrollment IDs of DM sets.
+type SetEnrollmentRetriever interface {
+	RetrieveEnrollmentIDs(ctx context.Context, declarations []string, sets []string, ids []string) ([]string, error)
+}
+
+// split splits the comma-separated values of each of values.
+func split(values []string) []string {
+	var r []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				r = append(r, s)
+			}
+		}
+	}
+	return r
+}
+
+// ExportHandler streams all inventory matching the query parameters
+// as CSV or newline-delimited JSON (NDJSON) per the "format" query
+// parameter. The "columns" query parameter selects the inventory keys
+// to export and the "set" query parameter limits the export to the
+// enrollments of the DM sets. Sets may be nil to disable set filtering.
+func ExportHandler(searcher invquery.Searcher, sets SetEnrollmentRetriever, logger log.Logger) http.HandlerFunc {
+	if searcher == nil {
+		panic("nil searcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q, err := ParseQuery(r)
+		if errors.Is(err, invquery.ErrInvalid) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatCSV
+		}
+		if format != FormatCSV && format != FormatNDJSON {
+			httpapi.JSONError(w, fmt.Errorf("%w: format: %q", invquery.ErrInvalid, format), http.StatusBadRequest)
+			return
+		}
+
+		columns := split(r.URL.Query()["columns"])
+		if format == FormatCSV && len(columns) < 1 {
+			columns = DefaultColumns
+		}
+
+		var members map[string]bool
+		if setNames := split(r.URL.Query()["set"]); len(setNames) > 0 {
+			if sets == nil {
+				httpapi.JSONError(w, ErrNoSets, http.StatusBadRequest)
+				return
+			}
+			ids, err := sets.RetrieveEnrollmentIDs(r.Context(), nil, setNames, nil)
+			if err != nil {
+				logger.Info("msg", "retrieving set enrollments", "err", err)
+				httpapi.JSONError(w, err, 0)
+				return
+			}
+			members = make(map[string]bool, len(ids))
+			for _, id := range ids {
+				members[id] = true
+			}
+		}
+
+		var write func(*invquery.Result) error
+		if format == FormatCSV {
+			cw := csv.NewWriter(w)
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+			if err = cw.Write(append([]string{"id"}, columns...)); err != nil {
+				logger.Debug("msg", "writing export", "err", err)
+				return
+			}
+			write = func(res *invquery.Result) error {
+				record := []string{res.ID}
+				for _, c := range columns {
+					record = append(record, invquery.ValueString(res.Values[c]))
+				}
+				if err := cw.Write(record); err != nil {
+					return err
+				}
+				cw.Flush()
+				return cw.Error()
+			}
+		} else {
+			enc := json.NewEncoder(w)
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="inventory.ndjson"`)
+			write = func(res *invquery.Result) error {
+				if len(columns) > 0 {
+					values := make(storage.Values, len(columns))
+					for _, c := range columns {
+						if v, ok := res.Values[c]; ok {
+							values[c] = v
+						}
+					}
+					res = &invquery.Result{ID: res.ID, Values: values}
+				}
+				return enc.Encode(res)
+			}
+		}
+
+		flusher, _ := w.(http.Flusher)
+		var count int
+		err = invquery.Export(r.Context(), searcher, q, func(results []*invquery.Result) error {
+			for _, res := range results {
+				if members != nil && !members[res.ID] {
+					continue
+				}
+				if err := write(res); err != nil {
+					return fmt.Errorf("writing export: %w", err)
+				}
+				count++
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			// the response has started: the export is cut short
+			logger.Info("msg", "exporting inventory", "count", count, "err", err)
+			return
+		}
+		logger.Debug("msg", "exported inventory", "format", format, "count", count)
+	}
+}
@@ -0,0 +1,93 @@
+// Package http provides the HTTP API for inventory queries.
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/invquery"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// queryKeys maps query parameters to the inventory keys they filter.
+var queryKeys = []struct{ param, key string }{
+	{"model", storage.KeyModel},
+	{"os_version", storage.KeyOSVersion},
+	{"serial", storage.KeySerialNumber},
+}
+
+// ParseQuery parses the inventory query of the query parameters of r.
+// The "filter" parameter (which can be repeated) filters the custom
+// inventory key in the form "key=value".
+func ParseQuery(r *http.Request) (*invquery.Query, error) {
+	params := r.URL.Query()
+	q := &invquery.Query{Cursor: params.Get("cursor")}
+	var err error
+	if q.Limit, err = httpapi.QueryInt(r, "limit", 0); err != nil {
+		return nil, fmt.Errorf("%w: limit: %v", invquery.ErrInvalid, err)
+	}
+	for _, qk := range queryKeys {
+		if v := params.Get(qk.param); v != "" {
+			q.Filters = append(q.Filters, invquery.Filter{Key: qk.key, Value: v})
+		}
+	}
+	for _, f := range params["filter"] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: filter not in key=value form: %q", invquery.ErrInvalid, f)
+		}
+		q.Filters = append(q.Filters, invquery.Filter{Key: k, Value: v})
+	}
+	return q, q.Validate()
+}
+
+// SearchHandler returns the page of inventory matching the query parameters.
+func SearchHandler(searcher invquery.Searcher, logger log.Logger) http.HandlerFunc {
+	if searcher == nil {
+		panic("nil searcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q, err := ParseQuery(r)
+		if errors.Is(err, invquery.ErrInvalid) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		page, err := searcher.SearchInventory(r.Context(), q)
+		if err != nil {
+			logger.Info("msg", "searching inventory", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, page, logger)
+	}
+}
+
+// HandleAPIv1 registers the inventory query API handlers into mux.
+// Sets may be nil to disable filtering exports by DM sets.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, searcher invquery.Searcher, sets SetEnrollmentRetriever) {
+	mux.Handle(
+		prefix+"/inventory/search",
+		SearchHandler(searcher, logger.With("handler", "search-inventory")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/inventory/export",
+		ExportHandler(searcher, sets, logger.With("handler", "export-inventory")),
+		"GET",
+	)
+}
@@ -0,0 +1,241 @@
+// Package invquery searches the NanoCMD inventory subsystem by values.
+//
+// Queries filter enrollments by inventory values (such as the model,
+// OS version, or serial number) and page through the matching
+// enrollments ordered by enrollment ID.
+package invquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+)
+
+const (
+	// DefaultLimit is the page size of queries without a limit.
+	DefaultLimit = 100
+
+	// MaxLimit is the largest page size.
+	MaxLimit = 1000
+)
+
+// ErrInvalid is returned for invalid queries.
+var ErrInvalid = errors.New("invalid query")
+
+// Filter matches the inventory value of Key.
+// The value matches Value case-insensitively.
+// A trailing "*" in Value matches values starting with Value.
+type Filter struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Prefix returns the prefix to match and true if f is a prefix filter.
+func (f Filter) Prefix() (string, bool) {
+	if strings.HasSuffix(f.Value, "*") {
+		return strings.TrimSuffix(f.Value, "*"), true
+	}
+	return f.Value, false
+}
+
+// Match reports whether the inventory value v matches f.
+func (f Filter) Match(v interface{}) bool {
+	s := strings.ToLower(ValueString(v))
+	want, prefix := f.Prefix()
+	want = strings.ToLower(want)
+	if prefix {
+		return strings.HasPrefix(s, want)
+	}
+	return s == want
+}
+
+// Query selects inventory.
+type Query struct {
+	// Filters that all must match. All enrollments match without filters.
+	Filters []Filter
+
+	// Cursor is the enrollment ID after which to start the page.
+	// It is the NextCursor of the previous page.
+	Cursor string
+
+	// Limit is the page size. DefaultLimit is used if Limit is zero.
+	Limit int
+}
+
+// Validate checks q and sets its default limit.
+func (q *Query) Validate() error {
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit < 0 || q.Limit > MaxLimit {
+		return fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalid, MaxLimit)
+	}
+	for _, f := range q.Filters {
+		if f.Key == "" {
+			return fmt.Errorf("%w: empty filter key", ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// Match reports whether all filters of q match values.
+func (q *Query) Match(values storage.Values) bool {
+	for _, f := range q.Filters {
+		v, ok := values[f.Key]
+		if !ok || !f.Match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Result is the inventory of a matching enrollment.
+type Result struct {
+	ID     string         `json:"id"`
+	Values storage.Values `json:"values"`
+}
+
+// Page is a page of query results.
+type Page struct {
+	Results []*Result `json:"results"`
+
+	// NextCursor is the cursor of the next page.
+	// It is empty for the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Searcher searches inventory.
+type Searcher interface {
+	// SearchInventory returns the page of inventory matching the validated q.
+	SearchInventory(ctx context.Context, q *Query) (*Page, error)
+}
+
+// ValueString returns the string form of the inventory value v used
+// for matching filters.
+func ValueString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// chunkSize is the number of enrollments retrieved at a time when scanning.
+const chunkSize = 100
+
+// Index records the enrollments of an inventory storage to search it.
+// Searches scan the indexed enrollments in order and filter their
+// values. Inventory stored before the index was created is not searched
+// until it is stored again.
+type Index struct {
+	storage.Storage
+	b kv.Bucket
+}
+
+// NewIndex creates a new searchable index of store using b.
+func NewIndex(store storage.Storage, b kv.Bucket) *Index {
+	if store == nil {
+		panic("nil store")
+	}
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &Index{Storage: store, b: b}
+}
+
+// StoreInventoryValues stores values for id and indexes id.
+func (i *Index) StoreInventoryValues(ctx context.Context, id string, values storage.Values) error {
+	if err := i.Storage.StoreInventoryValues(ctx, id, values); err != nil {
+		return err
+	}
+	if err := i.b.Set(ctx, id, []byte{}); err != nil {
+		return fmt.Errorf("indexing inventory: %w", err)
+	}
+	return nil
+}
+
+// DeleteInventory deletes the inventory of id and removes id from the index.
+func (i *Index) DeleteInventory(ctx context.Context, id string) error {
+	if err := i.Storage.DeleteInventory(ctx, id); err != nil {
+		return err
+	}
+	if err := i.b.Delete(ctx, id); err != nil {
+		return fmt.Errorf("removing inventory index: %w", err)
+	}
+	return nil
+}
+
+// SearchInventory scans the indexed enrollments after the cursor of q
+// until a page of matching inventory is found.
+func (i *Index) SearchInventory(ctx context.Context, q *Query) (*Page, error) {
+	ids, err := i.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing inventory index: %w", err)
+	}
+	if q.Cursor != "" {
+		ids = ids[sort.SearchStrings(ids, q.Cursor+"\x00"):]
+	}
+	page := &Page{Results: []*Result{}}
+	for len(ids) > 0 {
+		n := chunkSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		chunk := ids[:n]
+		ids = ids[n:]
+		inv, err := i.Storage.RetrieveInventory(ctx, &storage.SearchOptions{IDs: chunk})
+		if err != nil {
+			return nil, fmt.Errorf("retrieving inventory: %w", err)
+		}
+		for _, id := range chunk {
+			values, ok := inv[id]
+			if !ok || !q.Match(values) {
+				continue
+			}
+			if len(page.Results) == q.Limit {
+				// another match exists: there is a next page
+				page.NextCursor = page.Results[len(page.Results)-1].ID
+				return page, nil
+			}
+			page.Results = append(page.Results, &Result{ID: id, Values: values})
+		}
+	}
+	return page, nil
+}
+
+// Export calls fn with the results of each page of q in order until
+// all matching inventory has been exported. Pages are MaxLimit in size.
+func Export(ctx context.Context, s Searcher, q *Query, fn func([]*Result) error) error {
+	q2 := *q
+	q2.Limit = MaxLimit
+	for {
+		page, err := s.SearchInventory(ctx, &q2)
+		if err != nil {
+			return err
+		}
+		if err = fn(page.Results); err != nil {
+			return err
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		q2.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,110 @@
+package invquery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+)
+
+type inventory map[string]storage.Values
+
+func (i inventory) RetrieveInventory(_ context.Context, opt *storage.SearchOptions) (map[string]storage.Values, error) {
+	r := make(map[string]storage.Values)
+	for _, id := range opt.IDs {
+		if v, ok := i[id]; ok {
+			r[id] = v
+		}
+	}
+	return r, nil
+}
+
+func (i inventory) StoreInventoryValues(_ context.Context, id string, values storage.Values) error {
+	i[id] = values
+	return nil
+}
+
+func (i inventory) DeleteInventory(_ context.Context, id string) error {
+	delete(i, id)
+	return nil
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	idx := NewIndex(make(inventory), kvmap.New())
+	for id, values := range map[string]storage.Values{
+		"ID1": {storage.KeyModel: "Mac14,2", storage.KeyOSVersion: "14.4", "sip_enabled": true},
+		"ID2": {storage.KeyModel: "Mac14,2", storage.KeyOSVersion: "13.6"},
+		"ID3": {storage.KeyModel: "iPhone15,2", storage.KeyOSVersion: "17.4"},
+		"ID4": {storage.KeyModel: "mac14,2", storage.KeyOSVersion: "14.1", "sip_enabled": false},
+		"ID5": {storage.KeyModel: "Mac14,2", storage.KeyOSVersion: "14.2"},
+	} {
+		if err := idx.StoreInventoryValues(ctx, id, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.DeleteInventory(ctx, "ID5"); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(q *Query) ([]string, string) {
+		t.Helper()
+		if err := q.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		page, err := idx.SearchInventory(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, r := range page.Results {
+			ids = append(ids, r.ID)
+		}
+		return ids, page.NextCursor
+	}
+
+	for _, test := range []struct {
+		filters []Filter
+		want    []string
+	}{
+		{nil, []string{"ID1", "ID2", "ID3", "ID4"}},
+		{[]Filter{{storage.KeyModel, "MAC14,2"}}, []string{"ID1", "ID2", "ID4"}},
+		{[]Filter{{storage.KeyModel, "Mac14,2"}, {storage.KeyOSVersion, "14.*"}}, []string{"ID1", "ID4"}},
+		{[]Filter{{"sip_enabled", "true"}}, []string{"ID1"}},
+		{[]Filter{{"missing", "x"}}, []string{}},
+	} {
+		ids, cursor := search(&Query{Filters: test.filters})
+		if !reflect.DeepEqual(ids, test.want) || cursor != "" {
+			t.Errorf("%v: have %v (cursor %q), want %v", test.filters, ids, cursor, test.want)
+		}
+	}
+
+	// paging
+	q := &Query{Filters: []Filter{{storage.KeyModel, "mac*"}}, Limit: 2}
+	ids, cursor := search(q)
+	if want := []string{"ID1", "ID2"}; !reflect.DeepEqual(ids, want) || cursor != "ID2" {
+		t.Fatalf("first page: have %v (cursor %q), want %v", ids, cursor, want)
+	}
+	q.Cursor = cursor
+	ids, cursor = search(q)
+	if want := []string{"ID4"}; !reflect.DeepEqual(ids, want) || cursor != "" {
+		t.Errorf("second page: have %v (cursor %q), want %v", ids, cursor, want)
+	}
+
+	var exported []string
+	err := Export(ctx, idx, &Query{Limit: 1}, func(results []*Result) error {
+		for _, r := range results {
+			exported = append(exported, r.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ID1", "ID2", "ID3", "ID4"}; !reflect.DeepEqual(exported, want) {
+		t.Errorf("export: have %v, want %v", exported, want)
+	}
+}
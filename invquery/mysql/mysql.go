@@ -0,0 +1,170 @@
+// Package mysql implements NanoCMD inventory subsystem storage with
+// indexed inventory queries backed by MySQL.
+// See schema.sql for the required table.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/invquery"
+
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+)
+
+// maxValueString is the length of the indexed string form of values.
+const maxValueString = 255
+
+// MySQL stores inventory values one row per enrollment and key.
+// The string form of each value is indexed to query inventory.
+type MySQL struct {
+	db *sql.DB
+}
+
+// New creates a new MySQL inventory storage using db.
+func New(db *sql.DB) *MySQL {
+	if db == nil {
+		panic("nil db")
+	}
+	return &MySQL{db: db}
+}
+
+// RetrieveInventory retrieves the inventory values of the IDs of opt.
+func (s *MySQL) RetrieveInventory(ctx context.Context, opt *storage.SearchOptions) (map[string]storage.Values, error) {
+	if opt == nil || len(opt.IDs) < 1 {
+		return nil, storage.ErrNoIDs
+	}
+	args := make([]interface{}, len(opt.IDs))
+	for i, id := range opt.IDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT id, k, v FROM nanohub_inventory WHERE id IN (?`+strings.Repeat(", ?", len(args)-1)+`);`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := make(map[string]storage.Values)
+	for rows.Next() {
+		var id, k string
+		var v []byte
+		if err = rows.Scan(&id, &k, &v); err != nil {
+			return r, err
+		}
+		var value interface{}
+		if err = json.Unmarshal(v, &value); err != nil {
+			return r, fmt.Errorf("unmarshal value %s for %s: %w", k, id, err)
+		}
+		if r[id] == nil {
+			r[id] = make(storage.Values)
+		}
+		r[id][k] = value
+	}
+	return r, rows.Err()
+}
+
+// valueString returns the indexed string form of v.
+func valueString(v interface{}) string {
+	s := invquery.ValueString(v)
+	if r := []rune(s); len(r) > maxValueString {
+		s = string(r[:maxValueString])
+	}
+	return s
+}
+
+// StoreInventoryValues merges values into the inventory of id.
+func (s *MySQL) StoreInventoryValues(ctx context.Context, id string, values storage.Values) error {
+	if id == "" {
+		return storage.ErrNoIDs
+	}
+	if len(values) < 1 {
+		return nil
+	}
+	var args []interface{}
+	for k, v := range values {
+		jsonValue, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("marshal value %s: %w", k, err)
+		}
+		args = append(args, id, k, jsonValue, valueString(v))
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO nanohub_inventory (id, k, v, v_str) VALUES (?, ?, ?, ?)`+
+			strings.Repeat(", (?, ?, ?, ?)", len(values)-1)+` AS new
+ON DUPLICATE KEY UPDATE v = new.v, v_str = new.v_str;`,
+		args...,
+	)
+	return err
+}
+
+// DeleteInventory deletes the inventory of id.
+func (s *MySQL) DeleteInventory(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM nanohub_inventory WHERE id = ?;`, id)
+	return err
+}
+
+// escapeLike escapes the LIKE wildcard characters in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchInventory queries the indexed inventory values for the page of q.
+// Filters match the first 255 characters of values case-insensitively
+// (with the default collation).
+func (s *MySQL) SearchInventory(ctx context.Context, q *invquery.Query) (*invquery.Page, error) {
+	query := `SELECT DISTINCT id FROM nanohub_inventory WHERE id > ?`
+	args := []interface{}{q.Cursor}
+	for _, f := range q.Filters {
+		if v, prefix := f.Prefix(); prefix {
+			query += ` AND id IN (SELECT id FROM nanohub_inventory WHERE k = ? AND v_str LIKE ?)`
+			args = append(args, f.Key, escapeLike(v)+"%")
+		} else {
+			query += ` AND id IN (SELECT id FROM nanohub_inventory WHERE k = ? AND v_str = ?)`
+			args = append(args, f.Key, v)
+		}
+	}
+	// one more than the page to know if there is a next page
+	query += ` ORDER BY id LIMIT ?;`
+	args = append(args, q.Limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying inventory: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := &invquery.Page{Results: []*invquery.Result{}}
+	if len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+		page.NextCursor = ids[len(ids)-1]
+	}
+	if len(ids) < 1 {
+		return page, nil
+	}
+	inv, err := s.RetrieveInventory(ctx, &storage.SearchOptions{IDs: ids})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving inventory: %w", err)
+	}
+	for _, id := range ids {
+		page.Results = append(page.Results, &invquery.Result{ID: id, Values: inv[id]})
+	}
+	return page, nil
+}
@@ -0,0 +1,12 @@
+CREATE TABLE nanohub_inventory (
+    id    VARCHAR(255) NOT NULL,
+    k     VARCHAR(63)  NOT NULL,
+    v     JSON         NOT NULL,
+    v_str VARCHAR(255) NOT NULL,
+
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id, k),
+    INDEX (k, v_str, id)
+);
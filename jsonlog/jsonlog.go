@@ -0,0 +1,134 @@
+// Package jsonlog implements a NanoLIB logger that writes JSON.
+// Each log line is a single JSON object.
+package jsonlog
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// Logger writes log lines as JSON objects.
+type Logger struct {
+	w       *lockedWriter
+	debug   bool
+	context []interface{}
+	now     func() time.Time
+}
+
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// Option configures a Logger.
+type Option func(*Logger)
+
+// WithDebug enables debug logging.
+func WithDebug() Option {
+	return func(l *Logger) {
+		l.debug = true
+	}
+}
+
+// WithDebugFlag enables debug logging if debug is true.
+func WithDebugFlag(debug bool) Option {
+	return func(l *Logger) {
+		l.debug = debug
+	}
+}
+
+// WithWriter writes log lines to w rather than standard error.
+func WithWriter(w io.Writer) Option {
+	if w == nil {
+		panic("nil writer")
+	}
+
+	return func(l *Logger) {
+		l.w = &lockedWriter{w: w}
+	}
+}
+
+// New creates a new JSON logger.
+func New(opts ...Option) *Logger {
+	l := &Logger{
+		w:   &lockedWriter{w: os.Stderr},
+		now: time.Now,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Info logs keyvals at the info level.
+func (l *Logger) Info(keyvals ...interface{}) {
+	l.log("info", keyvals)
+}
+
+// Debug logs keyvals at the debug level if debug logging is enabled.
+func (l *Logger) Debug(keyvals ...interface{}) {
+	if !l.debug {
+		return
+	}
+	l.log("debug", keyvals)
+}
+
+// With returns a new logger that includes keyvals in every log line.
+func (l *Logger) With(keyvals ...interface{}) log.Logger {
+	l2 := *l
+	l2.context = append(append([]interface{}{}, l.context...), keyvals...)
+	return &l2
+}
+
+// value converts v into a JSON-friendly value.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	case encoding.TextMarshaler:
+		if b, err := t.MarshalText(); err == nil {
+			return string(b)
+		}
+	case json.Marshaler:
+		return t
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+func (l *Logger) log(level string, keyvals []interface{}) {
+	all := append(append([]interface{}{}, l.context...), keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "MISSING")
+	}
+
+	m := make(map[string]interface{}, len(all)/2+2)
+	m["ts"] = l.now().UTC().Format(time.RFC3339Nano)
+	m["level"] = level
+	for i := 0; i < len(all); i += 2 {
+		m[fmt.Sprint(all[i])] = value(all[i+1])
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"error","msg":"marshal log line","err":%q}`, err.Error()))
+	}
+	b = append(b, '\n')
+
+	l.w.Lock()
+	defer l.w.Unlock()
+	l.w.w.Write(b)
+}
@@ -0,0 +1,42 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := New(WithWriter(buf))
+	l.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	l.With("service", "test").Info("msg", "hello", "err", errors.New("oops"), "count", 3)
+
+	// debug logging is disabled by default
+	l.Debug("msg", "not logged")
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"ts":      "2024-01-02T03:04:05Z",
+		"level":   "info",
+		"service": "test",
+		"msg":     "hello",
+		"err":     "oops",
+		"count":   float64(3),
+	}
+	for k, v := range want {
+		if have := m[k]; have != v {
+			t.Errorf("%s: have: %v, want: %v", k, have, v)
+		}
+	}
+	if have, want := len(m), len(want); have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,33 @@
+// Package kv defines a minimal key-value storage bucket.
+// NanoHUB subsystems build their storage on top of buckets so that
+// a single set of backends can serve all of them.
+package kv
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrKeyNotFound is returned when a key does not exist in a bucket.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Bucket is a simple key-value store.
+type Bucket interface {
+	// Get retrieves the value of key.
+	// ErrKeyNotFound is returned if key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set sets key to value.
+	Set(ctx context.Context, key string, value []byte) error
+
+	// Has reports whether key exists.
+	Has(ctx context.Context, key string) (bool, error)
+
+	// Delete removes key.
+	// Deleting a non-existent key is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// KeysPrefix returns the sorted keys that begin with prefix.
+	// An empty prefix returns all keys.
+	KeysPrefix(ctx context.Context, prefix string) ([]string, error)
+}
@@ -0,0 +1,67 @@
+// Package kvdiskv implements a key-value bucket backed by diskv.
+package kvdiskv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sort"
+
+	"github.com/micromdm/nanohub/kv"
+
+	"github.com/peterbourgon/diskv/v3"
+)
+
+// KVDiskv is a filesystem key-value bucket.
+type KVDiskv struct {
+	diskv *diskv.Diskv
+}
+
+// New creates a new filesystem key-value bucket rooted at path.
+func New(path string) *KVDiskv {
+	return &KVDiskv{
+		diskv: diskv.New(diskv.Options{
+			BasePath:     path,
+			Transform:    func(string) []string { return []string{} },
+			CacheSizeMax: 1024 * 1024,
+		}),
+	}
+}
+
+// Get retrieves the value of key.
+func (b *KVDiskv) Get(_ context.Context, key string) ([]byte, error) {
+	v, err := b.diskv.Read(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, kv.ErrKeyNotFound
+	}
+	return v, err
+}
+
+// Set sets key to value.
+func (b *KVDiskv) Set(_ context.Context, key string, value []byte) error {
+	return b.diskv.Write(key, value)
+}
+
+// Has reports whether key exists.
+func (b *KVDiskv) Has(_ context.Context, key string) (bool, error) {
+	return b.diskv.Has(key), nil
+}
+
+// Delete removes key.
+func (b *KVDiskv) Delete(_ context.Context, key string) error {
+	err := b.diskv.Erase(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// KeysPrefix returns the sorted keys that begin with prefix.
+func (b *KVDiskv) KeysPrefix(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for k := range b.diskv.KeysPrefix(prefix, nil) {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
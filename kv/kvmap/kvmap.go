@@ -0,0 +1,71 @@
+// Package kvmap implements an in-memory key-value bucket.
+package kvmap
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVMap is an in-memory key-value bucket.
+type KVMap struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+// New creates a new in-memory key-value bucket.
+func New() *KVMap {
+	return &KVMap{m: make(map[string][]byte)}
+}
+
+// Get retrieves the value of key.
+func (b *KVMap) Get(_ context.Context, key string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	v, ok := b.m[key]
+	if !ok {
+		return nil, kv.ErrKeyNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Set sets key to value.
+func (b *KVMap) Set(_ context.Context, key string, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.m[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Has reports whether key exists.
+func (b *KVMap) Has(_ context.Context, key string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.m[key]
+	return ok, nil
+}
+
+// Delete removes key.
+func (b *KVMap) Delete(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.m, key)
+	return nil
+}
+
+// KeysPrefix returns the sorted keys that begin with prefix.
+func (b *KVMap) KeysPrefix(_ context.Context, prefix string) ([]string, error) {
+	b.mu.RLock()
+	var keys []string
+	for k := range b.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Strings(keys)
+	return keys, nil
+}
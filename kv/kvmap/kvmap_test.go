@@ -0,0 +1,52 @@
+package kvmap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+func TestKVMap(t *testing.T) {
+	ctx := context.Background()
+	b := New()
+
+	if _, err := b.Get(ctx, "missing"); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("have: %v, want: %v", err, kv.ErrKeyNotFound)
+	}
+
+	for _, k := range []string{"b.2", "a.1", "b.1"} {
+		if err := b.Set(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := b.Get(ctx, "a.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(v), "a.1"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	keys, err := b.KeysPrefix(ctx, "b.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := keys, []string{"b.1", "b.2"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	if err = b.Delete(ctx, "b.1"); err != nil {
+		t.Fatal(err)
+	}
+	found, err := b.Has(ctx, "b.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("key found after delete")
+	}
+}
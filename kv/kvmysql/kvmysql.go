@@ -0,0 +1,103 @@
+// Package kvmysql implements a key-value bucket backed by MySQL.
+// See schema.sql for the required table.
+package kvmysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVMySQL is a MySQL key-value bucket.
+// Many buckets may share the same table and database handle.
+type KVMySQL struct {
+	db     *sql.DB
+	bucket string
+}
+
+// New creates a new MySQL key-value bucket named bucket using db.
+func New(db *sql.DB, bucket string) *KVMySQL {
+	if db == nil {
+		panic("nil db")
+	}
+	if bucket == "" {
+		panic("empty bucket")
+	}
+	return &KVMySQL{db: db, bucket: bucket}
+}
+
+// Get retrieves the value of key.
+func (b *KVMySQL) Get(ctx context.Context, key string) ([]byte, error) {
+	var v []byte
+	err := b.db.QueryRowContext(
+		ctx,
+		`SELECT v FROM nanohub_kv WHERE bucket = ? AND k = ?;`,
+		b.bucket, key,
+	).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, kv.ErrKeyNotFound
+	}
+	return v, err
+}
+
+// Set sets key to value.
+func (b *KVMySQL) Set(ctx context.Context, key string, value []byte) error {
+	_, err := b.db.ExecContext(
+		ctx,
+		`INSERT INTO nanohub_kv (bucket, k, v) VALUES (?, ?, ?) AS new
+ON DUPLICATE KEY UPDATE v = new.v;`,
+		b.bucket, key, value,
+	)
+	return err
+}
+
+// Has reports whether key exists.
+func (b *KVMySQL) Has(ctx context.Context, key string) (bool, error) {
+	var found bool
+	err := b.db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) > 0 FROM nanohub_kv WHERE bucket = ? AND k = ?;`,
+		b.bucket, key,
+	).Scan(&found)
+	return found, err
+}
+
+// Delete removes key.
+func (b *KVMySQL) Delete(ctx context.Context, key string) error {
+	_, err := b.db.ExecContext(
+		ctx,
+		`DELETE FROM nanohub_kv WHERE bucket = ? AND k = ?;`,
+		b.bucket, key,
+	)
+	return err
+}
+
+// escapeLike escapes the LIKE wildcard characters in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// KeysPrefix returns the sorted keys that begin with prefix.
+func (b *KVMySQL) KeysPrefix(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := b.db.QueryContext(
+		ctx,
+		`SELECT k FROM nanohub_kv WHERE bucket = ? AND k LIKE ? ORDER BY k;`,
+		b.bucket, escapeLike(prefix)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
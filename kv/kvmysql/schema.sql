@@ -0,0 +1,10 @@
+CREATE TABLE nanohub_kv (
+    bucket VARCHAR(63)    NOT NULL,
+    k      VARBINARY(255) NOT NULL,
+    v      MEDIUMBLOB     NOT NULL,
+
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (bucket, k)
+);
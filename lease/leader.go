@@ -0,0 +1,125 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Task is a background task run while leading.
+// It should return once ctx is done.
+type Task func(ctx context.Context) error
+
+type namedTask struct {
+	name string
+	run  Task
+}
+
+// Leader runs background tasks only while holding its lease so that
+// exactly one replica runs them.
+type Leader struct {
+	lease *Lease
+
+	mu      sync.Mutex
+	tasks   []namedTask
+	leading bool
+}
+
+// NewLeader creates a new leader using the lease l.
+func NewLeader(l *Lease) *Leader {
+	if l == nil {
+		panic("nil lease")
+	}
+	return &Leader{lease: l}
+}
+
+// Go registers the task run named name. It is started whenever the
+// leader acquires its lease and its context is canceled when the lease
+// is lost. Tasks must be registered before Run.
+func (l *Leader) Go(name string, run Task) {
+	if run == nil {
+		panic("nil task")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tasks = append(l.tasks, namedTask{name: name, run: run})
+}
+
+// Leading reports whether the leader runs its tasks.
+func (l *Leader) Leading() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// start starts the tasks with a context derived from ctx and returns
+// the function canceling it.
+func (l *Leader) start(ctx context.Context, wg *sync.WaitGroup) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leading = true
+	logger := ctxlog.Logger(ctx, l.lease.logger)
+	for _, t := range l.tasks {
+		wg.Add(1)
+		go func(t namedTask) {
+			defer wg.Done()
+			err := t.run(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logger.Info("msg", "task stopped", "task", t.name, "err", err)
+				return
+			}
+			logger.Debug("msg", "task stopped", "task", t.name)
+		}(t)
+	}
+	return cancel
+}
+
+// Run acquires and renews the lease every interval until ctx is done.
+// Interval must be shorter than half the lease ttl to keep holding it.
+// The lease is released when Run returns.
+func (l *Leader) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := l.lease.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	var cancel context.CancelFunc
+	stop := func() {
+		if cancel == nil {
+			return
+		}
+		cancel()
+		cancel = nil
+		wg.Wait()
+		l.mu.Lock()
+		l.leading = false
+		l.mu.Unlock()
+	}
+	defer func() {
+		stop()
+		if err := l.lease.Release(context.Background()); err != nil {
+			ctxlog.Logger(ctx, l.lease.logger).Info("err", err)
+		}
+	}()
+
+	for {
+		held := l.lease.Held(ctx)
+		if held && cancel == nil {
+			cancel = l.start(ctx, &wg)
+		} else if !held {
+			stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
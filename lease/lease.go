@@ -0,0 +1,206 @@
+// Package lease coordinates NanoHUB replicas with time-limited named
+// leases so that only one replica at a time performs a task.
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Locker acquires leases.
+type Locker interface {
+	// Acquire acquires the lease name for holder or renews it if holder
+	// already holds it. The lease expires after ttl unless renewed.
+	// It reports whether holder holds the lease.
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+
+	// Release releases the lease name if holder holds it.
+	Release(ctx context.Context, name, holder string) error
+}
+
+// MemLocker is an in-memory locker.
+// It only coordinates within a single process.
+type MemLocker struct {
+	mu     sync.Mutex
+	leases map[string]memLease
+	clock  clock.Clock
+}
+
+type memLease struct {
+	holder  string
+	expires time.Time
+}
+
+// NewMemLocker creates a new in-memory locker using c.
+func NewMemLocker(c clock.Clock) *MemLocker {
+	if c == nil {
+		panic("nil clock")
+	}
+	return &MemLocker{leases: make(map[string]memLease), clock: c}
+}
+
+// Acquire acquires or renews the lease name for holder.
+func (l *MemLocker) Acquire(_ context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if cur, ok := l.leases[name]; ok && cur.holder != holder && now.Before(cur.expires) {
+		return false, nil
+	}
+	l.leases[name] = memLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Release releases the lease name if holder holds it.
+func (l *MemLocker) Release(_ context.Context, name, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cur, ok := l.leases[name]; ok && cur.holder == holder {
+		delete(l.leases, name)
+	}
+	return nil
+}
+
+// NewHolder returns a holder name unique to this process.
+// It is the host name followed by a random suffix.
+func NewHolder() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "nanohub"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// Lease is a named lease held by this process while it is renewed.
+type Lease struct {
+	locker Locker
+	name   string
+	holder string
+	ttl    time.Duration
+	clock  clock.Clock
+	logger log.Logger
+
+	mu      sync.Mutex
+	held    bool
+	renewed time.Time
+}
+
+// Option configures the lease.
+type Option func(*Lease)
+
+// WithHolder configures the holder name of the lease.
+// The default is from NewHolder.
+func WithHolder(holder string) Option {
+	if holder == "" {
+		panic("empty holder")
+	}
+	return func(l *Lease) {
+		l.holder = holder
+	}
+}
+
+// WithClock configures the clock of the lease.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(l *Lease) {
+		l.clock = c
+	}
+}
+
+// WithLogger configures a logger for the lease.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(l *Lease) {
+		l.logger = logger
+	}
+}
+
+// New creates a new lease name using locker that expires after ttl
+// unless renewed.
+func New(locker Locker, name string, ttl time.Duration, opts ...Option) *Lease {
+	if locker == nil {
+		panic("nil locker")
+	}
+	if name == "" {
+		panic("empty name")
+	}
+	if ttl <= 0 {
+		panic("invalid ttl")
+	}
+	l := &Lease{
+		locker: locker,
+		name:   name,
+		ttl:    ttl,
+		clock:  clock.Real,
+		logger: log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.holder == "" {
+		l.holder = NewHolder()
+	}
+	return l
+}
+
+// Holder returns the holder name of the lease.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Held reports whether this process holds the lease. It acquires the
+// lease if it is free and renews it once half its ttl elapsed, so it
+// must be called more often than ttl to keep holding the lease.
+// Errors are logged and not holding the lease is assumed.
+func (l *Lease) Held(ctx context.Context) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if l.held && now.Sub(l.renewed) < l.ttl/2 {
+		return true
+	}
+	logger := ctxlog.Logger(ctx, l.logger)
+	held, err := l.locker.Acquire(ctx, l.name, l.holder, l.ttl)
+	if err != nil {
+		logger.Info("msg", "acquiring lease", "lease", l.name, "err", err)
+		held = false
+	}
+	if held != l.held {
+		logger.Info("msg", "lease changed", "lease", l.name, "holder", l.holder, "held", held)
+	}
+	l.held = held
+	if held {
+		l.renewed = now
+	}
+	return held
+}
+
+// Release releases the lease if this process holds it.
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return nil
+	}
+	l.held = false
+	if err := l.locker.Release(ctx, l.name, l.holder); err != nil {
+		return fmt.Errorf("releasing lease %s: %w", l.name, err)
+	}
+	return nil
+}
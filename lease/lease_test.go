@@ -0,0 +1,89 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemLocker(fake)
+	a := New(locker, "worker", time.Minute, WithHolder("a"), WithClock(fake))
+	b := New(locker, "worker", time.Minute, WithHolder("b"), WithClock(fake))
+
+	if !a.Held(ctx) {
+		t.Fatal("a: lease not held")
+	}
+	if b.Held(ctx) {
+		t.Fatal("b: lease held while a holds it")
+	}
+
+	// a renews the lease past its initial expiry
+	fake.Advance(45 * time.Second)
+	if !a.Held(ctx) {
+		t.Fatal("a: lease not renewed")
+	}
+	fake.Advance(45 * time.Second)
+	if b.Held(ctx) {
+		t.Fatal("b: lease held after renewal")
+	}
+
+	// b takes over once a stops renewing
+	fake.Advance(time.Minute)
+	if !b.Held(ctx) {
+		t.Fatal("b: expired lease not acquired")
+	}
+	if a.Held(ctx) {
+		t.Fatal("a: lease held after expiry")
+	}
+
+	// releasing frees the lease
+	if err := b.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Held(ctx) {
+		t.Fatal("a: released lease not acquired")
+	}
+}
+
+func TestLeader(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemLocker(fake)
+	a := NewLeader(New(locker, "leader", time.Minute, WithHolder("a"), WithClock(fake)))
+	b := New(locker, "leader", time.Minute, WithHolder("b"), WithClock(fake))
+
+	started, stopped := make(chan struct{}), make(chan struct{})
+	a.Go("test", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx, 20*time.Second) }()
+
+	<-started
+	if !a.Leading() {
+		t.Error("a: not leading with started tasks")
+	}
+	if b.Held(context.Background()) {
+		t.Error("b: lease held while a leads")
+	}
+
+	// stopping the leader stops its tasks and releases the lease
+	cancel()
+	<-stopped
+	<-done
+	if a.Leading() {
+		t.Error("a: leading after stop")
+	}
+	if !b.Held(context.Background()) {
+		t.Error("b: lease not acquired after a stopped")
+	}
+}
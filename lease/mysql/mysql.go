@@ -0,0 +1,76 @@
+// Package mysql implements leases backed by MySQL.
+// See schema.sql for the required table.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Locker acquires leases in MySQL.
+// Lease expiry uses the database clock so replica clocks may differ.
+type Locker struct {
+	db *sql.DB
+}
+
+// New creates a new MySQL locker using db.
+func New(db *sql.DB) *Locker {
+	if db == nil {
+		panic("nil db")
+	}
+	return &Locker{db: db}
+}
+
+// Acquire acquires the lease name for holder if it is free or expired,
+// or renews it if holder already holds it.
+func (l *Locker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	_, err := l.db.ExecContext(
+		ctx,
+		`INSERT IGNORE INTO nanohub_leases (name, holder, expires_at) VALUES (?, ?, NOW(6) + INTERVAL ? MICROSECOND);`,
+		name, holder, ttl.Microseconds(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("inserting lease: %w", err)
+	}
+	_, err = l.db.ExecContext(
+		ctx, `
+UPDATE
+    nanohub_leases
+SET
+    holder = ?,
+    expires_at = NOW(6) + INTERVAL ? MICROSECOND
+WHERE
+    name = ? AND
+    (holder = ? OR expires_at < NOW(6));`,
+		holder, ttl.Microseconds(), name, holder,
+	)
+	if err != nil {
+		return false, fmt.Errorf("updating lease: %w", err)
+	}
+	var cur string
+	err = l.db.QueryRowContext(
+		ctx,
+		`SELECT holder FROM nanohub_leases WHERE name = ?;`,
+		name,
+	).Scan(&cur)
+	if errors.Is(err, sql.ErrNoRows) {
+		// released between the statements
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("selecting lease: %w", err)
+	}
+	return cur == holder, nil
+}
+
+// Release releases the lease name if holder holds it.
+func (l *Locker) Release(ctx context.Context, name, holder string) error {
+	_, err := l.db.ExecContext(
+		ctx,
+		`DELETE FROM nanohub_leases WHERE name = ? AND holder = ?;`,
+		name, holder,
+	)
+	return err
+}
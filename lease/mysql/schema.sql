@@ -0,0 +1,11 @@
+CREATE TABLE nanohub_leases (
+    name   VARCHAR(63)  NOT NULL,
+    holder VARCHAR(255) NOT NULL,
+
+    expires_at TIMESTAMP(6) NOT NULL,
+
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (name)
+);
@@ -0,0 +1,152 @@
+// Package http provides the HTTP API for enrollment lifecycle management.
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/lifecycle"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// changeHandler changes the lifecycle state of the enrollment ID in the
+// URL path with change and returns the result.
+func changeHandler(change func(context.Context, string) (*lifecycle.Result, error), logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		res, err := change(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "changing enrollment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, res, logger)
+	}
+}
+
+// DisableHandler disables the enrollment ID in the URL path.
+func DisableHandler(m *lifecycle.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return changeHandler(m.Disable, logger)
+}
+
+// DeleteHandler deletes the enrollment ID in the URL path.
+func DeleteHandler(m *lifecycle.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return changeHandler(m.Delete, logger)
+}
+
+// recordHandler returns the lifecycle record of the enrollment ID in the
+// URL path from fn.
+func recordHandler(fn func(context.Context, string) (*lifecycle.Record, error), logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		rec, err := fn(r.Context(), id)
+		if errors.Is(err, lifecycle.ErrNotFound) {
+			httpapi.JSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving lifecycle record", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, rec, logger)
+	}
+}
+
+// EnableHandler re-enables the enrollment ID in the URL path.
+// A 202 Accepted status is returned if the enrollment is only enabled
+// when it enrolls again.
+func EnableHandler(m *lifecycle.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		res, err := m.Enable(r.Context(), id)
+		if errors.Is(err, lifecycle.ErrNotFound) {
+			httpapi.JSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Info("msg", "enabling enrollment", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		if res.State == lifecycle.StateReenroll {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+		}
+		httpapi.WriteJSON(w, res, logger)
+	}
+}
+
+// GetHandler returns the lifecycle record of the enrollment ID in the URL path.
+func GetHandler(m *lifecycle.Manager, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil manager")
+	}
+	return recordHandler(m.Record, logger)
+}
+
+// HandleAPIv1 registers the enrollment lifecycle API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, m *lifecycle.Manager) {
+	mux.Handle(
+		prefix+"/enrollments/:id/lifecycle",
+		GetHandler(m, logger.With("handler", "get-lifecycle")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/disable",
+		DisableHandler(m, logger.With("handler", "disable-enrollment")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/enable",
+		EnableHandler(m, logger.With("handler", "enable-enrollment")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id",
+		DeleteHandler(m, logger.With("handler", "delete-enrollment")),
+		"DELETE",
+	)
+}
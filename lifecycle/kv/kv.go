@@ -0,0 +1,147 @@
+// Package kv deletes enrollment data directly from NanoMDM's and
+// KMFDDM's key-value storage buckets (e.g. of their file storage).
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanolib/storage/kv"
+)
+
+// keys of NanoMDM and KMFDDM key-value storage.
+const (
+	keySep = "."
+
+	keyUserChannel = "user_ch"
+	keyDisabled    = "disabled"
+	keyCertHash    = "cert_hash"
+	keyHashCert    = "hash_cert"
+)
+
+// statusPrefixes are the KMFDDM key prefixes of status reports,
+// declaration statuses, status values, and status errors.
+var statusPrefixes = []string{"rs", "ds", "vs", "es"}
+
+// deletePrefix deletes the keys of b beginning with prefix.
+func deletePrefix(ctx context.Context, b kv.Bucket, prefix string) error {
+	return kv.DeleteSlice(ctx, b, kv.AllKeysPrefix(ctx, b, prefix))
+}
+
+// Enrollments deletes enrollments from NanoMDM key-value storage.
+type Enrollments struct {
+	devices     kv.Bucket
+	enrollments kv.Bucket
+	users       kv.Bucket
+	queue       kv.Bucket
+	certAuth    kv.Bucket
+}
+
+// NewEnrollments creates a new enrollment cleaner using the buckets of
+// NanoMDM key-value storage. The buckets should be shared with the
+// storage so that caches stay consistent.
+func NewEnrollments(devices, enrollments, users, queue, certAuth kv.Bucket) *Enrollments {
+	if devices == nil || enrollments == nil || users == nil || queue == nil || certAuth == nil {
+		panic("nil bucket")
+	}
+	return &Enrollments{
+		devices:     devices,
+		enrollments: enrollments,
+		users:       users,
+		queue:       queue,
+		certAuth:    certAuth,
+	}
+}
+
+// userChannelPrefix returns the enrollments key prefix of the user
+// channels of device id.
+func userChannelPrefix(id string) string {
+	return id + keySep + keyUserChannel + keySep
+}
+
+// enrollmentIDs returns device id and the IDs of its user channels.
+func (s *Enrollments) enrollmentIDs(ctx context.Context, id string) []string {
+	ids := []string{id}
+	pfx := userChannelPrefix(id)
+	for _, key := range kv.AllKeysPrefix(ctx, s.enrollments, pfx) {
+		if ucID := key[len(pfx):]; !strings.Contains(ucID, keySep) {
+			ids = append(ids, ucID)
+		}
+	}
+	return ids
+}
+
+// Enable re-enables device id and its user channels.
+func (s *Enrollments) Enable(ctx context.Context, id string) error {
+	// NanoMDM disables the user channels of a device with a key below
+	// their prefix rather than with a key of each user channel
+	keys := []string{userChannelPrefix(id) + keySep + keyDisabled}
+	for _, id := range s.enrollmentIDs(ctx, id) {
+		keys = append(keys, id+keySep+keyDisabled)
+	}
+	if err := kv.DeleteSlice(ctx, s.enrollments, keys); err != nil {
+		return fmt.Errorf("enabling %s: %w", id, err)
+	}
+	return nil
+}
+
+// Clean deletes device id with its user channels, enrollments, push
+// tokens, command queues, command results, and certificate associations.
+// Commands are shared between enrollments and are not deleted.
+func (s *Enrollments) Clean(ctx context.Context, id string) error {
+	for _, id := range s.enrollmentIDs(ctx, id) {
+		hash, err := s.certAuth.Get(ctx, id+keySep+keyCertHash)
+		if err == nil {
+			err = s.certAuth.Delete(ctx, string(hash)+keySep+keyHashCert)
+		} else if errors.Is(err, kv.ErrKeyNotFound) {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("deleting certificate association of %s: %w", id, err)
+		}
+		for name, b := range map[string]kv.Bucket{
+			"devices":     s.devices,
+			"enrollments": s.enrollments,
+			"users":       s.users,
+			"queue":       s.queue,
+			"cert_auth":   s.certAuth,
+		} {
+			if err = deletePrefix(ctx, b, id+keySep); err != nil {
+				return fmt.Errorf("deleting %s of %s: %w", name, id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Status deletes the DM status of enrollments from KMFDDM key-value storage.
+type Status struct {
+	status kv.Bucket
+}
+
+// NewStatus creates a new status cleaner using the status bucket of
+// KMFDDM key-value storage. The bucket should be shared with the
+// storage so that caches stay consistent.
+func NewStatus(status kv.Bucket) *Status {
+	if status == nil {
+		panic("nil bucket")
+	}
+	return &Status{status: status}
+}
+
+// Clean deletes the declaration statuses, status values, errors, and
+// status reports of enrollment id.
+func (s *Status) Clean(ctx context.Context, id string) error {
+	for _, pfx := range statusPrefixes {
+		// status errors are indexed by a key without suffix
+		if err := s.status.Delete(ctx, pfx+keySep+id); err != nil {
+			return fmt.Errorf("deleting %s index: %w", pfx, err)
+		}
+		if err := deletePrefix(ctx, s.status, pfx+keySep+id+keySep); err != nil {
+			return fmt.Errorf("deleting %s: %w", pfx, err)
+		}
+	}
+	return nil
+}
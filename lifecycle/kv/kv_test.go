@@ -0,0 +1,142 @@
+package kv
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"testing"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	dmkv "github.com/jessepeterson/kmfddm/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv"
+	"github.com/micromdm/nanolib/storage/kv/kvmap"
+	"github.com/micromdm/nanolib/storage/kv/kvtxn"
+	"github.com/micromdm/nanomdm/mdm"
+	mdmkv "github.com/micromdm/nanomdm/storage/kv"
+)
+
+func newBucket() kv.TxnBucketWithCRUD {
+	return kvtxn.New(kvmap.New())
+}
+
+// enroll stores the check-ins of device id and its user channel into s.
+func enroll(t *testing.T, s *mdmkv.KV, id string) {
+	t.Helper()
+	push := mdm.Push{Topic: "com.example.topic", PushMagic: "magic", Token: []byte(id)}
+	r := mdm.NewRequestWithContext(context.Background(), nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+	if err := s.StoreAuthenticate(r, &mdm.Authenticate{Enrollment: mdm.Enrollment{UDID: id}, Topic: push.Topic, Raw: []byte("<plist/>")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreTokenUpdate(r, &mdm.TokenUpdate{Enrollment: mdm.Enrollment{UDID: id}, Push: push, Raw: []byte("<plist/>")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AssociateCertHash(r, "hash-"+id); err != nil {
+		t.Fatal(err)
+	}
+
+	r = mdm.NewRequestWithContext(context.Background(), nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.User, ID: id + ":user", ParentID: id}
+	if err := s.StoreTokenUpdate(r, &mdm.TokenUpdate{Enrollment: mdm.Enrollment{UDID: id, UserID: "user"}, Push: push, Raw: []byte("<plist/>")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keys returns the keys of b that contain s.
+func keys(ctx context.Context, b kv.Bucket, s string) (r []string) {
+	for _, k := range kv.AllKeys(ctx, b) {
+		if strings.Contains(k, s) {
+			r = append(r, k)
+		}
+	}
+	return
+}
+
+func TestEnrollments(t *testing.T) {
+	ctx := context.Background()
+	devices, enrollments, users, queue, certAuth := newBucket(), newBucket(), newBucket(), newBucket(), newBucket()
+	s := mdmkv.New(users, certAuth, queue, newBucket(), devices, enrollments)
+	enroll(t, s, "DEVICE1")
+	enroll(t, s, "DEVICE2")
+	cmd := &mdm.Command{CommandUUID: "UUID1", Raw: []byte("<plist/>")}
+	cmd.Command.RequestType = "DeviceInformation"
+	if _, err := s.EnqueueCommand(ctx, []string{"DEVICE1", "DEVICE1:user", "DEVICE2"}, cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewEnrollments(devices, enrollments, users, queue, certAuth).Clean(ctx, "DEVICE1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]kv.Bucket{
+		"devices":     devices,
+		"enrollments": enrollments,
+		"users":       users,
+		"queue":       queue,
+		"cert_auth":   certAuth,
+	} {
+		if have := keys(ctx, b, "DEVICE1"); len(have) != 0 {
+			t.Errorf("%s: have keys: %v", name, have)
+		}
+		if have := keys(ctx, b, "DEVICE2"); len(have) == 0 {
+			t.Errorf("%s: no keys of DEVICE2", name)
+		}
+	}
+	push, err := s.RetrievePushInfo(ctx, []string{"DEVICE1", "DEVICE1:user", "DEVICE2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(push) != 1 || push["DEVICE2"] == nil {
+		t.Errorf("unexpected push info: %v", push)
+	}
+	if id, err := s.EnrollmentFromHash(ctx, "hash-DEVICE1"); err != nil || id != "" {
+		t.Errorf("have: %q (err %v), want: empty", id, err)
+	}
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: "DEVICE2"}
+	if err = s.Disable(r); err != nil {
+		t.Fatal(err)
+	}
+	if have := keys(ctx, enrollments, keyDisabled); len(have) != 2 {
+		t.Errorf("disabled: have keys: %v", have)
+	}
+	if err = NewEnrollments(devices, enrollments, users, queue, certAuth).Enable(ctx, "DEVICE2"); err != nil {
+		t.Fatal(err)
+	}
+	if have := keys(ctx, enrollments, keyDisabled); len(have) != 0 {
+		t.Errorf("enabled: have keys: %v", have)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	status := newBucket()
+	s := dmkv.New(fnv.New128, newBucket(), newBucket(), newBucket(), status)
+	_, report, err := ddm.ParseStatus([]byte(`{
+    "StatusItems": {
+        "device": {"model": {"family": "Mac"}},
+        "management": {"declarations": {"configurations": [{"active": true, "identifier": "d1", "server-token": "t1", "valid": "valid"}]}}
+    },
+    "Errors": [{"StatusItem": "device.operating-system.family", "Reasons": [{"Code": "Error.NotSupported"}]}]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"DEVICE1", "DEVICE2"} {
+		if err = s.StoreDeclarationStatus(ctx, id, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = NewStatus(status).Clean(ctx, "DEVICE1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := keys(ctx, status, "DEVICE1"); len(have) != 0 {
+		t.Errorf("have keys: %v", have)
+	}
+	if have := keys(ctx, status, "DEVICE2"); len(have) == 0 {
+		t.Error("no keys of DEVICE2")
+	}
+}
@@ -0,0 +1,317 @@
+// Package lifecycle disables, re-enables, and deletes enrollments with
+// cleanup cascading across the configured storage backends.
+//
+// NanoMDM storage can only disable enrollments and clear their command
+// queues. Other data (e.g. DM set associations, workflow state, and
+// inventory) is removed by named cleaners and disabled enrollments are
+// re-enabled by an enabler. As NanoMDM re-enables enrollments on their
+// next TokenUpdate check-in the manager is also a NanoMDM service that
+// disables them again until they are re-enabled or, if deleted, enroll
+// again.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Enrollment states.
+const (
+	// StateDisabled is an enrollment disabled until re-enabled.
+	StateDisabled = "disabled"
+
+	// StateDeleted is a deleted enrollment. Deleted enrollments are
+	// forgotten when they enroll again.
+	StateDeleted = "deleted"
+
+	// StateEnabled is an enrollment re-enabled in NanoMDM storage.
+	StateEnabled = "enabled"
+
+	// StateReenroll is a re-enabled enrollment that NanoMDM storage
+	// enables when it enrolls again (i.e. on its next TokenUpdate
+	// check-in). Deleted enrollments and enrollments without an enabler
+	// must enroll again.
+	StateReenroll = "reenroll"
+)
+
+// ErrNotFound is returned when an enrollment is neither disabled nor deleted.
+var ErrNotFound = errors.New("enrollment not disabled or deleted")
+
+// Record is the lifecycle state of an enrollment.
+type Record struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Result is the outcome of a lifecycle change of an enrollment.
+type Result struct {
+	*Record
+
+	// Errors contains the errors of failed cleanups by cleaner name.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Store stores lifecycle records.
+type Store interface {
+	StoreRecord(ctx context.Context, r *Record) error
+
+	// RetrieveRecord retrieves the record of enrollment id.
+	// Nil is returned if id has no record.
+	RetrieveRecord(ctx context.Context, id string) (*Record, error)
+
+	DeleteRecord(ctx context.Context, id string) error
+}
+
+// MDMStore is the NanoMDM storage of enrollments and their command queues.
+type MDMStore interface {
+	Disable(r *mdm.Request) error
+	ClearQueue(r *mdm.Request) error
+}
+
+// Enabler re-enables disabled enrollments in NanoMDM storage.
+type Enabler interface {
+	// Enable re-enables device id and its user channels.
+	Enable(ctx context.Context, id string) error
+}
+
+// Cleaner removes the data of an enrollment from a storage backend.
+type Cleaner interface {
+	Clean(ctx context.Context, id string) error
+}
+
+// CleanerFunc adapts a function to a Cleaner.
+type CleanerFunc func(ctx context.Context, id string) error
+
+// Clean calls f(ctx, id).
+func (f CleanerFunc) Clean(ctx context.Context, id string) error {
+	return f(ctx, id)
+}
+
+// namedCleaner is a cleaner with its name.
+type namedCleaner struct {
+	name    string
+	cleaner Cleaner
+}
+
+// Manager changes the lifecycle state of enrollments.
+type Manager struct {
+	service.CheckinAndCommandService
+
+	store     Store
+	mdm       MDMStore
+	disablers []namedCleaner
+	deleters  []namedCleaner
+	enabler   Enabler
+	logger    log.Logger
+	clock     clock.Clock
+}
+
+// Option configures the manager.
+type Option func(*Manager)
+
+// WithDisableCleaner runs cleaner when enrollments are disabled or
+// deleted. Name identifies the cleaner in logs and results.
+func WithDisableCleaner(name string, cleaner Cleaner) Option {
+	if cleaner == nil {
+		panic("nil cleaner")
+	}
+	return func(m *Manager) {
+		m.disablers = append(m.disablers, namedCleaner{name: name, cleaner: cleaner})
+	}
+}
+
+// WithDeleteCleaner runs cleaner when enrollments are deleted.
+// Name identifies the cleaner in logs and results.
+func WithDeleteCleaner(name string, cleaner Cleaner) Option {
+	if cleaner == nil {
+		panic("nil cleaner")
+	}
+	return func(m *Manager) {
+		m.deleters = append(m.deleters, namedCleaner{name: name, cleaner: cleaner})
+	}
+}
+
+// WithEnabler re-enables disabled enrollments in NanoMDM storage with
+// enabler. Otherwise they are only enabled when they enroll again.
+func WithEnabler(enabler Enabler) Option {
+	if enabler == nil {
+		panic("nil enabler")
+	}
+	return func(m *Manager) {
+		m.enabler = enabler
+	}
+}
+
+// WithLogger configures a logger for the manager.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithClock configures the clock of the manager.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// New creates a new manager.
+func New(store Store, mdmStore MDMStore, opts ...Option) *Manager {
+	if store == nil {
+		panic("nil store")
+	}
+	if mdmStore == nil {
+		panic("nil MDM store")
+	}
+	m := &Manager{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		mdm:                      mdmStore,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// newRequest creates a new request for enrollment id.
+func newRequest(ctx context.Context, id string) *mdm.Request {
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: id}
+	return r
+}
+
+// clean runs cleaners for id and records their errors in res.
+// Cleaning continues after errors.
+func (m *Manager) clean(ctx context.Context, id string, res *Result, cleaners []namedCleaner) {
+	logger := ctxlog.Logger(ctx, m.logger)
+	for _, c := range cleaners {
+		if err := c.cleaner.Clean(ctx, id); err != nil {
+			if res.Errors == nil {
+				res.Errors = make(map[string]string)
+			}
+			res.Errors[c.name] = err.Error()
+			logger.Info("msg", "cleaning enrollment", "id", id, "cleaner", c.name, "err", err)
+			continue
+		}
+		logger.Debug("msg", "cleaned enrollment", "id", id, "cleaner", c.name)
+	}
+}
+
+// change stores the state of id and disables it in NanoMDM storage.
+// The disable cleaners and then cleaners are run.
+func (m *Manager) change(ctx context.Context, id, state string, cleaners []namedCleaner) (*Result, error) {
+	if id == "" {
+		return nil, errors.New("empty enrollment id")
+	}
+	res := &Result{Record: &Record{ID: id, State: state, UpdatedAt: m.clock.Now()}}
+	if err := m.store.StoreRecord(ctx, res.Record); err != nil {
+		return nil, fmt.Errorf("storing record: %w", err)
+	}
+
+	r := newRequest(ctx, id)
+	m.clean(ctx, id, res, []namedCleaner{
+		{name: "mdm-disable", cleaner: CleanerFunc(func(_ context.Context, _ string) error { return m.mdm.Disable(r) })},
+		{name: "mdm-queue", cleaner: CleanerFunc(func(_ context.Context, _ string) error { return m.mdm.ClearQueue(r) })},
+	})
+	m.clean(ctx, id, res, m.disablers)
+	m.clean(ctx, id, res, cleaners)
+	return res, nil
+}
+
+// Disable disables enrollment id: it is disabled in NanoMDM storage,
+// its command queue is cleared, and the disable cleaners are run.
+// The enrollment stays disabled until re-enabled with Enable.
+func (m *Manager) Disable(ctx context.Context, id string) (*Result, error) {
+	return m.change(ctx, id, StateDisabled, nil)
+}
+
+// Delete deletes enrollment id: it is disabled and then the delete
+// cleaners are run. A deleted enrollment may enroll again.
+func (m *Manager) Delete(ctx context.Context, id string) (*Result, error) {
+	return m.change(ctx, id, StateDeleted, m.deleters)
+}
+
+// Enable re-enables disabled or deleted enrollment id. Disabled
+// enrollments are re-enabled in NanoMDM storage with the enabler (if
+// any) and have the state StateEnabled. Otherwise the state is
+// StateReenroll: NanoMDM storage enables the enrollment when it enrolls
+// again. ErrNotFound is returned if id is neither disabled nor deleted.
+func (m *Manager) Enable(ctx context.Context, id string) (*Result, error) {
+	rec, err := m.Record(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.store.DeleteRecord(ctx, id); err != nil {
+		return nil, fmt.Errorf("deleting record: %w", err)
+	}
+	res := &Result{Record: &Record{ID: id, State: StateReenroll, UpdatedAt: m.clock.Now()}}
+	if rec.State != StateDisabled || m.enabler == nil {
+		return res, nil
+	}
+	if err = m.enabler.Enable(ctx, id); err != nil {
+		res.Errors = map[string]string{"mdm-enable": err.Error()}
+		ctxlog.Logger(ctx, m.logger).Info("msg", "enabling enrollment", "id", id, "err", err)
+		return res, nil
+	}
+	res.State = StateEnabled
+	return res, nil
+}
+
+// Record retrieves the lifecycle record of enrollment id.
+// ErrNotFound is returned if id is neither disabled nor deleted.
+func (m *Manager) Record(ctx context.Context, id string) (*Record, error) {
+	rec, err := m.store.RetrieveRecord(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving record: %w", err)
+	}
+	if rec == nil {
+		return nil, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Authenticate forgets deleted enrollments enrolling again.
+func (m *Manager) Authenticate(r *mdm.Request, _ *mdm.Authenticate) error {
+	if r.ParentID != "" {
+		return nil
+	}
+	rec, err := m.store.RetrieveRecord(r.Context(), r.ID)
+	if err != nil || rec == nil || rec.State != StateDeleted {
+		return err
+	}
+	return m.store.DeleteRecord(r.Context(), r.ID)
+}
+
+// TokenUpdate disables disabled and deleted enrollments again as
+// NanoMDM storage enables enrollments on TokenUpdate check-ins.
+func (m *Manager) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	if r.ParentID != "" {
+		return nil
+	}
+	rec, err := m.store.RetrieveRecord(r.Context(), r.ID)
+	if err != nil || rec == nil {
+		return err
+	}
+	ctxlog.Logger(r.Context(), m.logger).Info("msg", "disabling enrollment again", "id", r.ID, "state", rec.State)
+	return m.mdm.Disable(r)
+}
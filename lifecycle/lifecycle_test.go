@@ -0,0 +1,120 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type mdmStore struct {
+	disabled map[string]int
+	cleared  map[string]int
+	enabled  map[string]int
+}
+
+func (s *mdmStore) Disable(r *mdm.Request) error {
+	s.disabled[r.ID]++
+	return nil
+}
+
+func (s *mdmStore) ClearQueue(r *mdm.Request) error {
+	s.cleared[r.ID]++
+	return nil
+}
+
+func (s *mdmStore) Enable(_ context.Context, id string) error {
+	s.enabled[id]++
+	return nil
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	ms := &mdmStore{disabled: make(map[string]int), cleared: make(map[string]int), enabled: make(map[string]int)}
+	var steps, deleted []string
+	m := New(NewKVStore(kvmap.New()), ms,
+		WithDisableCleaner("steps", CleanerFunc(func(_ context.Context, id string) error {
+			steps = append(steps, id)
+			return nil
+		})),
+		WithDeleteCleaner("inventory", CleanerFunc(func(_ context.Context, id string) error {
+			deleted = append(deleted, id)
+			return nil
+		})),
+		WithDeleteCleaner("broken", CleanerFunc(func(context.Context, string) error {
+			return errors.New("broken")
+		})),
+		WithEnabler(ms),
+	)
+
+	res, err := m.Disable(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != StateDisabled || len(res.Errors) != 0 {
+		t.Errorf("disable: have %+v", res)
+	}
+	if ms.disabled["ID1"] != 1 || ms.cleared["ID1"] != 1 || len(steps) != 1 || len(deleted) != 0 {
+		t.Errorf("disable: disabled=%v cleared=%v steps=%v deleted=%v", ms.disabled, ms.cleared, steps, deleted)
+	}
+
+	// TokenUpdate re-enables in NanoMDM so disabled enrollments are disabled again
+	r := newRequest(ctx, "ID1")
+	if err = m.TokenUpdate(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := ms.disabled["ID1"], 2; have != want {
+		t.Errorf("disabled: have %d, want %d", have, want)
+	}
+
+	// disabled enrollments are re-enabled in NanoMDM storage
+	if res, err = m.Enable(ctx, "ID1"); err != nil {
+		t.Fatal(err)
+	}
+	if res.State != StateEnabled || ms.enabled["ID1"] != 1 {
+		t.Errorf("enable: have %+v, enabled=%v", res, ms.enabled)
+	}
+	if _, err = m.Enable(ctx, "ID1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("enable: have %v, want %v", err, ErrNotFound)
+	}
+	if err = m.TokenUpdate(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := ms.disabled["ID1"], 2; have != want {
+		t.Errorf("disabled: have %d, want %d", have, want)
+	}
+
+	// cleanups continue after errors
+	res, err = m.Delete(ctx, "ID2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != StateDeleted || res.Errors["broken"] != "broken" || len(res.Errors) != 1 {
+		t.Errorf("delete: have %+v", res)
+	}
+	if len(deleted) != 1 || deleted[0] != "ID2" || len(steps) != 2 {
+		t.Errorf("delete: steps=%v deleted=%v", steps, deleted)
+	}
+
+	// deleted enrollments are enabled when they enroll again
+	if _, err = m.Delete(ctx, "ID3"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = m.Enable(ctx, "ID3"); err != nil {
+		t.Fatal(err)
+	}
+	if res.State != StateReenroll || ms.enabled["ID3"] != 0 {
+		t.Errorf("enable: have %+v, enabled=%v", res, ms.enabled)
+	}
+
+	// deleted enrollments are forgotten when they enroll again
+	if err = m.Authenticate(newRequest(ctx, "ID2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Record(ctx, "ID2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("record: have %v, want %v", err, ErrNotFound)
+	}
+}
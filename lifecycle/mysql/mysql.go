@@ -0,0 +1,94 @@
+// Package mysql deletes enrollment data directly from NanoMDM's and
+// KMFDDM's MySQL storage tables.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Enrollments deletes enrollments from NanoMDM MySQL storage.
+type Enrollments struct {
+	db *sql.DB
+}
+
+// NewEnrollments creates a new enrollment cleaner using db.
+// The database must contain the NanoMDM schema.
+func NewEnrollments(db *sql.DB) *Enrollments {
+	if db == nil {
+		panic("nil db")
+	}
+	return &Enrollments{db: db}
+}
+
+// Clean deletes device id with its user channels, enrollments, push
+// tokens, command queues, command results, and certificate associations.
+func (s *Enrollments) Clean(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM cert_auth_associations WHERE id = ? OR id IN (SELECT id FROM users WHERE device_id = ?);`,
+		id, id,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting certificate associations: %w", err)
+	}
+	// users, enrollments, queues, and results cascade
+	if _, err = s.db.ExecContext(ctx, `DELETE FROM devices WHERE id = ?;`, id); err != nil {
+		return fmt.Errorf("deleting device: %w", err)
+	}
+	_, err = s.db.ExecContext(
+		ctx, `
+DELETE
+    c
+FROM
+    commands AS c
+    LEFT JOIN enrollment_queue AS q
+        ON q.command_uuid = c.command_uuid
+    LEFT JOIN command_results AS r
+        ON r.command_uuid = c.command_uuid
+WHERE
+    q.command_uuid IS NULL AND
+    r.command_uuid IS NULL;`,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting commands: %w", err)
+	}
+	return nil
+}
+
+// Enable re-enables device id and its user channels.
+func (s *Enrollments) Enable(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE enrollments SET enabled = 1 WHERE device_id = ? AND enabled = 0;`, id)
+	return err
+}
+
+// Status deletes the DM status of enrollments from KMFDDM MySQL storage.
+type Status struct {
+	db *sql.DB
+}
+
+// NewStatus creates a new status cleaner using db.
+// The database must contain the KMFDDM schema.
+func NewStatus(db *sql.DB) *Status {
+	if db == nil {
+		panic("nil db")
+	}
+	return &Status{db: db}
+}
+
+// Clean deletes the declaration statuses, status values, errors, and
+// status reports of enrollment id.
+func (s *Status) Clean(ctx context.Context, id string) error {
+	for _, table := range []string{
+		"status_declarations",
+		"status_values",
+		"status_errors",
+		"status_reports",
+	} {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE enrollment_id = ?;`, id); err != nil {
+			return fmt.Errorf("deleting from %s: %w", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package loglevel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Handler returns the current service log levels on GET and
+// sets service log levels from a JSON object of service names
+// to level names on PUT.
+func Handler(levels *Levels, logger log.Logger) http.HandlerFunc {
+	if levels == nil {
+		panic("nil levels")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		if r.Method == http.MethodPut {
+			var m map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				httpapi.JSONError(w, fmt.Errorf("decoding levels: %w", err), http.StatusBadRequest)
+				return
+			}
+			// parse all levels before setting any
+			parsed := make(map[string]Level, len(m))
+			for service, name := range m {
+				level, err := ParseLevel(name)
+				if err != nil {
+					httpapi.JSONError(w, err, http.StatusBadRequest)
+					return
+				}
+				parsed[service] = level
+			}
+			for service, level := range parsed {
+				levels.Set(service, level)
+			}
+			logger.Info("msg", "set log levels", "levels", levels.String())
+		}
+
+		httpapi.WriteJSON(w, levels.Map(), logger)
+	}
+}
@@ -0,0 +1,169 @@
+// Package loglevel provides per-service log level filtering.
+// Services are identified by the "service" key of child loggers
+// (e.g. "nanomdm", "dm", "worker").
+package loglevel
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// Level is a log level.
+type Level int
+
+const (
+	Info Level = iota
+	Debug
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l == Debug {
+		return "debug"
+	}
+	return "info"
+}
+
+// ParseLevel parses the named level s.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	}
+	return Info, fmt.Errorf("unknown log level: %s", s)
+}
+
+// DefaultService is the name used to set the default level.
+const DefaultService = "default"
+
+// Levels holds the log levels of services.
+// It is safe for concurrent use.
+type Levels struct {
+	mu       sync.RWMutex
+	def      Level
+	services map[string]Level
+}
+
+// NewLevels creates a new set of levels using def as the default level.
+func NewLevels(def Level) *Levels {
+	return &Levels{def: def, services: make(map[string]Level)}
+}
+
+// Set sets the log level of service.
+// Setting [DefaultService] changes the default level.
+func (l *Levels) Set(service string, level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if service == DefaultService || service == "" {
+		l.def = level
+		return
+	}
+	l.services[service] = level
+}
+
+// Get returns the log level of service.
+func (l *Levels) Get(service string) Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.services[service]; ok {
+		return level
+	}
+	return l.def
+}
+
+// Map returns the level names of all configured services
+// including the default level.
+func (l *Levels) Map() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	m := map[string]string{DefaultService: l.def.String()}
+	for s, level := range l.services {
+		m[s] = level.String()
+	}
+	return m
+}
+
+// Parse parses a comma-separated list of service=level pairs
+// (e.g. "worker=debug,nanomdm=info") and sets them.
+func (l *Levels) Parse(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		service, name, ok := strings.Cut(pair, "=")
+		if !ok || service == "" {
+			return errors.New("invalid service log level: " + pair)
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		l.Set(strings.TrimSpace(service), level)
+	}
+	return nil
+}
+
+// String returns the levels in the same format accepted by Parse.
+func (l *Levels) String() string {
+	var pairs []string
+	for s, level := range l.Map() {
+		pairs = append(pairs, s+"="+level)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Logger filters debug logging of the wrapped logger by service.
+// The wrapped logger should have debug logging enabled.
+type Logger struct {
+	next    log.Logger
+	levels  *Levels
+	service string
+}
+
+// New wraps logger with per-service log level filtering using levels.
+func New(logger log.Logger, levels *Levels) *Logger {
+	if logger == nil {
+		panic("nil logger")
+	}
+	if levels == nil {
+		panic("nil levels")
+	}
+	return &Logger{next: logger, levels: levels}
+}
+
+// Info logs keyvals.
+func (l *Logger) Info(keyvals ...interface{}) {
+	l.next.Info(keyvals...)
+}
+
+// Debug logs keyvals if the service of l is at the debug level.
+func (l *Logger) Debug(keyvals ...interface{}) {
+	if l.levels.Get(l.service) < Debug {
+		return
+	}
+	l.next.Debug(keyvals...)
+}
+
+// With returns a new child logger with keyvals.
+// A "service" key in keyvals sets the service of the child logger.
+func (l *Logger) With(keyvals ...interface{}) log.Logger {
+	l2 := &Logger{
+		next:    l.next.With(keyvals...),
+		levels:  l.levels,
+		service: l.service,
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if k, ok := keyvals[i].(string); ok && k == "service" {
+			l2.service = fmt.Sprint(keyvals[i+1])
+		}
+	}
+	return l2
+}
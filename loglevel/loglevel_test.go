@@ -0,0 +1,42 @@
+package loglevel
+
+import (
+	"testing"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+type countLogger struct {
+	debug *int
+}
+
+func (l *countLogger) Info(...interface{})            {}
+func (l *countLogger) Debug(...interface{})           { *l.debug++ }
+func (l *countLogger) With(...interface{}) log.Logger { return l }
+
+func TestServiceLevels(t *testing.T) {
+	var debugs int
+	levels := NewLevels(Info)
+	if err := levels.Parse("worker=debug"); err != nil {
+		t.Fatal(err)
+	}
+	logger := New(&countLogger{debug: &debugs}, levels)
+
+	logger.Debug("msg", "root")
+	logger.With("service", "nanomdm").Debug("msg", "nanomdm")
+	worker := logger.With("service", "worker")
+	worker.Debug("msg", "worker")
+	// child loggers inherit the service
+	worker.With("handler", "test").Debug("msg", "worker child")
+
+	if have, want := debugs, 2; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// change the default level at runtime
+	levels.Set(DefaultService, Debug)
+	logger.With("service", "nanomdm").Debug("msg", "nanomdm")
+	if have, want := debugs, 3; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,89 @@
+// Package http provides the HTTP API for bulk enrollment migrations.
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/migration"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// migrateFunc migrates the stream of enrollments in r.
+type migrateFunc func(ctx context.Context, r io.Reader, dryRun bool) (*migration.Report, error)
+
+// MigrateHandler migrates the stream of enrollments in the request body
+// and returns the migration report. The "dry_run" query parameter only
+// validates the enrollments.
+func MigrateHandler(m *migration.Migrator, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil migrator")
+	}
+	return migrateHandler(m.Migrate, logger)
+}
+
+// ImportMicroMDMHandler imports the stream of MicroMDM device records
+// in the request body and returns the migration report. The "dry_run"
+// query parameter only validates the devices.
+func ImportMicroMDMHandler(m *migration.Migrator, logger log.Logger) http.HandlerFunc {
+	if m == nil {
+		panic("nil migrator")
+	}
+	return migrateHandler(m.ImportMicroMDM, logger)
+}
+
+func migrateHandler(migrate migrateFunc, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		var dryRun bool
+		if v := r.URL.Query().Get("dry_run"); v != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				httpapi.JSONError(w, fmt.Errorf("parsing dry_run: %w", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		report, err := migrate(r.Context(), r.Body, dryRun)
+		if errors.Is(err, migration.ErrTooManyEntries) {
+			httpapi.JSONError(w, err, http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			logger.Info("msg", "migrating enrollments", "err", err)
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		logger.Debug(
+			"msg", "migrated enrollments",
+			"dry_run", dryRun,
+			"migrated", report.Migrated,
+			"failed", report.Failed,
+			"skipped", report.Skipped,
+		)
+		httpapi.WriteJSON(w, report, logger)
+	}
+}
+
+// HandleAPIv1 registers the bulk migration API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, m *migration.Migrator) {
+	mux.Handle(
+		prefix+"/migration/bulk",
+		MigrateHandler(m, logger.With("handler", "migrate-bulk")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/migration/micromdm",
+		ImportMicroMDMHandler(m, logger.With("handler", "import-micromdm")),
+		"POST",
+	)
+}
@@ -0,0 +1,99 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/micromdm/plist"
+)
+
+// MicroMDMDevice is a MicroMDM device record. The JSON field names are
+// those of the protobuf JSON mapping of MicroMDM's BoltDB device
+// records (byte fields are base64 encoded). CertHash is the hash of
+// MicroMDM's UDID certificate authorization record, if any.
+type MicroMDMDevice struct {
+	UDID         string `json:"udid"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	OSVersion    string `json:"os_version,omitempty"`
+	BuildVersion string `json:"build_version,omitempty"`
+	ProductName  string `json:"product_name,omitempty"`
+	Model        string `json:"model,omitempty"`
+	ModelName    string `json:"model_name,omitempty"`
+	DeviceName   string `json:"device_name,omitempty"`
+	IMEI         string `json:"imei,omitempty"`
+	MEID         string `json:"meid,omitempty"`
+
+	MDMTopic    string `json:"mdm_topic"`
+	PushMagic   string `json:"push_magic"`
+	Token       []byte `json:"token"`
+	UnlockToken []byte `json:"unlock_token,omitempty"`
+
+	Enrolled bool   `json:"enrolled"`
+	CertHash string `json:"cert_hash,omitempty"`
+}
+
+// Entry converts the device record into a migration entry.
+// Devices that are not enrolled are skipped.
+func (d *MicroMDMDevice) Entry() (*Entry, error) {
+	if !d.Enrolled {
+		return &Entry{skip: "not enrolled", id: d.UDID}, nil
+	}
+	auth := map[string]interface{}{
+		"MessageType": "Authenticate",
+		"UDID":        d.UDID,
+		"Topic":       d.MDMTopic,
+	}
+	for k, v := range map[string]string{
+		"SerialNumber": d.SerialNumber,
+		"OSVersion":    d.OSVersion,
+		"BuildVersion": d.BuildVersion,
+		"ProductName":  d.ProductName,
+		"Model":        d.Model,
+		"ModelName":    d.ModelName,
+		"DeviceName":   d.DeviceName,
+		"IMEI":         d.IMEI,
+		"MEID":         d.MEID,
+	} {
+		if v != "" {
+			auth[k] = v
+		}
+	}
+	tu := map[string]interface{}{
+		"MessageType": "TokenUpdate",
+		"UDID":        d.UDID,
+		"Topic":       d.MDMTopic,
+		"PushMagic":   d.PushMagic,
+		"Token":       d.Token,
+	}
+	if len(d.UnlockToken) > 0 {
+		tu["UnlockToken"] = d.UnlockToken
+	}
+
+	entry := &Entry{CertHash: d.CertHash}
+	var err error
+	if entry.Authenticate, err = plist.Marshal(auth); err != nil {
+		return nil, fmt.Errorf("marshal Authenticate: %w", err)
+	}
+	if entry.TokenUpdate, err = plist.Marshal(tu); err != nil {
+		return nil, fmt.Errorf("marshal TokenUpdate: %w", err)
+	}
+	return entry, nil
+}
+
+// ImportMicroMDM reads a stream of JSON [MicroMDMDevice] records from r
+// and migrates them like [Migrator.Migrate].
+func (m *Migrator) ImportMicroMDM(ctx context.Context, r io.Reader, dryRun bool) (*Report, error) {
+	entries, err := m.decodeAll(r, func(dec *json.Decoder) (*Entry, error) {
+		device := new(MicroMDMDevice)
+		if err := dec.Decode(device); err != nil {
+			return nil, err
+		}
+		return device.Entry()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.migrateEntries(ctx, entries, dryRun), nil
+}
@@ -0,0 +1,334 @@
+// Package migration migrates enrollments in bulk from other MDM servers.
+//
+// Each enrollment is supplied as the Authenticate and TokenUpdate
+// check-in messages a source MDM server assembled for it. Enrollments
+// are validated before they are stored and the outcome of each one is
+// reported.
+package migration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// TopicPrefix is the prefix of MDM push topics.
+const TopicPrefix = "com.apple.mgmt."
+
+// DefaultMaxEntries is the default maximum number of entries of a migration.
+const DefaultMaxEntries = 10000
+
+// ErrTooManyEntries is returned when a migration exceeds the maximum entries.
+var ErrTooManyEntries = errors.New("too many entries")
+
+// Entry is an enrollment to migrate.
+type Entry struct {
+	// Authenticate is the Authenticate check-in plist of the enrollment.
+	// It is optional for user channel enrollments.
+	Authenticate []byte `json:"authenticate,omitempty"`
+
+	// TokenUpdate is the TokenUpdate check-in plist of the enrollment.
+	TokenUpdate []byte `json:"token_update"`
+
+	// CertHash is the hex SHA-256 hash of the enrollment's identity
+	// certificate. It is optional and associated with the enrollment.
+	CertHash string `json:"cert_hash,omitempty"`
+
+	// skip is the reason the entry with id is skipped, if any.
+	skip string
+	id   string
+}
+
+// Result is the migration outcome of an entry.
+type Result struct {
+	// Index is the zero-based position of the entry in the migration.
+	Index int `json:"index"`
+
+	ID    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+
+	// OK is true if the entry was valid and (if not a dry run) migrated.
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// Skipped is the reason the entry was skipped, if any.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// Report is the outcome of a migration.
+type Report struct {
+	DryRun   bool      `json:"dry_run"`
+	Total    int       `json:"total"`
+	Migrated int       `json:"migrated"`
+	Failed   int       `json:"failed"`
+	Skipped  int       `json:"skipped"`
+	Results  []*Result `json:"results"`
+}
+
+// CertAssociator associates enrollments with certificate hashes.
+type CertAssociator interface {
+	AssociateCertHash(r *mdm.Request, hash string) error
+}
+
+// Migrator migrates enrollments in bulk.
+type Migrator struct {
+	svc        service.Checkin
+	certs      CertAssociator
+	topics     func() []string
+	maxEntries int
+	logger     log.Logger
+}
+
+// Option configures the migrator.
+type Option func(*Migrator)
+
+// WithTopics configures fn to supply the allowed push topics.
+// Any topic with the MDM topic prefix is allowed if fn returns no topics.
+func WithTopics(fn func() []string) Option {
+	return func(m *Migrator) {
+		m.topics = fn
+	}
+}
+
+// WithCertAssociator configures store to associate the certificate
+// hashes of entries. Entries with certificate hashes are invalid
+// without it.
+func WithCertAssociator(store CertAssociator) Option {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(m *Migrator) {
+		m.certs = store
+	}
+}
+
+// WithMaxEntries configures the maximum number of entries of a migration.
+func WithMaxEntries(n int) Option {
+	return func(m *Migrator) {
+		m.maxEntries = n
+	}
+}
+
+// WithLogger configures a logger for the migrator.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(m *Migrator) {
+		m.logger = logger
+	}
+}
+
+// New creates a new migrator that migrates enrollments to svc.
+func New(svc service.Checkin, opts ...Option) *Migrator {
+	if svc == nil {
+		panic("nil service")
+	}
+	m := &Migrator{
+		svc:        svc,
+		maxEntries: DefaultMaxEntries,
+		logger:     log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// enrollmentID returns an identifier of e for reporting.
+func enrollmentID(e *mdm.Enrollment) string {
+	switch {
+	case e.UserID != "":
+		return e.UDID + ":" + e.UserID
+	case e.EnrollmentUserID != "":
+		return e.EnrollmentID + ":" + e.EnrollmentUserID
+	case e.UDID != "":
+		return e.UDID
+	}
+	return e.EnrollmentID
+}
+
+// validate decodes and validates entry.
+// The Authenticate message is nil if the entry has none.
+func (m *Migrator) validate(entry *Entry, allowed map[string]bool, r *Result) (*mdm.Authenticate, *mdm.TokenUpdate, error) {
+	if len(entry.TokenUpdate) < 1 {
+		return nil, nil, errors.New("missing TokenUpdate")
+	}
+	msg, err := mdm.DecodeCheckin(entry.TokenUpdate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding TokenUpdate: %w", err)
+	}
+	tu, ok := msg.(*mdm.TokenUpdate)
+	if !ok {
+		return nil, nil, errors.New("token_update is not a TokenUpdate message")
+	}
+	r.ID = enrollmentID(&tu.Enrollment)
+	r.Topic = tu.Topic
+	if r.ID == "" {
+		return nil, nil, errors.New("missing enrollment identifier")
+	}
+
+	var auth *mdm.Authenticate
+	if len(entry.Authenticate) > 0 {
+		if msg, err = mdm.DecodeCheckin(entry.Authenticate); err != nil {
+			return nil, nil, fmt.Errorf("decoding Authenticate: %w", err)
+		}
+		if auth, ok = msg.(*mdm.Authenticate); !ok {
+			return nil, nil, errors.New("authenticate is not an Authenticate message")
+		}
+		if auth.UDID != tu.UDID || auth.EnrollmentID != tu.EnrollmentID {
+			return nil, nil, errors.New("Authenticate and TokenUpdate enrollments differ")
+		}
+		if auth.Topic != tu.Topic {
+			return nil, nil, errors.New("Authenticate and TokenUpdate topics differ")
+		}
+	} else if tu.UserID == "" && tu.EnrollmentUserID == "" {
+		return nil, nil, errors.New("missing Authenticate for device channel")
+	}
+
+	if !strings.HasPrefix(tu.Topic, TopicPrefix) {
+		return nil, nil, fmt.Errorf("invalid topic: %q", tu.Topic)
+	}
+	if len(allowed) > 0 && !allowed[tu.Topic] {
+		return nil, nil, fmt.Errorf("topic not allowed: %s", tu.Topic)
+	}
+	if len(tu.Token) < 1 {
+		return nil, nil, errors.New("missing push token")
+	}
+	if tu.PushMagic == "" {
+		return nil, nil, errors.New("missing push magic")
+	}
+	if entry.CertHash != "" {
+		if m.certs == nil {
+			return nil, nil, errors.New("certificate associations not supported")
+		}
+		if b, err := hex.DecodeString(entry.CertHash); err != nil || len(b) != sha256.Size {
+			return nil, nil, errors.New("invalid certificate hash")
+		}
+		if tu.UDID == "" || tu.UserID != "" {
+			return nil, nil, errors.New("certificate hash of non-device enrollment")
+		}
+	}
+	return auth, tu, nil
+}
+
+// migrate stores the check-in messages and any certificate
+// association of an entry.
+func (m *Migrator) migrate(ctx context.Context, auth *mdm.Authenticate, tu *mdm.TokenUpdate, certHash string) error {
+	if auth != nil {
+		if err := m.svc.Authenticate(mdm.NewRequestWithContext(ctx, nil), auth); err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
+	}
+	if err := m.svc.TokenUpdate(mdm.NewRequestWithContext(ctx, nil), tu); err != nil {
+		return fmt.Errorf("token update: %w", err)
+	}
+	if certHash != "" {
+		r := mdm.NewRequestWithContext(ctx, nil)
+		r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: tu.UDID}
+		if err := m.certs.AssociateCertHash(r, strings.ToLower(certHash)); err != nil {
+			return fmt.Errorf("associating certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Migrate reads a stream of JSON [Entry] objects from r, validates
+// them, and migrates the valid ones unless dryRun is set. Invalid
+// entries and migration failures are reported per entry and do not
+// stop the migration. The whole stream is read before any entry is
+// migrated: an error is returned and nothing is migrated if the
+// stream can't be decoded or exceeds the maximum entries.
+func (m *Migrator) Migrate(ctx context.Context, r io.Reader, dryRun bool) (*Report, error) {
+	entries, err := m.decodeAll(r, func(dec *json.Decoder) (*Entry, error) {
+		entry := new(Entry)
+		return entry, dec.Decode(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.migrateEntries(ctx, entries, dryRun), nil
+}
+
+// decodeAll decodes entries from the stream of JSON objects in r
+// with decode until the end of the stream.
+func (m *Migrator) decodeAll(r io.Reader, decode func(*json.Decoder) (*Entry, error)) ([]*Entry, error) {
+	var entries []*Entry
+	dec := json.NewDecoder(r)
+	for {
+		entry, err := decode(dec)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("decoding entry %d: %w", len(entries), err)
+		}
+		if m.maxEntries > 0 && len(entries) >= m.maxEntries {
+			return nil, fmt.Errorf("%w: maximum %d", ErrTooManyEntries, m.maxEntries)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// migrateEntries validates and migrates entries.
+func (m *Migrator) migrateEntries(ctx context.Context, entries []*Entry, dryRun bool) *Report {
+	allowed := make(map[string]bool)
+	if m.topics != nil {
+		for _, topic := range m.topics() {
+			allowed[topic] = true
+		}
+	}
+
+	report := &Report{DryRun: dryRun, Results: make([]*Result, 0, len(entries))}
+	seen := make(map[string]int)
+	for i, entry := range entries {
+		result := &Result{Index: i}
+		report.Results = append(report.Results, result)
+		if entry.skip != "" {
+			result.ID = entry.id
+			result.Skipped = entry.skip
+			report.Skipped++
+			continue
+		}
+		auth, tu, err := m.validate(entry, allowed, result)
+		if err == nil {
+			if prev, ok := seen[result.ID]; ok {
+				err = fmt.Errorf("duplicate of entry %d", prev)
+			} else {
+				seen[result.ID] = i
+			}
+		}
+		if err == nil && !dryRun {
+			err = m.migrate(ctx, auth, tu, entry.CertHash)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+			m.logger.Debug("msg", "migrating enrollment", "index", i, "id", result.ID, "err", err)
+			continue
+		}
+		result.OK = true
+		if !dryRun {
+			report.Migrated++
+		}
+	}
+	report.Total = len(report.Results)
+
+	m.logger.Info(
+		"msg", "migrated enrollments",
+		"dry_run", dryRun,
+		"total", report.Total,
+		"migrated", report.Migrated,
+		"failed", report.Failed,
+		"skipped", report.Skipped,
+	)
+	return report
+}
@@ -0,0 +1,128 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/plist"
+)
+
+type recorder struct {
+	service.NopService
+	tokenUpdates []string
+	certHashes   map[string]string
+}
+
+func (r *recorder) AssociateCertHash(req *mdm.Request, hash string) error {
+	if r.certHashes == nil {
+		r.certHashes = make(map[string]string)
+	}
+	r.certHashes[req.ID] = hash
+	return nil
+}
+
+func (r *recorder) TokenUpdate(_ *mdm.Request, m *mdm.TokenUpdate) error {
+	r.tokenUpdates = append(r.tokenUpdates, m.UDID)
+	return nil
+}
+
+func checkin(t *testing.T, v map[string]interface{}) []byte {
+	t.Helper()
+	b, err := plist.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func entry(t *testing.T, udid, topic string, token []byte) []byte {
+	t.Helper()
+	b, err := json.Marshal(&Entry{
+		Authenticate: checkin(t, map[string]interface{}{
+			"MessageType": "Authenticate",
+			"UDID":        udid,
+			"Topic":       topic,
+		}),
+		TokenUpdate: checkin(t, map[string]interface{}{
+			"MessageType": "TokenUpdate",
+			"UDID":        udid,
+			"Topic":       topic,
+			"Token":       token,
+			"PushMagic":   "magic",
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	token := []byte{1, 2, 3, 4}
+	stream := bytes.Join([][]byte{
+		entry(t, "UDID1", "com.apple.mgmt.External.ok", token),
+		entry(t, "UDID2", "com.apple.mgmt.External.other", token),
+		entry(t, "UDID3", "com.apple.mgmt.External.ok", nil),
+		entry(t, "UDID1", "com.apple.mgmt.External.ok", token),
+	}, []byte("\n"))
+
+	svc := new(recorder)
+	m := New(svc, WithTopics(func() []string { return []string{"com.apple.mgmt.External.ok"} }))
+
+	report, err := m.Migrate(ctx, bytes.NewReader(stream), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 4 || report.Failed != 3 || report.Migrated != 0 || len(svc.tokenUpdates) != 0 {
+		t.Errorf("dry run: %+v", report)
+	}
+	for i, want := range []string{"", "topic not allowed", "missing push token", "duplicate of entry 0"} {
+		if have := report.Results[i].Error; !strings.HasPrefix(have, want) || (want == "") != report.Results[i].OK {
+			t.Errorf("entry %d: have: %q, want: %q", i, have, want)
+		}
+	}
+
+	if report, err = m.Migrate(ctx, bytes.NewReader(stream), false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 || len(svc.tokenUpdates) != 1 || svc.tokenUpdates[0] != "UDID1" {
+		t.Errorf("migrate: %+v: %v", report, svc.tokenUpdates)
+	}
+
+	m = New(svc, WithMaxEntries(2))
+	if _, err = m.Migrate(ctx, bytes.NewReader(stream), false); !errors.Is(err, ErrTooManyEntries) {
+		t.Errorf("have: %v, want: %v", err, ErrTooManyEntries)
+	}
+	if _, err = m.Migrate(ctx, strings.NewReader(`{"token_update":`), false); err == nil {
+		t.Error("expected decoding error")
+	}
+}
+
+func TestImportMicroMDM(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	stream := `{"udid":"UDID1","serial_number":"C02X","mdm_topic":"com.apple.mgmt.External.ok","push_magic":"magic","token":"AQIDBA==","enrolled":true,"cert_hash":"` + hash + `"}
+{"udid":"UDID2","mdm_topic":"com.apple.mgmt.External.ok","push_magic":"magic","token":"AQIDBA==","enrolled":false}`
+
+	svc := new(recorder)
+	m := New(svc, WithCertAssociator(svc))
+	report, err := m.ImportMicroMDM(context.Background(), strings.NewReader(stream), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 || report.Skipped != 1 || report.Failed != 0 {
+		t.Errorf("report: %+v", report)
+	}
+	if have, want := report.Results[1].Skipped, "not enrolled"; have != want {
+		t.Errorf("skipped: have: %q, want: %q", have, want)
+	}
+	if have, want := svc.certHashes["UDID1"], hash; have != want {
+		t.Errorf("cert hash: have: %q, want: %q", have, want)
+	}
+}
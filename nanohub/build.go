@@ -0,0 +1,313 @@
+package nanohub
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/cmdservice"
+	"github.com/micromdm/nanohub/ddmadapter"
+	"github.com/micromdm/nanohub/enqueue"
+	"github.com/micromdm/nanohub/xfcc"
+	"github.com/micromdm/nanolib/log"
+
+	"github.com/cespare/xxhash"
+	"github.com/jessepeterson/kmfddm/notifier"
+	ddmstorage "github.com/jessepeterson/kmfddm/storage"
+	"github.com/micromdm/nanocmd/engine"
+	"github.com/micromdm/nanocmd/workflow"
+	nanoapi "github.com/micromdm/nanomdm/api"
+	"github.com/micromdm/nanomdm/cryptoutil"
+	nanohttpmdm "github.com/micromdm/nanomdm/http/mdm"
+	nanoservice "github.com/micromdm/nanomdm/service"
+	nanostorage "github.com/micromdm/nanomdm/storage"
+)
+
+// The Build functions construct the individual components of a NanoHUB
+// server from the same options as [New]. They allow embedders to
+// assemble custom topologies, such as a DM-only server or a workflow
+// engine worker process. Options that don't apply to a component are
+// ignored.
+
+// ErrNotConfigured is returned when building a component that the
+// options did not configure.
+var ErrNotConfigured = errors.New("not configured")
+
+// EnqueuerStore enqueues commands and retrieves push information.
+type EnqueuerStore interface {
+	nanostorage.CommandEnqueuer
+	nanostorage.PushStore
+}
+
+// DM contains the Declarative Management components.
+type DM struct {
+	// Adapter is the DM check-in service of the core MDM service.
+	Adapter *ddmadapter.DMAdapter
+
+	// Notifier notifies enrollments of DM changes.
+	Notifier DMNotifier
+
+	// Debouncer coalesces DM notification commands.
+	// It is nil unless configured with [WithDMDebounce] and must be
+	// run with Debounce.
+	Debouncer *enqueue.Debouncer
+	Debounce  time.Duration
+
+	// Services are supplementary check-in and command services.
+	Services []nanoservice.CheckinAndCommandService
+}
+
+// WorkflowEngine contains the command workflow engine components.
+type WorkflowEngine struct {
+	Engine *engine.Engine
+
+	// Service delivers MDM events to the engine.
+	Service nanoservice.CheckinAndCommandService
+
+	// Workflows are the names of the registered workflows.
+	Workflows []string
+
+	// Worker is the engine worker. It is nil unless configured with
+	// worker storage and must be run.
+	Worker *engine.Worker
+}
+
+// newConfigFromOptions creates a validated config from opts.
+func newConfigFromOptions(opts ...Option) (*config, error) {
+	config := newConfig()
+	if err := config.runOptions(opts...); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// BuildEnqueuer builds the MDM command enqueuer used by DM and workflows.
+// It pushes with the pusher of [WithAPNSPush] and includes any push
+// batcher and capability gate.
+func BuildEnqueuer(store EnqueuerStore, opts ...Option) (capability.Enqueuer, error) {
+	if store == nil {
+		panic("nil store")
+	}
+	config, err := newConfigFromOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return buildEnqueuer(config, store)
+}
+
+func buildEnqueuer(config *config, store nanostorage.CommandEnqueuer) (capability.Enqueuer, error) {
+	// create NanoMDM API result enqueuer
+	nanoPushEnq, err := nanoapi.NewPushEnqueuer(store, config.pusher, nanoapi.WithLogger(config.logger.With("service", "enqueue")))
+	if err != nil {
+		return nil, fmt.Errorf("creating push enqueuer: %w", err)
+	}
+
+	// create NanoHUB enqueue wrapper around NanoMDM API result enqueuer.
+	// satisfies both DM and NanoCMD command enqueuer interfaces.
+	var enqOpts []enqueue.Option
+	if config.pushBatcher != nil {
+		enqOpts = append(enqOpts, enqueue.WithBatcher(config.pushBatcher))
+	}
+	var pushEnq capability.Enqueuer = enqueue.New(nanoPushEnq, enqOpts...)
+	if config.capGate != nil {
+		pushEnq = config.capGate.Wrap(pushEnq)
+	}
+	return pushEnq, nil
+}
+
+// BuildDM builds the Declarative Management components configured
+// with [WithDM] that enqueue commands with enq.
+// [ErrNotConfigured] is returned if DM is not configured.
+func BuildDM(enq capability.Enqueuer, opts ...Option) (*DM, error) {
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+	config, err := newConfigFromOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if config.dmStore == nil {
+		return nil, fmt.Errorf("DM: %w", ErrNotConfigured)
+	}
+	return buildDM(config, enq)
+}
+
+func buildDM(config *config, enq capability.Enqueuer) (*DM, error) {
+	var dmStore ddmstorage.EnrollmentDeclarationStorage = config.dmStore
+	if len(config.dmDStores) >= 1 {
+		// if we have additional DM declaration storages configured
+		// then wrap them in a Multi storage wrapped by a JSONAdapt.
+		dmStore = ddmstorage.NewJSONAdapt(
+			ddmstorage.NewMulti(
+				append(config.dmDStores, config.dmStore)...,
+			),
+			func() hash.Hash { return xxhash.New() },
+		)
+	}
+
+	dm := new(DM)
+	var err error
+	dm.Adapter, err = ddmadapter.New(dmStore, append(config.dmOpts,
+		ddmadapter.WithLogger(config.logger.With("service", "dm")),
+	)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating DM adapter: %w", err)
+	}
+
+	var dmEnq notifier.Enqueuer = enq
+	if config.dmDebounce > 0 {
+		dm.Debouncer = enqueue.NewDebouncer(enq, enqueue.WithDebounceLogger(config.logger.With("service", "dm-debouncer")))
+		dm.Debounce = config.dmDebounce
+		dmEnq = dm.Debouncer
+	}
+
+	dm.Notifier, err = notifier.New(dmEnq, config.dmStore, notifier.WithLogger(config.logger.With("service", "notifier")))
+	if err != nil {
+		return nil, fmt.Errorf("creating notifier: %w", err)
+	}
+
+	if config.dmRmSets {
+		dm.Services = append(dm.Services, ddmadapter.NewSetsRemover(config.dmStore, nil))
+	}
+	return dm, nil
+}
+
+// BuildWorkflowEngine builds the command workflow engine configured
+// with [WithWF] that enqueues commands with enq. The store
+// tallies TokenUpdate check-ins for workflow events.
+// [ErrNotConfigured] is returned if the engine is not configured.
+func BuildWorkflowEngine(store nanostorage.TokenUpdateTallyStore, enq capability.Enqueuer, opts ...Option) (*WorkflowEngine, error) {
+	if store == nil {
+		panic("nil store")
+	}
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+	config, err := newConfigFromOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if config.cmdStore == nil {
+		return nil, fmt.Errorf("workflow engine: %w", ErrNotConfigured)
+	}
+	return buildWorkflowEngine(config, store, enq)
+}
+
+func buildWorkflowEngine(config *config, store nanostorage.TokenUpdateTallyStore, enq capability.Enqueuer) (*WorkflowEngine, error) {
+	e := engine.New(
+		config.cmdStore,
+		enq,
+		append(
+			[]engine.Option{engine.WithLogger(config.logger.With("service", "nanocmd"))},
+			config.cmdOpts...,
+		)...,
+	)
+	wf := &WorkflowEngine{Engine: e}
+
+	// create the adapter
+	var err error
+	wf.Service, err = cmdservice.New(e, append(config.cmdSvcOpts,
+		cmdservice.WithTokenUpdateTallyStore(store),
+		cmdservice.WithLogger(config.logger.With("service", "cmdservice")),
+	)...)
+	if err != nil {
+		return nil, fmt.Errorf("creating nanocmd service: %w", err)
+	}
+
+	// create and register any workflows
+	var stepEnq workflow.StepEnqueuer = e
+	for _, wrap := range config.cmdEnqWrappers {
+		stepEnq = wrap(stepEnq)
+	}
+	for _, fn := range config.cmdWorkflows {
+		if fn == nil {
+			continue
+		}
+		w, err := fn(stepEnq)
+		if err != nil {
+			return nil, fmt.Errorf("creating workflow: %w", err)
+		}
+		for _, wrap := range config.cmdWFWrappers {
+			w = wrap(w)
+		}
+		if err = e.RegisterWorkflow(w); err != nil {
+			return nil, fmt.Errorf("registering workflow: %w", err)
+		}
+		wf.Workflows = append(wf.Workflows, w.Name())
+	}
+
+	if config.cmdWorkerStore != nil {
+		var workerEnq engine.PushEnqueuer = enq
+		if config.cmdEscalator != nil {
+			workerEnq = config.cmdEscalator.Wrap(enq)
+		}
+
+		// configure command workflow engine worker
+		wf.Worker = engine.NewWorker(
+			e,
+			config.cmdWorkerStore,
+			workerEnq,
+			append(config.cmdWorkerOpts, engine.WithWorkerLogger(config.logger.With("service", "worker")))...,
+		)
+	}
+	return wf, nil
+}
+
+// BuildAuthMiddleware builds the MDM authentication HTTP middleware.
+// It extracts the MDM client certificate (via mTLS, a header, or the
+// Mdm-Signature header) and verifies it.
+func BuildAuthMiddleware(opts ...Option) (func(http.Handler) http.Handler, error) {
+	config, err := newConfigFromOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return buildAuthMiddleware(config)
+}
+
+func buildAuthMiddleware(config *config) (func(http.Handler) http.Handler, error) {
+	verifier, err := config.getOrMakeVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	// wrapped in "double" function to avoid keeping a reference to the config struct
+	return func(ac authConfig, cvl, cel log.Logger) func(h http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			// as the last wrapped step before the service, verify the cert validity
+			h = nanohttpmdm.CertVerifyMiddleware(h, verifier, cvl)
+
+			if ac.mdmSignature {
+				// Mdm-Signature header is configured
+				return nanohttpmdm.CertExtractMdmSignatureMiddleware(
+					h,
+					nanohttpmdm.MdmSignatureVerifierFunc(cryptoutil.VerifyMdmSignature),
+					nanohttpmdm.SigLogWithLogger(cel),
+					nanohttpmdm.SigLogWithLogErrors(ac.signatureLogErrors),
+				)
+			}
+
+			// mTLS is (default) configured
+			if ac.signatureHeader != "" && ac.xfcc {
+				// extract from the Envoy XFCC header
+				return xfcc.CertExtractMiddleware(h, ac.signatureHeader, cel)
+			}
+			if ac.signatureHeader != "" {
+				// signature header name present, extract from header
+				return nanohttpmdm.CertExtractPEMHeaderMiddleware(h, ac.signatureHeader, cel)
+			}
+
+			// default to mTLS (i.e. Go native mTLS) extraction
+			return nanohttpmdm.CertExtractTLSMiddleware(h, cel)
+		}
+	}(
+		config.authConfig,
+		config.logger.With("handler", "cert-verify"),
+		config.logger.With("handler", "cert-extract"),
+	), nil
+}
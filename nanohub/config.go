@@ -1,13 +1,24 @@
 package nanohub
 
 import (
+	"context"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/micromdm/nanohub/authpolicy"
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/certrevoke"
 	"github.com/micromdm/nanohub/cmdservice"
 	"github.com/micromdm/nanohub/ddmadapter"
+	"github.com/micromdm/nanohub/enqueue"
+	"github.com/micromdm/nanohub/escalation"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/idtransform"
+	"github.com/micromdm/nanohub/migration"
+	"github.com/micromdm/nanohub/reenroll"
 
 	ddmstorage "github.com/jessepeterson/kmfddm/storage"
 	"github.com/jessepeterson/kmfddm/storage/shard"
@@ -42,6 +53,10 @@ type authConfig struct {
 	// the mTLS certificate from the HTTP request (i.e. Go native mTLS).
 	signatureHeader string
 
+	// xfcc is true if signatureHeader is an Envoy
+	// x-forwarded-client-cert (XFCC) header.
+	xfcc bool
+
 	// signatureLogErrors enables logging of the `Mdm-Signature` header
 	// if MDM signature header extraction is false.
 	signatureLogErrors bool
@@ -52,11 +67,14 @@ type config struct {
 	logger     log.Logger
 	authConfig authConfig
 
-	migration bool
+	migration     bool
+	migrationOpts []migration.Option
 
 	checkin    bool // enables the check-in handler
 	noCombined bool // disables the "combined" check-in/command handler
 
+	maxBodySize int64 // limits MDM request body sizes if non-zero
+
 	tokenMuxers map[string]nanoservice.GetToken
 	dumpWriter  dump.DumpWriter
 
@@ -67,26 +85,46 @@ type config struct {
 	uazl      bool // UserAuthenticate Zero-Length Challenge mode
 
 	webhookURLs []string
+	eventSinks  event.MultiSink
+	streamSinks event.MultiSink
 
 	svcs   []nanoservice.CheckinAndCommandService
 	pusher push.Pusher
 
+	reenrollHooks []reenroll.HookFunc
+	reenrollStore reenroll.Store
+
+	pushBatcher *enqueue.Batcher
+	capGate     *capability.Gate
+
+	authProxyPolicies    []authpolicy.Policy
+	authProxyIDTransform idtransform.Transformer
+
 	verifier  certverify.CertVerifier
+	verifiers []certverify.CertVerifier // additional verifiers
 	rootsPEM  []byte
 	intsPEM   []byte
 	keyUsages []x509.ExtKeyUsage
 
+	revocation     bool
+	revocationOpts []certrevoke.Option
+
 	dmStore   DMStore
 	dmDStores []ddmstorage.EnrollmentDeclarationDataStorage
 	dmOpts    []ddmadapter.Option
 	dmRmSets  bool
 
+	dmDebounce time.Duration
+
 	cmdStore       cmdstorage.Storage
 	cmdWorkerStore cmdstorage.WorkerStorage
 	cmdOpts        []engine.Option
 	cmdWorkerOpts  []engine.WorkerOption
+	cmdEscalator   *escalation.Escalator
 	cmdSvcOpts     []cmdservice.Option
 	cmdWorkflows   []func(e workflow.StepEnqueuer) (workflow.Workflow, error)
+	cmdWFWrappers  []func(workflow.Workflow) workflow.Workflow
+	cmdEnqWrappers []func(workflow.StepEnqueuer) workflow.StepEnqueuer
 }
 
 // Options configure NanoHUBs.
@@ -115,6 +153,10 @@ func (c *config) validate() error {
 		return errors.New("roots and intermediates present with explicit verifier")
 	}
 
+	if c.revocation && c.verifier != nil {
+		return errors.New("revocation checking requires the pool verifier")
+	}
+
 	if c.authConfig.signatureHeader != "" && c.authConfig.mdmSignature {
 		return errors.New("signature header and Mdm-Signature are mutually exclusive")
 	}
@@ -146,12 +188,52 @@ func (c *config) attachGetTokenHandlers(muxer tokenMuxer) {
 	}
 }
 
-// getOrMakeVerifier returns configured verifier or builds a new pool verifier.
+// verifierChain verifies certificates with all of its verifiers in order.
+type verifierChain []certverify.CertVerifier
+
+// Verify returns the error of the first verifier that fails.
+func (vc verifierChain) Verify(ctx context.Context, cert *x509.Certificate) error {
+	for _, v := range vc {
+		if err := v.Verify(ctx, cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOrMakeVerifier returns the verifier chaining the configured or
+// pool verifier with any additional verifiers.
 func (c *config) getOrMakeVerifier() (certverify.CertVerifier, error) {
+	verifier, err := c.getOrMakeBaseVerifier()
+	if err != nil || len(c.verifiers) < 1 {
+		return verifier, err
+	}
+	return append(verifierChain{verifier}, c.verifiers...), nil
+}
+
+// getOrMakeBaseVerifier returns configured verifier or builds a new pool verifier.
+// The pool verifier checks revocation if configured.
+func (c *config) getOrMakeBaseVerifier() (certverify.CertVerifier, error) {
 	if c.verifier != nil {
 		return c.verifier, nil
 	}
-	return certverify.NewPoolVerifier(c.rootsPEM, c.intsPEM, c.keyUsages...)
+	pool, err := certverify.NewPoolVerifier(c.rootsPEM, c.intsPEM, c.keyUsages...)
+	if err != nil || !c.revocation {
+		return pool, err
+	}
+	issuers, err := certrevoke.ParseCertificates(append(append([]byte{}, c.rootsPEM...), c.intsPEM...))
+	if err != nil {
+		return nil, fmt.Errorf("parsing revocation issuers: %w", err)
+	}
+	revoker, err := certrevoke.New(
+		issuers,
+		append([]certrevoke.Option{certrevoke.WithLogger(c.logger.With("service", "certrevoke"))}, c.revocationOpts...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating revocation verifier: %w", err)
+	}
+	// only check revocation of certificates issued by the trusted CAs
+	return verifierChain{pool, revoker}, nil
 }
 
 // WithLogger is the "root" logger of NanoHUB.
@@ -233,6 +315,33 @@ func WithVerifier(verifier certverify.CertVerifier) Option {
 	}
 }
 
+// WithVerifiers adds verifiers that MDM client identity certificates
+// must also pass, in order, after the pool verifier (or the verifier of
+// [WithVerifier]). Unlike WithVerifier the pool verifier is kept, e.g.
+// to add custom certificate policies. May be specified multiple times.
+func WithVerifiers(verifiers ...certverify.CertVerifier) Option {
+	return func(c *config) error {
+		for _, v := range verifiers {
+			if v == nil {
+				return errors.New("nil verifier")
+			}
+		}
+		c.verifiers = append(c.verifiers, verifiers...)
+		return nil
+	}
+}
+
+// WithRevocationCheck checks the MDM client identity certificates
+// verified by the pool verifier for revocation with OCSP and/or CRLs.
+// The issuers are the root and intermediate CA certificates.
+func WithRevocationCheck(opts ...certrevoke.Option) Option {
+	return func(c *config) error {
+		c.revocation = true
+		c.revocationOpts = opts
+		return nil
+	}
+}
+
 // WithRootPEMs specifies the PEM bytes of the root CA(s) to verify the
 // MDM client identity certificate against using a pool verifier.
 func WithRootPEMs(pem []byte) Option {
@@ -270,6 +379,24 @@ func WithCertHeader(header string) Option {
 	return func(c *config) error {
 		c.authConfig.mdmSignature = false
 		c.authConfig.signatureHeader = header
+		c.authConfig.xfcc = false
+		return nil
+	}
+}
+
+// WithXFCCHeader configures the HTTP header name of an Envoy (or Istio)
+// x-forwarded-client-cert header from which the device certificate will
+// be extracted (see xfcc.Header for the default name).
+// Disables Mdm-Signature header extraction.
+func WithXFCCHeader(header string) Option {
+	if header == "" {
+		panic("empty header")
+	}
+
+	return func(c *config) error {
+		c.authConfig.mdmSignature = false
+		c.authConfig.signatureHeader = header
+		c.authConfig.xfcc = true
 		return nil
 	}
 }
@@ -293,6 +420,20 @@ func WithAPNSPush(pusher push.Pusher) Option {
 
 }
 
+// WithPushBatcher coalesces and batches the APNs pushes of DM
+// notifications and command workflows with b. The batcher should
+// push using the same pusher as [WithAPNSPush]. It must be run
+// separately (see [enqueue.Batcher.Run]).
+func WithPushBatcher(b *enqueue.Batcher) Option {
+	if b == nil {
+		panic("nil batcher")
+	}
+	return func(c *config) error {
+		c.pushBatcher = b
+		return nil
+	}
+}
+
 // WithWebhook configures a MicroMDM-compatible webhook to callback to url.
 func WithWebhook(url string) Option {
 	if url == "" {
@@ -305,6 +446,102 @@ func WithWebhook(url string) Option {
 	}
 }
 
+// WithEventSink sends device events (check-ins, command errors, etc.) to sink.
+// May be specified multiple times to send events to multiple sinks.
+func WithEventSink(sink event.Sink) Option {
+	if sink == nil {
+		panic("nil sink")
+	}
+
+	return func(c *config) error {
+		c.eventSinks = append(c.eventSinks, sink)
+		return nil
+	}
+}
+
+// WithEventStream sends live check-in and command result events to sink.
+// Unlike [WithEventSink] an event is sent for every command response.
+func WithEventStream(sink event.Sink) Option {
+	if sink == nil {
+		panic("nil sink")
+	}
+
+	return func(c *config) error {
+		c.streamSinks = append(c.streamSinks, sink)
+		return nil
+	}
+}
+
+// WithAuthProxyPolicy adds policies that must authorize authproxy requests.
+// May be specified multiple times to add multiple policies.
+func WithAuthProxyPolicy(policies ...authpolicy.Policy) Option {
+	return func(c *config) error {
+		for _, p := range policies {
+			if p == nil {
+				return errors.New("nil authproxy policy")
+			}
+		}
+		c.authProxyPolicies = append(c.authProxyPolicies, policies...)
+		return nil
+	}
+}
+
+// WithAuthProxyIDTransform transforms the enrollment ID sent to
+// authproxy destinations with t. The header will contain the
+// transformed ID instead of the raw enrollment ID.
+func WithAuthProxyIDTransform(t idtransform.Transformer) Option {
+	if t == nil {
+		panic("nil transformer")
+	}
+	return func(c *config) error {
+		c.authProxyIDTransform = t
+		return nil
+	}
+}
+
+// WithService adds an additional NanoMDM service.
+// May be specified multiple times to add multiple services.
+func WithService(svc nanoservice.CheckinAndCommandService) Option {
+	if svc == nil {
+		panic("nil service")
+	}
+
+	return func(c *config) error {
+		c.svcs = append(c.svcs, svc)
+		return nil
+	}
+}
+
+// WithReenrollHook calls hook with the previous and new enrollment state
+// when a device channel enrollment re-enrolls, i.e. sends its first
+// TokenUpdate check-in after an Authenticate check-in having completed
+// an enrollment before. May be specified multiple times to call multiple
+// hooks. See [WithReenrollStore] for where enrollment states are kept.
+func WithReenrollHook(hook reenroll.HookFunc) Option {
+	if hook == nil {
+		panic("nil hook")
+	}
+
+	return func(c *config) error {
+		c.reenrollHooks = append(c.reenrollHooks, hook)
+		return nil
+	}
+}
+
+// WithReenrollStore configures the storage of enrollment states for
+// re-enrollment hooks. By default enrollment states are kept in memory
+// and re-enrollments are only detected for enrollments seen since start.
+func WithReenrollStore(store reenroll.Store) Option {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(c *config) error {
+		c.reenrollStore = store
+		return nil
+	}
+}
+
 // WithUA configures the UserAuthenticate service for NanoMDM.
 func WithUA(ua nanoservice.UserAuthenticate) Option {
 	return func(c *config) error {
@@ -324,10 +561,12 @@ func WithUADefault(uazl bool) Option {
 	}
 }
 
-// WithMigration enables a NanoMDM "migration" HTTP handler.
-func WithMigration() Option {
+// WithMigration enables a NanoMDM "migration" HTTP handler and a
+// bulk enrollment migrator configured with opts.
+func WithMigration(opts ...migration.Option) Option {
 	return func(c *config) error {
 		c.migration = true
+		c.migrationOpts = opts
 		return nil
 	}
 }
@@ -352,6 +591,65 @@ func WithDMStatusStore(store ddmstorage.StatusStorer, fn ddmadapter.StatusIDFn)
 	}
 }
 
+// WithDMSecondaryStatusStore additionally stores Declarative Management
+// status reports in store. Failures of secondary stores are logged
+// but do not fail the DM check-in. The name identifies store in logs.
+func WithDMSecondaryStatusStore(name string, store ddmstorage.StatusStorer) Option {
+	return func(c *config) error {
+		c.dmOpts = append(c.dmOpts, ddmadapter.WithSecondaryStatusStore(name, store))
+		return nil
+	}
+}
+
+// WithDMStatusHandler processes Declarative Management status report
+// values at path with h.
+func WithDMStatusHandler(path string, h ddmadapter.StatusHandler) Option {
+	return func(c *config) error {
+		c.dmOpts = append(c.dmOpts, ddmadapter.WithStatusHandler(path, h))
+		return nil
+	}
+}
+
+// WithDMMaxStatusSize skips DM status items larger than size bytes.
+func WithDMMaxStatusSize(size int) Option {
+	return func(c *config) error {
+		c.dmOpts = append(c.dmOpts, ddmadapter.WithMaxStatusSize(size))
+		return nil
+	}
+}
+
+// WithDMTemplateValues renders placeholders in Declarative Management
+// declarations per-enrollment with the values returned by fn.
+func WithDMTemplateValues(fn ddmadapter.TemplateValuesFn) Option {
+	return func(c *config) error {
+		c.dmOpts = append(c.dmOpts, ddmadapter.WithTemplateValues(fn))
+		return nil
+	}
+}
+
+// WithMaxBodySize limits the size of MDM request bodies to size bytes.
+// Larger requests are rejected with an HTTP 413 status before
+// they are read into memory.
+func WithMaxBodySize(size int64) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return errors.New("invalid max body size")
+		}
+		c.maxBodySize = size
+		return nil
+	}
+}
+
+// WithDMDebounce coalesces the DeclarativeManagement commands of DM
+// notifications so that each enrollment is sent at most one command
+// per window. It must be run separately (see [NanoHUB.GoStartDMDebouncer]).
+func WithDMDebounce(window time.Duration) Option {
+	return func(c *config) error {
+		c.dmDebounce = window
+		return nil
+	}
+}
+
 // WithDMSetRemover turns on removal of DM enrollment set associations upon enrollment.
 func WithDMSetRemover() Option {
 	return func(c *config) error {
@@ -407,6 +705,30 @@ func WithWorkflow(fn func(e workflow.StepEnqueuer) (workflow.Workflow, error)) O
 	}
 }
 
+// WithWorkflowWrapper wraps each workflow with fn before it is
+// registered with the workflow engine.
+func WithWorkflowWrapper(fn func(workflow.Workflow) workflow.Workflow) Option {
+	if fn == nil {
+		panic("nil workflow wrapper")
+	}
+	return func(c *config) error {
+		c.cmdWFWrappers = append(c.cmdWFWrappers, fn)
+		return nil
+	}
+}
+
+// WithStepEnqueuerWrapper wraps the step enqueuer that workflows are
+// created with by fn.
+func WithStepEnqueuerWrapper(fn func(workflow.StepEnqueuer) workflow.StepEnqueuer) Option {
+	if fn == nil {
+		panic("nil step enqueuer wrapper")
+	}
+	return func(c *config) error {
+		c.cmdEnqWrappers = append(c.cmdEnqWrappers, fn)
+		return nil
+	}
+}
+
 // WithMaskAlreadyStarted enables masking of the "workflow already started" error.
 // The error is instead logged as a message to the service logger, but does not return the error.
 // This masking is only for the command-and-report-results endpoint and only for Idle events.
@@ -442,3 +764,31 @@ func WithWFWorkerRePushDuration(d time.Duration) Option {
 		return nil
 	}
 }
+
+// WithWFWorkerRePushEscalation escalates the worker's APNs re-pushes
+// to enrollments that don't respond with esc. The escalator is also
+// added as a NanoMDM service to reset escalations.
+func WithWFWorkerRePushEscalation(esc *escalation.Escalator) Option {
+	if esc == nil {
+		panic("nil escalator")
+	}
+	return func(c *config) error {
+		c.cmdEscalator = esc
+		c.svcs = append(c.svcs, esc)
+		return nil
+	}
+}
+
+// WithCapabilityGate checks commands enqueued by DM and NanoCMD
+// against the capability matrix of g. The gate is also added as a
+// NanoMDM service to record the OS versions of enrollments.
+func WithCapabilityGate(g *capability.Gate) Option {
+	if g == nil {
+		panic("nil gate")
+	}
+	return func(c *config) error {
+		c.capGate = g
+		c.svcs = append(c.svcs, g)
+		return nil
+	}
+}
@@ -4,23 +4,21 @@ package nanohub
 import (
 	"context"
 	"errors"
-	"fmt"
-	"hash"
 	"net/http"
+	"time"
 
-	"github.com/micromdm/nanohub/cmdservice"
-	"github.com/micromdm/nanohub/ddmadapter"
+	"github.com/micromdm/nanohub/authpolicy"
+	"github.com/micromdm/nanohub/capability"
 	"github.com/micromdm/nanohub/enqueue"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/idtransform"
+	"github.com/micromdm/nanohub/kv/kvmap"
+	"github.com/micromdm/nanohub/migration"
+	"github.com/micromdm/nanohub/reenroll"
 	"github.com/micromdm/nanolib/log"
 
-	"github.com/cespare/xxhash"
-	"github.com/jessepeterson/kmfddm/notifier"
-	ddmstorage "github.com/jessepeterson/kmfddm/storage"
-	"github.com/micromdm/nanocmd/engine"
 	"github.com/micromdm/nanocmd/logkeys"
 	"github.com/micromdm/nanocmd/workflow"
-	nanoapi "github.com/micromdm/nanomdm/api"
-	"github.com/micromdm/nanomdm/cryptoutil"
 	"github.com/micromdm/nanomdm/http/authproxy"
 	nanohttpmdm "github.com/micromdm/nanomdm/http/mdm"
 	nanoservice "github.com/micromdm/nanomdm/service"
@@ -45,6 +43,10 @@ type Engine interface {
 
 	// StartWorkflow starts a new workflow instance for workflow name.
 	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+
+	// MDMCommandResponseEvent delivers an MDM command response to any
+	// workflow awaiting it.
+	MDMCommandResponseEvent(ctx context.Context, id, uuid string, raw []byte, mdmCtx *workflow.MDMContext) error
 }
 
 type runner interface {
@@ -58,11 +60,19 @@ type NanoHUB struct {
 	nanomdm    http.Handler
 	checkin    http.Handler
 	migration  http.Handler
+	migrator   *migration.Migrator
 	engine     Engine
 	dmNotifier DMNotifier
+	debouncer  *enqueue.Debouncer
+	debounce   time.Duration
+	enqueuer   capability.Enqueuer
 	authMW     func(http.Handler) http.Handler
 	car        nanostorage.CertAuthRetriever
 	runner     runner
+	workflows  []string
+
+	authProxyPolicies    []authpolicy.Policy
+	authProxyIDTransform idtransform.Transformer
 }
 
 type Store interface {
@@ -81,12 +91,8 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 		panic("nil store")
 	}
 
-	config := newConfig()
-	if err := config.runOptions(opts...); err != nil {
-		return nil, err
-	}
-
-	if err := config.validate(); err != nil {
+	config, err := newConfigFromOptions(opts...)
+	if err != nil {
 		return nil, err
 	}
 
@@ -114,51 +120,32 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 	}
 
 	// create the NanoHUB!
-	hub := &NanoHUB{logger: config.logger, car: store}
+	hub := &NanoHUB{
+		logger:               config.logger,
+		car:                  store,
+		authProxyPolicies:    config.authProxyPolicies,
+		authProxyIDTransform: config.authProxyIDTransform,
+	}
 
-	// create NanoMDM API result enqueuer
-	nanoPushEnq, err := nanoapi.NewPushEnqueuer(store, config.pusher, nanoapi.WithLogger(config.logger.With("service", "enqueue")))
+	pushEnq, err := buildEnqueuer(config, store)
 	if err != nil {
-		return nil, fmt.Errorf("creating push enqueuer: %w", err)
+		return nil, err
 	}
-
-	// create NanoHUB enqueue wrapper around NanoMDM API result enqueuer.
-	// satisfies both DM and NanoCMD command enqueuer interfaces.
-	pushEnq := enqueue.New(nanoPushEnq)
+	hub.enqueuer = pushEnq
 
 	svcs := config.svcs
 
 	// declarative management configuration
 	if config.dmStore != nil {
-		var dmStore ddmstorage.EnrollmentDeclarationStorage = config.dmStore
-		if len(config.dmDStores) >= 1 {
-			// if we have additional DM declaration storages configured
-			// then wrap them in a Multi storage wrapped by a JSONAdapt.
-			dmStore = ddmstorage.NewJSONAdapt(
-				ddmstorage.NewMulti(
-					append(config.dmDStores, config.dmStore)...,
-				),
-				func() hash.Hash { return xxhash.New() },
-			)
-		}
-
-		dmAdapter, err := ddmadapter.New(dmStore, append(config.dmOpts,
-			ddmadapter.WithLogger(config.logger.With("service", "dm")),
-		)...)
-		if err != nil {
-			return nil, fmt.Errorf("creating DM adapter: %w", err)
-		}
-
-		nanoOpts = append(nanoOpts, nanomdm.WithDeclarativeManagement(dmAdapter))
-
-		hub.dmNotifier, err = notifier.New(pushEnq, config.dmStore, notifier.WithLogger(config.logger.With("service", "notifier")))
+		dm, err := buildDM(config, pushEnq)
 		if err != nil {
-			return nil, fmt.Errorf("creating notifier: %w", err)
-		}
-
-		if config.dmRmSets {
-			svcs = append(svcs, ddmadapter.NewSetsRemover(config.dmStore, nil))
+			return nil, err
 		}
+		nanoOpts = append(nanoOpts, nanomdm.WithDeclarativeManagement(dm.Adapter))
+		hub.dmNotifier = dm.Notifier
+		hub.debouncer = dm.Debouncer
+		hub.debounce = dm.Debounce
+		svcs = append(svcs, dm.Services...)
 	}
 
 	// create 'core' MDM service
@@ -166,52 +153,31 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 
 	// command workflow (NanoCMD) configuration
 	if config.cmdStore != nil {
-		e := engine.New(
-			config.cmdStore,
-			pushEnq,
-			append(
-				[]engine.Option{engine.WithLogger(config.logger.With("service", "nanocmd"))},
-				config.cmdOpts...,
-			)...,
-		)
-
-		hub.engine = e
-
-		// create the adapter
-		cmdSvc, err := cmdservice.New(e, append(config.cmdSvcOpts,
-			cmdservice.WithTokenUpdateTallyStore(store),
-			cmdservice.WithLogger(config.logger.With("service", "cmdservice")),
-		)...)
+		wf, err := buildWorkflowEngine(config, store, pushEnq)
 		if err != nil {
-			return nil, fmt.Errorf("creating nanocmd service: %w", err)
+			return nil, err
+		}
+		hub.engine = wf.Engine
+		hub.workflows = wf.Workflows
+		if wf.Worker != nil {
+			hub.runner = wf.Worker
 		}
 
 		// add our adapter service to list of services
-		svcs = append([]nanoservice.CheckinAndCommandService{cmdSvc}, svcs...)
-
-		// create and register any workflows
-		for _, fn := range config.cmdWorkflows {
-			if fn == nil {
-				continue
-			}
-			w, err := fn(e)
-			if err != nil {
-				return nil, fmt.Errorf("creating workflow: %w", err)
-			}
-			if err = e.RegisterWorkflow(w); err != nil {
-				return nil, fmt.Errorf("registering workflow: %w", err)
-			}
-		}
+		svcs = append([]nanoservice.CheckinAndCommandService{wf.Service}, svcs...)
+	}
 
-		if config.cmdWorkerStore != nil {
-			// configure command workflow engine worker
-			hub.runner = engine.NewWorker(
-				e,
-				config.cmdWorkerStore,
-				pushEnq,
-				append(config.cmdWorkerOpts, engine.WithWorkerLogger(config.logger.With("service", "worker")))...,
-			)
+	if len(config.reenrollHooks) >= 1 {
+		// detect re-enrollments for the hooks
+		reenrollStore := config.reenrollStore
+		if reenrollStore == nil {
+			reenrollStore = reenroll.NewKVStore(kvmap.New())
+		}
+		reenrollOpts := []reenroll.Option{reenroll.WithLogger(config.logger.With("service", "reenroll"))}
+		for _, hook := range config.reenrollHooks {
+			reenrollOpts = append(reenrollOpts, reenroll.WithHook(hook))
 		}
+		svcs = append(svcs, reenroll.New(reenrollStore, store, reenrollOpts...))
 	}
 
 	if len(config.webhookURLs) >= 1 {
@@ -221,6 +187,20 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 		}
 	}
 
+	if len(config.eventSinks) >= 1 {
+		// send device events to any configured sinks
+		svcs = append(svcs, event.NewService(config.eventSinks, config.logger.With("service", "event")))
+	}
+
+	if len(config.streamSinks) >= 1 {
+		// stream live device events including all command results
+		svcs = append(svcs, event.NewService(
+			config.streamSinks,
+			config.logger.With("service", "event-stream"),
+			event.WithCommandResults(),
+		))
+	}
+
 	if len(svcs) >= 1 {
 		// wrap all of the supplementary NanoMDM services in a mutli-service adapter.
 		nanoSvc = multi.New(
@@ -230,6 +210,14 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 		)
 	}
 
+	if config.migration {
+		// migrated enrollments have no certificate to authorize
+		hub.migrator = migration.New(nanoSvc, append(
+			[]migration.Option{migration.WithLogger(config.logger.With("service", "migration"))},
+			config.migrationOpts...,
+		)...)
+	}
+
 	// wrap the core service in certificate authorization middleware
 	nanoSvc = certauth.New(
 		nanoSvc,
@@ -242,42 +230,10 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 		nanoSvc = dump.New(nanoSvc, config.dumpWriter)
 	}
 
-	verifier, err := config.getOrMakeVerifier()
-	if err != nil {
+	if hub.authMW, err = buildAuthMiddleware(config); err != nil {
 		return nil, err
 	}
 
-	// wrapped in "double" function to avoid keeping a reference to the config struct
-	hub.authMW = func(ac authConfig, cvl, cel log.Logger) func(h http.Handler) http.Handler {
-		return func(h http.Handler) http.Handler {
-			// as the last wrapped step before the service, verify the cert validity
-			h = nanohttpmdm.CertVerifyMiddleware(h, verifier, cvl)
-
-			if ac.mdmSignature {
-				// Mdm-Signature header is configured
-				return nanohttpmdm.CertExtractMdmSignatureMiddleware(
-					h,
-					nanohttpmdm.MdmSignatureVerifierFunc(cryptoutil.VerifyMdmSignature),
-					nanohttpmdm.SigLogWithLogger(cel),
-					nanohttpmdm.SigLogWithLogErrors(ac.signatureLogErrors),
-				)
-			}
-
-			// mTLS is (default) configured
-			if ac.signatureHeader != "" {
-				// signature header name present, extract from header
-				return nanohttpmdm.CertExtractPEMHeaderMiddleware(h, ac.signatureHeader, cel)
-			}
-
-			// default to mTLS (i.e. Go native mTLS) extraction
-			return nanohttpmdm.CertExtractTLSMiddleware(h, cel)
-		}
-	}(
-		config.authConfig,
-		config.logger.With("handler", "cert-verify"),
-		config.logger.With("handler", "cert-extract"),
-	)
-
 	// create the primary "ServerURL" handler
 	if config.noCombined {
 		hub.nanomdm = nanohttpmdm.CommandAndReportResultsHandler(nanoSvc, config.logger.With(
@@ -290,7 +246,7 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 			"handler", "server",
 		))
 	}
-	hub.nanomdm = hub.authMW(hub.nanomdm)
+	hub.nanomdm = limitBody(hub.authMW(hub.nanomdm), config.maxBodySize)
 
 	if config.checkin {
 		// create the separate "CheckInURL" handler
@@ -298,7 +254,7 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 			"service", "handler",
 			"handler", "checkin",
 		))
-		hub.checkin = hub.authMW(hub.checkin)
+		hub.checkin = limitBody(hub.authMW(hub.checkin), config.maxBodySize)
 	}
 
 	if config.migration {
@@ -312,6 +268,23 @@ func New(store Store, opts ...Option) (*NanoHUB, error) {
 	return hub, nil
 }
 
+// limitBody wraps h to reject request bodies larger than size bytes.
+// Returns h unmodified if size is zero.
+func limitBody(h http.Handler, size int64) http.Handler {
+	if size <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > size {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// protect against bodies without (or with a wrong) content length
+		r.Body = http.MaxBytesReader(w, r.Body, size)
+		h.ServeHTTP(w, r)
+	})
+}
+
 // ServerHandler returns the primary "ServerURL" HTTP handler.
 func (nh *NanoHUB) ServerHandler() http.Handler {
 	return nh.nanomdm
@@ -331,12 +304,28 @@ func (nh *NanoHUB) MigrationHandler() http.Handler {
 	return nh.migration
 }
 
+// Migrator returns the bulk enrollment migrator if migration was
+// configured or nil. Like the migration handler it is not authenticated.
+func (nh *NanoHUB) Migrator() *migration.Migrator {
+	return nh.migrator
+}
+
 // Engine returns an interface that runs against the command workflow engine.
 // May be nil if the command workflow engine was not configured.
 func (nh *NanoHUB) Engine() Engine {
 	return nh.engine
 }
 
+// Enqueuer returns the MDM command enqueuer used by DM and workflows.
+func (nh *NanoHUB) Enqueuer() capability.Enqueuer {
+	return nh.enqueuer
+}
+
+// Workflows returns the names of the registered workflows.
+func (nh *NanoHUB) Workflows() []string {
+	return nh.workflows
+}
+
 // DMNotifier returns the DMNotifier.
 // Ostensibly to support API endpoints.
 func (nh *NanoHUB) DMNotifier() DMNotifier {
@@ -359,6 +348,23 @@ func (nh *NanoHUB) GoStartEngineRunner(ctx context.Context) {
 	}(nh.runner, nh.logger)
 }
 
+// GoStartDMDebouncer spawns the DM command debouncer in the background.
+// It does nothing unless configured with [WithDMDebounce].
+func (nh *NanoHUB) GoStartDMDebouncer(ctx context.Context) {
+	if nh.debouncer == nil {
+		return
+	}
+	go func(debouncer *enqueue.Debouncer, logger log.Logger) {
+		err := debouncer.Run(ctx, nh.debounce)
+		logs := []interface{}{logkeys.Message, "DM debouncer stopped"}
+		if err != nil {
+			logger.Info(append(logs, logkeys.Error, err)...)
+			return
+		}
+		logger.Debug(logs...)
+	}(nh.debouncer, nh.logger)
+}
+
 // IDAuthMiddleware wraps h in the same MDM authentication-requiring
 // HTTP handlers that the MDM protocol uses.
 // This is ostensibly to support Declarative Managament asset URLs that
@@ -380,6 +386,10 @@ func (nh *NanoHUB) IDAuthMiddleware(h http.Handler) http.Handler {
 // It should provide the enrollment ID to the proxied URL in idHeaderName.
 // Note you may wish to add any WithHeaderFunc() options for additional
 // headers (i.e. trace IDs, etc.) to identify the request downstream.
+// Requests must also pass any configured authproxy policies
+// (see [WithAuthProxyPolicy]). If an ID transform is configured
+// (see [WithAuthProxyIDTransform]) the transformed ID is provided
+// instead of the enrollment ID.
 func (nh *NanoHUB) NewAuthProxy(dest string, idHeaderName string, opts ...authproxy.Option) (http.Handler, error) {
 	if dest == "" {
 		return nil, errors.New("empty destination URL")
@@ -388,14 +398,38 @@ func (nh *NanoHUB) NewAuthProxy(dest string, idHeaderName string, opts ...authpr
 		return nil, errors.New("empty ID header name")
 	}
 
-	authProxy, err := authproxy.New(dest,
+	idFunc := nanohttpmdm.GetEnrollmentID
+	if nh.authProxyIDTransform != nil {
+		idFunc = idtransform.FromContext
+	}
+
+	proxy, err := authproxy.New(dest, append([]authproxy.Option{
 		authproxy.WithLogger(nh.logger.With("handler", "authproxy")),
-		// populate a header with the discovered enrollment ID
-		authproxy.WithHeaderFunc(idHeaderName, nanohttpmdm.GetEnrollmentID),
-	)
+		// populate a header with the discovered (or transformed) enrollment ID
+		authproxy.WithHeaderFunc(idHeaderName, idFunc),
+	}, opts...)...)
 	if err != nil {
 		return nil, err
 	}
+	var authProxy http.Handler = proxy
+
+	if nh.authProxyIDTransform != nil {
+		authProxy = idtransform.Middleware(
+			authProxy,
+			nanohttpmdm.GetEnrollmentID,
+			nh.authProxyIDTransform,
+			nh.logger.With("handler", "authproxy-id-transform"),
+		)
+	}
+
+	if len(nh.authProxyPolicies) > 0 {
+		authProxy = authpolicy.Middleware(
+			authProxy,
+			nanohttpmdm.GetEnrollmentID,
+			nh.logger.With("handler", "authproxy-policy"),
+			nh.authProxyPolicies...,
+		)
+	}
 
 	return nh.IDAuthMiddleware(authProxy), nil
 }
@@ -3,6 +3,11 @@ package nanohub
 import (
 	"context"
 	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/micromdm/nanomdm/storage/inmem"
@@ -14,6 +19,13 @@ func (v *nopVerifier) Verify(context.Context, *x509.Certificate) error {
 	return nil
 }
 
+type errVerifier struct{ calls int }
+
+func (v *errVerifier) Verify(context.Context, *x509.Certificate) error {
+	v.calls++
+	return errors.New("verifier error")
+}
+
 func TestInvalidConfig(t *testing.T) {
 	s := inmem.New()
 
@@ -30,3 +42,85 @@ func TestInvalidConfig(t *testing.T) {
 	}
 
 }
+
+func TestBuildNotConfigured(t *testing.T) {
+	s := inmem.New()
+
+	enq, err := BuildEnqueuer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = BuildDM(enq); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("DM: have: %v, want: %v", err, ErrNotConfigured)
+	}
+
+	if _, err = BuildWorkflowEngine(s, enq); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("workflow engine: have: %v, want: %v", err, ErrNotConfigured)
+	}
+
+	if _, err = BuildAuthMiddleware(WithRootPEMs([]byte("hello")), WithVerifier(new(nopVerifier))); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestVerifiers(t *testing.T) {
+	first, second := new(errVerifier), new(errVerifier)
+	c, err := newConfigFromOptions(
+		WithVerifier(new(nopVerifier)),
+		WithVerifiers(first),
+		WithVerifiers(second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.getOrMakeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all verifiers must pass
+	if err = v.Verify(context.Background(), nil); err == nil {
+		t.Error("expected error")
+	}
+	if first.calls != 1 || second.calls != 0 {
+		t.Errorf("calls: have %d and %d, want 1 and 0", first.calls, second.calls)
+	}
+
+	if _, err = newConfigFromOptions(WithVerifiers(nil)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	var readErr error
+	h := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}), 8)
+
+	for _, test := range []struct {
+		name    string
+		body    string
+		length  int64
+		status  int
+		readErr bool
+	}{
+		{"small", "12345678", 8, http.StatusOK, false},
+		// rejected by content length before the body is read
+		{"large", "123456789", 9, http.StatusRequestEntityTooLarge, false},
+		// rejected while reading a body without a content length
+		{"unknown-length", "123456789", -1, http.StatusOK, true},
+	} {
+		readErr = nil
+		r := httptest.NewRequest("POST", "/mdm", strings.NewReader(test.body))
+		r.ContentLength = test.length
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("%s: have status %d, want %d", test.name, rec.Code, test.status)
+		}
+		if (readErr != nil) != test.readErr {
+			t.Errorf("%s: have read error %v, want error %v", test.name, readErr, test.readErr)
+		}
+	}
+}
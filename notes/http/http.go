@@ -0,0 +1,127 @@
+// Package http provides the HTTP API for enrollment notes and ownership records.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/notes"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoIDs is returned when no enrollment IDs are provided.
+var ErrNoIDs = errors.New("no ids provided")
+
+// GetRecordsHandler returns the records for the "id" query parameters.
+func GetRecordsHandler(store notes.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		records, err := store.RetrieveRecords(r.Context(), ids)
+		if err != nil {
+			logger.Info("msg", "retrieving records", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, records, logger)
+	}
+}
+
+// PutRecordHandler stores the JSON record in the request body for
+// the enrollment ID in the URL path.
+func PutRecordHandler(store notes.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		record := new(notes.Record)
+		if err := json.NewDecoder(r.Body).Decode(record); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding record: %w", err), http.StatusBadRequest)
+			return
+		}
+		record.UpdatedAt = time.Now()
+
+		if err := store.StoreRecord(r.Context(), id, record); err != nil {
+			logger.Info("msg", "storing record", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored record", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteRecordHandler deletes the record for the enrollment ID in the URL path.
+func DeleteRecordHandler(store notes.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteRecord(r.Context(), id); err != nil {
+			logger.Info("msg", "deleting record", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted record", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the notes API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store notes.Store) {
+	mux.Handle(
+		prefix+"/notes",
+		GetRecordsHandler(store, logger.With("handler", "get-notes")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/notes/:id",
+		PutRecordHandler(store, logger.With("handler", "put-notes")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/notes/:id",
+		DeleteRecordHandler(store, logger.With("handler", "delete-notes")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,62 @@
+package notes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores enrollment records in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new record store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// RetrieveRecords retrieves the records for ids.
+func (s *KVStore) RetrieveRecords(ctx context.Context, ids []string) (map[string]*Record, error) {
+	ret := make(map[string]*Record)
+	for _, id := range ids {
+		v, err := s.b.Get(ctx, id)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return ret, fmt.Errorf("getting record %s: %w", id, err)
+		}
+		r := new(Record)
+		if err = json.Unmarshal(v, r); err != nil {
+			return ret, fmt.Errorf("unmarshal record %s: %w", id, err)
+		}
+		ret[id] = r
+	}
+	return ret, nil
+}
+
+// StoreRecord stores the record for id.
+func (s *KVStore) StoreRecord(ctx context.Context, id string, r *Record) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if r == nil {
+		return errors.New("nil record")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	return s.b.Set(ctx, id, v)
+}
+
+// DeleteRecord deletes the record for id.
+func (s *KVStore) DeleteRecord(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
@@ -0,0 +1,68 @@
+// Package notes stores free-form notes and ownership records for enrollments.
+package notes
+
+import (
+	"context"
+	"time"
+
+	"github.com/micromdm/nanohub/event"
+)
+
+// Record contains operator-maintained information about an enrollment.
+type Record struct {
+	Owner     string    `json:"owner,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// Store stores and retrieves enrollment records.
+type Store interface {
+	// RetrieveRecords retrieves the records for ids.
+	// IDs without a record are not included in the returned map.
+	RetrieveRecords(ctx context.Context, ids []string) (map[string]*Record, error)
+
+	// StoreRecord stores (replaces) the record for id.
+	StoreRecord(ctx context.Context, id string, r *Record) error
+
+	// DeleteRecord deletes the record for id.
+	DeleteRecord(ctx context.Context, id string) error
+}
+
+// Enricher is an event sink that adds enrollment record fields to
+// events before sending them to the next sink.
+type Enricher struct {
+	store Store
+	next  event.Sink
+}
+
+// NewEnricher creates a new enriching event sink.
+func NewEnricher(store Store, next event.Sink) *Enricher {
+	if store == nil {
+		panic("nil store")
+	}
+	if next == nil {
+		panic("nil sink")
+	}
+	return &Enricher{store: store, next: next}
+}
+
+// Send adds the "owner", "location", and "notes" fields to e
+// if a record exists for the event's enrollment.
+func (en *Enricher) Send(ctx context.Context, e *event.Event) error {
+	if e != nil && e.EnrollmentID != "" {
+		records, err := en.store.RetrieveRecords(ctx, []string{e.EnrollmentID})
+		if err != nil {
+			return err
+		}
+		if r, ok := records[e.EnrollmentID]; ok {
+			if e.Fields == nil {
+				e.Fields = make(map[string]string)
+			}
+			e.Fields["owner"] = r.Owner
+			e.Fields["location"] = r.Location
+			e.Fields["notes"] = r.Notes
+		}
+	}
+	return en.next.Send(ctx, e)
+}
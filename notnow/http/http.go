@@ -0,0 +1,119 @@
+// Package http provides the HTTP API for NotNow streaks.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/notnow"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when an enrollment has no NotNow streak.
+	ErrNotFound = errors.New("no NotNow streak")
+)
+
+// GetStreaksHandler returns the NotNow streaks of all enrollments.
+func GetStreaksHandler(s *notnow.Scheduler, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil scheduler")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		streaks, err := s.Streaks(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving streaks", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, streaks, logger)
+	}
+}
+
+// GetStreakHandler returns the NotNow streak of the enrollment ID in the URL path.
+func GetStreakHandler(s *notnow.Scheduler, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil scheduler")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		streak, err := s.Streak(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving streak", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if streak == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, streak, logger)
+	}
+}
+
+// DeleteStreakHandler clears the NotNow streak of the enrollment ID in the URL path.
+func DeleteStreakHandler(s *notnow.Scheduler, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil scheduler")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := s.Reset(r.Context(), id); err != nil {
+			logger.Info("msg", "resetting streak", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "reset streak", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the NotNow API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, s *notnow.Scheduler) {
+	mux.Handle(
+		prefix+"/notnow",
+		GetStreaksHandler(s, logger.With("handler", "get-notnow-streaks")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/notnow/:id",
+		GetStreakHandler(s, logger.With("handler", "get-notnow-streak")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/notnow/:id",
+		DeleteStreakHandler(s, logger.With("handler", "delete-notnow-streak")),
+		"DELETE",
+	)
+}
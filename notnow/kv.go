@@ -0,0 +1,74 @@
+package notnow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores NotNow streaks in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new streak store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreStreak stores the NotNow streak of an enrollment.
+func (s *KVStore) StoreStreak(ctx context.Context, streak *Streak) error {
+	if streak == nil || streak.ID == "" {
+		return errors.New("invalid streak")
+	}
+	v, err := json.Marshal(streak)
+	if err != nil {
+		return fmt.Errorf("marshal streak: %w", err)
+	}
+	return s.b.Set(ctx, streak.ID, v)
+}
+
+// RetrieveStreak retrieves the NotNow streak of id.
+func (s *KVStore) RetrieveStreak(ctx context.Context, id string) (*Streak, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	streak := new(Streak)
+	if err = json.Unmarshal(v, streak); err != nil {
+		return nil, fmt.Errorf("unmarshal streak: %w", err)
+	}
+	return streak, nil
+}
+
+// DeleteStreak deletes the NotNow streak of id.
+func (s *KVStore) DeleteStreak(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
+
+// RetrieveStreaks retrieves all NotNow streaks.
+func (s *KVStore) RetrieveStreaks(ctx context.Context) ([]*Streak, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	streaks := make([]*Streak, 0, len(keys))
+	for _, k := range keys {
+		streak, err := s.RetrieveStreak(ctx, k)
+		if err != nil {
+			return streaks, fmt.Errorf("retrieving streak %s: %w", k, err)
+		}
+		if streak != nil {
+			streaks = append(streaks, streak)
+		}
+	}
+	return streaks, nil
+}
@@ -0,0 +1,252 @@
+// Package notnow re-pushes enrollments that defer commands with NotNow.
+// Enrollments respond NotNow when they can't process a command at the
+// moment (e.g. the device is locked). Rather than waiting for the
+// generic re-push interval, they are re-pushed after a delay that
+// doubles with every consecutive NotNow and unanswered re-push.
+package notnow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+	"github.com/micromdm/nanomdm/service"
+)
+
+const (
+	// DefaultDelay is the default delay before re-pushing after the
+	// first NotNow of a streak.
+	DefaultDelay = 5 * time.Minute
+
+	// DefaultMaxDelay is the default maximum delay between re-pushes.
+	DefaultMaxDelay = 4 * time.Hour
+)
+
+// Streak is a run of consecutive NotNow responses from an enrollment.
+type Streak struct {
+	ID string `json:"id"`
+
+	// Count is the number of consecutive NotNow responses.
+	Count int `json:"count"`
+
+	// Commands counts the NotNow responses by command UUID.
+	Commands map[string]int `json:"commands"`
+
+	Since  time.Time `json:"since"` // time of the first NotNow
+	LastAt time.Time `json:"last_at"`
+
+	// Pushes is the number of re-pushes since the last NotNow.
+	Pushes     int       `json:"pushes"`
+	NextPushAt time.Time `json:"next_push_at"`
+}
+
+// Store stores NotNow streaks.
+type Store interface {
+	StoreStreak(ctx context.Context, s *Streak) error
+
+	// RetrieveStreak retrieves the streak of id.
+	// A nil streak is returned if id has no streak.
+	RetrieveStreak(ctx context.Context, id string) (*Streak, error)
+
+	DeleteStreak(ctx context.Context, id string) error
+
+	// RetrieveStreaks retrieves all streaks.
+	RetrieveStreaks(ctx context.Context) ([]*Streak, error)
+}
+
+// Scheduler tracks NotNow streaks and re-pushes their enrollments.
+// It is also a NanoMDM service that records NotNow responses and ends
+// streaks once enrollments process a command.
+type Scheduler struct {
+	service.CheckinAndCommandService
+
+	store    Store
+	pusher   push.Pusher
+	delay    time.Duration
+	maxDelay time.Duration
+	logger   log.Logger
+	clock    clock.Clock
+}
+
+// Option configures the scheduler.
+type Option func(*Scheduler)
+
+// WithDelay configures the delay before the first re-push of a streak
+// and the maximum delay between re-pushes.
+func WithDelay(delay, max time.Duration) Option {
+	return func(s *Scheduler) {
+		s.delay = delay
+		s.maxDelay = max
+	}
+}
+
+// WithLogger configures a logger for the scheduler.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Scheduler) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the scheduler.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// New creates a new scheduler re-pushing with pusher.
+func New(store Store, pusher push.Pusher, opts ...Option) *Scheduler {
+	if store == nil {
+		panic("nil store")
+	}
+	if pusher == nil {
+		panic("nil pusher")
+	}
+	s := &Scheduler{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		pusher:                   pusher,
+		delay:                    DefaultDelay,
+		maxDelay:                 DefaultMaxDelay,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// backoff returns the delay before the nth re-push attempt (from 1).
+func (s *Scheduler) backoff(n int) time.Duration {
+	d := s.delay
+	for i := 1; i < n && d < s.maxDelay; i++ {
+		d *= 2
+	}
+	if d > s.maxDelay {
+		d = s.maxDelay
+	}
+	return d
+}
+
+// CommandAndReportResults records NotNow responses. Any other response
+// to a command ends the streak of the enrollment.
+func (s *Scheduler) CommandAndReportResults(r *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if r.ID == "" || results.CommandUUID == "" {
+		return nil, nil
+	}
+	ctx := r.Context()
+	streak, err := s.store.RetrieveStreak(ctx, r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving streak: %w", err)
+	}
+
+	if results.Status != "NotNow" {
+		if streak == nil {
+			return nil, nil
+		}
+		if err = s.store.DeleteStreak(ctx, r.ID); err != nil {
+			return nil, fmt.Errorf("deleting streak: %w", err)
+		}
+		ctxlog.Logger(ctx, s.logger).Debug("msg", "streak ended", "id", r.ID, "count", streak.Count)
+		return nil, nil
+	}
+
+	now := s.clock.Now()
+	if streak == nil {
+		streak = &Streak{ID: r.ID, Since: now}
+	}
+	if streak.Commands == nil {
+		streak.Commands = make(map[string]int)
+	}
+	streak.Count++
+	streak.Commands[results.CommandUUID]++
+	streak.LastAt = now
+	streak.Pushes = 0
+	streak.NextPushAt = now.Add(s.backoff(streak.Count))
+	if err = s.store.StoreStreak(ctx, streak); err != nil {
+		return nil, fmt.Errorf("storing streak: %w", err)
+	}
+	return nil, nil
+}
+
+// Streak returns the NotNow streak of id.
+// A nil streak is returned if id has no streak.
+func (s *Scheduler) Streak(ctx context.Context, id string) (*Streak, error) {
+	return s.store.RetrieveStreak(ctx, id)
+}
+
+// Streaks returns all NotNow streaks sorted by ID.
+func (s *Scheduler) Streaks(ctx context.Context) ([]*Streak, error) {
+	streaks, err := s.store.RetrieveStreaks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(streaks, func(i, j int) bool { return streaks[i].ID < streaks[j].ID })
+	return streaks, nil
+}
+
+// Reset clears the streak of id. It is no longer re-pushed.
+func (s *Scheduler) Reset(ctx context.Context, id string) error {
+	return s.store.DeleteStreak(ctx, id)
+}
+
+// RePush re-pushes the enrollments whose streaks are due.
+func (s *Scheduler) RePush(ctx context.Context) error {
+	streaks, err := s.store.RetrieveStreaks(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving streaks: %w", err)
+	}
+	now := s.clock.Now()
+	var ids []string
+	for _, streak := range streaks {
+		if streak.NextPushAt.After(now) {
+			continue
+		}
+		streak.Pushes++
+		streak.NextPushAt = now.Add(s.backoff(streak.Count + streak.Pushes))
+		if err = s.store.StoreStreak(ctx, streak); err != nil {
+			return fmt.Errorf("storing streak for %s: %w", streak.ID, err)
+		}
+		ids = append(ids, streak.ID)
+	}
+	if len(ids) < 1 {
+		return nil
+	}
+	ctxlog.Logger(ctx, s.logger).Debug("msg", "re-pushing", "count", len(ids))
+	_, err = s.pusher.Push(ctx, ids)
+	return err
+}
+
+// Run re-pushes due enrollments every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+			if err := s.RePush(ctx); err != nil {
+				ctxlog.Logger(ctx, s.logger).Info("msg", "re-pushing NotNow enrollments", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package notnow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+)
+
+type pusher struct {
+	pushed []string
+}
+
+func (p *pusher) Push(_ context.Context, ids []string) (map[string]*push.Response, error) {
+	p.pushed = append(p.pushed, ids...)
+	return nil, nil
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	p := new(pusher)
+	s := New(NewKVStore(kvmap.New()), p, WithClock(c), WithDelay(time.Minute, 3*time.Minute))
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	report := func(uuid, status string) {
+		t.Helper()
+		if _, err := s.CommandAndReportResults(r, &mdm.CommandResults{CommandUUID: uuid, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report("CMD1", "NotNow")
+	report("CMD1", "NotNow")
+	streak, err := s.Streak(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streak == nil || streak.Count != 2 || streak.Commands["CMD1"] != 2 {
+		t.Fatalf("incorrect streak: %v", streak)
+	}
+
+	for _, test := range []struct {
+		advance time.Duration
+		pushes  int
+	}{
+		{time.Minute, 0},     // second NotNow doubles the delay
+		{time.Minute, 1},     // 2m after the last NotNow
+		{2 * time.Minute, 1}, // delay capped at 3m
+		{time.Minute, 2},
+	} {
+		c.Advance(test.advance)
+		if err = s.RePush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := len(p.pushed), test.pushes; have != want {
+			t.Errorf("have: %d pushes, want: %d", have, want)
+		}
+	}
+
+	// the enrollment processes the command
+	report("CMD1", "Acknowledged")
+	if streak, _ = s.Streak(ctx, "ID1"); streak != nil {
+		t.Errorf("expected ended streak: %v", streak)
+	}
+}
@@ -0,0 +1,84 @@
+// Package http provides the HTTP API for OS update progress.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/osupdate"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoIDs is returned when no enrollment IDs are provided.
+var ErrNoIDs = errors.New("no ids provided")
+
+// GetProgressHandler returns the OS update progress of the enrollment
+// IDs in the "id" query parameters.
+func GetProgressHandler(t *osupdate.Tracker, logger log.Logger) http.HandlerFunc {
+	if t == nil {
+		panic("nil tracker")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		progress, err := t.Progress(r.Context(), ids)
+		if err != nil {
+			logger.Info("msg", "retrieving progress", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, progress, logger)
+	}
+}
+
+// GetPostureHandler returns the OS update posture of the enrollment
+// IDs in the "id" query parameters.
+func GetPostureHandler(rep *osupdate.Reporter, logger log.Logger) http.HandlerFunc {
+	if rep == nil {
+		panic("nil reporter")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		postures, err := rep.Postures(r.Context(), ids)
+		if err != nil {
+			logger.Info("msg", "retrieving posture", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, postures, logger)
+	}
+}
+
+// HandleAPIv1 registers the OS update API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, t *osupdate.Tracker, rep *osupdate.Reporter) {
+	mux.Handle(
+		prefix+"/osupdate/progress",
+		GetProgressHandler(t, logger.With("handler", "get-osupdate-progress")),
+		"GET",
+	)
+	mux.Handle(
+		prefix+"/osupdate/posture",
+		GetPostureHandler(rep, logger.With("handler", "get-osupdate-posture")),
+		"GET",
+	)
+}
@@ -0,0 +1,50 @@
+package osupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores OS update progress in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new progress store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreProgress stores p, replacing the progress of p.ID.
+func (s *KVStore) StoreProgress(ctx context.Context, p *Progress) error {
+	if p == nil || p.ID == "" {
+		return errors.New("invalid progress")
+	}
+	v, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal progress: %w", err)
+	}
+	return s.b.Set(ctx, p.ID, v)
+}
+
+// RetrieveProgress retrieves the progress of enrollment id.
+func (s *KVStore) RetrieveProgress(ctx context.Context, id string) (*Progress, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p := new(Progress)
+	if err = json.Unmarshal(v, p); err != nil {
+		return nil, fmt.Errorf("unmarshal progress: %w", err)
+	}
+	return p, nil
+}
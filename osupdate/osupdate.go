@@ -0,0 +1,324 @@
+// Package osupdate schedules and tracks OS updates.
+// DDM-capable devices are sent software update enforcement declarations
+// and report their progress in DM status reports. Other devices are
+// sent ScheduleOSUpdate commands.
+package osupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	// DeclarationType is the type of software update enforcement declarations.
+	DeclarationType = "com.apple.configuration.softwareupdate.enforcement.specific"
+
+	// SubscriptionType is the type of status subscription declarations.
+	SubscriptionType = "com.apple.configuration.management.status-subscriptions"
+
+	// IdentifierPrefix prefixes the identifiers of generated
+	// declarations and the names of their DM sets.
+	IdentifierPrefix = "io.micromdm.nanohub.osupdate."
+
+	// StatusPath is the status report path of software update status items.
+	StatusPath = ".StatusItems.softwareupdate."
+)
+
+// Update methods.
+const (
+	MethodDDM     = "ddm"
+	MethodCommand = "command"
+)
+
+// Software update status item keys relative to StatusPath.
+const (
+	StatusInstallState   = "install-state"
+	StatusPendingVersion = "pending-version.os-version"
+	StatusFailureReason  = "failure-reason.reason"
+)
+
+// LocalDateTimeLayout is the layout of enforcement deadlines.
+const LocalDateTimeLayout = "2006-01-02T15:04:05"
+
+var (
+	ErrNoTargetVersion = errors.New("missing target OS version")
+	ErrInvalidDeadline = errors.New("invalid target local date time")
+)
+
+// Enforcement is an OS update to enforce.
+// It is the payload of software update enforcement declarations.
+type Enforcement struct {
+	TargetOSVersion     string `json:"TargetOSVersion"`
+	TargetBuildVersion  string `json:"TargetBuildVersion,omitempty"`
+	TargetLocalDateTime string `json:"TargetLocalDateTime"`
+	DetailsURL          string `json:"DetailsURL,omitempty"`
+}
+
+// Validate checks e for required fields.
+func (e *Enforcement) Validate() error {
+	if e == nil || e.TargetOSVersion == "" {
+		return ErrNoTargetVersion
+	}
+	if _, err := time.Parse(LocalDateTimeLayout, e.TargetLocalDateTime); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidDeadline, e.TargetLocalDateTime)
+	}
+	return nil
+}
+
+// MarshalBinary marshals e as the workflow context.
+func (e *Enforcement) MarshalBinary() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// UnmarshalBinary unmarshals the workflow context into e.
+func (e *Enforcement) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// Identifier returns the identifier of the declaration for e.
+// It is also the name of the DM set of the declarations.
+func (e *Enforcement) Identifier() string {
+	id := IdentifierPrefix + e.TargetOSVersion
+	if e.TargetBuildVersion != "" {
+		id += "." + e.TargetBuildVersion
+	}
+	return id
+}
+
+// Declaration generates the software update enforcement declaration for e.
+func Declaration(e *Enforcement) (*ddm.Declaration, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+	return &ddm.Declaration{
+		Identifier: e.Identifier(),
+		Type:       DeclarationType,
+		Payload:    payload,
+	}, nil
+}
+
+// SubscriptionDeclaration generates the status subscription declaration
+// for the software update status items tracked by this package.
+func SubscriptionDeclaration() *ddm.Declaration {
+	return &ddm.Declaration{
+		Identifier: IdentifierPrefix + "status-subscriptions",
+		Type:       SubscriptionType,
+		Payload: json.RawMessage(`{"StatusItems":[` +
+			`{"Name":"softwareupdate.install-state"},` +
+			`{"Name":"softwareupdate.pending-version"},` +
+			`{"Name":"softwareupdate.failure-reason"}]}`),
+	}
+}
+
+// Progress is the OS update progress of an enrollment.
+type Progress struct {
+	ID                  string `json:"id"`
+	Method              string `json:"method"`
+	TargetOSVersion     string `json:"target_os_version"`
+	TargetLocalDateTime string `json:"target_local_date_time,omitempty"`
+
+	// Set is the DM set of the declarations (DDM method).
+	Set string `json:"set,omitempty"`
+
+	// CommandUUID and CommandStatus are of the ScheduleOSUpdate command
+	// (command method).
+	CommandUUID   string `json:"command_uuid,omitempty"`
+	CommandStatus string `json:"command_status,omitempty"`
+
+	// Software update status items from DM status reports (DDM method).
+	InstallState   string `json:"install_state,omitempty"`
+	PendingVersion string `json:"pending_version,omitempty"`
+	FailureReason  string `json:"failure_reason,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store stores OS update progress by enrollment ID.
+type Store interface {
+	StoreProgress(ctx context.Context, p *Progress) error
+
+	// RetrieveProgress retrieves the progress of enrollment id.
+	// Nil is returned if no update was started for id.
+	RetrieveProgress(ctx context.Context, id string) (*Progress, error)
+}
+
+// Tracker tracks the OS update progress of enrollments.
+type Tracker struct {
+	store  Store
+	sink   event.Sink
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the tracker.
+type Option func(*Tracker)
+
+// WithSink sends progress events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(t *Tracker) {
+		t.sink = sink
+	}
+}
+
+// WithLogger configures a logger for the tracker.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(t *Tracker) {
+		t.logger = logger
+	}
+}
+
+// WithClock configures the clock of the tracker.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(t *Tracker) {
+		t.clock = c
+	}
+}
+
+// NewTracker creates a new tracker storing progress in store.
+func NewTracker(store Store, opts ...Option) *Tracker {
+	if store == nil {
+		panic("nil store")
+	}
+	t := &Tracker{
+		store:  store,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Progress retrieves the progress of enrollments ids.
+// Enrollments without a started update are omitted.
+func (t *Tracker) Progress(ctx context.Context, ids []string) (map[string]*Progress, error) {
+	ret := make(map[string]*Progress, len(ids))
+	for _, id := range ids {
+		p, err := t.store.RetrieveProgress(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving progress of %s: %w", id, err)
+		}
+		if p != nil {
+			ret[id] = p
+		}
+	}
+	return ret, nil
+}
+
+// start records the start of an update of p.ID.
+func (t *Tracker) start(ctx context.Context, p *Progress) error {
+	p.StartedAt = t.clock.Now()
+	p.UpdatedAt = p.StartedAt
+	return t.store.StoreProgress(ctx, p)
+}
+
+// commandResult records the ScheduleOSUpdate command status of id.
+func (t *Tracker) commandResult(ctx context.Context, id, uuid, status string) error {
+	return t.update(ctx, id, func(p *Progress) bool {
+		if p.CommandUUID != uuid || p.CommandStatus == status {
+			return false
+		}
+		p.CommandStatus = status
+		return true
+	})
+}
+
+// Update records the software update status item key (relative to
+// StatusPath) with value for enrollment id. Status of enrollments
+// without a started update is ignored.
+func (t *Tracker) Update(ctx context.Context, id, key, value string) error {
+	return t.update(ctx, id, func(p *Progress) bool {
+		var field *string
+		switch key {
+		case StatusInstallState:
+			field = &p.InstallState
+		case StatusPendingVersion:
+			field = &p.PendingVersion
+		case StatusFailureReason:
+			field = &p.FailureReason
+		default:
+			return false
+		}
+		if *field == value {
+			return false
+		}
+		*field = value
+		return true
+	})
+}
+
+// update applies fn to the progress of id and stores and sends an
+// event for it if fn reports a change.
+func (t *Tracker) update(ctx context.Context, id string, fn func(*Progress) bool) error {
+	p, err := t.store.RetrieveProgress(ctx, id)
+	if err != nil {
+		return fmt.Errorf("retrieving progress: %w", err)
+	}
+	if p == nil || !fn(p) {
+		return nil
+	}
+	p.UpdatedAt = t.clock.Now()
+	if err = t.store.StoreProgress(ctx, p); err != nil {
+		return fmt.Errorf("storing progress: %w", err)
+	}
+	if t.sink == nil {
+		return nil
+	}
+	ev := event.New(t.clock, event.TypeOSUpdateProgress, id)
+	ev.Fields["method"] = p.Method
+	ev.Fields["target_os_version"] = p.TargetOSVersion
+	for k, v := range map[string]string{
+		"command_status":  p.CommandStatus,
+		"install_state":   p.InstallState,
+		"pending_version": p.PendingVersion,
+		"failure_reason":  p.FailureReason,
+	} {
+		if v != "" {
+			ev.Fields[k] = v
+		}
+	}
+	if err = t.sink.Send(ctx, ev); err != nil {
+		ctxlog.Logger(ctx, t.logger).Info("msg", "sending event", "id", id, "err", err)
+	}
+	return nil
+}
+
+// StatusHandler records software update status items from DM status
+// reports. Register it for StatusPath.
+func (t *Tracker) StatusHandler(r *mdm.Request, path string, v *fastjson.Value) error {
+	value := v.String()
+	if v.Type() == fastjson.TypeString {
+		value = string(v.GetStringBytes())
+	}
+	err := t.Update(r.Context(), r.ID, strings.TrimPrefix(path, StatusPath), value)
+	if err != nil {
+		// do not fail the whole status report
+		ctxlog.Logger(r.Context(), t.logger).Info("msg", "updating progress", "path", path, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package osupdate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+type enqueuer struct{ steps []*workflow.StepEnqueueing }
+
+func (e *enqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+type declStore struct {
+	decls   map[string]*ddm.Declaration
+	setDecl map[string][]string
+	enrSets map[string]string
+}
+
+func (s *declStore) StoreDeclaration(_ context.Context, d *ddm.Declaration) (bool, error) {
+	s.decls[d.Identifier] = d
+	return true, nil
+}
+
+func (s *declStore) StoreSetDeclaration(_ context.Context, setName, declarationID string) (bool, error) {
+	s.setDecl[setName] = append(s.setDecl[setName], declarationID)
+	return true, nil
+}
+
+func (s *declStore) StoreEnrollmentSet(_ context.Context, enrollmentID, setName string) (bool, error) {
+	s.enrSets[enrollmentID] = setName
+	return true, nil
+}
+
+func (s *declStore) RemoveEnrollmentSet(_ context.Context, enrollmentID, _ string) (bool, error) {
+	delete(s.enrSets, enrollmentID)
+	return true, nil
+}
+
+type caps map[string]*capability.Device
+
+func (c caps) Device(_ context.Context, id string) (*capability.Device, error) {
+	return c[id], nil
+}
+
+func (c caps) Matrix() *capability.Matrix {
+	return capability.DefaultMatrix()
+}
+
+func TestWorkflow(t *testing.T) {
+	ctx := context.Background()
+	enq := new(enqueuer)
+	decls := &declStore{
+		decls:   make(map[string]*ddm.Declaration),
+		setDecl: make(map[string][]string),
+		enrSets: make(map[string]string),
+	}
+	var notified []string
+	notifier := NotifierFunc(func(_ context.Context, _, _, ids []string) error {
+		notified = append(notified, ids...)
+		return nil
+	})
+	devices := caps{
+		"sonoma":  {Platform: capability.MacOS, OSVersion: "14.4"},
+		"ventura": {Platform: capability.MacOS, OSVersion: "13.6"},
+	}
+
+	tracker := NewTracker(NewKVStore(kvmap.New()))
+	w, err := NewWorkflow(enq, tracker, WithDDM(decls, notifier, devices))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Enforcement{TargetOSVersion: "14.5", TargetLocalDateTime: "2024-06-01T12:00:00"}
+	step := &workflow.StepStart{IDs: []string{"sonoma", "ventura", "unknown"}}
+	step.Context = e
+	if err = w.Start(ctx, step); err != nil {
+		t.Fatal(err)
+	}
+
+	// DDM-capable enrollment
+	if have, want := decls.enrSets["sonoma"], e.Identifier(); have != want {
+		t.Errorf("set: have: %q, want: %q", have, want)
+	}
+	if d := decls.decls[e.Identifier()]; d == nil || d.Type != DeclarationType {
+		t.Errorf("enforcement declaration not stored: %v", d)
+	}
+	if len(decls.setDecl[e.Identifier()]) != 2 {
+		t.Errorf("set declarations: %v", decls.setDecl)
+	}
+	if len(notified) != 1 || notified[0] != "sonoma" {
+		t.Errorf("notified: %v", notified)
+	}
+
+	// command fallback enrollments
+	if len(enq.steps) != 2 {
+		t.Fatalf("have: %d steps, want: 2", len(enq.steps))
+	}
+	cmd, ok := enq.steps[0].Commands[0].(*mdmcommands.ScheduleOSUpdateCommand)
+	if !ok {
+		t.Fatal("incorrect command type")
+	}
+	if v := cmd.Command.Updates[0].ProductVersion; v == nil || *v != "14.5" {
+		t.Errorf("incorrect product version: %v", v)
+	}
+
+	// status report progress
+	if err = tracker.Update(ctx, "sonoma", StatusInstallState, "downloading"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tracker.Update(ctx, "other", StatusInstallState, "downloading"); err != nil {
+		t.Fatal(err)
+	}
+	progress, err := tracker.Progress(ctx, []string{"sonoma", "ventura", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 2 {
+		t.Errorf("have: %d progress, want: 2", len(progress))
+	}
+	if p := progress["sonoma"]; p == nil || p.Method != MethodDDM || p.InstallState != "downloading" {
+		t.Errorf("incorrect progress: %v", p)
+	}
+	if p := progress["ventura"]; p == nil || p.Method != MethodCommand {
+		t.Errorf("incorrect progress: %v", p)
+	}
+
+	e.TargetLocalDateTime = "tomorrow"
+	if err = w.Start(ctx, step); err == nil {
+		t.Error("expected invalid deadline error")
+	}
+}
+
+type responses map[string]map[string]*cmdresponse.Response
+
+func (r responses) RetrieveResponses(_ context.Context, id string) (map[string]*cmdresponse.Response, error) {
+	return r[id], nil
+}
+
+type enforcements map[string]*ddm.Declaration
+
+func (e enforcements) RetrieveDeclarationItemsJSON(context.Context, string) ([]byte, error) {
+	return []byte(`{"Declarations":{"Configurations":[{"Identifier":"u1"},{"Identifier":"u2"}]}}`), nil
+}
+
+func (e enforcements) RetrieveDeclaration(_ context.Context, id string) (*ddm.Declaration, error) {
+	return e[id], nil
+}
+
+func TestPosture(t *testing.T) {
+	ctx := context.Background()
+	declaration := func(version, deadline string) *ddm.Declaration {
+		d, err := Declaration(&Enforcement{TargetOSVersion: version, TargetLocalDateTime: deadline})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	info := func(version string) map[string]*cmdresponse.Response {
+		return map[string]*cmdresponse.Response{
+			cmdresponse.DeviceInformationType:  {DeviceInformation: &cmdresponse.DeviceInformation{OSVersion: version}},
+			cmdresponse.AvailableOSUpdatesType: {AvailableOSUpdates: []cmdresponse.OSUpdate{{Version: "14.5"}}},
+		}
+	}
+	r := NewReporter(
+		NewTracker(NewKVStore(kvmap.New())),
+		responses{"old": info("14.4"), "new": info("14.5.1")},
+		WithDeclarations(enforcements{
+			"u1": declaration("14.5", "2024-06-01T12:00:00"),
+			"u2": declaration("14.6", "2024-08-01T12:00:00"),
+		}),
+		WithReporterClock(clock.NewFake(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC))),
+	)
+
+	postures, err := r.Postures(ctx, []string{"old", "new", "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"old": PostureOverdue, "new": PostureUpToDate, "none": PostureUnknown} {
+		if p := postures[id]; p.State != want || p.TargetOSVersion != "14.5" {
+			t.Errorf("%s: have: %v %v, want: %v 14.5", id, p.State, p.TargetOSVersion, want)
+		}
+	}
+	if p := postures["old"]; p.LastCheck == nil || len(p.AvailableOSUpdates) != 1 || len(p.Enforcements) != 2 {
+		t.Errorf("incorrect posture: %v", p)
+	}
+}
@@ -0,0 +1,242 @@
+package osupdate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/capability"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+)
+
+// Update posture states.
+const (
+	// PostureUpToDate enrollments run at least the target OS version.
+	PostureUpToDate = "up_to_date"
+
+	// PosturePending enrollments have not yet updated to the target OS version.
+	PosturePending = "pending"
+
+	// PostureOverdue enrollments have not updated to the target OS
+	// version by its deadline.
+	PostureOverdue = "overdue"
+
+	// PostureFailed enrollments reported a software update failure.
+	PostureFailed = "failed"
+
+	// PostureUnknown enrollments have no target OS version or no
+	// reported OS version.
+	PostureUnknown = "unknown"
+)
+
+// ResponseStore retrieves the latest command responses of enrollments.
+type ResponseStore interface {
+	RetrieveResponses(ctx context.Context, id string) (map[string]*cmdresponse.Response, error)
+}
+
+// EnforcementStore retrieves the declarations assigned to enrollments.
+type EnforcementStore interface {
+	RetrieveDeclarationItemsJSON(ctx context.Context, enrollmentID string) ([]byte, error)
+	RetrieveDeclaration(ctx context.Context, declarationID string) (*ddm.Declaration, error)
+}
+
+// Posture is the OS update posture of an enrollment.
+// It joins the enforcement declarations assigned to the enrollment,
+// its OS update progress, and its DeviceInformation and
+// AvailableOSUpdates command responses.
+type Posture struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+
+	// Target OS version and deadline. These are from the enforcement
+	// declaration with the earliest deadline or otherwise from the
+	// update progress.
+	TargetOSVersion     string `json:"target_os_version,omitempty"`
+	TargetBuildVersion  string `json:"target_build_version,omitempty"`
+	TargetLocalDateTime string `json:"target_local_date_time,omitempty"`
+
+	// CurrentOSVersion and CurrentBuildVersion are from the latest
+	// DeviceInformation response received at DeviceInformationAt.
+	CurrentOSVersion    string     `json:"current_os_version,omitempty"`
+	CurrentBuildVersion string     `json:"current_build_version,omitempty"`
+	DeviceInformationAt *time.Time `json:"device_information_at,omitempty"`
+
+	// AvailableOSUpdates are from the latest AvailableOSUpdates
+	// response received at LastCheck.
+	AvailableOSUpdates []cmdresponse.OSUpdate `json:"available_os_updates,omitempty"`
+	LastCheck          *time.Time             `json:"last_check,omitempty"`
+
+	// Enforcements are the payloads of the enforcement declarations
+	// assigned to the enrollment.
+	Enforcements []*Enforcement `json:"enforcements,omitempty"`
+
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// Reporter reports the OS update posture of enrollments.
+type Reporter struct {
+	tracker      *Tracker
+	responses    ResponseStore
+	declarations EnforcementStore
+	clock        clock.Clock
+}
+
+// ReporterOption configures the reporter.
+type ReporterOption func(*Reporter)
+
+// WithDeclarations includes the enforcement declarations assigned to
+// enrollments in store.
+func WithDeclarations(store EnforcementStore) ReporterOption {
+	if store == nil {
+		panic("nil store")
+	}
+	return func(r *Reporter) {
+		r.declarations = store
+	}
+}
+
+// WithReporterClock configures the clock of the reporter.
+func WithReporterClock(c clock.Clock) ReporterOption {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Reporter) {
+		r.clock = c
+	}
+}
+
+// NewReporter creates a new posture reporter.
+func NewReporter(tracker *Tracker, responses ResponseStore, opts ...ReporterOption) *Reporter {
+	if tracker == nil {
+		panic("nil tracker")
+	}
+	if responses == nil {
+		panic("nil response store")
+	}
+	r := &Reporter{
+		tracker:   tracker,
+		responses: responses,
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Postures reports the OS update posture of enrollments ids.
+func (r *Reporter) Postures(ctx context.Context, ids []string) (map[string]*Posture, error) {
+	progress, err := r.tracker.Progress(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*Posture, len(ids))
+	for _, id := range ids {
+		p := &Posture{ID: id, Progress: progress[id]}
+		if err = r.setResponses(ctx, p); err != nil {
+			return nil, err
+		}
+		if r.declarations != nil {
+			if p.Enforcements, err = r.enforcements(ctx, id); err != nil {
+				return nil, err
+			}
+		}
+		r.setState(p)
+		ret[id] = p
+	}
+	return ret, nil
+}
+
+// setResponses sets the command response fields of p.
+func (r *Reporter) setResponses(ctx context.Context, p *Posture) error {
+	responses, err := r.responses.RetrieveResponses(ctx, p.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving responses of %s: %w", p.ID, err)
+	}
+	if resp := responses[cmdresponse.DeviceInformationType]; resp != nil && resp.DeviceInformation != nil {
+		p.CurrentOSVersion = resp.DeviceInformation.OSVersion
+		p.CurrentBuildVersion = resp.DeviceInformation.BuildVersion
+		receivedAt := resp.ReceivedAt
+		p.DeviceInformationAt = &receivedAt
+	}
+	if resp := responses[cmdresponse.AvailableOSUpdatesType]; resp != nil {
+		p.AvailableOSUpdates = resp.AvailableOSUpdates
+		receivedAt := resp.ReceivedAt
+		p.LastCheck = &receivedAt
+	}
+	return nil
+}
+
+// enforcements retrieves the enforcement declarations of enrollment id.
+func (r *Reporter) enforcements(ctx context.Context, id string) ([]*Enforcement, error) {
+	itemsJSON, err := r.declarations.RetrieveDeclarationItemsJSON(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving declaration items of %s: %w", id, err)
+	}
+	var items struct {
+		Declarations struct {
+			Configurations []struct{ Identifier string }
+		}
+	}
+	if err = json.Unmarshal(itemsJSON, &items); err != nil {
+		return nil, fmt.Errorf("unmarshal declaration items of %s: %w", id, err)
+	}
+	var ret []*Enforcement
+	for _, item := range items.Declarations.Configurations {
+		d, err := r.declarations.RetrieveDeclaration(ctx, item.Identifier)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving declaration %s: %w", item.Identifier, err)
+		}
+		if d == nil || d.Type != DeclarationType {
+			continue
+		}
+		e := new(Enforcement)
+		if err = json.Unmarshal(d.Payload, e); err != nil {
+			return nil, fmt.Errorf("unmarshal declaration %s payload: %w", item.Identifier, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// setState sets the target and the state of p.
+func (r *Reporter) setState(p *Posture) {
+	for _, e := range p.Enforcements {
+		// local date times of the same layout sort chronologically
+		if p.TargetOSVersion == "" || e.TargetLocalDateTime < p.TargetLocalDateTime {
+			p.TargetOSVersion = e.TargetOSVersion
+			p.TargetBuildVersion = e.TargetBuildVersion
+			p.TargetLocalDateTime = e.TargetLocalDateTime
+		}
+	}
+	if p.TargetOSVersion == "" && p.Progress != nil {
+		p.TargetOSVersion = p.Progress.TargetOSVersion
+		p.TargetLocalDateTime = p.Progress.TargetLocalDateTime
+	}
+
+	switch {
+	case p.TargetOSVersion == "" || p.CurrentOSVersion == "":
+		p.State = PostureUnknown
+	case capability.CompareVersions(p.CurrentOSVersion, p.TargetOSVersion) >= 0:
+		p.State = PostureUpToDate
+	case p.Progress != nil && p.Progress.FailureReason != "":
+		p.State = PostureFailed
+	case p.Progress != nil && p.Progress.CommandStatus == "Error":
+		p.State = PostureFailed
+	case r.overdue(p.TargetLocalDateTime):
+		p.State = PostureOverdue
+	default:
+		p.State = PosturePending
+	}
+}
+
+// overdue reports whether the deadline has passed.
+// The local date time of the deadline is compared in UTC.
+func (r *Reporter) overdue(deadline string) bool {
+	t, err := time.Parse(LocalDateTimeLayout, deadline)
+	return err == nil && r.clock.Now().UTC().After(t)
+}
@@ -0,0 +1,286 @@
+package osupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/capability"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/logkeys"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const WorkflowName = "io.micromdm.nanohub.wf.osupdate.v1"
+
+// InstallAction is the install action of ScheduleOSUpdate commands.
+const InstallAction = "InstallASAP"
+
+// DeclarationStore stores declarations and their DM sets.
+type DeclarationStore interface {
+	StoreDeclaration(ctx context.Context, d *ddm.Declaration) (bool, error)
+	StoreSetDeclaration(ctx context.Context, setName, declarationID string) (bool, error)
+	StoreEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+	RemoveEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(ctx context.Context, declarations []string, sets []string, ids []string) error
+
+// Changed calls f(ctx, declarations, sets, ids).
+func (f NotifierFunc) Changed(ctx context.Context, declarations []string, sets []string, ids []string) error {
+	return f(ctx, declarations, sets, ids)
+}
+
+// Capabilities provides the OS of enrollments and the capability matrix.
+type Capabilities interface {
+	Device(ctx context.Context, id string) (*capability.Device, error)
+	Matrix() *capability.Matrix
+}
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Workflow schedules OS updates.
+// The workflow context is an [Enforcement] in JSON.
+type Workflow struct {
+	enq     workflow.StepEnqueuer
+	ider    IDer
+	tracker *Tracker
+	logger  log.Logger
+
+	// DDM dependencies (optional)
+	decls    DeclarationStore
+	notifier Notifier
+	caps     Capabilities
+}
+
+// WorkflowOption configures the workflow.
+type WorkflowOption func(*Workflow)
+
+// WithWorkflowLogger configures a logger for the workflow.
+func WithWorkflowLogger(logger log.Logger) WorkflowOption {
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithIDer configures the command UUID generator.
+func WithIDer(ider IDer) WorkflowOption {
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithDDM enables enforcing updates with declarations on enrollments
+// whose OS supports them per caps. Otherwise only ScheduleOSUpdate
+// commands are sent.
+func WithDDM(decls DeclarationStore, notifier Notifier, caps Capabilities) WorkflowOption {
+	if decls == nil || notifier == nil || caps == nil {
+		panic("nil DDM dependency")
+	}
+	return func(w *Workflow) {
+		w.decls = decls
+		w.notifier = notifier
+		w.caps = caps
+	}
+}
+
+// NewWorkflow creates a new OS update workflow recording progress with tracker.
+func NewWorkflow(q workflow.StepEnqueuer, tracker *Tracker, opts ...WorkflowOption) (*Workflow, error) {
+	if q == nil {
+		return nil, errors.New("nil step enqueuer")
+	}
+	if tracker == nil {
+		return nil, errors.New("nil tracker")
+	}
+	w := &Workflow{
+		enq:     q,
+		ider:    uuid.NewUUID(),
+		tracker: tracker,
+		logger:  log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = w.logger.With(logkeys.WorkflowName, w.Name())
+	return w, nil
+}
+
+func (w *Workflow) Name() string {
+	return WorkflowName
+}
+
+func (w *Workflow) Config() *workflow.Config {
+	return nil
+}
+
+func (w *Workflow) NewContextValue(name string) workflow.ContextMarshaler {
+	if name == "" {
+		return new(Enforcement)
+	}
+	return nil
+}
+
+// ddmCapable reports whether enrollment id supports enforcement declarations.
+// Enrollments with an unknown OS are not considered capable.
+func (w *Workflow) ddmCapable(ctx context.Context, id string) (bool, error) {
+	if w.caps == nil {
+		return false, nil
+	}
+	d, err := w.caps.Device(ctx, id)
+	if err != nil || d == nil || d.Platform == "" || d.OSVersion == "" {
+		return false, err
+	}
+	ok, _ := w.caps.Matrix().Check(capability.KindDeclaration, DeclarationType, d.Platform, d.OSVersion)
+	return ok, nil
+}
+
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	e, ok := step.Context.(*Enforcement)
+	if !ok {
+		return workflow.ErrIncorrectContextType
+	}
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	var ddmIDs []string
+	for _, id := range step.IDs {
+		capable, err := w.ddmCapable(ctx, id)
+		if err != nil {
+			return fmt.Errorf("checking capabilities of %s: %w", id, err)
+		}
+		if capable {
+			ddmIDs = append(ddmIDs, id)
+			continue
+		}
+		if err = w.schedule(ctx, step, e, id); err != nil {
+			return err
+		}
+	}
+
+	if len(ddmIDs) > 0 {
+		return w.enforce(ctx, e, ddmIDs)
+	}
+	return nil
+}
+
+// schedule enqueues a ScheduleOSUpdate command for id.
+func (w *Workflow) schedule(ctx context.Context, step *workflow.StepStart, e *Enforcement, id string) error {
+	cmd := mdmcommands.NewScheduleOSUpdateCommand(w.ider.ID())
+	version := e.TargetOSVersion
+	cmd.Command.Updates = []mdmcommands.UpdatesItem{{
+		InstallAction:  InstallAction,
+		ProductVersion: &version,
+	}}
+
+	err := w.tracker.start(ctx, &Progress{
+		ID:              id,
+		Method:          MethodCommand,
+		TargetOSVersion: e.TargetOSVersion,
+		CommandUUID:     cmd.CommandUUID,
+	})
+	if err != nil {
+		return fmt.Errorf("storing progress for %s: %w", id, err)
+	}
+
+	se := step.NewStepEnqueueing()
+	se.IDs = []string{id} // scope to just this ID we're iterating over
+	se.Commands = []interface{}{cmd}
+
+	if err = w.enq.EnqueueStep(ctx, w, se); err != nil {
+		return fmt.Errorf("enqueueing step for %s: %w", id, err)
+	}
+	return nil
+}
+
+// enforce assigns the enforcement declaration for e to ids.
+func (w *Workflow) enforce(ctx context.Context, e *Enforcement, ids []string) error {
+	d, err := Declaration(e)
+	if err != nil {
+		return err
+	}
+	set := d.Identifier
+	for _, decl := range []*ddm.Declaration{d, SubscriptionDeclaration()} {
+		if _, err = w.decls.StoreDeclaration(ctx, decl); err != nil {
+			return fmt.Errorf("storing declaration %s: %w", decl.Identifier, err)
+		}
+		if _, err = w.decls.StoreSetDeclaration(ctx, set, decl.Identifier); err != nil {
+			return fmt.Errorf("storing set declaration %s: %w", decl.Identifier, err)
+		}
+	}
+
+	for _, id := range ids {
+		// replace the set of any earlier update
+		prev, err := w.tracker.store.RetrieveProgress(ctx, id)
+		if err != nil {
+			return fmt.Errorf("retrieving progress of %s: %w", id, err)
+		}
+		if prev != nil && prev.Set != "" && prev.Set != set {
+			if _, err = w.decls.RemoveEnrollmentSet(ctx, id, prev.Set); err != nil {
+				return fmt.Errorf("removing set from %s: %w", id, err)
+			}
+		}
+		if _, err = w.decls.StoreEnrollmentSet(ctx, id, set); err != nil {
+			return fmt.Errorf("storing set for %s: %w", id, err)
+		}
+		err = w.tracker.start(ctx, &Progress{
+			ID:                  id,
+			Method:              MethodDDM,
+			TargetOSVersion:     e.TargetOSVersion,
+			TargetLocalDateTime: e.TargetLocalDateTime,
+			Set:                 set,
+		})
+		if err != nil {
+			return fmt.Errorf("storing progress for %s: %w", id, err)
+		}
+	}
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.Message, "enforcing update",
+		"declaration", d.Identifier,
+		logkeys.GenericCount, len(ids),
+	)
+	return w.notifier.Changed(ctx, nil, nil, ids)
+}
+
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if len(stepResult.CommandResults) != 1 {
+		return workflow.ErrStepResultCommandLenMismatch
+	}
+	genResper, ok := stepResult.CommandResults[0].(mdmcommands.GenericResponser)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	response := genResper.GetGenericResponse()
+
+	err := w.tracker.commandResult(ctx, stepResult.ID, response.CommandUUID, response.Status)
+	if err != nil {
+		return fmt.Errorf("updating progress for %s: %w", stepResult.ID, err)
+	}
+	if err = response.Validate(); err != nil {
+		return fmt.Errorf("validating schedule OS update response: %w", err)
+	}
+	return nil
+}
+
+func (w *Workflow) StepTimeout(_ context.Context, _ *workflow.StepResult) error {
+	return workflow.ErrTimeoutNotUsed
+}
+
+func (w *Workflow) Event(_ context.Context, _ *workflow.Event, _ string, _ *workflow.MDMContext) error {
+	return workflow.ErrEventsNotSupported
+}
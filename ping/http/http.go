@@ -0,0 +1,129 @@
+// Package http provides the HTTP API for MDM round trip pings.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/ping"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoIDs is returned when no enrollment IDs are provided.
+	ErrNoIDs = errors.New("no ids provided")
+
+	// ErrNotFound is returned when an enrollment was never pinged.
+	ErrNotFound = errors.New("no ping result")
+)
+
+// PingHandler pings the enrollment IDs in the "id" query parameters
+// and returns their pending results.
+func PingHandler(rec *ping.Recorder, enq ping.Enqueuer, logger log.Logger) http.HandlerFunc {
+	if rec == nil {
+		panic("nil recorder")
+	}
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		ids := r.URL.Query()["id"]
+		if len(ids) < 1 {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		results, err := rec.Ping(r.Context(), enq, ids)
+		if err != nil {
+			logger.Info("msg", "pinging", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "pinged", "count", len(ids))
+		httpapi.WriteJSON(w, results, logger)
+	}
+}
+
+// GetResultsHandler returns the latest ping results of all enrollments.
+func GetResultsHandler(rec *ping.Recorder, logger log.Logger) http.HandlerFunc {
+	if rec == nil {
+		panic("nil recorder")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		results, err := rec.Results(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving ping results", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if results == nil {
+			// always return a JSON array
+			results = []*ping.Result{}
+		}
+
+		httpapi.WriteJSON(w, results, logger)
+	}
+}
+
+// GetResultHandler returns the latest ping result of the enrollment ID
+// in the URL path.
+func GetResultHandler(rec *ping.Recorder, logger log.Logger) http.HandlerFunc {
+	if rec == nil {
+		panic("nil recorder")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoIDs, http.StatusBadRequest)
+			return
+		}
+
+		result, err := rec.Result(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving ping result", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if result == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, result, logger)
+	}
+}
+
+// HandleAPIv1 registers the ping API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, rec *ping.Recorder, enq ping.Enqueuer) {
+	mux.Handle(
+		prefix+"/ping",
+		PingHandler(rec, enq, logger.With("handler", "ping")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/ping",
+		GetResultsHandler(rec, logger.With("handler", "get-ping-results")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/ping/:id",
+		GetResultHandler(rec, logger.With("handler", "get-ping-result")),
+		"GET",
+	)
+}
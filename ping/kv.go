@@ -0,0 +1,69 @@
+package ping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores ping results in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new ping result store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreResult stores r as the latest ping result of its enrollment.
+func (s *KVStore) StoreResult(ctx context.Context, r *Result) error {
+	if r == nil || r.ID == "" {
+		return errors.New("invalid result")
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal result: %w", err)
+	}
+	return s.b.Set(ctx, r.ID, v)
+}
+
+// RetrieveResult retrieves the latest ping result of enrollment id.
+func (s *KVStore) RetrieveResult(ctx context.Context, id string) (*Result, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Result)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal result: %w", err)
+	}
+	return r, nil
+}
+
+// RetrieveResults retrieves the latest ping results of all enrollments.
+func (s *KVStore) RetrieveResults(ctx context.Context) ([]*Result, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Result, 0, len(keys))
+	for _, k := range keys {
+		r, err := s.RetrieveResult(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,263 @@
+// Package ping measures the MDM round trip of enrollments.
+// A ping enqueues a minimal DeviceInformation command and times when the
+// enrollment connects after the push and when it reports the command.
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/plist"
+)
+
+// DefaultTimeout is the default time after which unanswered pings time out.
+const DefaultTimeout = 5 * time.Minute
+
+// Ping statuses.
+const (
+	// StatusPending is a ping enqueued and pushed to the enrollment.
+	StatusPending = "pending"
+
+	// StatusConnected is a ping whose enrollment connected after the
+	// push but has not yet reported the command.
+	StatusConnected = "connected"
+
+	// StatusResponded is a ping whose command the enrollment reported.
+	StatusResponded = "responded"
+
+	// StatusTimeout is a ping not reported within the timeout.
+	StatusTimeout = "timeout"
+)
+
+// Result is the latest ping of an enrollment.
+type Result struct {
+	ID          string    `json:"id"`
+	CommandUUID string    `json:"command_uuid"`
+	Status      string    `json:"status"`
+	EnqueuedAt  time.Time `json:"enqueued_at"`
+	ConnectedAt time.Time `json:"connected_at,omitempty"`
+	RespondedAt time.Time `json:"responded_at,omitempty"`
+
+	// CommandStatus is the status the enrollment reported for the command.
+	CommandStatus string `json:"command_status,omitempty"`
+
+	// ConnectMS is the time from the enqueue and push until the
+	// enrollment first connected in milliseconds.
+	ConnectMS int64 `json:"connect_ms,omitempty"`
+
+	// RoundTripMS is the time from the enqueue and push until the
+	// enrollment reported the command in milliseconds.
+	RoundTripMS int64 `json:"round_trip_ms,omitempty"`
+}
+
+// Store stores ping results.
+type Store interface {
+	StoreResult(ctx context.Context, r *Result) error
+
+	// RetrieveResult retrieves the latest ping result of enrollment id.
+	// Nil is returned if id was never pinged.
+	RetrieveResult(ctx context.Context, id string) (*Result, error)
+
+	// RetrieveResults retrieves the latest ping results of all enrollments.
+	RetrieveResults(ctx context.Context) ([]*Result, error)
+}
+
+// Enqueuer enqueues raw MDM commands and pushes the enrollments.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, ids []string, rawCmd []byte) error
+}
+
+// IDer generates unique command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Recorder records the round trips of pings.
+// It is a NanoMDM service that must see the command reports of pinged
+// enrollments.
+type Recorder struct {
+	service.CheckinAndCommandService
+
+	store   Store
+	logger  log.Logger
+	clock   clock.Clock
+	ider    IDer
+	timeout time.Duration
+}
+
+// Option configures a recorder.
+type Option func(*Recorder)
+
+// WithLogger configures a logger for the recorder.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(r *Recorder) {
+		r.logger = logger
+	}
+}
+
+// WithClock configures the clock used to time round trips.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Recorder) {
+		r.clock = c
+	}
+}
+
+// WithIDer configures the generator of ping command UUIDs.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(r *Recorder) {
+		r.ider = ider
+	}
+}
+
+// WithTimeout configures the time after which unanswered pings time out.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Recorder) {
+		if timeout > 0 {
+			r.timeout = timeout
+		}
+	}
+}
+
+// New creates a new ping recorder using store.
+func New(store Store, opts ...Option) *Recorder {
+	if store == nil {
+		panic("nil store")
+	}
+	r := &Recorder{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+		ider:                     uuid.NewUUID(),
+		timeout:                  DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// timedOut sets the status of res to timed out if it was not answered
+// within the timeout.
+func (r *Recorder) timedOut(res *Result) *Result {
+	if res != nil && res.Status != StatusResponded && r.clock.Now().Sub(res.EnqueuedAt) > r.timeout {
+		res.Status = StatusTimeout
+	}
+	return res
+}
+
+// Result retrieves the latest ping result of enrollment id.
+func (r *Recorder) Result(ctx context.Context, id string) (*Result, error) {
+	res, err := r.store.RetrieveResult(ctx, id)
+	return r.timedOut(res), err
+}
+
+// Results retrieves the latest ping results of all enrollments.
+func (r *Recorder) Results(ctx context.Context) ([]*Result, error) {
+	results, err := r.store.RetrieveResults(ctx)
+	for _, res := range results {
+		r.timedOut(res)
+	}
+	return results, err
+}
+
+// command is a minimal DeviceInformation command.
+type command struct {
+	CommandUUID string
+	Command     struct {
+		RequestType string
+		Queries     []string
+	}
+}
+
+// Ping enqueues a ping command for ids with enq and returns the
+// pending results. Any earlier ping results of ids are replaced.
+func (r *Recorder) Ping(ctx context.Context, enq Enqueuer, ids []string) ([]*Result, error) {
+	if enq == nil {
+		return nil, errors.New("nil enqueuer")
+	}
+	if len(ids) < 1 {
+		return nil, errors.New("no ids")
+	}
+	cmd := &command{CommandUUID: r.ider.ID()}
+	cmd.Command.RequestType = "DeviceInformation"
+	cmd.Command.Queries = []string{"UDID"}
+	raw, err := plist.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("marshal command: %w", err)
+	}
+
+	now := r.clock.Now()
+	results := make([]*Result, 0, len(ids))
+	for _, id := range ids {
+		res := &Result{ID: id, CommandUUID: cmd.CommandUUID, Status: StatusPending, EnqueuedAt: now}
+		// store before enqueueing so that fast responses are recorded
+		if err = r.store.StoreResult(ctx, res); err != nil {
+			return nil, fmt.Errorf("storing result: %w", err)
+		}
+		results = append(results, res)
+	}
+	if err = enq.Enqueue(ctx, ids, raw); err != nil {
+		return results, fmt.Errorf("enqueueing ping: %w", err)
+	}
+	ctxlog.Logger(ctx, r.logger).Debug("msg", "enqueued ping", "command_uuid", cmd.CommandUUID, "count", len(ids))
+	return results, nil
+}
+
+// CommandAndReportResults records the connection and the command report
+// of pinged enrollments.
+func (r *Recorder) CommandAndReportResults(req *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if req.EnrollID == nil || req.ID == "" {
+		return nil, nil
+	}
+	ctx := req.Context()
+	res, err := r.store.RetrieveResult(ctx, req.ID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving ping result: %w", err)
+	}
+	if res == nil || res.Status == StatusResponded {
+		return nil, nil
+	}
+
+	now := r.clock.Now()
+	var changed bool
+	if res.ConnectedAt.IsZero() {
+		res.Status = StatusConnected
+		res.ConnectedAt = now
+		res.ConnectMS = now.Sub(res.EnqueuedAt).Milliseconds()
+		changed = true
+	}
+	if results.CommandUUID == res.CommandUUID && results.Status != "NotNow" {
+		res.Status = StatusResponded
+		res.CommandStatus = results.Status
+		res.RespondedAt = now
+		res.RoundTripMS = now.Sub(res.EnqueuedAt).Milliseconds()
+		changed = true
+		ctxlog.Logger(ctx, r.logger).Debug("msg", "ping responded", "id", req.ID, "round_trip_ms", res.RoundTripMS)
+	}
+	if !changed {
+		return nil, nil
+	}
+	if err = r.store.StoreResult(ctx, res); err != nil {
+		return nil, fmt.Errorf("storing ping result: %w", err)
+	}
+	return nil, nil
+}
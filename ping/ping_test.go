@@ -0,0 +1,64 @@
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type enqueuer struct{ ids []string }
+
+func (e *enqueuer) Enqueue(_ context.Context, ids []string, _ []byte) error {
+	e.ids = ids
+	return nil
+}
+
+type ider string
+
+func (i ider) ID() string { return string(i) }
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	rec := New(NewKVStore(kvmap.New()), WithClock(c), WithIDer(ider("PING")), WithTimeout(time.Minute))
+
+	enq := new(enqueuer)
+	if _, err := rec.Ping(ctx, enq, []string{"A", "B"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enq.ids) != 2 {
+		t.Fatalf("enqueued: %v", enq.ids)
+	}
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "A"}
+	c.Advance(2 * time.Second)
+	if _, err := rec.CommandAndReportResults(r, &mdm.CommandResults{Status: "Idle"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Second)
+	if _, err := rec.CommandAndReportResults(r, &mdm.CommandResults{CommandUUID: "PING", Status: "Acknowledged"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := rec.Result(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != StatusResponded || res.ConnectMS != 2000 || res.RoundTripMS != 3000 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	c.Advance(time.Minute)
+	if res, err = rec.Result(ctx, "B"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := res.Status, StatusTimeout; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
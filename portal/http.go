@@ -0,0 +1,70 @@
+package portal
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultUserHeader is the default HTTP header containing the
+// user name authenticated by the SSO reverse proxy.
+const DefaultUserHeader = "X-Forwarded-User"
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Enroll</title></head>
+<body>
+<h1>Enroll your device</h1>
+<p>Signed in as {{ . }}.</p>
+<p><a href="profile">Download the enrollment profile</a> and install it from Settings.</p>
+</body>
+</html>
+`))
+
+// userFn returns an HTTP handler wrapper that requires a user in header.
+func userFn(header string, logger log.Logger, next func(http.ResponseWriter, *http.Request, string, log.Logger)) http.HandlerFunc {
+	if header == "" {
+		header = DefaultUserHeader
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		user := r.Header.Get(header)
+		if user == "" {
+			logger.Info("msg", "no user in header", "header", header)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r, user, logger)
+	}
+}
+
+// PageHandler serves the enrollment portal page for the user in header.
+func PageHandler(header string, logger log.Logger) http.HandlerFunc {
+	return userFn(header, logger, func(w http.ResponseWriter, _ *http.Request, user string, logger log.Logger) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := pageTemplate.Execute(w, user); err != nil {
+			logger.Info("msg", "rendering page", "err", err)
+		}
+	})
+}
+
+// ProfileHandler serves a new enrollment profile for the user in header.
+func ProfileHandler(p *Portal, header string, logger log.Logger) http.HandlerFunc {
+	if p == nil {
+		panic("nil portal")
+	}
+	return userFn(header, logger, func(w http.ResponseWriter, r *http.Request, user string, logger log.Logger) {
+		profile, err := p.Profile(r.Context(), user)
+		if err != nil {
+			logger.Info("msg", "generating profile", "user", user, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		logger.Debug("msg", "issued enrollment profile", "user", user)
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Header().Set("Content-Disposition", `attachment; filename="enroll.mobileconfig"`)
+		w.Write(profile)
+	})
+}
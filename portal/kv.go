@@ -0,0 +1,81 @@
+package portal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores enrollment tokens in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new token store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreToken stores token.
+func (s *KVStore) StoreToken(ctx context.Context, token string, t *Token) error {
+	if token == "" {
+		return errors.New("empty token")
+	}
+	v, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("marshal token: %w", err)
+	}
+	return s.b.Set(ctx, token, v)
+}
+
+// RetrieveToken retrieves token.
+func (s *KVStore) RetrieveToken(ctx context.Context, token string) (*Token, error) {
+	v, err := s.b.Get(ctx, token)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	t := new(Token)
+	if err = json.Unmarshal(v, t); err != nil {
+		return nil, fmt.Errorf("unmarshal token: %w", err)
+	}
+	return t, nil
+}
+
+// DeleteToken deletes token.
+func (s *KVStore) DeleteToken(ctx context.Context, token string) error {
+	return s.b.Delete(ctx, token)
+}
+
+// PruneTokens deletes the tokens created before before.
+func (s *KVStore) PruneTokens(ctx context.Context, before time.Time) (int, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, k := range keys {
+		t, err := s.RetrieveToken(ctx, k)
+		if errors.Is(err, ErrTokenNotFound) {
+			continue
+		} else if err != nil {
+			return n, fmt.Errorf("retrieving token: %w", err)
+		}
+		if !t.CreatedAt.Before(before) {
+			continue
+		}
+		if err = s.DeleteToken(ctx, k); err != nil {
+			return n, fmt.Errorf("deleting token: %w", err)
+		}
+		n++
+	}
+	return n, nil
+}
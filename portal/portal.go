@@ -0,0 +1,219 @@
+// Package portal provides a self-service enrollment portal.
+// Users, authenticated by an SSO reverse proxy, download an enrollment
+// profile that identifies them. When the device enrolls it is assigned
+// to the user in the directory.
+package portal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/directory"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Token is an enrollment token issued to a user.
+type Token struct {
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store stores enrollment tokens.
+type Store interface {
+	StoreToken(ctx context.Context, token string, t *Token) error
+
+	// RetrieveToken retrieves token.
+	// ErrTokenNotFound is returned if token does not exist.
+	RetrieveToken(ctx context.Context, token string) (*Token, error)
+
+	DeleteToken(ctx context.Context, token string) error
+
+	// PruneTokens deletes the tokens created before before.
+	// It returns the number of deleted tokens.
+	PruneTokens(ctx context.Context, before time.Time) (int, error)
+}
+
+// ErrTokenNotFound is returned when an enrollment token does not exist.
+var ErrTokenNotFound = errors.New("token not found")
+
+// DefaultTokenTTL is the default lifetime of unused enrollment tokens.
+const DefaultTokenTTL = 24 * time.Hour
+
+// ChallengeFunc issues a one-time SCEP challenge.
+type ChallengeFunc func(ctx context.Context) (string, error)
+
+// Portal issues enrollment profiles and assigns enrolled devices to users.
+type Portal struct {
+	service.CheckinAndCommandService
+
+	store     Store
+	generator *Generator
+	assigner  directory.Store
+	logger    log.Logger
+	challenge ChallengeFunc
+	ttl       time.Duration
+	clock     clock.Clock
+}
+
+// Option configures the portal.
+type Option func(*Portal)
+
+// WithChallenges sets a new challenge from f in the SCEP payload of
+// each enrollment profile.
+func WithChallenges(f ChallengeFunc) Option {
+	return func(p *Portal) {
+		p.challenge = f
+	}
+}
+
+// WithTokenTTL configures the lifetime of enrollment tokens. Devices
+// enrolling with an expired token are not assigned to its user.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(p *Portal) {
+		if ttl > 0 {
+			p.ttl = ttl
+		}
+	}
+}
+
+// WithClock configures the clock of the portal.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(p *Portal) {
+		p.clock = c
+	}
+}
+
+// New creates a new portal. Enrollment profiles are generated with
+// generator and tokens are stored in store. Enrollments are assigned
+// to users in assigner.
+func New(store Store, generator *Generator, assigner directory.Store, logger log.Logger, opts ...Option) *Portal {
+	if store == nil {
+		panic("nil store")
+	}
+	if generator == nil {
+		panic("nil generator")
+	}
+	if assigner == nil {
+		panic("nil assigner")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	p := &Portal{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		generator:                generator,
+		assigner:                 assigner,
+		logger:                   logger,
+		ttl:                      DefaultTokenTTL,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Profile issues a new enrollment token for user and returns an
+// enrollment profile containing it. The token expires unless a device
+// enrolls with it within the token lifetime.
+func (p *Portal) Profile(ctx context.Context, user string) ([]byte, error) {
+	if user == "" {
+		return nil, errors.New("empty user")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("generating token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	if err := p.store.StoreToken(ctx, token, &Token{User: user, CreatedAt: p.clock.Now()}); err != nil {
+		return nil, fmt.Errorf("storing token: %w", err)
+	}
+	var challenge string
+	if p.challenge != nil {
+		var err error
+		if challenge, err = p.challenge(ctx); err != nil {
+			return nil, fmt.Errorf("issuing challenge: %w", err)
+		}
+	}
+	return p.generator.GenerateWithChallenge(token, challenge)
+}
+
+// TokenUpdate assigns the enrollment to the user of the enrollment
+// token in the MDM URL. The token is consumed once the enrollment is
+// assigned. Expired tokens are deleted without assigning the enrollment.
+func (p *Portal) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	token := r.Params[ParamName]
+	if token == "" {
+		return nil
+	}
+	ctx := r.Context()
+	logger := ctxlog.Logger(ctx, p.logger)
+
+	t, err := p.store.RetrieveToken(ctx, token)
+	if errors.Is(err, ErrTokenNotFound) {
+		// already consumed (e.g. for a later TokenUpdate)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("retrieving enrollment token: %w", err)
+	}
+
+	if !p.clock.Now().Before(t.CreatedAt.Add(p.ttl)) {
+		logger.Info("msg", "expired enrollment token", "id", r.ID, "user", t.User, "created_at", t.CreatedAt)
+		if err = p.store.DeleteToken(ctx, token); err != nil {
+			logger.Info("msg", "deleting enrollment token", "err", err)
+		}
+		return nil
+	}
+
+	if err = p.assigner.StoreAssignment(ctx, r.ID, t.User); err != nil {
+		return fmt.Errorf("assigning enrollment: %w", err)
+	}
+	logger.Info("msg", "assigned enrollment", "id", r.ID, "user", t.User)
+
+	if err = p.store.DeleteToken(ctx, token); err != nil {
+		logger.Info("msg", "deleting enrollment token", "err", err)
+	}
+	return nil
+}
+
+// Prune deletes the expired enrollment tokens.
+// It returns the number of deleted tokens.
+func (p *Portal) Prune(ctx context.Context) (int, error) {
+	return p.store.PruneTokens(ctx, p.clock.Now().Add(-p.ttl))
+}
+
+// Run prunes expired enrollment tokens every interval until ctx is done.
+func (p *Portal) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := p.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+
+		n, err := p.Prune(ctx)
+		if err != nil {
+			p.logger.Info("msg", "pruning enrollment tokens", "err", err)
+		} else if n > 0 {
+			p.logger.Info("msg", "pruned enrollment tokens", "count", n)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package portal
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/directory"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+const testTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadType</key>
+			<string>com.apple.mdm</string>
+			<key>ServerURL</key>
+			<string>https://mdm.example.com/mdm</string>
+		</dict>
+	</array>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+</dict>
+</plist>`
+
+// profileToken returns the enrollment token of profile.
+func profileToken(t *testing.T, profile []byte) string {
+	t.Helper()
+	p := new(struct {
+		PayloadContent []struct{ ServerURL string }
+	})
+	if err := plist.Unmarshal(profile, p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.PayloadContent) != 1 {
+		t.Fatalf("have %d payloads, want 1", len(p.PayloadContent))
+	}
+	u, err := url.Parse(p.PayloadContent[0].ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get(ParamName)
+}
+
+func TestPortal(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	generator, err := NewGenerator([]byte(testTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewKVStore(kvmap.New())
+	dir := directory.NewKVStore(kvmap.New())
+	p := New(store, generator, dir, nil, WithTokenTTL(time.Hour), WithClock(fake))
+
+	tokenUpdate := func(id, token string) {
+		t.Helper()
+		r := &mdm.Request{EnrollID: &mdm.EnrollID{ID: id}, Params: map[string]string{ParamName: token}}
+		if err := p.TokenUpdate(r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assignments := func() map[string]string {
+		t.Helper()
+		a, err := dir.RetrieveAssignments(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	// issuing a profile stores its token for the user
+	profile, err := p.Profile(ctx, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token1 := profileToken(t, profile)
+	if token1 == "" {
+		t.Fatal("no token in profile")
+	}
+	tok, err := store.RetrieveToken(ctx, token1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.User != "user1" || !tok.CreatedAt.Equal(fake.Now()) {
+		t.Errorf("invalid token: %v", tok)
+	}
+	if _, err = p.Profile(ctx, ""); err == nil {
+		t.Error("expected error for empty user")
+	}
+
+	// enrolling assigns the user and consumes the token
+	tokenUpdate("ID1", token1)
+	if have, want := assignments()["ID1"], "user1"; have != want {
+		t.Errorf("ID1: have user %q, want %q", have, want)
+	}
+	if _, err = store.RetrieveToken(ctx, token1); err != ErrTokenNotFound {
+		t.Errorf("have error %v, want %v", err, ErrTokenNotFound)
+	}
+
+	// consumed tokens don't assign other enrollments
+	tokenUpdate("ID2", token1)
+	if have, ok := assignments()["ID2"]; ok {
+		t.Errorf("ID2: assigned to %q with consumed token", have)
+	}
+
+	// expired tokens don't assign enrollments and are deleted
+	profile, err = p.Profile(ctx, "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2 := profileToken(t, profile)
+	fake.Advance(time.Hour)
+	tokenUpdate("ID2", token2)
+	if have, ok := assignments()["ID2"]; ok {
+		t.Errorf("ID2: assigned to %q with expired token", have)
+	}
+	if _, err = store.RetrieveToken(ctx, token2); err != ErrTokenNotFound {
+		t.Errorf("have error %v, want %v", err, ErrTokenNotFound)
+	}
+
+	// unused tokens are pruned once expired
+	if _, err = p.Profile(ctx, "user3"); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(30 * time.Minute)
+	profile, err = p.Profile(ctx, "user4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token4 := profileToken(t, profile)
+	fake.Advance(45 * time.Minute)
+	if n, err := p.Prune(ctx); err != nil || n != 1 {
+		t.Errorf("have %d pruned (err %v), want 1", n, err)
+	}
+	if _, err = store.RetrieveToken(ctx, token4); err != nil {
+		t.Errorf("token4: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package portal
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/micromdm/plist"
+)
+
+// ParamName is the MDM URL query parameter containing the enrollment token.
+const ParamName = "enroll"
+
+// Generator generates per-user enrollment profiles from a template.
+type Generator struct {
+	template []byte
+}
+
+// NewGenerator creates a new generator using template.
+// The template is an (unsigned) enrollment profile containing
+// an MDM payload.
+func NewGenerator(template []byte) (*Generator, error) {
+	g := &Generator{template: template}
+	// make sure the template is usable
+	_, err := g.Generate("")
+	return g, err
+}
+
+// Generate generates a new enrollment profile with token embedded
+// in the MDM payload server and check-in URLs. All payload UUIDs
+// are regenerated.
+func (g *Generator) Generate(token string) ([]byte, error) {
+	return g.GenerateWithChallenge(token, "")
+}
+
+// GenerateWithChallenge generates a new enrollment profile like
+// Generate and sets the challenge of any SCEP payload to challenge.
+func (g *Generator) GenerateWithChallenge(token, challenge string) ([]byte, error) {
+	var profile map[string]interface{}
+	if err := plist.Unmarshal(g.template, &profile); err != nil {
+		return nil, fmt.Errorf("unmarshal profile template: %w", err)
+	}
+	if err := setUUID(profile); err != nil {
+		return nil, err
+	}
+
+	content, _ := profile["PayloadContent"].([]interface{})
+	var found bool
+	for _, p := range content {
+		payload, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := setUUID(payload); err != nil {
+			return nil, err
+		}
+		if payload["PayloadType"] == "com.apple.security.scep" && challenge != "" {
+			if err := setChallenge(payload, challenge); err != nil {
+				return nil, err
+			}
+		}
+		if payload["PayloadType"] != "com.apple.mdm" {
+			continue
+		}
+		found = true
+		for _, key := range []string{"ServerURL", "CheckInURL"} {
+			if err := setParam(payload, key, token); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no MDM payload in profile template")
+	}
+
+	return plist.MarshalIndent(profile, "\t")
+}
+
+// setParam adds the token query parameter to the URL in key of payload.
+func setParam(payload map[string]interface{}, key, token string) error {
+	s, ok := payload[key].(string)
+	if !ok || token == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", key, err)
+	}
+	q := u.Query()
+	q.Set(ParamName, token)
+	u.RawQuery = q.Encode()
+	payload[key] = u.String()
+	return nil
+}
+
+// setChallenge sets the challenge of the SCEP payload.
+func setChallenge(payload map[string]interface{}, challenge string) error {
+	content, ok := payload["PayloadContent"].(map[string]interface{})
+	if !ok {
+		return errors.New("no content in SCEP payload")
+	}
+	content["Challenge"] = challenge
+	return nil
+}
+
+// setUUID sets a new random PayloadUUID in payload.
+func setUUID(payload map[string]interface{}) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Errorf("generating uuid: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	payload["PayloadUUID"] = fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return nil
+}
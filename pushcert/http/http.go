@@ -0,0 +1,119 @@
+// Package http provides the HTTP API for push certificates.
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/pushcert"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoTopic is returned when no topic is provided.
+var ErrNoTopic = errors.New("no topic provided")
+
+// Retriever retrieves stored push certificates.
+type Retriever interface {
+	RetrievePushCert(ctx context.Context, topic string) (cert *tls.Certificate, staleToken string, err error)
+}
+
+// ListHandler returns the push certificates loaded from files.
+func ListHandler(loader *pushcert.Loader, logger log.Logger) http.HandlerFunc {
+	if loader == nil {
+		panic("nil loader")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		loaded := loader.Loaded()
+		if loaded == nil {
+			loaded = []*pushcert.Info{}
+		}
+		httpapi.WriteJSON(w, loaded, logger)
+	}
+}
+
+// ReloadHandler reloads the push certificate files into storage.
+// Renewed push certificates are used for subsequent pushes.
+func ReloadHandler(loader *pushcert.Loader, logger log.Logger) http.HandlerFunc {
+	if loader == nil {
+		panic("nil loader")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		loaded, err := loader.Load(r.Context())
+		if err != nil {
+			logger.Info("msg", "reloading push certificates", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "reloaded push certificates", "count", len(loaded))
+		httpapi.WriteJSON(w, loaded, logger)
+	}
+}
+
+// GetHandler returns the stored push certificate for the topic in the URL path.
+func GetHandler(store Retriever, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		topic := flow.Param(r.Context(), "topic")
+		if topic == "" {
+			httpapi.JSONError(w, ErrNoTopic, http.StatusBadRequest)
+			return
+		}
+
+		cert, _, err := store.RetrievePushCert(r.Context(), topic)
+		if err != nil {
+			logger.Info("msg", "retrieving push certificate", "topic", topic, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		info, err := pushcert.InfoFromCert(cert)
+		if err != nil {
+			logger.Info("msg", "reading push certificate", "topic", topic, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, info, logger)
+	}
+}
+
+// HandleAPIv1 registers the push certificate API handlers into mux.
+// The list and reload handlers are only registered if loader is not nil.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, loader *pushcert.Loader, store Retriever) {
+	if loader != nil {
+		mux.Handle(
+			prefix+"/pushcerts",
+			ListHandler(loader, logger.With("handler", "list-pushcerts")),
+			"GET",
+		)
+
+		mux.Handle(
+			prefix+"/pushcerts/reload",
+			ReloadHandler(loader, logger.With("handler", "reload-pushcerts")),
+			"POST",
+		)
+	}
+
+	mux.Handle(
+		prefix+"/pushcerts/:topic",
+		GetHandler(store, logger.With("handler", "get-pushcert")),
+		"GET",
+	)
+}
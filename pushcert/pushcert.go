@@ -0,0 +1,168 @@
+// Package pushcert loads APNs push certificates from files into storage.
+//
+// NanoMDM stores push certificates by topic and routes pushes to each
+// enrollment using the certificate of its topic. It also reloads a stored
+// certificate when it is replaced. Loading renewed certificates into
+// storage thus rotates them without a restart.
+package pushcert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// ErrNoTopic is returned when a certificate has no APNs topic.
+var ErrNoTopic = errors.New("no topic in certificate")
+
+// oidUID is the User ID attribute of the subject which contains the APNs topic.
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// Topic returns the APNs topic of a push certificate.
+func Topic(cert *x509.Certificate) (string, error) {
+	for _, n := range cert.Subject.Names {
+		if n.Type.Equal(oidUID) {
+			if topic, ok := n.Value.(string); ok && topic != "" {
+				return topic, nil
+			}
+		}
+	}
+	return "", ErrNoTopic
+}
+
+// Info describes a push certificate.
+type Info struct {
+	Topic    string    `json:"topic"`
+	NotAfter time.Time `json:"not_after"`
+	Path     string    `json:"path,omitempty"`
+}
+
+// InfoFromCert describes the leaf certificate of cert.
+func InfoFromCert(cert *tls.Certificate) (*Info, error) {
+	if cert == nil || len(cert.Certificate) < 1 {
+		return nil, errors.New("no certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	topic, err := Topic(leaf)
+	if err != nil {
+		return nil, err
+	}
+	return &Info{Topic: topic, NotAfter: leaf.NotAfter}, nil
+}
+
+// splitPEM splits PEM data into certificate and private key blocks.
+func splitPEM(pemBytes []byte) (certPEM, keyPEM []byte) {
+	var certBuf, keyBuf bytes.Buffer
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(&certBuf, block)
+		} else {
+			pem.Encode(&keyBuf, block)
+		}
+	}
+	return certBuf.Bytes(), keyBuf.Bytes()
+}
+
+// Store stores push certificates.
+type Store interface {
+	StorePushCert(ctx context.Context, pemCert, pemKey []byte) error
+}
+
+// Loader loads push certificates from files into a store.
+type Loader struct {
+	store  Store
+	paths  []string
+	logger log.Logger
+
+	mu     sync.RWMutex
+	loaded []*Info
+}
+
+// NewLoader creates a new loader for the PEM files at paths.
+// Each file must contain a push certificate and its private key.
+func NewLoader(store Store, paths []string, logger log.Logger) *Loader {
+	if store == nil {
+		panic("nil store")
+	}
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	return &Loader{store: store, paths: paths, logger: logger}
+}
+
+// Load (re)loads all push certificate files into the store.
+// A file that fails to load does not prevent loading the others.
+func (l *Loader) Load(ctx context.Context) ([]*Info, error) {
+	var (
+		loaded []*Info
+		errs   []string
+	)
+	for _, path := range l.paths {
+		info, err := l.load(ctx, path)
+		if err != nil {
+			l.logger.Info("msg", "loading push certificate", "path", path, "err", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		l.logger.Debug("msg", "loaded push certificate", "path", path, "topic", info.Topic, "not_after", info.NotAfter)
+		loaded = append(loaded, info)
+	}
+	l.mu.Lock()
+	l.loaded = loaded
+	l.mu.Unlock()
+	if len(errs) > 0 {
+		return loaded, fmt.Errorf("loading push certificates: %s", strings.Join(errs, "; "))
+	}
+	return loaded, nil
+}
+
+// load loads a single push certificate file.
+func (l *Loader) load(ctx context.Context, path string) (*Info, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM := splitPEM(pemBytes)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	info, err := InfoFromCert(&cert)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.store.StorePushCert(ctx, certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("storing push certificate: %w", err)
+	}
+	info.Path = path
+	return info, nil
+}
+
+// Loaded returns the push certificates of the last load.
+func (l *Loader) Loaded() []*Info {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.loaded
+}
@@ -0,0 +1,85 @@
+package pushcert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type store struct {
+	certs int
+}
+
+func (s *store) StorePushCert(_ context.Context, pemCert, pemKey []byte) error {
+	s.certs++
+	return nil
+}
+
+func writeCert(t *testing.T, path, topic string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "APSP:" + topic,
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUID, Value: topic}},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pemBytes = append(pemBytes, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	if err = os.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path1 := filepath.Join(dir, "push1.pem")
+	path2 := filepath.Join(dir, "push2.pem")
+	writeCert(t, path1, "com.apple.mgmt.External.1")
+	writeCert(t, path2, "com.apple.mgmt.External.2")
+
+	s := new(store)
+	l := NewLoader(s, []string{path1, path2}, nil)
+	loaded, err := l.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(loaded), 2; have != want {
+		t.Fatalf("have: %v, want: %v", have, want)
+	}
+	if have, want := loaded[1].Topic, "com.apple.mgmt.External.2"; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// renew (replace) a certificate and reload
+	writeCert(t, path1, "com.apple.mgmt.External.1")
+	if _, err = l.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := s.certs, 4; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,79 @@
+// Package http provides the HTTP API for invalid push tokens.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/pushfeedback"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// GetInvalidationsHandler returns the enrollments with invalid push tokens.
+func GetInvalidationsHandler(p *pushfeedback.Pruner, logger log.Logger) http.HandlerFunc {
+	if p == nil {
+		panic("nil pruner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		invs, err := p.Invalidations(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving invalid push tokens", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, invs, logger)
+	}
+}
+
+// DeleteInvalidationHandler clears the invalid push token of the
+// enrollment ID in the URL path so that it is pushed to again.
+func DeleteInvalidationHandler(p *pushfeedback.Pruner, logger log.Logger) http.HandlerFunc {
+	if p == nil {
+		panic("nil pruner")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := p.Clear(r.Context(), id); err != nil {
+			logger.Info("msg", "clearing invalid push token", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "cleared invalid push token", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the invalid push token API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, p *pushfeedback.Pruner) {
+	mux.Handle(
+		prefix+"/push/invalid",
+		GetInvalidationsHandler(p, logger.With("handler", "get-invalid-push-tokens")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/push/invalid/:id",
+		DeleteInvalidationHandler(p, logger.With("handler", "delete-invalid-push-token")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,74 @@
+package pushfeedback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores invalidations in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new invalidation store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreInvalidation stores the invalidation of an enrollment.
+func (s *KVStore) StoreInvalidation(ctx context.Context, inv *Invalidation) error {
+	if inv == nil || inv.ID == "" {
+		return errors.New("invalid invalidation")
+	}
+	v, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("marshal invalidation: %w", err)
+	}
+	return s.b.Set(ctx, inv.ID, v)
+}
+
+// RetrieveInvalidation retrieves the invalidation of id.
+func (s *KVStore) RetrieveInvalidation(ctx context.Context, id string) (*Invalidation, error) {
+	v, err := s.b.Get(ctx, id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	inv := new(Invalidation)
+	if err = json.Unmarshal(v, inv); err != nil {
+		return nil, fmt.Errorf("unmarshal invalidation: %w", err)
+	}
+	return inv, nil
+}
+
+// DeleteInvalidation deletes the invalidation of id.
+func (s *KVStore) DeleteInvalidation(ctx context.Context, id string) error {
+	return s.b.Delete(ctx, id)
+}
+
+// RetrieveInvalidations retrieves all invalidations.
+func (s *KVStore) RetrieveInvalidations(ctx context.Context) ([]*Invalidation, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	invs := make([]*Invalidation, 0, len(keys))
+	for _, k := range keys {
+		inv, err := s.RetrieveInvalidation(ctx, k)
+		if err != nil {
+			return invs, fmt.Errorf("retrieving invalidation %s: %w", k, err)
+		}
+		if inv != nil {
+			invs = append(invs, inv)
+		}
+	}
+	return invs, nil
+}
@@ -0,0 +1,250 @@
+// Package pushfeedback stops pushing to enrollments whose push tokens
+// APNs reports as invalid.
+package pushfeedback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/apnstoken"
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// APNs error reasons for invalid push tokens.
+const (
+	ReasonUnregistered   = "Unregistered"
+	ReasonBadDeviceToken = "BadDeviceToken"
+)
+
+// ErrInvalidToken is the push error of enrollments with invalid push tokens.
+var ErrInvalidToken = errors.New("invalid push token")
+
+// InvalidReason returns the APNs reason if err reports an invalid push token.
+// Otherwise an empty string is returned.
+func InvalidReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var apnsErr *apnstoken.Error
+	if errors.As(err, &apnsErr) {
+		switch apnsErr.Reason {
+		case ReasonUnregistered, ReasonBadDeviceToken:
+			return apnsErr.Reason
+		}
+		return ""
+	}
+	// the certificate-based pusher only reports the reason in its errors
+	msg := err.Error()
+	for _, reason := range []string{ReasonUnregistered, ReasonBadDeviceToken} {
+		if strings.Contains(msg, reason) {
+			return reason
+		}
+	}
+	return ""
+}
+
+// Invalidation records an enrollment with an invalid push token.
+type Invalidation struct {
+	ID            string    `json:"id"`
+	Reason        string    `json:"reason"`
+	InvalidatedAt time.Time `json:"invalidated_at"`
+}
+
+// Store stores invalidations.
+type Store interface {
+	StoreInvalidation(ctx context.Context, inv *Invalidation) error
+
+	// RetrieveInvalidation retrieves the invalidation of id.
+	// A nil invalidation is returned if the push token of id is valid.
+	RetrieveInvalidation(ctx context.Context, id string) (*Invalidation, error)
+
+	DeleteInvalidation(ctx context.Context, id string) error
+
+	// RetrieveInvalidations retrieves all invalidations.
+	RetrieveInvalidations(ctx context.Context) ([]*Invalidation, error)
+}
+
+// Pruner records invalid push tokens and no longer pushes to them.
+// It is also a NanoMDM service that clears the invalidation of an
+// enrollment when it reports a new push token.
+type Pruner struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	sink   event.Sink
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the pruner.
+type Option func(*Pruner)
+
+// WithLogger configures a logger for the pruner.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(p *Pruner) {
+		p.logger = logger
+	}
+}
+
+// WithClock configures the clock of the pruner.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(p *Pruner) {
+		p.clock = c
+	}
+}
+
+// WithSink configures an event sink for invalidated push tokens.
+func WithSink(sink event.Sink) Option {
+	return func(p *Pruner) {
+		p.sink = sink
+	}
+}
+
+// New creates a new pruner.
+func New(store Store, opts ...Option) *Pruner {
+	if store == nil {
+		panic("nil store")
+	}
+	p := &Pruner{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Wrap returns a pusher that skips enrollments with invalid push
+// tokens and records the invalid push tokens reported by next.
+func (p *Pruner) Wrap(next push.Pusher) push.Pusher {
+	if next == nil {
+		panic("nil pusher")
+	}
+	return &pruningPusher{next: next, p: p}
+}
+
+type pruningPusher struct {
+	next push.Pusher
+	p    *Pruner
+}
+
+// Push pushes to the ids with valid push tokens.
+func (p *pruningPusher) Push(ctx context.Context, ids []string) (map[string]*push.Response, error) {
+	return p.p.push(ctx, p.next, ids)
+}
+
+func (p *Pruner) push(ctx context.Context, next push.Pusher, ids []string) (map[string]*push.Response, error) {
+	logger := ctxlog.Logger(ctx, p.logger)
+	ret := make(map[string]*push.Response)
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		inv, err := p.store.RetrieveInvalidation(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving invalidation for %s: %w", id, err)
+		}
+		if inv != nil {
+			ret[id] = &push.Response{Err: ErrInvalidToken}
+			continue
+		}
+		valid = append(valid, id)
+	}
+	if len(ret) > 0 {
+		logger.Debug("msg", "skipped invalid push tokens", "count", len(ret))
+	}
+	if len(valid) < 1 {
+		return ret, nil
+	}
+
+	resp, err := next.Push(ctx, valid)
+	if err != nil {
+		return resp, err
+	}
+	for id, r := range resp {
+		ret[id] = r
+		if r == nil {
+			continue
+		}
+		reason := InvalidReason(r.Err)
+		if reason == "" {
+			continue
+		}
+		if err = p.invalidate(ctx, id, reason); err != nil {
+			logger.Info("msg", "invalidating push token", "id", id, "err", err)
+		}
+	}
+	return ret, nil
+}
+
+// invalidate records the invalid push token of id and sends an event.
+func (p *Pruner) invalidate(ctx context.Context, id, reason string) error {
+	inv := &Invalidation{ID: id, Reason: reason, InvalidatedAt: p.clock.Now()}
+	if err := p.store.StoreInvalidation(ctx, inv); err != nil {
+		return err
+	}
+	ctxlog.Logger(ctx, p.logger).Info("msg", "invalidated push token", "id", id, "reason", reason)
+	if p.sink == nil {
+		return nil
+	}
+	ev := event.New(p.clock, event.TypePushInvalid, id)
+	ev.Timestamp = inv.InvalidatedAt
+	ev.Fields["reason"] = reason
+	if err := p.sink.Send(ctx, ev); err != nil {
+		return fmt.Errorf("sending event: %w", err)
+	}
+	return nil
+}
+
+// Invalidations returns the enrollments with invalid push tokens sorted by ID.
+func (p *Pruner) Invalidations(ctx context.Context) ([]*Invalidation, error) {
+	invs, err := p.store.RetrieveInvalidations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(invs, func(i, j int) bool { return invs[i].ID < invs[j].ID })
+	return invs, nil
+}
+
+// Clear clears the invalidation of id so that it is pushed to again.
+func (p *Pruner) Clear(ctx context.Context, id string) error {
+	return p.store.DeleteInvalidation(ctx, id)
+}
+
+// TokenUpdate clears the invalidation of the enrollment.
+// A TokenUpdate check-in carries a new push token.
+func (p *Pruner) TokenUpdate(r *mdm.Request, _ *mdm.TokenUpdate) error {
+	if r.ID == "" {
+		return nil
+	}
+	inv, err := p.store.RetrieveInvalidation(r.Context(), r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving invalidation: %w", err)
+	}
+	if inv == nil {
+		return nil
+	}
+	if err = p.store.DeleteInvalidation(r.Context(), r.ID); err != nil {
+		return fmt.Errorf("deleting invalidation: %w", err)
+	}
+	ctxlog.Logger(r.Context(), p.logger).Info("msg", "cleared invalid push token", "id", r.ID, "reason", inv.Reason)
+	return nil
+}
@@ -0,0 +1,71 @@
+package pushfeedback
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/nanohub/apnstoken"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/push"
+)
+
+type pusher struct {
+	errs   map[string]error
+	pushed []string
+}
+
+func (p *pusher) Push(_ context.Context, ids []string) (map[string]*push.Response, error) {
+	p.pushed = append(p.pushed, ids...)
+	resp := make(map[string]*push.Response)
+	for _, id := range ids {
+		resp[id] = &push.Response{Id: "APNS-" + id, Err: p.errs[id]}
+	}
+	return resp, nil
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	next := &pusher{errs: map[string]error{
+		"ID1": &apnstoken.Error{Status: 410, Reason: ReasonUnregistered},
+		"ID2": &apnstoken.Error{Status: 500, Reason: "InternalServerError"},
+	}}
+	p := New(NewKVStore(kvmap.New()))
+	pusher := p.Wrap(next)
+
+	if _, err := pusher.Push(ctx, []string{"ID1", "ID2", "ID3"}); err != nil {
+		t.Fatal(err)
+	}
+	invs, err := p.Invalidations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invs) != 1 || invs[0].ID != "ID1" || invs[0].Reason != ReasonUnregistered {
+		t.Fatalf("unexpected invalidations: %v", invs)
+	}
+
+	// invalid push tokens are no longer pushed to
+	next.pushed = nil
+	resp, err := pusher.Push(ctx, []string{"ID1", "ID3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(next.pushed), 1; have != want {
+		t.Errorf("pushed: have: %v, want: %v", have, want)
+	}
+	if have, want := resp["ID1"].Err, ErrInvalidToken; !errors.Is(have, want) {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// a new push token clears the invalidation
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	if err = p.TokenUpdate(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if invs, _ = p.Invalidations(ctx); len(invs) != 0 {
+		t.Errorf("unexpected invalidations: %v", invs)
+	}
+}
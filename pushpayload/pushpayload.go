@@ -0,0 +1,123 @@
+// Package pushpayload customizes the payload of APNs MDM pushes.
+// Some network environments (e.g. enterprise push proxies) inspect or
+// require additional metadata in MDM push payloads.
+package pushpayload
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	nanohttp "github.com/micromdm/nanomdm/http"
+	"github.com/micromdm/nanomdm/push/nanopush"
+)
+
+// MDMKey is the payload key of the enrollment's push magic.
+const MDMKey = "mdm"
+
+// Customizer customizes the JSON payload of an MDM push in place.
+// The MDMKey must not be removed or changed.
+type Customizer func(ctx context.Context, payload map[string]interface{}) error
+
+// Static returns a customizer that adds fields to payloads.
+// The MDMKey field is never overwritten.
+func Static(fields map[string]interface{}) Customizer {
+	return func(_ context.Context, payload map[string]interface{}) error {
+		for k, v := range fields {
+			if k != MDMKey {
+				payload[k] = v
+			}
+		}
+		return nil
+	}
+}
+
+// ParseStatic parses a JSON object of static payload fields.
+func ParseStatic(s string) (Customizer, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &fields); err != nil {
+		return nil, fmt.Errorf("parsing payload fields: %w", err)
+	}
+	return Static(fields), nil
+}
+
+// Apply applies c to the JSON push payload.
+func Apply(ctx context.Context, c Customizer, payload []byte) ([]byte, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal payload: %w", err)
+	}
+	magic := m[MDMKey]
+	if err := c(ctx, m); err != nil {
+		return nil, fmt.Errorf("customizing payload: %w", err)
+	}
+	m[MDMKey] = magic
+	return json.Marshal(m)
+}
+
+// transport applies a customizer to APNs request bodies.
+type transport struct {
+	next http.RoundTripper
+	c    Customizer
+}
+
+// RoundTrip customizes the payload of req and sends it with the next transport.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Method != http.MethodPost {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading payload: %w", err)
+	}
+	if body, err = Apply(req.Context(), t.c, body); err != nil {
+		return nil, err
+	}
+	// the request must not be modified by round trippers
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return t.next.RoundTrip(req)
+}
+
+// WrapClient configures client to apply c to the payloads of its requests.
+func WrapClient(client *http.Client, c Customizer) *http.Client {
+	if client == nil {
+		panic("nil client")
+	}
+	if c == nil {
+		panic("nil customizer")
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = &transport{next: next, c: c}
+	return &wrapped
+}
+
+// NewClient returns a NanoMDM push client constructor that applies c
+// to push payloads. Otherwise clients are configured like NanoMDM's
+// default push clients.
+func NewClient(c Customizer) nanopush.NewClient {
+	if c == nil {
+		panic("nil customizer")
+	}
+	return func(cert *tls.Certificate) (*http.Client, error) {
+		client, err := nanohttp.ClientWithCert(nil, cert)
+		if err != nil {
+			return client, fmt.Errorf("creating mTLS client: %w", err)
+		}
+		nanopush.UseProxyFromEnvironment(client)
+		if err = nanopush.ForceHTTP2(client); err != nil {
+			return client, err
+		}
+		return WrapClient(client, c), nil
+	}
+}
@@ -0,0 +1,48 @@
+package pushpayload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrapClient(t *testing.T) {
+	var payload map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := ParseStatic(`{"mdm":"override","proxy":{"site":"hq"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := WrapClient(srv.Client(), c)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, strings.NewReader(`{"mdm":"MAGIC"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("have: %d, want: %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if payload[MDMKey] != "MAGIC" {
+		t.Errorf("push magic changed: %v", payload[MDMKey])
+	}
+	if proxy, _ := payload["proxy"].(map[string]interface{}); proxy["site"] != "hq" {
+		t.Errorf("missing custom field: %v", payload)
+	}
+}
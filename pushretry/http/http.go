@@ -0,0 +1,78 @@
+// Package http provides the HTTP API for push failures.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/pushretry"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoID is returned when no enrollment ID is provided.
+var ErrNoID = errors.New("no id provided")
+
+// GetFailuresHandler returns the recorded push failures.
+func GetFailuresHandler(store *pushretry.KVStore, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		failures, err := store.RetrieveFailures(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving push failures", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, failures, logger)
+	}
+}
+
+// DeleteFailureHandler clears the push failure of the enrollment ID in the URL path.
+func DeleteFailureHandler(store *pushretry.KVStore, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.ClearFailures(r.Context(), []string{id}); err != nil {
+			logger.Info("msg", "clearing push failure", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "cleared push failure", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the push failure API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store *pushretry.KVStore) {
+	mux.Handle(
+		prefix+"/push/failures",
+		GetFailuresHandler(store, logger.With("handler", "get-push-failures")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/push/failures/:id",
+		DeleteFailureHandler(store, logger.With("handler", "delete-push-failure")),
+		"DELETE",
+	)
+}
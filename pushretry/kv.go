@@ -0,0 +1,83 @@
+package pushretry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// Failure is a permanent push failure of an enrollment.
+type Failure struct {
+	ID       string    `json:"id"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// KVStore records push failures in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new push failure store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// RecordFailure records that pushing to id permanently failed with err at failedAt.
+func (s *KVStore) RecordFailure(ctx context.Context, id string, err error, attempts int, failedAt time.Time) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	f := &Failure{ID: id, Attempts: attempts, FailedAt: failedAt}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	v, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshal failure: %w", err)
+	}
+	return s.b.Set(ctx, id, v)
+}
+
+// ClearFailures clears the failures of ids.
+func (s *KVStore) ClearFailures(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := s.b.Delete(ctx, id); err != nil {
+			return fmt.Errorf("deleting failure %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// RetrieveFailures retrieves all recorded failures sorted by ID.
+func (s *KVStore) RetrieveFailures(ctx context.Context) ([]*Failure, error) {
+	keys, err := s.b.KeysPrefix(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	failures := make([]*Failure, 0, len(keys))
+	for _, k := range keys {
+		v, err := s.b.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return failures, fmt.Errorf("getting failure %s: %w", k, err)
+		}
+		f := new(Failure)
+		if err = json.Unmarshal(v, f); err != nil {
+			return failures, fmt.Errorf("unmarshal failure %s: %w", k, err)
+		}
+		failures = append(failures, f)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].ID < failures[j].ID })
+	return failures, nil
+}
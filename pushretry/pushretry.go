@@ -0,0 +1,230 @@
+// Package pushretry retries APNs pushes that fail transiently.
+package pushretry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/push"
+)
+
+const (
+	// DefaultRetries is the default number of retries after the first push.
+	DefaultRetries = 3
+
+	// DefaultBackoff is the default delay before the first retry.
+	// Each further retry doubles the delay.
+	DefaultBackoff = time.Second
+
+	// DefaultMaxBackoff is the default maximum delay between retries.
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// Temporary reports whether a push error is transient and may succeed
+// if retried. Errors with a Temporary method (such as APNs 5xx responses
+// from the token-based pusher) report for themselves. Connection and
+// timeout errors are temporary. Other errors are permanent.
+func Temporary(err error) bool {
+	var tempErr interface{ Temporary() bool }
+	if errors.As(err, &tempErr) {
+		return tempErr.Temporary()
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Recorder records permanent push failures.
+type Recorder interface {
+	// RecordFailure records that pushing to id permanently failed with err at failedAt.
+	RecordFailure(ctx context.Context, id string, err error, attempts int, failedAt time.Time) error
+
+	// ClearFailures clears the failures of ids after successful pushes.
+	ClearFailures(ctx context.Context, ids []string) error
+}
+
+// Pusher retries transiently failed pushes with exponential backoff.
+type Pusher struct {
+	next       push.Pusher
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	recorder   Recorder
+	logger     log.Logger
+	clock      clock.Clock
+}
+
+// Option configures the pusher.
+type Option func(*Pusher)
+
+// WithRetries configures the number of retries after the first push.
+func WithRetries(n int) Option {
+	return func(p *Pusher) {
+		p.retries = n
+	}
+}
+
+// WithBackoff configures the delay before the first retry and the
+// maximum delay between retries.
+func WithBackoff(backoff, max time.Duration) Option {
+	return func(p *Pusher) {
+		p.backoff = backoff
+		p.maxBackoff = max
+	}
+}
+
+// WithRecorder records permanent push failures with r.
+func WithRecorder(r Recorder) Option {
+	return func(p *Pusher) {
+		p.recorder = r
+	}
+}
+
+// WithLogger configures a logger for the pusher.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(p *Pusher) {
+		p.logger = logger
+	}
+}
+
+// WithClock configures the clock used to wait between retries and to
+// timestamp push failures.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(p *Pusher) {
+		p.clock = c
+	}
+}
+
+// New creates a new retrying pusher that pushes with next.
+func New(next push.Pusher, opts ...Option) *Pusher {
+	if next == nil {
+		panic("nil pusher")
+	}
+	p := &Pusher{
+		next:       next,
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		logger:     log.NopLogger,
+		clock:      clock.Real,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Push pushes to ids and retries transient failures.
+// Enrollments that still fail after the last retry, or fail
+// permanently, are recorded with any configured recorder.
+func (p *Pusher) Push(ctx context.Context, ids []string) (map[string]*push.Response, error) {
+	logger := ctxlog.Logger(ctx, p.logger)
+	ret := make(map[string]*push.Response)
+	var (
+		succeeded []string
+		failed    = make(map[string]*push.Response)
+	)
+	remaining := ids
+	delay := p.backoff
+	attempt := 1
+	for ; ; attempt++ {
+		resp, err := p.next.Push(ctx, remaining)
+		var retry []string
+		if err != nil {
+			if !Temporary(err) && len(ret) < 1 {
+				return nil, err
+			}
+			for _, id := range remaining {
+				ret[id] = &push.Response{Err: err}
+				if Temporary(err) {
+					retry = append(retry, id)
+				} else {
+					failed[id] = ret[id]
+				}
+			}
+		} else {
+			for _, id := range remaining {
+				r, ok := resp[id]
+				if !ok {
+					// e.g. no push info for this enrollment
+					continue
+				}
+				ret[id] = r
+				if r == nil || r.Err == nil {
+					succeeded = append(succeeded, id)
+				} else if Temporary(r.Err) {
+					retry = append(retry, id)
+				} else {
+					failed[id] = r
+				}
+			}
+		}
+		if len(retry) < 1 || attempt > p.retries {
+			for _, id := range retry {
+				failed[id] = ret[id]
+			}
+			break
+		}
+		logger.Debug("msg", "retrying push", "count", len(retry), "attempt", attempt, "delay", delay)
+		if !p.sleep(ctx, delay) {
+			for _, id := range retry {
+				failed[id] = ret[id]
+			}
+			break
+		}
+		remaining = retry
+		if delay *= 2; delay > p.maxBackoff {
+			delay = p.maxBackoff
+		}
+	}
+
+	if len(failed) > 0 {
+		logger.Info("msg", "push failed", "count", len(failed), "attempts", attempt)
+	}
+	if p.recorder != nil {
+		now := p.clock.Now()
+		for id, r := range failed {
+			if err := p.recorder.RecordFailure(ctx, id, r.Err, attempt, now); err != nil {
+				logger.Info("msg", "recording push failure", "id", id, "err", err)
+			}
+		}
+		if len(succeeded) > 0 {
+			if err := p.recorder.ClearFailures(ctx, succeeded); err != nil {
+				logger.Info("msg", "clearing push failures", "err", err)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// sleep waits for d or until ctx is done.
+// It reports whether the full duration elapsed.
+func (p *Pusher) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := p.clock.NewTicker(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package pushretry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/push"
+)
+
+type tempErr struct{ temporary bool }
+
+func (e *tempErr) Error() string   { return "push error" }
+func (e *tempErr) Temporary() bool { return e.temporary }
+
+// pusher fails each ID with the errors in errs before succeeding.
+type pusher struct {
+	errs   map[string][]error
+	pushes int
+}
+
+func (p *pusher) Push(_ context.Context, ids []string) (map[string]*push.Response, error) {
+	p.pushes++
+	resp := make(map[string]*push.Response)
+	for _, id := range ids {
+		r := &push.Response{Id: "APNS-" + id}
+		if errs := p.errs[id]; len(errs) > 0 {
+			r.Err = errs[0]
+			p.errs[id] = errs[1:]
+		}
+		resp[id] = r
+	}
+	return resp, nil
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+	next := &pusher{errs: map[string][]error{
+		"ID1": {&tempErr{true}, &tempErr{true}},                 // succeeds on third push
+		"ID2": {&tempErr{false}},                                // fails permanently
+		"ID3": {&tempErr{true}, &tempErr{true}, &tempErr{true}}, // out of retries
+	}}
+	store := NewKVStore(kvmap.New())
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := New(next, WithRetries(2), WithBackoff(0, 0), WithRecorder(store), WithClock(c))
+
+	resp, err := p.Push(ctx, []string{"ID1", "ID2", "ID3", "ID4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := next.pushes, 3; have != want {
+		t.Errorf("pushes: have: %v, want: %v", have, want)
+	}
+	for id, failed := range map[string]bool{"ID1": false, "ID2": true, "ID3": true, "ID4": false} {
+		if have, want := resp[id].Err != nil, failed; have != want {
+			t.Errorf("%s: failed: have: %v, want: %v", id, have, want)
+		}
+	}
+
+	failures, err := store.RetrieveFailures(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(failures), 2; have != want {
+		t.Fatalf("failures: have: %v, want: %v", have, want)
+	}
+	if have, want := failures[0].FailedAt, c.Now(); !have.Equal(want) {
+		t.Errorf("failed at: have: %v, want: %v", have, want)
+	}
+
+	// a successful push clears the failure
+	if _, err = p.Push(ctx, []string{"ID3"}); err != nil {
+		t.Fatal(err)
+	}
+	if failures, _ = store.RetrieveFailures(ctx); len(failures) != 1 || failures[0].ID != "ID2" {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	if Temporary(errors.New("permanent")) {
+		t.Error("expected permanent error")
+	}
+	if !Temporary(context.DeadlineExceeded) {
+		t.Error("expected temporary error")
+	}
+	if Temporary(context.Canceled) {
+		t.Error("expected permanent error")
+	}
+}
@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/plist"
+)
+
+// maxBodySize is the largest request body read to find the enrollment.
+// Larger bodies are passed along but only limited globally.
+const maxBodySize = 10 * 1024 * 1024
+
+// enrollment contains the identifying keys of MDM check-in and command report requests.
+type enrollment struct {
+	UDID             string `plist:",omitempty"`
+	UserID           string `plist:",omitempty"`
+	EnrollmentID     string `plist:",omitempty"`
+	EnrollmentUserID string `plist:",omitempty"`
+}
+
+// key returns a key unique to the enrollment.
+// It mirrors the way NanoMDM distinguishes device and user channels.
+func (e *enrollment) key() string {
+	id := e.UDID
+	if id == "" {
+		id = e.EnrollmentID
+	}
+	if e.UserID != "" {
+		id += ":" + e.UserID
+	} else if e.EnrollmentUserID != "" {
+		id += ":" + e.EnrollmentUserID
+	}
+	return id
+}
+
+// Middleware rate limits MDM requests.
+type Middleware struct {
+	logger     log.Logger
+	clock      clock.Clock
+	enrollment *Limiter
+	global     *Limiter
+
+	enrollmentLimit *rateLimit
+	globalLimit     *rateLimit
+}
+
+// Option configures the middleware.
+type Option func(*Middleware)
+
+// WithLogger configures a logger for rate limited requests.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(m *Middleware) {
+		m.logger = logger
+	}
+}
+
+// WithClock configures the clock used by the rate limits.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(m *Middleware) {
+		m.clock = c
+	}
+}
+
+// rateLimit is the configuration of a limit.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// WithEnrollmentLimit limits each enrollment to rate requests per
+// second with bursts of up to burst requests.
+func WithEnrollmentLimit(rate float64, burst int) Option {
+	return func(m *Middleware) {
+		m.enrollmentLimit = &rateLimit{rate: rate, burst: burst}
+	}
+}
+
+// WithGlobalLimit limits all requests to rate requests per second
+// with bursts of up to burst requests.
+func WithGlobalLimit(rate float64, burst int) Option {
+	return func(m *Middleware) {
+		m.globalLimit = &rateLimit{rate: rate, burst: burst}
+	}
+}
+
+// New creates a new rate limiting middleware.
+func New(opts ...Option) *Middleware {
+	m := &Middleware{logger: log.NopLogger, clock: clock.Real}
+	for _, opt := range opts {
+		opt(m)
+	}
+	// create the limiters after all options so they use the configured clock
+	if l := m.enrollmentLimit; l != nil {
+		m.enrollment = NewLimiter(l.rate, l.burst, m.clock)
+	}
+	if l := m.globalLimit; l != nil {
+		m.global = NewLimiter(l.rate, l.burst, m.clock)
+	}
+	return m
+}
+
+// Wrap wraps next in rate limiting.
+// Rate limited requests are responded to with a 429 Too Many Requests
+// status and a Retry-After header.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	if m.enrollment == nil && m.global == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), m.logger)
+
+		if m.enrollment != nil {
+			if id := m.readEnrollmentKey(r); id != "" {
+				if ok, wait := m.enrollment.Allow(id); !ok {
+					logger.Info("msg", "rate limited", "limit", "enrollment", "id", id)
+					tooManyRequests(w, wait)
+					return
+				}
+			}
+		}
+
+		if m.global != nil {
+			if ok, wait := m.global.Allow(""); !ok {
+				logger.Info("msg", "rate limited", "limit", "global")
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readEnrollmentKey reads the enrollment key from the body of r.
+// The body of r is replaced so that it can be read again.
+func (m *Middleware) readEnrollmentKey(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || len(body) > maxBodySize {
+		return ""
+	}
+	e := new(enrollment)
+	if err = plist.Unmarshal(body, e); err != nil {
+		return ""
+	}
+	return e.key()
+}
+
+// tooManyRequests responds with a 429 status and a Retry-After header.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int(wait / time.Second)
+	if wait%time.Second > 0 {
+		secs++
+	}
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
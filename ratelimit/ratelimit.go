@@ -0,0 +1,94 @@
+// Package ratelimit limits the rate of MDM requests per enrollment and globally.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and tries to take a token from it.
+// If no token is available the duration until one is is returned.
+func (b *bucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Limiter is a token bucket rate limiter with per-key buckets.
+// It is safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst int
+	clock clock.Clock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewLimiter creates a new limiter that allows rate requests per
+// second per key with bursts of up to burst requests.
+// A nil clock uses the system clock.
+func NewLimiter(rate float64, burst int, c clock.Clock) *Limiter {
+	if rate <= 0 {
+		panic("invalid rate")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if c == nil {
+		c = clock.Real
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		clock:   c,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a request for key is allowed.
+// If it is not allowed the duration to wait before retrying is returned.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, l.rate, l.burst)
+}
+
+// sweep periodically removes buckets that would have refilled completely.
+// Removing these is indistinguishable from keeping them.
+func (l *Limiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < full {
+		return
+	}
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestLimiter(t *testing.T) {
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	l := NewLimiter(1, 2, c)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d: expected allowed", i)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("expected rate limited")
+	}
+	if wait != time.Second {
+		t.Errorf("have: %v, want: %v", wait, time.Second)
+	}
+
+	// other keys have their own bucket
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("expected allowed")
+	}
+
+	c.Advance(time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("expected allowed after refill")
+	}
+}
@@ -0,0 +1,30 @@
+// Package readonly restricts HTTP handlers to reads for replica
+// instances serving only the query API surface.
+package readonly
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+)
+
+// ErrReadOnly is returned for mutating requests.
+var ErrReadOnly = errors.New("read-only instance")
+
+// allowed are the HTTP methods of reads.
+const allowed = "GET, HEAD, OPTIONS"
+
+// Middleware rejects mutating requests (i.e. not GET, HEAD, or
+// OPTIONS) with a 405 Method Not Allowed status before they reach next.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", allowed)
+		httpapi.JSONError(w, ErrReadOnly, http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,30 @@
+package readonly
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodGet, http.StatusNoContent},
+		{http.MethodHead, http.StatusNoContent},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+		{http.MethodPut, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, "/api/v1/nanohub/dynsets", nil))
+		if have, want := rec.Code, test.status; have != want {
+			t.Errorf("%s: have: %d, want: %d", test.method, have, want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package recoverylock implements a Recovery Lock management workflow
+// for Apple silicon Macs. Passwords are generated randomly and escrowed
+// to inventory (alongside FileVault PRKs) before they are sent.
+package recoverylock
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/logkeys"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+const WorkflowName = "io.micromdm.nanohub.wf.recoverylock.v1"
+
+// Inventory keys set by the workflow.
+const (
+	KeyPassword   = WorkflowName + ".password"
+	KeyPending    = WorkflowName + ".pending"
+	KeySetAt      = WorkflowName + ".set_at"
+	KeyVerified   = WorkflowName + ".verified"
+	KeyVerifiedAt = WorkflowName + ".verified_at"
+	KeyStatus     = WorkflowName + ".status"
+)
+
+// Operations of the workflow given as the workflow context.
+const (
+	// OpSet sets a new password, rotating any escrowed password.
+	// The new password is verified once set. This is the default.
+	OpSet = "set"
+
+	// OpVerify verifies the escrowed password.
+	OpVerify = "verify"
+
+	// OpClear removes the Recovery Lock and the escrowed password.
+	OpClear = "clear"
+)
+
+const (
+	stepNameSet    = "set"
+	stepNameVerify = "verify"
+)
+
+// PasswordLength is the length of generated Recovery Lock passwords.
+const PasswordLength = 20
+
+// passwordChars excludes visually ambiguous characters.
+const passwordChars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Workflow manages Recovery Lock passwords.
+// The workflow context is the operation (see [OpSet]).
+type Workflow struct {
+	enq    workflow.StepEnqueuer
+	ider   IDer
+	store  storage.Storage
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the workflow.
+type Option func(*Workflow)
+
+// WithLogger configures a logger for the workflow.
+func WithLogger(logger log.Logger) Option {
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithIDer configures the command UUID generator.
+func WithIDer(ider IDer) Option {
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithClock configures the clock of the workflow.
+func WithClock(c clock.Clock) Option {
+	return func(w *Workflow) {
+		w.clock = c
+	}
+}
+
+// New creates a new Recovery Lock workflow.
+// Passwords and results are stored in store.
+func New(q workflow.StepEnqueuer, store storage.Storage, opts ...Option) (*Workflow, error) {
+	if q == nil {
+		return nil, errors.New("nil step enqueuer")
+	}
+	if store == nil {
+		return nil, errors.New("nil inventory storage")
+	}
+	w := &Workflow{
+		enq:    q,
+		ider:   uuid.NewUUID(),
+		store:  store,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = w.logger.With(logkeys.WorkflowName, w.Name())
+	return w, nil
+}
+
+func (w *Workflow) Name() string {
+	return WorkflowName
+}
+
+func (w *Workflow) Config() *workflow.Config {
+	return nil
+}
+
+func (w *Workflow) NewContextValue(name string) workflow.ContextMarshaler {
+	switch name {
+	case "", stepNameSet, stepNameVerify:
+		return new(workflow.StringContext)
+	}
+	return nil
+}
+
+// randomPassword generates a random password.
+func randomPassword() (string, error) {
+	chars := big.NewInt(int64(len(passwordChars)))
+	password := make([]byte, PasswordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, chars)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// appleSilicon reports whether inventory values v are of an Apple silicon Mac.
+// Recovery Lock is only supported on Apple silicon.
+func appleSilicon(v storage.Values) bool {
+	appleSilicon, ok := v[storage.KeyAppleSilicon].(bool)
+	return ok && appleSilicon
+}
+
+// password returns the escrowed password in inventory values v.
+func password(v storage.Values) string {
+	password, _ := v[KeyPassword].(string)
+	return password
+}
+
+// operation returns the operation in the workflow context c.
+func operation(c workflow.ContextMarshaler) (string, error) {
+	if c == nil {
+		return OpSet, nil
+	}
+	op, ok := c.(*workflow.StringContext)
+	if !ok {
+		return "", workflow.ErrIncorrectContextType
+	}
+	switch string(*op) {
+	case "":
+		return OpSet, nil
+	case OpSet, OpVerify, OpClear:
+		return string(*op), nil
+	}
+	return "", fmt.Errorf("unknown operation: %s", *op)
+}
+
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	op, err := operation(step.Context)
+	if err != nil {
+		return err
+	}
+
+	inv, err := w.store.RetrieveInventory(ctx, &storage.SearchOptions{IDs: step.IDs})
+	if err != nil {
+		return fmt.Errorf("retrieving inventory: %w", err)
+	}
+
+	logger := ctxlog.Logger(ctx, w.logger)
+	for _, id := range step.IDs {
+		if !appleSilicon(inv[id]) {
+			logger.Info(
+				logkeys.InstanceID, step.InstanceID,
+				logkeys.EnrollmentID, id,
+				logkeys.Message, "skipping enrollment: not an Apple silicon Mac in inventory",
+			)
+			continue
+		}
+		current := password(inv[id])
+
+		se := step.NewStepEnqueueing()
+		se.IDs = []string{id} // scope to just this ID we're iterating over
+		opCtx := workflow.StringContext(op)
+		se.Context = &opCtx
+
+		if op == OpVerify {
+			if current == "" {
+				logger.Info(
+					logkeys.InstanceID, step.InstanceID,
+					logkeys.EnrollmentID, id,
+					logkeys.Message, "skipping enrollment: no escrowed password",
+				)
+				continue
+			}
+			se.Name = stepNameVerify
+			se.Commands = []interface{}{w.verifyCommand(current)}
+		} else {
+			cmd := mdmcommands.NewSetRecoveryLockCommand(w.ider.ID())
+			if current != "" {
+				cmd.Command.CurrentPassword = &current
+			}
+			if op == OpSet {
+				if cmd.Command.NewPassword, err = randomPassword(); err != nil {
+					return fmt.Errorf("generating password for %s: %w", id, err)
+				}
+			}
+
+			// escrow the new password before the device can be locked with it
+			err = w.store.StoreInventoryValues(ctx, id, storage.Values{
+				KeyPending:            cmd.Command.NewPassword,
+				storage.KeyLastSource: WorkflowName,
+			})
+			if err != nil {
+				return fmt.Errorf("store inventory values for %s: %w", id, err)
+			}
+			se.Name = stepNameSet
+			se.Commands = []interface{}{cmd}
+		}
+
+		if err = w.enq.EnqueueStep(ctx, w, se); err != nil {
+			return fmt.Errorf("enqueueing step for %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// verifyCommand creates a new VerifyRecoveryLock command for password.
+func (w *Workflow) verifyCommand(password string) *mdmcommands.VerifyRecoveryLockCommand {
+	cmd := mdmcommands.NewVerifyRecoveryLockCommand(w.ider.ID())
+	cmd.Command.Password = password
+	return cmd
+}
+
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if len(stepResult.CommandResults) != 1 {
+		return workflow.ErrStepResultCommandLenMismatch
+	}
+	switch stepResult.Name {
+	case stepNameSet:
+		return w.setCompleted(ctx, stepResult)
+	case stepNameVerify:
+		return w.verifyCompleted(ctx, stepResult)
+	}
+	return workflow.ErrUnknownStepName
+}
+
+// setCompleted escrows the pending password if it was set and
+// enqueues its verification.
+func (w *Workflow) setCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	response, ok := stepResult.CommandResults[0].(*mdmcommands.SetRecoveryLockResponse)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	op, err := operation(stepResult.Context)
+	if err != nil {
+		return err
+	}
+	validErr := response.Validate()
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "set recovery lock received",
+		"operation", op,
+		"status", response.Status,
+	)
+
+	inv, err := w.store.RetrieveInventory(ctx, &storage.SearchOptions{IDs: []string{stepResult.ID}})
+	if err != nil {
+		return fmt.Errorf("retrieving inventory: %w", err)
+	}
+	pending, _ := inv[stepResult.ID][KeyPending].(string)
+
+	values := storage.Values{
+		KeyPending:            "",
+		KeyStatus:             response.Status,
+		storage.KeyLastSource: WorkflowName,
+	}
+	if validErr == nil {
+		values[KeyPassword] = pending
+		values[KeySetAt] = w.clock.Now()
+		values[KeyVerified] = false
+	}
+	if err = w.store.StoreInventoryValues(ctx, stepResult.ID, values); err != nil {
+		return fmt.Errorf("update inventory values for %s: %w", stepResult.ID, err)
+	}
+
+	if validErr != nil {
+		return fmt.Errorf("validating set recovery lock response: %w", validErr)
+	}
+	if op != OpSet || pending == "" {
+		return nil
+	}
+
+	se := stepResult.NewStepEnqueueing()
+	se.Name = stepNameVerify
+	se.Context = stepResult.Context
+	se.Commands = []interface{}{w.verifyCommand(pending)}
+	return w.enq.EnqueueStep(ctx, w, se)
+}
+
+// verifyCompleted records the verification result.
+func (w *Workflow) verifyCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	response, ok := stepResult.CommandResults[0].(*mdmcommands.VerifyRecoveryLockResponse)
+	if !ok {
+		return workflow.ErrIncorrectCommandType
+	}
+	validErr := response.Validate()
+
+	ctxlog.Logger(ctx, w.logger).Debug(
+		logkeys.InstanceID, stepResult.InstanceID,
+		logkeys.EnrollmentID, stepResult.ID,
+		logkeys.Message, "verify recovery lock received",
+		"status", response.Status,
+		"verified", response.PasswordVerified,
+	)
+
+	values := storage.Values{
+		KeyStatus:             response.Status,
+		storage.KeyLastSource: WorkflowName,
+	}
+	if validErr == nil {
+		values[KeyVerified] = response.PasswordVerified
+		values[KeyVerifiedAt] = w.clock.Now()
+	}
+	if err := w.store.StoreInventoryValues(ctx, stepResult.ID, values); err != nil {
+		return fmt.Errorf("update inventory values for %s: %w", stepResult.ID, err)
+	}
+
+	if validErr != nil {
+		return fmt.Errorf("validating verify recovery lock response: %w", validErr)
+	}
+	if !response.PasswordVerified {
+		return errors.New("escrowed password not verified")
+	}
+	return nil
+}
+
+func (w *Workflow) StepTimeout(_ context.Context, _ *workflow.StepResult) error {
+	return workflow.ErrTimeoutNotUsed
+}
+
+func (w *Workflow) Event(_ context.Context, _ *workflow.Event, _ string, _ *workflow.MDMContext) error {
+	return workflow.ErrEventsNotSupported
+}
@@ -0,0 +1,112 @@
+package recoverylock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/subsystem/inventory/storage"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+// inventory is an in-memory inventory store.
+type inventory map[string]storage.Values
+
+func (inv inventory) RetrieveInventory(_ context.Context, opt *storage.SearchOptions) (map[string]storage.Values, error) {
+	ret := make(map[string]storage.Values)
+	for _, id := range opt.IDs {
+		if v, ok := inv[id]; ok {
+			ret[id] = v
+		}
+	}
+	return ret, nil
+}
+
+func (inv inventory) StoreInventoryValues(_ context.Context, id string, values storage.Values) error {
+	if inv[id] == nil {
+		inv[id] = make(storage.Values)
+	}
+	for k, v := range values {
+		inv[id][k] = v
+	}
+	return nil
+}
+
+func (inv inventory) DeleteInventory(_ context.Context, id string) error {
+	delete(inv, id)
+	return nil
+}
+
+type enqueuer struct{ steps []*workflow.StepEnqueueing }
+
+func (e *enqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	inv := inventory{
+		"intel":   {storage.KeyAppleSilicon: false},
+		"silicon": {storage.KeyAppleSilicon: true, KeyPassword: "old"},
+	}
+	enq := new(enqueuer)
+	w, err := New(enq, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Start(ctx, &workflow.StepStart{IDs: []string{"intel", "silicon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enq.steps) != 1 {
+		t.Fatalf("have: %d steps, want: 1", len(enq.steps))
+	}
+	cmd, ok := enq.steps[0].Commands[0].(*mdmcommands.SetRecoveryLockCommand)
+	if !ok {
+		t.Fatal("incorrect command type")
+	}
+	if cmd.Command.CurrentPassword == nil || *cmd.Command.CurrentPassword != "old" {
+		t.Error("current password not sent")
+	}
+	newPassword := cmd.Command.NewPassword
+	if len(newPassword) != PasswordLength || inv["silicon"][KeyPending] != newPassword {
+		t.Errorf("new password not escrowed: %q", newPassword)
+	}
+
+	// the device sets the new password
+	result := &workflow.StepResult{ID: "silicon", CommandResults: []interface{}{
+		&mdmcommands.SetRecoveryLockResponse{GenericResponse: mdmcommands.GenericResponse{Status: "Acknowledged"}},
+	}}
+	result.Name = stepNameSet
+	result.Context = enq.steps[0].Context
+	if err = w.StepCompleted(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := inv["silicon"][KeyPassword], newPassword; have != want {
+		t.Errorf("have: %v, want: %v", have, want)
+	}
+
+	// and verifies it
+	if len(enq.steps) != 2 || enq.steps[1].Name != stepNameVerify {
+		t.Fatal("verification not enqueued")
+	}
+	verify, ok := enq.steps[1].Commands[0].(*mdmcommands.VerifyRecoveryLockCommand)
+	if !ok || verify.Command.Password != newPassword {
+		t.Fatal("incorrect verify command")
+	}
+	result = &workflow.StepResult{ID: "silicon", CommandResults: []interface{}{
+		&mdmcommands.VerifyRecoveryLockResponse{
+			GenericResponse:  mdmcommands.GenericResponse{Status: "Acknowledged"},
+			PasswordVerified: true,
+		},
+	}}
+	result.Name = stepNameVerify
+	if err = w.StepCompleted(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	if inv["silicon"][KeyVerified] != true {
+		t.Error("password not verified")
+	}
+}
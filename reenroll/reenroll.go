@@ -0,0 +1,248 @@
+// Package reenroll detects re-enrollments of MDM enrollments.
+//
+// NanoMDM resets the TokenUpdate tally of an enrollment when it sends an
+// Authenticate check-in so the first TokenUpdate of every enrollment has
+// a tally of one. An enrollment that completed an enrollment before (i.e.
+// sent a TokenUpdate) and then does so again is re-enrolled. The detector
+// keeps the state of enrollments to hand both the previous and the new
+// state to hooks.
+package reenroll
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/nanomdm/storage"
+	"github.com/micromdm/plist"
+)
+
+// State is the enrollment state of a device channel enrollment.
+type State struct {
+	ID           string `json:"id"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	ProductName  string `json:"product_name,omitempty"`
+	OSVersion    string `json:"os_version,omitempty"`
+	DeviceName   string `json:"device_name,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+
+	// CertHash is the hex SHA-256 hash of the identity certificate.
+	CertHash string `json:"cert_hash,omitempty"`
+
+	AuthenticatedAt time.Time `json:"authenticated_at,omitempty"`
+
+	// EnrolledAt is the time of the first TokenUpdate check-in.
+	// It is zero while the enrollment is in progress.
+	EnrolledAt time.Time `json:"enrolled_at,omitempty"`
+}
+
+// Record contains the enrollment states of an enrollment.
+type Record struct {
+	ID      string `json:"id"`
+	Current *State `json:"current"`
+
+	// Previous is the state of the last completed enrollment while
+	// a re-enrollment is in progress.
+	Previous *State `json:"previous,omitempty"`
+}
+
+// Store stores enrollment state records.
+type Store interface {
+	StoreRecord(ctx context.Context, r *Record) error
+
+	// RetrieveRecord retrieves the record of enrollment id.
+	// Nil is returned if id has no record.
+	RetrieveRecord(ctx context.Context, id string) (*Record, error)
+}
+
+// HookFunc is called with the previous and the new enrollment state when
+// an enrollment re-enrolled. Returned errors are logged.
+type HookFunc func(ctx context.Context, prev, cur *State) error
+
+// Detector is a NanoMDM service that detects re-enrollments.
+type Detector struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	tally  storage.TokenUpdateTallyStore
+	hooks  []HookFunc
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the detector.
+type Option func(*Detector)
+
+// WithHook calls hook for re-enrollments.
+// May be specified multiple times to call multiple hooks in order.
+func WithHook(hook HookFunc) Option {
+	if hook == nil {
+		panic("nil hook")
+	}
+	return func(d *Detector) {
+		d.hooks = append(d.hooks, hook)
+	}
+}
+
+// WithLogger configures a logger for the detector.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(d *Detector) {
+		d.logger = logger
+	}
+}
+
+// WithClock configures the clock of the detector.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(d *Detector) {
+		d.clock = c
+	}
+}
+
+// New creates a new detector. Tally is the NanoMDM storage of the
+// TokenUpdate tallies of enrollments. The detector must run after the
+// core NanoMDM service has stored the check-ins (e.g. in a multi-service).
+func New(store Store, tally storage.TokenUpdateTallyStore, opts ...Option) *Detector {
+	if store == nil {
+		panic("nil store")
+	}
+	if tally == nil {
+		panic("nil tally store")
+	}
+	d := &Detector{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		tally:                    tally,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// certHash returns the hex SHA-256 hash of the identity certificate of r.
+func certHash(r *mdm.Request) string {
+	if r.Certificate == nil {
+		return ""
+	}
+	hash := sha256.Sum256(r.Certificate.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// deviceInfo are the optional device attributes of Authenticate messages.
+// NanoMDM doesn't parse them so they are read from the raw message.
+type deviceInfo struct {
+	ProductName string
+	OSVersion   string
+	DeviceName  string
+}
+
+// Authenticate records the new enrollment state and keeps the state of
+// a completed previous enrollment.
+func (d *Detector) Authenticate(r *mdm.Request, m *mdm.Authenticate) error {
+	if r.ParentID != "" {
+		return nil
+	}
+	info := new(deviceInfo)
+	if len(m.Raw) > 0 {
+		if err := plist.Unmarshal(m.Raw, info); err != nil {
+			return fmt.Errorf("unmarshal authenticate: %w", err)
+		}
+	}
+	rec, err := d.store.RetrieveRecord(r.Context(), r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving record: %w", err)
+	}
+	if rec == nil {
+		rec = &Record{ID: r.ID}
+	} else if rec.Current != nil && !rec.Current.EnrolledAt.IsZero() {
+		rec.Previous = rec.Current
+	}
+	rec.Current = &State{
+		ID:              r.ID,
+		SerialNumber:    m.SerialNumber,
+		ProductName:     info.ProductName,
+		OSVersion:       info.OSVersion,
+		DeviceName:      info.DeviceName,
+		Topic:           m.Topic,
+		CertHash:        certHash(r),
+		AuthenticatedAt: d.clock.Now(),
+	}
+	if err = d.store.StoreRecord(r.Context(), rec); err != nil {
+		return fmt.Errorf("storing record: %w", err)
+	}
+	return nil
+}
+
+// TokenUpdate completes enrollments on their first TokenUpdate check-in
+// and calls the hooks if the enrollment re-enrolled.
+func (d *Detector) TokenUpdate(r *mdm.Request, m *mdm.TokenUpdate) error {
+	if r.ParentID != "" {
+		return nil
+	}
+	tally, err := d.tally.RetrieveTokenUpdateTally(r.Context(), r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving token update tally: %w", err)
+	}
+	rec, err := d.store.RetrieveRecord(r.Context(), r.ID)
+	if err != nil {
+		return fmt.Errorf("retrieving record: %w", err)
+	}
+	if rec == nil {
+		// enrolled before the detector was enabled
+		rec = &Record{ID: r.ID}
+	}
+	if rec.Current == nil {
+		rec.Current = &State{ID: r.ID, Topic: m.Topic}
+	}
+	if !rec.Current.EnrolledAt.IsZero() && tally != 1 {
+		// already enrolled and no new enrollment
+		return nil
+	}
+	rec.Current.EnrolledAt = d.clock.Now()
+	if rec.Current.CertHash == "" {
+		rec.Current.CertHash = certHash(r)
+	}
+	prev := rec.Previous
+	if tally != 1 {
+		// the enrollment was not seen to re-enroll
+		prev = nil
+	}
+	rec.Previous = nil
+	if err = d.store.StoreRecord(r.Context(), rec); err != nil {
+		return fmt.Errorf("storing record: %w", err)
+	}
+	if prev == nil {
+		return nil
+	}
+
+	logger := ctxlog.Logger(r.Context(), d.logger)
+	logger.Debug("msg", "re-enrollment", "id", r.ID, "enrolled_at", prev.EnrolledAt)
+	for i, hook := range d.hooks {
+		if err = hook(r.Context(), prev, rec.Current); err != nil {
+			logger.Info("msg", "re-enrollment hook", "id", r.ID, "hook", i, "err", err)
+		}
+	}
+	return nil
+}
+
+// Record retrieves the enrollment state record of enrollment id.
+// Nil is returned if id has no record.
+func (d *Detector) Record(ctx context.Context, id string) (*Record, error) {
+	return d.store.RetrieveRecord(ctx, id)
+}
@@ -0,0 +1,78 @@
+package reenroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+type tallies map[string]int
+
+func (t tallies) RetrieveTokenUpdateTally(_ context.Context, id string) (int, error) {
+	return t[id], nil
+}
+
+func TestDetector(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tally := make(tallies)
+	var calls [][2]*State
+	d := New(NewKVStore(kvmap.New()), tally, WithClock(c), WithHook(func(_ context.Context, prev, cur *State) error {
+		calls = append(calls, [2]*State{prev, cur})
+		return nil
+	}))
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{Type: mdm.Device, ID: "ID1"}
+	enroll := func(osVersion string) {
+		t.Helper()
+		tally["ID1"] = 0
+		raw, err := plist.Marshal(map[string]string{"MessageType": "Authenticate", "OSVersion": osVersion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := &mdm.Authenticate{Topic: "com.apple.mgmt.test", Raw: raw}
+		if err := d.Authenticate(r, auth); err != nil {
+			t.Fatal(err)
+		}
+		c.Advance(time.Minute)
+		for i := 0; i < 2; i++ {
+			tally["ID1"]++
+			if err := d.TokenUpdate(r, &mdm.TokenUpdate{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	enroll("17.0")
+	if len(calls) != 0 {
+		t.Fatalf("initial enrollment: have %d hook calls, want 0", len(calls))
+	}
+
+	c.Advance(time.Hour)
+	enroll("17.1")
+	if len(calls) != 1 {
+		t.Fatalf("re-enrollment: have %d hook calls, want 1", len(calls))
+	}
+	prev, cur := calls[0][0], calls[0][1]
+	if prev.OSVersion != "17.0" || cur.OSVersion != "17.1" {
+		t.Errorf("os versions: have %q and %q", prev.OSVersion, cur.OSVersion)
+	}
+	if !cur.EnrolledAt.After(prev.EnrolledAt) {
+		t.Errorf("enrolled at: previous %v, current %v", prev.EnrolledAt, cur.EnrolledAt)
+	}
+
+	rec, err := d.Record(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.Previous != nil || rec.Current.OSVersion != "17.1" {
+		t.Errorf("record: have %+v", rec)
+	}
+}
@@ -0,0 +1,143 @@
+// Package mysql prunes DM status reports and command results directly
+// from KMFDDM's and NanoMDM's MySQL storage tables.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StatusReports prunes the status reports of KMFDDM MySQL storage.
+type StatusReports struct {
+	db *sql.DB
+}
+
+// NewStatusReports creates a new status report pruner using db.
+// The database must contain the KMFDDM schema.
+func NewStatusReports(db *sql.DB) *StatusReports {
+	if db == nil {
+		panic("nil db")
+	}
+	return &StatusReports{db: db}
+}
+
+// Prune deletes the status reports older than before and all but the
+// newest maxCount status reports of each enrollment.
+func (s *StatusReports) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	var deleted int64
+	if !before.IsZero() {
+		res, err := s.db.ExecContext(ctx, `DELETE FROM status_reports WHERE created_at < ?;`, before)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting status reports by age: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if maxCount > 0 {
+		// KMFDDM counts each enrollment's reports from newest (0) to oldest
+		res, err := s.db.ExecContext(ctx, `DELETE FROM status_reports WHERE row_count >= ?;`, maxCount)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting status reports by count: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// CommandResults prunes the command results of NanoMDM MySQL storage.
+// NotNow results are never pruned as their commands are still pending.
+// The queued commands of pruned results are deleted with the results
+// as they would otherwise be delivered again.
+type CommandResults struct {
+	db *sql.DB
+}
+
+// NewCommandResults creates a new command result pruner using db.
+// The database must contain the NanoMDM schema.
+func NewCommandResults(db *sql.DB) *CommandResults {
+	if db == nil {
+		panic("nil db")
+	}
+	return &CommandResults{db: db}
+}
+
+// Prune deletes the command results last updated before before and
+// all but the newest maxCount command results of each enrollment.
+// Commands no longer queued nor with results are deleted as well.
+func (s *CommandResults) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	var deleted int64
+	if !before.IsZero() {
+		res, err := s.db.ExecContext(
+			ctx, `
+DELETE
+    q, r
+FROM
+    command_results AS r
+    LEFT JOIN enrollment_queue AS q
+        ON q.command_uuid = r.command_uuid AND q.id = r.id
+WHERE
+    r.status != 'NotNow' AND
+    r.updated_at < ?;`,
+			before,
+		)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting command results by age: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if maxCount > 0 {
+		res, err := s.db.ExecContext(
+			ctx, `
+DELETE
+    q, r
+FROM
+    command_results AS r
+    INNER JOIN (
+        SELECT id, command_uuid FROM (
+            SELECT
+                id,
+                command_uuid,
+                ROW_NUMBER() OVER (PARTITION BY id ORDER BY updated_at DESC) AS n
+            FROM
+                command_results
+            WHERE
+                status != 'NotNow'
+        ) AS ranked
+        WHERE n > ?
+    ) AS old
+        ON old.id = r.id AND old.command_uuid = r.command_uuid
+    LEFT JOIN enrollment_queue AS q
+        ON q.command_uuid = r.command_uuid AND q.id = r.id;`,
+			maxCount,
+		)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting command results by count: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if deleted > 0 {
+		_, err := s.db.ExecContext(
+			ctx, `
+DELETE
+    c
+FROM
+    commands AS c
+    LEFT JOIN enrollment_queue AS q
+        ON q.command_uuid = c.command_uuid
+    LEFT JOIN command_results AS r
+        ON r.command_uuid = c.command_uuid
+WHERE
+    q.command_uuid IS NULL AND
+    r.command_uuid IS NULL;`,
+		)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting commands: %w", err)
+		}
+	}
+	return deleted, nil
+}
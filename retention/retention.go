@@ -0,0 +1,154 @@
+// Package retention prunes stored DM status reports and command results
+// according to age- and count-based retention policies.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Policy is a retention policy.
+// Zero-valued fields do not prune.
+type Policy struct {
+	// MaxAge is the age after which records are pruned.
+	MaxAge time.Duration
+
+	// MaxCount is the number of newest records kept per enrollment.
+	MaxCount int
+}
+
+// Pruner prunes stored records.
+type Pruner interface {
+	// Prune deletes the records older than before (if not zero) and all
+	// but the newest maxCount records of each enrollment (if not zero).
+	// It returns the number of deleted records.
+	Prune(ctx context.Context, before time.Time, maxCount int) (int64, error)
+}
+
+// PrunerFunc adapts a function to a Pruner.
+type PrunerFunc func(ctx context.Context, before time.Time, maxCount int) (int64, error)
+
+// Prune calls f(ctx, before, maxCount).
+func (f PrunerFunc) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	return f(ctx, before, maxCount)
+}
+
+// policyPruner is a pruner with its policy.
+type policyPruner struct {
+	name   string
+	pruner Pruner
+	policy Policy
+}
+
+// Retainer prunes records according to their retention policies.
+type Retainer struct {
+	pruners []policyPruner
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the retainer.
+type Option func(*Retainer)
+
+// WithPruner prunes the records of pruner according to policy.
+// Name identifies the pruned records in logs and results.
+// Pruners with an empty policy are ignored.
+func WithPruner(name string, pruner Pruner, policy Policy) Option {
+	if pruner == nil {
+		panic("nil pruner")
+	}
+	return func(r *Retainer) {
+		if policy.MaxAge <= 0 && policy.MaxCount <= 0 {
+			return
+		}
+		r.pruners = append(r.pruners, policyPruner{name: name, pruner: pruner, policy: policy})
+	}
+}
+
+// WithLogger configures a logger for the retainer.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(r *Retainer) {
+		r.logger = logger
+	}
+}
+
+// WithClock configures the clock of the retainer.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Retainer) {
+		r.clock = c
+	}
+}
+
+// New creates a new retainer.
+func New(opts ...Option) *Retainer {
+	r := &Retainer{logger: log.NopLogger, clock: clock.Real}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Enabled reports whether r has any pruners.
+func (r *Retainer) Enabled() bool {
+	return len(r.pruners) > 0
+}
+
+// Prune prunes the records of all pruners and returns the number of
+// deleted records by pruner name. Pruning continues after errors.
+func (r *Retainer) Prune(ctx context.Context) (map[string]int64, error) {
+	logger := ctxlog.Logger(ctx, r.logger)
+	now := r.clock.Now()
+	deleted := make(map[string]int64, len(r.pruners))
+	var errs []string
+	for _, p := range r.pruners {
+		var before time.Time
+		if p.policy.MaxAge > 0 {
+			before = now.Add(-p.policy.MaxAge)
+		}
+		n, err := p.pruner.Prune(ctx, before, p.policy.MaxCount)
+		deleted[p.name] = n
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p.name, err))
+			continue
+		}
+		logger.Debug("msg", "pruned", "records", p.name, "deleted", n)
+	}
+	if len(errs) > 0 {
+		return deleted, fmt.Errorf("pruning: %s", strings.Join(errs, "; "))
+	}
+	return deleted, nil
+}
+
+// Run prunes every interval until ctx is done.
+func (r *Retainer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid interval")
+	}
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Prune(ctx); err != nil {
+			ctxlog.Logger(ctx, r.logger).Info("err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
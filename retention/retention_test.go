@@ -0,0 +1,47 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var haveBefore time.Time
+	var haveCount int
+	reports := PrunerFunc(func(_ context.Context, before time.Time, maxCount int) (int64, error) {
+		haveBefore, haveCount = before, maxCount
+		return 3, nil
+	})
+	failing := PrunerFunc(func(_ context.Context, _ time.Time, _ int) (int64, error) {
+		return 0, errors.New("prune failed")
+	})
+
+	r := New(
+		WithClock(clock.NewFake(now)),
+		WithPruner("reports", reports, Policy{MaxAge: time.Hour, MaxCount: 10}),
+		WithPruner("results", failing, Policy{MaxCount: 5}),
+		WithPruner("ignored", failing, Policy{}),
+	)
+
+	deleted, err := r.Prune(context.Background())
+	if err == nil {
+		t.Error("expected error")
+	}
+	if have, want := deleted["reports"], int64(3); have != want {
+		t.Errorf("deleted: have: %v, want: %v", have, want)
+	}
+	if _, ok := deleted["ignored"]; ok {
+		t.Error("pruner without policy ran")
+	}
+	if have, want := haveBefore, now.Add(-time.Hour); !have.Equal(want) {
+		t.Errorf("before: have: %v, want: %v", have, want)
+	}
+	if have, want := haveCount, 10; have != want {
+		t.Errorf("max count: have: %v, want: %v", have, want)
+	}
+}
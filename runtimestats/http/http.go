@@ -0,0 +1,47 @@
+// Package http provides the HTTP API for runtime statistics and
+// profiling.
+package http
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/runtimestats"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// StatsHandler returns the current runtime statistics.
+func StatsHandler(c *runtimestats.Collector, logger log.Logger) http.HandlerFunc {
+	if c == nil {
+		panic("nil collector")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+		httpapi.WriteJSON(w, c.Collect(), logger)
+	}
+}
+
+// HandleAPIv1 registers the runtime statistics, expvar, and pprof
+// handlers into mux. The pprof index only finds profiles if requests
+// reach mux with a "/debug/pprof/" path so prefix should be empty and
+// any outer path prefix stripped.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, c *runtimestats.Collector) {
+	mux.Handle(
+		prefix+"/debug/runtime",
+		StatsHandler(c, logger.With("handler", "runtime-stats")),
+		"GET",
+	)
+
+	mux.Handle(prefix+"/debug/vars", expvar.Handler(), "GET")
+
+	// specific pprof handlers must be registered before the index
+	mux.Handle(prefix+"/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline), "GET")
+	mux.Handle(prefix+"/debug/pprof/profile", http.HandlerFunc(pprof.Profile), "GET")
+	mux.Handle(prefix+"/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol), "GET", "POST")
+	mux.Handle(prefix+"/debug/pprof/trace", http.HandlerFunc(pprof.Trace), "GET")
+	mux.Handle(prefix+"/debug/pprof/...", http.HandlerFunc(pprof.Index), "GET")
+}
@@ -0,0 +1,112 @@
+// Package runtimestats reports Go runtime statistics of the running
+// server for troubleshooting memory and CPU usage.
+package runtimestats
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+// Memory are Go runtime memory statistics in bytes.
+type Memory struct {
+	Alloc       uint64 `json:"alloc"`
+	TotalAlloc  uint64 `json:"total_alloc"`
+	Sys         uint64 `json:"sys"`
+	HeapAlloc   uint64 `json:"heap_alloc"`
+	HeapInuse   uint64 `json:"heap_inuse"`
+	HeapIdle    uint64 `json:"heap_idle"`
+	HeapObjects uint64 `json:"heap_objects"`
+	StackInuse  uint64 `json:"stack_inuse"`
+}
+
+// GC are Go garbage collector statistics.
+type GC struct {
+	NumGC      uint32     `json:"num_gc"`
+	PauseTotal string     `json:"pause_total"`
+	LastGC     *time.Time `json:"last_gc,omitempty"`
+	NextGC     uint64     `json:"next_gc"`
+}
+
+// Stats are the runtime statistics of the server.
+type Stats struct {
+	Version    string    `json:"version"`
+	GoVersion  string    `json:"go_version"`
+	GOOS       string    `json:"goos"`
+	GOARCH     string    `json:"goarch"`
+	NumCPU     int       `json:"num_cpu"`
+	GOMAXPROCS int       `json:"gomaxprocs"`
+	Goroutines int       `json:"goroutines"`
+	StartTime  time.Time `json:"start_time"`
+	Uptime     string    `json:"uptime"`
+	Memory     Memory    `json:"memory"`
+	GC         GC        `json:"gc"`
+}
+
+// Collector collects runtime statistics.
+type Collector struct {
+	version string
+	clock   clock.Clock
+	start   time.Time
+}
+
+// Option configures a Collector.
+type Option func(*Collector)
+
+// WithClock configures the clock for the uptime.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Collector) {
+		c.clock = clk
+	}
+}
+
+// New creates a new collector for the server version.
+// The uptime starts at creation.
+func New(version string, opts ...Option) *Collector {
+	c := &Collector{version: version, clock: clock.Real}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.start = c.clock.Now()
+	return c
+}
+
+// Collect returns the current runtime statistics.
+// Note that reading memory statistics briefly stops the world.
+func (c *Collector) Collect() *Stats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	s := &Stats{
+		Version:    c.version,
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		StartTime:  c.start,
+		Uptime:     c.clock.Now().Sub(c.start).Truncate(time.Second).String(),
+		Memory: Memory{
+			Alloc:       m.Alloc,
+			TotalAlloc:  m.TotalAlloc,
+			Sys:         m.Sys,
+			HeapAlloc:   m.HeapAlloc,
+			HeapInuse:   m.HeapInuse,
+			HeapIdle:    m.HeapIdle,
+			HeapObjects: m.HeapObjects,
+			StackInuse:  m.StackInuse,
+		},
+		GC: GC{
+			NumGC:      m.NumGC,
+			PauseTotal: time.Duration(m.PauseTotalNs).String(),
+			NextGC:     m.NextGC,
+		},
+	}
+	if m.LastGC > 0 {
+		lastGC := time.Unix(0, int64(m.LastGC))
+		s.GC.LastGC = &lastGC
+	}
+	return s
+}
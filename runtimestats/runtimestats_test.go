@@ -0,0 +1,22 @@
+package runtimestats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+)
+
+func TestCollect(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	c := New("v1.2.3", WithClock(clk))
+	clk.Advance(90 * time.Second)
+
+	s := c.Collect()
+	if have, want := s.Uptime, "1m30s"; have != want {
+		t.Errorf("uptime: have: %q, want: %q", have, want)
+	}
+	if s.Version != "v1.2.3" || s.Goroutines < 1 || s.Memory.Sys == 0 {
+		t.Errorf("stats: %+v", s)
+	}
+}
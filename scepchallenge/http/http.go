@@ -0,0 +1,93 @@
+// Package http provides the HTTP API for SCEP challenges.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/scepchallenge"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// VerifyRequest is the body of a challenge verification request.
+// The step-ca SCEP challenge webhook field name is also accepted.
+type VerifyRequest struct {
+	Challenge     string `json:"challenge"`
+	SCEPChallenge string `json:"scepChallenge"`
+}
+
+// VerifyResponse is the response to a challenge verification request.
+type VerifyResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// IssueHandler issues a new challenge.
+func IssueHandler(i *scepchallenge.Issuer, logger log.Logger) http.HandlerFunc {
+	if i == nil {
+		panic("nil issuer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		c, err := i.Issue(r.Context())
+		if err != nil {
+			logger.Info("msg", "issuing challenge", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, c, logger)
+	}
+}
+
+// VerifyHandler validates and consumes a challenge.
+// It is meant to be called by a SCEP server for each certificate request.
+func VerifyHandler(i *scepchallenge.Issuer, logger log.Logger) http.HandlerFunc {
+	if i == nil {
+		panic("nil issuer")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		req := new(VerifyRequest)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+		challenge := req.Challenge
+		if challenge == "" {
+			challenge = req.SCEPChallenge
+		}
+
+		err := i.Validate(r.Context(), challenge)
+		if err != nil && !errors.Is(err, scepchallenge.ErrInvalidChallenge) {
+			logger.Info("msg", "validating challenge", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, &VerifyResponse{Allow: err == nil}, logger)
+	}
+}
+
+// HandleAPIv1 registers the SCEP challenge API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, i *scepchallenge.Issuer) {
+	mux.Handle(
+		prefix+"/scep/challenges",
+		IssueHandler(i, logger.With("handler", "issue-scep-challenge")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/scep/challenges/verify",
+		VerifyHandler(i, logger.With("handler", "verify-scep-challenge")),
+		"POST",
+	)
+}
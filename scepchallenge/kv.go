@@ -0,0 +1,55 @@
+package scepchallenge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+// KVStore stores challenges in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new challenge store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreChallenge stores c.
+func (s *KVStore) StoreChallenge(ctx context.Context, c *Challenge) error {
+	if c == nil || c.Challenge == "" {
+		return errors.New("invalid challenge")
+	}
+	v, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal challenge: %w", err)
+	}
+	return s.b.Set(ctx, c.Challenge, v)
+}
+
+// RetrieveChallenge retrieves challenge.
+func (s *KVStore) RetrieveChallenge(ctx context.Context, challenge string) (*Challenge, error) {
+	v, err := s.b.Get(ctx, challenge)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := new(Challenge)
+	if err = json.Unmarshal(v, c); err != nil {
+		return nil, fmt.Errorf("unmarshal challenge: %w", err)
+	}
+	return c, nil
+}
+
+// DeleteChallenge deletes challenge.
+func (s *KVStore) DeleteChallenge(ctx context.Context, challenge string) error {
+	return s.b.Delete(ctx, challenge)
+}
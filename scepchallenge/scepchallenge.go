@@ -0,0 +1,146 @@
+// Package scepchallenge issues and validates one-time SCEP challenge
+// passwords. A SCEP server validates the challenge of each certificate
+// request with the issuer instead of using a static challenge.
+package scepchallenge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultTTL is the default lifetime of a challenge.
+const DefaultTTL = time.Hour
+
+// ErrInvalidChallenge is returned for unknown, used, or expired challenges.
+var ErrInvalidChallenge = errors.New("invalid challenge")
+
+// Challenge is a one-time SCEP challenge.
+type Challenge struct {
+	Challenge string    `json:"challenge"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store stores challenges.
+type Store interface {
+	StoreChallenge(ctx context.Context, c *Challenge) error
+
+	// RetrieveChallenge retrieves challenge.
+	// A nil challenge is returned if it does not exist.
+	RetrieveChallenge(ctx context.Context, challenge string) (*Challenge, error)
+
+	DeleteChallenge(ctx context.Context, challenge string) error
+}
+
+// Issuer issues and validates challenges.
+type Issuer struct {
+	store  Store
+	ttl    time.Duration
+	logger log.Logger
+	clock  clock.Clock
+}
+
+// Option configures the issuer.
+type Option func(*Issuer)
+
+// WithTTL configures the lifetime of issued challenges.
+func WithTTL(ttl time.Duration) Option {
+	return func(i *Issuer) {
+		if ttl > 0 {
+			i.ttl = ttl
+		}
+	}
+}
+
+// WithLogger configures a logger for the issuer.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(i *Issuer) {
+		i.logger = logger
+	}
+}
+
+// WithClock configures the clock of the issuer.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(i *Issuer) {
+		i.clock = c
+	}
+}
+
+// New creates a new challenge issuer.
+func New(store Store, opts ...Option) *Issuer {
+	if store == nil {
+		panic("nil store")
+	}
+	i := &Issuer{
+		store:  store,
+		ttl:    DefaultTTL,
+		logger: log.NopLogger,
+		clock:  clock.Real,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Issue issues a new challenge.
+func (i *Issuer) Issue(ctx context.Context) (*Challenge, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("generating challenge: %w", err)
+	}
+	now := i.clock.Now()
+	c := &Challenge{
+		Challenge: hex.EncodeToString(b),
+		CreatedAt: now,
+		ExpiresAt: now.Add(i.ttl),
+	}
+	if err := i.store.StoreChallenge(ctx, c); err != nil {
+		return nil, fmt.Errorf("storing challenge: %w", err)
+	}
+	ctxlog.Logger(ctx, i.logger).Debug("msg", "issued challenge", "expires_at", c.ExpiresAt)
+	return c, nil
+}
+
+// Validate validates and consumes challenge.
+// ErrInvalidChallenge is returned if challenge is not valid.
+func (i *Issuer) Validate(ctx context.Context, challenge string) error {
+	logger := ctxlog.Logger(ctx, i.logger)
+	if _, err := hex.DecodeString(challenge); err != nil || challenge == "" {
+		// not issued by us (and not a safe storage key)
+		return ErrInvalidChallenge
+	}
+	c, err := i.store.RetrieveChallenge(ctx, challenge)
+	if err != nil {
+		return fmt.Errorf("retrieving challenge: %w", err)
+	}
+	if c == nil {
+		logger.Info("msg", "unknown challenge")
+		return ErrInvalidChallenge
+	}
+	// challenges are single-use, even when expired
+	if err = i.store.DeleteChallenge(ctx, challenge); err != nil {
+		return fmt.Errorf("deleting challenge: %w", err)
+	}
+	if !i.clock.Now().Before(c.ExpiresAt) {
+		logger.Info("msg", "expired challenge", "expired_at", c.ExpiresAt)
+		return ErrInvalidChallenge
+	}
+	logger.Debug("msg", "validated challenge")
+	return nil
+}
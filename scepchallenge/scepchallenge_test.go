@@ -0,0 +1,42 @@
+package scepchallenge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	i := New(NewKVStore(kvmap.New()), WithTTL(time.Hour), WithClock(c))
+
+	ch, err := i.Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Validate(ctx, ch.Challenge); err != nil {
+		t.Fatal(err)
+	}
+	// challenges are single-use
+	if err = i.Validate(ctx, ch.Challenge); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalidChallenge)
+	}
+
+	ch, err = i.Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(2 * time.Hour)
+	if err = i.Validate(ctx, ch.Challenge); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expired: have: %v, want: %v", err, ErrInvalidChallenge)
+	}
+
+	if err = i.Validate(ctx, "../not-a-challenge"); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalidChallenge)
+	}
+}
@@ -0,0 +1,57 @@
+// Package http provides the HTTP API for searching.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/search"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// ErrNoQuery is returned when no search query is provided.
+var ErrNoQuery = errors.New("no query provided")
+
+// SearchHandler searches for the "q" query parameter.
+// The "type" query parameter (repeatable) limits the result types
+// and the "limit" query parameter limits the number of results.
+func SearchHandler(s *search.Searcher, logger log.Logger) http.HandlerFunc {
+	if s == nil {
+		panic("nil searcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		q := r.URL.Query()
+		if q.Get("q") == "" {
+			httpapi.JSONError(w, ErrNoQuery, http.StatusBadRequest)
+			return
+		}
+
+		limit, err := httpapi.QueryInt(r, "limit", 100)
+		if err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		results := s.Search(r.Context(), q.Get("q"), q["type"], limit)
+		if results == nil {
+			results = []*search.Result{}
+		}
+
+		httpapi.WriteJSON(w, results, logger)
+	}
+}
+
+// HandleAPIv1 registers the search API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, s *search.Searcher) {
+	mux.Handle(
+		prefix+"/search",
+		SearchHandler(s, logger.With("handler", "search")),
+		"GET",
+	)
+}
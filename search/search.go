@@ -0,0 +1,280 @@
+// Package search looks up enrollments, declarations, sets, workflows,
+// and commands across NanoHUB's subsystems.
+package search
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/micromdm/nanohub/cmdexpiry"
+	"github.com/micromdm/nanohub/cmdresponse"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// Result types.
+const (
+	TypeEnrollment  = "enrollment"
+	TypeDeclaration = "declaration"
+	TypeSet         = "set"
+	TypeWorkflow    = "workflow"
+	TypeCommand     = "command"
+)
+
+// Result is a search result.
+type Result struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	// Match is the field that matched the query (e.g. "id" or "serial_number").
+	Match string `json:"match"`
+}
+
+// Source searches one kind of object.
+type Source interface {
+	// Type returns the result type of the source.
+	Type() string
+
+	// Search returns the results matching the (lower-case) query.
+	Search(ctx context.Context, query string) ([]*Result, error)
+}
+
+// Searcher searches sources.
+type Searcher struct {
+	sources []Source
+	logger  log.Logger
+}
+
+// New creates a new searcher of sources.
+func New(logger log.Logger, sources ...Source) *Searcher {
+	if logger == nil {
+		logger = log.NopLogger
+	}
+	return &Searcher{sources: sources, logger: logger}
+}
+
+// Search searches all sources of types for query.
+// All sources are searched if types is empty. Results are sorted by
+// type and ID. At most limit results are returned if limit > 0.
+// The sources that fail are logged and skipped.
+func (s *Searcher) Search(ctx context.Context, query string, types []string, limit int) []*Result {
+	logger := ctxlog.Logger(ctx, s.logger)
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+	var results []*Result
+	for _, src := range s.sources {
+		if len(types) > 0 && !contains(types, src.Type()) {
+			continue
+		}
+		r, err := src.Search(ctx, query)
+		if err != nil {
+			logger.Info("msg", "searching", "type", src.Type(), "err", err)
+			continue
+		}
+		results = append(results, r...)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Type != results[j].Type {
+			return results[i].Type < results[j].Type
+		}
+		return results[i].ID < results[j].ID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the query matches v.
+func match(query, v string) bool {
+	return v != "" && strings.Contains(strings.ToLower(v), query)
+}
+
+// ids returns results of typ for the IDs matching query.
+func ids(typ string, query string, ids []string) []*Result {
+	var results []*Result
+	for _, id := range ids {
+		if match(query, id) {
+			results = append(results, &Result{Type: typ, ID: id, Match: "id"})
+		}
+	}
+	return results
+}
+
+type sourceFunc struct {
+	typ string
+	fn  func(ctx context.Context, query string) ([]*Result, error)
+}
+
+func (s *sourceFunc) Type() string { return s.typ }
+
+func (s *sourceFunc) Search(ctx context.Context, query string) ([]*Result, error) {
+	return s.fn(ctx, query)
+}
+
+// ResponseStore retrieves command responses of all enrollments.
+type ResponseStore interface {
+	RetrieveResponsesByType(ctx context.Context, requestType string) (map[string]*cmdresponse.Response, error)
+}
+
+// AssignmentStore retrieves the users assigned to enrollments.
+type AssignmentStore interface {
+	RetrieveAssignments(ctx context.Context) (map[string]string, error)
+}
+
+// Enrollments searches the enrollments with DeviceInformation responses
+// by ID, serial number, device name, and model as well as enrollments
+// by assigned user. Either store may be nil.
+func Enrollments(responses ResponseStore, assignments AssignmentStore) Source {
+	return &sourceFunc{typ: TypeEnrollment, fn: func(ctx context.Context, query string) ([]*Result, error) {
+		found := make(map[string]*Result)
+		if responses != nil {
+			resps, err := responses.RetrieveResponsesByType(ctx, cmdresponse.DeviceInformationType)
+			if err != nil {
+				return nil, fmt.Errorf("retrieving device information: %w", err)
+			}
+			for id, r := range resps {
+				di := r.DeviceInformation
+				if di == nil {
+					continue
+				}
+				res := &Result{Type: TypeEnrollment, ID: id, Name: di.DeviceName}
+				switch {
+				case match(query, id):
+					res.Match = "id"
+				case match(query, di.SerialNumber):
+					res.Match = "serial_number"
+				case match(query, di.DeviceName):
+					res.Match = "device_name"
+				case match(query, di.Model), match(query, di.ModelName):
+					res.Match = "model"
+				default:
+					continue
+				}
+				found[id] = res
+			}
+		}
+		if assignments != nil {
+			users, err := assignments.RetrieveAssignments(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("retrieving assignments: %w", err)
+			}
+			for id, user := range users {
+				if _, ok := found[id]; ok {
+					continue
+				}
+				if match(query, id) {
+					found[id] = &Result{Type: TypeEnrollment, ID: id, Match: "id"}
+				} else if match(query, user) {
+					found[id] = &Result{Type: TypeEnrollment, ID: id, Name: user, Match: "user"}
+				}
+			}
+		}
+		results := make([]*Result, 0, len(found))
+		for _, r := range found {
+			results = append(results, r)
+		}
+		return results, nil
+	}}
+}
+
+// DeclarationStore retrieves DDM declaration identifiers.
+type DeclarationStore interface {
+	RetrieveDeclarations(ctx context.Context) ([]string, error)
+}
+
+// Declarations searches DDM declarations by identifier.
+func Declarations(store DeclarationStore) Source {
+	return &sourceFunc{typ: TypeDeclaration, fn: func(ctx context.Context, query string) ([]*Result, error) {
+		decls, err := store.RetrieveDeclarations(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving declarations: %w", err)
+		}
+		return ids(TypeDeclaration, query, decls), nil
+	}}
+}
+
+// SetStore retrieves DDM set names.
+type SetStore interface {
+	RetrieveSets(ctx context.Context) ([]string, error)
+}
+
+// Sets searches DDM sets by name.
+func Sets(store SetStore) Source {
+	return &sourceFunc{typ: TypeSet, fn: func(ctx context.Context, query string) ([]*Result, error) {
+		sets, err := store.RetrieveSets(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving sets: %w", err)
+		}
+		return ids(TypeSet, query, sets), nil
+	}}
+}
+
+// Workflows searches the names of the registered workflows.
+func Workflows(names []string) Source {
+	return &sourceFunc{typ: TypeWorkflow, fn: func(_ context.Context, query string) ([]*Result, error) {
+		return ids(TypeWorkflow, query, names), nil
+	}}
+}
+
+// ExpiryStore retrieves command expirations.
+type ExpiryStore interface {
+	RetrieveExpiries(ctx context.Context) (map[string]*cmdexpiry.Expiry, error)
+}
+
+// Commands searches commands by UUID. Commands with expirations and
+// commands with stored responses are searched. Either store may be nil.
+func Commands(expiries ExpiryStore, responses ResponseStore) Source {
+	return &sourceFunc{typ: TypeCommand, fn: func(ctx context.Context, query string) ([]*Result, error) {
+		found := make(map[string]*Result)
+		if expiries != nil {
+			exps, err := expiries.RetrieveExpiries(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("retrieving expiries: %w", err)
+			}
+			for uuid := range exps {
+				if match(query, uuid) {
+					found[uuid] = &Result{Type: TypeCommand, ID: uuid, Match: "uuid"}
+				}
+			}
+		}
+		if responses != nil {
+			for _, t := range []string{
+				cmdresponse.DeviceInformationType,
+				cmdresponse.SecurityInfoType,
+				cmdresponse.ProfileListType,
+				cmdresponse.InstalledApplicationListType,
+			} {
+				resps, err := responses.RetrieveResponsesByType(ctx, t)
+				if err != nil {
+					return nil, fmt.Errorf("retrieving %s responses: %w", t, err)
+				}
+				for _, r := range resps {
+					if match(query, r.CommandUUID) {
+						found[r.CommandUUID] = &Result{Type: TypeCommand, ID: r.CommandUUID, Name: r.RequestType, Match: "uuid"}
+					}
+				}
+			}
+		}
+		results := make([]*Result, 0, len(found))
+		for _, r := range found {
+			results = append(results, r)
+		}
+		return results, nil
+	}}
+}
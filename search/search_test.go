@@ -0,0 +1,61 @@
+package search
+
+import (
+	"context"
+	"testing"
+
+	"github.com/micromdm/nanohub/cmdresponse"
+)
+
+type responses map[string]*cmdresponse.Response
+
+func (r responses) RetrieveResponsesByType(_ context.Context, requestType string) (map[string]*cmdresponse.Response, error) {
+	ret := make(map[string]*cmdresponse.Response)
+	for id, resp := range r {
+		if resp.RequestType == requestType {
+			ret[id] = resp
+		}
+	}
+	return ret, nil
+}
+
+type assignments map[string]string
+
+func (a assignments) RetrieveAssignments(context.Context) (map[string]string, error) { return a, nil }
+
+func TestSearch(t *testing.T) {
+	resps := responses{"ID1": {
+		RequestType:       cmdresponse.DeviceInformationType,
+		CommandUUID:       "5E1C3B9A-0000",
+		DeviceInformation: &cmdresponse.DeviceInformation{SerialNumber: "C02XYZ", DeviceName: "Jane's Mac"},
+	}}
+	s := New(nil,
+		Enrollments(resps, assignments{"ID2": "jane"}),
+		Workflows([]string{"io.micromdm.wf.inventory.v1"}),
+		Commands(nil, resps),
+	)
+
+	for _, test := range []struct {
+		query string
+		types []string
+		want  []string
+	}{
+		{"c02x", nil, []string{"enrollment:ID1:serial_number"}},
+		{"JANE", nil, []string{"enrollment:ID1:device_name", "enrollment:ID2:user"}},
+		{"inventory", nil, []string{"workflow:io.micromdm.wf.inventory.v1:id"}},
+		{"5e1c", nil, []string{"command:5E1C3B9A-0000:uuid"}},
+		{"jane", []string{TypeWorkflow}, nil},
+		{"", nil, nil},
+	} {
+		results := s.Search(context.Background(), test.query, test.types, 0)
+		if have, want := len(results), len(test.want); have != want {
+			t.Errorf("%s: have: %v, want: %v", test.query, have, want)
+			continue
+		}
+		for i, r := range results {
+			if have, want := r.Type+":"+r.ID+":"+r.Match, test.want[i]; have != want {
+				t.Errorf("%s: have: %v, want: %v", test.query, have, want)
+			}
+		}
+	}
+}
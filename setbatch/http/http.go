@@ -0,0 +1,133 @@
+// Package http provides the HTTP API for batch DM set membership jobs.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/setbatch"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no job ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNotFound is returned when a job does not exist.
+	ErrNotFound = errors.New("job not found")
+)
+
+// request is the body of a batch request.
+type request struct {
+	Set string   `json:"set"`
+	Op  string   `json:"op"`
+	IDs []string `json:"ids"`
+}
+
+// StartJobHandler starts the batch job in the JSON request body and
+// returns the started job.
+func StartJobHandler(b *setbatch.Batcher, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil batcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		req := new(request)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding request: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		j, err := b.Start(r.Context(), req.Set, req.Op, req.IDs)
+		if errors.Is(err, setbatch.ErrNoSet) || errors.Is(err, setbatch.ErrNoIDs) || errors.Is(err, setbatch.ErrInvalidOp) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "starting job", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "started job", "job", j.ID, "set", j.Set, "op", j.Op, "count", j.Total)
+		httpapi.WriteJSON(w, j, logger)
+	}
+}
+
+// GetJobsHandler returns the reports of all jobs.
+func GetJobsHandler(b *setbatch.Batcher, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil batcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		jobs, err := b.Jobs(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving jobs", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, jobs, logger)
+	}
+}
+
+// GetJobHandler returns the report of the job ID in the URL path.
+func GetJobHandler(b *setbatch.Batcher, logger log.Logger) http.HandlerFunc {
+	if b == nil {
+		panic("nil batcher")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		j, err := b.Job(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving job", "job", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if j == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, j, logger)
+	}
+}
+
+// HandleAPIv1 registers the batch set membership API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, b *setbatch.Batcher) {
+	mux.Handle(
+		prefix+"/setbatches",
+		StartJobHandler(b, logger.With("handler", "start-setbatch")),
+		"POST",
+	)
+
+	mux.Handle(
+		prefix+"/setbatches",
+		GetJobsHandler(b, logger.With("handler", "get-setbatches")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/setbatches/:id",
+		GetJobHandler(b, logger.With("handler", "get-setbatch")),
+		"GET",
+	)
+}
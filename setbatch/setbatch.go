@@ -0,0 +1,314 @@
+// Package setbatch adds and removes large numbers of enrollments to and
+// from DM sets in background jobs. Enrollments are notified in chunks
+// once their set memberships changed rather than once per enrollment.
+package setbatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultChunkSize is the default number of enrollments per notification
+// and progress update.
+const DefaultChunkSize = 500
+
+// MaxFailures is the maximum number of individual failures recorded in a job.
+const MaxFailures = 100
+
+// Operations of jobs.
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+)
+
+// Job statuses.
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+var (
+	// ErrNoSet is returned when a job has no set name.
+	ErrNoSet = errors.New("no set name")
+
+	// ErrNoIDs is returned when a job has no enrollment IDs.
+	ErrNoIDs = errors.New("no enrollment ids")
+
+	// ErrInvalidOp is returned for unknown job operations.
+	ErrInvalidOp = errors.New("invalid operation")
+)
+
+// Failure is the failure to change the set membership of an enrollment.
+type Failure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// Job is a batch set membership change and its report.
+type Job struct {
+	ID  string `json:"id"`
+	Set string `json:"set"`
+	Op  string `json:"op"`
+
+	Status string `json:"status"`
+
+	// Error is the error that stopped a failed job.
+	Error string `json:"error,omitempty"`
+
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+
+	// Changed is the number of enrollments whose membership changed.
+	// Only these enrollments are notified.
+	Changed int `json:"changed"`
+
+	// Notified is the number of enrollments notified.
+	Notified int `json:"notified"`
+
+	FailedCount int `json:"failed_count"`
+
+	// Failures are the first failures of the job (up to MaxFailures).
+	Failures []Failure `json:"failures,omitempty"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// Store stores jobs.
+type Store interface {
+	StoreJob(ctx context.Context, j *Job) error
+
+	// RetrieveJob retrieves job id.
+	// Nil is returned if the job does not exist.
+	RetrieveJob(ctx context.Context, id string) (*Job, error)
+
+	RetrieveJobs(ctx context.Context) ([]*Job, error)
+}
+
+// SetStore changes the DM set memberships of enrollments.
+// The returned booleans report whether the membership changed.
+type SetStore interface {
+	StoreEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+	RemoveEnrollmentSet(ctx context.Context, enrollmentID, setName string) (bool, error)
+}
+
+// Notifier notifies enrollments of DM changes.
+type Notifier interface {
+	Changed(ctx context.Context, declarations []string, sets []string, ids []string) error
+}
+
+// IDer generates job IDs.
+type IDer interface {
+	ID() string
+}
+
+// Batcher runs batch set membership jobs.
+type Batcher struct {
+	store     Store
+	sets      SetStore
+	notifier  Notifier
+	logger    log.Logger
+	clock     clock.Clock
+	ider      IDer
+	chunkSize int
+	wg        sync.WaitGroup
+}
+
+// Option configures the batcher.
+type Option func(*Batcher)
+
+// WithLogger configures a logger for the batcher.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(b *Batcher) {
+		b.logger = logger
+	}
+}
+
+// WithClock configures the clock of the batcher.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(b *Batcher) {
+		b.clock = c
+	}
+}
+
+// WithIDer configures the generator of job IDs.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(b *Batcher) {
+		b.ider = ider
+	}
+}
+
+// WithChunkSize configures the number of enrollments per notification
+// and progress update.
+func WithChunkSize(n int) Option {
+	return func(b *Batcher) {
+		if n > 0 {
+			b.chunkSize = n
+		}
+	}
+}
+
+// New creates a new batcher.
+func New(store Store, sets SetStore, notifier Notifier, opts ...Option) *Batcher {
+	if store == nil {
+		panic("nil store")
+	}
+	if sets == nil {
+		panic("nil set store")
+	}
+	if notifier == nil {
+		panic("nil notifier")
+	}
+	b := &Batcher{
+		store:     store,
+		sets:      sets,
+		notifier:  notifier,
+		logger:    log.NopLogger,
+		clock:     clock.Real,
+		ider:      uuid.NewUUID(),
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Start starts a job changing the membership of ids in set with op.
+// The job runs in the background; its report is available with [Batcher.Job].
+func (b *Batcher) Start(ctx context.Context, set, op string, ids []string) (*Job, error) {
+	if set == "" {
+		return nil, ErrNoSet
+	}
+	if op != OpAdd && op != OpRemove {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOp, op)
+	}
+	if len(ids) < 1 {
+		return nil, ErrNoIDs
+	}
+
+	j := &Job{
+		ID:        b.ider.ID(),
+		Set:       set,
+		Op:        op,
+		Status:    StatusRunning,
+		Total:     len(ids),
+		CreatedAt: b.clock.Now(),
+	}
+	if err := b.store.StoreJob(ctx, j); err != nil {
+		return nil, fmt.Errorf("storing job: %w", err)
+	}
+
+	// the caller gets a copy as the job changes while running
+	started := *j
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.run(context.Background(), j, ids)
+	}()
+	return &started, nil
+}
+
+// Wait waits for all running jobs to finish.
+func (b *Batcher) Wait() {
+	b.wg.Wait()
+}
+
+// Job retrieves the report of job id.
+func (b *Batcher) Job(ctx context.Context, id string) (*Job, error) {
+	return b.store.RetrieveJob(ctx, id)
+}
+
+// Jobs retrieves the reports of all jobs.
+func (b *Batcher) Jobs(ctx context.Context) ([]*Job, error) {
+	return b.store.RetrieveJobs(ctx)
+}
+
+// change changes the set membership of id for j.
+func (b *Batcher) change(ctx context.Context, j *Job, id string) (bool, error) {
+	if j.Op == OpRemove {
+		return b.sets.RemoveEnrollmentSet(ctx, id, j.Set)
+	}
+	return b.sets.StoreEnrollmentSet(ctx, id, j.Set)
+}
+
+// run processes ids in chunks, notifying the changed enrollments of
+// each chunk and storing the progress of j.
+func (b *Batcher) run(ctx context.Context, j *Job, ids []string) {
+	logger := ctxlog.Logger(ctx, b.logger).With("job", j.ID, "set", j.Set, "op", j.Op)
+	logger.Debug("msg", "starting job", "count", len(ids))
+
+	for start := 0; start < len(ids); start += b.chunkSize {
+		end := start + b.chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var changed []string
+		for _, id := range ids[start:end] {
+			ok, err := b.change(ctx, j, id)
+			if err != nil {
+				j.FailedCount++
+				if len(j.Failures) < MaxFailures {
+					j.Failures = append(j.Failures, Failure{ID: id, Error: err.Error()})
+				}
+				continue
+			}
+			if ok {
+				changed = append(changed, id)
+			}
+		}
+		j.Processed = end
+		j.Changed += len(changed)
+
+		if len(changed) > 0 {
+			if err := b.notifier.Changed(ctx, nil, nil, changed); err != nil {
+				// the memberships are changed: stop to not hide
+				// un-notified enrollments in later chunks
+				j.Status = StatusFailed
+				j.Error = fmt.Sprintf("notifying enrollments: %v", err)
+				break
+			}
+			j.Notified += len(changed)
+		}
+
+		if end < len(ids) {
+			if err := b.store.StoreJob(ctx, j); err != nil {
+				logger.Info("msg", "storing job progress", "err", err)
+			}
+		}
+	}
+
+	if j.Status == StatusRunning {
+		j.Status = StatusCompleted
+	}
+	j.CompletedAt = b.clock.Now()
+	if err := b.store.StoreJob(ctx, j); err != nil {
+		logger.Info("msg", "storing job report", "err", err)
+	}
+	logger.Debug(
+		"msg", "job finished",
+		"status", j.Status,
+		"changed", j.Changed,
+		"failed", j.FailedCount,
+	)
+}
@@ -0,0 +1,70 @@
+package setbatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+type sets map[string]bool
+
+func (s sets) StoreEnrollmentSet(_ context.Context, id, _ string) (bool, error) {
+	if id == "bad" {
+		return false, errors.New("bad id")
+	}
+	changed := !s[id]
+	s[id] = true
+	return changed, nil
+}
+
+func (s sets) RemoveEnrollmentSet(_ context.Context, id, _ string) (bool, error) {
+	changed := s[id]
+	delete(s, id)
+	return changed, nil
+}
+
+type ider int
+
+func (i *ider) ID() string {
+	*i++
+	return fmt.Sprintf("JOB%d", *i)
+}
+
+type notifier struct{ calls [][]string }
+
+func (n *notifier) Changed(_ context.Context, _, _, ids []string) error {
+	n.calls = append(n.calls, ids)
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	members := sets{"ID2": true}
+	n := new(notifier)
+	b := New(NewKVStore(kvmap.New()), members, n, WithChunkSize(2), WithIDer(new(ider)))
+
+	if _, err := b.Start(ctx, "set1", "replace", []string{"ID1"}); !errors.Is(err, ErrInvalidOp) {
+		t.Errorf("have: %v, want: %v", err, ErrInvalidOp)
+	}
+
+	started, err := b.Start(ctx, "set1", OpAdd, []string{"ID1", "ID2", "bad", "ID3", "ID4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Wait()
+
+	j, err := b.Job(ctx, started.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != StatusCompleted || j.Processed != 5 || j.Changed != 3 || j.FailedCount != 1 || j.Failures[0].ID != "bad" {
+		t.Errorf("incorrect report: %+v", j)
+	}
+	// one notification per chunk with changes: [ID1] [ID3] [ID4]
+	if have, want := len(n.calls), 3; have != want {
+		t.Errorf("have: %d notifications, want: %d", have, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Package http provides the HTTP API for DM status trigger rules.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/statustrigger"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoName is returned when no rule name is provided.
+	ErrNoName = errors.New("no name provided")
+
+	// ErrNotFound is returned when a rule does not exist.
+	ErrNotFound = errors.New("rule not found")
+)
+
+// GetRulesHandler returns all rules.
+func GetRulesHandler(store statustrigger.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		rules, err := store.RetrieveRules(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving rules", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, rules, logger)
+	}
+}
+
+// GetRuleHandler returns the rule named in the URL path.
+func GetRuleHandler(store statustrigger.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		rule, err := store.RetrieveRule(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if rule == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, rule, logger)
+	}
+}
+
+// PutRuleHandler stores the JSON rule in the request body under the
+// name in the URL path.
+func PutRuleHandler(store statustrigger.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		rule := new(statustrigger.Rule)
+		if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding rule: %w", err), http.StatusBadRequest)
+			return
+		}
+		rule.Name = name
+		if err := rule.Validate(); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreRule(r.Context(), rule); err != nil {
+			logger.Info("msg", "storing rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored rule", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteRuleHandler deletes the rule named in the URL path.
+func DeleteRuleHandler(store statustrigger.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteRule(r.Context(), name); err != nil {
+			logger.Info("msg", "deleting rule", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted rule", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the status trigger API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store statustrigger.Store) {
+	mux.Handle(
+		prefix+"/statustriggers",
+		GetRulesHandler(store, logger.With("handler", "get-statustriggers")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/statustriggers/:name",
+		GetRuleHandler(store, logger.With("handler", "get-statustrigger")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/statustriggers/:name",
+		PutRuleHandler(store, logger.With("handler", "put-statustrigger")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/statustriggers/:name",
+		DeleteRuleHandler(store, logger.With("handler", "delete-statustrigger")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,130 @@
+package statustrigger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPrefixRule      = "rule."
+	keyPrefixTriggered = "triggered."
+	keyPrefixValue     = "value."
+)
+
+// KVStore stores rules, their trigger times, and the last reported
+// values of changed conditions in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new rule store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreRule stores r.
+func (s *KVStore) StoreRule(ctx context.Context, r *Rule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal rule: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixRule+r.Name, v)
+}
+
+// RetrieveRule retrieves the rule name.
+func (s *KVStore) RetrieveRule(ctx context.Context, name string) (*Rule, error) {
+	v, err := s.b.Get(ctx, keyPrefixRule+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Rule)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal rule: %w", err)
+	}
+	return r, nil
+}
+
+// RetrieveRules retrieves all rules.
+func (s *KVStore) RetrieveRules(ctx context.Context) ([]*Rule, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPrefixRule)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0, len(keys))
+	for _, k := range keys {
+		r, err := s.RetrieveRule(ctx, strings.TrimPrefix(k, keyPrefixRule))
+		if err != nil {
+			return rules, fmt.Errorf("retrieving rule %s: %w", k, err)
+		}
+		if r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// DeleteRule deletes the rule name, its trigger times, and its values.
+func (s *KVStore) DeleteRule(ctx context.Context, name string) error {
+	for _, prefix := range []string{keyPrefixTriggered, keyPrefixValue} {
+		keys, err := s.b.KeysPrefix(ctx, prefix+name+".")
+		if err != nil {
+			return fmt.Errorf("listing rule keys: %w", err)
+		}
+		for _, k := range keys {
+			if err = s.b.Delete(ctx, k); err != nil {
+				return fmt.Errorf("deleting rule key: %w", err)
+			}
+		}
+	}
+	return s.b.Delete(ctx, keyPrefixRule+name)
+}
+
+// StoreTriggered stores when rule name triggered for id.
+func (s *KVStore) StoreTriggered(ctx context.Context, name, id string, at time.Time) error {
+	v, err := at.MarshalText()
+	if err != nil {
+		return err
+	}
+	return s.b.Set(ctx, keyPrefixTriggered+name+"."+id, v)
+}
+
+// RetrieveTriggered retrieves when rule name last triggered for id.
+func (s *KVStore) RetrieveTriggered(ctx context.Context, name, id string) (time.Time, error) {
+	var at time.Time
+	v, err := s.b.Get(ctx, keyPrefixTriggered+name+"."+id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return at, nil
+	} else if err != nil {
+		return at, err
+	}
+	err = at.UnmarshalText(v)
+	return at, err
+}
+
+// StoreValue stores the value id last reported for rule name.
+func (s *KVStore) StoreValue(ctx context.Context, name, id string, value []byte) error {
+	return s.b.Set(ctx, keyPrefixValue+name+"."+id, value)
+}
+
+// RetrieveValue retrieves the value id last reported for rule name.
+func (s *KVStore) RetrieveValue(ctx context.Context, name, id string) ([]byte, error) {
+	v, err := s.b.Get(ctx, keyPrefixValue+name+"."+id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
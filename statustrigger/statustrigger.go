@@ -0,0 +1,538 @@
+// Package statustrigger enqueues MDM commands and starts workflows in
+// response to DM status reports. Rules match status item values reported
+// by enrollments (e.g. a non-compliant passcode), changed values (e.g. a
+// new OS version), or declaration errors. Matching rules enqueue their
+// commands to the reporting enrollment, start their workflow for it, and
+// send an event to notify any event actions.
+package statustrigger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+	"github.com/micromdm/plist"
+)
+
+// DefaultCooldown is the default minimum time between triggers of a
+// rule for an enrollment.
+const DefaultCooldown = time.Hour
+
+// Rule conditions.
+const (
+	// ConditionMatch matches the reported value of the status item
+	// path (the default).
+	ConditionMatch = "match"
+
+	// ConditionChanged matches when the reported value of the status
+	// item path differs from the value the enrollment last reported.
+	ConditionChanged = "changed"
+
+	// ConditionDeclarationError matches when the enrollment reports an
+	// invalid declaration or one with reasons (errors).
+	ConditionDeclarationError = "declaration-error"
+)
+
+var (
+	// ErrInvalidName is returned for empty rule names or names
+	// containing periods or slashes.
+	ErrInvalidName = errors.New("invalid rule name")
+
+	// ErrNoPath is returned for rules without a status item path.
+	ErrNoPath = errors.New("no status item path")
+
+	// ErrNoCommands is returned for rules without commands or workflow.
+	ErrNoCommands = errors.New("no commands or workflow")
+
+	// ErrNoStarter is returned when a workflow can't be started.
+	ErrNoStarter = errors.New("no workflow starter")
+)
+
+// Rule enqueues commands when a DM status item is reported.
+type Rule struct {
+	Name string `json:"name"`
+
+	// Condition is the condition of the rule. Empty is ConditionMatch.
+	Condition string `json:"condition,omitempty"`
+
+	// Path is the period-separated path of the status item below
+	// "StatusItems" (e.g. "passcode.is-compliant").
+	// It is not used by declaration error conditions.
+	Path string `json:"path,omitempty"`
+
+	// Value is the JSON value the status item must have.
+	// If empty any reported value matches. For declaration error
+	// conditions it is the JSON string of the declaration identifier.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Commands are the commands to enqueue as JSON objects of the
+	// command dictionary (e.g. {"RequestType": "DeviceInformation"}).
+	// A new CommandUUID is generated for each enqueueing.
+	Commands []map[string]interface{} `json:"commands,omitempty"`
+
+	// Workflow is the name of the NanoCMD workflow to start for the
+	// enrollment with the optional WorkflowContext.
+	Workflow        string `json:"workflow,omitempty"`
+	WorkflowContext string `json:"workflow_context,omitempty"`
+
+	// CooldownSeconds is the minimum time between triggers of the rule
+	// for an enrollment. Zero uses the default cooldown.
+	CooldownSeconds int `json:"cooldown_seconds,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// ValidName reports whether name is a valid rule name.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./")
+}
+
+// Validate checks r for errors.
+func (r *Rule) Validate() error {
+	if r == nil || !ValidName(r.Name) {
+		return ErrInvalidName
+	}
+	switch r.Condition {
+	case "", ConditionMatch, ConditionChanged:
+		if r.Path == "" {
+			return ErrNoPath
+		}
+	case ConditionDeclarationError:
+	default:
+		return fmt.Errorf("invalid condition: %s", r.Condition)
+	}
+	if len(r.Commands) < 1 && r.Workflow == "" {
+		return ErrNoCommands
+	}
+	for i, cmd := range r.Commands {
+		if rt, _ := cmd["RequestType"].(string); rt == "" {
+			return fmt.Errorf("command %d: no RequestType", i)
+		}
+	}
+	if len(r.Value) > 0 && !json.Valid(r.Value) {
+		return errors.New("invalid JSON value")
+	}
+	return nil
+}
+
+// cooldown returns the cooldown of r.
+func (r *Rule) cooldown() time.Duration {
+	if r.CooldownSeconds > 0 {
+		return time.Duration(r.CooldownSeconds) * time.Second
+	}
+	return DefaultCooldown
+}
+
+// Store stores rules and when they last triggered for enrollments.
+type Store interface {
+	StoreRule(ctx context.Context, r *Rule) error
+
+	// RetrieveRule retrieves the rule name.
+	// Nil is returned if the rule does not exist.
+	RetrieveRule(ctx context.Context, name string) (*Rule, error)
+
+	RetrieveRules(ctx context.Context) ([]*Rule, error)
+
+	// DeleteRule deletes the rule name and its trigger times.
+	DeleteRule(ctx context.Context, name string) error
+
+	StoreTriggered(ctx context.Context, name, id string, at time.Time) error
+
+	// RetrieveTriggered retrieves when rule name last triggered for id.
+	// The zero time is returned if it never triggered.
+	RetrieveTriggered(ctx context.Context, name, id string) (time.Time, error)
+
+	// StoreValue stores the value id last reported for rule name.
+	StoreValue(ctx context.Context, name, id string, value []byte) error
+
+	// RetrieveValue retrieves the value id last reported for rule name.
+	// Nil is returned if no value was stored.
+	RetrieveValue(ctx context.Context, name, id string) ([]byte, error)
+}
+
+// Enqueuer enqueues raw MDM commands and pushes the enrollments.
+type Enqueuer interface {
+	Enqueue(ctx context.Context, ids []string, rawCmd []byte) error
+}
+
+// EnqueuerFunc adapts a function to an Enqueuer.
+type EnqueuerFunc func(ctx context.Context, ids []string, rawCmd []byte) error
+
+// Enqueue calls f(ctx, ids, rawCmd).
+func (f EnqueuerFunc) Enqueue(ctx context.Context, ids []string, rawCmd []byte) error {
+	return f(ctx, ids, rawCmd)
+}
+
+// WorkflowStarter starts NanoCMD workflows.
+type WorkflowStarter interface {
+	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+}
+
+// WorkflowStarterFunc adapts a function to a WorkflowStarter.
+type WorkflowStarterFunc func(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+
+// StartWorkflow calls f(ctx, name, context, ids, e, mdmCtx).
+func (f WorkflowStarterFunc) StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error) {
+	return f(ctx, name, context, ids, e, mdmCtx)
+}
+
+// IDer generates unique command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Service triggers rules from DM status reports.
+// It is a NanoMDM service.
+type Service struct {
+	service.CheckinAndCommandService
+
+	store   Store
+	enq     Enqueuer
+	starter WorkflowStarter
+	sink    event.Sink
+	logger  log.Logger
+	clock   clock.Clock
+	ider    IDer
+}
+
+// Option configures the service.
+type Option func(*Service)
+
+// WithSink sends trigger events to sink.
+func WithSink(sink event.Sink) Option {
+	return func(s *Service) {
+		s.sink = sink
+	}
+}
+
+// WithWorkflowStarter starts the workflows of rules with starter.
+func WithWorkflowStarter(starter WorkflowStarter) Option {
+	if starter == nil {
+		panic("nil starter")
+	}
+	return func(s *Service) {
+		s.starter = starter
+	}
+}
+
+// WithLogger configures a logger for the service.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithClock configures the clock of the service.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(s *Service) {
+		s.clock = c
+	}
+}
+
+// WithIDer configures the generator of command UUIDs.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(s *Service) {
+		s.ider = ider
+	}
+}
+
+// New creates a new status trigger service enqueueing commands with enq.
+func New(store Store, enq Enqueuer, opts ...Option) *Service {
+	if store == nil {
+		panic("nil store")
+	}
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+	s := &Service{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		enq:                      enq,
+		logger:                   log.NopLogger,
+		clock:                    clock.Real,
+		ider:                     uuid.NewUUID(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// flatten adds the values of the JSON object o to values by their
+// period-separated paths below prefix. Arrays are not traversed.
+func flatten(values map[string]json.RawMessage, prefix string, o map[string]json.RawMessage) {
+	for k, v := range o {
+		path := prefix + k
+		var child map[string]json.RawMessage
+		if bytes.HasPrefix(bytes.TrimSpace(v), []byte("{")) && json.Unmarshal(v, &child) == nil {
+			flatten(values, path+".", child)
+			continue
+		}
+		values[path] = v
+	}
+}
+
+// equalJSON reports whether the JSON values a and b are equal.
+func equalJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ca, errA := json.Marshal(va)
+	cb, errB := json.Marshal(vb)
+	return errA == nil && errB == nil && bytes.Equal(ca, cb)
+}
+
+// declarationErrors returns the identifiers of the invalid declarations
+// and the declarations with reasons in the "management" status item.
+func declarationErrors(items map[string]json.RawMessage) []string {
+	var mgmt struct {
+		Declarations map[string][]struct {
+			Identifier string          `json:"identifier"`
+			Valid      string          `json:"valid"`
+			Reasons    json.RawMessage `json:"reasons"`
+		} `json:"declarations"`
+	}
+	if v, ok := items["management"]; !ok || json.Unmarshal(v, &mgmt) != nil {
+		return nil
+	}
+	var ids []string
+	for _, kind := range []string{"activations", "configurations", "assets", "management"} {
+		for _, d := range mgmt.Declarations[kind] {
+			reasons := bytes.TrimSpace(d.Reasons)
+			if d.Valid == "invalid" || (len(reasons) > 0 && !bytes.Equal(reasons, []byte("null")) && !bytes.Equal(reasons, []byte("[]"))) {
+				ids = append(ids, d.Identifier)
+			}
+		}
+	}
+	return ids
+}
+
+// match reports whether rule r matches the status report of id and
+// returns the matching value. Values are the flattened status items.
+func (s *Service) match(ctx context.Context, r *Rule, id string, values, items map[string]json.RawMessage) (json.RawMessage, bool, error) {
+	switch r.Condition {
+	case ConditionDeclarationError:
+		errIDs := declarationErrors(items)
+		if len(r.Value) > 0 {
+			var want string
+			if err := json.Unmarshal(r.Value, &want); err != nil {
+				return nil, false, fmt.Errorf("declaration identifier: %w", err)
+			}
+			for _, errID := range errIDs {
+				if errID == want {
+					return r.Value, true, nil
+				}
+			}
+			return nil, false, nil
+		}
+		if len(errIDs) < 1 {
+			return nil, false, nil
+		}
+		value, err := json.Marshal(errIDs)
+		return value, err == nil, err
+	case ConditionChanged:
+		value, ok := values[r.Path]
+		if !ok {
+			return nil, false, nil
+		}
+		prev, err := s.store.RetrieveValue(ctx, r.Name, id)
+		if err != nil {
+			return nil, false, fmt.Errorf("retrieving value: %w", err)
+		}
+		if prev != nil && equalJSON(prev, value) {
+			return nil, false, nil
+		}
+		if err = s.store.StoreValue(ctx, r.Name, id, value); err != nil {
+			return nil, false, fmt.Errorf("storing value: %w", err)
+		}
+		// the first reported value is not a change
+		if prev == nil || (len(r.Value) > 0 && !equalJSON(value, r.Value)) {
+			return nil, false, nil
+		}
+		return value, true, nil
+	}
+	value, ok := values[r.Path]
+	if !ok || (len(r.Value) > 0 && !equalJSON(value, r.Value)) {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// command is a raw MDM command.
+type command struct {
+	CommandUUID string
+	Command     map[string]interface{}
+}
+
+// numbers converts the JSON numbers in v to integers or floats.
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = numbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = numbers(e)
+		}
+	}
+	return v
+}
+
+// rawCommand marshals cmd with a new command UUID.
+func (s *Service) rawCommand(cmd map[string]interface{}) (string, []byte, error) {
+	// copy with integers as JSON decodes all numbers as floats
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return "", nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	c := &command{CommandUUID: s.ider.ID()}
+	if err = dec.Decode(&c.Command); err != nil {
+		return "", nil, err
+	}
+	numbers(c.Command)
+	raw, err := plist.Marshal(c)
+	return c.CommandUUID, raw, err
+}
+
+// trigger enqueues the commands and starts the workflow of rule r for id.
+func (s *Service) trigger(ctx context.Context, r *Rule, id string, value json.RawMessage) error {
+	last, err := s.store.RetrieveTriggered(ctx, r.Name, id)
+	if err != nil {
+		return fmt.Errorf("retrieving trigger time: %w", err)
+	}
+	now := s.clock.Now()
+	if !last.IsZero() && now.Sub(last) < r.cooldown() {
+		return nil
+	}
+	if err = s.store.StoreTriggered(ctx, r.Name, id, now); err != nil {
+		return fmt.Errorf("storing trigger time: %w", err)
+	}
+
+	var uuids []string
+	for _, cmd := range r.Commands {
+		uuid, raw, err := s.rawCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("marshal command: %w", err)
+		}
+		if err = s.enq.Enqueue(ctx, []string{id}, raw); err != nil {
+			return fmt.Errorf("enqueueing command: %w", err)
+		}
+		uuids = append(uuids, uuid)
+	}
+
+	var instanceID string
+	if r.Workflow != "" {
+		if s.starter == nil {
+			return ErrNoStarter
+		}
+		var wfCtx []byte
+		if r.WorkflowContext != "" {
+			wfCtx = []byte(r.WorkflowContext)
+		}
+		if instanceID, err = s.starter.StartWorkflow(ctx, r.Workflow, wfCtx, []string{id}, nil, nil); err != nil {
+			return fmt.Errorf("starting workflow: %w", err)
+		}
+	}
+
+	ctxlog.Logger(ctx, s.logger).Debug(
+		"msg", "rule triggered",
+		"rule", r.Name,
+		"id", id,
+		"count", len(uuids),
+		"instance_id", instanceID,
+	)
+
+	if s.sink != nil {
+		ev := event.New(s.clock, event.TypeStatusTriggered, id)
+		ev.Fields["rule"] = r.Name
+		ev.Fields["path"] = r.Path
+		ev.Fields["value"] = string(value)
+		ev.Fields["command_uuids"] = strings.Join(uuids, ",")
+		if instanceID != "" {
+			ev.Fields["workflow"] = r.Workflow
+			ev.Fields["instance_id"] = instanceID
+		}
+		if err = s.sink.Send(ctx, ev); err != nil {
+			ctxlog.Logger(ctx, s.logger).Info("msg", "sending event", "rule", r.Name, "err", err)
+		}
+	}
+	return nil
+}
+
+// DeclarativeManagement triggers the rules matching the status items
+// of DM status reports.
+func (s *Service) DeclarativeManagement(r *mdm.Request, m *mdm.DeclarativeManagement) ([]byte, error) {
+	if m.Endpoint != "status" || r.ID == "" {
+		return nil, nil
+	}
+	ctx := r.Context()
+	logger := ctxlog.Logger(ctx, s.logger)
+
+	rules, err := s.store.RetrieveRules(ctx)
+	if err != nil {
+		// do not fail the status report
+		logger.Info("msg", "retrieving rules", "err", err)
+		return nil, nil
+	}
+	if len(rules) < 1 {
+		return nil, nil
+	}
+
+	var report struct {
+		StatusItems map[string]json.RawMessage
+	}
+	if err = json.Unmarshal(m.Data, &report); err != nil || len(report.StatusItems) < 1 {
+		return nil, nil
+	}
+	values := make(map[string]json.RawMessage)
+	flatten(values, "", report.StatusItems)
+
+	for _, rule := range rules {
+		if rule.Disabled {
+			continue
+		}
+		value, ok, err := s.match(ctx, rule, r.ID, values, report.StatusItems)
+		if err != nil {
+			logger.Info("msg", "matching rule", "rule", rule.Name, "id", r.ID, "err", err)
+			continue
+		} else if !ok {
+			continue
+		}
+		if err = s.trigger(ctx, rule, r.ID, value); err != nil {
+			logger.Info("msg", "triggering rule", "rule", rule.Name, "id", r.ID, "err", err)
+		}
+	}
+	return nil, nil
+}
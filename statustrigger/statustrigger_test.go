@@ -0,0 +1,131 @@
+package statustrigger
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/event"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+func TestTrigger(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	err := store.StoreRule(ctx, &Rule{
+		Name:     "passcode",
+		Path:     "passcode.is-compliant",
+		Value:    json.RawMessage("false"),
+		Commands: []map[string]interface{}{{"RequestType": "DeviceInformation", "Queries": []interface{}{"UDID"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var enqueued int
+	var events []*event.Event
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	s := New(
+		store,
+		EnqueuerFunc(func(_ context.Context, ids []string, _ []byte) error {
+			enqueued += len(ids)
+			return nil
+		}),
+		WithClock(c),
+		WithSink(event.SinkFunc(func(_ context.Context, e *event.Event) error {
+			events = append(events, e)
+			return nil
+		})),
+	)
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	report := func(compliant string) {
+		t.Helper()
+		m := &mdm.DeclarativeManagement{
+			Endpoint: "status",
+			Data:     []byte(`{"StatusItems": {"passcode": {"is-compliant": ` + compliant + `, "is-present": true}}}`),
+		}
+		if _, err := s.DeclarativeManagement(r, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		compliant string
+		advance   time.Duration
+		enqueued  int
+	}{
+		{"true", 0, 0},
+		{"false", 0, 1},
+		{"false", time.Minute, 1}, // within cooldown
+		{"false", DefaultCooldown, 2},
+	} {
+		c.Advance(test.advance)
+		report(test.compliant)
+		if have, want := enqueued, test.enqueued; have != want {
+			t.Errorf("have: %d enqueued, want: %d", have, want)
+		}
+	}
+	if len(events) != 2 || events[0].Type != event.TypeStatusTriggered || events[0].Fields["rule"] != "passcode" {
+		t.Errorf("incorrect events: %v", events)
+	}
+}
+
+type starter []string
+
+func (s *starter) StartWorkflow(_ context.Context, name string, _ []byte, ids []string, _ *workflow.Event, _ *workflow.MDMContext) (string, error) {
+	*s = append(*s, name+":"+ids[0])
+	return "instance", nil
+}
+
+func TestWorkflowConditions(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	for _, rule := range []*Rule{
+		{Name: "os", Condition: ConditionChanged, Path: "device.operating-system.version", Workflow: "wf.os", CooldownSeconds: 1},
+		{Name: "decl", Condition: ConditionDeclarationError, Value: json.RawMessage(`"com.example.bad"`), Workflow: "wf.decl", CooldownSeconds: 1},
+	} {
+		if err := store.StoreRule(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	started := new(starter)
+	c := clock.NewFake(time.Unix(1700000000, 0))
+	s := New(store, EnqueuerFunc(func(context.Context, []string, []byte) error { return nil }), WithClock(c), WithWorkflowStarter(started))
+
+	r := mdm.NewRequestWithContext(ctx, nil)
+	r.EnrollID = &mdm.EnrollID{ID: "ID1"}
+	for _, test := range []struct {
+		version, valid string
+		started        int
+	}{
+		{"17.0", "valid", 0}, // first value is not a change
+		{"17.0", "invalid", 1},
+		{"17.1", "valid", 2},
+		{"17.1", "valid", 2},
+	} {
+		c.Advance(time.Minute)
+		m := &mdm.DeclarativeManagement{
+			Endpoint: "status",
+			Data: []byte(`{"StatusItems": {"device": {"operating-system": {"version": "` + test.version + `"}}, ` +
+				`"management": {"declarations": {"configurations": [{"identifier": "com.example.bad", "valid": "` + test.valid + `"}]}}}}`),
+		}
+		if _, err := s.DeclarativeManagement(r, m); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := len(*started), test.started; have != want {
+			t.Fatalf("%s/%s: have: %d started (%v), want: %d", test.version, test.valid, have, *started, want)
+		}
+	}
+	if want := []string{"wf.decl:ID1", "wf.os:ID1"}; !reflect.DeepEqual([]string(*started), want) {
+		t.Errorf("started: have: %v, want: %v", *started, want)
+	}
+}
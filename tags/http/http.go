@@ -0,0 +1,257 @@
+// Package http provides the HTTP API for enrollment tags.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/tags"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNoKey is returned when no tag key is provided.
+	ErrNoKey = errors.New("no tag key provided")
+)
+
+// Tag is the value of a tag.
+type Tag struct {
+	Value string `json:"value"`
+}
+
+// GetTagsHandler returns the tags of the enrollment ID in the URL path.
+func GetTagsHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		t, err := store.RetrieveTags(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving tags", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, t, logger)
+	}
+}
+
+// storeTags stores t for id and writes the response.
+func storeTags(w http.ResponseWriter, r *http.Request, store tags.Store, logger log.Logger, id string, t map[string]string) {
+	if err := store.StoreTags(r.Context(), id, t); errors.Is(err, tags.ErrInvalid) {
+		httpapi.JSONError(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		logger.Info("msg", "storing tags", "id", id, "err", err)
+		httpapi.JSONError(w, err, 0)
+		return
+	}
+
+	logger.Debug("msg", "stored tags", "id", id, "count", len(t))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PutTagsHandler replaces the tags of the enrollment ID in the URL path
+// with the JSON object of the request body.
+func PutTagsHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		var t map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding tags: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		storeTags(w, r, store, logger, id, t)
+	}
+}
+
+// DeleteTagsHandler removes all tags of the enrollment ID in the URL path.
+func DeleteTagsHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		storeTags(w, r, store, logger, id, nil)
+	}
+}
+
+// PutTagHandler sets the tag key in the URL path of the enrollment ID in
+// the URL path to the value in the JSON request body.
+// Other tags of the enrollment are kept.
+func PutTagHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		key := flow.Param(r.Context(), "key")
+		if key == "" {
+			httpapi.JSONError(w, ErrNoKey, http.StatusBadRequest)
+			return
+		}
+
+		tag := new(Tag)
+		if err := json.NewDecoder(r.Body).Decode(tag); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding tag: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		t, err := store.RetrieveTags(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving tags", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		t[key] = tag.Value
+
+		storeTags(w, r, store, logger, id, t)
+	}
+}
+
+// DeleteTagHandler removes the tag key in the URL path from the
+// enrollment ID in the URL path.
+func DeleteTagHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		id := flow.Param(r.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		key := flow.Param(r.Context(), "key")
+		if key == "" {
+			httpapi.JSONError(w, ErrNoKey, http.StatusBadRequest)
+			return
+		}
+
+		t, err := store.RetrieveTags(r.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving tags", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		delete(t, key)
+
+		storeTags(w, r, store, logger, id, t)
+	}
+}
+
+// GetEnrollmentsHandler returns the enrollment IDs tagged with the tag
+// key in the URL path and the optional "value" query parameter.
+func GetEnrollmentsHandler(store tags.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		key := flow.Param(r.Context(), "key")
+		if key == "" {
+			httpapi.JSONError(w, ErrNoKey, http.StatusBadRequest)
+			return
+		}
+
+		ids, err := store.RetrieveEnrollments(r.Context(), key, r.URL.Query().Get("value"))
+		if errors.Is(err, tags.ErrInvalid) {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving enrollments", "key", key, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, ids, logger)
+	}
+}
+
+// HandleAPIv1 registers the tag API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store tags.Store) {
+	mux.Handle(
+		prefix+"/enrollments/:id/tags",
+		GetTagsHandler(store, logger.With("handler", "get-tags")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/tags",
+		PutTagsHandler(store, logger.With("handler", "put-tags")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/tags",
+		DeleteTagsHandler(store, logger.With("handler", "delete-tags")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/tags/:key",
+		PutTagHandler(store, logger.With("handler", "put-tag")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/enrollments/:id/tags/:key",
+		DeleteTagHandler(store, logger.With("handler", "delete-tag")),
+		"DELETE",
+	)
+
+	mux.Handle(
+		prefix+"/tags/:key",
+		GetEnrollmentsHandler(store, logger.With("handler", "get-tag-enrollments")),
+		"GET",
+	)
+}
@@ -0,0 +1,110 @@
+package tags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPrefixID  = "id."
+	keyPrefixTag = "tag."
+)
+
+// KVStore stores enrollment tags in a key-value bucket.
+// An index of enrollments by tag key is kept for targeting.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new tag store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// RetrieveTags retrieves the tags of id.
+func (s *KVStore) RetrieveTags(ctx context.Context, id string) (map[string]string, error) {
+	tags := make(map[string]string)
+	v, err := s.b.Get(ctx, keyPrefixID+id)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return tags, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting tags: %w", err)
+	}
+	if err = json.Unmarshal(v, &tags); err != nil {
+		return nil, fmt.Errorf("unmarshal tags: %w", err)
+	}
+	return tags, nil
+}
+
+// StoreTags replaces the tags of id.
+func (s *KVStore) StoreTags(ctx context.Context, id string, tags map[string]string) error {
+	if id == "" {
+		return errors.New("empty id")
+	}
+	if err := Validate(tags); err != nil {
+		return err
+	}
+	prev, err := s.RetrieveTags(ctx, id)
+	if err != nil {
+		return err
+	}
+	for k := range prev {
+		if _, ok := tags[k]; !ok {
+			if err = s.b.Delete(ctx, keyPrefixTag+k+"."+id); err != nil {
+				return fmt.Errorf("deleting index: %w", err)
+			}
+		}
+	}
+	for k, v := range tags {
+		if prev[k] == v {
+			continue
+		}
+		if err = s.b.Set(ctx, keyPrefixTag+k+"."+id, []byte(v)); err != nil {
+			return fmt.Errorf("setting index: %w", err)
+		}
+	}
+	if len(tags) < 1 {
+		return s.b.Delete(ctx, keyPrefixID+id)
+	}
+	v, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("marshal tags: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixID+id, v)
+}
+
+// RetrieveEnrollments retrieves the enrollment IDs tagged with key and value.
+func (s *KVStore) RetrieveEnrollments(ctx context.Context, key, value string) ([]string, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("%w: key: %q", ErrInvalid, key)
+	}
+	prefix := keyPrefixTag + key + "."
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing enrollments: %w", err)
+	}
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if value != "" {
+			v, err := s.b.Get(ctx, k)
+			if errors.Is(err, kv.ErrKeyNotFound) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("getting index: %w", err)
+			}
+			if string(v) != value {
+				continue
+			}
+		}
+		ids = append(ids, strings.TrimPrefix(k, prefix))
+	}
+	return ids, nil
+}
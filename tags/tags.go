@@ -0,0 +1,70 @@
+// Package tags stores key/value tags of enrollments.
+//
+// Tags are free-form operator metadata (e.g. "department=finance") used
+// to target enrollments: they resolve "tag:key=value" identifiers to
+// enrollment IDs and are properties of dynamic set predicates.
+package tags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is returned for invalid tag keys or values.
+var ErrInvalid = errors.New("invalid tag")
+
+// Store stores enrollment tags.
+type Store interface {
+	// RetrieveTags retrieves the tags of id.
+	// An empty map is returned for enrollments without tags.
+	RetrieveTags(ctx context.Context, id string) (map[string]string, error)
+
+	// StoreTags replaces the tags of id. Empty tags remove all tags.
+	StoreTags(ctx context.Context, id string, tags map[string]string) error
+
+	// RetrieveEnrollments retrieves the sorted enrollment IDs tagged
+	// with key and value. Any value matches if value is empty.
+	RetrieveEnrollments(ctx context.Context, key, value string) ([]string, error)
+}
+
+// validKey reports whether key consists of letters, digits, dashes,
+// and underscores.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the keys of tags consist of letters, digits,
+// dashes, and underscores and that the values are not empty and
+// contain no commas (which separate targeted identifiers).
+func Validate(tags map[string]string) error {
+	for k, v := range tags {
+		if !validKey(k) {
+			return fmt.Errorf("%w: key: %q", ErrInvalid, k)
+		}
+		if v == "" || strings.Contains(v, ",") {
+			return fmt.Errorf("%w: value of %s: %q", ErrInvalid, k, v)
+		}
+	}
+	return nil
+}
+
+// ParseSelector parses the tag selector "key=value" or "key" (any value).
+func ParseSelector(s string) (key, value string, err error) {
+	key, value, _ = strings.Cut(s, "=")
+	if !validKey(key) {
+		return "", "", fmt.Errorf("%w: key: %q", ErrInvalid, key)
+	}
+	return key, value, nil
+}
@@ -0,0 +1,78 @@
+package tags
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+)
+
+func TestKVStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewKVStore(kvmap.New())
+
+	if err := s.StoreTags(ctx, "ID1", map[string]string{"dept": "finance", "floor": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreTags(ctx, "ID2", map[string]string{"dept": "sales"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreTags(ctx, "ID3", map[string]string{"dept-x": "finance"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		key, value string
+		want       []string
+	}{
+		{"dept", "finance", []string{"ID1"}},
+		{"dept", "", []string{"ID1", "ID2"}},
+		{"floor", "4", []string{}},
+	} {
+		ids, err := s.RetrieveEnrollments(ctx, test.key, test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s=%s: have %v, want %v", test.key, test.value, ids, test.want)
+		}
+	}
+
+	// replacing tags updates the index
+	if err := s.StoreTags(ctx, "ID1", map[string]string{"dept": "sales"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.RetrieveEnrollments(ctx, "dept", "sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ID1", "ID2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("have %v, want %v", ids, want)
+	}
+	if ids, _ = s.RetrieveEnrollments(ctx, "floor", ""); len(ids) != 0 {
+		t.Errorf("floor: have %v, want none", ids)
+	}
+
+	if err = s.StoreTags(ctx, "ID1", nil); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := s.RetrieveTags(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("tags: have %v, want none", tags)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"a.b": "c"},
+		{"a": ""},
+		{"a": "b,c"},
+	} {
+		if err = s.StoreTags(ctx, "ID1", invalid); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%v: have %v, want %v", invalid, err, ErrInvalid)
+		}
+	}
+}
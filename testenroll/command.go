@@ -0,0 +1,173 @@
+package testenroll
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+// Command statuses.
+const (
+	StatusAcknowledged = "Acknowledged"
+	StatusError        = "Error"
+	StatusNotNow       = "NotNow"
+)
+
+// Result is the response of a device to a command.
+type Result struct {
+	// Status is the command status. Acknowledged if empty.
+	Status string
+
+	// ErrorChain is included in Error responses.
+	ErrorChain []mdm.ErrorChain
+
+	// Fields are added to the response (e.g. "QueryResponses").
+	Fields map[string]interface{}
+
+	// After is called after the response is sent (but before the
+	// next command is processed) if not nil.
+	After func(ctx context.Context) error
+}
+
+// CommandHandler responds to cmd sent to d.
+// A nil result acknowledges the command.
+// An error is responded to the server as an Error status.
+type CommandHandler func(ctx context.Context, d *Device, cmd *mdm.Command) (*Result, error)
+
+// Command is a command processed by a device and its response status.
+type Command struct {
+	UUID        string
+	RequestType string
+	Status      string
+
+	// Raw is the raw command plist.
+	Raw []byte
+}
+
+// report returns the command report of r for the device.
+func (d *Device) report(uuid string, r *Result) ([]byte, error) {
+	report := make(map[string]interface{}, len(r.Fields)+4)
+	for k, v := range r.Fields {
+		report[k] = v
+	}
+	report["UDID"] = d.enrollment.GetEnrollment().UDID
+	report["Status"] = r.Status
+	if uuid != "" {
+		report["CommandUUID"] = uuid
+	}
+	if len(r.ErrorChain) > 0 {
+		report["ErrorChain"] = r.ErrorChain
+	}
+	return plist.Marshal(report)
+}
+
+// send sends the command report of r and returns the next command.
+// A nil command is returned if there are no more commands.
+func (d *Device) send(ctx context.Context, uuid string, r *Result) (*mdm.Command, error) {
+	report, err := d.report(uuid, r)
+	if err != nil {
+		return nil, fmt.Errorf("marshal report: %w", err)
+	}
+	resp, err := d.enrollment.DoReportAndFetch(ctx, bytes.NewReader(report))
+	if err != nil {
+		return nil, err
+	}
+	body, err := readResponse(resp)
+	if err != nil || len(body) < 1 {
+		return nil, err
+	}
+	return mdm.DecodeCommand(body)
+}
+
+// handle responds to cmd with the handler of its request type.
+func (d *Device) handle(ctx context.Context, cmd *mdm.Command) *Result {
+	h := d.handlers[cmd.Command.RequestType]
+	if h == nil {
+		return &Result{Status: StatusAcknowledged}
+	}
+	r, err := h(ctx, d, cmd)
+	if err != nil {
+		return &Result{
+			Status: StatusError,
+			ErrorChain: []mdm.ErrorChain{{
+				ErrorCode:            1,
+				ErrorDomain:          "testenroll",
+				LocalizedDescription: err.Error(),
+				USEnglishDescription: err.Error(),
+			}},
+		}
+	}
+	if r == nil {
+		r = new(Result)
+	}
+	if r.Status == "" {
+		r.Status = StatusAcknowledged
+	}
+	return r
+}
+
+// Poll sends an Idle report and responds to every command the server
+// sends until there are no more commands. It returns the processed
+// commands. Commands without a handler are acknowledged.
+func (d *Device) Poll(ctx context.Context) ([]*Command, error) {
+	var cmds []*Command
+	cmd, err := d.send(ctx, "", &Result{Status: "Idle"})
+	for err == nil && cmd != nil {
+		r := d.handle(ctx, cmd)
+		cmds = append(cmds, &Command{
+			UUID:        cmd.CommandUUID,
+			RequestType: cmd.Command.RequestType,
+			Status:      r.Status,
+			Raw:         cmd.Raw,
+		})
+		d.logger.Debug("msg", "responding to command", "command_uuid", cmd.CommandUUID, "request_type", cmd.Command.RequestType, "status", r.Status)
+		var next *mdm.Command
+		if next, err = d.send(ctx, cmd.CommandUUID, r); err != nil {
+			break
+		}
+		if r.After != nil {
+			if err = r.After(ctx); err != nil {
+				err = fmt.Errorf("after %s response: %w", cmd.Command.RequestType, err)
+				break
+			}
+		}
+		cmd = next
+	}
+	return cmds, err
+}
+
+// DeviceInformationHandler responds to DeviceInformation commands with
+// the device identifiers and default device details. Any values
+// replace or add to the query responses.
+func DeviceInformationHandler(values map[string]interface{}) CommandHandler {
+	return func(_ context.Context, d *Device, _ *mdm.Command) (*Result, error) {
+		qr := map[string]interface{}{
+			"UDID":         d.ID(),
+			"SerialNumber": d.SerialNumber(),
+			"DeviceName":   "testenroll-" + d.SerialNumber(),
+			"Model":        "Mac14,3",
+			"ModelName":    "Mac mini",
+			"ProductName":  "Mac14,3",
+			"OSVersion":    "15.0",
+			"BuildVersion": "24A335",
+		}
+		for k, v := range values {
+			qr[k] = v
+		}
+		return &Result{Fields: map[string]interface{}{"QueryResponses": qr}}, nil
+	}
+}
+
+// DeclarativeManagementHandler acknowledges DeclarativeManagement
+// commands and then synchronizes Declarative Management.
+func DeclarativeManagementHandler() CommandHandler {
+	return func(_ context.Context, d *Device, _ *mdm.Command) (*Result, error) {
+		return &Result{After: func(ctx context.Context) error {
+			_, err := d.DMSync(ctx)
+			return err
+		}}, nil
+	}
+}
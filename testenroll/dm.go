@@ -0,0 +1,186 @@
+package testenroll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+// DMSync is the result of a Declarative Management synchronization.
+type DMSync struct {
+	// DeclarationsToken is the synchronization token of the server.
+	DeclarationsToken string
+
+	// Changed is true if the token changed since the last synchronization.
+	// Unchanged declarations are not synchronized.
+	Changed bool
+
+	// Fetched are the identifiers of the new or changed declarations.
+	Fetched []string
+
+	// Removed are the identifiers of the declarations no longer assigned.
+	Removed []string
+}
+
+// dm sends a DeclarativeManagement check-in to endpoint with data and
+// decodes the JSON response into v (if not nil).
+func (d *Device) dm(ctx context.Context, endpoint string, data []byte, v interface{}) error {
+	body, err := d.checkIn(ctx, &mdm.DeclarativeManagement{
+		Enrollment:  *d.enrollment.GetEnrollment(),
+		MessageType: mdm.MessageType{MessageType: "DeclarativeManagement"},
+		Endpoint:    endpoint,
+		Data:        data,
+	})
+	if err != nil {
+		return fmt.Errorf("DM %s: %w", endpoint, err)
+	}
+	if v == nil {
+		return nil
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("DM %s: unmarshal: %w", endpoint, err)
+	}
+	return nil
+}
+
+// manifestItems returns the manifest declarations of items keyed by
+// their declaration endpoint manifest type.
+func manifestItems(items *ddm.ManifestDeclarationItems) map[string][]ddm.ManifestDeclaration {
+	return map[string][]ddm.ManifestDeclaration{
+		"activation":    items.Activations,
+		"asset":         items.Assets,
+		"configuration": items.Configurations,
+		"management":    items.Management,
+	}
+}
+
+// DMSync synchronizes Declarative Management like a device does when
+// it is sent a DeclarativeManagement command. If the server tokens
+// changed the declaration items are retrieved, new and changed
+// declarations are fetched, and a status report is sent.
+func (d *Device) DMSync(ctx context.Context) (*DMSync, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tokens := new(ddm.TokensResponse)
+	if err := d.dm(ctx, "tokens", nil, tokens); err != nil {
+		return nil, err
+	}
+	sync := &DMSync{DeclarationsToken: tokens.SyncTokens.DeclarationsToken}
+	if sync.DeclarationsToken == d.token {
+		return sync, nil
+	}
+	sync.Changed = true
+
+	items := new(ddm.DeclarationItems)
+	if err := d.dm(ctx, "declaration-items", nil, items); err != nil {
+		return nil, err
+	}
+	assigned := make(map[string]struct{})
+	for manifestType, decls := range manifestItems(&items.Declarations) {
+		for _, md := range decls {
+			assigned[md.Identifier] = struct{}{}
+			if cur := d.declarations[md.Identifier]; cur != nil && cur.ServerToken == md.ServerToken {
+				continue
+			}
+			decl := new(ddm.Declaration)
+			if err := d.dm(ctx, "declaration/"+manifestType+"/"+md.Identifier, nil, decl); err != nil {
+				return nil, err
+			}
+			d.declarations[md.Identifier] = decl
+			sync.Fetched = append(sync.Fetched, md.Identifier)
+		}
+	}
+	for id := range d.declarations {
+		if _, ok := assigned[id]; !ok {
+			delete(d.declarations, id)
+			sync.Removed = append(sync.Removed, id)
+		}
+	}
+	sort.Strings(sync.Fetched)
+	sort.Strings(sync.Removed)
+
+	if err := d.sendDMStatus(ctx); err != nil {
+		return nil, err
+	}
+	d.token = sync.DeclarationsToken
+	d.logger.Debug("msg", "synchronized DM", "fetched", len(sync.Fetched), "removed", len(sync.Removed))
+	return sync, nil
+}
+
+// Declarations returns the synchronized declarations ordered by identifier.
+func (d *Device) Declarations() []*ddm.Declaration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := make([]*ddm.Declaration, 0, len(d.declarations))
+	for _, decl := range d.declarations {
+		ret = append(ret, decl)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Identifier < ret[j].Identifier })
+	return ret
+}
+
+// SendDMStatus sends a DM status report of the synchronized declarations.
+func (d *Device) SendDMStatus(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sendDMStatus(ctx)
+}
+
+// sendDMStatus sends a DM status report of the synchronized declarations.
+// All declarations are reported as active and valid.
+func (d *Device) sendDMStatus(ctx context.Context) error {
+	declarations := map[string][]ddm.DeclarationStatus{
+		"activations":    {},
+		"assets":         {},
+		"configurations": {},
+		"management":     {},
+	}
+	for _, decl := range d.declarations {
+		key := ddm.ManifestType(decl.Type)
+		if key != "management" {
+			key += "s"
+		}
+		if _, ok := declarations[key]; !ok {
+			continue
+		}
+		declarations[key] = append(declarations[key], ddm.DeclarationStatus{
+			Identifier:  decl.Identifier,
+			Active:      true,
+			Valid:       "valid",
+			ServerToken: decl.ServerToken,
+		})
+	}
+	for _, s := range declarations {
+		sort.Slice(s, func(i, j int) bool { return s[i].Identifier < s[j].Identifier })
+	}
+
+	items := map[string]interface{}{
+		"device": map[string]interface{}{
+			"identifier": map[string]interface{}{
+				"udid":          d.ID(),
+				"serial-number": d.SerialNumber(),
+			},
+		},
+		"management": map[string]interface{}{
+			"declarations": declarations,
+		},
+	}
+	if d.statusFn != nil {
+		for k, v := range d.statusFn() {
+			items[k] = v
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"StatusItems": items,
+		"Errors":      []interface{}{},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal status report: %w", err)
+	}
+	return d.dm(ctx, "status", data, nil)
+}
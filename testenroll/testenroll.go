@@ -0,0 +1,202 @@
+// Package testenroll simulates MDM device enrollments against a NanoHUB
+// (or any MDM) server. Simulated devices can enroll, poll for and
+// respond to commands, synchronize Declarative Management, and check
+// out. It builds on the NanoMDM test enrollment and can be used for
+// end-to-end tests and load testing of NanoHUB deployments.
+package testenroll
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/jessepeterson/kmfddm/ddm"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/test/enrollment"
+	"github.com/micromdm/nanomdm/test/protocol"
+	"github.com/micromdm/plist"
+)
+
+// DefaultTopic is the default APNs topic of simulated devices.
+const DefaultTopic = "com.apple.mgmt.External.testenroll"
+
+// Device is a simulated MDM device enrollment.
+type Device struct {
+	enrollment *enrollment.Enrollment
+	transport  *protocol.Transport
+
+	topic      string
+	checkInURL string
+	doer       protocol.Doer
+	logger     log.Logger
+	handlers   map[string]CommandHandler
+	statusFn   func() map[string]interface{}
+
+	mu           sync.Mutex
+	declarations map[string]*ddm.Declaration
+	token        string
+}
+
+// Option configures a device.
+type Option func(*Device)
+
+// WithTopic configures the APNs topic of the device.
+func WithTopic(topic string) Option {
+	return func(d *Device) {
+		d.topic = topic
+	}
+}
+
+// WithCheckInURL configures a separate check-in URL.
+func WithCheckInURL(url string) Option {
+	return func(d *Device) {
+		d.checkInURL = url
+	}
+}
+
+// WithClient configures the HTTP client of the device.
+// The default is [http.DefaultClient].
+// For example an [httptest.Server] client can be used.
+func WithClient(doer protocol.Doer) Option {
+	if doer == nil {
+		panic("nil client")
+	}
+	return func(d *Device) {
+		d.doer = doer
+	}
+}
+
+// WithLogger configures a logger for the device.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(d *Device) {
+		d.logger = logger
+	}
+}
+
+// WithCommandHandler configures h to respond to commands of requestType.
+// It replaces any built-in handler.
+func WithCommandHandler(requestType string, h CommandHandler) Option {
+	if h == nil {
+		panic("nil handler")
+	}
+	return func(d *Device) {
+		d.handlers[requestType] = h
+	}
+}
+
+// WithStatusItems configures fn to supply additional DM status items.
+// The returned items are merged into the "StatusItems" of status reports.
+func WithStatusItems(fn func() map[string]interface{}) Option {
+	return func(d *Device) {
+		d.statusFn = fn
+	}
+}
+
+// New creates a new randomly identified simulated device.
+// The serverURL is the MDM server URL (e.g. "https://nanohub.example.com/mdm").
+// Devices sign their messages with a self-signed certificate: the
+// server must accept it (e.g. with the Mdm-Signature header and a
+// certificate verifier that trusts any certificate).
+func New(serverURL string, opts ...Option) (*Device, error) {
+	d := &Device{
+		topic:        DefaultTopic,
+		doer:         http.DefaultClient,
+		logger:       log.NopLogger,
+		handlers:     make(map[string]CommandHandler),
+		declarations: make(map[string]*ddm.Declaration),
+	}
+	d.handlers["DeviceInformation"] = DeviceInformationHandler(nil)
+	d.handlers["DeclarativeManagement"] = DeclarativeManagementHandler()
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	var err error
+	d.enrollment, err = enrollment.NewRandomDeviceEnrollment(d.doer, d.topic, serverURL, d.checkInURL)
+	if err != nil {
+		return nil, fmt.Errorf("creating enrollment: %w", err)
+	}
+	d.transport = protocol.NewTransport(
+		protocol.WithSignMessage(),
+		protocol.WithIdentityProvider(d.enrollment.GetIdentity),
+		protocol.WithMDMURLs(serverURL, d.checkInURL),
+		protocol.WithClient(d.doer),
+	)
+	d.logger = d.logger.With("id", d.ID())
+	return d, nil
+}
+
+// ID returns the enrollment ID of the device.
+func (d *Device) ID() string {
+	return d.enrollment.ID()
+}
+
+// SerialNumber returns the serial number of the device.
+func (d *Device) SerialNumber() string {
+	return d.enrollment.SerialNumber()
+}
+
+// Enrollment returns the underlying NanoMDM test enrollment.
+func (d *Device) Enrollment() *enrollment.Enrollment {
+	return d.enrollment
+}
+
+// Enroll sends the Authenticate and TokenUpdate check-ins.
+func (d *Device) Enroll(ctx context.Context) error {
+	if err := d.enrollment.DoEnroll(ctx); err != nil {
+		return err
+	}
+	d.logger.Debug("msg", "enrolled")
+	return nil
+}
+
+// TokenUpdate sends a TokenUpdate check-in with a new push token.
+func (d *Device) TokenUpdate(ctx context.Context) error {
+	return d.enrollment.DoTokenUpdate(ctx)
+}
+
+// CheckOut sends a CheckOut check-in.
+func (d *Device) CheckOut(ctx context.Context) error {
+	_, err := d.checkIn(ctx, &mdm.CheckOut{
+		Enrollment:  *d.enrollment.GetEnrollment(),
+		MessageType: mdm.MessageType{MessageType: "CheckOut"},
+	})
+	if err == nil {
+		d.logger.Debug("msg", "checked out")
+	}
+	return err
+}
+
+// checkIn sends the check-in msg and returns the response body.
+func (d *Device) checkIn(ctx context.Context, msg interface{}) ([]byte, error) {
+	b, err := plist.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal check-in: %w", err)
+	}
+	resp, err := d.transport.DoCheckIn(ctx, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(resp)
+}
+
+// readResponse reads and closes the body of resp.
+// An error is returned for non-200 status codes.
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, enrollment.NewHTTPError(resp, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,153 @@
+package testenroll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/plist"
+)
+
+// server is a minimal fake MDM server.
+type server struct {
+	t        *testing.T
+	checkins []string
+	commands []string
+	results  []*mdm.CommandResults
+	statuses [][]byte
+}
+
+func (s *server) command(uuid, requestType string) []byte {
+	b, err := plist.Marshal(map[string]interface{}{
+		"CommandUUID": uuid,
+		"Command":     map[string]interface{}{"RequestType": requestType},
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return b
+}
+
+func (s *server) dm(w http.ResponseWriter, m *mdm.DeclarativeManagement) {
+	switch {
+	case m.Endpoint == "tokens":
+		fmt.Fprint(w, `{"SyncTokens":{"DeclarationsToken":"tok1","Timestamp":"2024-01-01T00:00:00Z"}}`)
+	case m.Endpoint == "declaration-items":
+		fmt.Fprint(w, `{"Declarations":{"Activations":[{"Identifier":"act","ServerToken":"a1"}],"Configurations":[{"Identifier":"cfg","ServerToken":"c1"}]},"DeclarationsToken":"tok1"}`)
+	case strings.HasPrefix(m.Endpoint, "declaration/"):
+		parts := strings.Split(m.Endpoint, "/")
+		fmt.Fprintf(w, `{"Identifier":%q,"Type":"com.apple.%s.test","Payload":{},"ServerToken":"x"}`, parts[2], parts[1])
+	case m.Endpoint == "status":
+		s.statuses = append(s.statuses, m.Data)
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("Content-Type") == "application/x-apple-aspen-mdm-checkin" {
+		msg, err := mdm.DecodeCheckin(body)
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+		switch m := msg.(type) {
+		case *mdm.Authenticate:
+			s.checkins = append(s.checkins, "Authenticate")
+		case *mdm.TokenUpdate:
+			s.checkins = append(s.checkins, "TokenUpdate")
+		case *mdm.CheckOut:
+			s.checkins = append(s.checkins, "CheckOut")
+		case *mdm.DeclarativeManagement:
+			s.checkins = append(s.checkins, "DeclarativeManagement:"+m.Endpoint)
+			s.dm(w, m)
+		}
+		return
+	}
+	results, err := mdm.DecodeCommandResults(body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	if results.Status != "Idle" {
+		s.results = append(s.results, results)
+	}
+	if len(s.commands) > 0 {
+		requestType := s.commands[0]
+		s.commands = s.commands[1:]
+		w.Write(s.command("UUID-"+requestType, requestType))
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s := &server{t: t, commands: []string{"DeviceInformation", "DeclarativeManagement", "Unknown"}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	d, err := New(srv.URL, WithClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Enroll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cmds, err := d.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(cmds), 3; have != want {
+		t.Fatalf("commands: have: %v, want: %v", have, want)
+	}
+	if have, want := len(s.results), 3; have != want {
+		t.Fatalf("results: have: %v, want: %v", have, want)
+	}
+	if have, want := s.results[0].Status, StatusAcknowledged; have != want {
+		t.Errorf("status: have: %v, want: %v", have, want)
+	}
+
+	decls := d.Declarations()
+	if len(decls) != 2 || decls[0].Identifier != "act" || decls[1].Identifier != "cfg" {
+		t.Errorf("incorrect declarations: %v", decls)
+	}
+	if len(s.statuses) != 1 {
+		t.Fatalf("status reports: have: %v, want: 1", len(s.statuses))
+	}
+	var status struct {
+		StatusItems struct {
+			Management struct {
+				Declarations map[string][]struct {
+					Identifier string `json:"identifier"`
+				} `json:"declarations"`
+			} `json:"management"`
+		}
+	}
+	if err = json.Unmarshal(s.statuses[0], &status); err != nil {
+		t.Fatal(err)
+	}
+	if have := status.StatusItems.Management.Declarations["configurations"]; len(have) != 1 || have[0].Identifier != "cfg" {
+		t.Errorf("incorrect status configurations: %v", have)
+	}
+
+	// unchanged tokens do not synchronize again
+	sync, err := d.DMSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync.Changed || len(s.statuses) != 1 {
+		t.Errorf("synchronized unchanged tokens: %v", sync)
+	}
+
+	if err = d.CheckOut(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := s.checkins[len(s.checkins)-1], "CheckOut"; have != want {
+		t.Errorf("check-in: have: %v, want: %v", have, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Package http provides the HTTP API for workflow chains.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/wfchain"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoName is returned when no chain name is provided.
+	ErrNoName = errors.New("no name provided")
+
+	// ErrNotFound is returned when a chain does not exist.
+	ErrNotFound = errors.New("chain not found")
+)
+
+// GetChainsHandler returns all chains.
+func GetChainsHandler(store wfchain.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		chains, err := store.RetrieveChains(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving chains", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, chains, logger)
+	}
+}
+
+// GetChainHandler returns the chain named in the URL path.
+func GetChainHandler(store wfchain.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		chain, err := store.RetrieveChain(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving chain", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if chain == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, chain, logger)
+	}
+}
+
+// PutChainHandler stores the JSON chain in the request body under the
+// name in the URL path.
+func PutChainHandler(store wfchain.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		chain := new(wfchain.Chain)
+		if err := json.NewDecoder(r.Body).Decode(chain); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding chain: %w", err), http.StatusBadRequest)
+			return
+		}
+		chain.Name = name
+		if err := chain.Validate(); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StoreChain(r.Context(), chain); err != nil {
+			logger.Info("msg", "storing chain", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored chain", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteChainHandler deletes the chain named in the URL path.
+func DeleteChainHandler(store wfchain.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeleteChain(r.Context(), name); err != nil {
+			logger.Info("msg", "deleting chain", "name", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted chain", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the workflow chain API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store wfchain.Store) {
+	mux.Handle(
+		prefix+"/workflowchains",
+		GetChainsHandler(store, logger.With("handler", "get-workflow-chains")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/workflowchains/:name",
+		GetChainHandler(store, logger.With("handler", "get-workflow-chain")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/workflowchains/:name",
+		PutChainHandler(store, logger.With("handler", "put-workflow-chain")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/workflowchains/:name",
+		DeleteChainHandler(store, logger.With("handler", "delete-workflow-chain")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,77 @@
+package wfchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const keyPrefixChain = "chain."
+
+// KVStore stores chains in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new chain store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StoreChain stores c.
+func (s *KVStore) StoreChain(ctx context.Context, c *Chain) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	v, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal chain: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixChain+c.Name, v)
+}
+
+// RetrieveChain retrieves the chain name.
+func (s *KVStore) RetrieveChain(ctx context.Context, name string) (*Chain, error) {
+	v, err := s.b.Get(ctx, keyPrefixChain+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := new(Chain)
+	if err = json.Unmarshal(v, c); err != nil {
+		return nil, fmt.Errorf("unmarshal chain: %w", err)
+	}
+	return c, nil
+}
+
+// RetrieveChains retrieves all chains.
+func (s *KVStore) RetrieveChains(ctx context.Context) ([]*Chain, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPrefixChain)
+	if err != nil {
+		return nil, err
+	}
+	chains := make([]*Chain, 0, len(keys))
+	for _, k := range keys {
+		c, err := s.RetrieveChain(ctx, strings.TrimPrefix(k, keyPrefixChain))
+		if err != nil {
+			return chains, fmt.Errorf("retrieving chain %s: %w", k, err)
+		}
+		if c != nil {
+			chains = append(chains, c)
+		}
+	}
+	return chains, nil
+}
+
+// DeleteChain deletes the chain name.
+func (s *KVStore) DeleteChain(ctx context.Context, name string) error {
+	return s.b.Delete(ctx, keyPrefixChain+name)
+}
@@ -0,0 +1,222 @@
+// Package wfchain chains NanoCMD workflows.
+//
+// A chain starts its next workflow for an enrollment when a workflow
+// completes for the enrollment, optionally only if it succeeded.
+// Workflows are wrapped to observe their completed and timed out steps:
+// a workflow has completed for an enrollment when it has no outstanding
+// steps for the enrollment after handling a step.
+package wfchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrInvalidName is returned for empty chain names or names
+	// containing periods or slashes.
+	ErrInvalidName = errors.New("invalid chain name")
+
+	// ErrInvalid is returned for invalid chains.
+	ErrInvalid = errors.New("invalid chain")
+)
+
+// Chain starts the Next workflow when Workflow completes.
+type Chain struct {
+	Name string `json:"name"`
+
+	// Workflow is the name of the workflow whose completion starts Next.
+	Workflow string `json:"workflow"`
+
+	// Next is the name of the workflow to start for the same enrollment.
+	Next string `json:"next"`
+
+	// NextContext is the optional workflow context of Next.
+	NextContext string `json:"next_context,omitempty"`
+
+	// OnSuccess only starts Next if Workflow succeeded: its steps
+	// didn't time out and all its last commands were acknowledged.
+	OnSuccess bool `json:"on_success,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// ValidName reports whether name is a valid chain name.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./")
+}
+
+// Validate checks c for errors.
+func (c *Chain) Validate() error {
+	switch {
+	case c == nil || !ValidName(c.Name):
+		return ErrInvalidName
+	case c.Workflow == "" || c.Next == "":
+		return fmt.Errorf("%w: no workflow or next workflow", ErrInvalid)
+	case c.Workflow == c.Next:
+		return fmt.Errorf("%w: workflow chained to itself", ErrInvalid)
+	}
+	return nil
+}
+
+// Store stores chains.
+type Store interface {
+	StoreChain(ctx context.Context, c *Chain) error
+
+	// RetrieveChain retrieves the chain name.
+	// Nil is returned if the chain does not exist.
+	RetrieveChain(ctx context.Context, name string) (*Chain, error)
+
+	RetrieveChains(ctx context.Context) ([]*Chain, error)
+	DeleteChain(ctx context.Context, name string) error
+}
+
+// WorkflowStarter starts NanoCMD workflows.
+type WorkflowStarter interface {
+	StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+}
+
+// WorkflowStarterFunc adapts a function to a WorkflowStarter.
+type WorkflowStarterFunc func(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error)
+
+// StartWorkflow calls f(ctx, name, context, ids, e, mdmCtx).
+func (f WorkflowStarterFunc) StartWorkflow(ctx context.Context, name string, context []byte, ids []string, e *workflow.Event, mdmCtx *workflow.MDMContext) (string, error) {
+	return f(ctx, name, context, ids, e, mdmCtx)
+}
+
+// StatusRetriever retrieves the enrollments with outstanding workflow steps.
+type StatusRetriever interface {
+	RetrieveOutstandingWorkflowStatus(ctx context.Context, workflowName string, ids []string) (outstandingIDs []string, err error)
+}
+
+// Chainer starts the next workflows of chains.
+type Chainer struct {
+	store   Store
+	starter WorkflowStarter
+	status  StatusRetriever
+	logger  log.Logger
+}
+
+// Option configures the chainer.
+type Option func(*Chainer)
+
+// WithLogger configures a logger for the chainer.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(c *Chainer) {
+		c.logger = logger
+	}
+}
+
+// New creates a new chainer.
+// Status retrieves the outstanding steps of the workflow engine storage.
+func New(store Store, starter WorkflowStarter, status StatusRetriever, opts ...Option) *Chainer {
+	if store == nil {
+		panic("nil store")
+	}
+	if starter == nil {
+		panic("nil starter")
+	}
+	if status == nil {
+		panic("nil status retriever")
+	}
+	c := &Chainer{
+		store:   store,
+		starter: starter,
+		status:  status,
+		logger:  log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// acknowledged reports whether all command results were acknowledged.
+func acknowledged(results []interface{}) bool {
+	for _, r := range results {
+		genResper, ok := r.(mdmcommands.GenericResponser)
+		if !ok || genResper.GetGenericResponse().Status != "Acknowledged" {
+			return false
+		}
+	}
+	return true
+}
+
+// stepDone starts the next workflows of the chains of workflow name if
+// the workflow has completed for the enrollment of the step result.
+func (c *Chainer) stepDone(ctx context.Context, name string, stepResult *workflow.StepResult, success bool) {
+	logger := ctxlog.Logger(ctx, c.logger).With("workflow", name, "id", stepResult.ID)
+	chains, err := c.store.RetrieveChains(ctx)
+	if err != nil {
+		logger.Info("msg", "retrieving chains", "err", err)
+		return
+	}
+	var matching []*Chain
+	for _, chain := range chains {
+		if !chain.Disabled && chain.Workflow == name && (success || !chain.OnSuccess) {
+			matching = append(matching, chain)
+		}
+	}
+	if len(matching) < 1 {
+		return
+	}
+
+	outstanding, err := c.status.RetrieveOutstandingWorkflowStatus(ctx, name, []string{stepResult.ID})
+	if err != nil {
+		logger.Info("msg", "retrieving workflow status", "err", err)
+		return
+	} else if len(outstanding) > 0 {
+		// the workflow continues with another step
+		return
+	}
+
+	for _, chain := range matching {
+		var wfCtx []byte
+		if chain.NextContext != "" {
+			wfCtx = []byte(chain.NextContext)
+		}
+		instanceID, err := c.starter.StartWorkflow(ctx, chain.Next, wfCtx, []string{stepResult.ID}, nil, nil)
+		if err != nil {
+			logger.Info("msg", "starting chained workflow", "chain", chain.Name, "next", chain.Next, "err", err)
+			continue
+		}
+		logger.Debug("msg", "started chained workflow", "chain", chain.Name, "next", chain.Next, "instance_id", instanceID, "success", success)
+	}
+}
+
+// Wrap wraps w to start the next workflows of chains when w completes.
+func (c *Chainer) Wrap(w workflow.Workflow) workflow.Workflow {
+	return &chainedWorkflow{Workflow: w, c: c}
+}
+
+// chainedWorkflow starts the chains of the wrapped workflow.
+type chainedWorkflow struct {
+	workflow.Workflow
+	c *Chainer
+}
+
+// StepCompleted hands the step result to the wrapped workflow and then
+// starts any chains if the workflow completed.
+func (w *chainedWorkflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	err := w.Workflow.StepCompleted(ctx, stepResult)
+	w.c.stepDone(ctx, w.Name(), stepResult, err == nil && acknowledged(stepResult.CommandResults))
+	return err
+}
+
+// StepTimeout hands the step result to the wrapped workflow and then
+// starts any chains not only on success if the workflow completed.
+func (w *chainedWorkflow) StepTimeout(ctx context.Context, stepResult *workflow.StepResult) error {
+	err := w.Workflow.StepTimeout(ctx, stepResult)
+	w.c.stepDone(ctx, w.Name(), stepResult, false)
+	return err
+}
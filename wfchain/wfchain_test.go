@@ -0,0 +1,90 @@
+package wfchain
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+type testWorkflow struct {
+	workflow.Workflow
+	name string
+}
+
+func (w *testWorkflow) Name() string { return w.name }
+
+func (w *testWorkflow) StepCompleted(context.Context, *workflow.StepResult) error { return nil }
+
+func (w *testWorkflow) StepTimeout(context.Context, *workflow.StepResult) error { return nil }
+
+type outstanding map[string]bool
+
+func (o outstanding) RetrieveOutstandingWorkflowStatus(_ context.Context, _ string, ids []string) ([]string, error) {
+	var r []string
+	for _, id := range ids {
+		if o[id] {
+			r = append(r, id)
+		}
+	}
+	return r, nil
+}
+
+func TestChainer(t *testing.T) {
+	ctx := context.Background()
+	store := NewKVStore(kvmap.New())
+	for _, c := range []*Chain{
+		{Name: "always", Workflow: "a", Next: "b", NextContext: "ctx"},
+		{Name: "success", Workflow: "a", Next: "c", OnSuccess: true},
+		{Name: "disabled", Workflow: "a", Next: "d", Disabled: true},
+		{Name: "other", Workflow: "b", Next: "c"},
+	} {
+		if err := store.StoreChain(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.StoreChain(ctx, &Chain{Name: "self", Workflow: "a", Next: "a"}); err == nil {
+		t.Error("expected error chaining a workflow to itself")
+	}
+
+	var started []string
+	starter := WorkflowStarterFunc(func(_ context.Context, name string, context []byte, ids []string, _ *workflow.Event, _ *workflow.MDMContext) (string, error) {
+		started = append(started, name+":"+string(context)+":"+ids[0])
+		return "instance", nil
+	})
+	status := outstanding{"ID2": true}
+	w := New(store, starter, status).Wrap(&testWorkflow{name: "a"})
+
+	ack := []interface{}{&mdmcommands.InstallProfileResponse{GenericResponse: mdmcommands.GenericResponse{Status: "Acknowledged"}}}
+	errored := []interface{}{&mdmcommands.InstallProfileResponse{GenericResponse: mdmcommands.GenericResponse{Status: "Error"}}}
+
+	for _, test := range []struct {
+		name    string
+		result  *workflow.StepResult
+		timeout bool
+		want    []string
+	}{
+		{"success", &workflow.StepResult{ID: "ID1", CommandResults: ack}, false, []string{"b:ctx:ID1", "c::ID1"}},
+		{"error", &workflow.StepResult{ID: "ID1", CommandResults: errored}, false, []string{"b:ctx:ID1"}},
+		{"timeout", &workflow.StepResult{ID: "ID1", CommandResults: ack}, true, []string{"b:ctx:ID1"}},
+		{"outstanding", &workflow.StepResult{ID: "ID2", CommandResults: ack}, false, nil},
+	} {
+		started = nil
+		var err error
+		if test.timeout {
+			err = w.StepTimeout(ctx, test.result)
+		} else {
+			err = w.StepCompleted(ctx, test.result)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(started, test.want) {
+			t.Errorf("%s: have %v, want %v", test.name, started, test.want)
+		}
+	}
+}
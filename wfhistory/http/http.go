@@ -0,0 +1,108 @@
+// Package http provides the HTTP API for workflow instance history.
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/wfhistory"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoID is returned when no enrollment ID is provided.
+	ErrNoID = errors.New("no id provided")
+
+	// ErrNoInstanceID is returned when no instance ID is provided.
+	ErrNoInstanceID = errors.New("no instance id provided")
+)
+
+// GetInstancesHandler returns the workflow instances of the enrollment
+// ID in the URL path, most recently started first. The optional
+// "workflow" and "status" query parameters filter the instances.
+func GetInstancesHandler(r *wfhistory.Recorder, logger log.Logger) http.HandlerFunc {
+	if r == nil {
+		panic("nil recorder")
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := ctxlog.Logger(req.Context(), logger)
+
+		id := flow.Param(req.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+
+		instances, err := r.RetrieveInstances(req.Context(), id)
+		if err != nil {
+			logger.Info("msg", "retrieving instances", "id", id, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		workflow, status := req.URL.Query().Get("workflow"), req.URL.Query().Get("status")
+		filtered := make([]*wfhistory.Instance, 0, len(instances))
+		for _, i := range instances {
+			if (workflow == "" || i.Workflow == workflow) && (status == "" || i.Status == status) {
+				filtered = append(filtered, i)
+			}
+		}
+
+		httpapi.WriteJSON(w, filtered, logger)
+	}
+}
+
+// GetInstanceHandler returns the workflow instance in the URL path of
+// the enrollment ID in the URL path.
+func GetInstanceHandler(r *wfhistory.Recorder, logger log.Logger) http.HandlerFunc {
+	if r == nil {
+		panic("nil recorder")
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := ctxlog.Logger(req.Context(), logger)
+
+		id := flow.Param(req.Context(), "id")
+		if id == "" {
+			httpapi.JSONError(w, ErrNoID, http.StatusBadRequest)
+			return
+		}
+		instanceID := flow.Param(req.Context(), "instance")
+		if instanceID == "" {
+			httpapi.JSONError(w, ErrNoInstanceID, http.StatusBadRequest)
+			return
+		}
+
+		i, err := r.RetrieveInstance(req.Context(), id, instanceID)
+		if errors.Is(err, wfhistory.ErrNotFound) {
+			httpapi.JSONError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Info("msg", "retrieving instance", "id", id, "instance_id", instanceID, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, i, logger)
+	}
+}
+
+// HandleAPIv1 registers the workflow instance history API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, r *wfhistory.Recorder) {
+	mux.Handle(
+		prefix+"/workflowinstances/:id",
+		GetInstancesHandler(r, logger.With("handler", "get-workflow-instances")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/workflowinstances/:id/:instance",
+		GetInstanceHandler(r, logger.With("handler", "get-workflow-instance")),
+		"GET",
+	)
+}
@@ -0,0 +1,208 @@
+package wfhistory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPrefixInstance = "instance."
+	keyPrefixCommand  = "cmd."
+	keyPrefixResponse = "response."
+)
+
+// KVStore stores workflow instances in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new instance store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+func instanceKey(id, instanceID string) string {
+	return keyPrefixInstance + id + "." + instanceID
+}
+
+func commandKey(id, commandUUID string) string {
+	return keyPrefixCommand + id + "." + commandUUID
+}
+
+func responseKey(id, commandUUID string) string {
+	return keyPrefixResponse + id + "." + commandUUID
+}
+
+// StoreInstance stores i.
+// The commands of its enqueued steps are indexed to store their responses.
+func (s *KVStore) StoreInstance(ctx context.Context, i *Instance) error {
+	v, err := json.Marshal(i)
+	if err != nil {
+		return fmt.Errorf("marshal instance: %w", err)
+	}
+	for _, step := range i.Steps {
+		if step.Status != StepEnqueued {
+			continue
+		}
+		for _, c := range step.Commands {
+			if err = s.b.Set(ctx, commandKey(i.ID, c.CommandUUID), []byte(i.InstanceID)); err != nil {
+				return fmt.Errorf("indexing command: %w", err)
+			}
+		}
+	}
+	return s.b.Set(ctx, instanceKey(i.ID, i.InstanceID), v)
+}
+
+// RetrieveInstance retrieves instanceID of enrollment id.
+func (s *KVStore) RetrieveInstance(ctx context.Context, id, instanceID string) (*Instance, error) {
+	v, err := s.b.Get(ctx, instanceKey(id, instanceID))
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	i := new(Instance)
+	if err = json.Unmarshal(v, i); err != nil {
+		return nil, fmt.Errorf("unmarshal instance: %w", err)
+	}
+	return i, nil
+}
+
+// RetrieveInstances retrieves the instances of enrollment id,
+// most recently started first.
+func (s *KVStore) RetrieveInstances(ctx context.Context, id string) ([]*Instance, error) {
+	prefix := keyPrefixInstance + id + "."
+	keys, err := s.b.KeysPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*Instance, 0, len(keys))
+	for _, k := range keys {
+		i, err := s.RetrieveInstance(ctx, id, strings.TrimPrefix(k, prefix))
+		if err != nil {
+			return instances, fmt.Errorf("retrieving instance %s: %w", k, err)
+		}
+		// the prefix of id may also be the prefix of other IDs
+		if i != nil && i.ID == id {
+			instances = append(instances, i)
+		}
+	}
+	sort.SliceStable(instances, func(a, b int) bool {
+		return instances[a].Started.After(instances[b].Started)
+	})
+	return instances, nil
+}
+
+// deleteInstance deletes i and the responses of its commands.
+func (s *KVStore) deleteInstance(ctx context.Context, i *Instance) error {
+	for _, step := range i.Steps {
+		for _, c := range step.Commands {
+			if err := s.b.Delete(ctx, commandKey(i.ID, c.CommandUUID)); err != nil {
+				return err
+			}
+			if err := s.b.Delete(ctx, responseKey(i.ID, c.CommandUUID)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.b.Delete(ctx, instanceKey(i.ID, i.InstanceID))
+}
+
+// DeleteInstances deletes the instances of enrollment id.
+func (s *KVStore) DeleteInstances(ctx context.Context, id string) error {
+	instances, err := s.RetrieveInstances(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if err = s.deleteInstance(ctx, i); err != nil {
+			return fmt.Errorf("deleting instance %s: %w", i.InstanceID, err)
+		}
+	}
+	return nil
+}
+
+// StoreResponse stores the response of commandUUID for enrollment id
+// if the command is indexed.
+func (s *KVStore) StoreResponse(ctx context.Context, id, commandUUID string, r *Response) error {
+	ok, err := s.b.Has(ctx, commandKey(id, commandUUID))
+	if err != nil || !ok {
+		return err
+	}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal response: %w", err)
+	}
+	return s.b.Set(ctx, responseKey(id, commandUUID), v)
+}
+
+// RetrieveResponse retrieves the response of commandUUID for enrollment id.
+func (s *KVStore) RetrieveResponse(ctx context.Context, id, commandUUID string) (*Response, error) {
+	v, err := s.b.Get(ctx, responseKey(id, commandUUID))
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := new(Response)
+	if err = json.Unmarshal(v, r); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+	return r, nil
+}
+
+// Prune deletes the instances that were last updated before before (if
+// not zero) and all but the newest maxCount instances of each enrollment
+// (if not zero). It returns the number of deleted instances.
+func (s *KVStore) Prune(ctx context.Context, before time.Time, maxCount int) (int64, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPrefixInstance)
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[string][]*Instance)
+	var ids []string
+	for _, k := range keys {
+		v, err := s.b.Get(ctx, k)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("retrieving instance %s: %w", k, err)
+		}
+		i := new(Instance)
+		if err = json.Unmarshal(v, i); err != nil {
+			return 0, fmt.Errorf("unmarshal instance %s: %w", k, err)
+		}
+		if _, ok := byID[i.ID]; !ok {
+			ids = append(ids, i.ID)
+		}
+		byID[i.ID] = append(byID[i.ID], i)
+	}
+
+	var count int64
+	for _, id := range ids {
+		instances := byID[id]
+		sort.SliceStable(instances, func(a, b int) bool {
+			return instances[a].Started.After(instances[b].Started)
+		})
+		for n, i := range instances {
+			if (before.IsZero() || !i.Updated.Before(before)) && (maxCount < 1 || n < maxCount) {
+				continue
+			}
+			if err = s.deleteInstance(ctx, i); err != nil {
+				return count, fmt.Errorf("deleting instance %s: %w", i.InstanceID, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
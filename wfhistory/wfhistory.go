@@ -0,0 +1,439 @@
+// Package wfhistory records the history of NanoCMD workflow instances.
+//
+// Workflow step enqueuers are wrapped to record the steps and commands
+// of workflow instances per enrollment. Workflows are wrapped to record
+// completed and timed out steps and when instances finish: a workflow
+// instance has finished for an enrollment when the workflow has no
+// outstanding steps for the enrollment. The recorder is also a NanoMDM
+// service that records the raw responses of the recorded commands.
+package wfhistory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/nanomdm/mdm"
+	"github.com/micromdm/nanomdm/service"
+)
+
+// Instance statuses.
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusTimedOut  = "timed_out"
+)
+
+// Step statuses.
+const (
+	StepEnqueued  = "enqueued"
+	StepCompleted = "completed"
+	StepTimedOut  = "timed_out"
+)
+
+// ErrNotFound is returned when an instance does not exist.
+var ErrNotFound = errors.New("instance not found")
+
+// Command is a command of a step.
+type Command struct {
+	CommandUUID string `json:"command_uuid"`
+	RequestType string `json:"request_type,omitempty"`
+
+	// Status, Received, and Response are set from the latest
+	// command response when instances are retrieved.
+	Status   string     `json:"status,omitempty"`
+	Received *time.Time `json:"received,omitempty"`
+
+	// Response is the raw XML plist command response.
+	Response string `json:"response,omitempty"`
+}
+
+// Step is a step of a workflow instance.
+type Step struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Enqueued time.Time  `json:"enqueued"`
+	NotUntil *time.Time `json:"not_until,omitempty"`
+	Timeout  *time.Time `json:"timeout,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Commands []*Command `json:"commands,omitempty"`
+}
+
+// Instance is a workflow instance for an enrollment.
+type Instance struct {
+	InstanceID string     `json:"instance_id"`
+	Workflow   string     `json:"workflow"`
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Started    time.Time  `json:"started"`
+	Updated    time.Time  `json:"updated"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Steps      []*Step    `json:"steps,omitempty"`
+}
+
+// Response is a recorded command response.
+type Response struct {
+	Status   string    `json:"status"`
+	Received time.Time `json:"received"`
+	Raw      []byte    `json:"raw,omitempty"`
+}
+
+// Store stores workflow instances and the responses of their commands.
+type Store interface {
+	StoreInstance(ctx context.Context, i *Instance) error
+
+	// RetrieveInstance retrieves instanceID of enrollment id.
+	// Nil is returned if the instance does not exist.
+	RetrieveInstance(ctx context.Context, id, instanceID string) (*Instance, error)
+
+	// RetrieveInstances retrieves the instances of enrollment id.
+	RetrieveInstances(ctx context.Context, id string) ([]*Instance, error)
+
+	// DeleteInstances deletes the instances of enrollment id.
+	DeleteInstances(ctx context.Context, id string) error
+
+	// StoreResponse stores the response of commandUUID for enrollment
+	// id if the command belongs to a stored instance of id.
+	StoreResponse(ctx context.Context, id, commandUUID string, r *Response) error
+
+	// RetrieveResponse retrieves the response of commandUUID for
+	// enrollment id. Nil is returned if the response does not exist.
+	RetrieveResponse(ctx context.Context, id, commandUUID string) (*Response, error)
+}
+
+// StatusRetriever retrieves the enrollments with outstanding workflow steps.
+type StatusRetriever interface {
+	RetrieveOutstandingWorkflowStatus(ctx context.Context, workflowName string, ids []string) (outstandingIDs []string, err error)
+}
+
+// Recorder records workflow instances.
+type Recorder struct {
+	service.CheckinAndCommandService
+
+	store  Store
+	status StatusRetriever
+	clock  clock.Clock
+	logger log.Logger
+}
+
+// Option configures the recorder.
+type Option func(*Recorder)
+
+// WithClock configures the clock of the recorder.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Recorder) {
+		r.clock = c
+	}
+}
+
+// WithLogger configures a logger for the recorder.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(r *Recorder) {
+		r.logger = logger
+	}
+}
+
+// New creates a new recorder.
+// Status retrieves the outstanding steps of the workflow engine storage.
+func New(store Store, status StatusRetriever, opts ...Option) *Recorder {
+	if store == nil {
+		panic("nil store")
+	}
+	if status == nil {
+		panic("nil status retriever")
+	}
+	r := &Recorder{
+		CheckinAndCommandService: new(service.NopService),
+		store:                    store,
+		status:                   status,
+		clock:                    clock.Real,
+		logger:                   log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// timePtr returns a pointer to t or nil if t is zero.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// instance retrieves the instance of the step context for id or creates it.
+func (r *Recorder) instance(ctx context.Context, workflowName, instanceID, id string) (*Instance, error) {
+	i, err := r.store.RetrieveInstance(ctx, id, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving instance: %w", err)
+	}
+	if i == nil {
+		now := r.clock.Now()
+		i = &Instance{
+			InstanceID: instanceID,
+			Workflow:   workflowName,
+			ID:         id,
+			Status:     StatusRunning,
+			Started:    now,
+			Updated:    now,
+		}
+	}
+	return i, nil
+}
+
+// recordEnqueued records the enqueued step se of workflow name.
+func (r *Recorder) recordEnqueued(ctx context.Context, name string, se *workflow.StepEnqueueing) error {
+	now := r.clock.Now()
+	var cmds []*Command
+	for _, cmd := range se.Commands {
+		genCmder, ok := cmd.(mdmcommands.GenericCommander)
+		if !ok {
+			continue
+		}
+		if genCmd := genCmder.GenericCommand(); genCmd != nil {
+			cmds = append(cmds, &Command{CommandUUID: genCmd.CommandUUID, RequestType: genCmd.Command.RequestType})
+		}
+	}
+	for _, id := range se.IDs {
+		i, err := r.instance(ctx, name, se.InstanceID, id)
+		if err != nil {
+			return err
+		}
+		i.Status = StatusRunning
+		i.Finished = nil
+		i.Updated = now
+		i.Steps = append(i.Steps, &Step{
+			Name:     se.Name,
+			Status:   StepEnqueued,
+			Enqueued: now,
+			NotUntil: timePtr(se.NotUntil),
+			Timeout:  timePtr(se.Timeout),
+			Commands: cmds,
+		})
+		if err = r.store.StoreInstance(ctx, i); err != nil {
+			return fmt.Errorf("storing instance: %w", err)
+		}
+	}
+	return nil
+}
+
+// acknowledged reports whether all command results were acknowledged.
+func acknowledged(results []interface{}) bool {
+	for _, res := range results {
+		genResper, ok := res.(mdmcommands.GenericResponser)
+		if !ok || genResper.GetGenericResponse().Status != "Acknowledged" {
+			return false
+		}
+	}
+	return true
+}
+
+// recordStep records the completed or timed out step of stepResult.
+func (r *Recorder) recordStep(ctx context.Context, name string, stepResult *workflow.StepResult, status string) error {
+	i, err := r.instance(ctx, name, stepResult.InstanceID, stepResult.ID)
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	i.Updated = now
+	for j := len(i.Steps) - 1; j >= 0; j-- {
+		if s := i.Steps[j]; s.Name == stepResult.Name && s.Status == StepEnqueued {
+			s.Status = status
+			s.Finished = &now
+			break
+		}
+	}
+	return r.store.StoreInstance(ctx, i)
+}
+
+// recordFinished records the instances of workflow name as finished
+// with status for the ids without outstanding steps.
+func (r *Recorder) recordFinished(ctx context.Context, name, instanceID string, ids []string, status string) error {
+	outstanding, err := r.status.RetrieveOutstandingWorkflowStatus(ctx, name, ids)
+	if err != nil {
+		return fmt.Errorf("retrieving workflow status: %w", err)
+	}
+	running := make(map[string]bool)
+	for _, id := range outstanding {
+		running[id] = true
+	}
+	for _, id := range ids {
+		if running[id] {
+			continue
+		}
+		i, err := r.instance(ctx, name, instanceID, id)
+		if err != nil {
+			return err
+		}
+		now := r.clock.Now()
+		i.Status = status
+		i.Updated = now
+		i.Finished = &now
+		if err = r.store.StoreInstance(ctx, i); err != nil {
+			return fmt.Errorf("storing instance: %w", err)
+		}
+	}
+	return nil
+}
+
+// RetrieveInstances retrieves the instances of enrollment id with the
+// latest responses of their commands.
+func (r *Recorder) RetrieveInstances(ctx context.Context, id string) ([]*Instance, error) {
+	instances, err := r.store.RetrieveInstances(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range instances {
+		if err = r.responses(ctx, i); err != nil {
+			return instances, err
+		}
+	}
+	return instances, nil
+}
+
+// RetrieveInstance retrieves instanceID of enrollment id with the
+// latest responses of its commands.
+// ErrNotFound is returned if the instance does not exist.
+func (r *Recorder) RetrieveInstance(ctx context.Context, id, instanceID string) (*Instance, error) {
+	i, err := r.store.RetrieveInstance(ctx, id, instanceID)
+	if err != nil {
+		return nil, err
+	} else if i == nil {
+		return nil, ErrNotFound
+	}
+	return i, r.responses(ctx, i)
+}
+
+// responses sets the latest responses of the commands of i.
+func (r *Recorder) responses(ctx context.Context, i *Instance) error {
+	for _, s := range i.Steps {
+		for _, c := range s.Commands {
+			resp, err := r.store.RetrieveResponse(ctx, i.ID, c.CommandUUID)
+			if err != nil {
+				return fmt.Errorf("retrieving response %s: %w", c.CommandUUID, err)
+			} else if resp == nil {
+				continue
+			}
+			c.Status = resp.Status
+			c.Received = timePtr(resp.Received)
+			c.Response = string(resp.Raw)
+		}
+	}
+	return nil
+}
+
+// CommandAndReportResults records the raw responses of the commands
+// of recorded instances. Storage errors are logged but not returned to
+// the MDM client.
+func (r *Recorder) CommandAndReportResults(req *mdm.Request, results *mdm.CommandResults) (*mdm.Command, error) {
+	if results.Status == "Idle" || results.CommandUUID == "" {
+		return nil, nil
+	}
+	err := r.store.StoreResponse(req.Context(), req.ID, results.CommandUUID, &Response{
+		Status:   results.Status,
+		Received: r.clock.Now(),
+		Raw:      results.Raw,
+	})
+	if err != nil {
+		ctxlog.Logger(req.Context(), r.logger).Info("msg", "storing command response", "command_uuid", results.CommandUUID, "err", err)
+	}
+	return nil, nil
+}
+
+// WrapEnqueuer wraps the step enqueuer of the workflow engine to
+// record enqueued steps.
+func (r *Recorder) WrapEnqueuer(e workflow.StepEnqueuer) workflow.StepEnqueuer {
+	if e == nil {
+		panic("nil enqueuer")
+	}
+	return &stepEnqueuer{StepEnqueuer: e, r: r}
+}
+
+// stepEnqueuer records enqueued steps.
+type stepEnqueuer struct {
+	workflow.StepEnqueuer
+	r *Recorder
+}
+
+// EnqueueStep enqueues se and records it once enqueued.
+func (e *stepEnqueuer) EnqueueStep(ctx context.Context, n workflow.Namer, se *workflow.StepEnqueueing) error {
+	if err := e.StepEnqueuer.EnqueueStep(ctx, n, se); err != nil {
+		return err
+	}
+	if err := e.r.recordEnqueued(ctx, n.Name(), se); err != nil {
+		ctxlog.Logger(ctx, e.r.logger).Info("msg", "recording step", "workflow", n.Name(), "instance_id", se.InstanceID, "err", err)
+	}
+	return nil
+}
+
+// Wrap wraps w to record its steps and finished instances.
+func (r *Recorder) Wrap(w workflow.Workflow) workflow.Workflow {
+	return &historyWorkflow{Workflow: w, r: r}
+}
+
+// historyWorkflow records the steps and finished instances of the
+// wrapped workflow.
+type historyWorkflow struct {
+	workflow.Workflow
+	r *Recorder
+}
+
+// Start starts the wrapped workflow and records the instance as
+// completed for the enrollments without enqueued steps.
+func (w *historyWorkflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	if err := w.Workflow.Start(ctx, step); err != nil {
+		return err
+	}
+	if err := w.r.recordFinished(ctx, w.Name(), step.InstanceID, step.IDs, StatusCompleted); err != nil {
+		ctxlog.Logger(ctx, w.r.logger).Info("msg", "recording instance", "workflow", w.Name(), "instance_id", step.InstanceID, "err", err)
+	}
+	return nil
+}
+
+// stepDone records the step of stepResult with status and then hands it
+// to the wrapped workflow with fn. The instance is then recorded as
+// finished with finishedStatus if no steps are outstanding.
+func (w *historyWorkflow) stepDone(ctx context.Context, stepResult *workflow.StepResult, status, finishedStatus string, fn func(context.Context, *workflow.StepResult) error) error {
+	logger := ctxlog.Logger(ctx, w.r.logger).With("workflow", w.Name(), "instance_id", stepResult.InstanceID, "id", stepResult.ID)
+	if err := w.r.recordStep(ctx, w.Name(), stepResult, status); err != nil {
+		logger.Info("msg", "recording step", "err", err)
+	}
+	err := fn(ctx, stepResult)
+	if err != nil {
+		finishedStatus = StatusFailed
+	}
+	if recErr := w.r.recordFinished(ctx, w.Name(), stepResult.InstanceID, []string{stepResult.ID}, finishedStatus); recErr != nil {
+		logger.Info("msg", "recording instance", "err", recErr)
+	}
+	return err
+}
+
+// StepCompleted records the completed step.
+func (w *historyWorkflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	finished := StatusCompleted
+	if !acknowledged(stepResult.CommandResults) {
+		finished = StatusFailed
+	}
+	return w.stepDone(ctx, stepResult, StepCompleted, finished, w.Workflow.StepCompleted)
+}
+
+// StepTimeout records the timed out step.
+func (w *historyWorkflow) StepTimeout(ctx context.Context, stepResult *workflow.StepResult) error {
+	return w.stepDone(ctx, stepResult, StepTimedOut, StatusTimedOut, w.Workflow.StepTimeout)
+}
@@ -0,0 +1,134 @@
+package wfhistory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanomdm/mdm"
+)
+
+type testEnqueuer struct {
+	outstanding map[string]bool
+}
+
+func (e *testEnqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	for _, id := range se.IDs {
+		e.outstanding[id] = true
+	}
+	return nil
+}
+
+func (e *testEnqueuer) RetrieveOutstandingWorkflowStatus(_ context.Context, _ string, ids []string) ([]string, error) {
+	var r []string
+	for _, id := range ids {
+		if e.outstanding[id] {
+			r = append(r, id)
+		}
+	}
+	return r, nil
+}
+
+type testCommand struct {
+	generic mdmcommands.GenericCommand
+}
+
+func (c *testCommand) GenericCommand() *mdmcommands.GenericCommand {
+	return &c.generic
+}
+
+type testWorkflow struct {
+	workflow.Workflow
+	e workflow.StepEnqueuer
+}
+
+func (w *testWorkflow) Name() string { return "wf" }
+
+func (w *testWorkflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	cmd := new(testCommand)
+	cmd.generic.CommandUUID = "UUID1"
+	cmd.generic.Command.RequestType = "SecurityInfo"
+	return w.e.EnqueueStep(ctx, w, &workflow.StepEnqueueing{
+		StepContext: step.StepContext,
+		IDs:         step.IDs[:1],
+		Commands:    []interface{}{cmd},
+	})
+}
+
+func (w *testWorkflow) StepCompleted(context.Context, *workflow.StepResult) error { return nil }
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	enq := &testEnqueuer{outstanding: make(map[string]bool)}
+	store := NewKVStore(kvmap.New())
+	r := New(store, enq, WithClock(fake))
+	w := r.Wrap(&testWorkflow{e: r.WrapEnqueuer(enq)})
+
+	// ID2 has no steps so its instance completes when started
+	stepCtx := workflow.StepContext{InstanceID: "I1"}
+	if err := w.Start(ctx, &workflow.StepStart{StepContext: stepCtx, IDs: []string{"ID1", "ID2"}}); err != nil {
+		t.Fatal(err)
+	}
+	i, err := r.RetrieveInstance(ctx, "ID2", "I1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Status != StatusCompleted || len(i.Steps) != 0 {
+		t.Errorf("ID2: have status %s with %d steps", i.Status, len(i.Steps))
+	}
+
+	// responses are only recorded for the commands of instances
+	for _, id := range []string{"ID1", "ID3"} {
+		req := &mdm.Request{EnrollID: &mdm.EnrollID{ID: id}}
+		results := &mdm.CommandResults{CommandUUID: "UUID1", Status: "Acknowledged", Raw: []byte("<plist/>")}
+		if _, err = r.CommandAndReportResults(req, results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, err := store.RetrieveResponse(ctx, "ID3", "UUID1"); err != nil || resp != nil {
+		t.Errorf("ID3: have response %v, err %v", resp, err)
+	}
+
+	fake.Advance(time.Minute)
+	enq.outstanding["ID1"] = false
+	ack := []interface{}{&mdmcommands.InstallProfileResponse{GenericResponse: mdmcommands.GenericResponse{Status: "Acknowledged"}}}
+	if err = w.StepCompleted(ctx, &workflow.StepResult{StepContext: stepCtx, ID: "ID1", CommandResults: ack}); err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := r.RetrieveInstances(ctx, "ID1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("ID1: have %d instances, want 1", len(instances))
+	}
+	i = instances[0]
+	if i.Status != StatusCompleted || i.Finished == nil || !i.Finished.Equal(fake.Now()) {
+		t.Errorf("ID1: have status %s finished %v", i.Status, i.Finished)
+	}
+	if len(i.Steps) != 1 || i.Steps[0].Status != StepCompleted || len(i.Steps[0].Commands) != 1 {
+		t.Fatalf("ID1: invalid steps: %v", i.Steps)
+	}
+	if c := i.Steps[0].Commands[0]; c.RequestType != "SecurityInfo" || c.Status != "Acknowledged" || c.Response != "<plist/>" {
+		t.Errorf("ID1: invalid command: %v", c)
+	}
+
+	// finished instances are pruned
+	n, err := store.Prune(ctx, time.Time{}, 0)
+	if err != nil || n != 0 {
+		t.Errorf("prune nothing: have %d, err %v", n, err)
+	}
+	if n, err = store.Prune(ctx, fake.Now().Add(time.Second), 0); err != nil || n != 2 {
+		t.Errorf("prune: have %d, err %v", n, err)
+	}
+	if resp, err := store.RetrieveResponse(ctx, "ID1", "UUID1"); err != nil || resp != nil {
+		t.Errorf("pruned response: have %v, err %v", resp, err)
+	}
+}
@@ -0,0 +1,58 @@
+package wfplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxResponseSize is the maximum size of callout responses.
+const maxResponseSize = 10 << 20
+
+// callout calls the methods of an HTTP service.
+type callout struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// call POSTs method and params to the service and decodes the result
+// of its response into result.
+func (c *callout) call(ctx context.Context, method string, params, result interface{}) error {
+	b, err := json.Marshal(&request{Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("%s: reading response: %w", method, err)
+	}
+	resp := new(response)
+	if err = json.Unmarshal(body, resp); err != nil && httpResp.StatusCode >= 200 && httpResp.StatusCode < 300 {
+		return fmt.Errorf("%s: decoding response: %w", method, err)
+	}
+	if resp.Error == "" && (httpResp.StatusCode < 200 || httpResp.StatusCode >= 300) {
+		return fmt.Errorf("%s: unexpected HTTP status: %s", method, httpResp.Status)
+	}
+	return resp.decode(result)
+}
@@ -0,0 +1,195 @@
+package wfplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/micromdm/nanolib/log"
+)
+
+// ErrExited is returned when the plugin process exits.
+var ErrExited = errors.New("plugin exited")
+
+// request is a request to the plugin.
+type request struct {
+	ID     int         `json:"id,omitempty"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// response is a response of the plugin.
+type response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// decode returns the error of r or decodes its result into result.
+// JSON numbers are decoded as [json.Number].
+func (r *response) decode(result interface{}) error {
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	if result == nil || len(r.Result) < 1 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(r.Result))
+	dec.UseNumber()
+	if err := dec.Decode(result); err != nil {
+		return fmt.Errorf("decoding result: %w", err)
+	}
+	return nil
+}
+
+// conn is a started plugin.
+type conn struct {
+	w         io.WriteCloser
+	responses chan *response
+	stop      func() error
+}
+
+// startFunc starts a plugin connected to w (its input) and r (its output).
+type startFunc func() (w io.WriteCloser, r io.Reader, stop func() error, err error)
+
+// process calls a plugin, (re)starting it as needed.
+// Calls are serialized.
+type process struct {
+	start   startFunc
+	timeout time.Duration
+	logger  log.Logger
+
+	mu     sync.Mutex
+	conn   *conn
+	nextID int
+}
+
+// commandStarter returns a startFunc that runs the executable path.
+// The standard error lines of the process are logged.
+func commandStarter(path string, logger log.Logger) startFunc {
+	return func() (io.WriteCloser, io.Reader, func() error, error) {
+		cmd := exec.Command(path)
+		w, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, nil, nil, err
+		}
+		go func() {
+			s := bufio.NewScanner(stderr)
+			for s.Scan() {
+				logger.Info("msg", "plugin stderr", "line", s.Text())
+			}
+		}()
+		stop := func() error {
+			w.Close()
+			cmd.Process.Kill()
+			return cmd.Wait()
+		}
+		return w, r, stop, nil
+	}
+}
+
+// connect starts the plugin if it isn't running.
+func (p *process) connect() (*conn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	w, r, stop, err := p.start()
+	if err != nil {
+		return nil, fmt.Errorf("starting plugin: %w", err)
+	}
+	c := &conn{w: w, responses: make(chan *response), stop: stop}
+	go func() {
+		defer close(c.responses)
+		dec := json.NewDecoder(r)
+		for {
+			resp := new(response)
+			if err := dec.Decode(resp); err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+					p.logger.Info("msg", "decoding plugin response", "err", err)
+				}
+				return
+			}
+			c.responses <- resp
+		}
+	}()
+	p.conn = c
+	return c, nil
+}
+
+// close stops the running plugin.
+func (p *process) close() {
+	if p.conn == nil {
+		return
+	}
+	if err := p.conn.stop(); err != nil {
+		p.logger.Debug("msg", "stopping plugin", "err", err)
+	}
+	// drain the responses until the reader exits
+	for range p.conn.responses {
+	}
+	p.conn = nil
+}
+
+// call calls method of the plugin with params and decodes its result
+// into result. The plugin is stopped if it doesn't respond in time or
+// exits so that it is restarted by the next call.
+func (p *process) call(ctx context.Context, method string, params, result interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, err := p.connect()
+	if err != nil {
+		return err
+	}
+	p.nextID++
+	req := &request{ID: p.nextID, Method: method, Params: params}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	if _, err = c.w.Write(append(b, '\n')); err != nil {
+		p.close()
+		return fmt.Errorf("writing request: %w", err)
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case resp, ok := <-c.responses:
+			if !ok {
+				p.close()
+				return ErrExited
+			}
+			if resp.ID != req.ID {
+				// a late response to an earlier request
+				continue
+			}
+			return resp.decode(result)
+		case <-timer.C:
+			p.close()
+			return fmt.Errorf("%s: plugin timed out", method)
+		case <-ctx.Done():
+			// any late response is skipped by the next call
+			return ctx.Err()
+		}
+	}
+}
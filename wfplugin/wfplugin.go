@@ -0,0 +1,430 @@
+// Package wfplugin implements NanoCMD workflows with external processes
+// and HTTP services.
+//
+// A plugin is an executable that reads requests from its standard input
+// and writes responses to its standard output, one JSON object per line.
+// Requests have an "id", a "method", and "params". Responses have the
+// "id" of their request and either a "result" or an "error" string.
+// The standard error of the plugin is logged.
+//
+// A callout is an HTTP service that is POSTed the same requests and
+// replies with the same responses.
+//
+// The "config" method is called when the workflow is created. Its result
+// configures the workflow:
+//
+//	{"name": "com.example.wf.hello.v1", "timeout_seconds": 3600, "multiple_simultaneous": false}
+//
+// The "start", "step_completed", and "step_timeout" methods are called
+// when the workflow is started and when its steps complete or time out.
+// Their results are the steps to enqueue:
+//
+//	{"steps": [{"name": "info", "context": "any string", "commands": [{"RequestType": "DeviceInformation", "Queries": ["OSVersion"]}]}]}
+//
+// Commands are the "Command" dictionaries of MDM commands. Their command
+// UUIDs are generated. Steps are enqueued to the IDs of the started
+// workflow or the ID of the completed step unless they specify "ids".
+// Steps may specify "timeout_seconds" and "delay_seconds".
+package wfplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+// DefaultTimeout is the default time a plugin has to respond.
+const DefaultTimeout = 30 * time.Second
+
+var (
+	// ErrNoName is returned when the plugin config has no workflow name.
+	ErrNoName = errors.New("no workflow name")
+
+	// ErrInvalidCommand is returned for commands without a request type
+	// or with a request type whose responses the workflow engine can't decode.
+	ErrInvalidCommand = errors.New("invalid command")
+)
+
+// Config is the result of the "config" method.
+type Config struct {
+	// Name is the name of the workflow.
+	Name string `json:"name"`
+
+	// TimeoutSeconds is the default step timeout of the workflow.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// MultipleSimultaneous allows simultaneous instances of the
+	// workflow for an enrollment.
+	MultipleSimultaneous bool `json:"multiple_simultaneous,omitempty"`
+}
+
+// StartParams are the params of the "start" method.
+type StartParams struct {
+	InstanceID string            `json:"instance_id"`
+	Context    string            `json:"context,omitempty"`
+	IDs        []string          `json:"ids"`
+	Params     map[string]string `json:"params,omitempty"`
+}
+
+// Response is an MDM command response.
+type Response struct {
+	CommandUUID string `json:"command_uuid"`
+	Status      string `json:"status"`
+
+	// Response is the command response as JSON.
+	Response interface{} `json:"response"`
+}
+
+// StepParams are the params of the "step_completed" and "step_timeout"
+// methods. Timed out steps only have the responses received in time.
+type StepParams struct {
+	InstanceID string      `json:"instance_id"`
+	StepName   string      `json:"step_name"`
+	Context    string      `json:"context,omitempty"`
+	ID         string      `json:"id"`
+	Responses  []*Response `json:"responses"`
+}
+
+// Step is a step to enqueue.
+type Step struct {
+	Name           string                   `json:"name,omitempty"`
+	IDs            []string                 `json:"ids,omitempty"`
+	Context        string                   `json:"context,omitempty"`
+	Commands       []map[string]interface{} `json:"commands"`
+	TimeoutSeconds int                      `json:"timeout_seconds,omitempty"`
+	DelaySeconds   int                      `json:"delay_seconds,omitempty"`
+}
+
+// Result is the result of the "start", "step_completed", and
+// "step_timeout" methods.
+type Result struct {
+	Steps []*Step `json:"steps,omitempty"`
+}
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// caller calls methods of a plugin.
+type caller interface {
+	call(ctx context.Context, method string, params, result interface{}) error
+}
+
+// Workflow is a workflow implemented by a plugin.
+type Workflow struct {
+	enq     workflow.StepEnqueuer
+	c       caller
+	config  *Config
+	ider    IDer
+	timeout time.Duration
+	client  *http.Client
+	logger  log.Logger
+	clock   clock.Clock
+}
+
+// Option configures the workflow.
+type Option func(*Workflow)
+
+// WithTimeout configures the time the plugin has to respond.
+func WithTimeout(d time.Duration) Option {
+	return func(w *Workflow) {
+		w.timeout = d
+	}
+}
+
+// WithHTTPClient configures the HTTP client of callout workflows.
+func WithHTTPClient(client *http.Client) Option {
+	if client == nil {
+		panic("nil client")
+	}
+	return func(w *Workflow) {
+		w.client = client
+	}
+}
+
+// WithIDer configures the command UUID generator of plugin commands.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(w *Workflow) {
+		w.ider = ider
+	}
+}
+
+// WithLogger configures a logger for the workflow.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(w *Workflow) {
+		w.logger = logger
+	}
+}
+
+// WithClock configures the clock used for step enqueueing times.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(w *Workflow) {
+		w.clock = c
+	}
+}
+
+// New starts the plugin executable path and creates its workflow.
+func New(enq workflow.StepEnqueuer, path string, opts ...Option) (*Workflow, error) {
+	if path == "" {
+		return nil, errors.New("no plugin path")
+	}
+	w := newWorkflow(enq, opts...)
+	logger := w.logger.With("plugin", path)
+	w.c = &process{start: commandStarter(path, logger), timeout: w.timeout, logger: logger}
+	return w, w.configure()
+}
+
+// NewCallout creates a workflow implemented by the HTTP service at url.
+func NewCallout(enq workflow.StepEnqueuer, url string, opts ...Option) (*Workflow, error) {
+	if url == "" {
+		return nil, errors.New("no callout url")
+	}
+	w := newWorkflow(enq, opts...)
+	w.c = &callout{url: url, client: w.client, timeout: w.timeout}
+	return w, w.configure()
+}
+
+// newWorkflow creates a new workflow without a caller.
+func newWorkflow(enq workflow.StepEnqueuer, opts ...Option) *Workflow {
+	if enq == nil {
+		panic("nil enqueuer")
+	}
+	w := &Workflow{
+		enq:     enq,
+		ider:    uuid.NewUUID(),
+		timeout: DefaultTimeout,
+		client:  http.DefaultClient,
+		logger:  log.NopLogger,
+		clock:   clock.Real,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// configure calls the "config" method of the plugin.
+func (w *Workflow) configure() error {
+	cfg := new(Config)
+	if err := w.c.call(context.Background(), "config", nil, cfg); err != nil {
+		return fmt.Errorf("configuring plugin: %w", err)
+	}
+	if cfg.Name == "" {
+		return ErrNoName
+	}
+	w.config = cfg
+	return nil
+}
+
+// Name returns the workflow name of the plugin.
+func (w *Workflow) Name() string {
+	return w.config.Name
+}
+
+// Config returns the workflow config of the plugin.
+func (w *Workflow) Config() *workflow.Config {
+	cfg := &workflow.Config{Timeout: time.Duration(w.config.TimeoutSeconds) * time.Second}
+	if w.config.MultipleSimultaneous {
+		cfg.Exclusivity = workflow.MultipleSimultaneous
+	}
+	return cfg
+}
+
+// NewContextValue returns a string context.
+func (w *Workflow) NewContextValue(_ string) workflow.ContextMarshaler {
+	return new(workflow.StringContext)
+}
+
+// contextString returns the string of c.
+func contextString(c workflow.ContextMarshaler) string {
+	if c == nil {
+		return ""
+	}
+	b, err := c.MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// command is a command of a plugin step.
+type command struct {
+	generic *mdmcommands.GenericCommand
+	command map[string]interface{}
+}
+
+// GenericCommand returns the generic attributes of c.
+func (c *command) GenericCommand() *mdmcommands.GenericCommand {
+	return c.generic
+}
+
+// MarshalPlist returns the command with its command UUID.
+func (c *command) MarshalPlist() (interface{}, error) {
+	return map[string]interface{}{
+		"CommandUUID": c.generic.CommandUUID,
+		"Command":     c.command,
+	}, nil
+}
+
+// numbers converts the JSON numbers of v to integers or floats.
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = numbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = numbers(e)
+		}
+	}
+	return v
+}
+
+// enqueue enqueues the steps of the plugin result.
+// Steps are enqueued to ids unless they specify their IDs.
+func (w *Workflow) enqueue(ctx context.Context, instanceID string, ids []string, res *Result) error {
+	now := w.clock.Now()
+	for _, s := range res.Steps {
+		c := workflow.StringContext(s.Context)
+		se := &workflow.StepEnqueueing{
+			StepContext: workflow.StepContext{
+				InstanceID: instanceID,
+				Name:       s.Name,
+				Context:    &c,
+			},
+			IDs: ids,
+		}
+		if len(s.IDs) > 0 {
+			se.IDs = s.IDs
+		}
+		for _, cmd := range s.Commands {
+			reqType, _ := cmd["RequestType"].(string)
+			if reqType == "" {
+				return fmt.Errorf("step %s: %w: no request type", s.Name, ErrInvalidCommand)
+			}
+			// the workflow engine only decodes responses of known request types
+			if mdmcommands.NewResponse(reqType) == nil {
+				return fmt.Errorf("step %s: %w: unsupported request type: %s", s.Name, ErrInvalidCommand, reqType)
+			}
+			gc := &mdmcommands.GenericCommand{CommandUUID: w.ider.ID()}
+			gc.Command.RequestType = reqType
+			se.Commands = append(se.Commands, &command{generic: gc, command: numbers(cmd).(map[string]interface{})})
+		}
+		if s.DelaySeconds > 0 {
+			se.NotUntil = now.Add(time.Duration(s.DelaySeconds) * time.Second)
+		}
+		if s.TimeoutSeconds > 0 {
+			start := now
+			if !se.NotUntil.IsZero() {
+				start = se.NotUntil
+			}
+			se.Timeout = start.Add(time.Duration(s.TimeoutSeconds) * time.Second)
+		}
+		if err := w.enq.EnqueueStep(ctx, w, se); err != nil {
+			return fmt.Errorf("enqueueing step %s: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Start calls the "start" method of the plugin and enqueues its steps.
+func (w *Workflow) Start(ctx context.Context, step *workflow.StepStart) error {
+	params := &StartParams{
+		InstanceID: step.InstanceID,
+		Context:    contextString(step.Context),
+		IDs:        step.IDs,
+		Params:     step.MDMContext.Params,
+	}
+	res := new(Result)
+	if err := w.c.call(ctx, "start", params, res); err != nil {
+		return fmt.Errorf("plugin start: %w", err)
+	}
+	return w.enqueue(ctx, step.InstanceID, step.IDs, res)
+}
+
+// stepDone calls method of the plugin for stepResult and enqueues its steps.
+func (w *Workflow) stepDone(ctx context.Context, method string, stepResult *workflow.StepResult) error {
+	params := &StepParams{
+		InstanceID: stepResult.InstanceID,
+		StepName:   stepResult.Name,
+		Context:    contextString(stepResult.Context),
+		ID:         stepResult.ID,
+		Responses:  []*Response{},
+	}
+	for _, r := range stepResult.CommandResults {
+		resp := &Response{Response: r}
+		if genResper, ok := r.(mdmcommands.GenericResponser); ok {
+			genResp := genResper.GetGenericResponse()
+			resp.CommandUUID = genResp.CommandUUID
+			resp.Status = genResp.Status
+		}
+		params.Responses = append(params.Responses, resp)
+	}
+	res := new(Result)
+	if err := w.c.call(ctx, method, params, res); err != nil {
+		return fmt.Errorf("plugin %s: %w", method, err)
+	}
+	for _, s := range res.Steps {
+		// only steps of started workflows may be enqueued to multiple IDs
+		if len(s.IDs) > 0 && (len(s.IDs) != 1 || s.IDs[0] != stepResult.ID) {
+			return fmt.Errorf("plugin %s: step %s: IDs other than %s", method, s.Name, stepResult.ID)
+		}
+	}
+	return w.enqueue(ctx, stepResult.InstanceID, []string{stepResult.ID}, res)
+}
+
+// StepCompleted calls the "step_completed" method of the plugin and
+// enqueues its steps.
+func (w *Workflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	return w.stepDone(ctx, "step_completed", stepResult)
+}
+
+// StepTimeout calls the "step_timeout" method of the plugin and
+// enqueues its steps.
+func (w *Workflow) StepTimeout(ctx context.Context, stepResult *workflow.StepResult) error {
+	return w.stepDone(ctx, "step_timeout", stepResult)
+}
+
+// Event is not supported by plugins.
+func (w *Workflow) Event(ctx context.Context, _ *workflow.Event, id string, _ *workflow.MDMContext) error {
+	ctxlog.Logger(ctx, w.logger).Debug("msg", "plugin event ignored", "workflow", w.Name(), "id", id)
+	return nil
+}
+
+// Close stops the plugin process, if any.
+func (w *Workflow) Close() {
+	if p, ok := w.c.(*process); ok {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.close()
+	}
+}
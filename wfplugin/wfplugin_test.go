@@ -0,0 +1,185 @@
+package wfplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/plist"
+)
+
+type testEnqueuer struct {
+	steps []*workflow.StepEnqueueing
+}
+
+func (e *testEnqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+// testPlugin returns a startFunc of a plugin that answers requests with
+// the results of handle.
+func testPlugin(handle func(method string, params json.RawMessage) (interface{}, error)) startFunc {
+	return func() (io.WriteCloser, io.Reader, func() error, error) {
+		reqR, reqW := io.Pipe()
+		respR, respW := io.Pipe()
+		go func() {
+			defer respW.Close()
+			s := bufio.NewScanner(reqR)
+			enc := json.NewEncoder(respW)
+			for s.Scan() {
+				req := new(struct {
+					ID     int             `json:"id"`
+					Method string          `json:"method"`
+					Params json.RawMessage `json:"params"`
+				})
+				if err := json.Unmarshal(s.Bytes(), req); err != nil {
+					return
+				}
+				resp := &response{ID: req.ID}
+				result, err := handle(req.Method, req.Params)
+				if err != nil {
+					resp.Error = err.Error()
+				} else {
+					resp.Result, _ = json.Marshal(result)
+				}
+				if enc.Encode(resp) != nil {
+					return
+				}
+			}
+		}()
+		stop := func() error {
+			reqW.Close()
+			return respR.Close()
+		}
+		return reqW, respR, stop, nil
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	ctx := context.Background()
+	var stepParams *StepParams
+	handle := func(method string, params json.RawMessage) (interface{}, error) {
+		switch method {
+		case "config":
+			return &Config{Name: "com.example.wf.test.v1", TimeoutSeconds: 60}, nil
+		case "start":
+			cmd := map[string]interface{}{"RequestType": "DeviceInformation", "Queries": []string{"OSVersion"}}
+			return &Result{Steps: []*Step{{Name: "info", Context: "ctx1", Commands: []map[string]interface{}{cmd}}}}, nil
+		case "step_completed":
+			stepParams = new(StepParams)
+			return &Result{}, json.Unmarshal(params, stepParams)
+		}
+		return nil, errors.New("unknown method")
+	}
+
+	enq := new(testEnqueuer)
+	w := newWorkflow(enq)
+	w.c = &process{start: testPlugin(handle), timeout: DefaultTimeout, logger: log.NopLogger}
+	defer w.Close()
+	if err := w.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := w.Name(), "com.example.wf.test.v1"; have != want {
+		t.Errorf("name: have %q, want %q", have, want)
+	}
+
+	ids := []string{"ID1", "ID2"}
+	if err := w.Start(ctx, &workflow.StepStart{StepContext: workflow.StepContext{InstanceID: "I1"}, IDs: ids}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enq.steps) != 1 {
+		t.Fatalf("have %d steps, want 1", len(enq.steps))
+	}
+	se := enq.steps[0]
+	if se.Name != "info" || se.InstanceID != "I1" || len(se.IDs) != 2 || contextString(se.Context) != "ctx1" {
+		t.Errorf("invalid step: %v", se)
+	}
+	if len(se.Commands) != 1 {
+		t.Fatalf("have %d commands, want 1", len(se.Commands))
+	}
+	cmd, ok := se.Commands[0].(mdmcommands.GenericCommander)
+	if !ok || cmd.GenericCommand().CommandUUID == "" || cmd.GenericCommand().Command.RequestType != "DeviceInformation" {
+		t.Errorf("invalid command: %v", se.Commands[0])
+	}
+	if _, err := plist.Marshal(se.Commands[0]); err != nil {
+		t.Errorf("marshal command: %v", err)
+	}
+
+	resp := &mdmcommands.DeviceInformationResponse{GenericResponse: mdmcommands.GenericResponse{CommandUUID: "UUID1", Status: "Acknowledged"}}
+	result := &workflow.StepResult{StepContext: se.StepContext, ID: "ID1", CommandResults: []interface{}{resp}}
+	if err := w.StepCompleted(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	if stepParams == nil || stepParams.StepName != "info" || stepParams.ID != "ID1" || stepParams.Context != "ctx1" {
+		t.Fatalf("invalid step params: %v", stepParams)
+	}
+	if len(stepParams.Responses) != 1 || stepParams.Responses[0].CommandUUID != "UUID1" || stepParams.Responses[0].Status != "Acknowledged" {
+		t.Errorf("invalid responses: %v", stepParams.Responses)
+	}
+
+	// plugin errors are returned
+	if err := w.StepTimeout(ctx, result); err == nil {
+		t.Error("expected error")
+	}
+
+	// commands with responses the engine can't decode are rejected
+	unknown := &Result{Steps: []*Step{{Name: "unknown", Commands: []map[string]interface{}{{"RequestType": "Unknown"}}}}}
+	if err := w.enqueue(ctx, "I1", ids, unknown); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("have error %v, want %v", err, ErrInvalidCommand)
+	}
+}
+
+func TestCallout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(request)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "config":
+			w.Write([]byte(`{"result": {"name": "com.example.wf.callout.v1", "multiple_simultaneous": true}}`))
+		case "start":
+			w.Write([]byte(`{"result": {"steps": [{"name": "lock", "delay_seconds": 60, "commands": [{"RequestType": "DeviceLock", "PIN": 123456}]}]}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "unknown method"}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	enq := new(testEnqueuer)
+	w, err := NewCallout(enq, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Name() != "com.example.wf.callout.v1" || w.Config().Exclusivity != workflow.MultipleSimultaneous {
+		t.Errorf("invalid config: %v", w.config)
+	}
+
+	if err = w.Start(ctx, &workflow.StepStart{StepContext: workflow.StepContext{InstanceID: "I1"}, IDs: []string{"ID1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enq.steps) != 1 || enq.steps[0].NotUntil.IsZero() || len(enq.steps[0].Commands) != 1 {
+		t.Fatalf("invalid steps: %v", enq.steps)
+	}
+	if pin := enq.steps[0].Commands[0].(*command).command["PIN"]; pin != int64(123456) {
+		t.Errorf("PIN: have %#v, want int64", pin)
+	}
+
+	err = w.StepCompleted(ctx, &workflow.StepResult{StepContext: enq.steps[0].StepContext, ID: "ID1"})
+	if err == nil || !strings.Contains(err.Error(), "unknown method") {
+		t.Errorf("have error %v, want unknown method", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package http provides the HTTP API for workflow policies.
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micromdm/nanohub/internal/httpapi"
+	"github.com/micromdm/nanohub/wfpolicy"
+
+	"github.com/alexedwards/flow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+)
+
+var (
+	// ErrNoName is returned when no workflow name is provided.
+	ErrNoName = errors.New("no workflow name provided")
+
+	// ErrNotFound is returned when a policy does not exist.
+	ErrNotFound = errors.New("policy not found")
+)
+
+// GetPoliciesHandler returns all policies.
+func GetPoliciesHandler(store wfpolicy.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		policies, err := store.RetrievePolicies(r.Context())
+		if err != nil {
+			logger.Info("msg", "retrieving policies", "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		httpapi.WriteJSON(w, policies, logger)
+	}
+}
+
+// GetPolicyHandler returns the policy of the workflow named in the URL path.
+func GetPolicyHandler(store wfpolicy.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		policy, err := store.RetrievePolicy(r.Context(), name)
+		if err != nil {
+			logger.Info("msg", "retrieving policy", "workflow", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+		if policy == nil {
+			httpapi.JSONError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		httpapi.WriteJSON(w, policy, logger)
+	}
+}
+
+// PutPolicyHandler stores the JSON policy in the request body for the
+// workflow named in the URL path.
+func PutPolicyHandler(store wfpolicy.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		policy := new(wfpolicy.Policy)
+		if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+			httpapi.JSONError(w, fmt.Errorf("decoding policy: %w", err), http.StatusBadRequest)
+			return
+		}
+		policy.Workflow = name
+		if err := policy.Validate(); err != nil {
+			httpapi.JSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.StorePolicy(r.Context(), policy); err != nil {
+			logger.Info("msg", "storing policy", "workflow", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "stored policy", "workflow", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeletePolicyHandler deletes the policy of the workflow named in the URL path.
+func DeletePolicyHandler(store wfpolicy.Store, logger log.Logger) http.HandlerFunc {
+	if store == nil {
+		panic("nil store")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := ctxlog.Logger(r.Context(), logger)
+
+		name := flow.Param(r.Context(), "name")
+		if name == "" {
+			httpapi.JSONError(w, ErrNoName, http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DeletePolicy(r.Context(), name); err != nil {
+			logger.Info("msg", "deleting policy", "workflow", name, "err", err)
+			httpapi.JSONError(w, err, 0)
+			return
+		}
+
+		logger.Debug("msg", "deleted policy", "workflow", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleAPIv1 registers the workflow policy API handlers into mux.
+func HandleAPIv1(prefix string, mux httpapi.Mux, logger log.Logger, store wfpolicy.Store) {
+	mux.Handle(
+		prefix+"/workflowpolicies",
+		GetPoliciesHandler(store, logger.With("handler", "get-workflow-policies")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/workflowpolicies/:name",
+		GetPolicyHandler(store, logger.With("handler", "get-workflow-policy")),
+		"GET",
+	)
+
+	mux.Handle(
+		prefix+"/workflowpolicies/:name",
+		PutPolicyHandler(store, logger.With("handler", "put-workflow-policy")),
+		"PUT",
+	)
+
+	mux.Handle(
+		prefix+"/workflowpolicies/:name",
+		DeletePolicyHandler(store, logger.With("handler", "delete-workflow-policy")),
+		"DELETE",
+	)
+}
@@ -0,0 +1,113 @@
+package wfpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/micromdm/nanohub/kv"
+)
+
+const (
+	keyPrefixPolicy = "policy."
+	keyPrefixStep   = "step."
+)
+
+// KVStore stores policies and steps in a key-value bucket.
+type KVStore struct {
+	b kv.Bucket
+}
+
+// NewKVStore creates a new policy store using b.
+func NewKVStore(b kv.Bucket) *KVStore {
+	if b == nil {
+		panic("nil bucket")
+	}
+	return &KVStore{b: b}
+}
+
+// StorePolicy stores p.
+func (s *KVStore) StorePolicy(ctx context.Context, p *Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	v, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal policy: %w", err)
+	}
+	return s.b.Set(ctx, keyPrefixPolicy+p.Workflow, v)
+}
+
+// RetrievePolicy retrieves the policy of workflow name.
+func (s *KVStore) RetrievePolicy(ctx context.Context, name string) (*Policy, error) {
+	v, err := s.b.Get(ctx, keyPrefixPolicy+name)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	if err = json.Unmarshal(v, p); err != nil {
+		return nil, fmt.Errorf("unmarshal policy: %w", err)
+	}
+	return p, nil
+}
+
+// RetrievePolicies retrieves all policies.
+func (s *KVStore) RetrievePolicies(ctx context.Context) ([]*Policy, error) {
+	keys, err := s.b.KeysPrefix(ctx, keyPrefixPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]*Policy, 0, len(keys))
+	for _, k := range keys {
+		p, err := s.RetrievePolicy(ctx, strings.TrimPrefix(k, keyPrefixPolicy))
+		if err != nil {
+			return policies, fmt.Errorf("retrieving policy %s: %w", k, err)
+		}
+		if p != nil {
+			policies = append(policies, p)
+		}
+	}
+	return policies, nil
+}
+
+// DeletePolicy deletes the policy of workflow name.
+func (s *KVStore) DeletePolicy(ctx context.Context, name string) error {
+	return s.b.Delete(ctx, keyPrefixPolicy+name)
+}
+
+func stepKey(instanceID, id string) string {
+	return keyPrefixStep + instanceID + "." + id
+}
+
+// StoreStep stores the step of instanceID for id.
+func (s *KVStore) StoreStep(ctx context.Context, instanceID, id string, step *Step) error {
+	v, err := json.Marshal(step)
+	if err != nil {
+		return fmt.Errorf("marshal step: %w", err)
+	}
+	return s.b.Set(ctx, stepKey(instanceID, id), v)
+}
+
+// RetrieveStep retrieves the step of instanceID for id.
+func (s *KVStore) RetrieveStep(ctx context.Context, instanceID, id string) (*Step, error) {
+	v, err := s.b.Get(ctx, stepKey(instanceID, id))
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	step := new(Step)
+	if err = json.Unmarshal(v, step); err != nil {
+		return nil, fmt.Errorf("unmarshal step: %w", err)
+	}
+	return step, nil
+}
+
+// DeleteStep deletes the step of instanceID for id.
+func (s *KVStore) DeleteStep(ctx context.Context, instanceID, id string) error {
+	return s.b.Delete(ctx, stepKey(instanceID, id))
+}
@@ -0,0 +1,372 @@
+// Package wfpolicy applies per-workflow step timeout and retry policies.
+//
+// Workflow step enqueuers are wrapped to apply the step timeout of the
+// workflow policy and to record the commands of the steps of workflows
+// that retry. Workflows are wrapped to re-enqueue the commands of timed
+// out steps after a backoff until the workflow policy's retries are
+// exhausted. Only then is the step timeout handed to the workflow.
+package wfpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/utils/uuid"
+	"github.com/micromdm/nanocmd/workflow"
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	"github.com/micromdm/plist"
+)
+
+// MaxRetries is the largest number of step retries of a policy.
+const MaxRetries = 10
+
+// ErrInvalid is returned for invalid policies.
+var ErrInvalid = errors.New("invalid policy")
+
+// Policy is the step timeout and retry policy of a workflow.
+type Policy struct {
+	// Workflow is the name of the workflow.
+	Workflow string `json:"workflow"`
+
+	// TimeoutSeconds is the step timeout of the workflow.
+	// Steps that specify their own timeout keep it.
+	// The engine default is used if zero.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// MaxRetries is how many times the commands of a timed out step
+	// are enqueued again before the workflow is told of the timeout.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// BackoffSeconds delays the first retry of a step.
+	// Each further retry doubles the delay.
+	BackoffSeconds int `json:"backoff_seconds,omitempty"`
+}
+
+// Validate checks p for errors.
+func (p *Policy) Validate() error {
+	switch {
+	case p == nil || p.Workflow == "":
+		return fmt.Errorf("%w: no workflow", ErrInvalid)
+	case p.TimeoutSeconds < 0 || p.BackoffSeconds < 0:
+		return fmt.Errorf("%w: negative duration", ErrInvalid)
+	case p.MaxRetries < 0 || p.MaxRetries > MaxRetries:
+		return fmt.Errorf("%w: max retries must be between 0 and %d", ErrInvalid, MaxRetries)
+	}
+	return nil
+}
+
+// timeout returns the step timeout of p.
+func (p *Policy) timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// backoff returns the delay of retry number n (from zero) of a step.
+func (p *Policy) backoff(n int) time.Duration {
+	return time.Duration(p.BackoffSeconds) * time.Second << uint(n)
+}
+
+// Step is the recorded step of a workflow instance for an enrollment.
+type Step struct {
+	// Name is the name of the step.
+	Name string `json:"name"`
+
+	// Commands are the raw plist commands of the step.
+	Commands [][]byte `json:"commands"`
+
+	// Retries is the number of times the step was retried.
+	Retries int `json:"retries,omitempty"`
+}
+
+// Store stores policies and the steps of workflow instances.
+type Store interface {
+	StorePolicy(ctx context.Context, p *Policy) error
+
+	// RetrievePolicy retrieves the policy of workflow name.
+	// Nil is returned if the policy does not exist.
+	RetrievePolicy(ctx context.Context, name string) (*Policy, error)
+
+	RetrievePolicies(ctx context.Context) ([]*Policy, error)
+	DeletePolicy(ctx context.Context, name string) error
+
+	StoreStep(ctx context.Context, instanceID, id string, s *Step) error
+
+	// RetrieveStep retrieves the step of instanceID for id.
+	// Nil is returned if the step does not exist.
+	RetrieveStep(ctx context.Context, instanceID, id string) (*Step, error)
+
+	DeleteStep(ctx context.Context, instanceID, id string) error
+}
+
+// IDer generates command UUIDs.
+type IDer interface {
+	ID() string
+}
+
+// Retrier applies workflow policies to steps.
+type Retrier struct {
+	store    Store
+	policies map[string]*Policy
+	enq      workflow.StepEnqueuer
+	ider     IDer
+	clock    clock.Clock
+	logger   log.Logger
+}
+
+// Option configures the retrier.
+type Option func(*Retrier)
+
+// WithPolicy configures the default policy p of its workflow.
+// Stored policies take precedence.
+func WithPolicy(p *Policy) Option {
+	if err := p.Validate(); err != nil {
+		panic(err)
+	}
+	return func(r *Retrier) {
+		r.policies[p.Workflow] = p
+	}
+}
+
+// WithIDer configures the command UUID generator of retried commands.
+func WithIDer(ider IDer) Option {
+	if ider == nil {
+		panic("nil ider")
+	}
+	return func(r *Retrier) {
+		r.ider = ider
+	}
+}
+
+// WithClock configures the clock of the retrier.
+func WithClock(c clock.Clock) Option {
+	if c == nil {
+		panic("nil clock")
+	}
+	return func(r *Retrier) {
+		r.clock = c
+	}
+}
+
+// WithLogger configures a logger for the retrier.
+func WithLogger(logger log.Logger) Option {
+	if logger == nil {
+		panic("nil logger")
+	}
+	return func(r *Retrier) {
+		r.logger = logger
+	}
+}
+
+// New creates a new retrier.
+func New(store Store, opts ...Option) *Retrier {
+	if store == nil {
+		panic("nil store")
+	}
+	r := &Retrier{
+		store:    store,
+		policies: make(map[string]*Policy),
+		ider:     uuid.NewUUID(),
+		clock:    clock.Real,
+		logger:   log.NopLogger,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Policy returns the policy of workflow name.
+// Nil is returned if the workflow has no policy.
+func (r *Retrier) Policy(ctx context.Context, name string) (*Policy, error) {
+	p, err := r.store.RetrievePolicy(ctx, name)
+	if err != nil {
+		return nil, err
+	} else if p != nil {
+		return p, nil
+	}
+	return r.policies[name], nil
+}
+
+// WrapEnqueuer wraps the step enqueuer of the workflow engine.
+// Timed out steps are retried with e so workflows wrapped with Wrap
+// only retry steps once WrapEnqueuer has been called.
+func (r *Retrier) WrapEnqueuer(e workflow.StepEnqueuer) workflow.StepEnqueuer {
+	if e == nil {
+		panic("nil enqueuer")
+	}
+	r.enq = e
+	return &stepEnqueuer{StepEnqueuer: e, r: r}
+}
+
+// stepEnqueuer applies workflow policies to enqueued steps.
+type stepEnqueuer struct {
+	workflow.StepEnqueuer
+	r *Retrier
+}
+
+// EnqueueStep applies the step timeout of the workflow policy to se and
+// records its commands for retries before enqueueing it.
+func (e *stepEnqueuer) EnqueueStep(ctx context.Context, n workflow.Namer, se *workflow.StepEnqueueing) error {
+	p, err := e.r.Policy(ctx, n.Name())
+	if err != nil {
+		return fmt.Errorf("retrieving workflow policy: %w", err)
+	}
+	if p == nil {
+		return e.StepEnqueuer.EnqueueStep(ctx, n, se)
+	}
+	if se.Timeout.IsZero() && p.TimeoutSeconds > 0 {
+		copied := *se
+		copied.Timeout = e.r.stepTimeout(p, se.NotUntil)
+		se = &copied
+	}
+	if p.MaxRetries > 0 {
+		step := &Step{Name: se.Name}
+		for _, cmd := range se.Commands {
+			raw, err := plist.Marshal(cmd)
+			if err != nil {
+				return fmt.Errorf("marshal command: %w", err)
+			}
+			step.Commands = append(step.Commands, raw)
+		}
+		for _, id := range se.IDs {
+			if err = e.r.store.StoreStep(ctx, se.InstanceID, id, step); err != nil {
+				return fmt.Errorf("storing step: %w", err)
+			}
+		}
+	}
+	return e.StepEnqueuer.EnqueueStep(ctx, n, se)
+}
+
+// stepTimeout returns the timeout of a step of policy p that is
+// enqueued at notUntil (or now).
+func (r *Retrier) stepTimeout(p *Policy, notUntil time.Time) time.Time {
+	start := r.clock.Now()
+	if notUntil.After(start) {
+		start = notUntil
+	}
+	return start.Add(p.timeout())
+}
+
+// rawCommand is a recorded command to enqueue again.
+type rawCommand struct {
+	generic *mdmcommands.GenericCommand
+	command map[string]interface{}
+}
+
+// GenericCommand returns the generic attributes of c.
+func (c *rawCommand) GenericCommand() *mdmcommands.GenericCommand {
+	return c.generic
+}
+
+// MarshalPlist returns the command dictionary of c.
+func (c *rawCommand) MarshalPlist() (interface{}, error) {
+	return c.command, nil
+}
+
+// newRawCommand unmarshals the raw plist command with a new command UUID.
+func (r *Retrier) newRawCommand(raw []byte) (*rawCommand, error) {
+	c := &rawCommand{generic: new(mdmcommands.GenericCommand)}
+	if err := plist.Unmarshal(raw, &c.command); err != nil {
+		return nil, err
+	}
+	if cmd, ok := c.command["Command"].(map[string]interface{}); ok {
+		c.generic.Command.RequestType, _ = cmd["RequestType"].(string)
+	}
+	c.generic.CommandUUID = r.ider.ID()
+	c.command["CommandUUID"] = c.generic.CommandUUID
+	return c, nil
+}
+
+// retry enqueues the commands of the timed out step again if the policy
+// of the workflow allows. It reports whether the step was retried.
+func (r *Retrier) retry(ctx context.Context, n workflow.Namer, stepResult *workflow.StepResult) (bool, error) {
+	if r.enq == nil {
+		return false, nil
+	}
+	step, err := r.store.RetrieveStep(ctx, stepResult.InstanceID, stepResult.ID)
+	if err != nil {
+		return false, fmt.Errorf("retrieving step: %w", err)
+	} else if step == nil || step.Name != stepResult.Name {
+		return false, nil
+	}
+	p, err := r.Policy(ctx, n.Name())
+	if err != nil {
+		return false, fmt.Errorf("retrieving workflow policy: %w", err)
+	}
+	if p == nil || step.Retries >= p.MaxRetries {
+		return false, r.store.DeleteStep(ctx, stepResult.InstanceID, stepResult.ID)
+	}
+
+	se := &workflow.StepEnqueueing{
+		StepContext: stepResult.StepContext,
+		IDs:         []string{stepResult.ID},
+	}
+	for _, raw := range step.Commands {
+		cmd, err := r.newRawCommand(raw)
+		if err != nil {
+			return false, fmt.Errorf("unmarshal command: %w", err)
+		}
+		se.Commands = append(se.Commands, cmd)
+	}
+	if backoff := p.backoff(step.Retries); backoff > 0 {
+		se.NotUntil = r.clock.Now().Add(backoff)
+	}
+	if p.TimeoutSeconds > 0 {
+		se.Timeout = r.stepTimeout(p, se.NotUntil)
+	}
+
+	step.Retries++
+	if err = r.store.StoreStep(ctx, stepResult.InstanceID, stepResult.ID, step); err != nil {
+		return false, fmt.Errorf("storing step: %w", err)
+	}
+	if err = r.enq.EnqueueStep(ctx, n, se); err != nil {
+		return false, fmt.Errorf("enqueueing step: %w", err)
+	}
+	ctxlog.Logger(ctx, r.logger).Debug(
+		"msg", "retried step",
+		"workflow", n.Name(),
+		"instance_id", stepResult.InstanceID,
+		"step", stepResult.Name,
+		"id", stepResult.ID,
+		"retries", step.Retries,
+	)
+	return true, nil
+}
+
+// Wrap wraps w to retry its timed out steps.
+func (r *Retrier) Wrap(w workflow.Workflow) workflow.Workflow {
+	return &retryWorkflow{Workflow: w, r: r}
+}
+
+// retryWorkflow retries the timed out steps of the wrapped workflow.
+type retryWorkflow struct {
+	workflow.Workflow
+	r *Retrier
+}
+
+// StepCompleted forgets the recorded step and hands the step result
+// to the wrapped workflow.
+func (w *retryWorkflow) StepCompleted(ctx context.Context, stepResult *workflow.StepResult) error {
+	if err := w.r.store.DeleteStep(ctx, stepResult.InstanceID, stepResult.ID); err != nil {
+		ctxlog.Logger(ctx, w.r.logger).Info("msg", "deleting step", "workflow", w.Name(), "id", stepResult.ID, "err", err)
+	}
+	return w.Workflow.StepCompleted(ctx, stepResult)
+}
+
+// StepTimeout retries the step or hands the step result to the wrapped
+// workflow once the retries are exhausted.
+func (w *retryWorkflow) StepTimeout(ctx context.Context, stepResult *workflow.StepResult) error {
+	retried, err := w.r.retry(ctx, w, stepResult)
+	if err != nil {
+		ctxlog.Logger(ctx, w.r.logger).Info("msg", "retrying step", "workflow", w.Name(), "id", stepResult.ID, "err", err)
+	}
+	if retried {
+		return nil
+	}
+	return w.Workflow.StepTimeout(ctx, stepResult)
+}
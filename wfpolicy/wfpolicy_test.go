@@ -0,0 +1,107 @@
+package wfpolicy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/nanohub/clock"
+	"github.com/micromdm/nanohub/kv/kvmap"
+
+	"github.com/jessepeterson/mdmcommands"
+	"github.com/micromdm/nanocmd/workflow"
+)
+
+type testEnqueuer struct {
+	steps []*workflow.StepEnqueueing
+}
+
+func (e *testEnqueuer) EnqueueStep(_ context.Context, _ workflow.Namer, se *workflow.StepEnqueueing) error {
+	e.steps = append(e.steps, se)
+	return nil
+}
+
+type testWorkflow struct {
+	workflow.Workflow
+	timeouts int
+}
+
+func (w *testWorkflow) Name() string { return "wf" }
+
+func (w *testWorkflow) StepTimeout(context.Context, *workflow.StepResult) error {
+	w.timeouts++
+	return nil
+}
+
+type ider string
+
+func (i ider) ID() string { return string(i) }
+
+func TestRetrier(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewKVStore(kvmap.New())
+	r := New(
+		store,
+		WithPolicy(&Policy{Workflow: "wf", TimeoutSeconds: 60, MaxRetries: 2, BackoffSeconds: 10}),
+		WithClock(clock.NewFake(now)),
+		WithIDer(ider("RETRY")),
+	)
+	if err := store.StorePolicy(ctx, &Policy{Workflow: "wf", MaxRetries: MaxRetries + 1}); err == nil {
+		t.Error("expected error for too many retries")
+	}
+
+	enq := &testEnqueuer{}
+	inner := &testWorkflow{}
+	w := r.Wrap(inner)
+	stepEnq := r.WrapEnqueuer(enq)
+
+	cmd := mdmcommands.NewEraseDeviceCommand("UUID1")
+	pin := "123456"
+	cmd.Command.PIN = &pin
+
+	stepCtx := workflow.StepContext{InstanceID: "I1", Name: "erase"}
+	err := stepEnq.EnqueueStep(ctx, w, &workflow.StepEnqueueing{
+		StepContext: stepCtx,
+		IDs:         []string{"ID1"},
+		Commands:    []interface{}{cmd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := enq.steps[0].Timeout, now.Add(time.Minute); !have.Equal(want) {
+		t.Errorf("timeout: have %v, want %v", have, want)
+	}
+
+	// the step is retried twice with a doubling backoff
+	for i, backoff := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		if err = w.StepTimeout(ctx, &workflow.StepResult{StepContext: stepCtx, ID: "ID1"}); err != nil {
+			t.Fatal(err)
+		}
+		if inner.timeouts != 0 || len(enq.steps) != i+2 {
+			t.Fatalf("retry %d: timeouts %d, steps %d", i, inner.timeouts, len(enq.steps))
+		}
+		se := enq.steps[i+1]
+		if have, want := se.NotUntil, now.Add(backoff); !have.Equal(want) {
+			t.Errorf("retry %d: not until: have %v, want %v", i, have, want)
+		}
+		cmd, ok := se.Commands[0].(mdmcommands.GenericCommander)
+		if !ok {
+			t.Fatalf("retry %d: invalid command type %T", i, se.Commands[0])
+		}
+		if gc := cmd.GenericCommand(); gc.CommandUUID != "RETRY" || gc.Command.RequestType != "EraseDevice" {
+			t.Errorf("retry %d: command: %v %v", i, gc.CommandUUID, gc.Command.RequestType)
+		}
+	}
+
+	// retries are exhausted
+	if err = w.StepTimeout(ctx, &workflow.StepResult{StepContext: stepCtx, ID: "ID1"}); err != nil {
+		t.Fatal(err)
+	}
+	if inner.timeouts != 1 || len(enq.steps) != 3 {
+		t.Errorf("exhausted: timeouts %d, steps %d", inner.timeouts, len(enq.steps))
+	}
+	if step, err := store.RetrieveStep(ctx, "I1", "ID1"); err != nil || step != nil {
+		t.Errorf("exhausted: step %v, err %v", step, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package xfcc extracts MDM client identity certificates from the
+// x-forwarded-client-cert (XFCC) header of Envoy and Istio.
+//
+// The header contains an element per proxy hop that forwarded the
+// client certificate. Elements are separated by commas and contain
+// semicolon-separated key=value pairs. Values may be double-quoted.
+// The Cert key contains the URL-encoded PEM client certificate.
+package xfcc
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/nanolib/log"
+	"github.com/micromdm/nanolib/log/ctxlog"
+	nanohttpmdm "github.com/micromdm/nanomdm/http/mdm"
+)
+
+// Header is the default XFCC header name.
+const Header = "X-Forwarded-Client-Cert"
+
+// certHeader is the internal header the extracted certificate is
+// passed in to the NanoMDM PEM header extraction.
+const certHeader = "X-Nanohub-Xfcc-Cert"
+
+// ErrInvalid is returned for malformed XFCC header values.
+var ErrInvalid = errors.New("invalid XFCC header")
+
+// Element is the forwarded client certificate information of one hop.
+// Keys are e.g. By, Hash, Cert, Chain, Subject, URI, and DNS.
+// Only the last value of repeated keys is kept.
+type Element map[string]string
+
+// split splits s on sep outside of double-quoted strings.
+func split(s string, sep byte) ([]string, error) {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, ErrInvalid
+	}
+	return append(parts, s[start:]), nil
+}
+
+// unquote removes double quotes and backslash escapes from v.
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// Parse parses the elements of the XFCC header value v.
+func Parse(v string) ([]Element, error) {
+	elements, err := split(v, ',')
+	if err != nil {
+		return nil, err
+	}
+	var parsed []Element
+	for _, element := range elements {
+		pairs, err := split(element, ';')
+		if err != nil {
+			return nil, err
+		}
+		e := make(Element)
+		for _, pair := range pairs {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				return nil, ErrInvalid
+			}
+			e[key] = unquote(value)
+		}
+		parsed = append(parsed, e)
+	}
+	return parsed, nil
+}
+
+// Cert returns the URL-encoded PEM certificate of the first element of
+// the XFCC header value v. The first element is the client of the
+// outermost proxy; later elements are appended by proxies in between.
+// An empty string is returned if the element has no certificate.
+func Cert(v string) (string, error) {
+	elements, err := Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if len(elements) < 1 {
+		return "", nil
+	}
+	return elements[0]["Cert"], nil
+}
+
+// CertExtractMiddleware extracts the MDM client identity certificate
+// from the XFCC header into the HTTP request context like
+// [nanohttpmdm.CertExtractPEMHeaderMiddleware]. The outermost proxy must
+// sanitize XFCC headers sent by clients.
+func CertExtractMiddleware(next http.Handler, header string, logger log.Logger) http.HandlerFunc {
+	extract := nanohttpmdm.CertExtractPEMHeaderMiddleware(next, certHeader, logger)
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		// never trust the internal header from clients
+		r.Header.Del(certHeader)
+
+		if v := r.Header.Get(header); v != "" {
+			cert, err := Cert(v)
+			if err != nil {
+				ctxlog.Logger(r.Context(), logger).Info(
+					"msg", "parsing XFCC header",
+					"header", header,
+					"err", err,
+				)
+			} else if cert != "" {
+				r.Header.Set(certHeader, cert)
+			}
+		}
+
+		extract(w, r)
+	}
+}
@@ -0,0 +1,33 @@
+package xfcc
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	v := `By=spiffe://cluster.local/ns/mdm/sa/nanohub;Hash=abc;Cert="-----BEGIN%20CERTIFICATE-----%0AMIIB%0A-----END%20CERTIFICATE-----%0A";Subject="CN=device,O=Example \"Inc\"";URI=,By=spiffe://cluster.local/ns/mdm/sa/sidecar;Hash=def`
+
+	elements, err := Parse(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(elements), 2; have != want {
+		t.Fatalf("elements: have %d, want %d", have, want)
+	}
+	if have, want := elements[0]["Subject"], `CN=device,O=Example "Inc"`; have != want {
+		t.Errorf("subject: have %q, want %q", have, want)
+	}
+	if have, want := elements[1]["Hash"], "def"; have != want {
+		t.Errorf("hash: have %q, want %q", have, want)
+	}
+
+	cert, err := Cert(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := cert, "-----BEGIN%20CERTIFICATE-----%0AMIIB%0A-----END%20CERTIFICATE-----%0A"; have != want {
+		t.Errorf("cert: have %q, want %q", have, want)
+	}
+
+	if _, err = Parse(`Cert="unterminated`); err != ErrInvalid {
+		t.Errorf("have: %v, want: %v", err, ErrInvalid)
+	}
+}